@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/ddworken/hishtory/shared"
+	"github.com/rodaine/table"
+	"gorm.io/gorm"
+)
+
+const adminUsage = `Usage: server admin COMMAND
+
+Commands:
+  users                 List the registered users with their number of devices, entries, and when they were last active
+  purge-user USER_ID    Delete all data for the user with the given ID (the hash of their secret that clients send as user_id)
+  gc-orphans [-dry-run] Delete entries and requests that are queued for devices that are no longer registered
+  storage [-top N]      Print storage statistics, including the N users that use the most storage
+`
+
+// runAdminCommand runs one of the `server admin` commands, which are for operators of self-hosted servers
+func runAdminCommand(ctx context.Context, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing admin command\n\n%s", adminUsage)
+	}
+	switch args[0] {
+	case "users":
+		return adminListUsers(ctx, w)
+	case "purge-user":
+		if len(args) != 2 {
+			return fmt.Errorf("purge-user takes exactly one user ID\n\n%s", adminUsage)
+		}
+		return adminPurgeUser(ctx, w, args[1])
+	case "gc-orphans":
+		flags := flag.NewFlagSet("gc-orphans", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "Only print how much would be deleted")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return adminGcOrphans(ctx, w, *dryRun)
+	case "storage":
+		flags := flag.NewFlagSet("storage", flag.ContinueOnError)
+		top := flags.Int("top", 10, "The number of users with the most storage to list")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return adminStorageStats(ctx, w, *top)
+	default:
+		return fmt.Errorf("unknown admin command %#v\n\n%s", args[0], adminUsage)
+	}
+}
+
+func adminListUsers(ctx context.Context, w io.Writer) error {
+	rows, err := GLOBAL_DB.WithContext(ctx).Raw(`
+	SELECT
+		devices.user_id,
+		COUNT(*) AS num_devices,
+		MIN(devices.registration_date) AS registration_date,
+		(SELECT COUNT(*) FROM enc_history_entries WHERE enc_history_entries.user_id = devices.user_id) AS num_entries,
+		(SELECT MAX(last_used) FROM usage_data WHERE usage_data.user_id = devices.user_id) AS last_active
+	FROM devices
+	GROUP BY devices.user_id
+	ORDER BY registration_date
+	`).Rows()
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+	tbl := table.New("User ID", "Num Devices", "Num Entries", "Registration Date", "Last Active")
+	tbl.WithWriter(w)
+	for rows.Next() {
+		var userId string
+		var numDevices, numEntries int64
+		var registrationDate, lastActive aggregateTime
+		if err := rows.Scan(&userId, &numDevices, &registrationDate, &numEntries, &lastActive); err != nil {
+			return fmt.Errorf("failed to scan users: %w", err)
+		}
+		lastActiveStr := "Never"
+		if lastActive.Valid {
+			lastActiveStr = lastActive.Time.Format("2006-01-02")
+		}
+		tbl.AddRow(userId, numDevices, numEntries, registrationDate.Time.Format("2006-01-02"), lastActiveStr)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+	tbl.Print()
+	return nil
+}
+
+// adminPurgeUser deletes everything that the server stores for the given user (see purgeUser)
+func adminPurgeUser(ctx context.Context, w io.Writer, userId string) error {
+	deletion, err := purgeUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Purged user %s: deleted %d devices and %d history entries\n", userId, deletion.NumDevices, deletion.NumEntries)
+	return nil
+}
+
+// adminGcOrphans deletes the data that is queued for devices that are no longer registered. These are never
+// read, so they would otherwise be kept forever.
+func adminGcOrphans(ctx context.Context, w io.Writer, dryRun bool) error {
+	orphans := []struct {
+		name   string
+		model  interface{}
+		column string
+	}{
+		{"history entries", &shared.EncHistoryEntry{}, "device_id"},
+		{"deletion requests", &shared.DeletionRequest{}, "destination_device_id"},
+		{"metadata updates", &shared.EncMetadataUpdate{}, "destination_device_id"},
+		{"dump requests", &shared.DumpRequest{}, "requesting_device_id"},
+		{"usage records", &UsageData{}, "device_id"},
+	}
+	for _, orphan := range orphans {
+		query := func() *gorm.DB {
+			return GLOBAL_DB.WithContext(ctx).Model(orphan.model).
+				Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_id = %s.user_id AND devices.device_id = %s.%s)", tableName(orphan.model), tableName(orphan.model), orphan.column))
+		}
+		var count int64
+		if dryRun {
+			if err := query().Count(&count).Error; err != nil {
+				return fmt.Errorf("failed to count orphaned %s: %w", orphan.name, err)
+			}
+			fmt.Fprintf(w, "Would delete %d orphaned %s\n", count, orphan.name)
+			continue
+		}
+		if _, ok := orphan.model.(*shared.EncHistoryEntry); ok {
+			var err error
+			count, err = deleteHistoryEntries(ctx, query())
+			if err != nil {
+				return fmt.Errorf("failed to delete orphaned %s: %w", orphan.name, err)
+			}
+		} else {
+			result := query().Delete(orphan.model)
+			if result.Error != nil {
+				return fmt.Errorf("failed to delete orphaned %s: %w", orphan.name, result.Error)
+			}
+			count = result.RowsAffected
+		}
+		fmt.Fprintf(w, "Deleted %d orphaned %s\n", count, orphan.name)
+	}
+	return nil
+}
+
+func tableName(model interface{}) string {
+	stmt := &gorm.Statement{DB: GLOBAL_DB}
+	if err := stmt.Parse(model); err != nil {
+		panic(fmt.Errorf("failed to parse the model %T: %w", model, err))
+	}
+	return stmt.Schema.Table
+}
+
+// adminStorageStats prints the number of rows in each table, how much space the history entries take up, and the
+// users with the most storage
+func adminStorageStats(ctx context.Context, w io.Writer, top int) error {
+	var numUsers int64
+	if err := GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Distinct("user_id").Count(&numUsers).Error; err != nil {
+		return fmt.Errorf("failed to count users: %w", err)
+	}
+	fmt.Fprintf(w, "Users: %d\n", numUsers)
+	for _, model := range []interface{}{&shared.Device{}, &shared.EncHistoryEntry{}, &shared.DeletionRequest{}, &shared.EncMetadataUpdate{}, &shared.DumpRequest{}} {
+		var count int64
+		if err := GLOBAL_DB.WithContext(ctx).Model(model).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to count %s: %w", tableName(model), err)
+		}
+		fmt.Fprintf(w, "Rows in %s: %d\n", tableName(model), count)
+	}
+	var dbBytes, blobBytes int64
+	row := GLOBAL_DB.WithContext(ctx).Raw("SELECT COALESCE(SUM(LENGTH(encrypted_data) + LENGTH(nonce)), 0), COALESCE(SUM(blob_size), 0) FROM enc_history_entries").Row()
+	if err := row.Scan(&dbBytes, &blobBytes); err != nil {
+		return fmt.Errorf("failed to query the size of history entries: %w", err)
+	}
+	fmt.Fprintf(w, "History entries stored in the DB: %s\n", byteCountToString(int(dbBytes)))
+	if GLOBAL_BLOB_STORE != nil || blobBytes > 0 {
+		// Blobs are shared by the copies of an entry for each device, so this overcounts the space used
+		fmt.Fprintf(w, "History entries stored in object storage (counting each device's copy): %s\n", byteCountToString(int(blobBytes)))
+	}
+
+	rows, err := GLOBAL_DB.WithContext(ctx).Raw(`
+	SELECT user_id, COUNT(*), SUM(LENGTH(encrypted_data) + LENGTH(nonce) + COALESCE(blob_size, 0)) AS num_bytes
+	FROM enc_history_entries
+	GROUP BY user_id
+	ORDER BY num_bytes DESC
+	LIMIT ?
+	`, top).Rows()
+	if err != nil {
+		return fmt.Errorf("failed to query storage per user: %w", err)
+	}
+	defer rows.Close()
+	fmt.Fprintln(w)
+	tbl := table.New("User ID", "Num Entries", "Size")
+	tbl.WithWriter(w)
+	for rows.Next() {
+		var userId string
+		var numEntries, numBytes int64
+		if err := rows.Scan(&userId, &numEntries, &numBytes); err != nil {
+			return fmt.Errorf("failed to scan storage per user: %w", err)
+		}
+		tbl.AddRow(userId, numEntries, byteCountToString(int(numBytes)))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query storage per user: %w", err)
+	}
+	tbl.Print()
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// GLOBAL_BLOB_STORE is only set if HISHTORY_S3_BUCKET is configured, in which case the encrypted data for newly
+// submitted entries is stored in object storage and the DB only stores the metadata needed to route and clean up
+// entries. Entries that are stored inline in the DB are still served, so the two can be mixed while migrating.
+var GLOBAL_BLOB_STORE blobStore
+
+// The number of blobs that are read or written concurrently when handling a single request
+const blobStoreConcurrency = 16
+
+// The maximum number of keys that can be deleted by a single S3 DeleteObjects request
+const maxBlobDeleteBatchSize = 1000
+
+type blobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, keys []string) error
+}
+
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// newS3BlobStore returns a blob store for the configured S3 bucket, or nil if one isn't configured. Credentials
+// are loaded from the standard AWS environment variables and config files. HISHTORY_S3_ENDPOINT can be set to use
+// other S3-compatible object storage (e.g. MinIO or R2).
+func newS3BlobStore(ctx context.Context) (*s3BlobStore, error) {
+	bucket := os.Getenv("HISHTORY_S3_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the AWS config: %w", err)
+	}
+	if region := os.Getenv("HISHTORY_S3_REGION"); region != "" {
+		cfg.Region = region
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := os.Getenv("HISHTORY_S3_ENDPOINT"); endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			// Most S3-compatible services don't support virtual-hosted-style bucket addressing
+			o.UsePathStyle = true
+		}
+	})
+	return &s3BlobStore{client: client, bucket: bucket, prefix: os.Getenv("HISHTORY_S3_PREFIX")}, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", key, err)
+	}
+	return data, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, keys []string) error {
+	for _, chunk := range shared.Chunks(keys, maxBlobDeleteBatchSize) {
+		objects := make([]s3types.ObjectIdentifier, 0, len(chunk))
+		for _, key := range chunk {
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(s.prefix + key)})
+		}
+		resp, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %d blobs: %w", len(chunk), err)
+		}
+		if len(resp.Errors) > 0 {
+			return fmt.Errorf("failed to delete %d blobs, e.g. %s: %s", len(resp.Errors), aws.ToString(resp.Errors[0].Key), aws.ToString(resp.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+// encodeBlob serializes the encrypted fields of an entry as the nonce length, the nonce, and then the encrypted data
+func encodeBlob(entry *shared.EncHistoryEntry) []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(entry.Nonce)+len(entry.EncryptedData))
+	buf = buf[:binary.PutUvarint(buf, uint64(len(entry.Nonce)))]
+	buf = append(buf, entry.Nonce...)
+	return append(buf, entry.EncryptedData...)
+}
+
+func decodeBlob(blob []byte, entry *shared.EncHistoryEntry) error {
+	nonceLen, n := binary.Uvarint(blob)
+	if n <= 0 || uint64(len(blob)-n) < nonceLen {
+		return errors.New("blob is truncated")
+	}
+	entry.Nonce = blob[n : n+int(nonceLen)]
+	entry.EncryptedData = blob[n+int(nonceLen):]
+	return nil
+}
+
+// forEachConcurrently calls f for each index in [0, n) using up to blobStoreConcurrency goroutines, and returns
+// the first error
+func forEachConcurrently(n int, f func(i int) error) error {
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, blobStoreConcurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := f(i); err != nil {
+				errLock.Lock()
+				defer errLock.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// offloadEntries moves the encrypted data of the given entries into the blob store (if one is configured), so
+// that only their metadata is written to the DB. This must be called before the entries are copied for each
+// device, so that all of the copies share a single blob.
+func offloadEntries(ctx context.Context, entries []*shared.EncHistoryEntry) error {
+	if GLOBAL_BLOB_STORE == nil {
+		return nil
+	}
+	return forEachConcurrently(len(entries), func(i int) error {
+		entry := entries[i]
+		blob := encodeBlob(entry)
+		key := entry.UserId + "/" + uuid.Must(uuid.NewRandom()).String()
+		if err := GLOBAL_BLOB_STORE.Put(ctx, key, blob); err != nil {
+			return err
+		}
+		entry.BlobKey = key
+		entry.BlobSize = len(blob)
+		entry.EncryptedData = []byte{}
+		entry.Nonce = []byte{}
+		return nil
+	})
+}
+
+// hydrateEntries fills in the encrypted data of entries that were stored in the blob store. Each blob is only read
+// once, even if it is shared by multiple of the entries (e.g. when bootstrapping).
+func hydrateEntries(ctx context.Context, entries []*shared.EncHistoryEntry) error {
+	entriesByBlobKey := make(map[string][]*shared.EncHistoryEntry)
+	blobKeys := make([]string, 0)
+	for _, entry := range entries {
+		if entry.BlobKey == "" {
+			continue
+		}
+		if _, ok := entriesByBlobKey[entry.BlobKey]; !ok {
+			blobKeys = append(blobKeys, entry.BlobKey)
+		}
+		entriesByBlobKey[entry.BlobKey] = append(entriesByBlobKey[entry.BlobKey], entry)
+	}
+	if len(blobKeys) > 0 && GLOBAL_BLOB_STORE == nil {
+		return fmt.Errorf("%d entries are stored in object storage but no blob store is configured, set HISHTORY_S3_BUCKET", len(entries))
+	}
+	return forEachConcurrently(len(blobKeys), func(i int) error {
+		blob, err := GLOBAL_BLOB_STORE.Get(ctx, blobKeys[i])
+		if err != nil {
+			return err
+		}
+		for _, entry := range entriesByBlobKey[blobKeys[i]] {
+			if err := decodeBlob(blob, entry); err != nil {
+				return fmt.Errorf("failed to decode blob %s: %w", blobKeys[i], err)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteHistoryEntries deletes the entries matched by query, along with any blobs that are no longer referenced
+// by an entry. Blobs are only ever shared by the per-device copies of an entry that are created together, so once
+// a blob is unreferenced it will never be referenced again.
+func deleteHistoryEntries(ctx context.Context, query *gorm.DB) (int64, error) {
+	query = query.Session(&gorm.Session{})
+	var blobKeys []string
+	if GLOBAL_BLOB_STORE != nil {
+		if err := query.Model(&shared.EncHistoryEntry{}).Distinct("blob_key").Pluck("blob_key", &blobKeys).Error; err != nil {
+			return 0, fmt.Errorf("failed to list the blobs for deleted entries: %w", err)
+		}
+	}
+	result := query.Delete(&shared.EncHistoryEntry{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if err := deleteUnreferencedBlobs(ctx, blobKeys); err != nil {
+		// The entries are already deleted, so this only leaks the blobs
+		fmt.Printf("Failed to delete blobs for deleted entries: %v\n", err)
+	}
+	return result.RowsAffected, nil
+}
+
+func deleteUnreferencedBlobs(ctx context.Context, blobKeys []string) error {
+	for _, chunk := range shared.Chunks(blobKeys, maxBlobDeleteBatchSize) {
+		var referencedKeys []string
+		if err := GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).Distinct("blob_key").Where("blob_key IN ?", chunk).Pluck("blob_key", &referencedKeys).Error; err != nil {
+			return fmt.Errorf("failed to check which blobs are referenced: %w", err)
+		}
+		referenced := make(map[string]bool)
+		for _, key := range referencedKeys {
+			referenced[key] = true
+		}
+		unreferencedKeys := make([]string, 0)
+		for _, key := range chunk {
+			if key != "" && !referenced[key] {
+				unreferencedKeys = append(unreferencedKeys, key)
+			}
+		}
+		if len(unreferencedKeys) == 0 {
+			continue
+		}
+		if err := GLOBAL_BLOB_STORE.Delete(ctx, unreferencedKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureBlobKeyIndex indexes enc_history_entries.blob_key, which is needed to efficiently clean up blobs. This is
+// only created once a blob store is configured, to avoid building an unused index on large existing DBs.
+func ensureBlobKeyIndex(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&shared.EncHistoryEntry{}, "blob_key_idx") {
+		return nil
+	}
+	return db.Exec("CREATE INDEX blob_key_idx ON enc_history_entries (blob_key)").Error
+}
+
+// The directions that migrateBlobs can move entries in
+const (
+	migrateToObjectStorage = "to-object-storage"
+	migrateToDb            = "to-db"
+)
+
+// The number of entries that migrateBlobs moves per batch
+const blobMigrationBatchSize = 1000
+
+// migrateBlobs moves the encrypted data of all existing entries between the DB and the blob store. This is safe to
+// run while the server is running, since entries stored either way are served.
+func migrateBlobs(ctx context.Context, direction string) (int, error) {
+	if GLOBAL_BLOB_STORE == nil {
+		return 0, fmt.Errorf("no blob store is configured, set HISHTORY_S3_BUCKET")
+	}
+	var migrateBatch func(ctx context.Context) (numMigrated int, done bool, err error)
+	switch direction {
+	case migrateToObjectStorage:
+		migrateBatch = migrateBatchToObjectStorage
+	case migrateToDb:
+		migrateBatch = migrateBatchToDb
+	default:
+		return 0, fmt.Errorf("unknown migration direction %#v, expected %#v or %#v", direction, migrateToObjectStorage, migrateToDb)
+	}
+	numMigrated := 0
+	for {
+		n, done, err := migrateBatch(ctx)
+		numMigrated += n
+		if err != nil || done {
+			return numMigrated, err
+		}
+		fmt.Printf("Migrated %d entries %s\n", numMigrated, direction)
+	}
+}
+
+func migrateBatchToObjectStorage(ctx context.Context) (int, bool, error) {
+	var entries []*shared.EncHistoryEntry
+	if err := GLOBAL_DB.WithContext(ctx).Where("blob_key = '' OR blob_key IS NULL").Limit(blobMigrationBatchSize).Find(&entries).Error; err != nil {
+		return 0, false, fmt.Errorf("failed to list entries stored in the DB: %w", err)
+	}
+	if len(entries) == 0 {
+		return 0, true, nil
+	}
+	originalNonces := make([][]byte, len(entries))
+	for i, entry := range entries {
+		originalNonces[i] = entry.Nonce
+	}
+	if err := offloadEntries(ctx, entries); err != nil {
+		return 0, false, err
+	}
+	numMigrated := 0
+	for i, entry := range entries {
+		// Entries don't have a primary key, so they're matched on their contents
+		r := GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).
+			Where("user_id = ? AND device_id = ? AND encrypted_id = ? AND date = ? AND nonce = ? AND (blob_key = '' OR blob_key IS NULL)", entry.UserId, entry.DeviceId, entry.EncryptedId, entry.Date, originalNonces[i]).
+			Updates(map[string]interface{}{"blob_key": entry.BlobKey, "blob_size": entry.BlobSize, "encrypted_data": []byte{}, "nonce": []byte{}})
+		if r.Error != nil {
+			return numMigrated, false, fmt.Errorf("failed to update migrated entry: %w", r.Error)
+		}
+		if r.RowsAffected == 0 {
+			// The entry was deleted while it was being migrated
+			if err := deleteUnreferencedBlobs(ctx, []string{entry.BlobKey}); err != nil {
+				return numMigrated, false, err
+			}
+		}
+		numMigrated += int(r.RowsAffected)
+	}
+	if numMigrated == 0 {
+		// Since the same entries would be retried forever
+		return 0, false, fmt.Errorf("failed to migrate any of a batch of %d entries", len(entries))
+	}
+	return numMigrated, false, nil
+}
+
+func migrateBatchToDb(ctx context.Context) (int, bool, error) {
+	var blobKeys []string
+	if err := GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).Distinct("blob_key").Where("blob_key != ''").Limit(blobMigrationBatchSize).Pluck("blob_key", &blobKeys).Error; err != nil {
+		return 0, false, fmt.Errorf("failed to list entries stored in object storage: %w", err)
+	}
+	if len(blobKeys) == 0 {
+		return 0, true, nil
+	}
+	numMigrated := 0
+	for _, key := range blobKeys {
+		blob, err := GLOBAL_BLOB_STORE.Get(ctx, key)
+		if err != nil {
+			return numMigrated, false, err
+		}
+		var entry shared.EncHistoryEntry
+		if err := decodeBlob(blob, &entry); err != nil {
+			return numMigrated, false, fmt.Errorf("failed to decode blob %s: %w", key, err)
+		}
+		r := GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).Where("blob_key = ?", key).
+			Updates(map[string]interface{}{"blob_key": "", "blob_size": 0, "encrypted_data": entry.EncryptedData, "nonce": entry.Nonce})
+		if r.Error != nil {
+			return numMigrated, false, fmt.Errorf("failed to update migrated entry: %w", r.Error)
+		}
+		if err := GLOBAL_BLOB_STORE.Delete(ctx, []string{key}); err != nil {
+			return numMigrated, false, err
+		}
+		numMigrated += int(r.RowsAffected)
+	}
+	return numMigrated, false, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ddworken/hishtory/shared"
+)
+
+// The largest that a compressed request body can be once decompressed, so that a small compressed request can't
+// exhaust the server's memory
+const maxDecompressedBodySize = 256 * 1024 * 1024
+
+// Responses smaller than this aren't compressed since compressing them saves little
+const minCompressedResponseSize = 1024
+
+// serveWithCompression serves a request, decompressing its body if the client compressed it with zstd (which clients
+// only do once the server has advertised protocol version 2) and compressing the response if the client accepts zstd
+func serveWithCompression(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(shared.ProtocolVersionHeader, strconv.Itoa(shared.ProtocolVersion))
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		if encoding != "zstd" {
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding %#v", encoding), http.StatusUnsupportedMediaType)
+			return
+		}
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read the request body", http.StatusBadRequest)
+			return
+		}
+		body, err := shared.DecompressZstd(compressed, maxDecompressedBodySize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decompress the request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Content-Encoding")
+	}
+	if !acceptsZstd(r) {
+		h.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressingResponseWriter{ResponseWriter: w}
+	h.ServeHTTP(cw, r)
+	cw.finish()
+}
+
+// acceptsZstd returns whether the request's Accept-Encoding header includes zstd
+func acceptsZstd(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) != "zstd" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+		return err != nil || q > 0
+	}
+	return false
+}
+
+// compressingResponseWriter buffers the response so that it can be compressed once the handler is done. The API's
+// responses are built in memory anyway, so this doesn't use much more memory.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *compressingResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *compressingResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *compressingResponseWriter) finish() {
+	body := w.body.Bytes()
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(body) >= minCompressedResponseSize && w.Header().Get("Content-Encoding") == "" {
+		body = shared.CompressZstd(body)
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Header().Del("Content-Length")
+	}
+	if w.statusCode != 0 {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	}
+	if _, err := w.ResponseWriter.Write(body); err != nil {
+		fmt.Printf("failed to write the response: %v\n", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// The SQL dialects that the server can run against, as returned by gorm's Dialector.Name(). Postgres is used in
+// production, and most queries are written in SQL that all of them support. The few that can't be are built by the
+// helpers below.
+const (
+	dialectPostgres = "postgres"
+	dialectMysql    = "mysql"
+	dialectSqlite   = "sqlite"
+)
+
+// newMysqlDialector returns the dialector for a go-sql-driver DSN (e.g. `user:pass@tcp(mysql:3306)/hishtory`)
+func newMysqlDialector(dsn string) (gorm.Dialector, error) {
+	config, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the MySQL DSN: %w", err)
+	}
+	// Required to scan DATETIME columns into a time.Time
+	config.ParseTime = true
+	// Entries are deleted by matching on their timestamp, so they have to be stored with the same (microsecond)
+	// precision that they're sent with rather than gorm's default of milliseconds
+	datetimePrecision := 6
+	return mysql.New(mysql.Config{
+		DSN: config.FormatDSN(),
+		// MySQL can't index TEXT columns, which gorm otherwise uses for strings (e.g. in usageDataUniqueIndex)
+		DefaultStringSize:        191,
+		DefaultDatetimePrecision: &datetimePrecision,
+	}), nil
+}
+
+// stringAggDistinct returns an aggregate expression that joins the distinct non-NULL values of column with ", "
+func stringAggDistinct(db *gorm.DB, column string) string {
+	switch db.Dialector.Name() {
+	case dialectMysql:
+		return fmt.Sprintf("GROUP_CONCAT(DISTINCT %s SEPARATOR ', ')", column)
+	case dialectSqlite:
+		// sqlite doesn't support a custom separator for DISTINCT aggregates
+		return fmt.Sprintf("REPLACE(GROUP_CONCAT(DISTINCT %s), ',', ', ')", column)
+	default:
+		return fmt.Sprintf("STRING_AGG(DISTINCT %s, ', ')", column)
+	}
+}
+
+// The formats that sqlite stores times in
+var sqliteTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// aggregateTime scans a time computed by an aggregate (e.g. MAX(last_used)). sqlite returns these as strings
+// since, unlike a column, the result of an aggregate doesn't have a declared type.
+type aggregateTime struct {
+	sql.NullTime
+}
+
+func (t *aggregateTime) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return t.NullTime.Scan(value)
+	}
+	for _, format := range sqliteTimeFormats {
+		if parsed, err := time.Parse(format, s); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to parse %#v as a time", s)
+}
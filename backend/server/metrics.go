@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddworken/hishtory/shared"
+)
+
+// GLOBAL_METRICS is only set if HISHTORY_METRICS_ADDR is configured, in which case the metrics are served in the
+// Prometheus text format at /metrics on that address
+var GLOBAL_METRICS *serverMetrics
+
+// The upper bounds of the buckets for the request latency histogram, in seconds
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The metrics that require counting rows in the DB are cached for this long so that frequent scrapes don't add
+// load to a large DB
+const dbMetricsCacheDuration = time.Minute
+
+// The windows over which devices are counted as active, based on when they last synced
+var activeDeviceWindows = []struct {
+	label    string
+	duration time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+type latencyHistogram struct {
+	// The number of requests in each of requestDurationBuckets (not cumulative)
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+type dbCounts struct {
+	entriesStored     int64
+	devicesRegistered int64
+	activeDevices     []int64
+	retrievedAt       time.Time
+}
+
+type serverMetrics struct {
+	lock           sync.Mutex
+	requestCounts  map[requestKey]uint64
+	requestLatency map[string]*latencyHistogram
+
+	dbCountsLock   sync.Mutex
+	cachedDbCounts *dbCounts
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requestCounts:  make(map[requestKey]uint64),
+		requestLatency: make(map[string]*latencyHistogram),
+	}
+}
+
+func (m *serverMetrics) recordRequest(handler string, code int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requestCounts[requestKey{handler, code}]++
+	h, ok := m.requestLatency[handler]
+	if !ok {
+		h = &latencyHistogram{bucketCounts: make([]uint64, len(requestDurationBuckets))}
+		m.requestLatency[handler] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			h.bucketCounts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *serverMetrics) getDbCounts(ctx context.Context) (*dbCounts, error) {
+	m.dbCountsLock.Lock()
+	defer m.dbCountsLock.Unlock()
+	now := time.Now()
+	if m.cachedDbCounts != nil && now.Sub(m.cachedDbCounts.retrievedAt) < dbMetricsCacheDuration {
+		return m.cachedDbCounts, nil
+	}
+	counts := &dbCounts{retrievedAt: now}
+	db := GLOBAL_DB.WithContext(ctx)
+	if err := db.Model(&shared.EncHistoryEntry{}).Count(&counts.entriesStored).Error; err != nil {
+		return nil, fmt.Errorf("failed to count entries: %w", err)
+	}
+	if err := db.Model(&shared.Device{}).Count(&counts.devicesRegistered).Error; err != nil {
+		return nil, fmt.Errorf("failed to count devices: %w", err)
+	}
+	for _, window := range activeDeviceWindows {
+		var count int64
+		if err := db.Model(&UsageData{}).Where("last_used >= ?", now.Add(-window.duration)).Count(&count).Error; err != nil {
+			return nil, fmt.Errorf("failed to count active devices: %w", err)
+		}
+		counts.activeDevices = append(counts.activeDevices, count)
+	}
+	m.cachedDbCounts = counts
+	return counts, nil
+}
+
+// write writes all of the metrics in the Prometheus text exposition format
+func (m *serverMetrics) write(ctx context.Context, w io.Writer) error {
+	m.writeRequestMetrics(w)
+
+	sqlDb, err := GLOBAL_DB.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get the DB: %w", err)
+	}
+	stats := sqlDb.Stats()
+	writeMetric(w, "hishtory_db_max_open_connections", "gauge", "The maximum number of open connections to the DB.", float64(stats.MaxOpenConnections))
+	writeMetric(w, "hishtory_db_open_connections", "gauge", "The number of established connections to the DB, both in use and idle.", float64(stats.OpenConnections))
+	writeMetric(w, "hishtory_db_in_use_connections", "gauge", "The number of connections to the DB that are currently in use.", float64(stats.InUse))
+	writeMetric(w, "hishtory_db_idle_connections", "gauge", "The number of idle connections to the DB.", float64(stats.Idle))
+	writeMetric(w, "hishtory_db_wait_count_total", "counter", "The total number of times a request waited for a connection to the DB.", float64(stats.WaitCount))
+	writeMetric(w, "hishtory_db_wait_duration_seconds_total", "counter", "The total time spent waiting for a connection to the DB.", stats.WaitDuration.Seconds())
+
+	counts, err := m.getDbCounts(ctx)
+	if err != nil {
+		return err
+	}
+	writeMetric(w, "hishtory_entries_stored", "gauge", "The number of encrypted history entries stored and waiting to be synced.", float64(counts.entriesStored))
+	writeMetric(w, "hishtory_devices_registered", "gauge", "The number of registered devices.", float64(counts.devicesRegistered))
+	fmt.Fprintf(w, "# HELP hishtory_active_devices The number of devices that synced within the given window.\n# TYPE hishtory_active_devices gauge\n")
+	for i, window := range activeDeviceWindows {
+		fmt.Fprintf(w, "hishtory_active_devices{window=%q} %d\n", window.label, counts.activeDevices[i])
+	}
+	return nil
+}
+
+func (m *serverMetrics) writeRequestMetrics(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requestCounts))
+	for k := range m.requestCounts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+	fmt.Fprintf(w, "# HELP hishtory_http_requests_total The number of HTTP requests handled, by handler and status code.\n# TYPE hishtory_http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "hishtory_http_requests_total{handler=%q,code=\"%d\"} %d\n", k.handler, k.code, m.requestCounts[k])
+	}
+
+	handlers := make([]string, 0, len(m.requestLatency))
+	for handler := range m.requestLatency {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	fmt.Fprintf(w, "# HELP hishtory_http_request_duration_seconds The latency of HTTP requests, by handler.\n# TYPE hishtory_http_request_duration_seconds histogram\n")
+	for _, handler := range handlers {
+		h := m.requestLatency[handler]
+		cumulativeCount := uint64(0)
+		for i, bound := range requestDurationBuckets {
+			cumulativeCount += h.bucketCounts[i]
+			fmt.Fprintf(w, "hishtory_http_request_duration_seconds_bucket{handler=%q,le=%q} %d\n", handler, formatMetricValue(bound), cumulativeCount)
+		}
+		fmt.Fprintf(w, "hishtory_http_request_duration_seconds_bucket{handler=%q,le=\"+Inf\"} %d\n", handler, h.count)
+		fmt.Fprintf(w, "hishtory_http_request_duration_seconds_sum{handler=%q} %s\n", handler, formatMetricValue(h.sum))
+		fmt.Fprintf(w, "hishtory_http_request_duration_seconds_count{handler=%q} %d\n", handler, h.count)
+	}
+}
+
+func writeMetric(w io.Writer, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, metricType, name, formatMetricValue(value))
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	if err := GLOBAL_METRICS.write(r.Context(), &sb); err != nil {
+		fmt.Printf("Failed to collect metrics: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// serveMetrics serves /metrics on its own address, so that it can be exposed to a monitoring system without
+// being exposed publicly alongside the API
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", withPanicGuard(metricsHandler))
+	fmt.Printf("Serving metrics on %s/metrics\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		panic(fmt.Errorf("failed to serve metrics on %s: %w", addr, err))
+	}
+}
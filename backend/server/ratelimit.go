@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rate limiters for the endpoints that read and write entries. Each is nil if its limit isn't configured via
+// HISHTORY_RATE_LIMIT_PER_DEVICE or HISHTORY_RATE_LIMIT_PER_IP, which are the maximum number of requests per
+// minute (with bursts of up to that many requests).
+var (
+	GLOBAL_DEVICE_RATE_LIMITER *rateLimiter
+	GLOBAL_IP_RATE_LIMITER     *rateLimiter
+	// The reverse proxies (configured via HISHTORY_TRUSTED_PROXIES) whose X-Real-Ip and X-Forwarded-For headers are
+	// trusted. Requests from anywhere else are limited by their own address, so that clients can't pick their own IP.
+	GLOBAL_TRUSTED_PROXIES []*net.IPNet
+	// Guards the rate limiters and trusted proxies, which are replaced when the config is reloaded
+	rateLimitersLock sync.RWMutex
+)
+
+// Buckets that have been idle for long enough to refill are dropped after this long, so that the limiters don't
+// grow without bound
+const rateLimiterSweepInterval = 10 * time.Minute
+
+// The maximum number of buckets in each rate limiter. Once it is reached, idle buckets are dropped early and then (if
+// there still isn't room) an arbitrary bucket is dropped for each new key.
+const rateLimiterMaxBuckets = 100_000
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key (e.g. a device ID or IP address)
+type rateLimiter struct {
+	lock sync.Mutex
+	// The number of tokens that are added to each bucket per second
+	rate float64
+	// The maximum number of tokens in each bucket
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(requestsPerMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(requestsPerMinute) / 60,
+		burst:     float64(requestsPerMinute),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// newRateLimiterFromEnv returns a rate limiter configured by the given environment variable, or nil if it is unset
+func newRateLimiterFromEnv(envVar string) (*rateLimiter, error) {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return nil, nil
+	}
+	requestsPerMinute, err := strconv.Atoi(val)
+	if err != nil || requestsPerMinute <= 0 {
+		return nil, fmt.Errorf("failed to parse %s=%#v, expected a positive number of requests per minute", envVar, val)
+	}
+	return newRateLimiter(requestsPerMinute), nil
+}
+
+// allow takes a token from the bucket for key if there is one. If not, it returns how long until there will be.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimiterMaxBuckets {
+			l.sweep(now)
+		}
+		for evictedKey := range l.buckets {
+			if len(l.buckets) < rateLimiterMaxBuckets {
+				break
+			}
+			delete(l.buckets, evictedKey)
+		}
+		bucket = &tokenBucket{tokens: l.burst, lastRefill: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*l.rate)
+	bucket.lastRefill = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that would have refilled by now, since they're equivalent to new buckets
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func initRateLimiters() error {
+	deviceRateLimiter, err := newRateLimiterFromEnv("HISHTORY_RATE_LIMIT_PER_DEVICE")
+	if err != nil {
+		return err
+	}
+	ipRateLimiter, err := newRateLimiterFromEnv("HISHTORY_RATE_LIMIT_PER_IP")
+	if err != nil {
+		return err
+	}
+	trustedProxies, err := parseTrustedProxies(os.Getenv("HISHTORY_TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+	GLOBAL_DEVICE_RATE_LIMITER, GLOBAL_IP_RATE_LIMITER = deviceRateLimiter, ipRateLimiter
+	GLOBAL_TRUSTED_PROXIES = trustedProxies
+	return nil
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges
+func parseTrustedProxies(val string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+	for _, proxy := range strings.Split(val, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("failed to parse HISHTORY_TRUSTED_PROXIES, %#v is not an IP address or CIDR range", proxy)
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse HISHTORY_TRUSTED_PROXIES, %#v is not an IP address or CIDR range", proxy)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIp returns the IP address of the client. If the request came from a trusted proxy, this is read from the
+// X-Real-Ip header (or else the last untrusted address in X-Forwarded-For) that the proxy set.
+func getClientIp(r *http.Request) string {
+	remoteIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIp = r.RemoteAddr
+	}
+	rateLimitersLock.RLock()
+	trustedProxies := GLOBAL_TRUSTED_PROXIES
+	rateLimitersLock.RUnlock()
+	if !isTrustedProxy(trustedProxies, remoteIp) {
+		return remoteIp
+	}
+	if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+		return ip
+	}
+	// Each proxy appends the address that it received the request from, so the last address that wasn't added by a
+	// trusted proxy is the client's (and any before it may have been sent by the client)
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwardedFor[i])
+		if ip != "" && !isTrustedProxy(trustedProxies, ip) {
+			return ip
+		}
+	}
+	return remoteIp
+}
+
+// isRateLimited checks the request against the per-device and per-IP rate limits. If either is exceeded, it
+// responds with a 429 and a Retry-After header and returns true, in which case the handler should return
+// immediately.
+func isRateLimited(w http.ResponseWriter, r *http.Request) bool {
+	now := time.Now()
+	deviceId := r.URL.Query().Get("device_id")
+	if deviceId == "" {
+		deviceId = r.URL.Query().Get("source_device_id")
+	}
+	type limit struct {
+		limiter *rateLimiter
+		key     string
+	}
+	rateLimitersLock.RLock()
+	deviceRateLimiter, ipRateLimiter := GLOBAL_DEVICE_RATE_LIMITER, GLOBAL_IP_RATE_LIMITER
+	rateLimitersLock.RUnlock()
+	limits := make([]limit, 0)
+	if deviceRateLimiter != nil && deviceId != "" {
+		limits = append(limits, limit{deviceRateLimiter, "device " + deviceId})
+	}
+	if ipRateLimiter != nil {
+		limits = append(limits, limit{ipRateLimiter, "IP " + getClientIp(r)})
+	}
+	for _, limit := range limits {
+		if ok, retryAfter := limit.limiter.allow(limit.key, now); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Rate limit exceeded for %s, retry after %s\n", limit.key, retryAfter.Round(time.Second))))
+			return true
+		}
+	}
+	return false
+}
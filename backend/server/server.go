@@ -20,6 +20,7 @@ import (
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/ddworken/hishtory/shared"
+	"github.com/glebarez/sqlite"
 	"github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/lib/pq"
 	"github.com/rodaine/table"
@@ -30,7 +31,6 @@ import (
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/profiler"
 	"gorm.io/driver/postgres"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -90,21 +90,21 @@ func updateUsageData(ctx context.Context, r *http.Request, userId, deviceId stri
 
 func usageStatsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	query := `
+	query := fmt.Sprintf(`
 	SELECT 
 		MIN(devices.registration_date) as registration_date, 
 		COUNT(DISTINCT devices.device_id) as num_devices,
 		SUM(usage_data.num_entries_handled) as num_history_entries,
 		MAX(usage_data.last_used) as last_active,
-		COALESCE(STRING_AGG(DISTINCT usage_data.last_ip, ', ') FILTER (WHERE usage_data.last_ip != 'Unknown' AND usage_data.last_ip != 'UnknownIp'), 'Unknown')  as ip_addresses,
+		COALESCE(%s, 'Unknown')  as ip_addresses,
 		COALESCE(SUM(usage_data.num_queries), 0) as num_queries,
-		COALESCE(MAX(usage_data.last_queried), 'January 1, 1970') as last_queried,
-		STRING_AGG(DISTINCT usage_data.version, ', ') as versions
+		MAX(usage_data.last_queried) as last_queried,
+		%s as versions
 	FROM devices
 	INNER JOIN usage_data ON devices.device_id = usage_data.device_id
 	GROUP BY devices.user_id
 	ORDER BY registration_date
-	`
+	`, stringAggDistinct(GLOBAL_DB, "CASE WHEN usage_data.last_ip != 'Unknown' AND usage_data.last_ip != 'UnknownIp' THEN usage_data.last_ip END"), stringAggDistinct(GLOBAL_DB, "usage_data.version"))
 	rows, err := GLOBAL_DB.WithContext(ctx).Raw(query).Rows()
 	if err != nil {
 		panic(err)
@@ -113,21 +113,24 @@ func usageStatsHandler(w http.ResponseWriter, r *http.Request) {
 	tbl := table.New("Registration Date", "Num Devices", "Num Entries", "Num Queries", "Last Active", "Last Query", "Versions", "IPs")
 	tbl.WithWriter(w)
 	for rows.Next() {
-		var registrationDate time.Time
+		var registrationDate aggregateTime
 		var numDevices int
 		var numEntries int
-		var lastUsedDate time.Time
+		var lastUsedDate aggregateTime
 		var ipAddresses string
 		var numQueries int
-		var lastQueried time.Time
+		var lastQueried aggregateTime
 		var versions string
 		err = rows.Scan(&registrationDate, &numDevices, &numEntries, &lastUsedDate, &ipAddresses, &numQueries, &lastQueried, &versions)
 		if err != nil {
 			panic(err)
 		}
 		versions = strings.ReplaceAll(strings.ReplaceAll(versions, "Unknown", ""), ", ", "")
-		lastQueryStr := strings.ReplaceAll(lastQueried.Format("2006-01-02"), "1970-01-01", "")
-		tbl.AddRow(registrationDate.Format("2006-01-02"), numDevices, numEntries, numQueries, lastUsedDate.Format("2006-01-02"), lastQueryStr, versions, ipAddresses)
+		lastQueryStr := ""
+		if lastQueried.Valid {
+			lastQueryStr = lastQueried.Time.Format("2006-01-02")
+		}
+		tbl.AddRow(registrationDate.Time.Format("2006-01-02"), numDevices, numEntries, numQueries, lastUsedDate.Time.Format("2006-01-02"), lastQueryStr, versions, ipAddresses)
 	}
 	tbl.Print()
 }
@@ -149,12 +152,13 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Where("last_used > ?", lastWeek).Count(&weeklyActiveInstalls))
 	var weeklyQueryUsers int64 = 0
 	checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Where("last_queried > ?", lastWeek).Count(&weeklyQueryUsers))
-	var lastRegistration string = ""
-	row := GLOBAL_DB.WithContext(ctx).Raw("select to_char(max(registration_date), 'DD Month YYYY HH24:MI') from devices").Row()
-	err := row.Scan(&lastRegistration)
+	var lastRegistrationDate aggregateTime
+	row := GLOBAL_DB.WithContext(ctx).Raw("select max(registration_date) from devices").Row()
+	err := row.Scan(&lastRegistrationDate)
 	if err != nil {
 		panic(err)
 	}
+	lastRegistration := lastRegistrationDate.Time.Format("02 January 2006 15:04")
 	w.Write([]byte(fmt.Sprintf("Num devices: %d\n", numDevices)))
 	w.Write([]byte(fmt.Sprintf("Num history entries processed: %d\n", nep.Total)))
 	w.Write([]byte(fmt.Sprintf("Num DB entries: %d\n", numDbEntries)))
@@ -164,6 +168,9 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
 	ctx := r.Context()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -186,6 +193,13 @@ func apiSubmitHandler(w http.ResponseWriter, r *http.Request) {
 		panic(fmt.Errorf("found no devices associated with user_id=%s, can't save history entry", entries[0].UserId))
 	}
 	fmt.Printf("apiSubmitHandler: Found %d devices\n", len(devices))
+	if err := checkSubmittingDevices(devices, entries); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := offloadEntries(ctx, entries); err != nil {
+		panic(fmt.Errorf("failed to store entries in object storage: %w", err))
+	}
 	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		for _, device := range devices {
 			for _, entry := range entries {
@@ -207,14 +221,24 @@ func apiSubmitHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiBootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
 	ctx := r.Context()
 	userId := getRequiredQueryParam(r, "user_id")
 	deviceId := getRequiredQueryParam(r, "device_id")
 	updateUsageData(ctx, r, userId, deviceId, 0, false)
-	tx := GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId)
+	tx, err := applyEntryFilters(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var historyEntries []*shared.EncHistoryEntry
 	checkGormResult(tx.Find(&historyEntries))
 	fmt.Printf("apiBootstrapHandler: Found %d entries\n", len(historyEntries))
+	if err := hydrateEntries(ctx, historyEntries); err != nil {
+		panic(err)
+	}
 	resp, err := json.Marshal(historyEntries)
 	if err != nil {
 		panic(err)
@@ -222,7 +246,40 @@ func apiBootstrapHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+// applyEntryFilters filters tx by the optional query params of r. The end time is always visible to the server, but
+// the other fields are only set for entries from clients that opted in to making them server-visible, so filtering on
+// them excludes entries from clients that didn't.
+func applyEntryFilters(tx *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	query := r.URL.Query()
+	for param, condition := range map[string]string{"after": "date > ?", "before": "date < ?", "started_after": "start_time > ?", "started_before": "start_time < ?"} {
+		if val := query.Get(param); val != "" {
+			unixTime, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s=%#v as a unix timestamp", param, val)
+			}
+			tx = tx.Where(condition, time.Unix(unixTime, 0))
+		}
+	}
+	if hostname := query.Get("hostname"); hostname != "" {
+		tx = tx.Where("hostname = ?", hostname)
+	}
+	if sourceDeviceId := query.Get("source_device_id"); sourceDeviceId != "" {
+		tx = tx.Where("source_device_id = ?", sourceDeviceId)
+	}
+	if val := query.Get("exit_code"); val != "" {
+		exitCode, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse exit_code=%#v as an integer", val)
+		}
+		tx = tx.Where("exit_code = ?", exitCode)
+	}
+	return tx, nil
+}
+
 func apiQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
 	ctx := r.Context()
 	userId := getRequiredQueryParam(r, "user_id")
 	deviceId := getRequiredQueryParam(r, "device_id")
@@ -243,6 +300,9 @@ func apiQueryHandler(w http.ResponseWriter, r *http.Request) {
 	var historyEntries []*shared.EncHistoryEntry
 	checkGormResult(tx.Find(&historyEntries))
 	fmt.Printf("apiQueryHandler: Found %d entries for %s\n", len(historyEntries), r.URL)
+	if err := hydrateEntries(ctx, historyEntries); err != nil {
+		panic(err)
+	}
 	resp, err := json.Marshal(historyEntries)
 	if err != nil {
 		panic(err)
@@ -282,6 +342,16 @@ func getRemoteAddr(r *http.Request) string {
 
 func apiRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	userId := getRequiredQueryParam(r, "user_id")
+	deviceId := getRequiredQueryParam(r, "device_id")
+	readOnly := r.URL.Query().Get("read_only") == "true"
+	// Registering an existing device again is a no-op. In particular, it can't change whether the device is read-only,
+	// since otherwise a read-only device could just re-register itself to get around that.
+	var existingDevice []*shared.Device
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ?", userId, deviceId).Find(&existingDevice))
+	if len(existingDevice) > 0 {
+		return
+	}
 	if getMaximumNumberOfAllowedUsers() < math.MaxInt {
 		row := GLOBAL_DB.WithContext(ctx).Raw("SELECT COUNT(DISTINCT devices.user_id) FROM devices").Row()
 		var numDistinctUsers int64 = 0
@@ -293,12 +363,10 @@ func apiRegisterHandler(w http.ResponseWriter, r *http.Request) {
 			panic(fmt.Sprintf("Refusing to allow registration of new device since there are currently %d users and this server allows a max of %d users", numDistinctUsers, getMaximumNumberOfAllowedUsers()))
 		}
 	}
-	userId := getRequiredQueryParam(r, "user_id")
-	deviceId := getRequiredQueryParam(r, "device_id")
 	var existingDevicesCount int64 = -1
 	checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ?", userId).Count(&existingDevicesCount))
 	fmt.Printf("apiRegisterHandler: existingDevicesCount=%d\n", existingDevicesCount)
-	checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.Device{UserId: userId, DeviceId: deviceId, RegistrationIp: getRemoteAddr(r), RegistrationDate: time.Now()}))
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.Device{UserId: userId, DeviceId: deviceId, RegistrationIp: getRemoteAddr(r), RegistrationDate: time.Now(), ReadOnly: readOnly}))
 	if existingDevicesCount > 0 {
 		checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.DumpRequest{UserId: userId, RequestingDeviceId: deviceId, RequestTime: time.Now()}))
 	}
@@ -324,27 +392,41 @@ func apiGetPendingDumpRequestsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiSubmitDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
 	ctx := r.Context()
 	userId := getRequiredQueryParam(r, "user_id")
 	srcDeviceId := getRequiredQueryParam(r, "source_device_id")
 	requestingDeviceId := getRequiredQueryParam(r, "requesting_device_id")
+	var srcDevices []*shared.Device
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ?", userId, srcDeviceId).Find(&srcDevices))
+	if isReadOnlyDevice(srcDevices, srcDeviceId) {
+		http.Error(w, "refusing to accept a dump from a read-only device", http.StatusForbidden)
+		return
+	}
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		panic(err)
 	}
-	var entries []shared.EncHistoryEntry
+	var entries []*shared.EncHistoryEntry
 	err = json.Unmarshal(data, &entries)
 	if err != nil {
 		panic(fmt.Sprintf("body=%#v, err=%v", data, err))
 	}
 	fmt.Printf("apiSubmitDumpHandler: received request containg %d EncHistoryEntry\n", len(entries))
+	for _, entry := range entries {
+		if entry.UserId != userId {
+			panic(fmt.Errorf("batch contains an entry with UserId=%#v, when the query param contained the user_id=%#v", entry.UserId, userId))
+		}
+	}
+	if err := offloadEntries(ctx, entries); err != nil {
+		panic(fmt.Errorf("failed to store dumped entries in object storage: %w", err))
+	}
 	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		for _, entry := range entries {
 			entry.DeviceId = requestingDeviceId
-			if entry.UserId != userId {
-				return fmt.Errorf("batch contains an entry with UserId=%#v, when the query param contained the user_id=%#v", entry.UserId, userId)
-			}
-			checkGormResult(tx.Create(&entry))
+			checkGormResult(tx.Create(entry))
 		}
 		return nil
 	})
@@ -355,6 +437,37 @@ func apiSubmitDumpHandler(w http.ResponseWriter, r *http.Request) {
 	updateUsageData(ctx, r, userId, srcDeviceId, len(entries), false)
 }
 
+// isReadOnlyDevice returns whether the device with the given ID is one of the given devices and was registered as
+// read-only
+func isReadOnlyDevice(devices []*shared.Device, deviceId string) bool {
+	for _, device := range devices {
+		if device.DeviceId == deviceId && device.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSubmittingDevices returns an error unless every entry was submitted by one of the user's devices that isn't
+// read-only. Each entry's DeviceId is the device that submitted it, until it is replaced with the device that it is
+// queued for.
+func checkSubmittingDevices(devices []*shared.Device, entries []*shared.EncHistoryEntry) error {
+	devicesById := make(map[string]*shared.Device, len(devices))
+	for _, device := range devices {
+		devicesById[device.DeviceId] = device
+	}
+	for _, entry := range entries {
+		device, ok := devicesById[entry.DeviceId]
+		if !ok || entry.UserId != device.UserId {
+			return fmt.Errorf("refusing to accept entries from device_id=%#v since it isn't registered", entry.DeviceId)
+		}
+		if device.ReadOnly {
+			return fmt.Errorf("refusing to accept entries from a read-only device")
+		}
+	}
+	return nil
+}
+
 func apiBannerHandler(w http.ResponseWriter, r *http.Request) {
 	commitHash := getRequiredQueryParam(r, "commit_hash")
 	deviceId := getRequiredQueryParam(r, "device_id")
@@ -367,6 +480,21 @@ func apiBannerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(html.EscapeString(forcedBanner)))
 }
 
+func apiStorageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := getRequiredQueryParam(r, "user_id")
+	var usage shared.StorageUsage
+	row := GLOBAL_DB.WithContext(ctx).Raw("SELECT COUNT(*), COALESCE(SUM(LENGTH(encrypted_data) + LENGTH(nonce) + COALESCE(blob_size, 0)), 0) FROM enc_history_entries WHERE user_id = ?", userId).Row()
+	if err := row.Scan(&usage.NumEntries, &usage.NumBytes); err != nil {
+		panic(fmt.Errorf("failed to query storage usage: %v", err))
+	}
+	respBody, err := json.Marshal(usage)
+	if err != nil {
+		panic(fmt.Errorf("failed to JSON marshall the storage usage: %v", err))
+	}
+	w.Write(respBody)
+}
+
 func getDeletionRequestsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	userId := getRequiredQueryParam(r, "user_id")
@@ -420,6 +548,292 @@ func addDeletionRequestHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("addDeletionRequestHandler: Deleted %d rows in the backend\n", numDeleted)
 }
 
+func addMetadataUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	var updates []*shared.EncMetadataUpdate
+	err = json.Unmarshal(data, &updates)
+	if err != nil {
+		panic(fmt.Sprintf("body=%#v, err=%v", data, err))
+	}
+	fmt.Printf("addMetadataUpdatesHandler: received request containg %d metadata updates\n", len(updates))
+	if len(updates) == 0 {
+		return
+	}
+
+	// Store the updates once per device so all the devices will get them
+	tx := GLOBAL_DB.WithContext(ctx).Where("user_id = ?", updates[0].UserId)
+	var devices []*shared.Device
+	checkGormResult(tx.Find(&devices))
+	if len(devices) == 0 {
+		panic(fmt.Errorf("found no devices associated with user_id=%s, can't save metadata updates", updates[0].UserId))
+	}
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, device := range devices {
+			for _, update := range updates {
+				if update.UserId != updates[0].UserId {
+					return fmt.Errorf("batch contains updates for multiple users")
+				}
+				update.DestinationDeviceId = device.DeviceId
+				update.ReadCount = 0
+			}
+			checkGormResult(tx.Create(&updates))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to execute transaction to add metadata updates to DB: %v", err))
+	}
+}
+
+func getMetadataUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := getRequiredQueryParam(r, "user_id")
+	deviceId := getRequiredQueryParam(r, "device_id")
+
+	var updates []*shared.EncMetadataUpdate
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND destination_device_id = ? AND read_count < 5", userId, deviceId).Order("send_time ASC").Find(&updates))
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Exec("UPDATE enc_metadata_updates SET read_count = read_count + 1 WHERE destination_device_id = ? AND user_id = ?", deviceId, userId))
+	respBody, err := json.Marshal(updates)
+	if err != nil {
+		panic(fmt.Errorf("failed to JSON marshall the metadata updates: %v", err))
+	}
+	w.Write(respBody)
+}
+
+// getShareOwner returns the user ID of the user who created the share with the given ID, or "" if there is no such
+// share (e.g. because it was revoked)
+func getShareOwner(ctx context.Context, shareId string) string {
+	var shares []*shared.Share
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("share_id = ?", shareId).Find(&shares))
+	if len(shares) == 0 {
+		return ""
+	}
+	return shares[0].OwnerUserId
+}
+
+func submitSharedEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
+	ctx := r.Context()
+	shareId := getRequiredQueryParam(r, "share_id")
+	userId := getRequiredQueryParam(r, "user_id")
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	var entries []*shared.EncSharedEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		panic(fmt.Sprintf("body=%#v, err=%v", data, err))
+	}
+	fmt.Printf("submitSharedEntriesHandler: received request containing %d EncSharedEntry\n", len(entries))
+	owner := getShareOwner(ctx, shareId)
+	if owner != "" && owner != userId {
+		http.Error(w, "refusing to modify a share that was created by another user", http.StatusForbidden)
+		return
+	}
+	var devices []*shared.Device
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId).Find(&devices))
+	if len(devices) == 0 {
+		http.Error(w, "only registered users can share history", http.StatusForbidden)
+		return
+	}
+	// The owner always submits every entry in the share, so that entries they deleted are removed from it too
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if owner == "" {
+			checkGormResult(tx.Create(&shared.Share{ShareId: shareId, OwnerUserId: userId, CreationDate: time.Now()}))
+		}
+		checkGormResult(tx.Where("share_id = ?", shareId).Delete(&shared.EncSharedEntry{}))
+		for _, entry := range entries {
+			entry.ShareId = shareId
+		}
+		for _, entriesChunk := range shared.Chunks(entries, 1000) {
+			checkGormResult(tx.Create(&entriesChunk))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to execute transaction to add shared entries to DB: %v", err))
+	}
+}
+
+func getSharedEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
+	ctx := r.Context()
+	shareId := getRequiredQueryParam(r, "share_id")
+	if getShareOwner(ctx, shareId) == "" {
+		http.Error(w, "no such share, it may have been revoked", http.StatusNotFound)
+		return
+	}
+	var entries []*shared.EncSharedEntry
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("share_id = ?", shareId).Find(&entries))
+	fmt.Printf("getSharedEntriesHandler: Found %d entries\n", len(entries))
+	resp, err := json.Marshal(entries)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resp)
+}
+
+func revokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	shareId := getRequiredQueryParam(r, "share_id")
+	userId := getRequiredQueryParam(r, "user_id")
+	owner := getShareOwner(ctx, shareId)
+	if owner == "" {
+		// Already revoked
+		return
+	}
+	if owner != userId {
+		http.Error(w, "refusing to revoke a share that was created by another user", http.StatusForbidden)
+		return
+	}
+	err := GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		checkGormResult(tx.Where("share_id = ?", shareId).Delete(&shared.EncSharedEntry{}))
+		checkGormResult(tx.Where("share_id = ?", shareId).Delete(&shared.Share{}))
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to execute transaction to revoke share: %v", err))
+	}
+}
+
+// The tables that have rows keyed by user_id, which purgeUser deletes all of a user's rows from. Shares (and their
+// entries) are keyed by owner_user_id instead, and history entries are deleted via deleteHistoryEntries so that their
+// blobs are deleted too.
+var userKeyedModels = []interface{}{&shared.Device{}, &shared.DumpRequest{}, &shared.DeletionRequest{}, &shared.EncMetadataUpdate{}, &shared.Feedback{}, &UsageData{}}
+
+// purgeUser deletes everything stored on the backend for a user, for both account deletion and `admin purge-user`.
+// Entries published to team channels are kept, since they belong to the team rather than to the user that published
+// them.
+func purgeUser(ctx context.Context, userId string) (shared.AccountDeletion, error) {
+	var deletion shared.AccountDeletion
+	numEntries, err := deleteHistoryEntries(ctx, GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId))
+	if err != nil {
+		return deletion, fmt.Errorf("failed to delete history entries: %w", err)
+	}
+	deletion.NumEntries = numEntries
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var shareIds []string
+		if err := tx.Model(&shared.Share{}).Where("owner_user_id = ?", userId).Pluck("share_id", &shareIds).Error; err != nil {
+			return err
+		}
+		if len(shareIds) > 0 {
+			if err := tx.Where("share_id IN ?", shareIds).Delete(&shared.EncSharedEntry{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("share_id IN ?", shareIds).Delete(&shared.Share{}).Error; err != nil {
+				return err
+			}
+		}
+		deletion.NumShares = int64(len(shareIds))
+		for _, model := range userKeyedModels {
+			result := tx.Where("user_id = ?", userId).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+			if _, ok := model.(*shared.Device); ok {
+				deletion.NumDevices = result.RowsAffected
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return deletion, fmt.Errorf("failed to delete the user's devices, requests, and shares: %w", err)
+	}
+	return deletion, nil
+}
+
+// deleteAccountHandler deletes everything stored on the backend for a user (see purgeUser)
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := getRequiredQueryParam(r, "user_id")
+	deletion, err := purgeUser(ctx, userId)
+	if err != nil {
+		panic(fmt.Errorf("failed to delete account: %w", err))
+	}
+	fmt.Printf("deleteAccountHandler: deleted %d entries, %d devices, and %d shares\n", deletion.NumEntries, deletion.NumDevices, deletion.NumShares)
+	respBody, err := json.Marshal(deletion)
+	if err != nil {
+		panic(fmt.Errorf("failed to JSON marshall the account deletion: %v", err))
+	}
+	w.Write(respBody)
+}
+
+// The maximum number of entries returned per request by getChannelEntriesHandler
+const channelEntriesPageSize = 1000
+
+func submitChannelEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
+	ctx := r.Context()
+	channelId := getRequiredQueryParam(r, "channel_id")
+	userId := getRequiredQueryParam(r, "user_id")
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	var entries []*shared.EncChannelEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		panic(fmt.Sprintf("body=%#v, err=%v", data, err))
+	}
+	fmt.Printf("submitChannelEntriesHandler: received request containing %d EncChannelEntry\n", len(entries))
+	var devices []*shared.Device
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId).Find(&devices))
+	if len(devices) == 0 {
+		http.Error(w, "only registered users can publish to channels", http.StatusForbidden)
+		return
+	}
+	// Channels are append-only, and the IDs are always assigned by the server so that clients can page through them
+	for _, entry := range entries {
+		entry.Id = 0
+		entry.ChannelId = channelId
+	}
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, entriesChunk := range shared.Chunks(entries, 1000) {
+			checkGormResult(tx.Create(&entriesChunk))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to execute transaction to add channel entries to DB: %v", err))
+	}
+}
+
+func getChannelEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if isRateLimited(w, r) {
+		return
+	}
+	ctx := r.Context()
+	channelId := getRequiredQueryParam(r, "channel_id")
+	afterId := uint64(0)
+	if val := r.URL.Query().Get("after_id"); val != "" {
+		var err error
+		afterId, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse after_id=%#v as an integer", val), http.StatusBadRequest)
+			return
+		}
+	}
+	var entries []*shared.EncChannelEntry
+	checkGormResult(GLOBAL_DB.WithContext(ctx).Where("channel_id = ? AND id > ?", channelId, afterId).Order("id ASC").Limit(channelEntriesPageSize).Find(&entries))
+	fmt.Printf("getChannelEntriesHandler: Found %d entries\n", len(entries))
+	resp, err := json.Marshal(entries)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resp)
+}
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	if isProductionEnvironment() {
@@ -466,9 +880,11 @@ func applyDeletionRequestsToBackend(ctx context.Context, request shared.Deletion
 	for _, message := range request.Messages.Ids {
 		tx = tx.Or(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ? AND date = ?", request.UserId, message.DeviceId, message.Date))
 	}
-	result := tx.Delete(&shared.EncHistoryEntry{})
-	checkGormResult(result)
-	return int(result.RowsAffected), nil
+	numDeleted, err := deleteHistoryEntries(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	return int(numDeleted), nil
 }
 
 func wipeDbEntriesHandler(w http.ResponseWriter, r *http.Request) {
@@ -479,7 +895,9 @@ func wipeDbEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	if !isTestEnvironment() {
 		panic("refusing to wipe the DB non-test environment")
 	}
-	checkGormResult(GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_history_entries"))
+	if _, err := deleteHistoryEntries(ctx, GLOBAL_DB.WithContext(ctx).Where("true")); err != nil {
+		panic(err)
+	}
 }
 
 func getNumConnectionsHandler(w http.ResponseWriter, r *http.Request) {
@@ -526,6 +944,14 @@ func OpenDB() (*gorm.DB, error) {
 	if os.Getenv("HISHTORY_SQLITE_DB") != "" {
 		sqliteDb = os.Getenv("HISHTORY_SQLITE_DB")
 	}
+	mysqlDb := os.Getenv("HISHTORY_MYSQL_DB")
+	if isStandalone() {
+		var err error
+		sqliteDb, err = getDefaultSqliteDsn()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var db *gorm.DB
 	if sqliteDb != "" {
@@ -534,6 +960,15 @@ func OpenDB() (*gorm.DB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to the DB: %v", err)
 		}
+	} else if mysqlDb != "" {
+		dialector, err := newMysqlDialector(mysqlDb)
+		if err != nil {
+			return nil, err
+		}
+		db, err = gorm.Open(dialector, &gorm.Config{Logger: customLogger})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the DB: %v", err)
+		}
 	} else {
 		postgresDb := fmt.Sprintf(PostgresDb, os.Getenv("POSTGRESQL_PASSWORD"))
 		if os.Getenv("HISHTORY_POSTGRES_DB") != "" {
@@ -559,13 +994,20 @@ func AddDatabaseTables(db *gorm.DB) {
 	db.AutoMigrate(&UsageData{})
 	db.AutoMigrate(&shared.DumpRequest{})
 	db.AutoMigrate(&shared.DeletionRequest{})
+	db.AutoMigrate(&shared.EncMetadataUpdate{})
 	db.AutoMigrate(&shared.Feedback{})
+	db.AutoMigrate(&shared.Share{})
+	db.AutoMigrate(&shared.EncSharedEntry{})
+	db.AutoMigrate(&shared.EncChannelEntry{})
 }
 
 func init() {
 	if ReleaseVersion == "UNKNOWN" && !isTestEnvironment() {
 		panic("server.go was built without a ReleaseVersion!")
 	}
+	if err := loadConfigFile(); err != nil {
+		panic(err)
+	}
 	InitDB()
 	go runBackgroundJobs(context.Background())
 }
@@ -573,7 +1015,11 @@ func init() {
 func cron(ctx context.Context) error {
 	err := updateReleaseVersion()
 	if err != nil {
-		panic(err)
+		if !isStandalone() {
+			panic(err)
+		}
+		// Standalone servers may not be able to reach GitHub, in which case they keep the version they were built with
+		fmt.Printf("Failed to update the release version: %v\n", err)
 	}
 	err = cleanDatabase(ctx)
 	if err != nil {
@@ -695,6 +1141,16 @@ func InitDB() {
 	if isTestEnvironment() {
 		sqlDb.SetMaxIdleConns(1)
 	}
+	blobStore, err := newS3BlobStore(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if blobStore != nil {
+		GLOBAL_BLOB_STORE = blobStore
+		if err := ensureBlobKeyIndex(GLOBAL_DB); err != nil {
+			panic(fmt.Errorf("failed to index blob keys: %w", err))
+		}
+	}
 }
 
 func decrementVersion(version string) (string, error) {
@@ -778,7 +1234,8 @@ func feedbackHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type loggedResponseData struct {
-	size int
+	size       int
+	statusCode int
 }
 
 type loggingResponseWriter struct {
@@ -793,6 +1250,7 @@ func (r *loggingResponseWriter) Write(b []byte) (int, error) {
 }
 
 func (r *loggingResponseWriter) WriteHeader(statusCode int) {
+	r.responseData.statusCode = statusCode
 	r.ResponseWriter.WriteHeader(statusCode)
 }
 
@@ -829,8 +1287,22 @@ func withLogging(h http.HandlerFunc) http.HandlerFunc {
 			tracer.ServiceName("hishtory-api"),
 		)
 		defer span.Finish()
+		completed := false
+		if GLOBAL_METRICS != nil {
+			defer func() {
+				statusCode := responseData.statusCode
+				if !completed {
+					// The handler panicked, so withPanicGuard will respond with a 500
+					statusCode = http.StatusInternalServerError
+				} else if statusCode == 0 {
+					statusCode = http.StatusOK
+				}
+				GLOBAL_METRICS.recordRequest(getFunctionName(h), statusCode, time.Since(start))
+			}()
+		}
 
-		h.ServeHTTP(&lrw, r.WithContext(ctx))
+		serveWithCompression(h, &lrw, r.WithContext(ctx))
+		completed = true
 
 		duration := time.Since(start)
 		fmt.Printf("%s %s %#v %s %s %s\n", getRemoteAddr(r), r.Method, r.RequestURI, getHishtoryVersion(r), duration.String(), byteCountToString(responseData.size))
@@ -855,11 +1327,14 @@ func byteCountToString(b int) string {
 }
 
 func cleanDatabase(ctx context.Context) error {
-	r := GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_history_entries WHERE read_count > 10")
+	if _, err := deleteHistoryEntries(ctx, GLOBAL_DB.WithContext(ctx).Where("read_count > 10")); err != nil {
+		return err
+	}
+	r := GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM deletion_requests WHERE read_count > 100")
 	if r.Error != nil {
 		return r.Error
 	}
-	r = GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM deletion_requests WHERE read_count > 100")
+	r = GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_metadata_updates WHERE read_count > 10")
 	if r.Error != nil {
 		return r.Error
 	}
@@ -868,33 +1343,32 @@ func cleanDatabase(ctx context.Context) error {
 
 func deepCleanDatabase(ctx context.Context) {
 	err := GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		cutoff := time.Now().AddDate(0, 0, -90)
 		r := tx.Exec(`
-		CREATE TEMP TABLE temp_users_with_one_device AS (
+		CREATE TEMPORARY TABLE temp_users_with_one_device AS
 			SELECT user_id
 			FROM devices
 			GROUP BY user_id
 			HAVING COUNT(DISTINCT device_id) > 1
-		)	
 		`)
 		if r.Error != nil {
 			return r.Error
 		}
 		r = tx.Exec(`
-		CREATE TEMP TABLE temp_inactive_users AS (
+		CREATE TEMPORARY TABLE temp_inactive_users AS
 			SELECT user_id
 			FROM usage_data
-			WHERE last_used <= (now() - INTERVAL '90 days')
-		)	
-		`)
+			WHERE last_used <= ?
+		`, cutoff)
 		if r.Error != nil {
 			return r.Error
 		}
 		r = tx.Exec(`
 		SELECT COUNT(*) FROM enc_history_entries WHERE
-			date <= (now() - INTERVAL '90 days')
+			date <= ?
 			AND user_id IN (SELECT * FROM temp_users_with_one_device)
 			AND user_id IN (SELECT * FROM temp_inactive_users)
-		`)
+		`, cutoff)
 		if r.Error != nil {
 			return r.Error
 		}
@@ -949,12 +1423,33 @@ func configureObservability(mux *httptrace.ServeMux) func() {
 }
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == "migrate-blobs" {
+		numMigrated, err := migrateBlobs(context.Background(), os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to migrate entries after migrating %d: %v", numMigrated, err)
+		}
+		fmt.Printf("Migrated %d entries %s\n", numMigrated, os.Args[2])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "admin" {
+		if err := runAdminCommand(context.Background(), os.Stdout, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	mux := httptrace.NewServeMux()
 
 	if isProductionEnvironment() {
 		defer configureObservability(mux)()
 		go deepCleanDatabase(context.Background())
 	}
+	if err := initRateLimiters(); err != nil {
+		log.Fatal(err)
+	}
+	if metricsAddr := os.Getenv("HISHTORY_METRICS_ADDR"); metricsAddr != "" {
+		GLOBAL_METRICS = newServerMetrics()
+		go serveMetrics(metricsAddr)
+	}
 
 	middleware := func(fn http.HandlerFunc) http.HandlerFunc { return withPanicGuard(withLogging(fn)) }
 
@@ -969,8 +1464,17 @@ func main() {
 	mux.Handle("/api/v1/trigger-cron", middleware(triggerCronHandler))
 	mux.Handle("/api/v1/get-deletion-requests", middleware(getDeletionRequestsHandler))
 	mux.Handle("/api/v1/add-deletion-request", middleware(addDeletionRequestHandler))
+	mux.Handle("/api/v1/add-metadata-updates", middleware(addMetadataUpdatesHandler))
+	mux.Handle("/api/v1/get-metadata-updates", middleware(getMetadataUpdatesHandler))
 	mux.Handle("/api/v1/slsa-status", middleware(slsaStatusHandler))
 	mux.Handle("/api/v1/feedback", middleware(feedbackHandler))
+	mux.Handle("/api/v1/storage-usage", middleware(apiStorageUsageHandler))
+	mux.Handle("/api/v1/submit-shared-entries", middleware(submitSharedEntriesHandler))
+	mux.Handle("/api/v1/get-shared-entries", middleware(getSharedEntriesHandler))
+	mux.Handle("/api/v1/revoke-share", middleware(revokeShareHandler))
+	mux.Handle("/api/v1/submit-channel-entries", middleware(submitChannelEntriesHandler))
+	mux.Handle("/api/v1/get-channel-entries", middleware(getChannelEntriesHandler))
+	mux.Handle("/api/v1/delete-account", middleware(deleteAccountHandler))
 	mux.Handle("/healthcheck", middleware(healthCheckHandler))
 	mux.Handle("/internal/api/v1/usage-stats", middleware(usageStatsHandler))
 	mux.Handle("/internal/api/v1/stats", middleware(statsHandler))
@@ -978,8 +1482,9 @@ func main() {
 		mux.Handle("/api/v1/wipe-db-entries", middleware(wipeDbEntriesHandler))
 		mux.Handle("/api/v1/get-num-connections", middleware(getNumConnectionsHandler))
 	}
-	fmt.Println("Listening on localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	if err := serve(mux); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func checkGormResult(result *gorm.DB) {
@@ -4,11 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -41,6 +47,7 @@ func TestESubmitThenQuery(t *testing.T) {
 	entry := testutils.MakeFakeHistoryEntry("ls ~/")
 	encEntry, err := data.EncryptHistoryEntry("key", entry)
 	testutils.Check(t, err)
+	encEntry.DeviceId = devId1
 	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
 	submitReq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
@@ -346,6 +353,7 @@ func TestDeletionRequests(t *testing.T) {
 	entry1.DeviceId = devId1
 	encEntry, err := data.EncryptHistoryEntry("dkey", entry1)
 	testutils.Check(t, err)
+	encEntry.DeviceId = devId1
 	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
 	submitReq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
@@ -356,6 +364,7 @@ func TestDeletionRequests(t *testing.T) {
 	entry2.DeviceId = devId2
 	encEntry, err = data.EncryptHistoryEntry("dkey", entry2)
 	testutils.Check(t, err)
+	encEntry.DeviceId = devId2
 	reqBody, err = json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
 	submitReq = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
@@ -367,6 +376,7 @@ func TestDeletionRequests(t *testing.T) {
 	entry3.EndTime = entry1.EndTime
 	encEntry, err = data.EncryptHistoryEntry("dOtherkey", entry3)
 	testutils.Check(t, err)
+	encEntry.DeviceId = otherDev1
 	reqBody, err = json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
 	submitReq = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
@@ -522,6 +532,95 @@ func TestHealthcheck(t *testing.T) {
 	assertNoLeakedConnections(t, GLOBAL_DB)
 }
 
+func TestStorageUsage(t *testing.T) {
+	// Set up
+	InitDB()
+
+	// Register two devices and submit an entry, which is stored once per device
+	userId := data.UserId("skey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil))
+	entry := testutils.MakeFakeHistoryEntry("ls ~/")
+	entry.DeviceId = devId1
+	encEntry, err := data.EncryptHistoryEntry("skey", entry)
+	testutils.Check(t, err)
+	encEntry.DeviceId = devId1
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	apiSubmitHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+
+	// Check the usage
+	w := httptest.NewRecorder()
+	apiStorageUsageHandler(w, httptest.NewRequest(http.MethodGet, "/?user_id="+userId, nil))
+	res := w.Result()
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var usage shared.StorageUsage
+	testutils.Check(t, json.Unmarshal(respBody, &usage))
+	expectedBytes := int64(2 * (len(encEntry.EncryptedData) + len(encEntry.Nonce)))
+	if usage.NumEntries != 2 || usage.NumBytes != expectedBytes {
+		t.Fatalf("unexpected storage usage: %#v (expected %d bytes)", usage, expectedBytes)
+	}
+
+	// And for a user with no entries
+	w = httptest.NewRecorder()
+	apiStorageUsageHandler(w, httptest.NewRequest(http.MethodGet, "/?user_id="+data.UserId("otherkey"), nil))
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	if usage.NumEntries != 0 || usage.NumBytes != 0 {
+		t.Fatalf("unexpected storage usage for a user with no entries: %#v", usage)
+	}
+}
+
+func TestMetadataUpdates(t *testing.T) {
+	// Set up
+	InitDB()
+
+	// Register two devices
+	userId := data.UserId("mkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil))
+
+	// Submit an update, which should be delivered to both devices
+	update := data.MetadataUpdate{Kind: data.MetadataUpdateAddTag, DeviceId: devId1, EndTime: time.Unix(1000, 0), Tag: "golden"}
+	encUpdate, err := data.EncryptMetadataUpdate("mkey", update)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncMetadataUpdate{encUpdate})
+	testutils.Check(t, err)
+	addMetadataUpdatesHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+	for _, devId := range []string{devId1, devId2} {
+		w := httptest.NewRecorder()
+		getMetadataUpdatesHandler(w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+		var updates []shared.EncMetadataUpdate
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &updates))
+		if len(updates) != 1 || updates[0].DestinationDeviceId != devId {
+			t.Fatalf("expected 1 update for device %s, got %#v", devId, updates)
+		}
+		decUpdate, err := data.DecryptMetadataUpdate("mkey", updates[0])
+		testutils.Check(t, err)
+		if decUpdate.Tag != "golden" || decUpdate.DeviceId != devId1 || !decUpdate.EndTime.Equal(update.EndTime) {
+			t.Fatalf("unexpected decrypted update: %#v", decUpdate)
+		}
+	}
+
+	// Updates stop being returned once they've been read enough times
+	for i := 0; i < 5; i++ {
+		getMetadataUpdatesHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	}
+	w := httptest.NewRecorder()
+	getMetadataUpdatesHandler(w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected no more updates to be returned, got %s", w.Body.String())
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
 func TestLimitRegistrations(t *testing.T) {
 	// Set up
 	InitDB()
@@ -558,6 +657,7 @@ func TestCleanDatabaseNoErrors(t *testing.T) {
 	entry1.DeviceId = devId1
 	encEntry, err := data.EncryptHistoryEntry("dkey", entry1)
 	testutils.Check(t, err)
+	encEntry.DeviceId = devId1
 	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
 	submitReq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
@@ -591,3 +691,1033 @@ func TestWithPanicGuard(t *testing.T) {
 		t.Fatalf("expected 500 resp code for withPanicGuard")
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	InitDB()
+	GLOBAL_METRICS = newServerMetrics()
+	defer func() { GLOBAL_METRICS = nil }()
+
+	// Requests are counted by handler and status code, including ones that panic
+	handler := withPanicGuard(withLogging(healthCheckHandler))
+	for i := 0; i < 2; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	panicHandler := withPanicGuard(withLogging(func(w http.ResponseWriter, r *http.Request) { panic("oh no") }))
+	panicHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code from /metrics: %d", w.Code)
+	}
+	metrics := w.Body.String()
+	for _, expected := range []string{
+		"hishtory_http_requests_total{handler=\"healthCheckHandler\",code=\"200\"} 2\n",
+		",code=\"500\"} 1\n",
+		"hishtory_http_request_duration_seconds_bucket{handler=\"healthCheckHandler\",le=\"+Inf\"} 2\n",
+		"hishtory_http_request_duration_seconds_count{handler=\"healthCheckHandler\"} 2\n",
+		"# TYPE hishtory_db_open_connections gauge\n",
+		"# TYPE hishtory_entries_stored gauge\n",
+		"hishtory_active_devices{window=\"7d\"} ",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("expected metrics to contain %#v, got:\n%s", expected, metrics)
+		}
+	}
+}
+
+func TestStatsHandlers(t *testing.T) {
+	InitDB()
+
+	// Register a device and submit an entry so that there is usage data to aggregate
+	userId := data.UserId("dkey")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	entry := testutils.MakeFakeHistoryEntry("ls ~/")
+	entry.DeviceId = devId
+	encEntry, err := data.EncryptHistoryEntry("dkey", entry)
+	testutils.Check(t, err)
+	encEntry.DeviceId = devId
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	apiSubmitHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+
+	// The aggregates are built per SQL dialect, so check that they run against sqlite
+	w := httptest.NewRecorder()
+	usageStatsHandler(w, httptest.NewRequest(http.MethodGet, "/internal/api/v1/usage-stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code from the usage stats handler: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), time.Now().Format("2006-01-02")) {
+		t.Fatalf("expected the usage stats to include today's registration, got: %#v", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/internal/api/v1/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code from the stats handler: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Last registration: "+time.Now().Format("02 January 2006")) {
+		t.Fatalf("expected the stats to include today's registration, got: %#v", w.Body.String())
+	}
+}
+
+func TestAggregateTimeScan(t *testing.T) {
+	expected := time.Date(2023, 10, 16, 12, 34, 56, 789000000, time.UTC)
+	for _, value := range []interface{}{expected, "2023-10-16 12:34:56.789+00:00", []byte("2023-10-16 12:34:56.789")} {
+		var parsed aggregateTime
+		testutils.Check(t, parsed.Scan(value))
+		if !parsed.Valid || !parsed.Time.Equal(expected) {
+			t.Fatalf("failed to scan %#v, got %#v", value, parsed)
+		}
+	}
+	var null aggregateTime
+	testutils.Check(t, null.Scan(nil))
+	if null.Valid {
+		t.Fatalf("expected NULL to scan as an invalid time, got %#v", null)
+	}
+}
+
+type fakeBlobStore struct {
+	lock  sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *fakeBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blobs[key] = data
+	return nil
+}
+
+func (s *fakeBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("no blob with key %s", key)
+	}
+	return data, nil
+}
+
+func (s *fakeBlobStore) Delete(ctx context.Context, keys []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		delete(s.blobs, key)
+	}
+	return nil
+}
+
+func (s *fakeBlobStore) numBlobs() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.blobs)
+}
+
+func TestBlobStore(t *testing.T) {
+	InitDB()
+	_, err := deleteHistoryEntries(context.TODO(), GLOBAL_DB.Where("true"))
+	testutils.Check(t, err)
+	store := &fakeBlobStore{blobs: make(map[string][]byte)}
+	GLOBAL_BLOB_STORE = store
+	defer func() { GLOBAL_BLOB_STORE = nil }()
+
+	// Register two devices
+	userId := data.UserId("blobkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	for _, devId := range []string{devId1, devId2} {
+		apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	}
+	submit := func(command string) data.HistoryEntry {
+		entry := testutils.MakeFakeHistoryEntry(command)
+		encEntry, err := data.EncryptHistoryEntry("blobkey", entry)
+		testutils.Check(t, err)
+		encEntry.DeviceId = devId1
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+		testutils.Check(t, err)
+		apiSubmitHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+		return entry
+	}
+	query := func(deviceId string) []data.HistoryEntry {
+		w := httptest.NewRecorder()
+		apiBootstrapHandler(w, httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId, nil))
+		var encEntries []shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &encEntries))
+		entries := make([]data.HistoryEntry, 0)
+		for _, encEntry := range encEntries {
+			if encEntry.DeviceId != deviceId {
+				continue
+			}
+			entry, err := data.DecryptHistoryEntry("blobkey", encEntry)
+			testutils.Check(t, err)
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	// The encrypted data is stored in a single blob shared by the copies for each device
+	entry1 := submit("echo one")
+	entry2 := submit("echo two")
+	if store.numBlobs() != 2 {
+		t.Fatalf("expected 2 blobs, got %d", store.numBlobs())
+	}
+	var numInlineBytes int64
+	testutils.Check(t, GLOBAL_DB.Raw("SELECT COALESCE(SUM(LENGTH(encrypted_data)), 0) FROM enc_history_entries WHERE user_id = ?", userId).Row().Scan(&numInlineBytes))
+	if numInlineBytes != 0 {
+		t.Fatalf("expected the encrypted data to not be stored in the DB, found %d bytes", numInlineBytes)
+	}
+	for _, devId := range []string{devId1, devId2} {
+		entries := query(devId)
+		if len(entries) != 2 || !data.EntryEquals(entries[0], entry1) || !data.EntryEquals(entries[1], entry2) {
+			t.Fatalf("unexpected entries for device %s: %#v", devId, entries)
+		}
+	}
+
+	// The blobs are still counted towards storage usage
+	w := httptest.NewRecorder()
+	apiStorageUsageHandler(w, httptest.NewRequest(http.MethodGet, "/?user_id="+userId, nil))
+	var usage shared.StorageUsage
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	if usage.NumEntries != 4 || usage.NumBytes == 0 {
+		t.Fatalf("unexpected storage usage: %#v", usage)
+	}
+
+	// Blobs are only deleted once no device references them
+	deleteEntry := func(deviceId string, entry data.HistoryEntry) {
+		_, err := applyDeletionRequestsToBackend(context.TODO(), shared.DeletionRequest{
+			UserId:   userId,
+			Messages: shared.MessageIdentifiers{Ids: []shared.MessageIdentifier{{DeviceId: deviceId, Date: entry.EndTime}}},
+		})
+		testutils.Check(t, err)
+	}
+	deleteEntry(devId1, entry1)
+	if store.numBlobs() != 2 {
+		t.Fatalf("expected the blob to still be referenced by the other device, got %d blobs", store.numBlobs())
+	}
+	deleteEntry(devId2, entry1)
+	if store.numBlobs() != 1 {
+		t.Fatalf("expected the unreferenced blob to be deleted, got %d blobs", store.numBlobs())
+	}
+
+	// Entries can be migrated out of and back into object storage
+	numMigrated, err := migrateBlobs(context.TODO(), migrateToDb)
+	testutils.Check(t, err)
+	if numMigrated != 2 || store.numBlobs() != 0 {
+		t.Fatalf("unexpected migration to the DB: migrated %d entries, have %d blobs", numMigrated, store.numBlobs())
+	}
+	if entries := query(devId1); len(entries) != 1 || !data.EntryEquals(entries[0], entry2) {
+		t.Fatalf("unexpected entries after migrating to the DB: %#v", entries)
+	}
+	numMigrated, err = migrateBlobs(context.TODO(), migrateToObjectStorage)
+	testutils.Check(t, err)
+	if numMigrated != 2 || store.numBlobs() != 2 {
+		t.Fatalf("unexpected migration to object storage: migrated %d entries, have %d blobs", numMigrated, store.numBlobs())
+	}
+	if entries := query(devId2); len(entries) != 1 || !data.EntryEquals(entries[0], entry2) {
+		t.Fatalf("unexpected entries after migrating to object storage: %#v", entries)
+	}
+
+	// And cleaned up once they've been read
+	testutils.Check(t, GLOBAL_DB.Exec("UPDATE enc_history_entries SET read_count = 100 WHERE user_id = ?", userId).Error)
+	testutils.Check(t, cleanDatabase(context.TODO()))
+	if store.numBlobs() != 0 {
+		t.Fatalf("expected cleaning the DB to delete the blobs, got %d blobs", store.numBlobs())
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	// Bursts of up to the limit are allowed, and then tokens are refilled at the limit per minute
+	limiter := newRateLimiter(2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("a", now); !ok {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+	ok, retryAfter := limiter.allow("a", now)
+	if ok || retryAfter != 30*time.Second {
+		t.Fatalf("expected the request to be rate limited for 30s, got ok=%v retryAfter=%v", ok, retryAfter)
+	}
+	if ok, _ := limiter.allow("b", now); !ok {
+		t.Fatalf("expected other keys to have their own limit")
+	}
+	if ok, _ := limiter.allow("a", now.Add(30*time.Second)); !ok {
+		t.Fatalf("expected the bucket to have been refilled")
+	}
+
+	// Idle buckets are eventually dropped
+	limiter.allow("c", now.Add(rateLimiterSweepInterval+time.Second))
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("expected only the new bucket to remain, got %#v", limiter.buckets)
+	}
+
+	// And the number of buckets is capped
+	for i := 0; i < rateLimiterMaxBuckets+10; i++ {
+		limiter.allow(fmt.Sprintf("key-%d", i), now.Add(rateLimiterSweepInterval+time.Second))
+	}
+	if len(limiter.buckets) != rateLimiterMaxBuckets {
+		t.Fatalf("expected the number of buckets to be capped, got %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitedHandlers(t *testing.T) {
+	InitDB()
+	GLOBAL_DEVICE_RATE_LIMITER = newRateLimiter(1)
+	GLOBAL_IP_RATE_LIMITER = newRateLimiter(3)
+	// The address that httptest requests come from
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	testutils.Check(t, err)
+	GLOBAL_TRUSTED_PROXIES = trustedProxies
+	defer func() {
+		GLOBAL_DEVICE_RATE_LIMITER = nil
+		GLOBAL_IP_RATE_LIMITER = nil
+		GLOBAL_TRUSTED_PROXIES = nil
+	}()
+
+	userId := data.UserId("ratelimitkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	query := func(deviceId, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId, nil)
+		req.Header.Set("X-Real-Ip", ip)
+		apiQueryHandler(w, req)
+		return w
+	}
+	apiRegisterHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	apiRegisterHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil))
+
+	// Each device is limited separately
+	if w := query(devId1, "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("expected the first request to succeed, got %d", w.Code)
+	}
+	w := query(devId1, "1.2.3.4")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected the second request to be rate limited, got %d with Retry-After=%#v", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := query(devId2, "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("expected a request from another device to succeed, got %d", w.Code)
+	}
+
+	// And so is each IP, across devices
+	GLOBAL_DEVICE_RATE_LIMITER = nil
+	if w := query(devId1, "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("expected the third request from the IP to succeed, got %d", w.Code)
+	}
+	if w := query(devId2, "1.2.3.4"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP to be rate limited, got %d", w.Code)
+	}
+	if w := query(devId2, "5.6.7.8"); w.Code != http.StatusOK {
+		t.Fatalf("expected a request from another IP to succeed, got %d", w.Code)
+	}
+
+	// The client's IP is only read from the headers set by trusted proxies
+	request := func(remoteAddr string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+	for _, tc := range []struct {
+		req      *http.Request
+		expected string
+	}{
+		{request("203.0.113.7:1234", map[string]string{"X-Real-Ip": "1.2.3.4", "X-Forwarded-For": "1.2.3.4"}), "203.0.113.7"},
+		{request("192.0.2.1:1234", map[string]string{"X-Real-Ip": "1.2.3.4"}), "1.2.3.4"},
+		{request("192.0.2.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.1.2.3"}), "1.2.3.4"},
+		{request("192.0.2.1:1234", nil), "192.0.2.1"},
+	} {
+		if ip := getClientIp(tc.req); ip != tc.expected {
+			t.Fatalf("expected the client IP to be %#v, got %#v for %#v", tc.expected, ip, tc.req.Header)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/8,not-an-ip"); err == nil {
+		t.Fatalf("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	InitDB()
+	ctx := context.Background()
+	userId := data.UserId("adminkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	for _, devId := range []string{devId1, devId2} {
+		apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	}
+	encEntry, err := data.EncryptHistoryEntry("adminkey", testutils.MakeFakeHistoryEntry("echo admin"))
+	testutils.Check(t, err)
+	encEntry.DeviceId = devId1
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	apiSubmitHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+	countRows := func(model interface{}, column, deviceId string) int64 {
+		var count int64
+		testutils.Check(t, GLOBAL_DB.Model(model).Where("user_id = ? AND "+column+" = ?", userId, deviceId).Count(&count).Error)
+		return count
+	}
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		testutils.Check(t, runAdminCommand(ctx, &out, args))
+		return out.String()
+	}
+
+	// Listing users
+	out := run("users")
+	if !regexp.MustCompile(regexp.QuoteMeta(userId) + `\s+2\s+2\s`).MatchString(out) {
+		t.Fatalf("expected the user to be listed with 2 devices and 2 entries, got:\n%s", out)
+	}
+
+	// Storage statistics
+	out = run("storage", "-top", "1000")
+	if !strings.Contains(out, "Rows in devices:") || !strings.Contains(out, userId) {
+		t.Fatalf("unexpected storage statistics:\n%s", out)
+	}
+
+	// Cleaning up the entries queued for a device that is no longer registered
+	testutils.Check(t, GLOBAL_DB.Where("user_id = ? AND device_id = ?", userId, devId2).Delete(&shared.Device{}).Error)
+	out = run("gc-orphans", "-dry-run")
+	if !strings.Contains(out, "Would delete") || countRows(&shared.EncHistoryEntry{}, "device_id", devId2) != 1 {
+		t.Fatalf("expected a dry run to not delete anything, got:\n%s", out)
+	}
+	run("gc-orphans")
+	if countRows(&shared.EncHistoryEntry{}, "device_id", devId2) != 0 || countRows(&UsageData{}, "device_id", devId2) != 0 {
+		t.Fatalf("expected the orphaned entries to be deleted")
+	}
+	if countRows(&shared.EncHistoryEntry{}, "device_id", devId1) != 1 {
+		t.Fatalf("expected the entries for the registered device to be kept")
+	}
+
+	// Purging a user
+	out = run("purge-user", userId)
+	if out != "Purged user "+userId+": deleted 1 devices and 1 history entries\n" {
+		t.Fatalf("unexpected output from purging the user: %#v", out)
+	}
+	if countRows(&shared.EncHistoryEntry{}, "device_id", devId1) != 0 || countRows(&shared.Device{}, "device_id", devId1) != 0 || countRows(&UsageData{}, "device_id", devId1) != 0 {
+		t.Fatalf("expected all of the user's data to be deleted")
+	}
+
+	// Invalid commands
+	if err := runAdminCommand(ctx, io.Discard, []string{"purge-user"}); err == nil {
+		t.Fatalf("expected an error for a missing user ID")
+	}
+	if err := runAdminCommand(ctx, io.Discard, []string{"bogus"}); err == nil || !strings.Contains(err.Error(), "unknown admin command") {
+		t.Fatalf("expected an error for an unknown command, got %v", err)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	defer func(environ map[string]bool) {
+		environVars = environ
+		testutils.Check(t, initRateLimiters())
+	}(environVars)
+	environVars = nil
+	t.Setenv("HISHTORY_RATE_LIMIT_PER_DEVICE", "10")
+	configPath := filepath.Join(t.TempDir(), "config.env")
+	t.Setenv("HISHTORY_CONFIG_FILE", configPath)
+	t.Setenv("HISHTORY_MAX_NUM_USERS", "")
+	os.Unsetenv("HISHTORY_MAX_NUM_USERS")
+
+	// A config file that is explicitly configured must exist
+	if err := loadConfigFile(); err == nil {
+		t.Fatalf("expected an error for a missing config file")
+	}
+
+	// Options are read from the config file, but environment variables take precedence
+	testutils.Check(t, os.WriteFile(configPath, []byte(`# Limits
+HISHTORY_MAX_NUM_USERS=3
+export HISHTORY_RATE_LIMIT_PER_IP="60"
+HISHTORY_RATE_LIMIT_PER_DEVICE='1'
+`), 0o600))
+	testutils.Check(t, reloadConfig())
+	if getMaximumNumberOfAllowedUsers() != 3 || os.Getenv("HISHTORY_RATE_LIMIT_PER_DEVICE") != "10" {
+		t.Fatalf("unexpected config: max users=%d, HISHTORY_RATE_LIMIT_PER_DEVICE=%#v", getMaximumNumberOfAllowedUsers(), os.Getenv("HISHTORY_RATE_LIMIT_PER_DEVICE"))
+	}
+	if GLOBAL_IP_RATE_LIMITER == nil || GLOBAL_IP_RATE_LIMITER.burst != 60 || GLOBAL_DEVICE_RATE_LIMITER.burst != 10 {
+		t.Fatalf("expected the rate limiters to be configured by the config file")
+	}
+
+	// Reloading picks up changes, including removed options
+	testutils.Check(t, os.WriteFile(configPath, []byte("HISHTORY_MAX_NUM_USERS=5\n"), 0o600))
+	testutils.Check(t, reloadConfig())
+	if getMaximumNumberOfAllowedUsers() != 5 || GLOBAL_IP_RATE_LIMITER != nil {
+		t.Fatalf("expected the reloaded config to be applied")
+	}
+	if _, ok := os.LookupEnv("HISHTORY_RATE_LIMIT_PER_IP"); ok {
+		t.Fatalf("expected the removed option to be unset")
+	}
+
+	// Invalid lines are rejected without changing the config
+	testutils.Check(t, os.WriteFile(configPath, []byte("HISHTORY_MAX_NUM_USERS=7\nnot an option\n"), 0o600))
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected an error for the invalid line, got %v", err)
+	}
+	if getMaximumNumberOfAllowedUsers() != 5 {
+		t.Fatalf("expected the config to be unchanged")
+	}
+	testutils.Check(t, os.WriteFile(configPath, nil, 0o600))
+	testutils.Check(t, loadConfigFile())
+}
+
+func TestDefaultSqliteDb(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	t.Setenv("HISHTORY_DATA_DIR", dataDir)
+	dsn, err := getDefaultSqliteDsn()
+	testutils.Check(t, err)
+	if !strings.HasPrefix(dsn, "file:"+filepath.Join(dataDir, "hishtory.db")+"?") {
+		t.Fatalf("unexpected DSN: %#v", dsn)
+	}
+	if _, err := os.Stat(dataDir); err != nil {
+		t.Fatalf("expected the data directory to be created: %v", err)
+	}
+	t.Setenv("HISHTORY_DATA_DIR", "")
+	t.Setenv("XDG_DATA_HOME", "/xdg")
+	dir, err := getDataDir()
+	testutils.Check(t, err)
+	if dir != "/xdg/hishtory-server" {
+		t.Fatalf("unexpected data directory: %#v", dir)
+	}
+
+	// The server only uses the default sqlite DB (i.e. runs standalone) if no other DB is configured
+	if !isStandalone() {
+		t.Fatalf("expected the server to be standalone without a configured DB")
+	}
+	t.Setenv("HISHTORY_POSTGRES_DB", "postgresql://localhost/hishtory")
+	if isStandalone() {
+		t.Fatalf("expected the server not to be standalone with a configured DB")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	InitDB()
+	userId := data.UserId("compression-key")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	handler := withLogging(apiSubmitHandler)
+
+	// Submit a compressed batch of entries
+	var encEntries []shared.EncHistoryEntry
+	for i := 0; i < 20; i++ {
+		encEntry, err := data.EncryptHistoryEntry("compression-key", testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i)))
+		testutils.Check(t, err)
+		encEntry.DeviceId = devId
+		encEntries = append(encEntries, encEntry)
+	}
+	reqBody, err := json.Marshal(encEntries)
+	testutils.Check(t, err)
+	compressed := shared.CompressZstd(reqBody)
+	if len(compressed) >= len(reqBody) {
+		t.Fatalf("expected the batch to be smaller once compressed, got %d bytes from %d bytes", len(compressed), len(reqBody))
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "zstd")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(shared.ProtocolVersionHeader) != "2" {
+		t.Fatalf("unexpected response to a compressed submission: %d %#v", w.Code, w.Header())
+	}
+
+	// Unsupported and invalid encodings are rejected
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
+	req.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected an unsupported encoding to be rejected, got %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody))
+	req.Header.Set("Content-Encoding", "zstd")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid compressed body to be rejected, got %d", w.Code)
+	}
+
+	// Responses are only compressed for clients that accept zstd
+	query := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		withLogging(apiBootstrapHandler)(w, req)
+		return w
+	}
+	w = query("gzip")
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected an uncompressed response, got %#v", w.Header())
+	}
+	uncompressedBody := w.Body.Bytes()
+	for _, acceptEncoding := range []string{"zstd", "gzip, zstd;q=0.5"} {
+		w = query(acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "zstd" || w.Body.Len() >= len(uncompressedBody) {
+			t.Fatalf("expected a compressed response for Accept-Encoding=%#v, got %#v with %d bytes", acceptEncoding, w.Header(), w.Body.Len())
+		}
+		decompressed, err := shared.DecompressZstd(w.Body.Bytes(), maxDecompressedBodySize)
+		testutils.Check(t, err)
+		var retrieved []*shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal(decompressed, &retrieved))
+		if len(retrieved) != 20 {
+			t.Fatalf("expected 20 entries in the compressed response, got %d", len(retrieved))
+		}
+	}
+	if w = query("zstd;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected an uncompressed response for q=0, got %#v", w.Header())
+	}
+
+	// Bodies that decompress to more than the limit are rejected
+	if _, err := shared.DecompressZstd(shared.CompressZstd(make([]byte, 10_000)), 1000); err == nil {
+		t.Fatalf("expected an error for a body over the limit")
+	}
+}
+
+func TestReadOnlyDevices(t *testing.T) {
+	// Set up
+	InitDB()
+	userId := data.UserId("read-only-key")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	readOnlyDevId := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+readOnlyDevId+"&user_id="+userId+"&read_only=true", nil))
+
+	submit := func(handler http.HandlerFunc, query, srcDeviceId string) int {
+		entry := testutils.MakeFakeHistoryEntry("ls")
+		encEntry, err := data.EncryptHistoryEntry("read-only-key", entry)
+		testutils.Check(t, err)
+		encEntry.DeviceId = srcDeviceId
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+		testutils.Check(t, err)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/?"+query, bytes.NewReader(reqBody)))
+		return w.Code
+	}
+	countEntries := func(deviceId string) int64 {
+		var count int64
+		checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("device_id = ?", deviceId).Count(&count))
+		return count
+	}
+
+	// Uploads from the read-only device are rejected, but it still receives entries uploaded by other devices
+	if code := submit(apiSubmitHandler, "source_device_id="+readOnlyDevId, readOnlyDevId); code != http.StatusForbidden {
+		t.Fatalf("expected a submission from a read-only device to be rejected, got %d", code)
+	}
+	if code := submit(apiSubmitHandler, "", readOnlyDevId); code != http.StatusForbidden {
+		t.Fatalf("expected a submission from a read-only device without the source_device_id param to be rejected, got %d", code)
+	}
+	if code := submit(apiSubmitHandler, "", uuid.Must(uuid.NewRandom()).String()); code != http.StatusForbidden {
+		t.Fatalf("expected a submission from an unregistered device to be rejected, got %d", code)
+	}
+	if code := submit(apiSubmitDumpHandler, "user_id="+userId+"&source_device_id="+readOnlyDevId+"&requesting_device_id="+devId, ""); code != http.StatusForbidden {
+		t.Fatalf("expected a dump from a read-only device to be rejected, got %d", code)
+	}
+	if countEntries(devId) != 0 || countEntries(readOnlyDevId) != 0 {
+		t.Fatalf("expected no entries to be saved, got %d and %d", countEntries(devId), countEntries(readOnlyDevId))
+	}
+	if code := submit(apiSubmitHandler, "source_device_id="+devId, devId); code != http.StatusOK {
+		t.Fatalf("expected a submission from a normal device to succeed, got %d", code)
+	}
+	if countEntries(devId) != 1 || countEntries(readOnlyDevId) != 1 {
+		t.Fatalf("expected the entry to be saved for both devices, got %d and %d", countEntries(devId), countEntries(readOnlyDevId))
+	}
+
+	// Registering the device again doesn't change whether it is read-only, nor register a second device
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+readOnlyDevId+"&user_id="+userId+"&read_only=false", nil))
+	var numDevices int64
+	checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ?", userId).Count(&numDevices))
+	if numDevices != 2 {
+		t.Fatalf("expected 2 devices, got %d", numDevices)
+	}
+	if code := submit(apiSubmitHandler, "source_device_id="+readOnlyDevId, readOnlyDevId); code != http.StatusForbidden {
+		t.Fatalf("expected a submission from a re-registered read-only device to be rejected, got %d", code)
+	}
+	if countEntries(devId) != 1 || countEntries(readOnlyDevId) != 1 {
+		t.Fatalf("expected no more entries to be saved, got %d and %d", countEntries(devId), countEntries(readOnlyDevId))
+	}
+}
+
+func TestShares(t *testing.T) {
+	// Set up
+	InitDB()
+	ownerId := data.UserId("share-owner-key")
+	otherId := data.UserId("share-other-key")
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+uuid.Must(uuid.NewRandom()).String()+"&user_id="+ownerId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+uuid.Must(uuid.NewRandom()).String()+"&user_id="+otherId, nil))
+	readKey := data.ShareReadKey("share-owner-key", "runbook", "salt")
+	shareId := data.ShareId(readKey)
+
+	submit := func(userId string, commands ...string) int {
+		encEntries := make([]shared.EncSharedEntry, 0)
+		for _, command := range commands {
+			encEntry, err := data.EncryptSharedEntry(readKey, testutils.MakeFakeHistoryEntry(command))
+			testutils.Check(t, err)
+			encEntries = append(encEntries, encEntry)
+		}
+		reqBody, err := json.Marshal(encEntries)
+		testutils.Check(t, err)
+		w := httptest.NewRecorder()
+		submitSharedEntriesHandler(w, httptest.NewRequest(http.MethodPost, "/?share_id="+shareId+"&user_id="+userId, bytes.NewReader(reqBody)))
+		return w.Code
+	}
+	query := func() (int, []string) {
+		w := httptest.NewRecorder()
+		getSharedEntriesHandler(w, httptest.NewRequest(http.MethodGet, "/?share_id="+shareId, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var encEntries []shared.EncSharedEntry
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &encEntries))
+		commands := make([]string, 0)
+		for _, encEntry := range encEntries {
+			entry, err := data.DecryptSharedEntry(readKey, encEntry)
+			testutils.Check(t, err)
+			commands = append(commands, entry.Command)
+		}
+		sort.Strings(commands)
+		return w.Code, commands
+	}
+	revoke := func(userId string) int {
+		w := httptest.NewRecorder()
+		revokeShareHandler(w, httptest.NewRequest(http.MethodPost, "/?share_id="+shareId+"&user_id="+userId, nil))
+		return w.Code
+	}
+
+	// Shares that don't exist can't be read
+	if code, _ := query(); code != http.StatusNotFound {
+		t.Fatalf("expected a missing share to return a 404, got %d", code)
+	}
+
+	// The first submission creates the share, and later ones replace its entries
+	if code := submit(ownerId, "ls", "pwd"); code != http.StatusOK {
+		t.Fatalf("expected creating the share to succeed, got %d", code)
+	}
+	if code, commands := query(); code != http.StatusOK || !reflect.DeepEqual(commands, []string{"ls", "pwd"}) {
+		t.Fatalf("unexpected shared entries: code=%d, commands=%#v", code, commands)
+	}
+	if code := submit(ownerId, "ls", "make"); code != http.StatusOK {
+		t.Fatalf("expected updating the share to succeed, got %d", code)
+	}
+	if _, commands := query(); !reflect.DeepEqual(commands, []string{"ls", "make"}) {
+		t.Fatalf("unexpected shared entries after updating the share: %#v", commands)
+	}
+
+	// Only the owner can modify or revoke the share
+	if code := submit(otherId, "rm -rf /"); code != http.StatusForbidden {
+		t.Fatalf("expected another user's submission to be rejected, got %d", code)
+	}
+	if code := revoke(otherId); code != http.StatusForbidden {
+		t.Fatalf("expected another user's revocation to be rejected, got %d", code)
+	}
+	if _, commands := query(); !reflect.DeepEqual(commands, []string{"ls", "make"}) {
+		t.Fatalf("expected the share to be unchanged, got %#v", commands)
+	}
+
+	// And once it is revoked, its entries are deleted
+	if code := revoke(ownerId); code != http.StatusOK {
+		t.Fatalf("expected revoking the share to succeed, got %d", code)
+	}
+	if code, _ := query(); code != http.StatusNotFound {
+		t.Fatalf("expected a revoked share to return a 404, got %d", code)
+	}
+	var numEntries int64
+	checkGormResult(GLOBAL_DB.Model(&shared.EncSharedEntry{}).Where("share_id = ?", shareId).Count(&numEntries))
+	if numEntries != 0 {
+		t.Fatalf("expected the revoked share's entries to be deleted, got %d", numEntries)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestBootstrapFilters(t *testing.T) {
+	// Set up
+	InitDB()
+	userId := data.UserId("filter-key")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+
+	// Submit one entry with its hostname visible, and one without any visible fields
+	visibleEntry := testutils.MakeFakeHistoryEntry("ls")
+	visibleEntry.EndTime = time.Unix(2000, 0)
+	encVisibleEntry, err := data.EncryptHistoryEntry("filter-key", visibleEntry)
+	testutils.Check(t, err)
+	encVisibleEntry.DeviceId = devId
+	hostname := "build-server"
+	encVisibleEntry.Hostname = &hostname
+	hiddenEntry := testutils.MakeFakeHistoryEntry("pwd")
+	hiddenEntry.EndTime = time.Unix(1000, 0)
+	encHiddenEntry, err := data.EncryptHistoryEntry("filter-key", hiddenEntry)
+	testutils.Check(t, err)
+	encHiddenEntry.DeviceId = devId
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encVisibleEntry, encHiddenEntry})
+	testutils.Check(t, err)
+	apiSubmitHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+
+	bootstrap := func(filters string) (int, []string) {
+		w := httptest.NewRecorder()
+		apiBootstrapHandler(w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId+filters, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var encEntries []shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &encEntries))
+		commands := make([]string, 0)
+		for _, encEntry := range encEntries {
+			entry, err := data.DecryptHistoryEntry("filter-key", encEntry)
+			testutils.Check(t, err)
+			commands = append(commands, entry.Command)
+		}
+		sort.Strings(commands)
+		return w.Code, commands
+	}
+
+	// The end time is always visible, so it can be filtered on for every entry
+	if _, commands := bootstrap(""); !reflect.DeepEqual(commands, []string{"ls", "pwd"}) {
+		t.Fatalf("unexpected entries without filters: %#v", commands)
+	}
+	if _, commands := bootstrap("&after=1500"); !reflect.DeepEqual(commands, []string{"ls"}) {
+		t.Fatalf("unexpected entries after 1500: %#v", commands)
+	}
+	if _, commands := bootstrap("&before=1500"); !reflect.DeepEqual(commands, []string{"pwd"}) {
+		t.Fatalf("unexpected entries before 1500: %#v", commands)
+	}
+
+	// While other fields can only be filtered on for entries where they're visible
+	if _, commands := bootstrap("&hostname=build-server"); !reflect.DeepEqual(commands, []string{"ls"}) {
+		t.Fatalf("unexpected entries for hostname=build-server: %#v", commands)
+	}
+	if _, commands := bootstrap("&exit_code=2"); len(commands) != 0 {
+		t.Fatalf("expected no entries with a visible exit code, got %#v", commands)
+	}
+	if code, _ := bootstrap("&after=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid filter to be rejected, got %d", code)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	// Set up
+	InitDB()
+	userId := data.UserId("channel-key")
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+uuid.Must(uuid.NewRandom()).String()+"&user_id="+userId, nil))
+	teamKey := "team-key"
+	channelId := data.ChannelId(teamKey)
+
+	submit := func(userId string, commands ...string) int {
+		encEntries := make([]shared.EncChannelEntry, 0)
+		for _, command := range commands {
+			encEntry, err := data.EncryptChannelEntry(teamKey, testutils.MakeFakeHistoryEntry(command))
+			testutils.Check(t, err)
+			encEntries = append(encEntries, encEntry)
+		}
+		reqBody, err := json.Marshal(encEntries)
+		testutils.Check(t, err)
+		w := httptest.NewRecorder()
+		submitChannelEntriesHandler(w, httptest.NewRequest(http.MethodPost, "/?channel_id="+channelId+"&user_id="+userId, bytes.NewReader(reqBody)))
+		return w.Code
+	}
+	query := func(afterId uint64) ([]uint64, []string) {
+		w := httptest.NewRecorder()
+		getChannelEntriesHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/?channel_id=%s&after_id=%d", channelId, afterId), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected querying the channel to succeed, got %d", w.Code)
+		}
+		var encEntries []shared.EncChannelEntry
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &encEntries))
+		ids := make([]uint64, 0)
+		commands := make([]string, 0)
+		for _, encEntry := range encEntries {
+			entry, err := data.DecryptChannelEntry(teamKey, encEntry)
+			testutils.Check(t, err)
+			ids = append(ids, encEntry.Id)
+			commands = append(commands, entry.Command)
+		}
+		return ids, commands
+	}
+
+	// Unregistered users can't publish
+	if code := submit(data.UserId("unregistered-key"), "ls"); code != http.StatusForbidden {
+		t.Fatalf("expected an unregistered user's submission to be rejected, got %d", code)
+	}
+	if _, commands := query(0); len(commands) != 0 {
+		t.Fatalf("expected the channel to be empty, got %#v", commands)
+	}
+
+	// Channels are append-only, and entries are returned in the order they were published
+	if code := submit(userId, "ls", "pwd"); code != http.StatusOK {
+		t.Fatalf("expected publishing to succeed, got %d", code)
+	}
+	if code := submit(userId, "make"); code != http.StatusOK {
+		t.Fatalf("expected publishing to succeed, got %d", code)
+	}
+	ids, commands := query(0)
+	if !reflect.DeepEqual(commands, []string{"ls", "pwd", "make"}) {
+		t.Fatalf("unexpected channel entries: %#v", commands)
+	}
+
+	// And only entries published after the given ID are returned
+	if _, commands := query(ids[1]); !reflect.DeepEqual(commands, []string{"make"}) {
+		t.Fatalf("unexpected channel entries after id=%d: %#v", ids[1], commands)
+	}
+	if _, commands := query(ids[2]); len(commands) != 0 {
+		t.Fatalf("expected no channel entries after the last one, got %#v", commands)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestPurgeUser(t *testing.T) {
+	InitDB()
+	populate := func(secret string) string {
+		userId := data.UserId(secret)
+		deviceId := uuid.Must(uuid.NewRandom()).String()
+		apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId, nil))
+		entry := testutils.MakeFakeHistoryEntry("ls")
+		entry.DeviceId = deviceId
+		encEntry, err := data.EncryptHistoryEntry(secret, entry)
+		testutils.Check(t, err)
+		encEntry.DeviceId = deviceId
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+		testutils.Check(t, err)
+		apiSubmitHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+		shareId := uuid.Must(uuid.NewRandom()).String()
+		for _, row := range []interface{}{
+			&shared.DumpRequest{UserId: userId, RequestingDeviceId: deviceId, RequestTime: time.Now()},
+			&shared.DeletionRequest{UserId: userId, DestinationDeviceId: deviceId, SendTime: time.Now()},
+			&shared.EncMetadataUpdate{UserId: userId, DestinationDeviceId: deviceId, SendTime: time.Now()},
+			&shared.Feedback{UserId: userId, Date: time.Now(), Feedback: "bye"},
+			&UsageData{UserId: userId, DeviceId: uuid.Must(uuid.NewRandom()).String(), LastUsed: time.Now()},
+			&shared.Share{ShareId: shareId, OwnerUserId: userId, CreationDate: time.Now()},
+			&shared.EncSharedEntry{ShareId: shareId, Date: time.Now()},
+		} {
+			testutils.Check(t, GLOBAL_DB.Create(row).Error)
+		}
+		return userId
+	}
+	assertPurged := func(userId string) {
+		for _, model := range append([]interface{}{&shared.EncHistoryEntry{}}, userKeyedModels...) {
+			var count int64
+			testutils.Check(t, GLOBAL_DB.Model(model).Where("user_id = ?", userId).Count(&count).Error)
+			if count != 0 {
+				t.Fatalf("expected the user's rows in %s to be deleted, got %d", tableName(model), count)
+			}
+		}
+		var numShares, numSharedEntries int64
+		testutils.Check(t, GLOBAL_DB.Model(&shared.Share{}).Where("owner_user_id = ?", userId).Count(&numShares).Error)
+		testutils.Check(t, GLOBAL_DB.Model(&shared.EncSharedEntry{}).Where("share_id NOT IN (?)", GLOBAL_DB.Model(&shared.Share{}).Select("share_id")).Count(&numSharedEntries).Error)
+		if numShares != 0 || numSharedEntries != 0 {
+			t.Fatalf("expected the user's shares to be deleted, got %d shares and %d orphaned shared entries", numShares, numSharedEntries)
+		}
+	}
+	// Every user-keyed table is covered, so that new ones aren't missed
+	for _, model := range []interface{}{&shared.EncHistoryEntry{}, &shared.Device{}, &UsageData{}, &shared.DumpRequest{}, &shared.DeletionRequest{}, &shared.EncMetadataUpdate{}, &shared.Feedback{}, &shared.Share{}, &shared.EncSharedEntry{}, &shared.EncChannelEntry{}} {
+		if _, ok := model.(*shared.EncHistoryEntry); ok || !GLOBAL_DB.Migrator().HasColumn(model, "user_id") {
+			continue
+		}
+		found := false
+		for _, userKeyedModel := range userKeyedModels {
+			found = found || tableName(userKeyedModel) == tableName(model)
+		}
+		if !found {
+			t.Fatalf("expected %s to be purged along with the user", tableName(model))
+		}
+	}
+
+	// Deleting an account
+	userId := populate("purge-account-key")
+	otherUserId := populate("purge-other-key")
+	w := httptest.NewRecorder()
+	deleteAccountHandler(w, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected deleting the account to succeed, got %d", w.Code)
+	}
+	assertPurged(userId)
+
+	// And purging a user as an admin
+	var out bytes.Buffer
+	testutils.Check(t, runAdminCommand(context.Background(), &out, []string{"purge-user", otherUserId}))
+	assertPurged(otherUserId)
+
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	// Set up
+	InitDB()
+	userId := data.UserId("delete-account-key")
+	otherId := data.UserId("delete-account-other-key")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	otherDevId := uuid.Must(uuid.NewRandom()).String()
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil))
+	apiRegisterHandler(nil, httptest.NewRequest(http.MethodGet, "/?device_id="+otherDevId+"&user_id="+otherId, nil))
+	submit := func(secret, deviceId, command string) {
+		entry := testutils.MakeFakeHistoryEntry(command)
+		entry.DeviceId = deviceId
+		encEntry, err := data.EncryptHistoryEntry(secret, entry)
+		testutils.Check(t, err)
+		encEntry.DeviceId = deviceId
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+		testutils.Check(t, err)
+		apiSubmitHandler(nil, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBody)))
+	}
+	submit("delete-account-key", devId1, "ls")
+	submit("delete-account-other-key", otherDevId, "pwd")
+	readKey := data.ShareReadKey("delete-account-key", "runbook", "salt")
+	encEntry, err := data.EncryptSharedEntry(readKey, testutils.MakeFakeHistoryEntry("make"))
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncSharedEntry{encEntry})
+	testutils.Check(t, err)
+	submitSharedEntriesHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?share_id="+data.ShareId(readKey)+"&user_id="+userId, bytes.NewReader(reqBody)))
+
+	// Delete the account
+	w := httptest.NewRecorder()
+	deleteAccountHandler(w, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected deleting the account to succeed, got %d", w.Code)
+	}
+	var deletion shared.AccountDeletion
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &deletion))
+	if deletion.NumEntries != 2 || deletion.NumDevices != 2 || deletion.NumShares != 1 {
+		t.Fatalf("unexpected account deletion: %#v", deletion)
+	}
+
+	// Everything for the account is gone
+	countRows := func(model interface{}, column, value string) int64 {
+		var count int64
+		checkGormResult(GLOBAL_DB.Model(model).Where(column+" = ?", value).Count(&count))
+		return count
+	}
+	if n := countRows(&shared.EncHistoryEntry{}, "user_id", userId); n != 0 {
+		t.Fatalf("expected the account's entries to be deleted, got %d", n)
+	}
+	if n := countRows(&shared.Device{}, "user_id", userId); n != 0 {
+		t.Fatalf("expected the account's devices to be deleted, got %d", n)
+	}
+	if n := countRows(&UsageData{}, "user_id", userId); n != 0 {
+		t.Fatalf("expected the account's usage data to be deleted, got %d", n)
+	}
+	if n := countRows(&shared.EncSharedEntry{}, "share_id", data.ShareId(readKey)); n != 0 {
+		t.Fatalf("expected the account's shares to be deleted, got %d", n)
+	}
+
+	// But other accounts are untouched
+	if n := countRows(&shared.EncHistoryEntry{}, "user_id", otherId); n != 1 {
+		t.Fatalf("expected the other account's entries to be kept, got %d", n)
+	}
+	if n := countRows(&shared.Device{}, "user_id", otherId); n != 1 {
+		t.Fatalf("expected the other account's devices to be kept, got %d", n)
+	}
+
+	// Deleting an account that no longer exists is a no-op
+	w = httptest.NewRecorder()
+	deleteAccountHandler(w, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, nil))
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &deletion))
+	if w.Code != http.StatusOK || deletion.NumEntries != 0 || deletion.NumDevices != 0 || deletion.NumShares != 0 {
+		t.Fatalf("unexpected second account deletion: code=%d, deletion=%#v", w.Code, deletion)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
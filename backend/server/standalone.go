@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long in-flight requests are given to finish when the server is shut down
+const shutdownTimeout = 30 * time.Second
+
+// getDataDir returns the directory that the server stores its data in when it isn't configured to use an external
+// DB: $HISHTORY_DATA_DIR, or the hishtory-server directory in the XDG data directory
+func getDataDir() (string, error) {
+	if dataDir := os.Getenv("HISHTORY_DATA_DIR"); dataDir != "" {
+		return dataDir, nil
+	}
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); xdgDataHome != "" {
+		return filepath.Join(xdgDataHome, "hishtory-server"), nil
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the home directory for the default data directory, set HISHTORY_DATA_DIR instead: %w", err)
+	}
+	return filepath.Join(homedir, ".local", "share", "hishtory-server"), nil
+}
+
+// isPostgresConfigured returns whether the server was configured to use Postgres. Otherwise, and if no other DB is
+// configured, the server stores its data in sqlite so that self-hosting doesn't require running a separate DB.
+func isPostgresConfigured() bool {
+	return os.Getenv("HISHTORY_POSTGRES_DB") != "" || os.Getenv("POSTGRESQL_PASSWORD") != "" || isProductionEnvironment()
+}
+
+// isStandalone returns whether the server runs standalone, i.e. stores its data in the default sqlite DB in the data
+// directory since no other DB is configured
+func isStandalone() bool {
+	return os.Getenv("HISHTORY_SQLITE_DB") == "" && os.Getenv("HISHTORY_MYSQL_DB") == "" && !isPostgresConfigured()
+}
+
+// getDefaultSqliteDsn returns the DSN for the sqlite DB in the data directory, creating the directory if needed
+func getDefaultSqliteDsn() (string, error) {
+	dataDir, err := getDataDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the data directory: %w", err)
+	}
+	// WAL allows queries to run concurrently with writes, and the busy timeout makes concurrent writes wait for
+	// each other rather than failing
+	return "file:" + filepath.Join(dataDir, "hishtory.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", nil
+}
+
+// getListenAddr returns the address that the API is served on, configured via HISHTORY_LISTEN_ADDR
+func getListenAddr() string {
+	if addr := os.Getenv("HISHTORY_LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	return ":8080"
+}
+
+// The environment variables that were set by the config file, and the ones that were set before it was loaded.
+// Variables set in the environment take precedence over the config file.
+var (
+	configFileLock sync.Mutex
+	configFileVars = make(map[string]bool)
+	environVars    map[string]bool
+)
+
+// getConfigFilePath returns the path of the config file, which is $HISHTORY_CONFIG_FILE or config.env in the data
+// directory
+func getConfigFilePath() string {
+	if path := os.Getenv("HISHTORY_CONFIG_FILE"); path != "" {
+		return path
+	}
+	dataDir, err := getDataDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dataDir, "config.env")
+}
+
+// loadConfigFile loads the server's config file, if there is one. The file contains the same options as the
+// environment variables, as `KEY=VALUE` lines. It is re-read on SIGHUP, which updates the options that are read
+// while the server is running (e.g. the rate limits and HISHTORY_MAX_NUM_USERS). Options that are only read on
+// startup (e.g. the DB) require a restart.
+func loadConfigFile() error {
+	configFileLock.Lock()
+	defer configFileLock.Unlock()
+	if environVars == nil {
+		environVars = make(map[string]bool)
+		for _, kv := range os.Environ() {
+			environVars[strings.SplitN(kv, "=", 2)[0]] = true
+		}
+	}
+	path := getConfigFilePath()
+	if path == "" {
+		return nil
+	}
+	vars, err := parseConfigFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && os.Getenv("HISHTORY_CONFIG_FILE") == "" {
+			vars = make(map[string]string)
+		} else {
+			return err
+		}
+	}
+	// Unset the options that were removed from the config file
+	for key := range configFileVars {
+		if _, ok := vars[key]; !ok {
+			os.Unsetenv(key)
+			delete(configFileVars, key)
+		}
+	}
+	for key, val := range vars {
+		if environVars[key] {
+			continue
+		}
+		if err := os.Setenv(key, val); err != nil {
+			return fmt.Errorf("failed to set %s from the config file: %w", key, err)
+		}
+		configFileVars[key] = true
+	}
+	return nil
+}
+
+func parseConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the config file: %w", err)
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("failed to parse line %d of %s, expected KEY=VALUE", lineNum, path)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			if val[0] == '"' {
+				unquoted, err := strconv.Unquote(val)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the value on line %d of %s: %w", lineNum, path, err)
+				}
+				val = unquoted
+			} else {
+				val = val[1 : len(val)-1]
+			}
+		}
+		vars[key] = val
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// reloadConfig re-reads the config file and applies the options that can be changed while the server is running
+func reloadConfig() error {
+	if err := loadConfigFile(); err != nil {
+		return err
+	}
+	return initRateLimiters()
+}
+
+// serve serves the API until the server receives SIGINT or SIGTERM, at which point it stops accepting new
+// connections and waits for in-flight requests to finish. SIGHUP reloads the config file.
+func serve(handler http.Handler) error {
+	server := &http.Server{Addr: getListenAddr(), Handler: handler}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	shutdownErr := make(chan error, 1)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					fmt.Printf("Failed to reload the config: %v\n", err)
+				} else {
+					fmt.Println("Reloaded the config")
+				}
+				continue
+			}
+			fmt.Printf("Received %s, shutting down\n", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			shutdownErr <- server.Shutdown(ctx)
+			cancel()
+			return
+		}
+	}()
+	fmt.Printf("Listening on %s\n", server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-shutdownErr; err != nil {
+		return fmt.Errorf("failed to shut down gracefully: %w", err)
+	}
+	if sqlDb, err := GLOBAL_DB.DB(); err == nil {
+		sqlDb.Close()
+	}
+	return nil
+}
@@ -344,7 +344,7 @@ func testBasicUserFlow(t *testing.T, tester shellTester, onlineStatus OnlineStat
 	if err != nil {
 		t.Fatalf("failed to get homedir: %v", err)
 	}
-	dat, err := os.ReadFile(path.Join(homedir, data.GetHishtoryPath(), "config.sh"))
+	dat, err := os.ReadFile(path.Join(data.GetHishtoryDir(homedir), "config.sh"))
 	if err != nil {
 		t.Fatalf("failed to read config.sh: %v", err)
 	}
@@ -1000,7 +1000,7 @@ CGO_ENABLED=0 go build -o /tmp/client
 	if err != nil {
 		t.Fatalf("failed to get homedir: %v", err)
 	}
-	dat, err := os.ReadFile(path.Join(homedir, data.GetHishtoryPath(), "config.sh"))
+	dat, err := os.ReadFile(path.Join(data.GetHishtoryDir(homedir), "config.sh"))
 	if err != nil {
 		t.Fatalf("failed to read config.sh: %v", err)
 	}
@@ -1367,7 +1367,7 @@ func TestStripBashTimePrefix(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	f, err := os.OpenFile(path.Join(homedir, data.GetHishtoryPath(), "config.sh"),
+	f, err := os.OpenFile(path.Join(data.GetHishtoryDir(homedir), "config.sh"),
 		os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		t.Fatal(err)
@@ -1392,7 +1392,7 @@ func TestStripBashTimePrefix(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	f, err = os.OpenFile(path.Join(homedir, data.GetHishtoryPath(), "config.sh"),
+	f, err = os.OpenFile(path.Join(data.GetHishtoryDir(homedir), "config.sh"),
 		os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		t.Fatal(err)
@@ -1721,7 +1721,7 @@ func clearControlRSearchFromConfig(t *testing.T) {
 	configContents = []byte(strings.ReplaceAll(string(configContents), "enable_control_r_search", "something-else"))
 	homedir, err := os.UserHomeDir()
 	testutils.Check(t, err)
-	err = os.WriteFile(path.Join(homedir, data.GetHishtoryPath(), data.CONFIG_PATH), configContents, 0o644)
+	err = os.WriteFile(path.Join(data.GetHishtoryConfigDir(homedir), data.CONFIG_PATH), configContents, 0o644)
 	testutils.Check(t, err)
 }
 
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var agentRunLifetime *string
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Manage the hishtory agent, which makes searching your history (e.g. via control-r) faster",
+	Long: "The hishtory agent is a background process (like ssh-agent) that keeps your secret key and the history DB open, so that searches don't have to load them on every invocation. " +
+		"It keeps running until you run `hishtory agent stop` or restart your machine. If your secret key is encrypted with a passphrase, `hishtory unlock` starts the agent.",
+	GroupID: GROUP_ID_CONFIG,
+}
+
+var agentStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start the hishtory agent in the background",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if hctx.IsAgentRunning() {
+			fmt.Println("The hishtory agent is already running")
+			return
+		}
+		locked, err := hctx.IsLocked()
+		lib.CheckFatalError(err)
+		if locked {
+			promptAndUnlock()
+			return
+		}
+		lib.CheckFatalError(hctx.StartAgent("", 0))
+	},
+}
+
+var agentStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the hishtory agent. If your secret key is encrypted with a passphrase, this is the same as `hishtory lock`.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.StopAgent())
+	},
+}
+
+var agentStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print whether the hishtory agent is running",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if hctx.IsAgentRunning() {
+			fmt.Println("The hishtory agent is running")
+		} else {
+			fmt.Println("The hishtory agent isn't running")
+		}
+	},
+}
+
+var agentRunCmd = &cobra.Command{
+	Use:    "run",
+	Hidden: true,
+	Short:  "[Internal-only] Run the hishtory agent in the foreground, with the decrypted secret key (if any) read from stdin",
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		lib.CheckFatalError(err)
+		lifetime, err := time.ParseDuration(*agentRunLifetime)
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(hctx.RunAgent(strings.TrimSuffix(secret, "\n"), lifetime))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentStartCmd)
+	agentCmd.AddCommand(agentStopCmd)
+	agentCmd.AddCommand(agentStatusCmd)
+	agentCmd.AddCommand(agentRunCmd)
+	agentRunLifetime = agentRunCmd.Flags().String("lifetime", "0s", "How long the agent runs for, or 0 to run until it is stopped")
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var atomsMarkdown *bool
+
+var atomsCmd = &cobra.Command{
+	Use:     "atoms",
+	Short:   "List the atoms (e.g. cwd:/tmp or exit_code:1) that can be used to filter queries, with examples",
+	Long:    "Lists every atom that is supported in queries, including atoms for your custom columns. Pass --markdown to output a Markdown table, e.g. for documentation. Use 'hishtory query --check QUERY' to check a query for mistakes.",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.WriteAtomsDocumentation(ctx, os.Stdout, *atomsMarkdown))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(atomsCmd)
+	atomsMarkdown = atomsCmd.Flags().Bool("markdown", false, "Output a Markdown table")
+}
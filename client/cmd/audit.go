@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var auditLimit *int
+var auditAction *string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show the log of destructive actions, e.g. to find out where entries went",
+	Long: "hishtory keeps a local, append-only audit log of actions that delete entries (redactions, deletions from the TUI, " +
+		"deletion requests from other devices, pruning, rollbacks), rotate the secret key or encryption provider, or change " +
+		"the config. Each action is recorded with the time and the hishtory command that did it. The audit log only records " +
+		"how many entries were affected, never the commands themselves, so redacted secrets aren't kept in it.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		entries, err := lib.GetAuditLog(ctx, *auditAction, *auditLimit)
+		lib.CheckFatalError(err)
+		if len(entries) == 0 {
+			fmt.Println("The audit log is empty")
+			return
+		}
+		tbl := table.New("Time", "Action", "Details", "Command")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, entry := range entries {
+			tbl.AddRow(entry.Timestamp.Format(hctx.GetConf(ctx).TimestampFormat), entry.Action, entry.Details, entry.Command)
+		}
+		tbl.Print()
+	},
+}
+
+// auditCommandPath returns how the given command is shown in the audit log, e.g. `hishtory config-set proxy-url`
+func auditCommandPath(cmd *cobra.Command) string {
+	return strings.Join(append([]string{"hishtory"}, strings.Fields(cmd.CommandPath())[1:]...), " ")
+}
+
+// isConfigCommand returns whether the given command is one of the config-set, config-add, or config-delete
+// subcommands, whose changes are recorded in the audit log
+func isConfigCommand(cmd *cobra.Command) bool {
+	for c := cmd.Parent(); c != nil; c = c.Parent() {
+		if c == configSetCmd || c == configAddCmd || c == configDeleteCmd {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditLimit = auditCmd.Flags().Int("limit", 100, "The maximum number of actions to show, newest first (0 for no limit)")
+	auditAction = auditCmd.Flags().String("action", "", "Only show actions of this kind, e.g. redact or remote-delete")
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var backupIncremental *bool
+var backupOutput *string
+var restoreSecretKey *string
+
+var backupCmd = &cobra.Command{
+	Use:     "backup",
+	Short:   "Create an encrypted backup of your local history DB and config",
+	Long:    "Creates a single archive containing your history DB and config, encrypted with your secret key. Use --output - to write the backup to stdout (e.g. to pipe it to a cloud storage tool), and --incremental to only back up the entries recorded since the last backup.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Note that this doesn't use hctx.MakeContext() since CreateBackup opens the DB itself
+		config, err := hctx.GetConfig()
+		lib.CheckFatalError(err)
+		outputPath := *backupOutput
+		if outputPath == "" {
+			outputPath = fmt.Sprintf("hishtory-backup-%s.hbak", time.Now().Format("20060102-150405"))
+		}
+		var out io.Writer = os.Stdout
+		if outputPath != "-" {
+			f, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			lib.CheckFatalError(err)
+			defer f.Close()
+			out = f
+		}
+		manifest, err := lib.CreateBackup(out, config, *backupIncremental)
+		if err != nil && outputPath != "-" {
+			os.Remove(outputPath)
+		}
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.LastBackupTimestamp = manifest.CreatedAt.Unix()
+		}))
+		if outputPath != "-" {
+			fmt.Fprintf(os.Stderr, "Backed up %d entries to %s\n", manifest.NumEntries, outputPath)
+		}
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:     "restore BACKUP_FILE",
+	Short:   "Restore a backup created by `hishtory backup`",
+	Long:    "Restores a backup created by `hishtory backup`. Restoring a full backup replaces your local history DB and config, while restoring an incremental backup adds its entries to your local history DB. Pass - to read the backup from stdin.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// There is no config if this is restoring onto a new install
+		config, configErr := hctx.LoadConfig()
+		secretKey := *restoreSecretKey
+		if secretKey == "" {
+			if configErr != nil {
+				lib.CheckFatalError(fmt.Errorf("failed to read the current secret key, pass the secret key that was used to create the backup via --secret-key: %w", configErr))
+			}
+			secretKey = config.UserSecret
+		}
+		var in io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			lib.CheckFatalError(err)
+			defer f.Close()
+			in = f
+		}
+		manifest, err := lib.RestoreBackup(in, config, secretKey)
+		lib.CheckFatalError(err)
+		if manifest.Incremental {
+			fmt.Printf("Restored %d entries from an incremental backup created at %s\n", manifest.NumEntries, manifest.CreatedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("Restored %d entries and your config from a backup created at %s\n", manifest.NumEntries, manifest.CreatedAt.Format(time.RFC3339))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	backupIncremental = backupCmd.Flags().Bool("incremental", false, "Only back up the entries recorded since the last backup")
+	backupOutput = backupCmd.Flags().StringP("output", "o", "", "The path to write the backup to, or - for stdout (defaults to a timestamped file in the current directory)")
+	restoreSecretKey = restoreCmd.Flags().String("secret-key", "", "The secret key that was used to create the backup (defaults to the current secret key)")
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var channelCmd = &cobra.Command{
+	Use:   "channel",
+	Short: "Publish commands to team channels that your teammates subscribe to",
+	Long: "Channels let a team share the commands they run, e.g. everything run against production. Each member chooses which of " +
+		"their commands are published to the channel with a query (e.g. `kubectl` or `tag:prod`). Channel entries are encrypted " +
+		"with a team key that is separate from your secret key, and teammates' commands are only shown when searching for " +
+		"them with `channel:NAME`.",
+	GroupID: GROUP_ID_MANAGEMENT,
+}
+
+var channelCreateCmd = &cobra.Command{
+	Use:   "create NAME [PUBLISH_QUERY]",
+	Short: "Create a new team channel",
+	Long:  "Creates a new team channel, and prints the command that teammates can run to join it. If PUBLISH_QUERY is given, the commands you run from now on that match it are published to the channel.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		teamKey, err := lib.CreateChannel(ctx, args[0], strings.Join(args[1:], " "))
+		lib.CheckFatalError(err)
+		fmt.Printf("Created the channel %#v. To join it, teammates can run:\n\n  hishtory channel join %s %s [PUBLISH_QUERY]\n\n", args[0], args[0], teamKey)
+		fmt.Println("Anyone with this team key can read and publish to the channel.")
+	},
+}
+
+var channelJoinCmd = &cobra.Command{
+	Use:   "join NAME TEAM_KEY [PUBLISH_QUERY]",
+	Short: "Join a teammate's channel",
+	Long:  "Joins the channel with the given team key, so that the commands published to it can be searched with `channel:NAME`. If PUBLISH_QUERY is given, the commands you run from now on that match it are published to the channel.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		numEntries, err := lib.JoinChannel(ctx, args[0], args[1], strings.Join(args[2:], " "))
+		lib.CheckFatalError(err)
+		fmt.Printf("Joined the channel %#v and received %d entries, search for them with `channel:%s`\n", args[0], numEntries, args[0])
+	},
+}
+
+var channelPublishCmd = &cobra.Command{
+	Use:   "publish NAME [PUBLISH_QUERY]",
+	Short: "Change which of your commands are published to a channel",
+	Long:  "Sets the query that selects which of the commands you run are published to the channel. Omitting PUBLISH_QUERY stops publishing to the channel, while still receiving your teammates' commands.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		publishQuery := strings.Join(args[1:], " ")
+		lib.CheckFatalError(lib.SetChannelPublishQuery(ctx, args[0], publishQuery))
+		if publishQuery == "" {
+			fmt.Printf("Stopped publishing to the channel %#v\n", args[0])
+		} else {
+			fmt.Printf("Commands matching %#v will be published to the channel %#v\n", publishQuery, args[0])
+		}
+	},
+}
+
+var channelLeaveCmd = &cobra.Command{
+	Use:   "leave NAME",
+	Short: "Leave a channel and delete the entries received from it",
+	Long:  "Stops syncing the channel and deletes your teammates' entries that were received from it. The commands you already published to the channel stay in it.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		numDeleted, err := lib.LeaveChannel(ctx, args[0])
+		lib.CheckFatalError(err)
+		fmt.Printf("Left the channel %#v and deleted the %d entries received from it\n", args[0], numDeleted)
+	},
+}
+
+var channelSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Publish to and receive from channels now",
+	Long:  "Channels are normally synced at most once every five minutes after you run a command. This syncs them immediately.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.SyncChannels(ctx, true))
+	},
+}
+
+var channelListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the channels you are in",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		tbl := table.New("Name", "Publish Query", "Team Key")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, channel := range config.Channels {
+			tbl.AddRow(channel.Name, channel.PublishQuery, channel.TeamKey)
+		}
+		tbl.Print()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(channelCmd)
+	channelCmd.AddCommand(channelCreateCmd)
+	channelCmd.AddCommand(channelJoinCmd)
+	channelCmd.AddCommand(channelPublishCmd)
+	channelCmd.AddCommand(channelLeaveCmd)
+	channelCmd.AddCommand(channelSyncCmd)
+	channelCmd.AddCommand(channelListCmd)
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var compactCmd = &cobra.Command{
+	Use:     "compact",
+	Short:   "Shrink the local DB file after deleting history entries",
+	Long:    "sqlite doesn't shrink the DB file when entries are deleted (e.g. via `hishtory prune` or `hishtory redact`), and instead keeps the freed space around for reuse. This releases that space and reports how much was reclaimed. It is safe to run while other shells are recording commands. Run `hishtory status -v` to see how much space can be reclaimed.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		result, err := lib.CompactDb(ctx)
+		lib.CheckFatalError(err)
+		fmt.Printf("Compacted the DB from %s to %s (reclaimed %s)\n", lib.FormatBytes(result.BytesBefore), lib.FormatBytes(result.BytesAfter), lib.FormatBytes(result.BytesReclaimed()))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(compactCmd)
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
 	"github.com/spf13/cobra"
@@ -22,13 +24,12 @@ var addCustomColumnsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		columnName := args[0]
 		command := args[1]
-		ctx := hctx.MakeContext()
-		config := hctx.GetConf(ctx)
-		if config.CustomColumns == nil {
-			config.CustomColumns = make([]hctx.CustomColumnDefinition, 0)
-		}
-		config.CustomColumns = append(config.CustomColumns, hctx.CustomColumnDefinition{ColumnName: columnName, ColumnCommand: command})
-		lib.CheckFatalError(hctx.SetConfig(config))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if config.CustomColumns == nil {
+				config.CustomColumns = make([]hctx.CustomColumnDefinition, 0)
+			}
+			config.CustomColumns = append(config.CustomColumns, hctx.CustomColumnDefinition{ColumnName: columnName, ColumnCommand: command})
+		}))
 	},
 }
 
@@ -36,12 +37,175 @@ var addDisplayedColumnsCmd = &cobra.Command{
 	Use:   "displayed-columns",
 	Short: "Add a column to be displayed",
 	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			vals := args
+			config.DisplayedColumns = append(config.DisplayedColumns, vals...)
+		}))
+	},
+}
+
+var addRetentionRuleCmd = &cobra.Command{
+	Use:   "retention-rule MAX_AGE [KEEP_QUERY]",
+	Short: "Add a rule that prunes entries older than MAX_AGE (e.g. 90d or 2y), except for those matching KEEP_QUERY (e.g. exit_code:0)",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		rule := hctx.RetentionRule{MaxAge: args[0]}
+		if len(args) == 2 {
+			rule.KeepQuery = args[1]
+		}
+		lib.CheckFatalError(lib.ValidateRetentionRule(ctx, rule))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.RetentionPolicy = append(config.RetentionPolicy, rule)
+		}))
+	},
+}
+
+var addRuleCmd = &cobra.Command{
+	Use:   "rule NAME QUERY ACTION...",
+	Short: "Add a rule that runs ACTIONs for every command matching QUERY (e.g. `hishtory config-add rule deploys 'deploy.sh exit_code:0' tag:deploy notify`)",
+	Long: "Each ACTION is one of:\n" +
+		"  append:PATH    Append the entry to the file at PATH as a line of JSON\n" +
+		"  run:SCRIPT     Run SCRIPT via bash, with the entry as JSON on stdin and the rule name in $HISHTORY_RULE_NAME\n" +
+		"  tag:TAG        Add TAG to the entry\n" +
+		"  notify[:MSG]   Send a desktop notification, where MSG supports the same placeholders as `hishtory last --format`\n" +
+		"  pin            Pin (bookmark) the entry so that it is displayed first in the TUI\n" +
+		"Actions run in order once the command is saved.",
+	Args: cobra.MinimumNArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := hctx.MakeContext()
-		config := hctx.GetConf(ctx)
-		vals := args
-		config.DisplayedColumns = append(config.DisplayedColumns, vals...)
-		lib.CheckFatalError(hctx.SetConfig(config))
+		rule := hctx.Rule{Name: args[0], Query: args[1]}
+		for _, arg := range args[2:] {
+			action, err := lib.ParseRuleAction(arg)
+			lib.CheckFatalError(err)
+			rule.Actions = append(rule.Actions, action)
+		}
+		lib.CheckFatalError(lib.ValidateRule(ctx, rule))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			for _, existing := range config.Rules {
+				if existing.Name == rule.Name {
+					log.Fatalf("There is already a rule named %#v, delete it first via `hishtory config-delete rule %s`", rule.Name, rule.Name)
+				}
+			}
+			config.Rules = append(config.Rules, rule)
+		}))
+	},
+}
+
+var addTuiMacroCmd = &cobra.Command{
+	Use:   "tui-macro NAME KEY KEYS...",
+	Short: "Add a macro that replays KEYS when KEY is pressed in the TUI (e.g. `hishtory config-add tui-macro failed alt+1 e x i t _ c o d e : 1`). Macros can also be recorded in the TUI via ctrl+g.",
+	Args:  cobra.MinimumNArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(lib.SaveTuiMacro(hctx.TuiMacro{Name: args[0], Key: args[1], Keys: args[2:]}))
+	},
+}
+
+var addEnvSnapshotVariablesCmd = &cobra.Command{
+	Use:   "env-snapshot-variables NAME...",
+	Short: "Record the value of the given environment variables (e.g. AWS_PROFILE) with every command, so they can be searched via `env:NAME=value`",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := hctx.GetConfig()
+		lib.CheckFatalError(err)
+		names := config.EnvSnapshotVariables
+		for _, name := range args {
+			isDuplicate := false
+			for _, existing := range names {
+				if existing == name {
+					isDuplicate = true
+				}
+			}
+			if !isDuplicate {
+				names = append(names, name)
+			}
+		}
+		lib.CheckFatalError(lib.ValidateEnvSnapshotVariables(names))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.EnvSnapshotVariables = names
+		}))
+	},
+}
+
+var addDefaultFiltersCmd = &cobra.Command{
+	Use:                "default-filters FILTER...",
+	Short:              "Add filters (e.g. `-exit_code:130` or `after:2y`) that are applied to every interactive search, unless the query already filters on the same field",
+	DisableFlagParsing: true,
+	Args:               cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		filters := hctx.GetConf(ctx).DefaultFilters
+		for _, filter := range args {
+			lib.CheckFatalError(lib.ValidateDefaultFilter(ctx, filter))
+			isDuplicate := false
+			for _, existing := range filters {
+				if existing == filter {
+					isDuplicate = true
+				}
+			}
+			if !isDuplicate {
+				filters = append(filters, filter)
+			}
+		}
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.DefaultFilters = filters
+		}))
+	},
+}
+
+var addMcpRedactionPatternsCmd = &cobra.Command{
+	Use:   "mcp-redaction-patterns REGEX...",
+	Short: "Add regexes for secrets that are redacted from the history returned by `hishtory mcp`",
+	Long: "Matches are replaced with [REDACTED]. If a regex has capturing groups, only the groups are redacted, " +
+		"e.g. `--password[= ](\\S+)` keeps the flag but redacts its value.",
+	DisableFlagParsing: true,
+	Args:               cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, pattern := range args {
+			lib.CheckFatalError(lib.ValidateMcpRedactionPattern(pattern))
+		}
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			for _, pattern := range args {
+				isDuplicate := false
+				for _, existing := range config.McpRedactionPatterns {
+					if existing == pattern {
+						isDuplicate = true
+					}
+				}
+				if !isDuplicate {
+					config.McpRedactionPatterns = append(config.McpRedactionPatterns, pattern)
+				}
+			}
+		}))
+	},
+}
+
+var addServerVisibleFieldsCmd = &cobra.Command{
+	Use:       "server-visible-fields FIELD...",
+	Short:     "Also store the given fields of new history entries unencrypted, so that the sync server can filter on them",
+	Long:      "By default, everything except for the time that each command finished is end-to-end encrypted. This stores the given fields (start_time, device_id, hostname, or exit_code) unencrypted too, for entries that are uploaded from now on.",
+	Args:      cobra.MinimumNArgs(1),
+	ValidArgs: lib.VisibleFields,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := hctx.GetConfig()
+		lib.CheckFatalError(err)
+		fields := config.ServerVisibleFields
+		for _, field := range args {
+			isDuplicate := false
+			for _, existing := range fields {
+				if existing == field {
+					isDuplicate = true
+				}
+			}
+			if !isDuplicate {
+				fields = append(fields, field)
+			}
+		}
+		lib.CheckFatalError(lib.ValidateServerVisibleFields(fields))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.ServerVisibleFields = fields
+		}))
 	},
 }
 
@@ -49,4 +213,11 @@ func init() {
 	rootCmd.AddCommand(configAddCmd)
 	configAddCmd.AddCommand(addCustomColumnsCmd)
 	configAddCmd.AddCommand(addDisplayedColumnsCmd)
+	configAddCmd.AddCommand(addRetentionRuleCmd)
+	configAddCmd.AddCommand(addRuleCmd)
+	configAddCmd.AddCommand(addTuiMacroCmd)
+	configAddCmd.AddCommand(addEnvSnapshotVariablesCmd)
+	configAddCmd.AddCommand(addDefaultFiltersCmd)
+	configAddCmd.AddCommand(addMcpRedactionPatternsCmd)
+	configAddCmd.AddCommand(addServerVisibleFieldsCmd)
 }
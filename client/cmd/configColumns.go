@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var configColumnsCmd = &cobra.Command{
+	Use:     "config-columns",
+	Short:   "Develop and debug custom columns",
+	GroupID: GROUP_ID_CONFIG,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(cmd.Help())
+	},
+}
+
+var configColumnsDevCmd = &cobra.Command{
+	Use:   "dev [COLUMN_NAME...]",
+	Short: "Run the commands for your custom columns and show their output",
+	Long:  "Runs the command for each of your custom columns (or just the given ones) in the current environment, and shows the value that would be recorded along with how long the command took and any errors. Custom column commands run every time a command is recorded, so columns that take longer than " + lib.CustomColumnLatencyBudget.String() + " are flagged since they will slow down every prompt.",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		results, err := lib.RunCustomColumns(ctx, args)
+		lib.CheckFatalError(err)
+		if len(results) == 0 {
+			fmt.Println("There are no custom columns configured, add one with `hishtory config-add custom-columns`")
+			return
+		}
+		tbl := table.New("Column", "Output", "Time", "Error")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		var total time.Duration
+		for _, r := range results {
+			errMsg := ""
+			if r.Err != nil {
+				errMsg = r.Err.Error()
+				if r.Stderr != "" {
+					errMsg += ": " + r.Stderr
+				}
+			}
+			tbl.AddRow(r.Name, collapseNewlines(r.Output), r.Duration.Round(time.Millisecond/10), collapseNewlines(errMsg))
+			total += r.Duration
+		}
+		tbl.Print()
+		fmt.Printf("\nTotal: %s (budget: %s per column)\n", total.Round(time.Millisecond/10), lib.CustomColumnLatencyBudget)
+		for _, r := range results {
+			if r.IsOverBudget() {
+				fmt.Printf("Warning: the custom column %#v took %s, which will slow down every prompt. Consider caching its value or making its command faster.\n", r.Name, r.Duration.Round(time.Millisecond))
+			}
+		}
+	},
+}
+
+// collapseNewlines puts multi-line values on a single line so that they fit in a table row
+func collapseNewlines(s string) string {
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func init() {
+	rootCmd.AddCommand(configColumnsCmd)
+	configColumnsCmd.AddCommand(configColumnsDevCmd)
+}
@@ -22,25 +22,24 @@ var deleteCustomColumnsCmd = &cobra.Command{
 	Short: "Delete a custom column",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := hctx.MakeContext()
-		config := hctx.GetConf(ctx)
-		columnName := args[0]
-		if config.CustomColumns == nil {
-			log.Fatalf("Did not find a column with name %#v to delete (current columns = %#v)", columnName, config.CustomColumns)
-		}
-		newColumns := make([]hctx.CustomColumnDefinition, 0)
-		deletedColumns := false
-		for _, c := range config.CustomColumns {
-			if c.ColumnName != columnName {
-				newColumns = append(newColumns, c)
-				deletedColumns = true
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			columnName := args[0]
+			if config.CustomColumns == nil {
+				log.Fatalf("Did not find a column with name %#v to delete (current columns = %#v)", columnName, config.CustomColumns)
 			}
-		}
-		if !deletedColumns {
-			log.Fatalf("Did not find a column with name %#v to delete (current columns = %#v)", columnName, config.CustomColumns)
-		}
-		config.CustomColumns = newColumns
-		lib.CheckFatalError(hctx.SetConfig(config))
+			newColumns := make([]hctx.CustomColumnDefinition, 0)
+			deletedColumns := false
+			for _, c := range config.CustomColumns {
+				if c.ColumnName != columnName {
+					newColumns = append(newColumns, c)
+					deletedColumns = true
+				}
+			}
+			if !deletedColumns {
+				log.Fatalf("Did not find a column with name %#v to delete (current columns = %#v)", columnName, config.CustomColumns)
+			}
+			config.CustomColumns = newColumns
+		}))
 	},
 }
 var deleteDisplayedColumnCommand = &cobra.Command{
@@ -48,23 +47,177 @@ var deleteDisplayedColumnCommand = &cobra.Command{
 	Short: "Delete a displayed column",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := hctx.MakeContext()
-		config := hctx.GetConf(ctx)
-		deletedColumns := args
-		newColumns := make([]string, 0)
-		for _, c := range config.DisplayedColumns {
-			isDeleted := false
-			for _, d := range deletedColumns {
-				if c == d {
-					isDeleted = true
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			deletedColumns := args
+			newColumns := make([]string, 0)
+			for _, c := range config.DisplayedColumns {
+				isDeleted := false
+				for _, d := range deletedColumns {
+					if c == d {
+						isDeleted = true
+					}
+				}
+				if !isDeleted {
+					newColumns = append(newColumns, c)
+				}
+			}
+			config.DisplayedColumns = newColumns
+		}))
+	},
+}
+
+var deleteRetentionRuleCmd = &cobra.Command{
+	Use:   "retention-rule MAX_AGE",
+	Short: "Delete the retention rule(s) with the given max age",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newRules := make([]hctx.RetentionRule, 0)
+			for _, rule := range config.RetentionPolicy {
+				if rule.MaxAge != args[0] {
+					newRules = append(newRules, rule)
+				}
+			}
+			if len(newRules) == len(config.RetentionPolicy) {
+				log.Fatalf("Did not find a retention rule with max age %#v to delete (current rules = %#v)", args[0], config.RetentionPolicy)
+			}
+			config.RetentionPolicy = newRules
+		}))
+	},
+}
+
+var deleteRuleCmd = &cobra.Command{
+	Use:   "rule NAME",
+	Short: "Delete the rule with the given name",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newRules := make([]hctx.Rule, 0)
+			for _, rule := range config.Rules {
+				if rule.Name != args[0] {
+					newRules = append(newRules, rule)
+				}
+			}
+			if len(newRules) == len(config.Rules) {
+				log.Fatalf("Did not find a rule named %#v to delete", args[0])
+			}
+			config.Rules = newRules
+		}))
+	},
+}
+
+var deleteTuiMacroCmd = &cobra.Command{
+	Use:   "tui-macro NAME",
+	Short: "Delete the TUI macro with the given name",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newMacros := make([]hctx.TuiMacro, 0)
+			for _, macro := range config.TuiMacros {
+				if macro.Name != args[0] {
+					newMacros = append(newMacros, macro)
+				}
+			}
+			if len(newMacros) == len(config.TuiMacros) {
+				log.Fatalf("Did not find a TUI macro with name %#v to delete", args[0])
+			}
+			config.TuiMacros = newMacros
+		}))
+	},
+}
+
+var deleteEnvSnapshotVariablesCmd = &cobra.Command{
+	Use:   "env-snapshot-variables NAME...",
+	Short: "Stop recording the given environment variables",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newNames := make([]string, 0)
+			for _, name := range config.EnvSnapshotVariables {
+				isDeleted := false
+				for _, d := range args {
+					if name == d {
+						isDeleted = true
+					}
+				}
+				if !isDeleted {
+					newNames = append(newNames, name)
+				}
+			}
+			config.EnvSnapshotVariables = newNames
+		}))
+	},
+}
+
+var deleteDefaultFiltersCmd = &cobra.Command{
+	Use:                "default-filters FILTER...",
+	Short:              "Stop applying the given default filters to interactive searches",
+	DisableFlagParsing: true,
+	Args:               cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newFilters := make([]string, 0)
+			for _, filter := range config.DefaultFilters {
+				isDeleted := false
+				for _, d := range args {
+					if filter == d {
+						isDeleted = true
+					}
+				}
+				if !isDeleted {
+					newFilters = append(newFilters, filter)
+				}
+			}
+			config.DefaultFilters = newFilters
+		}))
+	},
+}
+
+var deleteMcpRedactionPatternsCmd = &cobra.Command{
+	Use:                "mcp-redaction-patterns REGEX...",
+	Short:              "Stop redacting the given regexes from the history returned by `hishtory mcp`",
+	DisableFlagParsing: true,
+	Args:               cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newPatterns := make([]string, 0)
+			for _, pattern := range config.McpRedactionPatterns {
+				isDeleted := false
+				for _, d := range args {
+					if pattern == d {
+						isDeleted = true
+					}
+				}
+				if !isDeleted {
+					newPatterns = append(newPatterns, pattern)
 				}
 			}
-			if !isDeleted {
-				newColumns = append(newColumns, c)
+			config.McpRedactionPatterns = newPatterns
+		}))
+	},
+}
+
+var deleteServerVisibleFieldsCmd = &cobra.Command{
+	Use:       "server-visible-fields FIELD...",
+	Short:     "Encrypt the given fields of new history entries again",
+	Args:      cobra.MinimumNArgs(1),
+	ValidArgs: lib.VisibleFields,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			newFields := make([]string, 0)
+			for _, field := range config.ServerVisibleFields {
+				isDeleted := false
+				for _, d := range args {
+					if field == d {
+						isDeleted = true
+					}
+				}
+				if !isDeleted {
+					newFields = append(newFields, field)
+				}
 			}
-		}
-		config.DisplayedColumns = newColumns
-		lib.CheckFatalError(hctx.SetConfig(config))
+			config.ServerVisibleFields = newFields
+		}))
 	},
 }
 
@@ -72,4 +225,11 @@ func init() {
 	rootCmd.AddCommand(configDeleteCmd)
 	configDeleteCmd.AddCommand(deleteCustomColumnsCmd)
 	configDeleteCmd.AddCommand(deleteDisplayedColumnCommand)
+	configDeleteCmd.AddCommand(deleteRetentionRuleCmd)
+	configDeleteCmd.AddCommand(deleteRuleCmd)
+	configDeleteCmd.AddCommand(deleteTuiMacroCmd)
+	configDeleteCmd.AddCommand(deleteEnvSnapshotVariablesCmd)
+	configDeleteCmd.AddCommand(deleteDefaultFiltersCmd)
+	configDeleteCmd.AddCommand(deleteMcpRedactionPatternsCmd)
+	configDeleteCmd.AddCommand(deleteServerVisibleFieldsCmd)
 }
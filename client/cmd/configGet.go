@@ -80,6 +80,387 @@ var getCustomColumnsCmd = &cobra.Command{
 	},
 }
 
+var getColorThemeCmd = &cobra.Command{
+	Use:   "color-theme",
+	Short: "The color theme used by the TUI",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.ColorTheme == "" {
+			fmt.Println(lib.DefaultColorTheme)
+		} else {
+			fmt.Println(config.ColorTheme)
+		}
+	},
+}
+
+var getThemeOverridesCmd = &cobra.Command{
+	Use:   "theme-overrides",
+	Short: "The colors that override the ones from the color theme",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		overrides := map[string]string{
+			"header":              config.ThemeOverrides.Header,
+			"selected-foreground": config.ThemeOverrides.SelectedForeground,
+			"selected-background": config.ThemeOverrides.SelectedBackground,
+			"match-highlight":     config.ThemeOverrides.MatchHighlight,
+			"border":              config.ThemeOverrides.Border,
+		}
+		for _, element := range lib.ThemeElementNames {
+			if overrides[element] != "" {
+				fmt.Println(element + ":   " + overrides[element])
+			}
+		}
+	},
+}
+
+var getSearchBackendCmd = &cobra.Command{
+	Use:   "search-backend",
+	Short: "The interactive picker used for searching your history (e.g. via control-r)",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.SearchBackend == "" {
+			fmt.Println(lib.BuiltinSearchBackend)
+		} else {
+			fmt.Println(config.SearchBackend)
+		}
+	},
+}
+
+var getRetentionPolicyCmd = &cobra.Command{
+	Use:   "retention-policy",
+	Short: "The rules used for pruning old history entries",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		for _, rule := range config.RetentionPolicy {
+			if rule.KeepQuery == "" {
+				fmt.Printf("%s:   delete all entries\n", rule.MaxAge)
+			} else {
+				fmt.Printf("%s:   delete entries not matching %#v\n", rule.MaxAge, rule.KeepQuery)
+			}
+		}
+	},
+}
+
+var getRulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "The rules that run actions for matching commands",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		for _, rule := range config.Rules {
+			actions := make([]string, 0, len(rule.Actions))
+			for _, action := range rule.Actions {
+				if action.Arg == "" {
+					actions = append(actions, action.Type)
+				} else {
+					actions = append(actions, action.Type+":"+action.Arg)
+				}
+			}
+			fmt.Printf("%s:   %#v -> %s\n", rule.Name, rule.Query, strings.Join(actions, ", "))
+		}
+	},
+}
+
+var getDisplayDeviceHostnameCmd = &cobra.Command{
+	Use:   "display-device-hostname",
+	Short: "Whether hishtory displays the current hostname of the device that recorded each entry, rather than the hostname at the time",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.DisplayDeviceHostname)
+	},
+}
+
+var getDisplayQueryStatsCmd = &cobra.Command{
+	Use:   "display-query-stats",
+	Short: "Whether the TUI displays the number of matching entries and how long the query took",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.DisplayQueryStats)
+	},
+}
+
+var getTuiSearchDebounceCmd = &cobra.Command{
+	Use:   "tui-search-debounce",
+	Short: "How many milliseconds the TUI waits after a key press before searching",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.TuiSearchDebounceMs)
+	},
+}
+
+var getSortByFrecencyCmd = &cobra.Command{
+	Use:   "sort-by-frecency",
+	Short: "Whether the TUI sorts results by frecency (how often and how recently each command was run or selected) rather than by recency",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.SortByFrecency)
+	},
+}
+
+var getRecordResolvedAliasesCmd = &cobra.Command{
+	Use:   "record-resolved-aliases",
+	Short: "Whether commands that start with a shell alias also record the command that the alias expanded to",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.RecordResolvedAliases)
+	},
+}
+
+var getCollapseDuplicateEntriesCmd = &cobra.Command{
+	Use:   "collapse-duplicate-entries",
+	Short: "Whether re-running a command in the same directory updates the existing entry's hit count rather than saving a new entry",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.CollapseDuplicateEntries)
+	},
+}
+
+var getImportBatchSizeCmd = &cobra.Command{
+	Use:   "import-batch-size",
+	Short: "How many entries are inserted per transaction when importing existing shell history",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.ImportBatchSize <= 0 {
+			fmt.Println(hctx.DefaultImportBatchSize)
+		} else {
+			fmt.Println(config.ImportBatchSize)
+		}
+	},
+}
+
+var getDbBusyTimeoutCmd = &cobra.Command{
+	Use:   "db-busy-timeout",
+	Short: "How long to wait (in milliseconds) for other shells to finish writing to the DB before giving up",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.DbBusyTimeoutMs <= 0 {
+			fmt.Println(hctx.DefaultDbBusyTimeoutMs)
+		} else {
+			fmt.Println(config.DbBusyTimeoutMs)
+		}
+	},
+}
+
+var getDbDurabilityCmd = &cobra.Command{
+	Use:   "db-durability",
+	Short: "How durable writes to the DB are: full, normal, or off",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.DbDurability == "" {
+			fmt.Println(hctx.DurabilityNormal)
+		} else {
+			fmt.Println(config.DbDurability)
+		}
+	},
+}
+
+var getWalAutocheckpointCmd = &cobra.Command{
+	Use:   "wal-autocheckpoint",
+	Short: "The number of pages written to the DB's write-ahead log before it is checkpointed into the DB",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.WalAutocheckpointPages <= 0 {
+			fmt.Println(hctx.DefaultWalAutocheckpointPages)
+		} else {
+			fmt.Println(config.WalAutocheckpointPages)
+		}
+	},
+}
+
+var getHotStorageMonthsCmd = &cobra.Command{
+	Use:   "hot-storage-months",
+	Short: "Entries older than this many months are archived to a separate DB that is only searched when needed (0 if disabled)",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.HotStorageMonths)
+	},
+}
+
+var getTuiMacrosCmd = &cobra.Command{
+	Use:   "tui-macros",
+	Short: "The macros that have been recorded in the TUI",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		for _, macro := range config.TuiMacros {
+			fmt.Printf("%s (%s):   %s\n", macro.Name, macro.Key, strings.Join(macro.Keys, " "))
+		}
+	},
+}
+
+var getLocalApiTokenCmd = &cobra.Command{
+	Use:   "local-api-token",
+	Short: "The token used to authenticate requests to the local API served by 'hishtory serve-api'",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		token, err := lib.GetOrCreateLocalApiToken(ctx)
+		lib.CheckFatalError(err)
+		fmt.Println(token)
+	},
+}
+
+var getDefaultFiltersCmd = &cobra.Command{
+	Use:   "default-filters",
+	Short: "The filters that are applied to every interactive search",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(strings.Join(config.DefaultFilters, " "))
+	},
+}
+
+var getEnvSnapshotVariablesCmd = &cobra.Command{
+	Use:   "env-snapshot-variables",
+	Short: "The environment variables that are recorded with every command",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(strings.Join(config.EnvSnapshotVariables, " "))
+	},
+}
+
+var getServerVisibleFieldsCmd = &cobra.Command{
+	Use:   "server-visible-fields",
+	Short: "The fields of history entries that are stored unencrypted on the sync server, in addition to when each command finished",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(strings.Join(config.ServerVisibleFields, " "))
+	},
+}
+
+var getPreExecHookCmd = &cobra.Command{
+	Use:   "pre-exec-hook",
+	Short: "A command that checks every command before it is run and can deny it or warn about it",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.PreExecHook)
+	},
+}
+
+var getJournalTemplateCmd = &cobra.Command{
+	Use:   "journal-template",
+	Short: "The Go text/template used by `hishtory journal` to render a day's commands as Markdown",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.JournalTemplate == "" {
+			fmt.Print(lib.DefaultJournalTemplate)
+			return
+		}
+		fmt.Print(config.JournalTemplate)
+	},
+}
+
+var getIntegrationsCmd = &cobra.Command{
+	Use:   "integrations",
+	Short: "Where daily journals are automatically published to",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if !config.Integrations.IsEnabled() {
+			fmt.Println("No integrations are configured")
+			return
+		}
+		if obsidian := config.Integrations.Obsidian; obsidian != nil {
+			fmt.Printf("Obsidian: folder=%#v file_name_format=%#v last_published=%#v\n", obsidian.Folder, obsidian.FileNameFormat, obsidian.LastPublishedDate)
+		}
+		if notion := config.Integrations.Notion; notion != nil {
+			fmt.Printf("Notion: database_id=%#v title_property=%#v last_published=%#v\n", notion.DatabaseId, notion.TitleProperty, notion.LastPublishedDate)
+		}
+	},
+}
+
+var getTlsCmd = &cobra.Command{
+	Use:   "tls",
+	Short: "The CA bundle and client certificate used for connections to a self-hosted sync server",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Printf("CA bundle: %#v\n", config.TlsCaBundle)
+		fmt.Printf("Client certificate: %#v\n", config.TlsClientCert)
+		fmt.Printf("Client key: %#v\n", config.TlsClientKey)
+	},
+}
+
+var getMcpRedactionPatternsCmd = &cobra.Command{
+	Use:   "mcp-redaction-patterns",
+	Short: "The regexes for secrets that are redacted from the history returned by `hishtory mcp`, one per line",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		for _, pattern := range config.McpRedactionPatterns {
+			fmt.Println(pattern)
+		}
+	},
+}
+
+var getProxyUrlCmd = &cobra.Command{
+	Use:   "proxy-url",
+	Short: "The proxy that requests to the sync server are sent through (with the password hidden)",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.ProxyUrl == "" {
+			fmt.Println("")
+			return
+		}
+		proxyUrl, err := lib.ParseProxyUrl(config.ProxyUrl)
+		lib.CheckFatalError(err)
+		fmt.Println(proxyUrl.Redacted())
+	},
+}
+
+var getReadOnlyDeviceCmd = &cobra.Command{
+	Use:   "read-only-device",
+	Short: "Whether this device only downloads and searches your synced history, without uploading its own commands",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.ReadOnlyDevice)
+	},
+}
+
+var getDeletionGracePeriodCmd = &cobra.Command{
+	Use:   "deletion-grace-period",
+	Short: "How long entries deleted from the search TUI can be restored before the deletion is sent to your other devices",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(formatInterval(lib.GetDeletionGracePeriod(config)))
+	},
+}
+
+var getSecretStorageCmd = &cobra.Command{
+	Use:   "secret-storage",
+	Short: "Where your secret key is stored, either in the config file or in the OS keychain",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if config.SecretStorage == "" {
+			fmt.Println(hctx.SecretStorageFile)
+			return
+		}
+		fmt.Println(config.SecretStorage)
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(configGetCmd)
 	configGetCmd.AddCommand(getEnableControlRCmd)
@@ -87,4 +468,34 @@ func init() {
 	configGetCmd.AddCommand(getDisplayedColumnsCmd)
 	configGetCmd.AddCommand(getTimestampFormatCmd)
 	configGetCmd.AddCommand(getCustomColumnsCmd)
+	configGetCmd.AddCommand(getColorThemeCmd)
+	configGetCmd.AddCommand(getThemeOverridesCmd)
+	configGetCmd.AddCommand(getSearchBackendCmd)
+	configGetCmd.AddCommand(getRetentionPolicyCmd)
+	configGetCmd.AddCommand(getRulesCmd)
+	configGetCmd.AddCommand(getDisplayDeviceHostnameCmd)
+	configGetCmd.AddCommand(getDisplayQueryStatsCmd)
+	configGetCmd.AddCommand(getTuiSearchDebounceCmd)
+	configGetCmd.AddCommand(getCollapseDuplicateEntriesCmd)
+	configGetCmd.AddCommand(getSortByFrecencyCmd)
+	configGetCmd.AddCommand(getRecordResolvedAliasesCmd)
+	configGetCmd.AddCommand(getDbBusyTimeoutCmd)
+	configGetCmd.AddCommand(getImportBatchSizeCmd)
+	configGetCmd.AddCommand(getDbDurabilityCmd)
+	configGetCmd.AddCommand(getWalAutocheckpointCmd)
+	configGetCmd.AddCommand(getHotStorageMonthsCmd)
+	configGetCmd.AddCommand(getLocalApiTokenCmd)
+	configGetCmd.AddCommand(getTuiMacrosCmd)
+	configGetCmd.AddCommand(getEnvSnapshotVariablesCmd)
+	configGetCmd.AddCommand(getServerVisibleFieldsCmd)
+	configGetCmd.AddCommand(getDefaultFiltersCmd)
+	configGetCmd.AddCommand(getPreExecHookCmd)
+	configGetCmd.AddCommand(getJournalTemplateCmd)
+	configGetCmd.AddCommand(getIntegrationsCmd)
+	configGetCmd.AddCommand(getTlsCmd)
+	configGetCmd.AddCommand(getMcpRedactionPatternsCmd)
+	configGetCmd.AddCommand(getProxyUrlCmd)
+	configGetCmd.AddCommand(getReadOnlyDeviceCmd)
+	configGetCmd.AddCommand(getDeletionGracePeriodCmd)
+	configGetCmd.AddCommand(getSecretStorageCmd)
 }
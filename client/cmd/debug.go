@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var generateNumEntries *int
+var generateSeed *int64
+var generateNumHosts *int
+
+var debugCmd = &cobra.Command{
+	Use:    "debug",
+	Hidden: true,
+	Short:  "Tools for debugging and benchmarking hiSHtory",
+}
+
+var debugGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Fill a sandbox DB with synthetic history",
+	Long: "Fills the DB with realistic synthetic history, for benchmarking, stress testing the TUI, and reproducing performance " +
+		"issues. The same --seed always generates the same history. To avoid mixing synthetic entries into your real history, " +
+		"this only runs with $HISHTORY_PATH pointing at a sandbox directory, which is set up as an offline install if it is " +
+		"empty. For example: `HISHTORY_PATH=/tmp/hishtory-sandbox hishtory debug generate --entries 100000 --seed 42`, and " +
+		"then `HISHTORY_PATH=/tmp/hishtory-sandbox hishtory tquery` to search it.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(setupSandbox())
+		ctx := hctx.MakeContext()
+		if !hctx.GetConf(ctx).IsOffline {
+			lib.CheckFatalError(fmt.Errorf("refusing to generate history in %s since it isn't an offline install, point HISHTORY_PATH at an empty directory instead", os.Getenv("HISHTORY_PATH")))
+		}
+		entries, err := lib.GenerateHistory(lib.GenerateOptions{NumEntries: *generateNumEntries, Seed: *generateSeed, NumHosts: *generateNumHosts})
+		lib.CheckFatalError(err)
+		numInserted, err := lib.InsertGeneratedHistory(ctx, entries)
+		lib.CheckFatalError(err)
+		fmt.Printf("Generated %d entries in %s\n", numInserted, os.Getenv("HISHTORY_PATH"))
+		if numSkipped := int64(len(entries)) - numInserted; numSkipped > 0 {
+			fmt.Printf("Skipped %d entries that were generated previously\n", numSkipped)
+		}
+	},
+}
+
+// setupSandbox checks that HISHTORY_PATH is set, and initializes an offline install there if it doesn't have one yet
+func setupSandbox() error {
+	if os.Getenv("HISHTORY_PATH") == "" {
+		return fmt.Errorf("HISHTORY_PATH must be set to a sandbox directory, e.g. `HISHTORY_PATH=/tmp/hishtory-sandbox hishtory debug generate`")
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get homedir: %w", err)
+	}
+	_, err = os.Stat(filepath.Join(data.GetHishtoryConfigDir(homedir), data.CONFIG_PATH))
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := hctx.MakeHishtoryDir(); err != nil {
+		return err
+	}
+	return lib.Setup("", true, false)
+}
+
+func init() {
+	rootCmd.AddCommand(debugCmd)
+	debugCmd.AddCommand(debugGenerateCmd)
+	generateNumEntries = debugGenerateCmd.Flags().Int("entries", 10000, "The number of entries to generate")
+	generateSeed = debugGenerateCmd.Flags().Int64("seed", 1, "The seed for the random generator")
+	generateNumHosts = debugGenerateCmd.Flags().Int("hosts", 3, "The number of hosts that the entries are spread across")
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var deleteAccountDryRun *bool
+var deleteAccountForce *bool
+
+var deleteAccountCmd = &cobra.Command{
+	Use:   "delete-account",
+	Short: "Permanently delete all of your history from the server and uninstall hiSHtory from this device",
+	Long: "Deletes everything the server stores for your account (the history of all of your devices, your devices, " +
+		"pending deletion requests, pin and tag updates, and the shares you created), then deletes this device's local " +
+		"history and config and removes hiSHtory's hooks from your shell rc files. Your other devices keep their local " +
+		"history but can no longer sync, so run `hishtory uninstall` on them too. Entries you published to team channels " +
+		"are kept, since they belong to the team. Pass --dry-run to show what would be deleted without deleting anything.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		homedir := hctx.GetHome(ctx)
+		if *deleteAccountDryRun {
+			fmt.Println("This would delete:")
+		} else {
+			fmt.Println("This will delete:")
+		}
+		if config.IsOffline {
+			fmt.Println("  Nothing on the server, since this device is in offline mode")
+		} else {
+			usage, err := lib.GetRemoteStorageUsage(config)
+			lib.CheckFatalError(err)
+			fmt.Printf("  %d entries (%s) stored on the server for your account, and everything else the server stores for it\n", usage.NumEntries, lib.FormatBytes(usage.NumBytes))
+		}
+		for _, dir := range getLocalDataDirs(homedir) {
+			fmt.Printf("  %s, which contains this device's local history and config\n", dir)
+		}
+		rcPaths, err := getHookedRcPaths(homedir)
+		lib.CheckFatalError(err)
+		for _, rcPath := range rcPaths {
+			fmt.Printf("  The hiSHtory hooks in %s\n", rcPath)
+		}
+		if *deleteAccountDryRun {
+			return
+		}
+		if !*deleteAccountForce {
+			fmt.Printf("This can't be undone, are you sure you want to permanently delete your account? [y/N]")
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting account deletion per user response of %#v\n", strings.TrimSpace(resp))
+				return
+			}
+		}
+		lib.CheckFatalError(deleteAccount(ctx))
+	},
+}
+
+func deleteAccount(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	// Delete the server-side data first, since the local config contains the secret that identifies the account
+	if !config.IsOffline {
+		deletion, err := lib.DeleteRemoteAccount(config)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %d entries, %d devices, and %d shares from the server\n", deletion.NumEntries, deletion.NumDevices, deletion.NumShares)
+	}
+	return uninstall(ctx)
+}
+
+// getLocalDataDirs returns the directories that contain hiSHtory's local data and config
+func getLocalDataDirs(homedir string) []string {
+	dataDir, configDir := data.GetHishtoryDir(homedir), data.GetHishtoryConfigDir(homedir)
+	if dataDir == configDir {
+		return []string{dataDir}
+	}
+	return []string{dataDir, configDir}
+}
+
+// getHookedRcPaths returns the shell rc files that contain hiSHtory's config fragment
+func getHookedRcPaths(homedir string) ([]string, error) {
+	fragments, err := getShellConfigFragments(homedir)
+	if err != nil {
+		return nil, err
+	}
+	rcPaths := make([]string, 0)
+	for rcPath, fragment := range fragments {
+		contents, err := os.ReadFile(rcPath)
+		if err != nil {
+			continue
+		}
+		// Skip the comment that starts the fragment, since other hiSHtory installs add the same one
+		for _, line := range strings.Split(fragment, "\n") {
+			if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") && strings.Contains(string(contents), line) {
+				rcPaths = append(rcPaths, rcPath)
+				break
+			}
+		}
+	}
+	sort.Strings(rcPaths)
+	return rcPaths, nil
+}
+
+func init() {
+	rootCmd.AddCommand(deleteAccountCmd)
+	deleteAccountDryRun = deleteAccountCmd.Flags().Bool("dry-run", false, "Show what would be deleted without deleting anything")
+	deleteAccountForce = deleteAccountCmd.Flags().Bool("force", false, "Don't ask for confirmation before deleting your account")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var doctorPermissions *bool
+var doctorFix *bool
+
+var doctorCmd = &cobra.Command{
+	Use:     "doctor",
+	Short:   "Check the local hishtory DB for corruption and repair it",
+	Long:    "Runs an integrity check on the local DB (salvaging what it can into a new DB if it is corrupted), checkpoints the WAL, rebuilds indexes, vacuums the DB, and reports any history entries that couldn't be decrypted.\n\nWith --permissions, instead audits the ownership and permissions of hishtory's files (the config, DB, WAL, logs, and backups) so that they're only accessible by you, and fixes them with --fix.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if *doctorFix && !*doctorPermissions {
+			lib.CheckFatalError(fmt.Errorf("--fix can only be used with --permissions"))
+		}
+		if *doctorPermissions {
+			unfixedProblems, err := lib.AuditPermissions(os.Stdout, *doctorFix)
+			lib.CheckFatalError(err)
+			if unfixedProblems > 0 {
+				if *doctorFix {
+					fmt.Printf("Found %d permission problem(s) that couldn't be automatically fixed\n", unfixedProblems)
+				} else {
+					fmt.Printf("Found %d permission problem(s), run `hishtory doctor --permissions --fix` to fix them\n", unfixedProblems)
+				}
+				os.Exit(1)
+			}
+			fmt.Println("No problems found")
+			return
+		}
+		// Note that this intentionally doesn't use hctx.MakeContext() since that panics if the DB can't be opened
+		unfixedProblems, err := lib.RunDoctor(os.Stdout)
+		lib.CheckFatalError(err)
+		if unfixedProblems > 0 {
+			fmt.Printf("Found %d problem(s) that couldn't be automatically fixed\n", unfixedProblems)
+			os.Exit(1)
+		}
+		fmt.Println("No problems found")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorPermissions = doctorCmd.Flags().Bool("permissions", false, "Audit the ownership and permissions of hishtory's files rather than checking the DB")
+	doctorFix = doctorCmd.Flags().Bool("fix", false, "Fix the problems found by --permissions")
+}
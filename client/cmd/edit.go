@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var editCmd = &cobra.Command{
+	Use:   "edit ENTRY_ID [COMMAND]",
+	Short: "Edit the command of a history entry, e.g. to fix a typo",
+	Long: "Replaces the command of a history entry and syncs the edit to all of your devices. ENTRY_ID is the ID shown in the `Entry ID` column (see `hishtory config-add displayed-columns 'Entry ID'`), " +
+		"or `last` for the previous command. If no command is given, the current command is opened in $EDITOR. The entry keeps its other fields, tags, and pins.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		entry, err := lib.GetEntryById(ctx, args[0])
+		lib.CheckFatalError(err)
+		var command string
+		if len(args) == 2 {
+			command = args[1]
+		} else {
+			command, err = lib.EditInEditor(entry.Command)
+			lib.CheckFatalError(err)
+		}
+		if command == entry.Command {
+			fmt.Println("The command is unchanged")
+			return
+		}
+		err = lib.EditEntryCommand(ctx, *entry, command)
+		if lib.IsOfflineError(err) {
+			fmt.Println("Warning: hishtory is offline so the command will only be updated on this device!")
+		} else {
+			lib.CheckFatalError(err)
+		}
+		fmt.Printf("Updated %#v to %#v\n", entry.Command, command)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(editCmd)
+}
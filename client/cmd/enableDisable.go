@@ -29,15 +29,15 @@ var disableCmd = &cobra.Command{
 }
 
 func Enable(ctx context.Context) error {
-	config := hctx.GetConf(ctx)
-	config.IsEnabled = true
-	return hctx.SetConfig(config)
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.IsEnabled = true
+	})
 }
 
 func Disable(ctx context.Context) error {
-	config := hctx.GetConf(ctx)
-	config.IsEnabled = false
-	return hctx.SetConfig(config)
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.IsEnabled = false
+	})
 }
 
 func init() {
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var encryptionAgeIdentity *string
+var encryptionAgeRecipients *[]string
+var encryptionKmsEncryptCommand *string
+var encryptionKmsDecryptCommand *string
+var encryptionWrappedKey *string
+
+var encryptionCmd = &cobra.Command{
+	Use:     "encryption",
+	Short:   "Configure how synced history is encrypted",
+	GroupID: GROUP_ID_CONFIG,
+}
+
+var encryptionSetupCmd = &cobra.Command{
+	Use:   "setup PROVIDER",
+	Short: "Encrypt synced history with the given provider (secret, age, or kms)",
+	Long: "By default, synced history is encrypted with a key derived from your secret key. The age and kms providers instead " +
+		"encrypt it with a random data key that is wrapped with age or a cloud KMS, so that your secret key alone isn't enough " +
+		"to decrypt it.\n\n" +
+		"On your first device, run e.g. `hishtory encryption setup age --identity ~/.config/age/key.txt` to generate a new " +
+		"data key, or `hishtory encryption setup kms --encrypt-command CMD --decrypt-command CMD` where the commands encrypt " +
+		"or decrypt stdin with your KMS and write the result to stdout. Then run the printed command on your other devices, " +
+		"which passes the wrapped data key via --wrapped-key.",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: lib.EncryptionProviders,
+	Run: func(cmd *cobra.Command, args []string) {
+		encryption, err := lib.SetupEncryption(lib.EncryptionSetupOptions{
+			Provider:          args[0],
+			WrappedKey:        *encryptionWrappedKey,
+			AgeIdentityFile:   *encryptionAgeIdentity,
+			AgeRecipients:     *encryptionAgeRecipients,
+			KmsEncryptCommand: *encryptionKmsEncryptCommand,
+			KmsDecryptCommand: *encryptionKmsDecryptCommand,
+		})
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.Encryption = encryption
+		}))
+		lib.CheckFatalError(lib.RecordAuditEvent(hctx.MakeContext(), lib.AuditActionEncryption, fmt.Sprintf("switched to the %s encryption provider", encryption.Provider)))
+		fmt.Printf("Synced history is now encrypted with the %s provider\n", encryption.Provider)
+		if encryption.Provider != lib.EncryptionProviderSecret && *encryptionWrappedKey == "" {
+			fmt.Printf("To set up your other devices to use the same data key, run:\n\n  %s\n\n", lib.JoinEncryptionCommand(encryption))
+			fmt.Printf("Entries recorded on devices that haven't been set up yet can't be decrypted by this device until they are.\n")
+		}
+
+		// Entries from devices that already use this provider may have been quarantined since they couldn't be decrypted
+		ctx := hctx.MakeContext()
+		numRecovered, err := lib.RetryQuarantinedEntries(ctx)
+		lib.CheckFatalError(err)
+		if numRecovered > 0 {
+			fmt.Printf("Decrypted %d previously quarantined history entries\n", numRecovered)
+		}
+	},
+}
+
+var encryptionStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show how synced history is encrypted",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		encryption := hctx.GetConf(ctx).Encryption
+		if encryption.Provider == "" || encryption.Provider == lib.EncryptionProviderSecret {
+			fmt.Println("Provider: secret (synced history is encrypted with a key derived from your secret key)")
+			return
+		}
+		fmt.Printf("Provider: %s\n", encryption.Provider)
+		if encryption.AgeIdentityFile != "" {
+			fmt.Printf("Identity File: %s\n", encryption.AgeIdentityFile)
+		}
+		if encryption.KmsDecryptCommand != "" {
+			fmt.Printf("Decrypt Command: %s\n", encryption.KmsDecryptCommand)
+		}
+		fmt.Printf("Wrapped Data Key: %s\n", encryption.WrappedKey)
+		_, err := lib.GetEncryptionProvider(hctx.GetConf(ctx))
+		lib.CheckFatalError(err)
+		fmt.Printf("To set up another device, run: %s\n", lib.JoinEncryptionCommand(encryption))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptionCmd)
+	encryptionCmd.AddCommand(encryptionSetupCmd)
+	encryptionCmd.AddCommand(encryptionStatusCmd)
+	encryptionAgeIdentity = encryptionSetupCmd.Flags().String("identity", "", "For the age provider, the age identity file that the data key is unwrapped with")
+	encryptionAgeRecipients = encryptionSetupCmd.Flags().StringArray("recipient", nil, "For the age provider, a recipient to wrap a new data key to (defaults to the identity's recipient), may be repeated")
+	encryptionKmsEncryptCommand = encryptionSetupCmd.Flags().String("encrypt-command", "", "For the kms provider, a command that encrypts stdin with your KMS and writes the result to stdout")
+	encryptionKmsDecryptCommand = encryptionSetupCmd.Flags().String("decrypt-command", "", "For the kms provider, a command that decrypts stdin with your KMS and writes the result to stdout")
+	encryptionWrappedKey = encryptionSetupCmd.Flags().String("wrapped-key", "", "The wrapped data key printed when the provider was set up on another device")
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var hostnamesCmd = &cobra.Command{
+	Use:     "hostnames",
+	Short:   "List the hostnames used by each of your devices",
+	Long:    "Lists every hostname that each device has recorded history entries under, which is useful for finding machines that were renamed. To display entries under each device's current hostname, run `hishtory config-set display-device-hostname true`.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		records, err := lib.GetHostnameHistory(ctx)
+		lib.CheckFatalError(err)
+		config := hctx.GetConf(ctx)
+		tbl := table.New("Device ID", "Hostname", "First Seen", "Last Seen", "Entries")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, r := range records {
+			deviceId := r.DeviceId
+			if deviceId == config.DeviceId {
+				deviceId += " (this device)"
+			}
+			tbl.AddRow(deviceId, r.Hostname, r.FirstSeen.Local().Format(config.TimestampFormat), r.LastSeen.Local().Format(config.TimestampFormat), r.Count)
+		}
+		tbl.Print()
+	},
+}
+
+var mergeHostnamesCmd = &cobra.Command{
+	Use:   "merge OLD_HOSTNAME NEW_HOSTNAME",
+	Short: "Rewrite the hostname of all local entries recorded under OLD_HOSTNAME to NEW_HOSTNAME",
+	Long:  "Rewrites the hostname of all history entries on this device that were recorded under OLD_HOSTNAME to be NEW_HOSTNAME, so that they can be queried together. This only changes entries on the current device, so run it on each of your devices.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		numUpdated, err := lib.MergeHostnames(ctx, args[0], args[1])
+		lib.CheckFatalError(err)
+		fmt.Printf("Updated %d entries from %#v to %#v\n", numUpdated, args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hostnamesCmd)
+	hostnamesCmd.AddCommand(mergeHostnamesCmd)
+}
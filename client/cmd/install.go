@@ -10,7 +10,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -24,6 +26,8 @@ import (
 
 var offlineInit *bool
 var offlineInstall *bool
+var readOnlyInit *bool
+var readOnlyInstall *bool
 
 var installCmd = &cobra.Command{
 	Use:    "install",
@@ -35,15 +39,13 @@ var installCmd = &cobra.Command{
 		if len(args) > 0 {
 			secretKey = args[0]
 		}
-		lib.CheckFatalError(install(secretKey, *offlineInstall))
+		lib.CheckFatalError(install(secretKey, *offlineInstall, *readOnlyInstall))
 		if os.Getenv("HISHTORY_SKIP_INIT_IMPORT") == "" {
-			db, err := hctx.OpenLocalSqliteDb()
-			lib.CheckFatalError(err)
-			data, err := lib.Search(nil, db, "", 10)
+			ctx := hctx.MakeContext()
+			data, err := lib.Search(nil, hctx.GetDb(ctx), "", 10)
 			lib.CheckFatalError(err)
 			if len(data) < 10 {
 				fmt.Println("Importing existing shell history...")
-				ctx := hctx.MakeContext()
 				numImported, err := lib.ImportHistory(ctx, false, false)
 				lib.CheckFatalError(err)
 				if numImported > 0 {
@@ -52,6 +54,9 @@ var installCmd = &cobra.Command{
 			}
 		}
 		lib.CheckFatalError(warnIfUnsupportedBashVersion())
+		homedir, err := os.UserHomeDir()
+		lib.CheckFatalError(err)
+		warnIfOtherInstallsPresent(homedir)
 	},
 }
 
@@ -61,7 +66,9 @@ var initCmd = &cobra.Command{
 	GroupID: GROUP_ID_CONFIG,
 	Args:    cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := hctx.OpenLocalSqliteDb()
+		// There is no config yet if hishtory was never set up, in which case the DB is opened with the default settings
+		config, _ := hctx.LoadConfig()
+		db, err := hctx.OpenLocalSqliteDb(config)
 		lib.CheckFatalError(err)
 		data, err := lib.Search(nil, db, "", 10)
 		lib.CheckFatalError(err)
@@ -79,7 +86,7 @@ var initCmd = &cobra.Command{
 		if len(args) > 0 {
 			secretKey = args[0]
 		}
-		lib.CheckFatalError(lib.Setup(secretKey, *offlineInit))
+		lib.CheckFatalError(lib.Setup(secretKey, *offlineInit, *readOnlyInit))
 		if os.Getenv("HISHTORY_SKIP_INIT_IMPORT") == "" {
 			fmt.Println("Importing existing shell history...")
 			ctx := hctx.MakeContext()
@@ -137,7 +144,7 @@ func warnIfUnsupportedBashVersion() error {
 	return nil
 }
 
-func install(secretKey string, offline bool) error {
+func install(secretKey string, offline, readOnly bool) error {
 	homedir, err := os.UserHomeDir()
 	if err != nil {
 		return fmt.Errorf("failed to get user's home directory: %v", err)
@@ -150,53 +157,76 @@ func install(secretKey string, offline bool) error {
 	if err != nil {
 		return err
 	}
-	err = configureBashrc(homedir, path)
+	err = configureShells(homedir, path)
 	if err != nil {
 		return err
 	}
-	err = configureZshrc(homedir, path)
+	err = hctx.MigrateConfig()
 	if err != nil {
 		return err
 	}
-	err = configureFish(homedir, path)
+	_, err = hctx.GetConfig()
 	if err != nil {
+		// No config, so set up a new installation
+		return lib.Setup(secretKey, offline, readOnly)
+	}
+	return nil
+}
+
+// configureShells adds the hishtory config fragment to the rc files of every supported shell, if it isn't already there
+func configureShells(homedir, binaryPath string) error {
+	if err := configureBashrc(homedir, binaryPath); err != nil {
 		return err
 	}
-	err = handleUpgradedFeatures()
-	if err != nil {
+	if err := configureZshrc(homedir, binaryPath); err != nil {
 		return err
 	}
-	_, err = hctx.GetConfig()
-	if err != nil {
-		// No config, so set up a new installation
-		return lib.Setup(secretKey, offline)
+	if err := configureFish(homedir, binaryPath); err != nil {
+		return err
 	}
-	return nil
+	if err := configurePowerShell(homedir); err != nil {
+		return err
+	}
+	if err := configureNushell(homedir); err != nil {
+		return err
+	}
+	if err := configureTcsh(homedir); err != nil {
+		return err
+	}
+	return configureKsh(homedir)
 }
 
-func handleUpgradedFeatures() error {
-	configConents, err := hctx.GetConfigContents()
+// getShellConfigFragments returns the config fragment that hishtory adds to each shell rc file, by the rc file's path
+func getShellConfigFragments(homedir string) (map[string]string, error) {
+	fragments := map[string]string{
+		path.Join(homedir, ".bashrc"):                  getBashConfigFragment(homedir),
+		path.Join(homedir, ".bash_profile"):            getBashConfigFragment(homedir),
+		getZshRcPath(homedir):                          getZshConfigFragment(homedir),
+		path.Join(homedir, ".config/fish/config.fish"): getFishConfigFragment(homedir),
+	}
+	powerShellProfilePaths, err := getPowerShellProfilePaths()
 	if err != nil {
-		// No config, so this is a new install and thus there is nothing to do
-		return nil
+		return nil, err
 	}
-	if strings.Contains(string(configConents), "enable_control_r_search") {
-		// control-r search is already configured, so there is nothing to do
-		return nil
+	for _, profilePath := range powerShellProfilePaths {
+		fragments[profilePath] = getPowerShellConfigFragment(homedir)
 	}
-	// Enable control-r search
-	config, err := hctx.GetConfig()
+	nushellRcPath, err := getNushellRcPath()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if nushellRcPath != "" {
+		fragments[nushellRcPath] = getNushellConfigFragment(homedir)
 	}
-	config.ControlRSearchEnabled = true
-	return hctx.SetConfig(config)
+	fragments[getTcshRcPath(homedir)] = getTcshConfigFragment(homedir)
+	fragments[path.Join(homedir, ".kshrc")] = getKshConfigFragment(homedir)
+	return fragments, nil
 }
 
 func installBinary(homedir string) (string, error) {
 	clientPath, err := exec.LookPath("hishtory")
 	if err != nil {
-		clientPath = path.Join(homedir, data.GetHishtoryPath(), "hishtory")
+		clientPath = data.GetHishtoryBinaryPath(homedir)
 	}
 	if _, err := os.Stat(clientPath); err == nil {
 		err = syscall.Unlink(clientPath)
@@ -216,7 +246,7 @@ func installBinary(homedir string) (string, error) {
 }
 
 func getFishConfigPath(homedir string) string {
-	return path.Join(homedir, data.GetHishtoryPath(), "config.fish")
+	return path.Join(data.GetHishtoryDir(homedir), "config.fish")
 }
 
 func configureFish(homedir, binaryPath string) error {
@@ -255,7 +285,7 @@ func configureFish(homedir, binaryPath string) error {
 }
 
 func getFishConfigFragment(homedir string) string {
-	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + path.Join(homedir, data.GetHishtoryPath()) + "\"\nsource " + getFishConfigPath(homedir) + "\n"
+	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + data.GetHishtoryDir(homedir) + "\"\nsource " + getFishConfigPath(homedir) + "\n"
 }
 
 func isFishConfigured(homedir string) (bool, error) {
@@ -270,8 +300,188 @@ func isFishConfigured(homedir string) (bool, error) {
 	return strings.Contains(string(fishConfig), getFishConfigFragment(homedir)), nil
 }
 
+func getPowerShellConfigPath(homedir string) string {
+	return filepath.Join(data.GetHishtoryDir(homedir), "config.ps1")
+}
+
+// getPowerShellProfilePaths returns the profile paths of all installed versions of PowerShell. Both PowerShell
+// 7+ (pwsh) and Windows PowerShell may be installed side by side, and they each have their own profile.
+func getPowerShellProfilePaths() ([]string, error) {
+	profilePaths := make([]string, 0)
+	for _, powershell := range []string{"pwsh", "powershell"} {
+		if _, err := exec.LookPath(powershell); err != nil {
+			continue
+		}
+		out, err := exec.Command(powershell, "-NoProfile", "-NonInteractive", "-Command", "$PROFILE.CurrentUserAllHosts").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the profile path for %s: %v", powershell, err)
+		}
+		profilePath := strings.TrimSpace(string(out))
+		if profilePath != "" {
+			profilePaths = append(profilePaths, profilePath)
+		}
+	}
+	return profilePaths, nil
+}
+
+func configurePowerShell(homedir string) error {
+	profilePaths, err := getPowerShellProfilePaths()
+	if err != nil {
+		return err
+	}
+	if len(profilePaths) == 0 {
+		// PowerShell is not installed
+		return nil
+	}
+	// Create the file we're going to source. Do this no matter what in case there are updates to it.
+	err = os.WriteFile(getPowerShellConfigPath(homedir), []byte(lib.ConfigPowerShellContents), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write config.ps1 file: %v", err)
+	}
+	for _, profilePath := range profilePaths {
+		profile, err := os.ReadFile(profilePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %v", profilePath, err)
+		}
+		if strings.Contains(string(profile), getPowerShellConfigFragment(homedir)) {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(profilePath), 0o744)
+		if err != nil {
+			return fmt.Errorf("failed to create PowerShell profile directory: %v", err)
+		}
+		err = addToShellConfig(profilePath, getPowerShellConfigFragment(homedir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPowerShellConfigFragment(homedir string) string {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return "\n# Hishtory Config:\n$env:PATH += [IO.Path]::PathSeparator + " + quote(data.GetHishtoryDir(homedir)) + "\n. " + quote(getPowerShellConfigPath(homedir)) + "\n"
+}
+
+func getNushellConfigPath(homedir string) string {
+	return filepath.Join(data.GetHishtoryDir(homedir), "config.nu")
+}
+
+// getNushellRcPath returns the path of the user's nushell config.nu, or an empty string if nushell isn't installed
+func getNushellRcPath() (string, error) {
+	if _, err := exec.LookPath("nu"); err != nil {
+		return "", nil
+	}
+	out, err := exec.Command("nu", "--no-config-file", "-c", "$nu.config-path").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the nushell config path: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func configureNushell(homedir string) error {
+	rcPath, err := getNushellRcPath()
+	if err != nil {
+		return err
+	}
+	if rcPath == "" {
+		// nushell is not installed
+		return nil
+	}
+	// Create the file we're going to source. Do this no matter what in case there are updates to it.
+	err = os.WriteFile(getNushellConfigPath(homedir), []byte(lib.ConfigNushellContents), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write config.nu file: %v", err)
+	}
+	rc, err := os.ReadFile(rcPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %v", rcPath, err)
+	}
+	if strings.Contains(string(rc), getNushellConfigFragment(homedir)) {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(rcPath), 0o744)
+	if err != nil {
+		return fmt.Errorf("failed to create nushell config directory: %v", err)
+	}
+	return addToShellConfig(rcPath, getNushellConfigFragment(homedir))
+}
+
+func getNushellConfigFragment(homedir string) string {
+	return "\n# Hishtory Config:\n$env.PATH = ($env.PATH | split row (char esep) | append " + strconv.Quote(data.GetHishtoryDir(homedir)) + ")\nsource " + strconv.Quote(getNushellConfigPath(homedir)) + "\n"
+}
+
+func getTcshConfigPath(homedir string) string {
+	return path.Join(data.GetHishtoryDir(homedir), "config.tcsh")
+}
+
+func getTcshRcPath(homedir string) string {
+	// tcsh only reads ~/.cshrc if there is no ~/.tcshrc
+	if _, err := os.Stat(path.Join(homedir, ".tcshrc")); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(path.Join(homedir, ".cshrc")); err == nil {
+			return path.Join(homedir, ".cshrc")
+		}
+	}
+	return path.Join(homedir, ".tcshrc")
+}
+
+func configureTcsh(homedir string) error {
+	// Check if tcsh is installed
+	_, err := exec.LookPath("tcsh")
+	if err != nil {
+		return nil
+	}
+	// Create the file we're going to source. Do this no matter what in case there are updates to it.
+	err = os.WriteFile(getTcshConfigPath(homedir), []byte(lib.ConfigTcshContents), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write config.tcsh file: %v", err)
+	}
+	return addToShellConfigIfMissing(getTcshRcPath(homedir), getTcshConfigFragment(homedir))
+}
+
+func getTcshConfigFragment(homedir string) string {
+	return "\n# Hishtory Config:\nsetenv PATH \"${PATH}:" + data.GetHishtoryDir(homedir) + "\"\nsource " + getTcshConfigPath(homedir) + "\n"
+}
+
+func getKshConfigPath(homedir string) string {
+	return path.Join(data.GetHishtoryDir(homedir), "config.ksh")
+}
+
+func configureKsh(homedir string) error {
+	// Check if ksh is installed
+	_, err := exec.LookPath("ksh")
+	if err != nil {
+		return nil
+	}
+	// Create the file we're going to source. Do this no matter what in case there are updates to it.
+	err = os.WriteFile(getKshConfigPath(homedir), []byte(lib.ConfigKshContents), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write config.ksh file: %v", err)
+	}
+	return addToShellConfigIfMissing(path.Join(homedir, ".kshrc"), getKshConfigFragment(homedir))
+}
+
+func getKshConfigFragment(homedir string) string {
+	// Only source the config from ksh93, since other ksh implementations (e.g. mksh) can't even parse it
+	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + data.GetHishtoryDir(homedir) + "\"\ncase \"$KSH_VERSION\" in *93*) . " + getKshConfigPath(homedir) + " ;; esac\n"
+}
+
+// addToShellConfigIfMissing appends the config fragment to the given shell config file, unless it is already there
+func addToShellConfigIfMissing(shellConfigPath, configFragment string) error {
+	shellConfig, err := os.ReadFile(shellConfigPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %v", shellConfigPath, err)
+	}
+	if strings.Contains(string(shellConfig), configFragment) {
+		return nil
+	}
+	return addToShellConfig(shellConfigPath, configFragment)
+}
+
 func getZshConfigPath(homedir string) string {
-	return path.Join(homedir, data.GetHishtoryPath(), "config.zsh")
+	return path.Join(data.GetHishtoryDir(homedir), "config.zsh")
 }
 
 func configureZshrc(homedir, binaryPath string) error {
@@ -308,7 +518,7 @@ func getZshRcPath(homedir string) string {
 }
 
 func getZshConfigFragment(homedir string) string {
-	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + path.Join(homedir, data.GetHishtoryPath()) + "\"\nsource " + getZshConfigPath(homedir) + "\n"
+	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + data.GetHishtoryDir(homedir) + "\"\nsource " + getZshConfigPath(homedir) + "\n"
 }
 
 func isZshConfigured(homedir string) (bool, error) {
@@ -324,7 +534,7 @@ func isZshConfigured(homedir string) (bool, error) {
 }
 
 func getBashConfigPath(homedir string) string {
-	return path.Join(homedir, data.GetHishtoryPath(), "config.sh")
+	return path.Join(data.GetHishtoryDir(homedir), "config.sh")
 }
 
 func configureBashrc(homedir, binaryPath string) error {
@@ -382,7 +592,7 @@ func addToShellConfig(shellConfigPath, configFragment string) error {
 }
 
 func getBashConfigFragment(homedir string) string {
-	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + path.Join(homedir, data.GetHishtoryPath()) + "\"\nsource " + getBashConfigPath(homedir) + "\n"
+	return "\n# Hishtory Config:\nexport PATH=\"$PATH:" + data.GetHishtoryDir(homedir) + "\"\nsource " + getBashConfigPath(homedir) + "\n"
 }
 
 func isBashRcConfigured(homedir string) (bool, error) {
@@ -477,19 +687,33 @@ func copyFile(src, dst string) error {
 
 func uninstall(ctx context.Context) error {
 	homedir := hctx.GetHome(ctx)
-	err := stripLines(path.Join(homedir, ".bashrc"), getBashConfigFragment(homedir))
+	fragments, err := getShellConfigFragments(homedir)
 	if err != nil {
 		return err
 	}
-	err = stripLines(getZshRcPath(homedir), getZshConfigFragment(homedir))
+	for rcPath, fragment := range fragments {
+		err = stripLines(rcPath, fragment)
+		if err != nil {
+			return err
+		}
+	}
+	if hctx.GetConf(ctx).SecretStorage == hctx.SecretStorageKeychain {
+		err = hctx.DeleteKeychainSecret()
+		if err != nil {
+			return err
+		}
+	}
+	err = hctx.StopAgent()
 	if err != nil {
 		return err
 	}
-	err = stripLines(path.Join(homedir, ".config/fish/config.fish"), getFishConfigFragment(homedir))
+	// Resolve both directories before deleting anything, since deleting the config file changes how they are resolved
+	dataDir, configDir := data.GetHishtoryDir(homedir), data.GetHishtoryConfigDir(homedir)
+	err = os.RemoveAll(configDir)
 	if err != nil {
 		return err
 	}
-	err = os.RemoveAll(path.Join(homedir, data.GetHishtoryPath()))
+	err = os.RemoveAll(dataDir)
 	if err != nil {
 		return err
 	}
@@ -529,4 +753,6 @@ func init() {
 
 	offlineInit = initCmd.Flags().Bool("offline", false, "Install hiSHtory in offline mode wiht all syncing capabilities disabled")
 	offlineInstall = installCmd.Flags().Bool("offline", false, "Install hiSHtory in offline mode wiht all syncing capabilities disabled")
+	readOnlyInit = initCmd.Flags().Bool("read-only", false, "Make this a read-only device that searches your synced history but never uploads its own commands")
+	readOnlyInstall = installCmd.Flags().Bool("read-only", false, "Make this a read-only device that searches your synced history but never uploads its own commands")
 }
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var journalDate *string
+var journalGroupBy *string
+var journalPublish *bool
+
+var journalCmd = &cobra.Command{
+	Use:   "journal [QUERY]",
+	Short: "Render a day's commands as a Markdown log, e.g. for appending to a notes vault",
+	Long: "Renders the commands that were started on the given day (today by default), grouped by project (the git repository " +
+		"they were run in) or by shell session, as Markdown. Supports the same query format as 'hishtory query' to filter the " +
+		"commands. The output format can be customized with `hishtory config-set journal-template`. With --publish, the journal is " +
+		"published to the configured integrations (see `hishtory config-set obsidian-folder` and `hishtory config-set notion-database`) " +
+		"rather than printed.",
+	GroupID: GROUP_ID_QUERYING,
+	Run: func(cmd *cobra.Command, args []string) {
+		day := time.Now()
+		if *journalDate != "" {
+			var err error
+			day, err = time.ParseInLocation("2006-01-02", *journalDate, time.Local)
+			if err != nil {
+				lib.CheckFatalError(fmt.Errorf("failed to parse --date=%#v, expected a date like 2024-06-01", *journalDate))
+			}
+		}
+		ctx := hctx.MakeContext()
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		journal, err := lib.BuildJournal(ctx, day, *journalGroupBy, strings.Join(args, " "))
+		lib.CheckFatalError(err)
+		rendered, err := lib.RenderJournal(journal, hctx.GetConf(ctx).JournalTemplate)
+		lib.CheckFatalError(err)
+		if *journalPublish {
+			lib.CheckFatalError(lib.PublishJournal(ctx, day, rendered))
+			fmt.Printf("Published the journal for %s\n", day.Format("2006-01-02"))
+			return
+		}
+		fmt.Print(rendered)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(journalCmd)
+	journalDate = journalCmd.Flags().String("date", "", "The day to render, in the format 2024-06-01 (defaults to today)")
+	journalPublish = journalCmd.Flags().Bool("publish", false, "Publish the journal to the configured integrations rather than printing it")
+	journalGroupBy = journalCmd.Flags().String("group-by", lib.JournalGroupByProject, "How to group the commands, either 'project' or 'session'")
+}
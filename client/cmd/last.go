@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var lastFormat *string
+var lastJson *bool
+var lastMinRuntime *time.Duration
+
+var lastCmd = &cobra.Command{
+	Use:   "last",
+	Short: "Print the exit code, runtime, and directory of the previous command, e.g. for displaying in your prompt",
+	Long: "Prints information about the previous command run in the current shell. This is read from a small cache rather than the DB so that it is fast enough to run in your prompt (e.g. via a starship custom module).\n\n" +
+		"Supported placeholders for --format: {command}, {exit_code}, {runtime}, {runtime_ms}, {cwd}, {end_time}",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		homedir, err := os.UserHomeDir()
+		lib.CheckFatalError(err)
+		last, ok, err := lib.GetCachedLastCommand(homedir)
+		lib.CheckFatalError(err)
+		if !ok {
+			// The shell hooks are from an older version of hishtory that doesn't cache the last command
+			ctx := hctx.MakeContext()
+			last, err = lib.GetLastCommandFromDb(ctx)
+			lib.CheckFatalError(err)
+		}
+		if last == nil || last.Runtime() < *lastMinRuntime {
+			return
+		}
+		if *lastJson {
+			serialized, err := json.Marshal(last)
+			lib.CheckFatalError(err)
+			fmt.Println(string(serialized))
+			return
+		}
+		fmt.Println(lib.FormatLastCommand(*last, *lastFormat))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lastCmd)
+	lastFormat = lastCmd.Flags().String("format", lib.DefaultLastCommandFormat, "The format to print the previous command in")
+	lastJson = lastCmd.Flags().Bool("json", false, "Output the previous command as JSON")
+	lastMinRuntime = lastCmd.Flags().Duration("min-runtime", 0, "Print nothing if the previous command ran for less than this (e.g. 5s)")
+}
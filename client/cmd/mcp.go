@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var mcpCmd = &cobra.Command{
+	Use:   "mcp",
+	Short: "Serve a read-only MCP server over stdio so that AI assistants can search your history",
+	Long: "Serves the Model Context Protocol over stdin and stdout, for AI assistants and coding tools that support MCP servers " +
+		"(configure them to run 'hishtory mcp'). Assistants can search your history and count commands, but can't modify anything. " +
+		"Secrets matching the patterns added with 'hishtory config-add mcp-redaction-patterns' are redacted from everything that is returned. " +
+		"The same server is also available over the local API at /api/v1/mcp (see 'hishtory serve-api').",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		lib.CheckFatalError(lib.ServeMcp(ctx, os.Stdin, os.Stdout))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mcpCmd)
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var migrateDataDirCmd = &cobra.Command{
+	Use:     "migrate-data-dir",
+	Short:   "Move hiSHtory's data out of ~/.hishtory and into $XDG_DATA_HOME and $XDG_CONFIG_HOME (or %APPDATA% on Windows)",
+	GroupID: GROUP_ID_CONFIG,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		homedir, err := os.UserHomeDir()
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(migrateDataDir(homedir))
+	},
+}
+
+func migrateDataDir(homedir string) error {
+	dataDir, configDir, needsMigration := data.GetHishtoryDirMigration(homedir)
+	if !needsMigration {
+		fmt.Println("hiSHtory is already using the preferred data directory, so there is nothing to migrate")
+		return nil
+	}
+	legacyDir := data.GetLegacyHishtoryDir(homedir)
+	// The agent's socket is in the config directory and it keeps the DB open, so it has to be restarted afterwards
+	if err := hctx.StopAgent(); err != nil {
+		return err
+	}
+
+	// Compute the old shell config fragments before moving anything, since they reference the legacy directory
+	oldFragments, err := getShellConfigFragments(homedir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{dataDir, configDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	// If only XDG_CONFIG_HOME is set, the data stays in the legacy directory and only the config file is moved
+	if dataDir != legacyDir {
+		files, err := os.ReadDir(legacyDir)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", legacyDir, err)
+		}
+		// Move the config file last, since its presence in the legacy directory is what makes hiSHtory keep using it. This
+		// way an interrupted migration leaves hiSHtory using the legacy directory rather than a half-populated new one.
+		for _, file := range files {
+			if file.Name() == data.CONFIG_PATH || file.Name() == data.CONFIG_PATH+".lock" {
+				continue
+			}
+			if err := moveFile(path.Join(legacyDir, file.Name()), path.Join(dataDir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	_ = moveFile(path.Join(legacyDir, data.CONFIG_PATH+".lock"), path.Join(configDir, data.CONFIG_PATH+".lock"))
+	if err := moveFile(path.Join(legacyDir, data.CONFIG_PATH), path.Join(configDir, data.CONFIG_PATH)); err != nil {
+		return err
+	}
+	if dataDir != legacyDir {
+		// Ignore errors here, since a non-empty legacy directory (e.g. containing files created by the user) is harmless
+		_ = os.Remove(legacyDir)
+	}
+
+	// Point the shell configs at the new directory
+	for rcPath, fragment := range oldFragments {
+		if err := stripLines(rcPath, fragment); err != nil {
+			return err
+		}
+	}
+	if err := configureShells(homedir, data.GetHishtoryBinaryPath(homedir)); err != nil {
+		return err
+	}
+	fmt.Printf("Moved hiSHtory's data to %s and its config to %s, please restart your terminal...\n", dataDir, configDir)
+	return nil
+}
+
+func moveFile(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("refusing to overwrite %s with %s", dst, src)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(migrateDataDirCmd)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/shared/testutils"
+)
+
+func TestMigrateDataDirConfigOnly(t *testing.T) {
+	homedir := t.TempDir()
+	t.Setenv("HISHTORY_PATH", "")
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", path.Join(homedir, "xdg-config"))
+	t.Setenv("ZDOTDIR", "")
+	legacyDir := data.GetLegacyHishtoryDir(homedir)
+	testutils.Check(t, os.MkdirAll(legacyDir, 0o700))
+	testutils.Check(t, os.WriteFile(path.Join(legacyDir, data.CONFIG_PATH), []byte("{}"), 0o600))
+	testutils.Check(t, os.WriteFile(path.Join(legacyDir, data.DB_PATH), []byte("db"), 0o600))
+
+	// Only XDG_CONFIG_HOME is set, so only the config file moves and the data stays in the legacy directory
+	testutils.Check(t, migrateDataDir(homedir))
+	configDir := path.Join(homedir, "xdg-config", "hishtory")
+	if _, err := os.Stat(path.Join(configDir, data.CONFIG_PATH)); err != nil {
+		t.Fatalf("expected the config file to be moved: %v", err)
+	}
+	if _, err := os.Stat(path.Join(legacyDir, data.CONFIG_PATH)); err == nil {
+		t.Fatalf("expected the config file to be removed from the legacy directory")
+	}
+	if contents, err := os.ReadFile(path.Join(legacyDir, data.DB_PATH)); err != nil || string(contents) != "db" {
+		t.Fatalf("expected the DB to be left in the legacy directory, got contents=%#v err=%v", string(contents), err)
+	}
+	if data.GetHishtoryDir(homedir) != legacyDir || data.GetHishtoryConfigDir(homedir) != configDir {
+		t.Fatalf("unexpected dirs after migrating: data=%#v config=%#v", data.GetHishtoryDir(homedir), data.GetHishtoryConfigDir(homedir))
+	}
+	if _, _, needsMigration := data.GetHishtoryDirMigration(homedir); needsMigration {
+		t.Fatalf("expected no further migration to be needed")
+	}
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var pickerStdoutEscaped *bool
+var pickerLimit *int
+
+var pickerCmd = &cobra.Command{
+	Use:   "picker",
+	Short: "Search your history live from an editor integration (e.g. a Telescope or fzf-lua source)",
+	Long: "With --stdout-escaped, reads queries from stdin (one per line, each being the full current query) and responds to each with the matching entries in the same escaped, tab-separated format as `hishtory query --fzf-source`, followed by an empty line. " +
+		"Queries that are superseded by a newer one before they are run are skipped. Errors are written to stderr. Exits once stdin is closed.",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !*pickerStdoutEscaped {
+			lib.CheckFatalError(fmt.Errorf("hishtory picker currently only supports --stdout-escaped"))
+		}
+		ctx := hctx.MakeContext()
+		// Don't print the offline warning since that would corrupt the stream read by the editor
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		lib.CheckFatalError(lib.ServeEscapedPicker(ctx, os.Stdin, os.Stdout, os.Stderr, *pickerLimit))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pickerCmd)
+	pickerStdoutEscaped = pickerCmd.Flags().Bool("stdout-escaped", false, "Respond to queries read from stdin with escaped results on stdout, for use by editor integrations")
+	pickerLimit = pickerCmd.Flags().Int("limit", 100, "The maximum number of results for each query")
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var pinnedCmd = &cobra.Command{
+	Use:                "pinned",
+	Short:              "List the entries that you pinned in the TUI",
+	Long:               "Lists the entries that were pinned via Control+L in the TUI, which are always displayed before other matching entries. Supports the same query format as 'hishtory query' for filtering the pinned entries.",
+	GroupID:            GROUP_ID_QUERYING,
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		entries, err := lib.Search(ctx, hctx.GetDb(ctx), strings.Join(append([]string{"pinned:true"}, args...), " "), 0)
+		lib.CheckFatalError(err)
+		_, err = lib.DisplayResults(ctx, entries, len(entries))
+		lib.CheckFatalError(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pinnedCmd)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var preExecCheckCmd = &cobra.Command{
+	Use:                "preExecCheck",
+	Hidden:             true,
+	Short:              "[Internal-only] The command used by the shell hooks to check commands with the pre-exec hook",
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			// Never block the user's command because of a mismatch between the shell hook and the binary
+			hctx.GetLogger().Warnf("preExecCheck called with args=%#v, expected a shell and a command", args)
+			return
+		}
+		ctx := hctx.MakeContext()
+		result := lib.CheckPreExec(ctx, args[0], args[1])
+		switch result.Decision {
+		case lib.PreExecDeny:
+			fmt.Fprintf(os.Stderr, "hishtory: this command was denied by the pre-exec hook")
+			if result.Message != "" {
+				fmt.Fprintf(os.Stderr, ": %s", result.Message)
+			}
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		case lib.PreExecWarn:
+			fmt.Fprintf(os.Stderr, "hishtory: warning from the pre-exec hook: %s\n", result.Message)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(preExecCheckCmd)
+}
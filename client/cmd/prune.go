@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var pruneDryRun *bool
+var pruneForce *bool
+
+var pruneCmd = &cobra.Command{
+	Use:     "prune",
+	Short:   "Delete old history entries according to your retention policy",
+	Long:    "Applies the retention policy configured via `hishtory config-add retention-rule` now, rather than waiting for it to be applied automatically. Pruned entries are removed on the current machine and on all remote machines.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		if len(config.RetentionPolicy) == 0 {
+			fmt.Println("No retention policy is configured, add one via `hishtory config-add retention-rule`")
+			return
+		}
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
+		now := time.Now()
+		entries, err := lib.FindEntriesToPrune(ctx, now)
+		lib.CheckFatalError(err)
+		if *pruneDryRun {
+			_, err = lib.DisplayResults(ctx, entries, len(entries))
+			lib.CheckFatalError(err)
+			fmt.Printf("Would prune %d entries\n", len(entries))
+			return
+		}
+		if len(entries) == 0 {
+			fmt.Println("No entries to prune")
+			return
+		}
+		if !*pruneForce {
+			fmt.Printf("This will permanently delete %d entries, are you sure? [y/N]", len(entries))
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting prune per user response of %#v\n", strings.TrimSpace(resp))
+				return
+			}
+		}
+		lib.CheckFatalError(lib.Prune(ctx, entries))
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.LastPruneTimestamp = now.Unix()
+		}))
+		fmt.Printf("Pruned %d entries (run `hishtory rollback` to undo this locally)\n", len(entries))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneDryRun = pruneCmd.Flags().Bool("dry-run", false, "Only display the entries that would be pruned")
+	pruneForce = pruneCmd.Flags().Bool("force", false, "Don't ask for confirmation before pruning")
+}
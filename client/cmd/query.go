@@ -3,7 +3,10 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
@@ -18,6 +21,18 @@ var EXAMPLE_QUERIES string = `Example queries:
 'hishtory SUBCOMMAND curl host:x1'		# Find shell commands containing 'curl' run on 'x1'
 'hishtory SUBCOMMAND exit_code:1'		# Find shell commands that exited with status code 1
 'hishtory SUBCOMMAND before:2022-02-01'	# Find shell commands run before 2022-02-01
+'hishtory SUBCOMMAND dev_env:node@20'	# Find shell commands run while mise had node 20 active
+'hishtory SUBCOMMAND remote:true'		# Find shell commands run over SSH
+'hishtory SUBCOMMAND container:devbox'	# Find shell commands run in the container named 'devbox'
+'hishtory SUBCOMMAND tmux:main:1.0'		# Find shell commands run in the first pane of window 1 of the tmux session 'main'
+'hishtory SUBCOMMAND correlation_id:1234-5678-1697452300-42'	# Find the shell command that a tool logged $HISHTORY_CORRELATION_ID from
+'hishtory SUBCOMMAND kubecontext:prod'	# Find shell commands run while kubectl was using the 'prod' context
+'hishtory SUBCOMMAND env:AWS_PROFILE=prod'	# Find shell commands run with $AWS_PROFILE set to 'prod' (see 'hishtory config-add env-snapshot-variables')
+'hishtory SUBCOMMAND tag:golden'		# Find shell commands that were tagged with 'golden' (see 'hishtory tag')
+'hishtory SUBCOMMAND pinned:true'		# Find shell commands that were pinned via Control+L in the TUI
+'hishtory SUBCOMMAND root:true'		# Find shell commands that were run as root (e.g. via 'sudo -i')
+'hishtory SUBCOMMAND script:false'		# Find shell commands that were typed at a prompt rather than run by a script
+'hishtory SUBCOMMAND nested:true'		# Find shell commands run in a shell started from another shell (e.g. by 'nix develop')
 `
 
 var GROUP_ID_QUERYING string = "group_id:querying"
@@ -26,24 +41,146 @@ var queryCmd = &cobra.Command{
 	Use:                "query",
 	Short:              "Query your shell history and display the results in an ASCII art table",
 	GroupID:            GROUP_ID_QUERYING,
-	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "query"),
+	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "query") + "\nPass --fzf-source to instead output tab-separated results (command, hostname, cwd, timestamp, runtime, exit code) for use with fzf.\nPass --verbose to also print the total number of matching entries and how long the query took.\nPass --check to instead only check that the query is valid, without running it (see 'hishtory atoms' for the supported atoms).\nPass --pick to instead interactively pick one of the matching commands in a minimal picker and print it (exits with status 1 if nothing was picked).\nPass --format json|tsv|null-delimited to instead output machine-readable results, optionally with --fields FIELD,FIELD (e.g. command,cwd,exit_code,start_time), --limit N, and --offset N.\n",
 	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := hctx.MakeContext()
+		args, isCheck := extractFlag(args, "--check")
+		if isCheck {
+			checkQuery(ctx, strings.Join(args, " "))
+			return
+		}
 		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
-		query(ctx, strings.Join(args, " "))
+		args, isFzfSource := extractFlag(args, "--fzf-source")
+		if isFzfSource {
+			// Don't print the offline warning since that would corrupt the stream read by fzf
+			err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+			if err != nil && !lib.IsOfflineError(err) {
+				lib.CheckFatalError(err)
+			}
+			lib.CheckFatalError(lib.WriteFzfSource(ctx, os.Stdout, strings.Join(args, " ")))
+			return
+		}
+		args, isPick := extractFlag(args, "--pick")
+		if isPick {
+			selected, err := lib.QuickPick(ctx, strings.Join(args, " "))
+			lib.CheckFatalError(err)
+			if selected == "" {
+				os.Exit(1)
+			}
+			fmt.Println(selected)
+			return
+		}
+		args, format, err := extractFlagValue(args, "--format")
+		lib.CheckFatalError(err)
+		args, fields, err := extractFlagValue(args, "--fields")
+		lib.CheckFatalError(err)
+		args, limit, err := extractIntFlagValue(args, "--limit")
+		lib.CheckFatalError(err)
+		args, offset, err := extractIntFlagValue(args, "--offset")
+		lib.CheckFatalError(err)
+		if format != "" {
+			// Don't print the offline warning since that would corrupt the output read by scripts
+			err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+			if err != nil && !lib.IsOfflineError(err) {
+				lib.CheckFatalError(err)
+			}
+			options := lib.FormattedQueryOptions{Format: format, Fields: fields, Limit: limit, Offset: offset}
+			lib.CheckFatalError(lib.WriteFormattedResults(ctx, os.Stdout, strings.Join(args, " "), options))
+			return
+		}
+		if fields != "" || limit != 0 || offset != 0 {
+			lib.CheckFatalError(fmt.Errorf("--fields, --limit, and --offset can only be used with --format"))
+		}
+		args, isVerbose := extractFlag(args, "--verbose")
+		query(ctx, strings.Join(args, " "), isVerbose)
 	},
 }
 
+// checkQuery validates a query without running it, printing any problems and exiting with status 1 if there are any
+func checkQuery(ctx context.Context, query string) {
+	problems, err := lib.CheckQuery(ctx, query)
+	lib.CheckFatalError(err)
+	if len(problems) > 0 {
+		fmt.Print(lib.FormatQueryErrors(query, problems))
+		os.Exit(1)
+	}
+	fmt.Println("The query is valid")
+}
+
+// extractFlag removes the given boolean flag from args and returns whether it was present. This
+// is needed for commands that disable flag parsing so that queries like `-foo` aren't parsed as flags.
+func extractFlag(args []string, flag string) ([]string, bool) {
+	remainingArgs := make([]string, 0, len(args))
+	found := false
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+		} else {
+			remainingArgs = append(remainingArgs, arg)
+		}
+	}
+	return remainingArgs, found
+}
+
+// extractFlagValue removes the given flag and its value (either `--flag value` or `--flag=value`) from args and
+// returns the value, or an empty string if the flag wasn't present
+func extractFlagValue(args []string, flag string) ([]string, string, error) {
+	remainingArgs := make([]string, 0, len(args))
+	value := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == flag:
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("%s requires a value", flag)
+			}
+			value = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], flag+"="):
+			value = strings.TrimPrefix(args[i], flag+"=")
+		default:
+			remainingArgs = append(remainingArgs, args[i])
+		}
+	}
+	return remainingArgs, value, nil
+}
+
+// extractIntFlagValue is like extractFlagValue for flags with integer values, and returns 0 if the flag wasn't present
+func extractIntFlagValue(args []string, flag string) ([]string, int, error) {
+	args, value, err := extractFlagValue(args, flag)
+	if err != nil || value == "" {
+		return args, 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s must be an integer, got %#v", flag, value)
+	}
+	return args, n, nil
+}
+
 var tqueryCmd = &cobra.Command{
 	Use:                "tquery",
+	Aliases:            []string{"tui"},
 	Short:              "Interactively query your shell history in a TUI interface",
 	GroupID:            GROUP_ID_QUERYING,
-	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "tquery"),
+	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "tquery") + "\nPass --query QUERY to pre-fill the search box (equivalent to passing the query as arguments).\nPass --stdin to instead pick from the commands read from stdin (one per line) and print the selected one (exits with status 1 if nothing was picked).\n",
 	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := hctx.MakeContext()
-		lib.CheckFatalError(lib.TuiQuery(ctx, strings.Join(args, " ")))
+		ctx := lib.MakeQueryContext()
+		args, initialQuery, err := extractFlagValue(args, "--query")
+		lib.CheckFatalError(err)
+		args, isStdin := extractFlag(args, "--stdin")
+		initialQuery = strings.TrimSpace(initialQuery + " " + strings.Join(args, " "))
+		if isStdin {
+			selected, err := lib.TuiPickFromCandidates(ctx, initialQuery, os.Stdin)
+			lib.CheckFatalError(err)
+			if selected == "" {
+				os.Exit(1)
+			}
+			fmt.Println(selected)
+			return
+		}
+		lib.CheckFatalError(lib.TuiQuery(ctx, initialQuery))
 	},
 }
 
@@ -51,25 +188,35 @@ var exportCmd = &cobra.Command{
 	Use:                "export",
 	Short:              "Export your shell history and display just the raw commands",
 	GroupID:            GROUP_ID_QUERYING,
-	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "export"),
+	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "export") + "\nPass --canonical to instead output every field of the matching entries as JSON lines in a canonical form sorted by entry hash, so that the exports of two machines can be diffed to find sync discrepancies (combine with 'defaults:false' to include everything).\n",
 	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := hctx.MakeContext()
 		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
-		export(ctx, strings.Join(args, " "))
+		args, isCanonical := extractFlag(args, "--canonical")
+		export(ctx, strings.Join(args, " "), isCanonical)
 	},
 }
 
-func export(ctx context.Context, query string) {
+func export(ctx context.Context, query string, isCanonical bool) {
 	db := hctx.GetDb(ctx)
 	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
 	if err != nil {
 		if lib.IsOfflineError(err) {
-			fmt.Println("Warning: hishtory is offline so this may be missing recent results from your other machines!")
+			// Warn on stderr for canonical exports, so that the output can still be diffed as-is
+			out := os.Stdout
+			if isCanonical {
+				out = os.Stderr
+			}
+			fmt.Fprintln(out, "Warning: hishtory is offline so this may be missing recent results from your other machines!")
 		} else {
 			lib.CheckFatalError(err)
 		}
 	}
+	if isCanonical {
+		lib.CheckFatalError(lib.CanonicalExport(ctx, query, os.Stdout))
+		return
+	}
 	data, err := lib.Search(ctx, db, query, 0)
 	lib.CheckFatalError(err)
 	for i := len(data) - 1; i >= 0; i-- {
@@ -77,7 +224,7 @@ func export(ctx context.Context, query string) {
 	}
 }
 
-func query(ctx context.Context, query string) {
+func query(ctx context.Context, query string, isVerbose bool) {
 	db := hctx.GetDb(ctx)
 	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
 	if err != nil {
@@ -89,9 +236,20 @@ func query(ctx context.Context, query string) {
 	}
 	lib.CheckFatalError(displayBannerIfSet(ctx))
 	numResults := 25
+	start := time.Now()
 	data, err := lib.Search(ctx, db, query, numResults*5)
 	lib.CheckFatalError(err)
-	lib.CheckFatalError(lib.DisplayResults(ctx, data, numResults))
+	var numMatches int64
+	if isVerbose {
+		numMatches, err = lib.CountSearchResults(ctx, db, query)
+		lib.CheckFatalError(err)
+	}
+	duration := time.Since(start)
+	numDisplayed, err := lib.DisplayResults(ctx, data, numResults)
+	lib.CheckFatalError(err)
+	if isVerbose {
+		fmt.Println(lib.QueryStats{NumMatches: numMatches, NumDisplayed: numDisplayed, Duration: duration})
+	}
 }
 
 func displayBannerIfSet(ctx context.Context) error {
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var recordCommand *string
+var recordExitCode *int
+var recordCwd *string
+var recordHostname *string
+var recordStart *string
+var recordEnd *string
+var recordStdin *bool
+
+var recordCmd = &cobra.Command{
+	Use:   "record",
+	Short: "Record a command that was run outside of a hooked shell (e.g. by a CI wrapper, tmux plugin, or editor terminal)",
+	Long: "Records a single command specified via flags, or with --stdin a batch of commands read from stdin as either a JSON array or one JSON object per line. " +
+		`Each object has the fields "command", "exit_code", "cwd", "start_time", "end_time", and "hostname", where only "command" is required. ` +
+		"Times are either unix timestamps in seconds or RFC3339 strings, and default to now.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		if !hctx.GetConf(ctx).IsEnabled {
+			fmt.Fprintln(os.Stderr, "Not recording since hishtory is disabled, run `hishtory enable` to re-enable it")
+			return
+		}
+		var commands []lib.RecordedCommand
+		if *recordStdin {
+			if *recordCommand != "" {
+				lib.CheckFatalError(fmt.Errorf("--command can't be combined with --stdin"))
+			}
+			var err error
+			commands, err = lib.ReadRecordedCommands(os.Stdin)
+			lib.CheckFatalError(err)
+		} else {
+			if *recordCommand == "" {
+				lib.CheckFatalError(fmt.Errorf("either --command or --stdin must be specified"))
+			}
+			start, err := lib.ParseRecordTime(*recordStart)
+			lib.CheckFatalError(err)
+			end, err := lib.ParseRecordTime(*recordEnd)
+			lib.CheckFatalError(err)
+			commands = []lib.RecordedCommand{{
+				Command:   *recordCommand,
+				ExitCode:  *recordExitCode,
+				Cwd:       *recordCwd,
+				Hostname:  *recordHostname,
+				StartTime: start,
+				EndTime:   end,
+			}}
+		}
+		entries, err := lib.BuildRecordedEntries(ctx, commands)
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(persistHistoryEntries(ctx, entries))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(recordCmd)
+	recordCommand = recordCmd.Flags().String("command", "", "The command that was run")
+	recordExitCode = recordCmd.Flags().Int("exit-code", 0, "The exit code of the command")
+	recordCwd = recordCmd.Flags().String("cwd", "", "The directory the command was run in (defaults to the current directory)")
+	recordHostname = recordCmd.Flags().String("hostname", "", "The hostname of the machine the command was run on (defaults to this machine)")
+	recordStart = recordCmd.Flags().String("start", "", "When the command started, as a unix timestamp or RFC3339 time (defaults to --end)")
+	recordEnd = recordCmd.Flags().String("end", "", "When the command finished, as a unix timestamp or RFC3339 time (defaults to now)")
+	recordStdin = recordCmd.Flags().Bool("stdin", false, "Read a batch of commands as JSON from stdin")
+}
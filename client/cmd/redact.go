@@ -6,12 +6,9 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
-	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
-	"github.com/ddworken/hishtory/shared"
 	"github.com/spf13/cobra"
 )
 
@@ -34,15 +31,10 @@ var redactCmd = &cobra.Command{
 }
 
 func redact(ctx context.Context, query string, force bool) error {
-	tx, err := lib.MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	historyEntries, err := lib.Search(ctx, hctx.GetDb(ctx), query, 0)
 	if err != nil {
 		return err
 	}
-	var historyEntries []*data.HistoryEntry
-	res := tx.Find(&historyEntries)
-	if res.Error != nil {
-		return res.Error
-	}
 	if force {
 		fmt.Printf("Permanently deleting %d entries\n", len(historyEntries))
 	} else {
@@ -57,40 +49,28 @@ func redact(ctx context.Context, query string, force bool) error {
 			return nil
 		}
 	}
-	tx, err = lib.MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	if len(historyEntries) > 0 {
+		if err := lib.SnapshotDb(ctx, "redact"); err != nil {
+			return err
+		}
+	}
+	numDeleted, err := lib.DeleteSearchResults(ctx, query)
 	if err != nil {
 		return err
 	}
-	res = tx.Delete(&data.HistoryEntry{})
-	if res.Error != nil {
-		return res.Error
+	if err := lib.RecordAuditEvent(ctx, lib.AuditActionRedact, fmt.Sprintf("deleted %d entries matching a search", numDeleted)); err != nil {
+		return err
 	}
-	if res.RowsAffected != int64(len(historyEntries)) {
-		return fmt.Errorf("DB deleted %d rows, when we only expected to delete %d rows, something may have gone wrong", res.RowsAffected, len(historyEntries))
+	if numDeleted != int64(len(historyEntries)) {
+		return fmt.Errorf("DB deleted %d rows, when we only expected to delete %d rows, something may have gone wrong", numDeleted, len(historyEntries))
 	}
-	err = deleteOnRemoteInstances(ctx, historyEntries)
+	err = lib.DeleteOnRemoteInstances(ctx, historyEntries)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func deleteOnRemoteInstances(ctx context.Context, historyEntries []*data.HistoryEntry) error {
-	config := hctx.GetConf(ctx)
-	if config.IsOffline {
-		return nil
-	}
-
-	var deletionRequest shared.DeletionRequest
-	deletionRequest.SendTime = time.Now()
-	deletionRequest.UserId = data.UserId(config.UserSecret)
-
-	for _, entry := range historyEntries {
-		deletionRequest.Messages.Ids = append(deletionRequest.Messages.Ids, shared.MessageIdentifier{Date: entry.EndTime, DeviceId: entry.DeviceId})
-	}
-	return lib.SendDeletionRequest(deletionRequest)
-}
-
 func init() {
 	rootCmd.AddCommand(redactCmd)
 }
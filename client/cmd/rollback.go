@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var rollbackList *bool
+
+var rollbackCmd = &cobra.Command{
+	Use:     "rollback [SNAPSHOT_ID]",
+	Short:   "Undo a bulk delete, import, or DB upgrade by rolling back to the snapshot taken before it",
+	Long:    "hishtory automatically snapshots the local DB before risky operations (`hishtory prune`, `hishtory redact`, imports, and DB upgrades). Snapshots are kept for a week. This rolls the local DB back to the given snapshot (or the newest one), after first snapshotting the current DB so that the rollback can itself be undone. Only the local DB is rolled back, so entries that were deleted on other devices stay deleted there (run `hishtory reupload` to restore them).",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		if *rollbackList {
+			snapshots, err := lib.ListSnapshots(ctx)
+			lib.CheckFatalError(err)
+			if len(snapshots) == 0 {
+				fmt.Println("There are no snapshots to roll back to")
+				return
+			}
+			tbl := table.New("ID", "Time", "Before", "Size")
+			tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+			for _, snapshot := range snapshots {
+				tbl.AddRow(snapshot.Id, snapshot.Time.Format(hctx.GetConf(ctx).TimestampFormat), snapshot.Operation, lib.FormatBytes(snapshot.SizeBytes))
+			}
+			tbl.Print()
+			return
+		}
+		// Apply any pending deletion requests first, since this device's own deletion request for the entries being
+		// restored would otherwise delete them again during the next sync
+		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
+		id := ""
+		if len(args) == 1 {
+			id = args[0]
+		}
+		snapshot, err := lib.RollbackToSnapshot(ctx, id)
+		lib.CheckFatalError(err)
+		fmt.Printf("Rolled back to the snapshot taken before the %s at %s\n", snapshot.Operation, snapshot.Time.Format(hctx.GetConf(ctx).TimestampFormat))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+	rollbackList = rollbackCmd.Flags().Bool("list", false, "List the snapshots that can be rolled back to")
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"os"
 
+	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
 	"github.com/spf13/cobra"
 )
@@ -14,20 +15,73 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "hiSHtory",
 	Short: "hiSHtory: Better shell history",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		lib.SetAuditCommand(auditCommandPath(cmd))
+		if isConfigCommand(cmd) {
+			// Snapshot the config so that the keys changed by the command can be recorded in the audit log
+			configBeforeCommand, _ = hctx.GetConfigContents()
+		}
+		return hctx.SetConfigOverrides(*configOverrides)
+	},
+	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+		if configBeforeCommand == nil {
+			return nil
+		}
+		return lib.RecordConfigChanges(hctx.MakeContext(), configBeforeCommand)
+	},
 }
 
+var configOverrides *[]string
+
+// The contents of the config file before a config command ran, see PersistentPreRunE
+var configBeforeCommand []byte
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	args, isTracing := extractTraceFlag(os.Args[1:])
+	if isTracing {
+		hctx.EnableTracing()
+		rootCmd.SetArgs(args)
+	}
 	err := rootCmd.Execute()
+	if isTracing {
+		command := "hishtory"
+		if cmd, _, findErr := rootCmd.Find(args); findErr == nil {
+			command = auditCommandPath(cmd)
+		}
+		hctx.WriteTrace(os.Stderr, command)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// extractTraceFlag removes --trace from args. This is done before cobra parses the args so that --trace also works
+// for the commands that parse their own flags (e.g. `hishtory query`), where it would otherwise be part of the query.
+func extractTraceFlag(args []string) ([]string, bool) {
+	remaining := make([]string, 0, len(args))
+	isTracing := false
+	for i, arg := range args {
+		if arg == "--" {
+			remaining = append(remaining, args[i:]...)
+			break
+		}
+		if arg == "--trace" {
+			isTracing = true
+			continue
+		}
+		remaining = append(remaining, arg)
+	}
+	return remaining, isTracing
+}
+
 func init() {
 	rootCmd.AddGroup(&cobra.Group{ID: GROUP_ID_QUERYING, Title: "History Searching"})
 	rootCmd.AddGroup(&cobra.Group{ID: GROUP_ID_MANAGEMENT, Title: "History Management"})
 	rootCmd.AddGroup(&cobra.Group{ID: GROUP_ID_CONFIG, Title: "Configuration"})
 	rootCmd.Version = "v0." + lib.Version
+	// Only registered so that it is documented in --help, see extractTraceFlag
+	rootCmd.PersistentFlags().Bool("trace", false, "Print a timing breakdown of the command (e.g. loading the config, opening the DB, running SQL, and rendering) to stderr, for reporting slowness")
+	configOverrides = rootCmd.PersistentFlags().StringArray("set", []string{}, "Override a config key for this invocation only, e.g. --set filter_duplicate_commands=false")
 }
@@ -20,8 +20,13 @@ var saveHistoryEntryCmd = &cobra.Command{
 	Short:              "[Internal-only] The command used to save history entries",
 	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
+		// Record commands run in a root shell (e.g. `sudo -i`) in the history of the user who ran sudo
+		if sudoHome := lib.UseSudoUserHome(); sudoHome != "" {
+			defer lib.RestoreSudoUserOwnership(sudoHome)
+		}
 		ctx := hctx.MakeContext()
 		lib.CheckFatalError(maybeUploadSkippedHistoryEntries(ctx))
+		lib.CheckFatalError(lib.MaybeResumeBootstrapUpload(ctx))
 		saveHistoryEntry(ctx)
 	},
 }
@@ -43,20 +48,17 @@ func maybeUploadSkippedHistoryEntries(ctx context.Context) error {
 		return fmt.Errorf("failed to retrieve history entries that haven't been uploaded yet: %v", err)
 	}
 	hctx.GetLogger().Infof("Uploading %d history entries that previously failed to upload (query=%#v)\n", len(entries), query)
-	jsonValue, err := lib.EncryptAndMarshal(config, entries)
-	if err != nil {
-		return err
-	}
-	_, err = lib.ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
+	err = lib.UploadEntries(ctx, entries)
 	if err != nil {
 		// Failed to upload the history entry, so we must still be offline. So just return nil and we'll try again later.
 		return nil
 	}
 
 	// Mark down that we persisted it
-	config.HaveMissedUploads = false
-	config.MissedUploadTimestamp = 0
-	err = hctx.SetConfig(config)
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.HaveMissedUploads = false
+		config.MissedUploadTimestamp = 0
+	})
 	if err != nil {
 		return fmt.Errorf("failed to mark a history entry as uploaded: %v", err)
 	}
@@ -71,36 +73,23 @@ func saveHistoryEntry(ctx context.Context) {
 	}
 	entry, err := lib.BuildHistoryEntry(ctx, os.Args)
 	lib.CheckFatalError(err)
+	// Cache it before anything slow, so that `hishtory last` in the next prompt is most likely up-to-date
+	if err := lib.CacheLastCommand(hctx.GetHome(ctx), entry); err != nil {
+		hctx.GetLogger().Infof("Failed to cache the last command: %v\n", err)
+	}
 	if entry == nil {
 		hctx.GetLogger().Infof("Skipping saving a history entry because we did not build a history entry (was the command prefixed with a space and/or empty?)\n")
 		return
 	}
 
-	// Persist it locally
-	db := hctx.GetDb(ctx)
-	err = lib.ReliableDbCreate(db, *entry)
-	lib.CheckFatalError(err)
+	// Persist it locally and remotely
+	lib.CheckFatalError(persistHistoryEntries(ctx, []*data.HistoryEntry{entry}))
 
-	// Persist it remotely
-	if !config.IsOffline {
-		jsonValue, err := lib.EncryptAndMarshal(config, []*data.HistoryEntry{entry})
-		lib.CheckFatalError(err)
-		_, err = lib.ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
-		if err != nil {
-			if lib.IsOfflineError(err) {
-				hctx.GetLogger().Infof("Failed to remotely persist hishtory entry because we failed to connect to the remote server! This is likely because the device is offline, but also could be because the remote server is having reliability issues. Original error: %v", err)
-				if !config.HaveMissedUploads {
-					config.HaveMissedUploads = true
-					config.MissedUploadTimestamp = time.Now().Unix()
-					lib.CheckFatalError(hctx.SetConfig(config))
-				}
-			} else {
-				lib.CheckFatalError(err)
-			}
-		}
-	}
+	// Run the actions of any rules that the entry matches
+	lib.RunRules(ctx, entry)
 
 	// Check if there is a pending dump request and reply to it if so
+	db := hctx.GetDb(ctx)
 	dumpRequests, err := lib.GetDumpRequests(config)
 	if err != nil {
 		if lib.IsOfflineError(err) {
@@ -115,9 +104,11 @@ func saveHistoryEntry(ctx context.Context) {
 		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
 		entries, err := lib.Search(ctx, db, "", 0)
 		lib.CheckFatalError(err)
+		provider, err := lib.GetEncryptionProvider(config)
+		lib.CheckFatalError(err)
 		var encEntries []*shared.EncHistoryEntry
 		for _, entry := range entries {
-			enc, err := data.EncryptHistoryEntry(config.UserSecret, *entry)
+			enc, err := lib.EncryptHistoryEntry(config, provider, *entry)
 			lib.CheckFatalError(err)
 			encEntries = append(encEntries, &enc)
 		}
@@ -133,6 +124,58 @@ func saveHistoryEntry(ctx context.Context) {
 
 	// Handle deletion requests
 	lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
+
+	// Send the deletions from the TUI whose grace period for undoing them is over
+	lib.CheckFatalError(lib.PropagateExpiredDeletions(ctx))
+
+	// Run the maintenance tasks that are due (e.g. applying the retention policy), see `hishtory schedule`
+	lib.CheckFatalError(lib.RunDueScheduledTasks(ctx))
+
+	// Archive old entries to the cold DB, if that is enabled
+	lib.CheckFatalError(lib.MaybeArchiveToColdStorage(ctx))
+
+	// Publish new entries to shares and refresh imported shares, if there are any
+	lib.CheckFatalError(lib.MaybeSyncShares(ctx))
+
+	// Publish new matching entries to team channels and receive teammates' entries, if there are any channels
+	lib.CheckFatalError(lib.MaybeSyncChannels(ctx))
+}
+
+// persistHistoryEntries saves the given entries to the local DB and uploads them, recording them as missed
+// uploads to be retried later if the device is offline
+func persistHistoryEntries(ctx context.Context, entries []*data.HistoryEntry) error {
+	config := hctx.GetConf(ctx)
+
+	// Persist it locally
+	if err := lib.SaveHistoryEntries(ctx, entries); err != nil {
+		return err
+	}
+
+	// Persist it remotely, unless this is a read-only device
+	if config.IsOffline || config.ReadOnlyDevice {
+		return nil
+	}
+	jsonValue, err := lib.EncryptAndMarshal(config, entries)
+	if err != nil {
+		return err
+	}
+	_, err = lib.ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
+	if err == nil {
+		return nil
+	}
+	if !lib.IsOfflineError(err) {
+		return err
+	}
+	hctx.GetLogger().Infof("Failed to remotely persist hishtory entry because we failed to connect to the remote server! This is likely because the device is offline, but also could be because the remote server is having reliability issues. Original error: %v", err)
+	if config.HaveMissedUploads {
+		return nil
+	}
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if !config.HaveMissedUploads {
+			config.HaveMissedUploads = true
+			config.MissedUploadTimestamp = time.Now().Unix()
+		}
+	})
 }
 
 func init() {
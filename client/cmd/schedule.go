@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// How often `hishtory schedule daemon` checks for due tasks
+const scheduleDaemonPollInterval = time.Minute
+
+var scheduleEnableInterval *string
+
+var scheduleCmd = &cobra.Command{
+	Use:     "schedule",
+	Short:   "Configure the maintenance tasks that hiSHtory runs periodically (backups, pruning, syncing, and digests)",
+	Long:    "hiSHtory has a built-in scheduler for maintenance tasks, so that they don't require setting up cron jobs. Due tasks are run in the background after commands are recorded, or by `hishtory schedule daemon` for machines where commands aren't run regularly. The tasks are:\n\n" + scheduledTaskDescriptions(),
+	GroupID: GROUP_ID_CONFIG,
+}
+
+func scheduledTaskDescriptions() string {
+	descriptions := make([]string, 0, len(lib.ScheduledTasks))
+	for _, task := range lib.ScheduledTasks {
+		defaultState := "disabled"
+		if task.DefaultEnabled {
+			defaultState = "enabled"
+		}
+		descriptions = append(descriptions, fmt.Sprintf("  %s: %s (%s by default, every %s)", task.Name, task.Description, defaultState, formatInterval(task.DefaultInterval)))
+	}
+	return strings.Join(descriptions, "\n")
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the scheduled tasks and when they last ran",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		formatTimestamp := func(ts int64) string {
+			if ts == 0 {
+				return "never"
+			}
+			return time.Unix(ts, 0).Format(config.TimestampFormat)
+		}
+		tbl := table.New("Task", "Enabled", "Interval", "Last Run", "Next Run", "Last Error")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, task := range lib.ScheduledTasks {
+			run := config.ScheduledTaskRuns[task.Name]
+			nextRun := "-"
+			if task.IsEnabled(config) {
+				nextRun = "next command"
+				if run.NextRunTimestamp > time.Now().Unix() {
+					nextRun = formatTimestamp(run.NextRunTimestamp)
+				}
+			}
+			tbl.AddRow(task.Name, task.IsEnabled(config), formatInterval(task.Interval(config)), formatTimestamp(run.LastRunTimestamp), nextRun, run.LastError)
+		}
+		tbl.Print()
+	},
+}
+
+var scheduleEnableCmd = &cobra.Command{
+	Use:       "enable TASK",
+	Short:     "Enable a scheduled task, optionally changing how often it runs",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: scheduledTaskNames(),
+	Run: func(cmd *cobra.Command, args []string) {
+		task, err := lib.FindScheduledTask(args[0])
+		lib.CheckFatalError(err)
+		if *scheduleEnableInterval != "" {
+			_, err := lib.ParseScheduledTaskInterval(*scheduleEnableInterval)
+			lib.CheckFatalError(err)
+		}
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			setScheduledTask(config, task.Name, true, *scheduleEnableInterval)
+		}))
+	},
+}
+
+var scheduleDisableCmd = &cobra.Command{
+	Use:       "disable TASK",
+	Short:     "Disable a scheduled task",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: scheduledTaskNames(),
+	Run: func(cmd *cobra.Command, args []string) {
+		task, err := lib.FindScheduledTask(args[0])
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			setScheduledTask(config, task.Name, false, "")
+		}))
+	},
+}
+
+var scheduleRunCmd = &cobra.Command{
+	Use:   "run [TASK...]",
+	Short: "Run the given tasks now, or all of the enabled tasks that are due if none are given",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		if len(args) == 0 {
+			lib.CheckFatalError(lib.RunDueScheduledTasks(ctx))
+			return
+		}
+		tasks := make([]*lib.ScheduledTask, 0, len(args))
+		for _, name := range args {
+			task, err := lib.FindScheduledTask(name)
+			lib.CheckFatalError(err)
+			tasks = append(tasks, task)
+		}
+		for _, task := range tasks {
+			lib.CheckFatalError(lib.RunScheduledTask(ctx, *task))
+			fmt.Printf("Ran %s\n", task.Name)
+		}
+	},
+}
+
+var scheduleDaemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the scheduled tasks whenever they are due, until interrupted",
+	Long:  "Runs in the foreground and checks for due tasks every minute, e.g. for running hiSHtory's maintenance tasks on a server via a systemd unit. Tasks are never run twice, even if commands are also being recorded on this machine.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		fmt.Printf("Running the scheduled tasks when they are due, checking every %s...\n", scheduleDaemonPollInterval)
+		for {
+			// Reload the config each time, so that changes to it (e.g. enabling tasks) take effect
+			config, err := hctx.GetConfig()
+			lib.CheckFatalError(err)
+			lib.CheckFatalError(lib.RunDueScheduledTasks(hctx.WithConf(ctx, config)))
+			time.Sleep(scheduleDaemonPollInterval)
+		}
+	},
+}
+
+// formatInterval formats an interval without trailing zero units, e.g. 24h rather than 24h0m0s
+func formatInterval(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func scheduledTaskNames() []string {
+	names := make([]string, 0, len(lib.ScheduledTasks))
+	for _, task := range lib.ScheduledTasks {
+		names = append(names, task.Name)
+	}
+	return names
+}
+
+// setScheduledTask enables or disables a task, keeping its current interval unless a new one is given
+func setScheduledTask(config *hctx.ClientConfig, name string, enabled bool, interval string) {
+	if config.ScheduledTasks == nil {
+		config.ScheduledTasks = make(map[string]hctx.ScheduledTaskConfig)
+	}
+	override := config.ScheduledTasks[name]
+	override.Enabled = enabled
+	if interval != "" {
+		override.Interval = interval
+	}
+	config.ScheduledTasks[name] = override
+	// Run it the next time the scheduler runs, rather than waiting for the rest of its previous interval
+	lib.ResetScheduledTask(config, name)
+}
+
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleEnableCmd)
+	scheduleCmd.AddCommand(scheduleDisableCmd)
+	scheduleCmd.AddCommand(scheduleRunCmd)
+	scheduleCmd.AddCommand(scheduleDaemonCmd)
+	scheduleEnableInterval = scheduleEnableCmd.Flags().String("interval", "", "How often to run the task, as a duration like 30m or 12h (defaults to the task's current interval)")
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var secretRecoverForce *bool
+
+var secretCmd = &cobra.Command{
+	Use:     "secret",
+	Short:   "Back up and recover your secret key with a recovery phrase",
+	Long:    "Your secret key is needed to decrypt your synced history. hishtory encodes it as a 12 word recovery phrase that is easier to write down than the key itself, so that you don't lose access to your synced history if you lose your config file.",
+	GroupID: GROUP_ID_CONFIG,
+}
+
+var secretPhraseCmd = &cobra.Command{
+	Use:   "phrase",
+	Short: "Print the recovery phrase for your secret key",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		phrase, err := lib.RecoveryPhrase(hctx.GetConf(ctx).UserSecret)
+		lib.CheckFatalError(err)
+		fmt.Println(phrase)
+	},
+}
+
+var secretRecoverCmd = &cobra.Command{
+	Use:   "recover PHRASE",
+	Short: "Recover your secret key from its recovery phrase, and re-initialize hishtory with it",
+	Long:  "Reconstructs your secret key from its recovery phrase (either quoted or as separate words) and re-initializes hishtory with it, like `hishtory init SECRET_KEY`, so that your synced history is downloaded again.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		secretKey, err := lib.SecretFromRecoveryPhrase(strings.Join(args, " "))
+		lib.CheckFatalError(err)
+		fmt.Printf("Recovered your secret key: %s\n", secretKey)
+		if lib.GetRecoveryConfig().UserSecret == secretKey {
+			fmt.Println("hishtory is already using this secret key")
+			return
+		}
+		if !*secretRecoverForce {
+			fmt.Printf("Re-initialize hishtory with this secret key? This replaces the history on this device with your synced history [y/N]")
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting per user response of %#v, run `hishtory init %s` to use it later\n", strings.TrimSpace(resp), secretKey)
+				return
+			}
+		}
+		lib.CheckFatalError(lib.RecoverSecret(secretKey))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+	secretCmd.AddCommand(secretPhraseCmd)
+	secretCmd.AddCommand(secretRecoverCmd)
+	secretRecoverForce = secretRecoverCmd.Flags().Bool("force", false, "Re-initialize hishtory without asking for confirmation")
+}
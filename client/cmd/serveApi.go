@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var serveApiPort *int
+
+var serveApiCmd = &cobra.Command{
+	Use:     "serve-api",
+	Short:   "Serve a JSON:API for querying your history from rich clients",
+	Long:    "Serves an API for querying history entries, aggregations, stats, devices, and settings on localhost. Requests must include an `Authorization: Bearer TOKEN` header with the token printed on startup (also available via 'hishtory config-get local-api-token').",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		token, err := lib.GetOrCreateLocalApiToken(ctx)
+		lib.CheckFatalError(err)
+		// Only listen on localhost since the API exposes the full (decrypted) history
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(*serveApiPort)))
+		lib.CheckFatalError(err)
+		fmt.Fprintf(os.Stderr, "Serving the hishtory API on http://%s/api/v1/ with token %s\n", listener.Addr().String(), token)
+		lib.CheckFatalError(http.Serve(listener, lib.NewLocalApiHandler(ctx, token)))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveApiCmd)
+	serveApiPort = serveApiCmd.Flags().Int("port", 8413, "The port to listen on")
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Share parts of your history with other hiSHtory users",
+	Long: "Shares are read-only copies of the history matching a query (e.g. `tag:runbook` or `kubectl`) that other hiSHtory users can " +
+		"import into their own history. Shared entries are encrypted with a read key that is specific to the share, so sharing " +
+		"never reveals your secret key or the rest of your history.",
+	GroupID: GROUP_ID_MANAGEMENT,
+}
+
+var shareCreateCmd = &cobra.Command{
+	Use:   "create NAME QUERY",
+	Short: "Share the history matching QUERY",
+	Long:  "Shares the history matching QUERY, and prints the command that other users can run to import it. The share is kept up to date as you run new matching commands, until it is revoked.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		readKey, err := lib.CreateShare(ctx, args[0], strings.Join(args[1:], " "))
+		lib.CheckFatalError(err)
+		fmt.Printf("Created the share %#v. To import it, other users can run:\n\n  hishtory share import %s %s\n\n", args[0], args[0], readKey)
+		fmt.Println("Anyone with this command can read the shared history until you run `hishtory share revoke " + args[0] + "`.")
+	},
+}
+
+var shareRevokeCmd = &cobra.Command{
+	Use:   "revoke NAME",
+	Short: "Stop sharing the history in a share",
+	Long:  "Deletes a share from the sync server so that it can no longer be imported or refreshed. Users who already imported it keep the entries that they imported.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RevokeShare(ctx, args[0]))
+		fmt.Printf("Revoked the share %#v\n", args[0])
+	},
+}
+
+var shareImportCmd = &cobra.Command{
+	Use:   "import NAME READ_KEY",
+	Short: "Import another user's shared history",
+	Long:  "Imports the history shared by another user into your history, where it is tagged with `shared:NAME`. It is refreshed periodically until it is removed with `hishtory share remove NAME`.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		numEntries, err := lib.ImportShare(ctx, args[0], args[1])
+		lib.CheckFatalError(err)
+		fmt.Printf("Imported %d entries, search for them with `tag:shared:%s`\n", numEntries, args[0])
+	},
+}
+
+var shareRemoveCmd = &cobra.Command{
+	Use:   "remove NAME",
+	Short: "Remove an imported share and its entries",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		numDeleted, err := lib.RemoveImportedShare(ctx, args[0])
+		lib.CheckFatalError(err)
+		fmt.Printf("Removed the share %#v and deleted its %d entries\n", args[0], numDeleted)
+	},
+}
+
+var shareSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Publish your shares and refresh imported shares now",
+	Long:  "Shares are normally synced at most once an hour after you run a command. This syncs them immediately, which also removes entries that you deleted from your shares.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.SyncShares(ctx, true))
+	},
+}
+
+var shareListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your shares and the shares you imported",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		tbl := table.New("Name", "Type", "Query", "Read Key")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, share := range config.Shares {
+			tbl.AddRow(share.Name, "created", share.Query, lib.GetShareReadKey(config, share))
+		}
+		for _, share := range config.ImportedShares {
+			tbl.AddRow(share.Name, "imported", "tag:shared:"+share.Name, share.ReadKey)
+		}
+		tbl.Print()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shareCmd)
+	shareCmd.AddCommand(shareCreateCmd)
+	shareCmd.AddCommand(shareRevokeCmd)
+	shareCmd.AddCommand(shareImportCmd)
+	shareCmd.AddCommand(shareRemoveCmd)
+	shareCmd.AddCommand(shareSyncCmd)
+	shareCmd.AddCommand(shareListCmd)
+}
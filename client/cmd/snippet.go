@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var snippetPrint *bool
+
+var snippetCmd = &cobra.Command{
+	Use:     "snippet",
+	Short:   "Save commands as named snippets and run them later",
+	Long:    "Snippets are commands saved under a name (from the CLI or from the TUI's command palette) that are synced to all of your devices. They support positional parameters: $1 to $9 (or ${N}) are replaced with the arguments passed to `hishtory snippet run`, and $@ with all of them.",
+	GroupID: GROUP_ID_MANAGEMENT,
+}
+
+var snippetSaveCmd = &cobra.Command{
+	Use:   "save NAME [ENTRY_ID]",
+	Short: "Save a history entry as a snippet",
+	Long:  "Saves the command of a history entry as a snippet called NAME, replacing any existing snippet with that name. ENTRY_ID is the ID shown in the `Entry ID` column, and defaults to `last` for the previous command.",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		entryId := "last"
+		if len(args) == 2 {
+			entryId = args[1]
+		}
+		entry, err := lib.GetEntryById(ctx, entryId)
+		lib.CheckFatalError(err)
+		err = lib.SaveSnippet(ctx, args[0], entry.Command)
+		if lib.IsOfflineError(err) {
+			fmt.Println("Warning: hishtory is offline so the snippet will only be saved on this device!")
+		} else {
+			lib.CheckFatalError(err)
+		}
+		fmt.Printf("Saved %#v as the snippet %#v\n", entry.Command, args[0])
+	},
+}
+
+var snippetRunCmd = &cobra.Command{
+	Use:   "run NAME [ARGS...]",
+	Short: "Run a snippet, substituting ARGS into its positional parameters",
+	Long:  "Runs the snippet called NAME in your shell, with ARGS substituted into its positional parameters. Pass --print to instead print the expanded command, e.g. to run it in your current shell with `eval \"$(hishtory snippet run --print NAME)\"`.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		snippet, err := lib.GetSnippet(ctx, args[0])
+		lib.CheckFatalError(err)
+		command, err := lib.ExpandSnippet(snippet.Command, args[1:])
+		lib.CheckFatalError(err)
+		if *snippetPrint {
+			fmt.Println(command)
+			return
+		}
+		exitCode, err := lib.RunSnippet(command)
+		lib.CheckFatalError(err)
+		os.Exit(exitCode)
+	},
+}
+
+var snippetListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your snippets",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		snippets, err := lib.ListSnippets(ctx)
+		lib.CheckFatalError(err)
+		tbl := table.New("Name", "Command")
+		tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+		for _, s := range snippets {
+			tbl.AddRow(s.Name, s.Command)
+		}
+		tbl.Print()
+	},
+}
+
+var snippetDeleteCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete a snippet from all of your devices",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		err := lib.DeleteSnippet(ctx, args[0])
+		if lib.IsOfflineError(err) {
+			fmt.Println("Warning: hishtory is offline so the snippet will only be deleted on this device!")
+		} else {
+			lib.CheckFatalError(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snippetCmd)
+	snippetCmd.AddCommand(snippetSaveCmd)
+	snippetCmd.AddCommand(snippetRunCmd)
+	snippetCmd.AddCommand(snippetListCmd)
+	snippetCmd.AddCommand(snippetDeleteCmd)
+	// Flags are only parsed before NAME, so that the snippet's arguments can start with a dash
+	snippetRunCmd.Flags().SetInterspersed(false)
+	snippetPrint = snippetRunCmd.Flags().Bool("print", false, "Print the expanded command rather than running it")
+}
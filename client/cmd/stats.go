@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var statsJson *bool
+var statsLimit *int
+
+var statsCmd = &cobra.Command{
+	Use:     "stats",
+	Short:   "Display statistics about your shell history (top commands, failure rates, busiest hours, etc)",
+	Long:    "Computes statistics over all history entries matching the given query. Supports the same query format as 'hishtory query'.",
+	GroupID: GROUP_ID_QUERYING,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		stats, err := lib.ComputeStats(ctx, strings.Join(args, " "), *statsLimit)
+		lib.CheckFatalError(err)
+		if *statsJson {
+			serialized, err := json.MarshalIndent(stats, "", "  ")
+			lib.CheckFatalError(err)
+			fmt.Println(string(serialized))
+			return
+		}
+		lib.DisplayStats(stats)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+	statsJson = statsCmd.Flags().Bool("json", false, "Output the statistics as JSON")
+	statsLimit = statsCmd.Flags().Int("limit", 10, "The maximum number of rows in the top commands and per-prefix statistics")
+}
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
@@ -19,12 +21,26 @@ var statusCmd = &cobra.Command{
 		config := hctx.GetConf(ctx)
 		fmt.Printf("hiSHtory: v0.%s\nEnabled: %v\n", lib.Version, config.IsEnabled)
 		fmt.Printf("Secret Key: %s\n", config.UserSecret)
+		if config.BootstrapUpload != nil {
+			fmt.Printf("Upload In Progress: %d entries uploaded so far, this will resume the next time a command is recorded\n", config.BootstrapUpload.NumUploaded)
+		}
 		if *verbose {
 			fmt.Printf("User ID: %s\n", data.UserId(config.UserSecret))
 			fmt.Printf("Device ID: %s\n", config.DeviceId)
+			if config.ReadOnlyDevice {
+				fmt.Printf("Read-Only Device: true\n")
+			}
+			if config.Encryption.Provider != "" {
+				fmt.Printf("Encryption Provider: %s\n", config.Encryption.Provider)
+			}
+			if len(config.ServerVisibleFields) > 0 {
+				fmt.Printf("Server-Visible Fields: %s\n", strings.Join(config.ServerVisibleFields, ", "))
+			}
 			printDumpStatus(config)
+			printStorageStatus(ctx, config)
 		}
 		fmt.Printf("Commit Hash: %s\n", lib.GitCommit)
+		warnIfOtherInstallsPresent(hctx.GetHome(ctx))
 	},
 }
 
@@ -38,6 +54,41 @@ func printDumpStatus(config hctx.ClientConfig) {
 	fmt.Print("\n")
 }
 
+func printStorageStatus(ctx context.Context, config hctx.ClientConfig) {
+	stats, err := lib.ComputeStorageStats(ctx)
+	lib.CheckFatalError(err)
+	fmt.Printf("Local Entries: %d\n", stats.TotalCount)
+	fmt.Printf("Local Entries By Host:\n")
+	for _, h := range stats.ByHost {
+		fmt.Printf("  %s: %d\n", h.Hostname, h.Count)
+	}
+	fmt.Printf("Local Entries By Year:\n")
+	for _, y := range stats.ByYear {
+		fmt.Printf("  %d: %d\n", y.Bucket, y.Count)
+	}
+	fmt.Printf("DB Size: %s (WAL: %s)\n", lib.FormatBytes(stats.DbSizeBytes), lib.FormatBytes(stats.WalSizeBytes))
+	if stats.ReclaimableBytes > 0 {
+		fmt.Printf("Reclaimable Space: %s (run `hishtory compact` to reclaim it)\n", lib.FormatBytes(stats.ReclaimableBytes))
+	}
+	numArchived, err := lib.CountArchivedEntries(ctx)
+	lib.CheckFatalError(err)
+	if numArchived > 0 {
+		fmt.Printf("Archived Entries: %d\n", numArchived)
+	}
+	if config.IsOffline {
+		return
+	}
+	usage, err := lib.GetRemoteStorageUsage(config)
+	if err != nil {
+		if lib.IsOfflineError(err) {
+			fmt.Printf("Remote Storage: unknown (offline)\n")
+			return
+		}
+		lib.CheckFatalError(err)
+	}
+	fmt.Printf("Remote Storage: %d entries, %s\n", usage.NumEntries, lib.FormatBytes(usage.NumBytes))
+}
+
 func init() {
 	rootCmd.AddCommand(statusCmd)
 	verbose = statusCmd.Flags().BoolP("verbose", "v", false, "Display verbose hiSHtory information")
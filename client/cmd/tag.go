@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var tagRemove *bool
+
+var tagCmd = &cobra.Command{
+	Use:   "tag ENTRY_ID [TAG...]",
+	Short: "Attach tags to a history entry, so that it can be found later with `hishtory query tag:TAG`",
+	Long: "Attaches the given tags to a history entry and syncs them to all of your devices. ENTRY_ID is the ID shown in the `Entry ID` column (see `hishtory config-add displayed-columns 'Entry ID'`), " +
+		"or `last` for the previous command. If no tags are given, the entry's current tags are listed.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		entry, err := lib.GetEntryById(ctx, args[0])
+		lib.CheckFatalError(err)
+		tags := args[1:]
+		if len(tags) > 0 {
+			if *tagRemove {
+				err = lib.UntagEntry(ctx, *entry, tags...)
+			} else {
+				err = lib.TagEntry(ctx, *entry, tags...)
+			}
+			if lib.IsOfflineError(err) {
+				fmt.Println("Warning: hishtory is offline so the tags will only be updated on this device!")
+			} else {
+				lib.CheckFatalError(err)
+			}
+		}
+		currentTags, err := lib.GetEntryTags(ctx, *entry)
+		lib.CheckFatalError(err)
+		fmt.Printf("%s: %s\n", entry.Command, strings.Join(currentTags, ","))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+	tagRemove = tagCmd.Flags().BoolP("remove", "r", false, "Remove the given tags from the entry rather than adding them")
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var takeoverForce *bool
+
+var takeoverCmd = &cobra.Command{
+	Use:   "takeover",
+	Short: "Remove the hooks of other hiSHtory installs (e.g. upstream hiSHtory) and import their history",
+	Long: "If another hiSHtory install (such as upstream hiSHtory) is hooked into the same shell rc files as this one, every " +
+		"command is recorded twice. This imports the other install's local history (skipping the commands that both installs " +
+		"recorded), removes its hooks from your shell rc files, and makes sure this install is hooked in instead. The other " +
+		"install's files are left in place.",
+	GroupID: GROUP_ID_CONFIG,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		homedir, err := os.UserHomeDir()
+		lib.CheckFatalError(err)
+		hooks, err := findOtherInstallHooks(homedir)
+		lib.CheckFatalError(err)
+		if len(hooks) == 0 {
+			fmt.Println("No other hiSHtory installs are hooked into your shells")
+			return
+		}
+		dirs := lib.OtherInstallDirs(hooks)
+		for _, dir := range dirs {
+			fmt.Printf("The hiSHtory install in %s is hooked into %s\n", dir, strings.Join(hookedRcPaths(hooks, dir), ", "))
+		}
+		if !*takeoverForce {
+			fmt.Printf("This will import its history and remove its hooks, are you sure? [y/N]")
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting takeover per user response of %#v\n", strings.TrimSpace(resp))
+				return
+			}
+		}
+
+		// Import before touching the rc files, so that a failed import leaves everything as it was
+		ctx := hctx.MakeContext()
+		for _, dir := range dirs {
+			numImported, numDuplicates, err := lib.ImportOtherInstallDb(ctx, dir)
+			lib.CheckFatalError(err)
+			fmt.Printf("Imported %d entries from %s (skipped %d entries that were recorded by both installs)\n", numImported, dir, numDuplicates)
+		}
+		lib.CheckFatalError(lib.RemoveOtherInstallHooks(hooks))
+		lib.CheckFatalError(configureShells(homedir, data.GetHishtoryBinaryPath(homedir)))
+		fmt.Printf("Removed the hooks of the other installs, their files were left in %s. Please restart your terminal...\n", strings.Join(dirs, ", "))
+	},
+}
+
+// findOtherInstallHooks returns the hooks for other hiSHtory installs in the shell rc files that this install uses
+func findOtherInstallHooks(homedir string) ([]lib.OtherInstallHook, error) {
+	fragments, err := getShellConfigFragments(homedir)
+	if err != nil {
+		return nil, err
+	}
+	rcPaths := make([]string, 0, len(fragments))
+	for rcPath := range fragments {
+		rcPaths = append(rcPaths, rcPath)
+	}
+	sort.Strings(rcPaths)
+	return lib.FindOtherInstallHooks(rcPaths, data.GetHishtoryDir(homedir))
+}
+
+func hookedRcPaths(hooks []lib.OtherInstallHook, dir string) []string {
+	rcPaths := make([]string, 0)
+	for _, hook := range hooks {
+		if hook.Dir == dir {
+			rcPaths = append(rcPaths, hook.RcPath)
+		}
+	}
+	return rcPaths
+}
+
+// warnIfOtherInstallsPresent warns if another hiSHtory install is hooked into the same shells, since that silently
+// records every command twice
+func warnIfOtherInstallsPresent(homedir string) {
+	hooks, err := findOtherInstallHooks(homedir)
+	if err != nil {
+		hctx.GetLogger().Infof("Failed to check for other hishtory installs: %v", err)
+		return
+	}
+	for _, dir := range lib.OtherInstallDirs(hooks) {
+		fmt.Fprintf(os.Stderr, "Warning: the hiSHtory install in %s is also hooked into %s, so every command is recorded twice. Run `hishtory takeover` to import its history and remove its hooks.\n", dir, strings.Join(hookedRcPaths(hooks, dir), ", "))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(takeoverCmd)
+	takeoverForce = takeoverCmd.Flags().Bool("force", false, "Don't ask for confirmation before taking over")
+}
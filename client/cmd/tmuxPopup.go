@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var tmuxPopupPane *string
+var tmuxPopupThisPane *bool
+
+var tmuxPopupCmd = &cobra.Command{
+	Use:   "tmux-popup [QUERY]",
+	Short: "Search your history from a tmux popup and type the chosen command into the active pane",
+	Long: "Meant to be bound to a key via tmux's display-popup, e.g. `bind-key C-r display-popup -E 'hishtory tmux-popup'` in tmux.conf. " +
+		"The chosen command is typed into the pane that the popup was opened over (or the pane given via --pane) without being run. " +
+		"Pass --this-pane to start out only searching the history of that pane.",
+	GroupID: GROUP_ID_QUERYING,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
+		lib.CheckFatalError(lib.TmuxPopup(ctx, *tmuxPopupPane, strings.Join(args, " "), *tmuxPopupThisPane))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tmuxPopupCmd)
+	tmuxPopupPane = tmuxPopupCmd.Flags().String("pane", "", "The tmux pane (e.g. '#{pane_id}') to type the chosen command into, defaults to the active pane")
+	tmuxPopupThisPane = tmuxPopupCmd.Flags().Bool("this-pane", false, "Only search the history of the target pane by default")
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+var undeleteList *bool
+
+var undeleteCmd = &cobra.Command{
+	Use:   "undelete [ID...]",
+	Short: "Restore entries that were recently deleted from the search TUI",
+	Long: "Entries deleted from the search TUI via Control+K are kept for a grace period (10 minutes by default, see " +
+		"`hishtory config-set deletion-grace-period`) before the deletion is sent to your other devices. Until then, they " +
+		"can be restored. With no arguments, this restores the most recently deleted entry. Use --list to find the IDs of " +
+		"the other deleted entries.",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		if *undeleteList {
+			entries, err := lib.GetTrashedEntries(ctx)
+			lib.CheckFatalError(err)
+			if len(entries) == 0 {
+				fmt.Println("There are no deleted entries to restore")
+				return
+			}
+			gracePeriod := lib.GetDeletionGracePeriod(hctx.GetConf(ctx))
+			tbl := table.New("ID", "Deleted", "Restorable For", "Command")
+			tbl.WithHeaderFormatter(color.New(color.FgGreen, color.Underline).SprintfFunc())
+			for _, entry := range entries {
+				remaining := time.Until(entry.DeletionTime.Add(gracePeriod)).Round(time.Second)
+				if remaining < 0 {
+					remaining = 0
+				}
+				tbl.AddRow(entry.Id, entry.DeletionTime.Format(hctx.GetConf(ctx).TimestampFormat), remaining, entry.Entry.Command)
+			}
+			tbl.Print()
+			return
+		}
+		if len(args) == 0 {
+			restored, err := lib.UndeleteLatestEntry(ctx)
+			lib.CheckFatalError(err)
+			if restored == nil {
+				fmt.Println("There are no deleted entries to restore")
+				return
+			}
+			fmt.Printf("Restored %#v\n", restored.Command)
+			return
+		}
+		ids := make([]uint64, 0, len(args))
+		for _, arg := range args {
+			id, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				lib.CheckFatalError(fmt.Errorf("failed to parse %#v as the ID of a deleted entry (see `hishtory undelete --list`): %w", arg, err))
+			}
+			ids = append(ids, id)
+		}
+		restored, err := lib.UndeleteEntries(ctx, ids)
+		lib.CheckFatalError(err)
+		for _, entry := range restored {
+			fmt.Printf("Restored %#v\n", entry.Command)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(undeleteCmd)
+	undeleteList = undeleteCmd.Flags().Bool("list", false, "List the deleted entries that can still be restored")
+}
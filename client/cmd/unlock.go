@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var unlockIfLocked *bool
+
+// The number of times that the passphrase can be re-entered if it is incorrect
+const unlockAttempts = 3
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Enter the passphrase that your secret key is encrypted with, so that hishtory can be used for the rest of the login session",
+	Long: "If your secret key is encrypted with a passphrase (see `hishtory config-set secret-storage passphrase`), it has to be decrypted once per login session. " +
+		"The decrypted secret key is then kept in memory by the hishtory agent (see `hishtory agent`) until you log out, run `hishtory lock`, or 12 hours have passed.",
+	GroupID: GROUP_ID_CONFIG,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		locked, err := hctx.IsLocked()
+		lib.CheckFatalError(err)
+		if *unlockIfLocked {
+			// Used by the shell integration, which prompts for the passphrase when the first shell of a login session starts
+			if !locked || !lib.CanReadPassphrase() {
+				return
+			}
+		} else if !locked {
+			config, err := hctx.GetConfig()
+			lib.CheckFatalError(err)
+			if config.SecretStorage != hctx.SecretStoragePassphrase {
+				lib.CheckFatalError(fmt.Errorf("your secret key isn't encrypted with a passphrase, see `hishtory config-set secret-storage passphrase`"))
+			}
+			fmt.Println("hishtory is already unlocked")
+			return
+		}
+		promptAndUnlock()
+	},
+}
+
+// promptAndUnlock prompts for the passphrase that the secret key is encrypted with until it is entered correctly, and
+// starts the agent with the decrypted secret key
+func promptAndUnlock() {
+	for i := 0; i < unlockAttempts; i++ {
+		passphrase, err := lib.ReadPassphrase("Enter the passphrase for your hishtory secret key: ")
+		lib.CheckFatalError(err)
+		err = hctx.Unlock(passphrase)
+		if err == nil {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
+
+var lockCmd = &cobra.Command{
+	Use:     "lock",
+	Short:   "Forget the passphrase that your secret key is encrypted with, so that it has to be entered again via `hishtory unlock`",
+	GroupID: GROUP_ID_CONFIG,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(hctx.StopAgent())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+	rootCmd.AddCommand(lockCmd)
+	unlockIfLocked = unlockCmd.Flags().Bool("if-locked", false, "Only prompt for the passphrase if hishtory is locked and running in a terminal")
+}
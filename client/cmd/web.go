@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var webPort *int
+var webNoBrowser *bool
+
+var webCmd = &cobra.Command{
+	Use:     "web",
+	Short:   "Open a local web interface for searching your history, viewing stats, and managing devices and settings",
+	Long:    "Serves a web interface on localhost and opens it in your browser. The web interface is built on the same API as 'hishtory serve-api'.",
+	GroupID: GROUP_ID_QUERYING,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil && !lib.IsOfflineError(err) {
+			lib.CheckFatalError(err)
+		}
+		token, err := lib.GetOrCreateLocalApiToken(ctx)
+		lib.CheckFatalError(err)
+		handler, err := lib.NewWebUiHandler(ctx, token)
+		lib.CheckFatalError(err)
+		// Only listen on localhost since the web UI exposes the full (decrypted) history
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(*webPort)))
+		lib.CheckFatalError(err)
+		// The token is passed in the fragment so that it isn't sent to the server or logged as part of the URL
+		webUrl := fmt.Sprintf("http://%s/#token=%s", listener.Addr().String(), url.QueryEscape(token))
+		fmt.Fprintf(os.Stderr, "Serving the hishtory web interface on %s (press control-c to stop)\n", webUrl)
+		if !*webNoBrowser {
+			if err := openBrowser(webUrl); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open your browser (%v), please open the above URL manually\n", err)
+			}
+		}
+		lib.CheckFatalError(http.Serve(listener, handler))
+	},
+}
+
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(webCmd)
+	webPort = webCmd.Flags().Int("port", 0, "The port to listen on (defaults to a random free port)")
+	webNoBrowser = webCmd.Flags().Bool("no-browser", false, "Don't automatically open the web interface in a browser")
+}
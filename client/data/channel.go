@@ -0,0 +1,50 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ddworken/hishtory/shared"
+)
+
+// ChannelId derives the ID that the backend stores a team channel under from its team key, so that the backend never
+// learns the team key itself
+func ChannelId(teamKey string) string {
+	return base64.URLEncoding.EncodeToString(sha256hmac(teamKey, KdfChannelId))
+}
+
+// EncryptChannelEntry encrypts entry with a key derived from the team key of the channel that it is published to
+func EncryptChannelEntry(teamKey string, entry HistoryEntry) (shared.EncChannelEntry, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return shared.EncChannelEntry{}, err
+	}
+	channelId := ChannelId(teamKey)
+	ciphertext, nonce, err := Encrypt(teamKey, data, []byte(channelId))
+	if err != nil {
+		return shared.EncChannelEntry{}, err
+	}
+	return shared.EncChannelEntry{
+		ChannelId:     channelId,
+		EncryptedData: ciphertext,
+		Nonce:         nonce,
+		Date:          entry.EndTime,
+	}, nil
+}
+
+func DecryptChannelEntry(teamKey string, entry shared.EncChannelEntry) (HistoryEntry, error) {
+	channelId := ChannelId(teamKey)
+	if entry.ChannelId != channelId {
+		return HistoryEntry{}, fmt.Errorf("refusing to decrypt channel entry with mismatching ChannelId")
+	}
+	plaintext, err := Decrypt(teamKey, entry.EncryptedData, []byte(channelId), entry.Nonce)
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to decrypt channel entry: %w", err)
+	}
+	var decryptedEntry HistoryEntry
+	if err := json.Unmarshal(plaintext, &decryptedEntry); err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to unmarshal channel entry: %w", err)
+	}
+	return decryptedEntry, nil
+}
@@ -21,8 +21,13 @@ import (
 const (
 	KdfUserID        = "user_id"
 	KdfEncryptionKey = "encryption_key"
+	KdfShareReadKey  = "share_read_key"
+	KdfShareId       = "share_id"
+	KdfChannelId     = "channel_id"
 	CONFIG_PATH      = ".hishtory.config"
 	DB_PATH          = ".hishtory.db"
+	COLD_DB_PATH     = ".hishtory-cold.db"
+	QUARANTINE_PATH  = ".hishtory.quarantine.jsonl"
 )
 
 const (
@@ -40,6 +45,144 @@ type HistoryEntry struct {
 	EndTime                 time.Time     `json:"end_time" gorm:"uniqueIndex:compositeindex,index:end_time_index"`
 	DeviceId                string        `json:"device_id" gorm:"uniqueIndex:compositeindex"`
 	CustomColumns           CustomColumns `json:"custom_columns"`
+	// The direnv/mise environment that was active when the command was run (e.g. the tool versions from mise)
+	DevEnvironment string `json:"dev_environment"`
+	// The chain of hosts that the command was run over SSH from, outermost first, or empty if it wasn't run in
+	// an SSH session. See lib.getRemoteHosts.
+	RemoteHosts string `json:"remote_hosts"`
+	// The container that the command was run in (e.g. "docker:0123456789ab"), or empty if it wasn't run in a
+	// container. See lib.getContainer.
+	Container string `json:"container"`
+	// The active kubectl context and namespace (e.g. "prod/payments"), or empty if kubectl isn't configured
+	KubeContext string `json:"kube_context"`
+	// Snapshots of the environment variables allowlisted via ClientConfig.EnvSnapshotVariables
+	EnvironmentVariables EnvironmentVariables `json:"environment_variables"`
+	// The number of times that the command was run, if duplicates are collapsed into a single entry when they're
+	// saved (see ClientConfig.CollapseDuplicateEntries). 0 for entries that were never collapsed, which is
+	// equivalent to 1.
+	HitCount int `json:"hit_count"`
+	// Whether the user pinned the entry, so that it is sorted before all other matching entries in the TUI
+	Pinned bool `json:"pinned"`
+	// The command with its leading alias expanded (e.g. "git status" for "gs"), or empty if the command didn't
+	// start with an alias or ClientConfig.RecordResolvedAliases is disabled. See lib.resolveAliases.
+	ResolvedCommand string `json:"resolved_command"`
+	// Whether the command was run as root. Commands run via sudo are attributed to the user who ran sudo (see
+	// lib.getSudoUser), so this is the only indication that they were run as root.
+	AsRoot bool `json:"as_root"`
+	// How the shell that the command was run in was started, as a comma-separated subset of "interactive",
+	// "login", and "script" (for shells whose commands weren't typed at a terminal), or empty if it isn't known.
+	// See lib.getShellMode.
+	ShellMode string `json:"shell_mode"`
+	// The value of $SHLVL, which is greater than 1 for shells started from another shell (e.g. by `poetry shell`
+	// or `nix develop`), or 0 if it isn't known
+	ShellLevel int `json:"shell_level"`
+	// The PID of the shell that the command was run in, and of the shell that it was started from (if that shell
+	// also has hishtory's shell hook), so that the nesting of shells can be reconstructed. 0 if they aren't known.
+	// See lib.getShellNesting.
+	ShellPid       int `json:"shell_pid"`
+	ParentShellPid int `json:"parent_shell_pid"`
+	// The tmux pane that the command was run in (e.g. "main:1.0" for the first pane in window 1 of the session
+	// named main), or empty if it wasn't run in tmux. See lib.getTmuxPane.
+	TmuxPane string `json:"tmux_pane"`
+	// A unique ID for the command that the shell hooks export as $HISHTORY_CORRELATION_ID while it runs, so that
+	// tools it starts can log it and their logs can be joined back to this entry. See lib.getCorrelationId.
+	CorrelationId string `json:"correlation_id"`
+}
+
+// DeletedEntry records that a history entry was deleted. This is only used when the home directory is shared
+// between hosts, so that deleted entries aren't resurrected when merging in the DBs of the other hosts.
+type DeletedEntry struct {
+	DeviceId string    `gorm:"uniqueIndex:deleted_entry_index"`
+	EndTime  time.Time `gorm:"uniqueIndex:deleted_entry_index"`
+}
+
+// SharedHomeMerge records how much of another host's DB has been merged into this host's DB, when the home
+// directory is shared between hosts.
+type SharedHomeMerge struct {
+	DbName    string `gorm:"primaryKey"`
+	LastRowId int64
+}
+
+// EntryTag is a freeform tag that the user attached to a history entry. Entries are identified by their device ID
+// and end time, like in shared.MessageIdentifier.
+type EntryTag struct {
+	DeviceId string    `gorm:"uniqueIndex:entry_tag_index"`
+	EndTime  time.Time `gorm:"uniqueIndex:entry_tag_index"`
+	Tag      string    `gorm:"uniqueIndex:entry_tag_index"`
+}
+
+// ChannelEntry records that a history entry was published to or received from a team channel (see `hishtory
+// channel`). Entries are identified by their device ID and end time, like EntryTag.
+type ChannelEntry struct {
+	DeviceId string    `gorm:"uniqueIndex:channel_entry_index"`
+	EndTime  time.Time `gorm:"uniqueIndex:channel_entry_index"`
+	Channel  string    `gorm:"uniqueIndex:channel_entry_index"`
+	// Whether the entry was received from a teammate rather than published by this user. Received entries are only
+	// returned by searches that filter on a channel, so that they don't clutter the user's own history.
+	Received bool
+}
+
+// AuditLogEntry records a destructive action (e.g. deleting entries, rotating the secret key, or changing the
+// config) in the local audit log shown by `hishtory audit`. The audit log is append-only and is never synced.
+type AuditLogEntry struct {
+	Id        uint64    `gorm:"primaryKey"`
+	Timestamp time.Time `gorm:"index:audit_log_timestamp_index"`
+	Action    string
+	Details   string
+	// The hishtory command that did the action, e.g. `hishtory redact`. Automatic actions (e.g. applying the
+	// retention policy) are attributed to the command that triggered them, such as `hishtory saveHistoryEntry`.
+	Command string
+}
+
+// TrashedEntry is a history entry that was deleted from the search TUI and can still be restored via `hishtory
+// undelete`. Other devices are only told about the deletion once the grace period is over, at which point it is
+// removed from the trash.
+type TrashedEntry struct {
+	Id           uint64    `gorm:"primaryKey"`
+	DeletionTime time.Time `gorm:"index:trashed_entry_deletion_time_index"`
+	// The deleted HistoryEntry, serialized as JSON
+	Entry []byte
+}
+
+// EntryUsage records that a history entry was selected from a search (e.g. in the TUI) to be run again. The
+// command is stored too so that usages can be counted per command, since re-running a command records a new entry.
+type EntryUsage struct {
+	DeviceId string
+	EndTime  time.Time
+	Command  string `gorm:"index:entry_usage_command_index"`
+	UsedTime time.Time
+}
+
+// Snippet is a command that the user saved under a name, so that it can be run with `hishtory snippet run NAME`
+type Snippet struct {
+	Name    string `gorm:"primaryKey" json:"name"`
+	Command string `json:"command"`
+	// When the snippet was last saved (or deleted), so that the most recent change wins when syncing
+	UpdatedTime time.Time `json:"updated_time"`
+}
+
+// The kinds of MetadataUpdate
+const (
+	MetadataUpdateAddTag        = "add_tag"
+	MetadataUpdateRemoveTag     = "remove_tag"
+	MetadataUpdatePin           = "pin"
+	MetadataUpdateUnpin         = "unpin"
+	MetadataUpdateSaveSnippet   = "save_snippet"
+	MetadataUpdateDeleteSnippet = "delete_snippet"
+	MetadataUpdateEditCommand   = "edit_command"
+)
+
+// MetadataUpdate is a change to the metadata of a history entry (or to a snippet) that is synced to the user's
+// other devices. It is encrypted into a shared.EncMetadataUpdate before being sent to the backend.
+type MetadataUpdate struct {
+	Kind     string    `json:"kind"`
+	DeviceId string    `json:"device_id"`
+	EndTime  time.Time `json:"end_time"`
+	Tag      string    `json:"tag"`
+	// Only set for MetadataUpdateSaveSnippet and MetadataUpdateDeleteSnippet
+	Snippet *Snippet `json:"snippet,omitempty"`
+	// The new command for the entry, only set for MetadataUpdateEditCommand
+	Command string `json:"command,omitempty"`
 }
 
 type CustomColumns []CustomColumn
@@ -62,6 +205,32 @@ func (c CustomColumns) Value() (driver.Value, error) {
 	return json.Marshal(c)
 }
 
+type EnvironmentVariables []EnvironmentVariable
+
+type EnvironmentVariable struct {
+	Name string `json:"name"`
+	Val  string `json:"value"`
+}
+
+func (e *EnvironmentVariables) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		// Entries recorded before environment variables were supported
+		*e = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	default:
+		return fmt.Errorf("failed to unmarshal EnvironmentVariables value %#v", value)
+	}
+}
+
+func (e EnvironmentVariables) Value() (driver.Value, error) {
+	return json.Marshal(e)
+}
+
 func (h *HistoryEntry) GoString() string {
 	return fmt.Sprintf("%#v", *h)
 }
@@ -80,8 +249,7 @@ func EncryptionKey(userSecret string) []byte {
 	return sha256hmac(userSecret, KdfEncryptionKey)
 }
 
-func makeAead(userSecret string) (cipher.AEAD, error) {
-	key := EncryptionKey(userSecret)
+func makeAead(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -94,7 +262,11 @@ func makeAead(userSecret string) (cipher.AEAD, error) {
 }
 
 func Encrypt(userSecret string, data, additionalData []byte) ([]byte, []byte, error) {
-	aead, err := makeAead(userSecret)
+	return encryptWithKey(EncryptionKey(userSecret), data, additionalData)
+}
+
+func encryptWithKey(key, data, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := makeAead(key)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to make AEAD: %w", err)
 	}
@@ -111,7 +283,11 @@ func Encrypt(userSecret string, data, additionalData []byte) ([]byte, []byte, er
 }
 
 func Decrypt(userSecret string, data, additionalData, nonce []byte) ([]byte, error) {
-	aead, err := makeAead(userSecret)
+	return decryptWithKey(EncryptionKey(userSecret), data, additionalData, nonce)
+}
+
+func decryptWithKey(key, data, additionalData, nonce []byte) ([]byte, error) {
+	aead, err := makeAead(key)
 	if err != nil {
 		return []byte{}, fmt.Errorf("failed to make AEAD: %w", err)
 	}
@@ -123,11 +299,17 @@ func Decrypt(userSecret string, data, additionalData, nonce []byte) ([]byte, err
 }
 
 func EncryptHistoryEntry(userSecret string, entry HistoryEntry) (shared.EncHistoryEntry, error) {
+	return EncryptHistoryEntryWithProvider(SecretEncryptionProvider{UserSecret: userSecret}, userSecret, entry)
+}
+
+// EncryptHistoryEntryWithProvider encrypts entry with the given provider. The user secret is still needed since it
+// determines the user ID that the entry is stored under.
+func EncryptHistoryEntryWithProvider(provider EncryptionProvider, userSecret string, entry HistoryEntry) (shared.EncHistoryEntry, error) {
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return shared.EncHistoryEntry{}, err
 	}
-	ciphertext, nonce, err := Encrypt(userSecret, data, []byte(UserId(userSecret)))
+	ciphertext, nonce, err := provider.Encrypt(data, []byte(UserId(userSecret)))
 	if err != nil {
 		return shared.EncHistoryEntry{}, err
 	}
@@ -142,21 +324,65 @@ func EncryptHistoryEntry(userSecret string, entry HistoryEntry) (shared.EncHisto
 }
 
 func DecryptHistoryEntry(userSecret string, entry shared.EncHistoryEntry) (HistoryEntry, error) {
+	return DecryptHistoryEntryWithProvider(SecretEncryptionProvider{UserSecret: userSecret}, userSecret, entry)
+}
+
+func DecryptHistoryEntryWithProvider(provider EncryptionProvider, userSecret string, entry shared.EncHistoryEntry) (HistoryEntry, error) {
 	if entry.UserId != UserId(userSecret) {
 		return HistoryEntry{}, fmt.Errorf("refusing to decrypt history entry with mismatching UserId")
 	}
-	plaintext, err := Decrypt(userSecret, entry.EncryptedData, []byte(UserId(userSecret)), entry.Nonce)
+	plaintext, err := provider.Decrypt(entry.EncryptedData, []byte(UserId(userSecret)), entry.Nonce)
 	if err != nil {
-		return HistoryEntry{}, nil
+		return HistoryEntry{}, fmt.Errorf("failed to decrypt history entry: %w", err)
 	}
 	var decryptedEntry HistoryEntry
 	err = json.Unmarshal(plaintext, &decryptedEntry)
 	if err != nil {
-		return HistoryEntry{}, nil
+		return HistoryEntry{}, fmt.Errorf("failed to unmarshal history entry: %w", err)
 	}
 	return decryptedEntry, nil
 }
 
+func EncryptMetadataUpdate(userSecret string, update MetadataUpdate) (shared.EncMetadataUpdate, error) {
+	return EncryptMetadataUpdateWithProvider(SecretEncryptionProvider{UserSecret: userSecret}, userSecret, update)
+}
+
+func EncryptMetadataUpdateWithProvider(provider EncryptionProvider, userSecret string, update MetadataUpdate) (shared.EncMetadataUpdate, error) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return shared.EncMetadataUpdate{}, err
+	}
+	ciphertext, nonce, err := provider.Encrypt(data, []byte(UserId(userSecret)))
+	if err != nil {
+		return shared.EncMetadataUpdate{}, err
+	}
+	return shared.EncMetadataUpdate{
+		EncryptedData: ciphertext,
+		Nonce:         nonce,
+		UserId:        UserId(userSecret),
+		SendTime:      time.Now(),
+	}, nil
+}
+
+func DecryptMetadataUpdate(userSecret string, update shared.EncMetadataUpdate) (MetadataUpdate, error) {
+	return DecryptMetadataUpdateWithProvider(SecretEncryptionProvider{UserSecret: userSecret}, userSecret, update)
+}
+
+func DecryptMetadataUpdateWithProvider(provider EncryptionProvider, userSecret string, update shared.EncMetadataUpdate) (MetadataUpdate, error) {
+	if update.UserId != UserId(userSecret) {
+		return MetadataUpdate{}, fmt.Errorf("refusing to decrypt metadata update with mismatching UserId")
+	}
+	plaintext, err := provider.Decrypt(update.EncryptedData, []byte(UserId(userSecret)), update.Nonce)
+	if err != nil {
+		return MetadataUpdate{}, err
+	}
+	var decryptedUpdate MetadataUpdate
+	if err := json.Unmarshal(plaintext, &decryptedUpdate); err != nil {
+		return MetadataUpdate{}, fmt.Errorf("failed to unmarshal metadata update: %w", err)
+	}
+	return decryptedUpdate, nil
+}
+
 func EntryEquals(entry1, entry2 HistoryEntry) bool {
 	return entry1.LocalUsername == entry2.LocalUsername &&
 		entry1.Hostname == entry2.Hostname &&
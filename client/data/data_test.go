@@ -1,6 +1,8 @@
 package data
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -59,3 +61,56 @@ func TestCustomColumnSerialization(t *testing.T) {
 	}
 
 }
+
+func TestGetHishtoryDir(t *testing.T) {
+	homedir := t.TempDir()
+	t.Setenv("HISHTORY_PATH", "")
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	// With no XDG vars set, fall back to ~/.hishtory
+	if dir := GetHishtoryDir(homedir); dir != filepath.Join(homedir, ".hishtory") {
+		t.Fatalf("unexpected data dir: %#v", dir)
+	}
+
+	// XDG vars are respected for new installs
+	t.Setenv("XDG_DATA_HOME", "/xdg/data")
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	if dir := GetHishtoryDir(homedir); dir != "/xdg/data/hishtory" {
+		t.Fatalf("unexpected data dir: %#v", dir)
+	}
+	if dir := GetHishtoryConfigDir(homedir); dir != "/xdg/config/hishtory" {
+		t.Fatalf("unexpected config dir: %#v", dir)
+	}
+	if _, _, needsMigration := GetHishtoryDirMigration(homedir); needsMigration {
+		t.Fatalf("expected no migration to be needed without a legacy install")
+	}
+
+	// But an existing install in ~/.hishtory keeps being used until it is migrated
+	legacyDir := filepath.Join(homedir, ".hishtory")
+	checkError(t, os.MkdirAll(legacyDir, 0o744))
+	checkError(t, os.WriteFile(filepath.Join(legacyDir, CONFIG_PATH), []byte("{}"), 0o644))
+	if dir := GetHishtoryDir(homedir); dir != legacyDir {
+		t.Fatalf("unexpected data dir: %#v", dir)
+	}
+	if dir := GetHishtoryConfigDir(homedir); dir != legacyDir {
+		t.Fatalf("unexpected config dir: %#v", dir)
+	}
+	dataDir, configDir, needsMigration := GetHishtoryDirMigration(homedir)
+	if !needsMigration || dataDir != "/xdg/data/hishtory" || configDir != "/xdg/config/hishtory" {
+		t.Fatalf("unexpected migration: dataDir=%#v, configDir=%#v, needsMigration=%v", dataDir, configDir, needsMigration)
+	}
+
+	// HISHTORY_PATH overrides everything, and may be relative to the home directory
+	t.Setenv("HISHTORY_PATH", ".custom-hishtory")
+	if dir := GetHishtoryDir(homedir); dir != filepath.Join(homedir, ".custom-hishtory") {
+		t.Fatalf("unexpected data dir: %#v", dir)
+	}
+	t.Setenv("HISHTORY_PATH", "/opt/hishtory")
+	if dir := GetHishtoryConfigDir(homedir); dir != "/opt/hishtory" {
+		t.Fatalf("unexpected config dir: %#v", dir)
+	}
+	if _, _, needsMigration := GetHishtoryDirMigration(homedir); needsMigration {
+		t.Fatalf("expected no migration to be needed when HISHTORY_PATH is set")
+	}
+}
@@ -0,0 +1,47 @@
+package data
+
+import "fmt"
+
+// An EncryptionProvider encrypts the history entries and metadata updates that are synced via the backend, so that
+// the backend never sees them in plaintext
+type EncryptionProvider interface {
+	Encrypt(plaintext, additionalData []byte) (ciphertext, nonce []byte, err error)
+	Decrypt(ciphertext, additionalData, nonce []byte) ([]byte, error)
+}
+
+// SecretEncryptionProvider encrypts with a key derived from the user secret. This is the default provider.
+type SecretEncryptionProvider struct {
+	UserSecret string
+}
+
+func (p SecretEncryptionProvider) Encrypt(plaintext, additionalData []byte) ([]byte, []byte, error) {
+	return Encrypt(p.UserSecret, plaintext, additionalData)
+}
+
+func (p SecretEncryptionProvider) Decrypt(ciphertext, additionalData, nonce []byte) ([]byte, error) {
+	return Decrypt(p.UserSecret, ciphertext, additionalData, nonce)
+}
+
+// The size of the data keys used by DataKeyEncryptionProvider, for AES-256
+const DataKeySize = 32
+
+// DataKeyEncryptionProvider encrypts with a random data key that is managed outside of hishtory, e.g. one that is
+// wrapped with age or with a cloud KMS. This means that the user secret alone isn't enough to decrypt synced entries.
+type DataKeyEncryptionProvider struct {
+	key []byte
+}
+
+func NewDataKeyEncryptionProvider(key []byte) (DataKeyEncryptionProvider, error) {
+	if len(key) != DataKeySize {
+		return DataKeyEncryptionProvider{}, fmt.Errorf("invalid data key: expected %d bytes, got %d", DataKeySize, len(key))
+	}
+	return DataKeyEncryptionProvider{key: key}, nil
+}
+
+func (p DataKeyEncryptionProvider) Encrypt(plaintext, additionalData []byte) ([]byte, []byte, error) {
+	return encryptWithKey(p.key, plaintext, additionalData)
+}
+
+func (p DataKeyEncryptionProvider) Decrypt(ciphertext, additionalData, nonce []byte) ([]byte, error) {
+	return decryptWithKey(p.key, ciphertext, additionalData, nonce)
+}
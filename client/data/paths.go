@@ -0,0 +1,158 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// GetHishtoryDir returns the absolute path of the directory that contains hishtory's data (the DB, the
+// binary, the shell config files, and the logs). In order of precedence, this is:
+//
+//  1. $HISHTORY_PATH (resolved relative to the home directory if it isn't absolute)
+//  2. ~/.hishtory, if it contains a config file (so that existing installs keep working until they are migrated)
+//  3. %APPDATA%\hishtory on Windows, or $XDG_DATA_HOME/hishtory if XDG_DATA_HOME is set
+//  4. ~/.hishtory
+func GetHishtoryDir(homedir string) string {
+	dataDir, _ := getHishtoryDirs(homedir, true)
+	return dataDir
+}
+
+// GetHishtoryConfigDir returns the absolute path of the directory that contains the hishtory config file. This
+// follows the same precedence as GetHishtoryDir, except that $XDG_CONFIG_HOME/hishtory is used if XDG_CONFIG_HOME
+// is set.
+func GetHishtoryConfigDir(homedir string) string {
+	_, configDir := getHishtoryDirs(homedir, true)
+	return configDir
+}
+
+// GetLegacyHishtoryDir returns the path of the ~/.hishtory directory that was used before hishtory supported
+// XDG_DATA_HOME and %APPDATA%.
+func GetLegacyHishtoryDir(homedir string) string {
+	return filepath.Join(homedir, defaultHishtoryPath)
+}
+
+// GetHishtoryDirMigration returns the directories that the data in the legacy ~/.hishtory directory should be
+// moved to. needsMigration is false if there is no legacy directory, if HISHTORY_PATH is set, or if the
+// preferred directories are the legacy directory.
+func GetHishtoryDirMigration(homedir string) (dataDir, configDir string, needsMigration bool) {
+	dataDir, configDir = getHishtoryDirs(homedir, false)
+	if os.Getenv("HISHTORY_PATH") != "" || !isLegacyInstall(homedir) {
+		return dataDir, configDir, false
+	}
+	legacyDir := GetLegacyHishtoryDir(homedir)
+	return dataDir, configDir, dataDir != legacyDir || configDir != legacyDir
+}
+
+func getHishtoryDirs(homedir string, allowLegacy bool) (dataDir, configDir string) {
+	if hishtoryPath := os.Getenv("HISHTORY_PATH"); hishtoryPath != "" {
+		if !filepath.IsAbs(hishtoryPath) {
+			hishtoryPath = filepath.Join(homedir, hishtoryPath)
+		}
+		return hishtoryPath, hishtoryPath
+	}
+	legacyDir := GetLegacyHishtoryDir(homedir)
+	if allowLegacy && isLegacyInstall(homedir) {
+		return legacyDir, legacyDir
+	}
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			dir := filepath.Join(appData, "hishtory")
+			return dir, dir
+		}
+		return legacyDir, legacyDir
+	}
+	dataDir = legacyDir
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(xdgDataHome) {
+		dataDir = filepath.Join(xdgDataHome, "hishtory")
+	}
+	configDir = dataDir
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdgConfigHome) {
+		configDir = filepath.Join(xdgConfigHome, "hishtory")
+	}
+	return dataDir, configDir
+}
+
+func isLegacyInstall(homedir string) bool {
+	_, err := os.Stat(filepath.Join(GetLegacyHishtoryDir(homedir), CONFIG_PATH))
+	return err == nil
+}
+
+// GetHishtoryBinaryPath returns the path that the hishtory binary is installed to
+func GetHishtoryBinaryPath(homedir string) string {
+	name := "hishtory"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(GetHishtoryDir(homedir), name)
+}
+
+// IsSharedHome returns whether the hishtory data directory may be shared between multiple hosts (e.g. an
+// NFS-mounted home directory on a cluster). This is detected from the type of the filesystem, and can be
+// overridden by setting HISHTORY_SHARED_HOME to true or false.
+func IsSharedHome(homedir string) bool {
+	switch strings.ToLower(os.Getenv("HISHTORY_SHARED_HOME")) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	dir := GetHishtoryDir(homedir)
+	if _, err := os.Stat(dir); err != nil {
+		// The data directory doesn't exist yet, so check the filesystem it will be created on
+		dir = filepath.Dir(dir)
+	}
+	return isNetworkFilesystem(dir)
+}
+
+// GetDbPath returns the path of the local sqlite DB. sqlite DBs can't safely be written to from multiple hosts
+// over a network filesystem, so each host gets its own DB if the home directory is shared.
+func GetDbPath(homedir string) string {
+	if IsSharedHome(homedir) {
+		return filepath.Join(GetHishtoryDir(homedir), getPerHostDbName())
+	}
+	return filepath.Join(GetHishtoryDir(homedir), DB_PATH)
+}
+
+// GetColdDbPath returns the path of the local sqlite DB that old entries are archived to, see
+// lib.ArchiveToColdStorage. Note that this isn't named like the per-host DBs, so that it is never mistaken for one.
+func GetColdDbPath(homedir string) string {
+	return filepath.Join(GetHishtoryDir(homedir), COLD_DB_PATH)
+}
+
+// GetSharedHomeDbPaths returns the paths of the DBs belonging to the other hosts that share this home directory,
+// including the DB that was used before the home directory was detected as being shared.
+func GetSharedHomeDbPaths(homedir string) ([]string, error) {
+	dir := GetHishtoryDir(homedir)
+	matches, err := filepath.Glob(filepath.Join(dir, ".hishtory.*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list per-host DBs: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DB_PATH)); err == nil {
+		matches = append(matches, filepath.Join(dir, DB_PATH))
+	}
+	ownDb := filepath.Join(dir, getPerHostDbName())
+	paths := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if m != ownDb {
+			paths = append(paths, m)
+		}
+	}
+	return paths, nil
+}
+
+func getPerHostDbName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, hostname)
+	return ".hishtory." + sanitized + ".db"
+}
@@ -0,0 +1,58 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ddworken/hishtory/shared"
+)
+
+// ShareReadKey derives the read key for a share of the user's history. The read key is given to the users that the
+// history is shared with, and is all that they need to read it. It is derived from a per-share salt so that a share
+// that was revoked can't be read with its old read key if it is created again under the same name.
+func ShareReadKey(userSecret, shareName, salt string) string {
+	return base64.URLEncoding.EncodeToString(sha256hmac(userSecret, KdfShareReadKey+":"+shareName+":"+salt))
+}
+
+// ShareId derives the ID that the backend stores a share under from its read key, so that the backend never learns
+// the read key itself
+func ShareId(readKey string) string {
+	return base64.URLEncoding.EncodeToString(sha256hmac(readKey, KdfShareId))
+}
+
+// EncryptSharedEntry encrypts entry with a key derived from the read key of the share that it is in, so that it can be
+// decrypted by anyone the share was given to without giving them the owner's user secret
+func EncryptSharedEntry(readKey string, entry HistoryEntry) (shared.EncSharedEntry, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return shared.EncSharedEntry{}, err
+	}
+	shareId := ShareId(readKey)
+	ciphertext, nonce, err := Encrypt(readKey, data, []byte(shareId))
+	if err != nil {
+		return shared.EncSharedEntry{}, err
+	}
+	return shared.EncSharedEntry{
+		ShareId:       shareId,
+		EncryptedData: ciphertext,
+		Nonce:         nonce,
+		Date:          entry.EndTime,
+	}, nil
+}
+
+func DecryptSharedEntry(readKey string, entry shared.EncSharedEntry) (HistoryEntry, error) {
+	shareId := ShareId(readKey)
+	if entry.ShareId != shareId {
+		return HistoryEntry{}, fmt.Errorf("refusing to decrypt shared entry with mismatching ShareId")
+	}
+	plaintext, err := Decrypt(readKey, entry.EncryptedData, []byte(shareId), entry.Nonce)
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to decrypt shared entry: %w", err)
+	}
+	var decryptedEntry HistoryEntry
+	if err := json.Unmarshal(plaintext, &decryptedEntry); err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to unmarshal shared entry: %w", err)
+	}
+	return decryptedEntry, nil
+}
@@ -0,0 +1,25 @@
+package data
+
+import "syscall"
+
+var networkFilesystemTypes = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+}
+
+func isNetworkFilesystem(p string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return false
+	}
+	fsType := make([]byte, 0, len(st.Fstypename))
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		fsType = append(fsType, byte(c))
+	}
+	return networkFilesystemTypes[string(fsType)]
+}
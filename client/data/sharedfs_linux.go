@@ -0,0 +1,24 @@
+package data
+
+import "syscall"
+
+// Filesystem magic numbers (from statfs(2)) for filesystems that may be mounted on multiple hosts at once
+var networkFilesystemMagics = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x5346414F: true, // AFS
+	0x00C36400: true, // Ceph
+	0x0BD00BD0: true, // Lustre
+	0x47504653: true, // GPFS
+	0x013111A8: true, // IBRIX
+}
+
+func isNetworkFilesystem(p string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return false
+	}
+	return networkFilesystemMagics[uint32(st.Type)]
+}
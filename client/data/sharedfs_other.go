@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package data
+
+func isNetworkFilesystem(p string) bool {
+	// Detection isn't supported on this platform, so HISHTORY_SHARED_HOME must be set to opt in
+	return false
+}
@@ -0,0 +1,439 @@
+package hctx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"gorm.io/gorm"
+)
+
+// The hishtory agent is a per-user background process (like ssh-agent) that caches the decrypted user secret and
+// keeps a warm connection to the DB. Other hishtory processes talk to it over a unix socket that only the current
+// user can access, so that latency sensitive commands (e.g. the control-r TUI) don't have to read the secret from the
+// keychain (or decrypt it with a passphrase) and open the DB on every invocation. See RunAgent.
+
+// An AgentHandler handles a kind of request to the agent (see RegisterAgentHandler). ctx has the config of the
+// process that sent the request and the agent's DB connection. The result is sent back as JSON.
+type AgentHandler func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+// The handlers for the kinds of requests that the agent supports, other than the built-in ones handled by
+// handleAgentRequest
+var agentHandlers = make(map[string]AgentHandler)
+
+// RegisterAgentHandler registers the handler for a kind of request to the agent. It should be called from an init
+// function, since the handlers are only read once the agent is running.
+func RegisterAgentHandler(kind string, handler AgentHandler) {
+	agentHandlers[kind] = handler
+}
+
+// The functions that are called when the agent stops, after it stops accepting requests and before its DB is closed
+var agentStopHooks []func()
+
+// RegisterAgentStopHook registers a function that is called when the agent stops (e.g. to finish the writes that
+// handlers queued). Like RegisterAgentHandler, it should be called from an init function.
+func RegisterAgentStopHook(hook func()) {
+	agentStopHooks = append(agentStopHooks, hook)
+}
+
+// ErrAgentUnavailable is returned (wrapped) by CallAgent when the agent didn't handle the request at all, because it
+// isn't running, doesn't support the request, or is stopping. The caller can then safely handle the request itself.
+// Handlers can return it too, if they didn't do anything.
+var ErrAgentUnavailable = errors.New("the hishtory agent is unavailable")
+
+type agentRequest struct {
+	Kind string `json:"kind"`
+	// The config of the process that sent the request, so that requests are handled with the same config (including
+	// any overrides via --set) as they would be without the agent
+	Config *ClientConfig   `json:"config,omitempty"`
+	Args   json.RawMessage `json:"args,omitempty"`
+}
+
+type agentResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Whether the error is ErrAgentUnavailable
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// The state of the agent, if this process is the agent. These are set before the agent starts serving requests.
+var (
+	isRunningAgent bool
+	// The user secret if it was decrypted with a passphrase, since the agent can't read it from the config file
+	runningAgentSecret string
+)
+
+// loginSessionId returns the ID of the current login session, which is shared by all the processes started from the
+// same login (e.g. every terminal in a desktop session). It is empty if unsupported, which is everywhere but Linux.
+func loginSessionId() string {
+	id, err := os.ReadFile("/proc/self/sessionid")
+	if err != nil {
+		return ""
+	}
+	// This is (uint32)-1 for processes that aren't part of a login session (e.g. in containers)
+	if strings.TrimSpace(string(id)) == "4294967295" {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// agentSocketPath returns the path of the unix socket that the agent of the current login session listens on. The
+// socket is in a directory that only the current user can access, since the socket's own permissions can only be
+// restricted once it already exists.
+func agentSocketPath() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve homedir: %w", err)
+	}
+	name := "agent.sock"
+	if id := loginSessionId(); id != "" {
+		name = "agent-" + id + ".sock"
+	}
+	return path.Join(data.GetHishtoryConfigDir(homedir), "agent", name), nil
+}
+
+// CallAgent sends a request to the agent and decodes its result into result. config is sent along with the request
+// for the handlers that depend on it, and may be nil otherwise. If ctx is cancelled, the connection is closed so that
+// the agent cancels the request too, and ctx's error is returned.
+func CallAgent(ctx context.Context, kind string, config *ClientConfig, args, result interface{}) error {
+	defer StartSpan("agent " + kind)()
+	err := callAgent(ctx, kind, config, args, result)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func callAgent(ctx context.Context, kind string, config *ClientConfig, args, result interface{}) error {
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("%w (failed to connect to it: %v)", ErrAgentUnavailable, err)
+	}
+	defer conn.Close()
+	// ctx's deadline isn't used for the connection's deadline, since that would race with ctx's own timer and could
+	// return an i/o timeout rather than ctx's error. Instead, the connection is closed once ctx is done.
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	request := agentRequest{Kind: kind, Config: config}
+	if args != nil {
+		request.Args, err = json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("failed to serialize the request to the hishtory agent: %w", err)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return fmt.Errorf("failed to send a request to the hishtory agent: %w", err)
+	}
+	var response agentResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("failed to read the response from the hishtory agent: %w", err)
+	}
+	if response.Unavailable {
+		return fmt.Errorf("%w%s", ErrAgentUnavailable, strings.TrimPrefix(response.Error, ErrAgentUnavailable.Error()))
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("failed to parse the response from the hishtory agent: %w", err)
+	}
+	return nil
+}
+
+// IsAgentProcess returns whether the current process is the agent
+func IsAgentProcess() bool {
+	return isRunningAgent
+}
+
+// IsAgentRunning returns whether the agent of the current login session is running
+func IsAgentRunning() bool {
+	if isRunningAgent {
+		return false
+	}
+	return CallAgent(context.Background(), "ping", nil, nil, nil) == nil
+}
+
+// getAgentSecret returns the user secret cached by the agent, or ErrLocked if the agent isn't running
+func getAgentSecret() (string, error) {
+	if isRunningAgent {
+		if runningAgentSecret == "" {
+			return "", ErrLocked
+		}
+		return runningAgentSecret, nil
+	}
+	var secret string
+	if err := CallAgent(context.Background(), "get_secret", nil, nil, &secret); err != nil {
+		return "", ErrLocked
+	}
+	return secret, nil
+}
+
+// RunAgent runs the agent in the current process until it is stopped via StopAgent or lifetime passes (if non-zero).
+// secret is the user secret if it was decrypted with a passphrase, and is empty otherwise.
+func RunAgent(secret string, lifetime time.Duration) error {
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	socketDir := path.Dir(socketPath)
+	if err := os.MkdirAll(socketDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", socketDir, err)
+	}
+	// In case the directory already existed with looser permissions
+	if err := os.Chmod(socketDir, 0o700); err != nil {
+		return fmt.Errorf("failed to restrict access to %s: %w", socketDir, err)
+	}
+	isRunningAgent = true
+	runningAgentSecret = secret
+	defer func() {
+		isRunningAgent = false
+		runningAgentSecret = ""
+	}()
+	// Clean up the socket of an agent that didn't exit cleanly (e.g. because the machine was rebooted)
+	_ = os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		return fmt.Errorf("failed to restrict access to %s: %w", socketPath, err)
+	}
+	if lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() { listener.Close() })
+		defer timer.Stop()
+	}
+	ctx, err := MakeLazyContext()
+	if err != nil {
+		return err
+	}
+	// Handlers' ctx is cancelled once the agent starts stopping
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	db := ctx.Value(contextDBKey).(*lazyDb)
+	// The DB is closed before the stop request is acknowledged, so that once StopAgent returns the DB can be replaced
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			listener.Close()
+			cancel()
+			for _, hook := range agentStopHooks {
+				hook()
+			}
+			db.close()
+		})
+	}
+	defer stop()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept a connection to the hishtory agent: %w", err)
+		}
+		go handleAgentRequest(ctx, conn, stop)
+	}
+}
+
+// handleAgentRequest responds to a single request to the agent, calling stop if it is a request to stop the agent
+func handleAgentRequest(ctx context.Context, conn net.Conn, stop func()) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return
+	}
+	var request agentRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		return
+	}
+	// Nothing else is sent after the request, so reading from the connection only returns once the caller hung up (e.g.
+	// because its ctx was cancelled), which cancels the request
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		cancel()
+	}()
+	var result interface{}
+	var err error
+	switch request.Kind {
+	case "ping":
+	case "stop":
+		stop()
+	case "get_secret":
+		result, err = getAgentSecret()
+		if errors.Is(err, ErrLocked) {
+			var config ClientConfig
+			config, err = GetConfig()
+			result = config.UserSecret
+		}
+	default:
+		handler, ok := agentHandlers[request.Kind]
+		if !ok {
+			err = fmt.Errorf("%w: it doesn't support %#v requests, run `hishtory agent stop` to restart it", ErrAgentUnavailable, request.Kind)
+			break
+		}
+		config := request.Config
+		if config == nil {
+			var c ClientConfig
+			c, err = GetConfig()
+			if err != nil {
+				break
+			}
+			config = &c
+		}
+		result, err = callAgentHandler(WithConf(ctx, *config), handler, request.Args)
+	}
+	var response agentResponse
+	if err != nil {
+		response.Error = err.Error()
+		response.Unavailable = errors.Is(err, ErrAgentUnavailable)
+	} else if response.Result, err = json.Marshal(result); err != nil {
+		response.Error = fmt.Sprintf("failed to serialize the result: %v", err)
+	}
+	_ = json.NewEncoder(conn).Encode(response)
+}
+
+// callAgentHandler runs handler, turning a panic into an error so that a bad request doesn't stop the agent
+func callAgentHandler(ctx context.Context, handler AgentHandler, args json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the hishtory agent failed to handle the request: %v", r)
+		}
+	}()
+	return handler(ctx, args)
+}
+
+// StartAgent starts the agent in the background (see RunAgent), replacing the agent that is already running if there
+// is one. The secret is passed to it over stdin so that it doesn't show up in the process list.
+func StartAgent(secret string, lifetime time.Duration) error {
+	if err := StopAgent(); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the hishtory binary: %w", err)
+	}
+	cmd := exec.Command(exe, "agent", "run", "--lifetime", lifetime.String())
+	detachProcess(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to start the hishtory agent: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the hishtory agent: %w", err)
+	}
+	_, err = stdin.Write([]byte(secret + "\n"))
+	stdin.Close()
+	if err != nil {
+		return fmt.Errorf("failed to send the secret key to the hishtory agent: %w", err)
+	}
+	if err := cmd.Process.Release(); err != nil {
+		return fmt.Errorf("failed to detach from the hishtory agent: %w", err)
+	}
+	for i := 0; i < 50; i++ {
+		if IsAgentRunning() {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("the hishtory agent didn't start, see the logs in ~/.hishtory/hishtory.log")
+}
+
+// StopAgent stops the agent of the current login session, if it is running. If the user secret is encrypted with a
+// passphrase, this locks hishtory until the passphrase is entered again.
+func StopAgent() error {
+	if err := CallAgent(context.Background(), "stop", nil, nil, nil); err != nil {
+		// The agent isn't running, so there is nothing to do
+		return nil
+	}
+	// Wait for the agent to stop listening, so that a new agent can be started right away
+	for i := 0; i < 50; i++ {
+		if !IsAgentRunning() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("the hishtory agent didn't stop")
+}
+
+type lazyDb struct {
+	config ClientConfig
+	once   sync.Once
+	db     *gorm.DB
+}
+
+func (l *lazyDb) get() *gorm.DB {
+	l.once.Do(func() {
+		defer StartSpan("db open")()
+		db, err := OpenLocalSqliteDb(l.config)
+		if err != nil {
+			panic(fmt.Errorf("failed to open local DB: %w", err))
+		}
+		l.db = db
+	})
+	if l.db == nil {
+		panic(fmt.Errorf("the local DB was already closed"))
+	}
+	return l.db
+}
+
+// close closes the DB if it was opened, and stops it from being opened later
+func (l *lazyDb) close() {
+	l.once.Do(func() {})
+	if l.db == nil {
+		return
+	}
+	if sqlDb, err := l.db.DB(); err == nil {
+		sqlDb.Close()
+	}
+}
+
+// MakeLazyContext is like MakeContext, except that the DB is only opened once it is first used. It is for commands
+// that usually get everything that they need from the agent.
+func MakeLazyContext() (context.Context, error) {
+	ctx := context.Background()
+	endSpan := StartSpan("config load")
+	if err := MigrateConfig(); err != nil {
+		return nil, fmt.Errorf("failed to upgrade config: %w", err)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	endSpan()
+	ctx = WithConf(ctx, config)
+	ctx = context.WithValue(ctx, contextDBKey, &lazyDb{config: config})
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get homedir: %w", err)
+	}
+	return WithHome(ctx, homedir), nil
+}
@@ -2,7 +2,20 @@ package hctx
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/shared/testutils"
+	"github.com/zalando/go-keyring"
+	"gorm.io/gorm/clause"
 )
 
 func TestCtxConfig(t *testing.T) {
@@ -24,3 +37,692 @@ func TestCtxConfig(t *testing.T) {
 		t.Errorf("expected %s, got %s", config.DeviceId, ctxConfig.DeviceId)
 	}
 }
+
+func TestConcurrentUpdateConfig(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, SetConfig(ClientConfig{UserSecret: "shhhh"}))
+
+	// Concurrently increment a field, none of the increments should be lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testutils.Check(t, UpdateConfig(func(config *ClientConfig) {
+				config.LastPruneTimestamp += 1
+			}))
+		}()
+	}
+	wg.Wait()
+
+	config, err := GetConfig()
+	testutils.Check(t, err)
+	if config.LastPruneTimestamp != 20 {
+		t.Fatalf("expected 20 increments, got %d", config.LastPruneTimestamp)
+	}
+	if config.UserSecret != "shhhh" {
+		t.Fatalf("UpdateConfig clobbered an unrelated field: %#v", config)
+	}
+}
+
+// The history_entries table as it was created by each historical schema version
+var historicalSchemas = map[int][]string{
+	0: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+	},
+	1: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"PRAGMA user_version = 1",
+	},
+	2: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 2",
+	},
+	3: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 3",
+	},
+	4: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 4",
+	},
+	5: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 5",
+	},
+	6: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 6",
+	},
+	7: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 7",
+	},
+	8: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"PRAGMA user_version = 8",
+	},
+	9: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"PRAGMA user_version = 9",
+	},
+	10: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"PRAGMA user_version = 10",
+	},
+	11: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"PRAGMA user_version = 11",
+	},
+	12: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 12",
+	},
+	13: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 13",
+	},
+	14: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 14",
+	},
+	15: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 15",
+	},
+	16: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 16",
+	},
+	17: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 17",
+	},
+	18: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text,`correlation_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"PRAGMA user_version = 18",
+	},
+	19: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text,`correlation_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"CREATE TABLE `channel_entries` (`device_id` text,`end_time` datetime,`channel` text,`received` numeric)",
+		"CREATE UNIQUE INDEX `channel_entry_index` ON `channel_entries`(`device_id`,`end_time`,`channel`)",
+		"PRAGMA user_version = 19",
+	},
+	20: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text,`correlation_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"CREATE TABLE `channel_entries` (`device_id` text,`end_time` datetime,`channel` text,`received` numeric)",
+		"CREATE UNIQUE INDEX `channel_entry_index` ON `channel_entries`(`device_id`,`end_time`,`channel`)",
+		"CREATE TABLE `audit_log_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`timestamp` datetime,`action` text,`details` text,`command` text)",
+		"CREATE INDEX `audit_log_timestamp_index` ON `audit_log_entries`(`timestamp`)",
+		"PRAGMA user_version = 20",
+	},
+	21: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text,`correlation_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"CREATE TABLE `channel_entries` (`device_id` text,`end_time` datetime,`channel` text,`received` numeric)",
+		"CREATE UNIQUE INDEX `channel_entry_index` ON `channel_entries`(`device_id`,`end_time`,`channel`)",
+		"CREATE TABLE `audit_log_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`timestamp` datetime,`action` text,`details` text,`command` text)",
+		"CREATE INDEX `audit_log_timestamp_index` ON `audit_log_entries`(`timestamp`)",
+		"CREATE TABLE `trashed_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`deletion_time` datetime,`entry` blob)",
+		"CREATE INDEX `trashed_entry_deletion_time_index` ON `trashed_entries`(`deletion_time`)",
+		"CREATE VIEW v_history AS SELECT command, hostname, local_username AS username, current_working_directory AS cwd, home_directory, exit_code, start_time, end_time, device_id FROM history_entries",
+		"PRAGMA user_version = 21",
+	},
+	22: {
+		"CREATE TABLE `history_entries` (`local_username` text,`hostname` text,`command` text,`current_working_directory` text,`home_directory` text,`exit_code` integer,`start_time` datetime,`end_time` datetime,`device_id` text,`custom_columns` blob,`dev_environment` text,`remote_hosts` text,`container` text,`kube_context` text,`environment_variables` blob,`hit_count` integer,`pinned` numeric,`resolved_command` text,`as_root` numeric,`shell_mode` text,`shell_level` integer,`shell_pid` integer,`parent_shell_pid` integer,`tmux_pane` text,`correlation_id` text)",
+		"CREATE UNIQUE INDEX `compositeindex` ON `history_entries`(`local_username`,`hostname`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_id`)",
+		"CREATE INDEX end_time_index ON history_entries(end_time)",
+		"CREATE TABLE `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+		"CREATE TABLE `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))",
+		"CREATE TABLE `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX `entry_usage_command_index` ON `entry_usages`(`command`)",
+		"CREATE TABLE `channel_entries` (`device_id` text,`end_time` datetime,`channel` text,`received` numeric)",
+		"CREATE UNIQUE INDEX `channel_entry_index` ON `channel_entries`(`device_id`,`end_time`,`channel`)",
+		"CREATE TABLE `audit_log_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`timestamp` datetime,`action` text,`details` text,`command` text)",
+		"CREATE INDEX `audit_log_timestamp_index` ON `audit_log_entries`(`timestamp`)",
+		"CREATE TABLE `trashed_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`deletion_time` datetime,`entry` blob)",
+		"CREATE INDEX `trashed_entry_deletion_time_index` ON `trashed_entries`(`deletion_time`)",
+		historyViewSql,
+		"PRAGMA user_version = 22",
+	},
+}
+
+func TestMigrateDbFromEveryVersion(t *testing.T) {
+	if len(historicalSchemas) != LatestDbVersion {
+		t.Fatalf("expected a historical schema for every version before %d, add one for the previous version", LatestDbVersion)
+	}
+	for version, schema := range historicalSchemas {
+		dbPath := path.Join(t.TempDir(), "old.db")
+		db, err := OpenSqliteDb(ClientConfig{}, dbPath, "rwc")
+		testutils.Check(t, err)
+		for _, sql := range schema {
+			testutils.Check(t, db.Exec(sql).Error)
+		}
+		testutils.Check(t, db.Exec("INSERT INTO history_entries (command, device_id, end_time) VALUES ('ls', 'device', '2023-01-01 00:00:00+00:00')").Error)
+
+		testutils.Check(t, migrateDb(db, dbPath))
+		newVersion, err := getDbVersion(db)
+		testutils.Check(t, err)
+		if newVersion != LatestDbVersion {
+			t.Fatalf("expected v%d to be migrated to v%d, got v%d", version, LatestDbVersion, newVersion)
+		}
+		var entries []data.HistoryEntry
+		testutils.Check(t, db.Find(&entries).Error)
+		if len(entries) != 1 || entries[0].Command != "ls" {
+			t.Fatalf("expected the entry to survive migrating from v%d, got %#v", version, entries)
+		}
+		entries[0].DevEnvironment = "mise"
+		entries[0].RemoteHosts = "10.0.0.1"
+		entries[0].Container = "docker"
+		entries[0].KubeContext = "prod/default"
+		entries[0].EnvironmentVariables = data.EnvironmentVariables{{Name: "AWS_PROFILE", Val: "prod"}}
+		entries[0].HitCount = 2
+		entries[0].Pinned = true
+		entries[0].ResolvedCommand = "ls --color=auto"
+		entries[0].StartTime = entries[0].EndTime
+		// history_entries is a view that can only be inserted into, so the entry is replaced with the updated one
+		testutils.Check(t, db.Exec("DELETE FROM "+HistoryEntryRowsTable).Error)
+		testutils.Check(t, db.Create(&entries[0]).Error)
+		var updated data.HistoryEntry
+		testutils.Check(t, db.Where("command = ?", "ls").First(&updated).Error)
+		if updated.DeviceId != "device" || updated.ResolvedCommand != "ls --color=auto" || !updated.Pinned {
+			t.Fatalf("expected the updated entry to be stored after migrating from v%d, got %#v", version, updated)
+		}
+		testutils.Check(t, db.Create(&data.EntryTag{DeviceId: "device", EndTime: entries[0].EndTime, Tag: "golden"}).Error)
+		testutils.Check(t, db.Create(&data.EntryUsage{DeviceId: "device", EndTime: entries[0].EndTime, Command: "ls", UsedTime: entries[0].EndTime}).Error)
+		testutils.Check(t, db.Create(&data.Snippet{Name: "deploy", Command: "make deploy", UpdatedTime: entries[0].EndTime}).Error)
+		testutils.Check(t, db.Create(&data.ChannelEntry{DeviceId: "device", EndTime: entries[0].EndTime, Channel: "ops", Received: true}).Error)
+		testutils.Check(t, db.Create(&data.AuditLogEntry{Timestamp: entries[0].EndTime, Action: "redact", Details: "deleted 1 entry", Command: "hishtory redact"}).Error)
+		testutils.Check(t, db.Create(&data.TrashedEntry{DeletionTime: entries[0].EndTime, Entry: []byte("{}")}).Error)
+		// Selecting runtime_seconds also checks that the view from older versions (without it) was replaced
+		var viewCommands []string
+		testutils.Check(t, db.Raw("SELECT command FROM "+HistoryViewName+" WHERE runtime_seconds = 0").Scan(&viewCommands).Error)
+		if len(viewCommands) != 1 {
+			t.Fatalf("expected the %s view to exist after migrating from v%d", HistoryViewName, version)
+		}
+		var indexes []string
+		testutils.Check(t, db.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND name = 'end_time_index'").Scan(&indexes).Error)
+		if len(indexes) != 1 {
+			t.Fatalf("expected the end_time index to exist after migrating from v%d", version)
+		}
+		snapshots, err := ListDbSnapshots(dbPath)
+		testutils.Check(t, err)
+		if len(snapshots) != 1 || snapshots[0].Operation != fmt.Sprintf("migration-v%d", version) {
+			t.Fatalf("expected a snapshot to be taken before migrating from v%d: %#v", version, snapshots)
+		}
+	}
+}
+
+func TestNormalizeHistoryEntries(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "old.db")
+	db, err := OpenSqliteDb(ClientConfig{}, dbPath, "rwc")
+	testutils.Check(t, err)
+	for _, sql := range historicalSchemas[LatestDbVersion-1] {
+		testutils.Check(t, db.Exec(sql).Error)
+	}
+	for i := 0; i < 10; i++ {
+		testutils.Check(t, db.Exec("INSERT INTO history_entries (rowid, hostname, command, device_id, end_time) VALUES (?, ?, ?, ?, ?)",
+			100+i, fmt.Sprintf("host-%d", i%2), fmt.Sprintf("cmd %d", i), fmt.Sprintf("device-%d", i%2), time.Unix(int64(i), 0)).Error)
+	}
+	testutils.Check(t, db.Exec("INSERT INTO history_entries (command) VALUES ('no host')").Error)
+	testutils.Check(t, migrateDb(db, dbPath))
+
+	// Each hostname and device ID is only stored once, and the entries (and their rowids) are unchanged
+	var numHostnames, numDevices int64
+	testutils.Check(t, db.Table("hostnames").Count(&numHostnames).Error)
+	testutils.Check(t, db.Table("devices").Count(&numDevices).Error)
+	if numHostnames != 2 || numDevices != 2 {
+		t.Fatalf("expected 2 hostnames and 2 devices, got %d and %d", numHostnames, numDevices)
+	}
+	var entry data.HistoryEntry
+	testutils.Check(t, db.Where("rowid = 103").First(&entry).Error)
+	if entry.Command != "cmd 3" || entry.Hostname != "host-1" || entry.DeviceId != "device-1" {
+		t.Fatalf("unexpected entry after normalizing: %#v", entry)
+	}
+	testutils.Check(t, db.Where("command = 'no host'").First(&entry).Error)
+	if entry.Hostname != "" || entry.DeviceId != "" {
+		t.Fatalf("expected the entry without a hostname to keep having none: %#v", entry)
+	}
+
+	// Inserting into the view adds new hostnames to the lookup tables, and duplicates are still ignored
+	newEntry := data.HistoryEntry{Hostname: "host-2", Command: "new", DeviceId: "device-0", EndTime: time.Unix(20, 0)}
+	for i := 0; i < 2; i++ {
+		testutils.Check(t, db.Clauses(clause.Insert{Modifier: "OR IGNORE"}).Create(&newEntry).Error)
+	}
+	var count int64
+	testutils.Check(t, db.Model(&data.HistoryEntry{}).Where("hostname = 'host-2'").Count(&count).Error)
+	if count != 1 {
+		t.Fatalf("expected the new entry to be inserted once, got %d", count)
+	}
+	testutils.Check(t, db.Table("hostnames").Count(&numHostnames).Error)
+	testutils.Check(t, db.Table("devices").Count(&numDevices).Error)
+	if numHostnames != 3 || numDevices != 2 {
+		t.Fatalf("expected 3 hostnames and 2 devices, got %d and %d", numHostnames, numDevices)
+	}
+	testutils.Check(t, db.Model(&data.HistoryEntry{}).Count(&count).Error)
+	if count != 12 {
+		t.Fatalf("expected 12 entries, got %d", count)
+	}
+}
+
+func TestMigrateDbFromNewerVersion(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "new.db")
+	db, err := OpenSqliteDb(ClientConfig{}, dbPath, "rwc")
+	testutils.Check(t, err)
+	testutils.Check(t, db.Exec(fmt.Sprintf("PRAGMA user_version = %d", LatestDbVersion+1)).Error)
+	err = migrateDb(db, dbPath)
+	if err == nil || !strings.Contains(err.Error(), "hishtory update") {
+		t.Fatalf("expected an error telling the user to update, got %v", err)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	homedir, err := os.UserHomeDir()
+	testutils.Check(t, err)
+	// A config from before control-r search and config versions existed
+	configPath := path.Join(data.GetHishtoryConfigDir(homedir), data.CONFIG_PATH)
+	testutils.Check(t, os.WriteFile(configPath, []byte(`{"user_secret": "shhhh", "is_enabled": true}`), 0o644))
+
+	testutils.Check(t, MigrateConfig())
+	config, err := GetConfig()
+	testutils.Check(t, err)
+	if config.ConfigVersion != LatestConfigVersion || !config.ControlRSearchEnabled || config.UserSecret != "shhhh" {
+		t.Fatalf("unexpected migrated config: %#v", config)
+	}
+	if _, err := os.Stat(configPath + ".pre-migration-v0"); err != nil {
+		t.Fatalf("expected a backup to be made before migrating the config: %v", err)
+	}
+
+	// Migrating again is a no-op, even if the user has since disabled control-r search
+	config.ControlRSearchEnabled = false
+	testutils.Check(t, SetConfig(config))
+	testutils.Check(t, MigrateConfig())
+	config, err = GetConfig()
+	testutils.Check(t, err)
+	if config.ControlRSearchEnabled {
+		t.Fatalf("expected an already migrated config to be left alone")
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	defer testutils.BackupAndRestoreEnv("HISHTORY_CONFIG_displayed_columns")()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_CONFIG_FILTER_DUPLICATE_COMMANDS")()
+	defer SetConfigOverrides(nil)
+
+	config := ClientConfig{DisplayedColumns: []string{"Hostname", "Command"}, TimestampFormat: "2006", DbBusyTimeoutMs: 10}
+	os.Setenv("HISHTORY_CONFIG_displayed_columns", "Exit Code, Command")
+	os.Setenv("HISHTORY_CONFIG_FILTER_DUPLICATE_COMMANDS", "true")
+	testutils.Check(t, SetConfigOverrides([]string{"filter-duplicate-commands=false", "db_busy_timeout_ms=500", "timestamp_format=Jan 2", `retention_policy=[{"max_age":"1y"}]`}))
+	overridden, err := applyConfigOverrides(config)
+	testutils.Check(t, err)
+	if strings.Join(overridden.DisplayedColumns, "|") != "Exit Code|Command" {
+		t.Fatalf("expected the displayed columns to be overridden from the environment, got %#v", overridden.DisplayedColumns)
+	}
+	if overridden.FilterDuplicateCommands || overridden.DbBusyTimeoutMs != 500 || overridden.TimestampFormat != "Jan 2" {
+		t.Fatalf("expected --set to take precedence over the environment, got %#v", overridden)
+	}
+	if len(overridden.RetentionPolicy) != 1 || overridden.RetentionPolicy[0].MaxAge != "1y" {
+		t.Fatalf("expected JSON values to be parsed, got %#v", overridden.RetentionPolicy)
+	}
+	if config.DbBusyTimeoutMs != 10 || len(config.DisplayedColumns) != 2 {
+		t.Fatalf("expected the original config to be unchanged, got %#v", config)
+	}
+
+	for _, overrides := range [][]string{{"filter_duplicate_commands"}, {"not_a_key=1"}, {"db_busy_timeout_ms=soon"}} {
+		if err := SetConfigOverrides(overrides); err == nil {
+			t.Fatalf("expected invalid overrides %#v to be rejected", overrides)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer func() {
+		tracer.enabled = false
+	}()
+	if StartSpan("ignored")(); IsTracing() {
+		t.Fatalf("expected tracing to be disabled by default")
+	}
+
+	// Spans nest under the running span, and SQL statements are timed via gorm callbacks
+	EnableTracing()
+	testutils.Check(t, InitConfig())
+	ctx := MakeContext()
+	endSearch := StartSpan("search")
+	var count int64
+	testutils.Check(t, GetDb(ctx).Model(&data.HistoryEntry{}).Count(&count).Error)
+	testutils.Check(t, GetDb(ctx).Model(&data.HistoryEntry{}).Count(&count).Error)
+	endSearch()
+	StartSpan("render")()
+
+	var sb strings.Builder
+	testutils.Check(t, WriteTrace(&sb, "hishtory query"))
+	// Strip the durations, and the number of statements run by the DB migrations since that changes over time
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	labels := make([]string, 0)
+	for _, line := range lines[1:] {
+		labels = append(labels, strings.TrimRight(line[:strings.LastIndex(line, "  ")], " "))
+	}
+	expected := []string{"  config load", "  db open", "    sql exec", "  search", "    sql exec (x2)", "  render"}
+	if !strings.HasPrefix(lines[0], "Trace of `hishtory query` (total ") || len(labels) != len(expected) {
+		t.Fatalf("unexpected trace:\n%s", sb.String())
+	}
+	for i, label := range labels {
+		if !strings.HasPrefix(label, expected[i]) {
+			t.Fatalf("unexpected trace:\n%s", sb.String())
+		}
+	}
+}
+
+func TestSecretStorage(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	keyring.MockInit()
+	testutils.Check(t, InitConfig())
+	testutils.Check(t, UpdateConfig(func(config *ClientConfig) {
+		config.UserSecret = "my-secret"
+	}))
+
+	// Moving the secret to the keychain removes it from the config file
+	testutils.Check(t, SetSecretStorage(SecretStorageKeychain))
+	contents, err := GetConfigContents()
+	testutils.Check(t, err)
+	if strings.Contains(string(contents), "my-secret") {
+		t.Fatalf("the config file still contains the secret: %s", contents)
+	}
+	account, err := keychainAccount()
+	testutils.Check(t, err)
+	secret, err := keyring.Get(keychainService, account)
+	testutils.Check(t, err)
+	if secret != "my-secret" {
+		t.Fatalf("unexpected secret in the keychain: %#v", secret)
+	}
+
+	// But reading the config still returns it, including after other changes to the config
+	testutils.Check(t, UpdateConfig(func(config *ClientConfig) {
+		config.IsEnabled = true
+	}))
+	config, err := GetConfig()
+	testutils.Check(t, err)
+	if config.UserSecret != "my-secret" || !config.IsEnabled {
+		t.Fatalf("unexpected config: %#v", config)
+	}
+
+	// Moving the secret back to the config file removes it from the keychain
+	testutils.Check(t, SetSecretStorage(SecretStorageFile))
+	contents, err = GetConfigContents()
+	testutils.Check(t, err)
+	if !strings.Contains(string(contents), "my-secret") {
+		t.Fatalf("the config file doesn't contain the secret: %s", contents)
+	}
+	if _, err := keyring.Get(keychainService, account); !errors.Is(err, keyring.ErrNotFound) {
+		t.Fatalf("expected the secret to be deleted from the keychain, got err=%v", err)
+	}
+
+	if err := SetSecretStorage("vault"); err == nil {
+		t.Fatalf("expected an error for an unknown secret storage")
+	}
+}
+
+func TestPassphraseStorage(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, InitConfig())
+
+	// The secret can only be decrypted with the right passphrase
+	encrypted, err := encryptSecretWithPassphrase("my-secret", "hunter2")
+	testutils.Check(t, err)
+	if _, err := decryptSecretWithPassphrase(encrypted, "hunter3"); err == nil {
+		t.Fatalf("expected decrypting with the wrong passphrase to fail")
+	}
+	secret, err := decryptSecretWithPassphrase(encrypted, "hunter2")
+	testutils.Check(t, err)
+	if secret != "my-secret" {
+		t.Fatalf("unexpected decrypted secret: %#v", secret)
+	}
+
+	// Once the secret is encrypted, it isn't in the config file and the config is locked until the agent is running
+	testutils.Check(t, UpdateConfig(func(config *ClientConfig) {
+		config.UserSecret = "my-secret"
+		config.SecretStorage = SecretStoragePassphrase
+		config.PassphraseEncryptedSecret = encrypted
+	}))
+	contents, err := GetConfigContents()
+	testutils.Check(t, err)
+	if strings.Contains(string(contents), "my-secret") {
+		t.Fatalf("the config file still contains the secret: %s", contents)
+	}
+	if _, err := GetConfig(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the config to be locked, got err=%v", err)
+	}
+	locked, err := IsLocked()
+	testutils.Check(t, err)
+	if !locked {
+		t.Fatalf("expected IsLocked() to be true")
+	}
+
+	// The agent serves the secret until it is stopped
+	agentErr := make(chan error)
+	go func() {
+		agentErr <- RunAgent("my-secret", time.Minute)
+	}()
+	waitForAgent(t)
+	var agentSecret string
+	testutils.Check(t, CallAgent(context.Background(), "get_secret", nil, nil, &agentSecret))
+	if agentSecret != "my-secret" {
+		t.Fatalf("unexpected secret from the agent: %#v", agentSecret)
+	}
+	config, err := GetConfig()
+	testutils.Check(t, err)
+	if config.UserSecret != "my-secret" {
+		t.Fatalf("unexpected config: %#v", config)
+	}
+	testutils.Check(t, StopAgent())
+	testutils.Check(t, <-agentErr)
+	if _, err := GetConfig(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the config to be locked after the agent stopped, got err=%v", err)
+	}
+
+	// And it stops on its own once its lifetime is over
+	go func() {
+		agentErr <- RunAgent("my-secret", 100*time.Millisecond)
+	}()
+	select {
+	case err := <-agentErr:
+		testutils.Check(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the agent didn't stop after its lifetime")
+	}
+	locked, err = IsLocked()
+	testutils.Check(t, err)
+	if !locked {
+		t.Fatalf("expected IsLocked() to be true once the agent stopped")
+	}
+}
+
+func waitForAgent(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if CallAgent(context.Background(), "ping", nil, nil, nil) == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the agent didn't start")
+}
+
+func TestAgentHandlers(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, InitConfig())
+	RegisterAgentHandler("test_echo", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var arg string
+		if err := json.Unmarshal(args, &arg); err != nil {
+			return nil, err
+		}
+		if arg == "fail" {
+			return nil, fmt.Errorf("failed as requested")
+		}
+		return arg + " from " + GetConf(ctx).DeviceId, nil
+	})
+	RegisterAgentHandler("test_panic", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		panic("bad request")
+	})
+	handlerCancelled := make(chan struct{})
+	RegisterAgentHandler("test_wait", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		close(handlerCancelled)
+		return nil, ctx.Err()
+	})
+	// Other users can't connect to the socket, even before its own permissions are restricted
+	socketPath, err := agentSocketPath()
+	testutils.Check(t, err)
+	testutils.Check(t, os.MkdirAll(path.Dir(socketPath), 0o755))
+	agentErr := make(chan error)
+	go func() {
+		agentErr <- RunAgent("", 0)
+	}()
+	waitForAgent(t)
+	info, err := os.Stat(path.Dir(socketPath))
+	testutils.Check(t, err)
+	if info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected the agent's socket to be in a private directory, got mode %v", info.Mode())
+	}
+
+	// Requests are handled with the config of the process that sent them
+	var result string
+	testutils.Check(t, CallAgent(context.Background(), "test_echo", &ClientConfig{DeviceId: "device"}, "hello", &result))
+	if result != "hello from device" {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	if err := CallAgent(context.Background(), "test_echo", nil, "fail", &result); err == nil || err.Error() != "failed as requested" {
+		t.Fatalf("expected the handler's error, got err=%v", err)
+	}
+	if err := CallAgent(context.Background(), "unknown", nil, nil, nil); !errors.Is(err, ErrAgentUnavailable) {
+		t.Fatalf("expected an unknown kind of request to not be handled, got %v", err)
+	}
+
+	// A panicking handler doesn't stop the agent
+	if err := CallAgent(context.Background(), "test_panic", nil, nil, nil); err == nil || errors.Is(err, ErrAgentUnavailable) {
+		t.Fatalf("expected the handler's panic to be returned as an error, got %v", err)
+	}
+	testutils.Check(t, CallAgent(context.Background(), "ping", nil, nil, nil))
+
+	// Cancelling a request closes the connection, which cancels the handler's ctx in the agent
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := CallAgent(ctx, "test_wait", nil, nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out, got err=%v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the request to return once ctx was done, took %v", time.Since(start))
+	}
+	select {
+	case <-handlerCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the handler's ctx to be cancelled")
+	}
+
+	testutils.Check(t, StopAgent())
+	testutils.Check(t, <-agentErr)
+	if err := CallAgent(context.Background(), "ping", nil, nil, nil); err == nil {
+		t.Fatalf("expected the agent to be stopped")
+	}
+}
@@ -0,0 +1,265 @@
+package hctx
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"gorm.io/gorm"
+)
+
+// A dbMigration upgrades the local DB by one schema version. The DB's current version is stored in sqlite's
+// user_version pragma, so a DB from any older version of hishtory (even one that hasn't been run in years) is
+// upgraded by running every migration after its version, in order. Migrations must be idempotent since DBs from
+// before schema versioning existed are at version 0 regardless of which columns they have. Once released,
+// migrations must never be edited or removed, only appended.
+type dbMigration struct {
+	// The schema version that the DB is at after this migration runs
+	version     int
+	description string
+	migrate     func(tx *gorm.DB) error
+}
+
+var dbMigrations = []dbMigration{
+	{1, "add the custom_columns column", addColumnIfMissing("custom_columns", "blob")},
+	{2, "add the end_time index", execSql("CREATE INDEX IF NOT EXISTS end_time_index ON history_entries(end_time)")},
+	{3, "add the dev_environment column", addColumnIfMissing("dev_environment", "text")},
+	{4, "add the remote_hosts column", addColumnIfMissing("remote_hosts", "text")},
+	{5, "add the container column", addColumnIfMissing("container", "text")},
+	{6, "add the kube_context column", addColumnIfMissing("kube_context", "text")},
+	{7, "add the environment_variables column", addColumnIfMissing("environment_variables", "blob")},
+	{8, "add the hit_count column", addColumnIfMissing("hit_count", "integer")},
+	{9, "add the entry_tags table", execSql(
+		"CREATE TABLE IF NOT EXISTS `entry_tags` (`device_id` text,`end_time` datetime,`tag` text)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `entry_tag_index` ON `entry_tags`(`device_id`,`end_time`,`tag`)",
+	)},
+	{10, "add the pinned column", addColumnIfMissing("pinned", "numeric")},
+	{11, "add the snippets table", execSql("CREATE TABLE IF NOT EXISTS `snippets` (`name` text,`command` text,`updated_time` datetime,PRIMARY KEY (`name`))")},
+	{12, "add the entry_usages table", execSql(
+		"CREATE TABLE IF NOT EXISTS `entry_usages` (`device_id` text,`end_time` datetime,`command` text,`used_time` datetime)",
+		"CREATE INDEX IF NOT EXISTS `entry_usage_command_index` ON `entry_usages`(`command`)",
+	)},
+	{13, "add the resolved_command column", addColumnIfMissing("resolved_command", "text")},
+	{14, "add the as_root column", addColumnIfMissing("as_root", "numeric")},
+	{15, "add the shell_mode column", addColumnIfMissing("shell_mode", "text")},
+	{16, "add the shell nesting columns", allOf(
+		addColumnIfMissing("shell_level", "integer"),
+		addColumnIfMissing("shell_pid", "integer"),
+		addColumnIfMissing("parent_shell_pid", "integer"),
+	)},
+	{17, "add the tmux_pane column", addColumnIfMissing("tmux_pane", "text")},
+	{18, "add the correlation_id column", addColumnIfMissing("correlation_id", "text")},
+	{19, "add the channel_entries table", execSql(
+		"CREATE TABLE IF NOT EXISTS `channel_entries` (`device_id` text,`end_time` datetime,`channel` text,`received` numeric)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `channel_entry_index` ON `channel_entries`(`device_id`,`end_time`,`channel`)",
+	)},
+	{20, "add the audit_log_entries table", execSql(
+		"CREATE TABLE IF NOT EXISTS `audit_log_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`timestamp` datetime,`action` text,`details` text,`command` text)",
+		"CREATE INDEX IF NOT EXISTS `audit_log_timestamp_index` ON `audit_log_entries`(`timestamp`)",
+	)},
+	{21, "add the trashed_entries table", execSql(
+		"CREATE TABLE IF NOT EXISTS `trashed_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`deletion_time` datetime,`entry` blob)",
+		"CREATE INDEX IF NOT EXISTS `trashed_entry_deletion_time_index` ON `trashed_entries`(`deletion_time`)",
+	)},
+	// The view used to be re-created on every invocation if it had changed. Changes to it now need a new migration
+	// that calls ensureHistoryView again, so that opening the DB doesn't have to check it.
+	{22, "create the v_history view", ensureHistoryView},
+	// history_entries is a view from here on (see schema.go), so new columns have to be added to history_entry_rows
+	// and the view and its trigger re-created
+	{23, "normalize hostnames and device IDs", normalizeHistoryEntries},
+}
+
+// The versions of the migrations that free up enough space that it is worth vacuuming the DB after them (which
+// rewrites the whole DB) in order to actually shrink it
+var vacuumingDbMigrations = map[int]bool{23: true}
+
+// LatestDbVersion is the schema version of DBs created by this version of hishtory
+var LatestDbVersion = dbMigrations[len(dbMigrations)-1].version
+
+func addColumnIfMissing(column, columnType string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(&data.HistoryEntry{}, column) {
+			return nil
+		}
+		return tx.Exec(fmt.Sprintf("ALTER TABLE history_entries ADD COLUMN `%s` %s", column, columnType)).Error
+	}
+}
+
+// allOf runs each of the given migration steps in order
+func allOf(steps ...func(tx *gorm.DB) error) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func execSql(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, sql := range statements {
+			if err := tx.Exec(sql).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func getDbVersion(db *gorm.DB) (int, error) {
+	var version int
+	if err := db.Raw("PRAGMA user_version").Scan(&version).Error; err != nil {
+		return 0, fmt.Errorf("failed to get the DB schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrateDb upgrades the DB at dbPath to LatestDbVersion. Before upgrading an existing DB, it is snapshotted so that
+// a failed (or buggy) upgrade never loses history and can be undone via `hishtory rollback`. All migrations run in a single transaction,
+// so a failure leaves the DB untouched.
+func migrateDb(db *gorm.DB, dbPath string) error {
+	version, err := getDbVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > LatestDbVersion {
+		return fmt.Errorf("the hishtory DB at %s has schema version %d, but this version of hishtory only supports up to version %d, please run `hishtory update`", dbPath, version, LatestDbVersion)
+	}
+	if version == LatestDbVersion {
+		// This is the common case, so it is checked before anything else to keep opening the DB fast
+		return nil
+	}
+	isNewDb := version == 0 && !db.Migrator().HasTable(&data.HistoryEntry{})
+
+	snapshotPath := ""
+	if !isNewDb {
+		snapshotPath, err = snapshotBeforeMigration(db, dbPath, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	vacuum := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if isNewDb {
+			// New DBs start out with the original history_entries table, which the migrations then upgrade like any
+			// other DB
+			if err := tx.AutoMigrate(&data.HistoryEntry{}); err != nil {
+				return fmt.Errorf("failed to create the history_entries table: %w", err)
+			}
+		}
+		for _, m := range dbMigrations {
+			if m.version <= version {
+				continue
+			}
+			if err := m.migrate(tx); err != nil {
+				return fmt.Errorf("failed to migrate to schema version %d (%s): %w", m.version, m.description, err)
+			}
+			vacuum = vacuum || vacuumingDbMigrations[m.version]
+		}
+		return tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", LatestDbVersion)).Error
+	})
+	if err != nil {
+		if snapshotPath != "" {
+			return fmt.Errorf("failed to upgrade the hishtory DB from schema version %d to %d (the DB was left unchanged, and a snapshot from before the upgrade is at %s): %w", version, LatestDbVersion, snapshotPath, err)
+		}
+		return fmt.Errorf("failed to create the hishtory DB: %w", err)
+	}
+	if snapshotPath != "" {
+		GetLogger().Infof("Upgraded the DB from schema version %d to %d, a snapshot from before the upgrade is at %s", version, LatestDbVersion, snapshotPath)
+	}
+	if vacuum && !isNewDb {
+		// The upgrade already succeeded, so failing to shrink the DB (e.g. because another shell is reading from it)
+		// isn't worth failing the command over
+		if err := db.Exec("VACUUM").Error; err != nil {
+			GetLogger().Infof("failed to vacuum the DB after upgrading it: %v", err)
+		}
+	}
+	return nil
+}
+
+// snapshotBeforeMigration snapshots the DB before upgrading it from the given version, unless it was already
+// snapshotted by a previous attempt at the same upgrade (so a failing upgrade doesn't snapshot on every command)
+func snapshotBeforeMigration(db *gorm.DB, dbPath string, version int) (string, error) {
+	operation := fmt.Sprintf("migration-v%d", version)
+	snapshots, err := ListDbSnapshots(dbPath)
+	if err != nil {
+		return "", err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Operation == operation {
+			return snapshot.Path, nil
+		}
+	}
+	snapshot, err := SnapshotDb(db, dbPath, operation)
+	if err != nil {
+		return "", err
+	}
+	CleanUpDbSnapshots(dbPath)
+	return snapshot.Path, nil
+}
+
+// A configMigration upgrades the config by one version. Like dbMigrations, these are run in order starting from
+// the config's ConfigVersion, and must never be edited or removed once released.
+type configMigration struct {
+	// The config version that the config is at after this migration runs
+	version     int
+	description string
+	// Migrates the config in place. rawConfig is the contents of the config file before any migrations ran, for
+	// migrations that need to distinguish between a missing field and a field set to its zero value.
+	migrate func(rawConfig []byte, config *ClientConfig)
+}
+
+var configMigrations = []configMigration{
+	{1, "enable control-r search for installs from before it existed", func(rawConfig []byte, config *ClientConfig) {
+		if !strings.Contains(string(rawConfig), "enable_control_r_search") {
+			config.ControlRSearchEnabled = true
+		}
+	}},
+}
+
+// LatestConfigVersion is the version of configs created by this version of hishtory
+var LatestConfigVersion = configMigrations[len(configMigrations)-1].version
+
+// MigrateConfig upgrades the config file to LatestConfigVersion, after saving a copy of the old config next to it
+func MigrateConfig() error {
+	rawConfig, err := GetConfigContents()
+	if err != nil {
+		// No config, so this is a new install and thus there is nothing to do
+		return nil
+	}
+	var versioned struct {
+		ConfigVersion int `json:"config_version"`
+	}
+	if err := json.Unmarshal(rawConfig, &versioned); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if versioned.ConfigVersion > LatestConfigVersion {
+		return fmt.Errorf("the hishtory config has version %d, but this version of hishtory only supports up to version %d, please run `hishtory update`", versioned.ConfigVersion, LatestConfigVersion)
+	}
+	if versioned.ConfigVersion == LatestConfigVersion {
+		return nil
+	}
+
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve homedir: %w", err)
+	}
+	backupPath := fmt.Sprintf("%s/%s.pre-migration-v%d", data.GetHishtoryConfigDir(homedir), data.CONFIG_PATH, versioned.ConfigVersion)
+	if err := os.WriteFile(backupPath, rawConfig, 0o600); err != nil {
+		return fmt.Errorf("failed to back up the config to %s before upgrading it: %w", backupPath, err)
+	}
+	return UpdateConfig(func(config *ClientConfig) {
+		// Re-check the version now that we hold the lock, in case a concurrent shell already migrated the config
+		for _, m := range configMigrations {
+			if m.version > config.ConfigVersion {
+				m.migrate(rawConfig, config)
+			}
+		}
+		config.ConfigVersion = LatestConfigVersion
+	})
+}
@@ -0,0 +1,87 @@
+package hctx
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Environment variables with this prefix override a config key for a single invocation, e.g.
+// HISHTORY_CONFIG_filter_duplicate_commands=false
+const configOverrideEnvPrefix = "HISHTORY_CONFIG_"
+
+// The `key=value` overrides passed via `--set`, which take precedence over the ones from the environment
+var configOverrides []string
+
+// SetConfigOverrides validates the overrides from `--set` and from the environment, and saves the ones from `--set`
+// so that MakeContext merges them over the loaded config
+func SetConfigOverrides(overrides []string) error {
+	configOverrides = overrides
+	_, err := applyConfigOverrides(ClientConfig{})
+	return err
+}
+
+// applyConfigOverrides returns config with the overrides from the environment and then the ones from `--set`
+// applied. Overrides only apply to the current invocation and are never written to the config file.
+func applyConfigOverrides(config ClientConfig) (ClientConfig, error) {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, configOverrideEnvPrefix) {
+			continue
+		}
+		key, value, _ := strings.Cut(strings.TrimPrefix(env, configOverrideEnvPrefix), "=")
+		if err := setConfigField(&config, key, value); err != nil {
+			return ClientConfig{}, fmt.Errorf("invalid config override from $%s%s: %w", configOverrideEnvPrefix, key, err)
+		}
+	}
+	for _, override := range configOverrides {
+		key, value, found := strings.Cut(override, "=")
+		if !found {
+			return ClientConfig{}, fmt.Errorf("invalid config override %#v, expected KEY=VALUE", override)
+		}
+		if err := setConfigField(&config, key, value); err != nil {
+			return ClientConfig{}, fmt.Errorf("invalid config override %#v: %w", override, err)
+		}
+	}
+	return config, nil
+}
+
+// setConfigField sets the config field whose JSON name is key (ignoring case, and treating dashes like
+// underscores so that the names used by config-set also work). The value is parsed as JSON, except that
+// strings may be given unquoted and lists of strings may be given as comma-separated values.
+func setConfigField(config *ClientConfig, key, value string) error {
+	normalizedKey := strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name != normalizedKey {
+			continue
+		}
+		field := v.Field(i)
+		parsed := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+			switch {
+			case field.Kind() == reflect.String:
+				parsed.Elem().SetString(value)
+			case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+				parsed.Elem().Set(reflect.ValueOf(splitCommaSeparated(value)))
+			default:
+				return fmt.Errorf("failed to parse %#v as a value for %s: %w", value, name, err)
+			}
+		}
+		field.Set(parsed.Elem())
+		return nil
+	}
+	return fmt.Errorf("unknown config key %#v", key)
+}
+
+func splitCommaSeparated(value string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
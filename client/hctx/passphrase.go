@@ -0,0 +1,131 @@
+package hctx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrLocked is returned when reading the config while the user secret is encrypted with a passphrase that hasn't
+// been entered in the current login session
+var ErrLocked = errors.New("hishtory is locked, run `hishtory unlock` to enter the passphrase for your secret key")
+
+// How long the agent keeps hishtory unlocked for after the passphrase is entered. The agent is specific to the login
+// session where it is supported (on Linux), so this only matters for long-running sessions.
+const PassphraseAgentLifetime = 12 * time.Hour
+
+// The additional data that the user secret is encrypted with, so that the ciphertext can't be used elsewhere
+const passphraseAdditionalData = "hishtory-passphrase-encrypted-secret"
+
+// A PassphraseEncryptedSecret is the user secret encrypted with a key derived from a passphrase via argon2id, which
+// is how the user secret is stored in the config file when SecretStorage is SecretStoragePassphrase
+type PassphraseEncryptedSecret struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func passphraseKey(passphrase string, salt []byte) string {
+	return hex.EncodeToString(argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32))
+}
+
+func encryptSecretWithPassphrase(secret, passphrase string) (*PassphraseEncryptedSecret, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate a salt: %w", err)
+	}
+	ciphertext, nonce, err := data.Encrypt(passphraseKey(passphrase, salt), []byte(secret), []byte(passphraseAdditionalData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt the secret key: %w", err)
+	}
+	return &PassphraseEncryptedSecret{Salt: salt, Nonce: nonce, Ciphertext: ciphertext}, nil
+}
+
+func decryptSecretWithPassphrase(encrypted *PassphraseEncryptedSecret, passphrase string) (string, error) {
+	secret, err := data.Decrypt(passphraseKey(passphrase, encrypted.Salt), encrypted.Ciphertext, []byte(passphraseAdditionalData), encrypted.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("incorrect passphrase")
+	}
+	return string(secret), nil
+}
+
+// readPassphraseEncryptedSecret returns the encrypted user secret from the config file, without decrypting it
+func readPassphraseEncryptedSecret() (*PassphraseEncryptedSecret, error) {
+	contents, err := GetConfigContents()
+	if err != nil {
+		return nil, err
+	}
+	var config ClientConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if config.SecretStorage != SecretStoragePassphrase || config.PassphraseEncryptedSecret == nil {
+		return nil, nil
+	}
+	return config.PassphraseEncryptedSecret, nil
+}
+
+// IsLocked returns whether the user secret is encrypted with a passphrase that hasn't been entered in the current
+// login session
+func IsLocked() (bool, error) {
+	encrypted, err := readPassphraseEncryptedSecret()
+	if err != nil || encrypted == nil {
+		return false, err
+	}
+	_, err = getAgentSecret()
+	return err != nil, nil
+}
+
+// Unlock decrypts the user secret with passphrase, and starts an agent that caches it for the rest of the login
+// session
+func Unlock(passphrase string) error {
+	encrypted, err := readPassphraseEncryptedSecret()
+	if err != nil {
+		return err
+	}
+	if encrypted == nil {
+		return fmt.Errorf("your secret key isn't encrypted with a passphrase, see `hishtory config-set secret-storage passphrase`")
+	}
+	secret, err := decryptSecretWithPassphrase(encrypted, passphrase)
+	if err != nil {
+		return err
+	}
+	return StartAgent(secret, PassphraseAgentLifetime)
+}
+
+// EnablePassphraseStorage encrypts the user secret with passphrase, so that the secret isn't stored in plaintext and
+// the passphrase has to be entered (once per login session) to use hishtory. If the secret is already encrypted with
+// a passphrase, this changes the passphrase.
+func EnablePassphraseStorage(passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("the passphrase can't be empty")
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	if config.UserSecret == "" {
+		return fmt.Errorf("hishtory isn't initialized, run `hishtory init` first")
+	}
+	encrypted, err := encryptSecretWithPassphrase(config.UserSecret, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := StartAgent(config.UserSecret, PassphraseAgentLifetime); err != nil {
+		return err
+	}
+	if err := UpdateConfig(func(c *ClientConfig) {
+		c.SecretStorage = SecretStoragePassphrase
+		c.PassphraseEncryptedSecret = encrypted
+	}); err != nil {
+		return err
+	}
+	return cleanUpSecretStorage(config.SecretStorage, SecretStoragePassphrase)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package hctx
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachProcess runs cmd in a new session, so that it keeps running after the terminal that started it is closed
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,209 @@
+package hctx
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"gorm.io/gorm"
+)
+
+// History entries are stored in the history_entry_rows table, which refers to the hostname and device ID of each
+// entry by its ID in the hostnames and devices tables rather than repeating them in every row (and in the unique
+// index). history_entries is a view over history_entry_rows with the same columns as the table that it replaced, so
+// entries are read from it as before. Inserting into the view inserts into the underlying tables via a trigger, but
+// updates and deletes have to go to history_entry_rows directly since sqlite doesn't count the rows changed by a
+// trigger (so e.g. gorm's RowsAffected would always be 0).
+
+// The table that history entries are stored in, see above
+const HistoryEntryRowsTable = "history_entry_rows"
+
+// A column of history_entries whose distinct values are stored in a lookup table, so that each value is only stored
+// once
+type lookupColumn struct {
+	// The name of the column in both history_entries and the lookup table
+	column string
+	table  string
+	// The column of history_entry_rows with the ID of the value in the lookup table
+	refColumn string
+}
+
+var lookupColumns = []lookupColumn{
+	{column: "hostname", table: "hostnames", refColumn: "hostname_ref"},
+	{column: "device_id", table: "devices", refColumn: "device_ref"},
+}
+
+// The columns of history_entry_rows, in the same order as the columns of the history_entries table that it replaced
+var historyEntryRowColumns = []struct{ name, sqlType string }{
+	{"local_username", "text"},
+	{"hostname_ref", "integer"},
+	{"command", "text"},
+	{"current_working_directory", "text"},
+	{"home_directory", "text"},
+	{"exit_code", "integer"},
+	{"start_time", "datetime"},
+	{"end_time", "datetime"},
+	{"device_ref", "integer"},
+	{"custom_columns", "blob"},
+	{"dev_environment", "text"},
+	{"remote_hosts", "text"},
+	{"container", "text"},
+	{"kube_context", "text"},
+	{"environment_variables", "blob"},
+	{"hit_count", "integer"},
+	{"pinned", "numeric"},
+	{"resolved_command", "text"},
+	{"as_root", "numeric"},
+	{"shell_mode", "text"},
+	{"shell_level", "integer"},
+	{"shell_pid", "integer"},
+	{"parent_shell_pid", "integer"},
+	{"tmux_pane", "text"},
+	{"correlation_id", "text"},
+}
+
+func getLookupColumn(refColumn string) (lookupColumn, bool) {
+	for _, l := range lookupColumns {
+		if l.refColumn == refColumn {
+			return l, true
+		}
+	}
+	return lookupColumn{}, false
+}
+
+// historyEntryRowValues returns the values of history_entry_rows' columns for an entry from source, which has the
+// columns of history_entries (e.g. NEW in a trigger on the view)
+func historyEntryRowValues(source string) string {
+	values := make([]string, 0, len(historyEntryRowColumns))
+	for _, c := range historyEntryRowColumns {
+		if l, ok := getLookupColumn(c.name); ok {
+			values = append(values, fmt.Sprintf("(SELECT id FROM `%s` WHERE `%s` = %s.`%s`)", l.table, l.column, source, l.column))
+		} else {
+			values = append(values, fmt.Sprintf("%s.`%s`", source, c.name))
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+func historyEntryRowColumnNames() string {
+	names := make([]string, 0, len(historyEntryRowColumns))
+	for _, c := range historyEntryRowColumns {
+		names = append(names, "`"+c.name+"`")
+	}
+	return strings.Join(names, ",")
+}
+
+func createHistoryEntryRowsSql() string {
+	columns := make([]string, 0, len(historyEntryRowColumns))
+	for _, c := range historyEntryRowColumns {
+		columns = append(columns, fmt.Sprintf("`%s` %s", c.name, c.sqlType))
+	}
+	return fmt.Sprintf("CREATE TABLE `%s` (%s)", HistoryEntryRowsTable, strings.Join(columns, ","))
+}
+
+// historyEntriesViewSql returns the SQL for the history_entries view. The hostname and device ID are looked up via
+// subqueries rather than joins, since sqlite only evaluates subqueries for the columns that are used, which keeps
+// e.g. counting entries as fast as it was before. The rowid and the refs are included so that rows can be updated and
+// deleted, and so that queries can filter on the refs rather than the looked up values.
+func historyEntriesViewSql() string {
+	columns := make([]string, 0, len(historyEntryRowColumns)+3)
+	for _, c := range historyEntryRowColumns {
+		if l, ok := getLookupColumn(c.name); ok {
+			columns = append(columns, fmt.Sprintf("(SELECT `%s` FROM `%s` WHERE `%s`.id = `%s`.`%s`) AS `%s`", l.column, l.table, l.table, HistoryEntryRowsTable, l.refColumn, l.column))
+		} else {
+			columns = append(columns, "`"+c.name+"`")
+		}
+	}
+	columns = append(columns, "`"+HistoryEntryRowsTable+"`.rowid AS rowid")
+	for _, l := range lookupColumns {
+		columns = append(columns, "`"+l.refColumn+"`")
+	}
+	return fmt.Sprintf("CREATE VIEW history_entries AS SELECT %s FROM `%s`", strings.Join(columns, ","), HistoryEntryRowsTable)
+}
+
+// historyEntriesInsertTriggerSql returns the SQL for the trigger that inserts entries that are inserted into the
+// history_entries view. New hostnames and device IDs are added to their lookup tables via NOT EXISTS rather than
+// INSERT OR IGNORE, since the conflict resolution of the statement that inserted into the view (e.g. INSERT OR
+// REPLACE) overrides the one in the trigger.
+func historyEntriesInsertTriggerSql() string {
+	statements := make([]string, 0, len(lookupColumns)+1)
+	for _, l := range lookupColumns {
+		statements = append(statements, fmt.Sprintf("INSERT INTO `%s` (`%s`) SELECT NEW.`%s` WHERE NEW.`%s` IS NOT NULL AND NOT EXISTS (SELECT 1 FROM `%s` WHERE `%s` = NEW.`%s`);",
+			l.table, l.column, l.column, l.column, l.table, l.column, l.column))
+	}
+	statements = append(statements, fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s);", HistoryEntryRowsTable, historyEntryRowColumnNames(), historyEntryRowValues("NEW")))
+	return fmt.Sprintf("CREATE TRIGGER history_entries_insert INSTEAD OF INSERT ON history_entries BEGIN %s END", strings.Join(statements, " "))
+}
+
+// The table that archived entries are queried from while the cold DB is attached (as the "cold" schema). The cold DB
+// stores entries in a plain history_entries table, without the lookup tables. It is aliased to history_entries so
+// that search queries (whose subqueries refer to history_entries) work unchanged against it.
+const ColdHistoryTable = "cold.history_entries AS history_entries"
+
+// IsColdTier returns whether tx queries the entries in the cold DB (i.e. ColdHistoryTable) rather than the
+// history_entries view in the main DB
+func IsColdTier(tx *gorm.DB) bool {
+	return tx.Statement.TableExpr != nil && tx.Statement.TableExpr.SQL == ColdHistoryTable
+}
+
+// historyEntryRows returns a query for the rows of history_entry_rows that store the entries matched by tx, which is
+// a query on the history_entries view in the main DB
+func historyEntryRows(tx *gorm.DB) *gorm.DB {
+	rowids := tx.Model(&data.HistoryEntry{}).Select("rowid")
+	return tx.Session(&gorm.Session{NewDB: true}).Table(HistoryEntryRowsTable).Where("rowid IN (?)", rowids)
+}
+
+// DeleteHistoryEntries deletes the entries matched by tx, from the cold DB if tx queries it (see IsColdTier) and from
+// history_entry_rows otherwise
+func DeleteHistoryEntries(tx *gorm.DB) *gorm.DB {
+	if IsColdTier(tx) {
+		return tx.Delete(&data.HistoryEntry{})
+	}
+	return historyEntryRows(tx).Delete(&data.HistoryEntry{})
+}
+
+// UpdateHistoryEntries sets the given columns of the entries matched by tx, in the same way as DeleteHistoryEntries.
+// The hostname and device ID can't be updated this way, since they are stored in lookup tables in the main DB.
+func UpdateHistoryEntries(tx *gorm.DB, values map[string]interface{}) *gorm.DB {
+	if IsColdTier(tx) {
+		return tx.Updates(values)
+	}
+	return historyEntryRows(tx).Updates(values)
+}
+
+// HostnameCondition returns cond, a condition on the hostname column, as a condition on the entries in the cold DB or
+// the main DB. Each hostname is only stored once in the main DB, so it is much faster to check the condition against
+// the hostnames table and then filter entries by the IDs of the matching hostnames than to check every entry's
+// hostname.
+func HostnameCondition(coldTier bool, cond string) string {
+	if coldTier {
+		return cond
+	}
+	return "hostname_ref IN (SELECT id FROM hostnames WHERE " + cond + ")"
+}
+
+// normalizeHistoryEntries moves all history entries from the history_entries table into history_entry_rows, and
+// replaces the table with the history_entries view. The rowids of entries are kept, since they are used to track
+// which entries have been merged from the DBs of other hosts (see data.SharedHomeMerge). It runs as a DB migration,
+// see dbMigrations.
+func normalizeHistoryEntries(tx *gorm.DB) error {
+	if tx.Migrator().HasTable(HistoryEntryRowsTable) {
+		return nil
+	}
+	statements := []string{createHistoryEntryRowsSql()}
+	for _, l := range lookupColumns {
+		statements = append(statements,
+			fmt.Sprintf("CREATE TABLE `%s` (`id` integer PRIMARY KEY,`%s` text NOT NULL UNIQUE)", l.table, l.column),
+			fmt.Sprintf("INSERT INTO `%s` (`%s`) SELECT DISTINCT `%s` FROM history_entries WHERE `%s` IS NOT NULL", l.table, l.column, l.column, l.column),
+		)
+	}
+	statements = append(statements,
+		fmt.Sprintf("INSERT INTO `%s` (rowid,%s) SELECT rowid,%s FROM history_entries", HistoryEntryRowsTable, historyEntryRowColumnNames(), historyEntryRowValues("history_entries")),
+		"DROP TABLE history_entries",
+		fmt.Sprintf("CREATE UNIQUE INDEX `compositeindex` ON `%s`(`local_username`,`hostname_ref`,`command`,`current_working_directory`,`home_directory`,`exit_code`,`start_time`,`end_time`,`device_ref`)", HistoryEntryRowsTable),
+		fmt.Sprintf("CREATE INDEX `end_time_index` ON `%s`(`end_time`)", HistoryEntryRowsTable),
+		historyEntriesViewSql(),
+		historyEntriesInsertTriggerSql(),
+	)
+	return execSql(statements...)(tx)
+}
@@ -0,0 +1,187 @@
+package hctx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/zalando/go-keyring"
+)
+
+// The values of ClientConfig.SecretStorage, which is where the user secret is stored
+const (
+	// The user secret is stored in plaintext in the config file. This is the default.
+	SecretStorageFile = "file"
+	// The user secret is stored in the OS keychain (the macOS Keychain, the Secret Service via libsecret on Linux, or
+	// the Windows Credential Manager), and is left out of the config file. On machines without a keychain (e.g.
+	// headless servers), it falls back to being stored in the config file.
+	SecretStorageKeychain = "keychain"
+	// The user secret is encrypted with a passphrase (see PassphraseEncryptedSecret), for shared machines where a
+	// keychain can't be used. The passphrase is entered once per login session via `hishtory unlock`, and the secret
+	// is then cached by the agent (see RunAgent).
+	SecretStoragePassphrase = "passphrase"
+)
+
+// The service that the user secret is stored under in the OS keychain
+const keychainService = "hishtory"
+
+// The user secret that was last read from or written to the keychain by this process, since keychain lookups can be
+// slow (and may prompt the user) and the config is read many times per command
+var keychainCache struct {
+	sync.Mutex
+	loaded bool
+	secret string
+}
+
+// keychainAccount returns the account that the user secret is stored under in the OS keychain. It is the path of the
+// hishtory dir, so that multiple installs (e.g. via $HISHTORY_PATH) don't share a secret.
+func keychainAccount() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve homedir: %w", err)
+	}
+	return data.GetHishtoryConfigDir(homedir), nil
+}
+
+func getKeychainSecret() (string, error) {
+	keychainCache.Lock()
+	defer keychainCache.Unlock()
+	if keychainCache.loaded {
+		return keychainCache.secret, nil
+	}
+	account, err := keychainAccount()
+	if err != nil {
+		return "", err
+	}
+	secret, err := keyring.Get(keychainService, account)
+	if err != nil {
+		return "", err
+	}
+	keychainCache.loaded = true
+	keychainCache.secret = secret
+	return secret, nil
+}
+
+func setKeychainSecret(secret string) error {
+	keychainCache.Lock()
+	defer keychainCache.Unlock()
+	if keychainCache.loaded && keychainCache.secret == secret {
+		return nil
+	}
+	account, err := keychainAccount()
+	if err != nil {
+		return err
+	}
+	if err := keyring.Set(keychainService, account, secret); err != nil {
+		return err
+	}
+	keychainCache.loaded = true
+	keychainCache.secret = secret
+	return nil
+}
+
+// DeleteKeychainSecret removes the user secret from the OS keychain, if it is stored there
+func DeleteKeychainSecret() error {
+	keychainCache.Lock()
+	defer keychainCache.Unlock()
+	keychainCache.loaded = false
+	keychainCache.secret = ""
+	account, err := keychainAccount()
+	if err != nil {
+		return err
+	}
+	err = keyring.Delete(keychainService, account)
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("failed to delete the secret key from the OS keychain: %w", err)
+	}
+	return nil
+}
+
+// loadUserSecret fills in the user secret of a config that was read from disk, if it is stored outside of the config
+// file. A secret in the config file always takes precedence, since that is where it is stored when the keychain is
+// unavailable.
+func loadUserSecret(config *ClientConfig) error {
+	if config.UserSecret != "" {
+		return nil
+	}
+	if config.SecretStorage == SecretStoragePassphrase {
+		secret, err := getAgentSecret()
+		if err != nil {
+			return err
+		}
+		config.UserSecret = secret
+		return nil
+	}
+	if config.SecretStorage != SecretStorageKeychain {
+		return nil
+	}
+	if secret, err := getAgentSecret(); err == nil {
+		// The agent already read the secret from the keychain, which is faster than reading it again
+		config.UserSecret = secret
+		return nil
+	}
+	secret, err := getKeychainSecret()
+	if err != nil {
+		return fmt.Errorf("failed to read your secret key from the OS keychain (if it is no longer available, run `hishtory secret recover` or `hishtory init SECRET_KEY` to store the secret key in the config file instead): %w", err)
+	}
+	config.UserSecret = secret
+	return nil
+}
+
+// storeUserSecret stores the user secret of a config that is about to be written to disk, and returns the user secret
+// that should be written to the config file
+func storeUserSecret(config ClientConfig) string {
+	if config.SecretStorage == SecretStoragePassphrase && config.PassphraseEncryptedSecret != nil {
+		// The encrypted copy of the secret is the only one that is stored
+		return ""
+	}
+	if config.SecretStorage != SecretStorageKeychain || config.UserSecret == "" {
+		return config.UserSecret
+	}
+	if err := setKeychainSecret(config.UserSecret); err != nil {
+		GetLogger().Warnf("failed to store the secret key in the OS keychain, storing it in the config file instead: %v", err)
+		return config.UserSecret
+	}
+	return ""
+}
+
+// SetSecretStorage changes where the user secret is stored to SecretStorageFile or SecretStorageKeychain (see
+// EnablePassphraseStorage for SecretStoragePassphrase). Switching to the keychain fails if the keychain isn't
+// available, in which case the secret stays where it was.
+func SetSecretStorage(storage string) error {
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	switch storage {
+	case SecretStorageFile:
+	case SecretStorageKeychain:
+		if err := setKeychainSecret(config.UserSecret); err != nil {
+			return fmt.Errorf("the OS keychain isn't available, so your secret key wasn't moved: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown secret storage %#v, must be one of: %s, %s, %s", storage, SecretStorageFile, SecretStorageKeychain, SecretStoragePassphrase)
+	}
+	if err := UpdateConfig(func(config *ClientConfig) {
+		config.SecretStorage = storage
+		config.PassphraseEncryptedSecret = nil
+	}); err != nil {
+		return err
+	}
+	return cleanUpSecretStorage(config.SecretStorage, storage)
+}
+
+// cleanUpSecretStorage removes the user secret from where it was previously stored, after it was moved elsewhere
+func cleanUpSecretStorage(previous, current string) error {
+	if previous == SecretStorageKeychain && current != SecretStorageKeychain {
+		if err := DeleteKeychainSecret(); err != nil {
+			return err
+		}
+	}
+	if previous == SecretStoragePassphrase && current != SecretStoragePassphrase {
+		return StopAgent()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package hctx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Snapshots of the DB taken before risky operations are deleted once they are older than this, or once there
+// are more than maxDbSnapshots newer ones
+const (
+	dbSnapshotRetention = 7 * 24 * time.Hour
+	maxDbSnapshots      = 10
+)
+
+// DbSnapshot is a copy of the DB taken before a risky operation (e.g. a bulk delete, a migration, or an import)
+// so that the operation can be rolled back via `hishtory rollback`
+type DbSnapshot struct {
+	// The ID of the snapshot, e.g. "1697452300123-prune"
+	Id        string
+	Path      string
+	Operation string
+	Time      time.Time
+	SizeBytes int64
+}
+
+// getDbSnapshotsDir returns the directory that snapshots of the DB at dbPath are stored in. This is specific to
+// each DB since hosts that share a home directory each have their own DB.
+func getDbSnapshotsDir(dbPath string) string {
+	return dbPath + ".snapshots"
+}
+
+// SnapshotDb saves a copy of the DB at dbPath before running the given operation. VACUUM INTO includes anything
+// that is still in the WAL and gives a consistent copy even if other shells are writing to the DB. Callers should
+// then call CleanUpDbSnapshots to delete expired snapshots.
+func SnapshotDb(db *gorm.DB, dbPath, operation string) (*DbSnapshot, error) {
+	dir := getDbSnapshotsDir(dbPath)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the snapshots directory: %w", err)
+	}
+	now := time.Now()
+	id := fmt.Sprintf("%d-%s", now.UnixMilli(), operation)
+	snapshotPath := filepath.Join(dir, id+".db")
+	if err := db.Exec("VACUUM INTO ?", snapshotPath).Error; err != nil {
+		return nil, fmt.Errorf("failed to snapshot the DB before the %s: %w", operation, err)
+	}
+	if err := os.Chmod(snapshotPath, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to set the permissions of the snapshot: %w", err)
+	}
+	return &DbSnapshot{Id: id, Path: snapshotPath, Operation: operation, Time: now}, nil
+}
+
+// ListDbSnapshots returns the snapshots of the DB at dbPath, newest first
+func ListDbSnapshots(dbPath string) ([]DbSnapshot, error) {
+	dir := getDbSnapshotsDir(dbPath)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DB snapshots: %w", err)
+	}
+	snapshots := make([]DbSnapshot, 0)
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".db")
+		timestamp, operation, ok := strings.Cut(id, "-")
+		millis, err := strconv.ParseInt(timestamp, 10, 64)
+		if f.IsDir() || id == f.Name() || !ok || err != nil {
+			// Not a snapshot (e.g. a leftover file from a snapshot that failed part way through)
+			continue
+		}
+		snapshot := DbSnapshot{Id: id, Path: filepath.Join(dir, f.Name()), Operation: operation, Time: time.UnixMilli(millis)}
+		if info, err := f.Info(); err == nil {
+			snapshot.SizeBytes = info.Size()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// CleanUpDbSnapshots deletes the snapshots of the DB at dbPath that have expired. Failures are only logged, since
+// they shouldn't block the operation that was snapshotted.
+func CleanUpDbSnapshots(dbPath string) {
+	snapshots, err := ListDbSnapshots(dbPath)
+	if err != nil {
+		GetLogger().Warnf("failed to clean up old DB snapshots: %v", err)
+		return
+	}
+	for i, snapshot := range snapshots {
+		if i < maxDbSnapshots && time.Since(snapshot.Time) < dbSnapshotRetention {
+			continue
+		}
+		if err := os.Remove(snapshot.Path); err != nil && !os.IsNotExist(err) {
+			GetLogger().Warnf("failed to delete the expired DB snapshot %s: %v", snapshot.Path, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package hctx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A traceSpan is a timed step of a command, shown by `--trace`. Spans with the same name and parent (e.g. every SQL
+// statement run while loading the config) are merged into a single span, so that the trace stays readable.
+type traceSpan struct {
+	name     string
+	count    int
+	duration time.Duration
+	parent   *traceSpan
+	children []*traceSpan
+}
+
+// The trace of the current process, since each hishtory command runs in its own process
+var tracer struct {
+	sync.Mutex
+	enabled bool
+	start   time.Time
+	root    *traceSpan
+	current *traceSpan
+}
+
+// EnableTracing starts recording the spans of the current command, see StartSpan
+func EnableTracing() {
+	tracer.Lock()
+	defer tracer.Unlock()
+	tracer.enabled = true
+	tracer.start = time.Now()
+	tracer.root = &traceSpan{}
+	tracer.current = tracer.root
+}
+
+// IsTracing returns whether the spans of the current command are being recorded
+func IsTracing() bool {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.enabled
+}
+
+// StartSpan starts timing a step of the current command, nested under the span that is currently running, and
+// returns a function that ends it. It is a no-op unless tracing is enabled, so it is cheap enough to call anywhere:
+//
+//	defer hctx.StartSpan("query build")()
+func StartSpan(name string) func() {
+	tracer.Lock()
+	defer tracer.Unlock()
+	if !tracer.enabled {
+		return func() {}
+	}
+	parent := tracer.current
+	var span *traceSpan
+	for _, child := range parent.children {
+		if child.name == name {
+			span = child
+		}
+	}
+	if span == nil {
+		span = &traceSpan{name: name, parent: parent}
+		parent.children = append(parent.children, span)
+	}
+	span.count++
+	tracer.current = span
+	start := time.Now()
+	return func() {
+		tracer.Lock()
+		defer tracer.Unlock()
+		span.duration += time.Since(start)
+		if tracer.current == span {
+			tracer.current = parent
+		}
+	}
+}
+
+// WriteTrace writes the hierarchical timing breakdown of the spans recorded since tracing was enabled
+func WriteTrace(w io.Writer, command string) error {
+	tracer.Lock()
+	defer tracer.Unlock()
+	if !tracer.enabled {
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Trace of `%s` (total %s):\n", command, formatTraceDuration(time.Since(tracer.start)))
+	width := traceNameWidth(tracer.root, 0)
+	for _, child := range tracer.root.children {
+		writeTraceSpan(&sb, child, 1, width)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func traceSpanLabel(span *traceSpan, depth int) string {
+	label := strings.Repeat("  ", depth) + span.name
+	if span.count > 1 {
+		label += fmt.Sprintf(" (x%d)", span.count)
+	}
+	return label
+}
+
+func traceNameWidth(span *traceSpan, depth int) int {
+	width := 0
+	for _, child := range span.children {
+		if w := len(traceSpanLabel(child, depth+1)); w > width {
+			width = w
+		}
+		if w := traceNameWidth(child, depth+1); w > width {
+			width = w
+		}
+	}
+	return width
+}
+
+func writeTraceSpan(sb *strings.Builder, span *traceSpan, depth, width int) {
+	fmt.Fprintf(sb, "%-*s  %10s\n", width, traceSpanLabel(span, depth), formatTraceDuration(span.duration))
+	for _, child := range span.children {
+		writeTraceSpan(sb, child, depth+1, width)
+	}
+}
+
+func formatTraceDuration(d time.Duration) string {
+	return d.Round(10 * time.Microsecond).String()
+}
+
+// The key that the function ending a SQL statement's span is stored under in the gorm statement
+const traceEndKey = "hishtory:trace_end"
+
+// registerTraceCallbacks times every SQL statement run on db as a "sql exec" span
+func registerTraceCallbacks(db *gorm.DB) error {
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(traceEndKey, StartSpan("sql exec"))
+	}
+	end := func(tx *gorm.DB) {
+		if endSpan, ok := tx.InstanceGet(traceEndKey); ok {
+			endSpan.(func())()
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("hishtory:trace_start_create", start),
+		cb.Create().After("gorm:create").Register("hishtory:trace_end_create", end),
+		cb.Query().Before("gorm:query").Register("hishtory:trace_start_query", start),
+		cb.Query().After("gorm:query").Register("hishtory:trace_end_query", end),
+		cb.Update().Before("gorm:update").Register("hishtory:trace_start_update", start),
+		cb.Update().After("gorm:update").Register("hishtory:trace_end_update", end),
+		cb.Delete().Before("gorm:delete").Register("hishtory:trace_start_delete", start),
+		cb.Delete().After("gorm:delete").Register("hishtory:trace_end_delete", end),
+		cb.Row().Before("gorm:row").Register("hishtory:trace_start_row", start),
+		cb.Row().After("gorm:row").Register("hishtory:trace_end_row", end),
+		cb.Raw().Before("gorm:raw").Register("hishtory:trace_start_raw", start),
+		cb.Raw().After("gorm:raw").Register("hishtory:trace_end_raw", end),
+	} {
+		if err != nil {
+			return fmt.Errorf("failed to register tracing callbacks: %w", err)
+		}
+	}
+	return nil
+}
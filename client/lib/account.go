@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+)
+
+// DeleteRemoteAccount deletes everything that the backend stores for this user, from all of their devices. Since the
+// user secret is what identifies the account, this must be done before the local config is deleted.
+func DeleteRemoteAccount(config hctx.ClientConfig) (*shared.AccountDeletion, error) {
+	resp, err := ApiPost("/api/v1/delete-account?user_id="+data.UserId(config.UserSecret), "application/json", []byte{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete the account from the server: %w", err)
+	}
+	var deletion shared.AccountDeletion
+	if err := json.Unmarshal(resp, &deletion); err != nil {
+		return nil, fmt.Errorf("failed to parse the account deletion response: %w", err)
+	}
+	return &deletion, nil
+}
@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+type agentSearchArgs struct {
+	Query  string       `json:"query"`
+	Cursor searchCursor `json:"cursor"`
+	Limit  int          `json:"limit"`
+}
+
+func init() {
+	// Older agents only supported searching for the first page of results via "search", so this has a new kind in
+	// order for them to fail rather than return the first page again
+	hctx.RegisterAgentHandler("search_page", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var searchArgs agentSearchArgs
+		if err := json.Unmarshal(args, &searchArgs); err != nil {
+			return nil, err
+		}
+		return dbResultsProvider{}.search(ctx, searchArgs.Query, searchArgs.Cursor, searchArgs.Limit)
+	})
+	hctx.RegisterAgentHandler("count", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var query string
+		if err := json.Unmarshal(args, &query); err != nil {
+			return nil, err
+		}
+		return dbResultsProvider{}.count(ctx, query)
+	})
+	hctx.RegisterAgentHandler("save_entries", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var entries []*data.HistoryEntry
+		if err := json.Unmarshal(args, &entries); err != nil {
+			return nil, err
+		}
+		return nil, queueAgentWrite(agentWrite{ctx: ctx, entries: entries, done: make(chan error, 1)})
+	})
+	hctx.RegisterAgentStopHook(stopAgentWriter)
+	hctx.RegisterAgentHandler("sync", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		if err := RetrieveAdditionalEntriesFromRemote(ctx); err != nil {
+			return nil, err
+		}
+		return nil, ProcessDeletionRequests(ctx)
+	})
+}
+
+// agentResultsProvider searches the shell history via the hishtory agent (see hctx.RunAgent), which already has the
+// DB open. If the agent stops, it falls back to searching the local DB directly. Cancelling ctx cancels the search in
+// the agent too.
+type agentResultsProvider struct{}
+
+func (p agentResultsProvider) search(ctx context.Context, query string, cursor searchCursor, limit int) ([]*data.HistoryEntry, error) {
+	config := hctx.GetConf(ctx)
+	var entries []*data.HistoryEntry
+	if err := hctx.CallAgent(ctx, "search_page", &config, agentSearchArgs{Query: query, Cursor: cursor, Limit: limit}, &entries); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		hctx.GetLogger().Infof("failed to search via the hishtory agent, falling back to the local DB: %v", err)
+		return dbResultsProvider{}.search(ctx, query, cursor, limit)
+	}
+	return entries, nil
+}
+
+func (p agentResultsProvider) count(ctx context.Context, query string) (int64, error) {
+	config := hctx.GetConf(ctx)
+	var count int64
+	if err := hctx.CallAgent(ctx, "count", &config, query, &count); err != nil {
+		if ctx.Err() != nil {
+			return 0, err
+		}
+		hctx.GetLogger().Infof("failed to count via the hishtory agent, falling back to the local DB: %v", err)
+		return dbResultsProvider{}.count(ctx, query)
+	}
+	return count, nil
+}
+
+// syncViaAgent retrieves new entries and deletion requests from the backend via the hishtory agent, falling back to
+// doing so directly if the agent stops
+func syncViaAgent(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	err := hctx.CallAgent(ctx, "sync", &config, nil, nil)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	hctx.GetLogger().Infof("failed to sync via the hishtory agent, falling back to syncing directly: %v", err)
+	if err := RetrieveAdditionalEntriesFromRemote(ctx); err != nil {
+		return err
+	}
+	return ProcessDeletionRequests(ctx)
+}
+
+// MakeQueryContext returns the context for searching the shell history. If the hishtory agent is running, searches
+// are sent to it and the DB is only opened if it is needed for something else (e.g. deleting an entry), which makes
+// opening the TUI nearly instant. Otherwise, this is the same as hctx.MakeContext.
+func MakeQueryContext() context.Context {
+	if !hctx.IsAgentRunning() {
+		return hctx.MakeContext()
+	}
+	ctx, err := hctx.MakeLazyContext()
+	if err != nil {
+		hctx.GetLogger().Infof("failed to make a context for the hishtory agent: %v", err)
+		return hctx.MakeContext()
+	}
+	return withResultsProvider(ctx, agentResultsProvider{})
+}
+
+// A write that a shell sent to the agent via SaveHistoryEntries
+type agentWrite struct {
+	ctx     context.Context
+	entries []*data.HistoryEntry
+	done    chan error
+}
+
+// The writes sent to the agent, which are all made by runAgentWriter so that concurrent shells don't contend for the
+// DB's write lock. agentWrites is nil while the writer isn't running, and agentWriterLock guards both.
+var (
+	agentWriterLock sync.Mutex
+	agentWrites     chan agentWrite
+	agentWriterDone chan struct{}
+)
+
+// queueAgentWrite sends write to the agent's writer (starting it if needed) and waits for it to be made
+func queueAgentWrite(write agentWrite) error {
+	agentWriterLock.Lock()
+	// The handler's ctx is cancelled once the agent starts stopping, after which nothing else may be written
+	if write.ctx.Err() != nil {
+		agentWriterLock.Unlock()
+		return fmt.Errorf("%w: %v", hctx.ErrAgentUnavailable, write.ctx.Err())
+	}
+	if agentWrites == nil {
+		agentWrites = make(chan agentWrite)
+		agentWriterDone = make(chan struct{})
+		go runAgentWriter(agentWrites, agentWriterDone)
+	}
+	select {
+	case agentWrites <- write:
+	case <-write.ctx.Done():
+		agentWriterLock.Unlock()
+		return fmt.Errorf("%w: %v", hctx.ErrAgentUnavailable, write.ctx.Err())
+	}
+	agentWriterLock.Unlock()
+	return <-write.done
+}
+
+func runAgentWriter(writes chan agentWrite, done chan struct{}) {
+	defer close(done)
+	for write := range writes {
+		write.done <- saveHistoryEntriesSafely(write.ctx, write.entries)
+	}
+}
+
+// saveHistoryEntriesSafely is saveHistoryEntriesLocally, except that a panic is returned as an error so that it doesn't
+// stop the agent
+func saveHistoryEntriesSafely(ctx context.Context, entries []*data.HistoryEntry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to save history entries: %v", r)
+		}
+	}()
+	return saveHistoryEntriesLocally(ctx, entries)
+}
+
+// stopAgentWriter waits for the writes that were already queued to be made, and then stops the agent's writer
+func stopAgentWriter() {
+	agentWriterLock.Lock()
+	defer agentWriterLock.Unlock()
+	if agentWrites == nil {
+		return
+	}
+	close(agentWrites)
+	<-agentWriterDone
+	agentWrites = nil
+}
+
+// SaveHistoryEntries saves entries to the local DB. If the agent is running, the entries are sent to it to be written
+// by its single writer goroutine. They're only written directly if the agent didn't handle the request at all, since
+// otherwise some of them may already have been written.
+func SaveHistoryEntries(ctx context.Context, entries []*data.HistoryEntry) error {
+	config := hctx.GetConf(ctx)
+	err := hctx.CallAgent(ctx, "save_entries", &config, entries, nil)
+	if !errors.Is(err, hctx.ErrAgentUnavailable) {
+		return err
+	}
+	hctx.GetLogger().Infof("failed to save history entries via the hishtory agent, saving them directly: %v", err)
+	return saveHistoryEntriesLocally(ctx, entries)
+}
+
+func saveHistoryEntriesLocally(ctx context.Context, entries []*data.HistoryEntry) error {
+	for _, entry := range entries {
+		if err := SaveHistoryEntryLocally(ctx, *entry); err != nil {
+			return fmt.Errorf("failed to save history entry %#v: %w", entry.Command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The shell hooks set this to the output of `alias` (captured when the hook is loaded) if
+// ClientConfig.RecordResolvedAliases is enabled
+const aliasesEnvVar = "HISHTORY_ALIASES"
+
+// Aliases can expand to commands that start with another alias, but bash and zsh stop expanding once an alias
+// would expand to itself. This also bounds the expansion for alias tables that we failed to parse sensibly.
+const maxAliasExpansions = 16
+
+// getResolvedCommand returns command with its leading alias expanded, or "" if it doesn't start with an alias
+func getResolvedCommand(ctx context.Context, command string) string {
+	if !hctx.GetConf(ctx).RecordResolvedAliases {
+		return ""
+	}
+	return resolveAliases(command, parseAliases(os.Getenv(aliasesEnvVar)))
+}
+
+// parseAliases parses the output of running `alias` in bash (`alias gs='git status'`) or zsh (`gs='git status'`)
+// into a map from each alias to its value
+func parseAliases(output string) map[string]string {
+	aliases := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "alias ")
+		name, value, found := strings.Cut(line, "=")
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			continue
+		}
+		aliases[name] = unquoteShellWord(value)
+	}
+	return aliases
+}
+
+// unquoteShellWord removes the quoting from a single shell word, e.g. `'echo "hi"'` becomes `echo "hi"`
+func unquoteShellWord(s string) string {
+	var sb strings.Builder
+	inSingleQuotes := false
+	inDoubleQuotes := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inSingleQuotes:
+			if c == '\'' {
+				inSingleQuotes = false
+			} else {
+				sb.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(s) && (!inDoubleQuotes || strings.IndexByte("\"\\$`", s[i+1]) >= 0):
+			i++
+			sb.WriteByte(s[i])
+		case c == '"':
+			inDoubleQuotes = !inDoubleQuotes
+		case c == '\'' && !inDoubleQuotes:
+			inSingleQuotes = true
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// resolveAliases expands the alias at the start of command (e.g. `gs -s` becomes `git status -s` if gs is an alias
+// for `git status`), including aliases that expand to other aliases. It returns "" if command doesn't start with an
+// alias.
+func resolveAliases(command string, aliases map[string]string) string {
+	resolved := command
+	expanded := make(map[string]bool)
+	for i := 0; i < maxAliasExpansions; i++ {
+		trimmed := strings.TrimLeft(resolved, " \t")
+		end := strings.IndexAny(trimmed, " \t\n;|&")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		name := trimmed[:end]
+		value, ok := aliases[name]
+		if !ok || expanded[name] {
+			break
+		}
+		expanded[name] = true
+		resolved = value + trimmed[end:]
+	}
+	if resolved == command {
+		return ""
+	}
+	return resolved
+}
@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// A QueryAtom is a `field:value` filter that is supported in queries. QueryAtoms is the registry of every atom that
+// parseAtomizedToken supports (besides custom columns), and is used to document them and to suggest atoms for typos.
+type QueryAtom struct {
+	Name    string
+	Aliases []string
+	// What the value is, e.g. `true|false`
+	Value       string
+	Description string
+	// Example queries using the atom, which are checked against the parser in tests
+	Examples []string
+}
+
+var QueryAtoms = []QueryAtom{
+	{Name: "user", Value: "USERNAME", Description: "Commands run by the given user", Examples: []string{"curl user:david"}},
+	{Name: "hostname", Aliases: []string{"host"}, Value: "TEXT", Description: "Commands run on a machine whose hostname contains the value", Examples: []string{"curl host:x1", "hostname:laptop"}},
+	{Name: "cwd", Value: "PATH", Description: "Commands run in a directory whose path contains the value (~/ matches the home directory)", Examples: []string{"curl cwd:/tmp/", "cwd:~/code/hishtory"}},
+	{Name: "exit_code", Value: "N", Description: "Commands that exited with the given status code", Examples: []string{"exit_code:1", "make -exit_code:0"}},
+	{Name: "before", Value: "TIME", Description: "Commands started before the given time, which can be a date, a timestamp, or an age like 2w", Examples: []string{"before:2022-02-01", "before:2022-02-01_15:04"}},
+	{Name: "after", Value: "TIME", Description: "Commands started after the given time, which can be a date, a timestamp, or an age like 2w", Examples: []string{"after:2022-02-01", "after:7d"}},
+	{Name: "dev_env", Value: "TEXT", Description: "Commands run while a direnv/mise environment containing the value was active", Examples: []string{"dev_env:node@20"}},
+	{Name: "remote", Value: "true|false|HOST", Description: "Commands run over SSH, or over SSH from the given host", Examples: []string{"remote:true", "remote:10.0.0.5"}},
+	{Name: "container", Value: "true|false|NAME", Description: "Commands run in a container, or in the container with the given name", Examples: []string{"container:true", "container:devbox"}},
+	{Name: "tmux", Value: "true|false|SESSION:WINDOW.PANE", Description: "Commands run in tmux, or in the given tmux session, window, or pane", Examples: []string{"tmux:true", "tmux:main:1.0"}},
+	{Name: "kubecontext", Value: "true|false|CONTEXT", Description: "Commands run while kubectl was using a context, or the given context", Examples: []string{"kubecontext:prod"}},
+	{Name: "env", Value: "NAME[=VALUE]", Description: "Commands run with the recorded environment variable set (see `hishtory config-add env-snapshot-variables`)", Examples: []string{"env:AWS_PROFILE", "env:AWS_PROFILE=prod"}},
+	{Name: "tag", Value: "TAG", Description: "Commands with the given tag (see `hishtory tag`)", Examples: []string{"tag:golden"}},
+	{Name: "channel", Value: "NAME", Description: "Commands published to the given team channel, including teammates' commands (see `hishtory channel`)", Examples: []string{"channel:ops"}},
+	{Name: "pinned", Value: "true|false", Description: "Commands that were pinned in the TUI", Examples: []string{"pinned:true"}},
+	{Name: "root", Value: "true|false", Description: "Commands run as root", Examples: []string{"root:true"}},
+	{Name: "interactive", Value: "true|false", Description: "Commands run in an interactive shell", Examples: []string{"interactive:true"}},
+	{Name: "login", Value: "true|false", Description: "Commands run in a login shell", Examples: []string{"login:true"}},
+	{Name: "script", Value: "true|false", Description: "Commands run by a script rather than typed at a prompt", Examples: []string{"script:false"}},
+	{Name: "shlvl", Value: "N", Description: "Commands run in a shell with the given $SHLVL", Examples: []string{"shlvl:2"}},
+	{Name: "nested", Value: "true|false", Description: "Commands run in a shell that was started from another shell (e.g. by `nix develop`)", Examples: []string{"nested:true"}},
+	{Name: "correlation_id", Value: "ID", Description: "The command that a tool logged $HISHTORY_CORRELATION_ID from", Examples: []string{"correlation_id:1234-5678-1697452300-42"}},
+	{Name: "defaults", Value: "true|false", Description: "Whether the default filters apply to an interactive search (see `hishtory config-add default-filters`)", Examples: []string{"defaults:false"}},
+}
+
+// A QueryError is a problem with a query found by CheckQuery
+type QueryError struct {
+	// The position (in runes) and length of the part of the query that has the problem
+	Position int
+	Length   int
+	Message  string
+	// A suggested fix, if there is one
+	Suggestion string
+}
+
+// CheckQuery parses a query without running it, and returns the problems with it
+func CheckQuery(ctx context.Context, query string) ([]QueryError, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	atomNames, err := getAllAtomNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var problems []QueryError
+	position := 0
+	for _, token := range tokens {
+		start := position
+		position += len([]rune(token)) + 1
+		atom := strings.TrimPrefix(token, "-")
+		if atom == "" || !containsUnescaped(atom, ":") {
+			continue
+		}
+		start += len([]rune(token)) - len([]rune(atom))
+		rawField := splitEscaped(atom, ':', 2)[0]
+		field := unescape(rawField)
+		if !containsString(atomNames, field) {
+			problem := QueryError{Position: start, Length: len([]rune(rawField)), Message: fmt.Sprintf("unknown atom %#v", field)}
+			if suggestion := suggestAtom(atomNames, field); suggestion != "" {
+				problem.Suggestion = fmt.Sprintf("did you mean %#v?", suggestion)
+			} else {
+				problem.Suggestion = "run `hishtory atoms` to list the supported atoms, or escape the colon with a backslash to search for it"
+			}
+			if rawField == "" {
+				problem.Length = 1
+			}
+			problems = append(problems, problem)
+			continue
+		}
+		if _, _, _, err := parseAtomizedToken(ctx, atom, false); err != nil {
+			valueStart := start + len([]rune(rawField)) + 1
+			problems = append(problems, QueryError{Position: valueStart, Length: len([]rune(atom)) - len([]rune(rawField)) - 1, Message: err.Error()})
+		}
+	}
+	return problems, nil
+}
+
+// FormatQueryErrors renders the problems found by CheckQuery, with carets pointing at where they are in the query
+func FormatQueryErrors(query string, problems []QueryError) string {
+	var sb strings.Builder
+	for i, problem := range problems {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "Error at position %d: %s\n", problem.Position+1, problem.Message)
+		fmt.Fprintf(&sb, "  %s\n", query)
+		length := problem.Length
+		if length < 1 {
+			length = 1
+		}
+		fmt.Fprintf(&sb, "  %s%s\n", strings.Repeat(" ", problem.Position), strings.Repeat("^", length))
+		if problem.Suggestion != "" {
+			fmt.Fprintf(&sb, "Hint: %s\n", problem.Suggestion)
+		}
+	}
+	return sb.String()
+}
+
+// getAllAtomNames returns the names of the atoms from the registry, their aliases, and the names of custom columns
+func getAllAtomNames(ctx context.Context) ([]string, error) {
+	var names []string
+	for _, atom := range QueryAtoms {
+		names = append(names, atom.Name)
+		names = append(names, atom.Aliases...)
+	}
+	customColumns, err := getKnownCustomColumnNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(names, customColumns...), nil
+}
+
+// getKnownCustomColumnNames returns the names of the custom columns that are configured on this device or that are
+// in the DB, which can all be used as atoms
+func getKnownCustomColumnNames(ctx context.Context) ([]string, error) {
+	var names []string
+	for _, c := range hctx.GetConf(ctx).CustomColumns {
+		names = append(names, c.ColumnName)
+	}
+	dbNames, err := getAllCustomColumnNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get custom column names from the DB: %v", err)
+	}
+	for _, name := range dbNames {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// suggestAtom returns the atom name closest to a misspelled one, or an empty string if none are close
+func suggestAtom(names []string, field string) string {
+	best, bestDistance := "", 0
+	for _, name := range names {
+		distance := editDistance(strings.ToLower(field), strings.ToLower(name))
+		if best == "" || distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	// Only suggest names that are a small edit away, relative to the length of the name
+	maxDistance := len([]rune(field)) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	if best == "" || bestDistance > maxDistance {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, min(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteAtomsDocumentation writes the documentation for every atom, either as plain text or as a Markdown table
+func WriteAtomsDocumentation(ctx context.Context, w io.Writer, markdown bool) error {
+	customColumns, err := getKnownCustomColumnNames(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(customColumns)
+	if markdown {
+		fmt.Fprintln(w, "| Atom | Description | Examples |")
+		fmt.Fprintln(w, "| --- | --- | --- |")
+		for _, atom := range QueryAtoms {
+			name := "`" + atom.Name + ":" + atom.Value + "`"
+			for _, alias := range atom.Aliases {
+				name += " (or `" + alias + ":`)"
+			}
+			examples := make([]string, 0, len(atom.Examples))
+			for _, example := range atom.Examples {
+				examples = append(examples, "`hishtory query "+example+"`")
+			}
+			fmt.Fprintf(w, "| %s | %s | %s |\n", name, strings.ReplaceAll(atom.Description, "|", "\\|"), strings.Join(examples, "<br>"))
+		}
+		for _, name := range customColumns {
+			fmt.Fprintf(w, "| `%s:TEXT` | Commands whose custom column %s contains the value | `hishtory query %s:foo` |\n", name, name, name)
+		}
+		return nil
+	}
+	for i, atom := range QueryAtoms {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s:%s", atom.Name, atom.Value)
+		if len(atom.Aliases) > 0 {
+			fmt.Fprintf(w, " (alias: %s)", strings.Join(atom.Aliases, ", "))
+		}
+		fmt.Fprintf(w, "\n    %s\n", atom.Description)
+		for _, example := range atom.Examples {
+			fmt.Fprintf(w, "    Example: hishtory query %s\n", example)
+		}
+	}
+	for _, name := range customColumns {
+		fmt.Fprintf(w, "\n%s:TEXT\n    Commands whose custom column %s contains the value\n    Example: hishtory query %s:foo\n", name, name, name)
+	}
+	fmt.Fprintln(w, "\nAny atom can be negated with a leading - (e.g. -exit_code:0), and a colon can be escaped with a backslash (e.g. foo\\:bar) to search for it.")
+	return nil
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// The kinds of actions recorded in the audit log
+const (
+	AuditActionRedact       = "redact"
+	AuditActionDelete       = "delete"
+	AuditActionUndelete     = "undelete"
+	AuditActionEdit         = "edit"
+	AuditActionRemoteDelete = "remote-delete"
+	AuditActionPrune        = "prune"
+	AuditActionRollback     = "rollback"
+	AuditActionInit         = "init"
+	AuditActionEncryption   = "encryption"
+	AuditActionConfig       = "config"
+)
+
+// The audit log table, which is never restored from snapshots since it should record rollbacks too
+const auditLogTable = "audit_log_entries"
+
+// The hishtory command that is currently running, which actions in the audit log are attributed to
+var auditCommand = "hishtory"
+
+// SetAuditCommand sets the command that actions recorded in the audit log are attributed to, e.g. `hishtory redact`
+func SetAuditCommand(command string) {
+	auditCommand = command
+}
+
+// RecordAuditEvent appends an action to the local audit log. Details should describe what was done and how many
+// entries were affected, but never include commands or queries, since those may be secrets that were just redacted.
+func RecordAuditEvent(ctx context.Context, action, details string) error {
+	return recordAuditEvent(hctx.GetDb(ctx), action, details)
+}
+
+func recordAuditEvent(db *gorm.DB, action, details string) error {
+	entry := data.AuditLogEntry{Timestamp: time.Now(), Action: action, Details: details, Command: auditCommand}
+	err := RetryDbWrite(func() error {
+		return db.Create(&entry).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %#v in the audit log: %w", action, err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the most recent actions in the audit log, newest first. If action isn't empty, only actions of
+// that kind are returned.
+func GetAuditLog(ctx context.Context, action string, limit int) ([]*data.AuditLogEntry, error) {
+	tx := hctx.GetDb(ctx).Order("id DESC")
+	if action != "" {
+		tx = tx.Where("action = ?", action)
+	}
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	var entries []*data.AuditLogEntry
+	if err := tx.Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to query the audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// RecordConfigChanges records which config keys changed in the audit log, given the contents of the config file
+// before a config command ran. Only the names of the keys are recorded, since their values may be secrets.
+func RecordConfigChanges(ctx context.Context, previousConfig []byte) error {
+	currentConfig, err := hctx.GetConfigContents()
+	if err != nil {
+		return err
+	}
+	changedKeys, err := diffConfigKeys(previousConfig, currentConfig)
+	if err != nil {
+		return err
+	}
+	if len(changedKeys) == 0 {
+		return nil
+	}
+	return RecordAuditEvent(ctx, AuditActionConfig, "changed "+strings.Join(changedKeys, ", "))
+}
+
+// diffConfigKeys returns the sorted top-level keys whose values differ between the two serialized configs
+func diffConfigKeys(before, after []byte) ([]string, error) {
+	var beforeFields, afterFields map[string]json.RawMessage
+	if err := json.Unmarshal(before, &beforeFields); err != nil {
+		return nil, fmt.Errorf("failed to parse the previous config: %w", err)
+	}
+	if err := json.Unmarshal(after, &afterFields); err != nil {
+		return nil, fmt.Errorf("failed to parse the config: %w", err)
+	}
+	changedKeys := make([]string, 0)
+	for key, val := range afterFields {
+		if !bytes.Equal(val, beforeFields[key]) {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	for key := range beforeFields {
+		if _, ok := afterFields[key]; !ok {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	sort.Strings(changedKeys)
+	return changedKeys, nil
+}
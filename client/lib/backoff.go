@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// When the server rate limits a request, the time until which requests shouldn't be retried is stored in this
+// file so that it applies to every hishtory process (e.g. the one run for each command), rather than each of them
+// retrying immediately
+const rateLimitBackoffPath = ".rate_limit_backoff"
+
+// The backoff used if the server doesn't say how long to wait, and the longest backoff that is respected
+const (
+	defaultRateLimitBackoff = time.Minute
+	maxRateLimitBackoff     = time.Hour
+)
+
+func getRateLimitBackoffPath() string {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(data.GetHishtoryDir(homedir), rateLimitBackoffPath)
+}
+
+// getRateLimitBackoff returns how much longer requests to the server should be held off for, or 0 if they can be
+// sent now
+func getRateLimitBackoff() time.Duration {
+	path := getRateLimitBackoffPath()
+	if path == "" {
+		return 0
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	until, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	backoff := time.Until(time.Unix(until, 0))
+	if backoff <= 0 || backoff > maxRateLimitBackoff {
+		return 0
+	}
+	return backoff
+}
+
+// recordRateLimit holds off requests to the server for as long as the Retry-After header of a 429 response asks
+func recordRateLimit(resp *http.Response) {
+	backoff := defaultRateLimitBackoff
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		backoff = time.Duration(seconds) * time.Second
+	}
+	if backoff > maxRateLimitBackoff {
+		backoff = maxRateLimitBackoff
+	}
+	path := getRateLimitBackoffPath()
+	if path == "" {
+		return
+	}
+	until := time.Now().Add(backoff).Unix()
+	if err := os.WriteFile(path, []byte(strconv.FormatInt(until, 10)), 0o600); err != nil {
+		hctx.GetLogger().Warnf("failed to record that the server rate limited requests: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The header at the start of every backup file, followed by the nonce and then the encrypted archive
+const backupMagic = "HISHTORY-BACKUP-V1\n"
+
+// The additional data used when encrypting backups, so that other ciphertexts can't be passed off as backups
+const backupAdditionalData = "hishtory-backup"
+
+const (
+	backupManifestFile = "manifest.json"
+	backupConfigFile   = "config.json"
+	backupDbFile       = "hishtory.db"
+	backupEntriesFile  = "entries.json"
+)
+
+type BackupManifest struct {
+	Version     string    `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	Incremental bool      `json:"incremental"`
+	// For incremental backups, the backup only contains entries that ended after this time
+	Since      time.Time `json:"since"`
+	NumEntries int64     `json:"num_entries"`
+}
+
+// CreateBackup writes an encrypted archive containing the config and history entries to out. A full backup
+// contains a snapshot of the entire DB, while an incremental backup only contains the entries created since
+// the last backup.
+func CreateBackup(out io.Writer, config hctx.ClientConfig, incremental bool) (*BackupManifest, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	db, err := hctx.OpenLocalSqliteDb(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.Close()
+		}
+	}()
+	manifest := BackupManifest{Version: "v0." + Version, CreatedAt: time.Now(), Incremental: incremental}
+	if incremental {
+		if config.LastBackupTimestamp == 0 {
+			return nil, fmt.Errorf("can't create an incremental backup since there is no previous backup, create a full backup first")
+		}
+		manifest.Since = time.Unix(config.LastBackupTimestamp, 0)
+	}
+
+	files := make(map[string][]byte)
+	if incremental {
+		var entries []*data.HistoryEntry
+		if err := db.Where("end_time > ?", manifest.Since).Order("end_time").Find(&entries).Error; err != nil {
+			return nil, fmt.Errorf("failed to query for new history entries: %w", err)
+		}
+		manifest.NumEntries = int64(len(entries))
+		files[backupEntriesFile], err = json.Marshal(entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize history entries: %w", err)
+		}
+	} else {
+		if err := db.Model(&data.HistoryEntry{}).Count(&manifest.NumEntries).Error; err != nil {
+			return nil, fmt.Errorf("failed to count history entries: %w", err)
+		}
+		// VACUUM INTO gives us a consistent snapshot even if other commands are writing to the DB
+		snapshotPath := path.Join(data.GetHishtoryDir(homedir), fmt.Sprintf("backup-snapshot-%d.db", time.Now().UnixNano()))
+		defer os.Remove(snapshotPath)
+		if err := db.Exec("VACUUM INTO ?", snapshotPath).Error; err != nil {
+			return nil, fmt.Errorf("failed to snapshot the DB: %w", err)
+		}
+		files[backupDbFile], err = os.ReadFile(snapshotPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DB snapshot: %w", err)
+		}
+	}
+	files[backupConfigFile], err = hctx.GetConfigContents()
+	if err != nil {
+		return nil, err
+	}
+	files[backupManifestFile], err = json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize backup manifest: %w", err)
+	}
+
+	var archive bytes.Buffer
+	gw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{backupManifestFile, backupConfigFile, backupDbFile, backupEntriesFile} {
+		contents, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(contents)), ModTime: manifest.CreatedAt}); err != nil {
+			return nil, fmt.Errorf("failed to write backup archive: %w", err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			return nil, fmt.Errorf("failed to write backup archive: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup archive: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress backup archive: %w", err)
+	}
+
+	ciphertext, nonce, err := data.Encrypt(config.UserSecret, archive.Bytes(), []byte(backupAdditionalData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+	for _, chunk := range [][]byte{[]byte(backupMagic), nonce, ciphertext} {
+		if _, err := out.Write(chunk); err != nil {
+			return nil, fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+	return &manifest, nil
+}
+
+// readBackup decrypts and unpacks a backup created by CreateBackup
+func readBackup(in io.Reader, userSecret string) (*BackupManifest, map[string][]byte, error) {
+	contents, err := io.ReadAll(in)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if !bytes.HasPrefix(contents, []byte(backupMagic)) || len(contents) < len(backupMagic)+12 {
+		return nil, nil, fmt.Errorf("not a hishtory backup file")
+	}
+	contents = contents[len(backupMagic):]
+	archive, err := data.Decrypt(userSecret, contents[12:], []byte(backupAdditionalData), contents[:12])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt backup, was it created with a different secret key? %w", err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress backup: %w", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read backup archive: %w", err)
+		}
+		files[hdr.Name], err = io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s from backup archive: %w", hdr.Name, err)
+		}
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(files[backupManifestFile], &manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	return &manifest, files, nil
+}
+
+// RestoreBackup restores a backup created by CreateBackup. Restoring a full backup replaces the local DB and
+// config (though the current device ID is kept so that syncing continues to work), while restoring an
+// incremental backup adds its entries to the local DB. A full backup can't be restored while another process has
+// the local DB open (see hctx.ReplaceLocalDb). currentConfig is the current config, which is empty if hishtory isn't
+// set up yet.
+func RestoreBackup(in io.Reader, currentConfig hctx.ClientConfig, userSecret string) (*BackupManifest, error) {
+	manifest, files, err := readBackup(in, userSecret)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Incremental {
+		var entries []data.HistoryEntry
+		if err := json.Unmarshal(files[backupEntriesFile], &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse history entries from backup: %w", err)
+		}
+		db, err := hctx.OpenLocalSqliteDb(currentConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if sqlDb, err := db.DB(); err == nil {
+				sqlDb.Close()
+			}
+		}()
+		for _, entry := range entries {
+			AddToDbIfNew(db, entry)
+		}
+		return manifest, nil
+	}
+
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	if err := hctx.MakeHishtoryDir(); err != nil {
+		return nil, fmt.Errorf("failed to make hishtory dir: %w", err)
+	}
+	var restoredConfig hctx.ClientConfig
+	if err := json.Unmarshal(files[backupConfigFile], &restoredConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config from backup: %w", err)
+	}
+	if currentConfig.DeviceId != "" {
+		restoredConfig.DeviceId = currentConfig.DeviceId
+	}
+	if restoredConfig.UserSecret == "" {
+		// The secret key was stored in the OS keychain rather than the backed up config file, and it is the key that
+		// the backup was encrypted with
+		restoredConfig.UserSecret = userSecret
+	}
+
+	// Write the DB to a temporary file and check that it is valid before replacing the current DB
+	dbPath := data.GetDbPath(homedir)
+	tmpDbPath := filepath.Join(filepath.Dir(dbPath), fmt.Sprintf("restore-%d.db", time.Now().UnixNano()))
+	defer os.Remove(tmpDbPath)
+	if err := os.WriteFile(tmpDbPath, files[backupDbFile], 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write restored DB: %w", err)
+	}
+	tmpDb, err := hctx.OpenSqliteDb(restoredConfig, tmpDbPath, "ro")
+	if err != nil {
+		return nil, fmt.Errorf("the DB in the backup is invalid: %w", err)
+	}
+	problems, err := checkDbIntegrity(tmpDb)
+	if sqlDb, err := tmpDb.DB(); err == nil {
+		sqlDb.Close()
+	}
+	if err != nil || len(problems) > 0 {
+		return nil, fmt.Errorf("the DB in the backup is corrupted (err=%v): %v", err, problems)
+	}
+	if err := hctx.ReplaceLocalDb(restoredConfig, tmpDbPath); err != nil {
+		return nil, err
+	}
+	if err := hctx.SetConfig(restoredConfig); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// canonicalEntry is the normalized form of a history entry used by `hishtory export --canonical`. Fields are in
+// alphabetical order, times are in UTC, and lists are sorted, so that the same entry is serialized identically on
+// every device regardless of the local timezone or the order that it was synced in.
+type canonicalEntry struct {
+	AsRoot                  bool                       `json:"as_root"`
+	Command                 string                     `json:"command"`
+	Container               string                     `json:"container"`
+	CorrelationId           string                     `json:"correlation_id"`
+	CurrentWorkingDirectory string                     `json:"current_working_directory"`
+	CustomColumns           []data.CustomColumn        `json:"custom_columns"`
+	DevEnvironment          string                     `json:"dev_environment"`
+	DeviceId                string                     `json:"device_id"`
+	EndTime                 string                     `json:"end_time"`
+	EnvironmentVariables    []data.EnvironmentVariable `json:"environment_variables"`
+	ExitCode                int                        `json:"exit_code"`
+	HitCount                int                        `json:"hit_count"`
+	HomeDirectory           string                     `json:"home_directory"`
+	Hostname                string                     `json:"hostname"`
+	KubeContext             string                     `json:"kube_context"`
+	LocalUsername           string                     `json:"local_username"`
+	ParentShellPid          int                        `json:"parent_shell_pid"`
+	RemoteHosts             string                     `json:"remote_hosts"`
+	ResolvedCommand         string                     `json:"resolved_command"`
+	ShellLevel              int                        `json:"shell_level"`
+	ShellMode               string                     `json:"shell_mode"`
+	ShellPid                int                        `json:"shell_pid"`
+	StartTime               string                     `json:"start_time"`
+	TmuxPane                string                     `json:"tmux_pane"`
+}
+
+// CanonicalExportLine is a single line of `hishtory export --canonical`. The hash only covers the entry itself and
+// not its metadata (pins and tags), so that an entry whose metadata differs between two devices is sorted into the
+// same position in both exports and shows up as a single changed line when they are diffed.
+type CanonicalExportLine struct {
+	Hash string `json:"hash"`
+	canonicalEntry
+	Pinned bool     `json:"pinned"`
+	Tags   []string `json:"tags"`
+}
+
+func makeCanonicalEntry(entry *data.HistoryEntry) canonicalEntry {
+	customColumns := append([]data.CustomColumn{}, entry.CustomColumns...)
+	sort.SliceStable(customColumns, func(i, j int) bool {
+		return customColumns[i].Name < customColumns[j].Name
+	})
+	environmentVariables := append([]data.EnvironmentVariable{}, entry.EnvironmentVariables...)
+	sort.SliceStable(environmentVariables, func(i, j int) bool {
+		return environmentVariables[i].Name < environmentVariables[j].Name
+	})
+	return canonicalEntry{
+		AsRoot:                  entry.AsRoot,
+		Command:                 entry.Command,
+		Container:               entry.Container,
+		CorrelationId:           entry.CorrelationId,
+		CurrentWorkingDirectory: entry.CurrentWorkingDirectory,
+		CustomColumns:           customColumns,
+		DevEnvironment:          entry.DevEnvironment,
+		DeviceId:                entry.DeviceId,
+		EndTime:                 entry.EndTime.UTC().Format(time.RFC3339Nano),
+		EnvironmentVariables:    environmentVariables,
+		ExitCode:                entry.ExitCode,
+		// Entries that were never collapsed have a hit count of 0, which is equivalent to 1
+		HitCount:        max(entry.HitCount, 1),
+		HomeDirectory:   entry.HomeDirectory,
+		Hostname:        entry.Hostname,
+		KubeContext:     entry.KubeContext,
+		LocalUsername:   entry.LocalUsername,
+		ParentShellPid:  entry.ParentShellPid,
+		RemoteHosts:     entry.RemoteHosts,
+		ResolvedCommand: entry.ResolvedCommand,
+		ShellLevel:      entry.ShellLevel,
+		ShellMode:       entry.ShellMode,
+		ShellPid:        entry.ShellPid,
+		StartTime:       entry.StartTime.UTC().Format(time.RFC3339Nano),
+		TmuxPane:        entry.TmuxPane,
+	}
+}
+
+// CanonicalExport writes the entries matching query to w as JSON lines in a canonical form (see canonicalEntry),
+// sorted by the hash of each entry, so that the exports of two devices can be diffed to find sync discrepancies
+func CanonicalExport(ctx context.Context, query string, w io.Writer) error {
+	entries, err := Search(ctx, hctx.GetDb(ctx), query, 0)
+	if err != nil {
+		return err
+	}
+	var entryTags []*data.EntryTag
+	if err := hctx.GetDb(ctx).Find(&entryTags).Error; err != nil {
+		return fmt.Errorf("failed to query for tags: %w", err)
+	}
+	tagsByEntry := make(map[string][]string)
+	for _, tag := range entryTags {
+		key := entryKey(&data.HistoryEntry{DeviceId: tag.DeviceId, EndTime: tag.EndTime})
+		tagsByEntry[key] = append(tagsByEntry[key], tag.Tag)
+	}
+
+	lines := make([]CanonicalExportLine, 0, len(entries))
+	for _, entry := range entries {
+		canonical := makeCanonicalEntry(entry)
+		serialized, err := json.Marshal(canonical)
+		if err != nil {
+			return fmt.Errorf("failed to serialize entry: %w", err)
+		}
+		hash := sha256.Sum256(serialized)
+		tags := append([]string{}, tagsByEntry[entryKey(entry)]...)
+		sort.Strings(tags)
+		lines = append(lines, CanonicalExportLine{Hash: hex.EncodeToString(hash[:]), canonicalEntry: canonical, Pinned: entry.Pinned, Tags: tags})
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Hash < lines[j].Hash
+	})
+	for _, line := range lines {
+		serialized, err := json.Marshal(line)
+		if err != nil {
+			return fmt.Errorf("failed to serialize entry: %w", err)
+		}
+		if _, err := fmt.Fprintln(w, string(serialized)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
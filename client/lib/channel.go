@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How often channels are automatically synced after commands are saved
+const channelSyncInterval = 5 * time.Minute
+
+// The maximum number of entries that the server returns per request for a channel's entries
+const channelEntriesPageSize = 1000
+
+// excludesReceivedChannelEntries returns whether a search with the given tokens should exclude the entries that were
+// received from teammates' channels. They're only included in searches that filter on a channel (e.g. `channel:ops`),
+// so that the user's own history isn't cluttered with their teammates' commands.
+func excludesReceivedChannelEntries(ctx context.Context, tokens []string) bool {
+	if ctx == nil || len(hctx.GetConf(ctx).Channels) == 0 {
+		return false
+	}
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "channel:") {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidateChannelName(name string) error {
+	if name == "" {
+		return fmt.Errorf("channel names can't be empty")
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' }) >= 0 {
+		return fmt.Errorf("channel name %#v contains whitespace, which isn't supported", name)
+	}
+	return nil
+}
+
+func findChannel(channels []hctx.ChannelConfig, name string) *hctx.ChannelConfig {
+	for i := range channels {
+		if channels[i].Name == name {
+			return &channels[i]
+		}
+	}
+	return nil
+}
+
+func checkPublishQuery(ctx context.Context, query string) error {
+	if query == "" {
+		return nil
+	}
+	if hctx.GetConf(ctx).ReadOnlyDevice {
+		return fmt.Errorf("read-only devices can't publish commands to channels, since that requires uploading them")
+	}
+	if _, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query); err != nil {
+		return fmt.Errorf("invalid query %#v: %w", query, err)
+	}
+	return nil
+}
+
+// CreateChannel creates a new team channel with a random team key, which teammates can join with JoinChannel.
+// Commands matching publishQuery (if it isn't empty) that are run from now on are published to the channel.
+func CreateChannel(ctx context.Context, name, publishQuery string) (string, error) {
+	teamKey := make([]byte, 32)
+	if _, err := rand.Read(teamKey); err != nil {
+		return "", fmt.Errorf("failed to generate a team key: %w", err)
+	}
+	encodedKey := base64.URLEncoding.EncodeToString(teamKey)
+	if _, err := JoinChannel(ctx, name, encodedKey, publishQuery); err != nil {
+		return "", err
+	}
+	return encodedKey, nil
+}
+
+// JoinChannel joins the team channel with the given team key, and returns the number of entries that were received
+// from it
+func JoinChannel(ctx context.Context, name, teamKey, publishQuery string) (int, error) {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return 0, fmt.Errorf("channels require syncing, which is disabled for offline installs")
+	}
+	if err := ValidateChannelName(name); err != nil {
+		return 0, err
+	}
+	if findChannel(config.Channels, name) != nil {
+		return 0, fmt.Errorf("there is already a channel named %#v", name)
+	}
+	if err := checkPublishQuery(ctx, publishQuery); err != nil {
+		return 0, err
+	}
+	// Only commands run after joining are published, so that joining a channel never publishes old history
+	channel := hctx.ChannelConfig{Name: name, TeamKey: strings.TrimSpace(teamKey), PublishQuery: publishQuery, LastPublishedNanos: time.Now().UnixNano()}
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.Channels = append(config.Channels, channel)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return receiveChannelEntries(hctx.MakeContext(), channel)
+}
+
+// SetChannelPublishQuery changes which commands are published to the channel. An empty query stops publishing.
+func SetChannelPublishQuery(ctx context.Context, name, publishQuery string) error {
+	if findChannel(hctx.GetConf(ctx).Channels, name) == nil {
+		return fmt.Errorf("there is no channel named %#v", name)
+	}
+	if err := checkPublishQuery(ctx, publishQuery); err != nil {
+		return err
+	}
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if c := findChannel(config.Channels, name); c != nil {
+			if c.PublishQuery == "" {
+				// Like when joining, only commands run from now on are published
+				c.LastPublishedNanos = time.Now().UnixNano()
+			}
+			c.PublishQuery = publishQuery
+		}
+	})
+}
+
+// LeaveChannel stops syncing the channel, and deletes the entries received from it. Commands that this user published
+// to the channel stay in the channel.
+func LeaveChannel(ctx context.Context, name string) (int64, error) {
+	if findChannel(hctx.GetConf(ctx).Channels, name) == nil {
+		return 0, fmt.Errorf("there is no channel named %#v", name)
+	}
+	var numDeleted int64
+	err := forEachTier(ctx, func(db *gorm.DB) error {
+		res := hctx.DeleteHistoryEntries(db.Where("EXISTS (SELECT 1 FROM channel_entries WHERE channel_entries.device_id = history_entries.device_id AND channel_entries.end_time = history_entries.end_time AND channel_entries.channel = ? AND channel_entries.received)", name).
+			Where("NOT EXISTS (SELECT 1 FROM channel_entries WHERE channel_entries.device_id = history_entries.device_id AND channel_entries.end_time = history_entries.end_time AND channel_entries.channel != ?)", name))
+		numDeleted += res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete the entries received from the channel: %w", err)
+	}
+	if err := RecordAuditEvent(ctx, AuditActionDelete, fmt.Sprintf("deleted %d entries received from the channel %#v", numDeleted, name)); err != nil {
+		return 0, err
+	}
+	if err := hctx.GetDb(ctx).Where("channel = ?", name).Delete(&data.ChannelEntry{}).Error; err != nil {
+		return 0, fmt.Errorf("failed to delete the channel's entries: %w", err)
+	}
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		channels := make([]hctx.ChannelConfig, 0, len(config.Channels))
+		for _, c := range config.Channels {
+			if c.Name != name {
+				channels = append(channels, c)
+			}
+		}
+		config.Channels = channels
+	})
+	return numDeleted, err
+}
+
+// publishChannelEntries publishes the commands matching the channel's publish query that were run since the last
+// time it was published to, and returns the number of published entries
+func publishChannelEntries(ctx context.Context, channel hctx.ChannelConfig) (int, error) {
+	if channel.PublishQuery == "" {
+		return 0, nil
+	}
+	db := hctx.GetDb(ctx)
+	tx, err := MakeWhereQueryFromSearch(ctx, db, channel.PublishQuery)
+	if err != nil {
+		return 0, err
+	}
+	var entries []*data.HistoryEntry
+	if err := tx.Where("end_time > ?", time.Unix(0, channel.LastPublishedNanos)).Order("end_time ASC").Find(&entries).Error; err != nil {
+		return 0, fmt.Errorf("failed to query for entries to publish to channel %#v: %w", channel.Name, err)
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	encEntries := make([]shared.EncChannelEntry, 0, len(entries))
+	for _, entry := range entries {
+		encEntry, err := data.EncryptChannelEntry(channel.TeamKey, *entry)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt channel entry: %w", err)
+		}
+		encEntries = append(encEntries, encEntry)
+	}
+	reqBody, err := json.Marshal(encEntries)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal channel entries: %w", err)
+	}
+	config := hctx.GetConf(ctx)
+	_, err = ApiPost("/api/v1/submit-channel-entries?channel_id="+data.ChannelId(channel.TeamKey)+"&user_id="+data.UserId(config.UserSecret), "application/json", reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish to channel %#v: %w", channel.Name, err)
+	}
+	for _, entry := range entries {
+		if err := recordChannelEntry(db, channel.Name, *entry, false); err != nil {
+			return 0, err
+		}
+	}
+	lastPublishedNanos := entries[len(entries)-1].EndTime.UnixNano()
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if c := findChannel(config.Channels, channel.Name); c != nil {
+			c.LastPublishedNanos = lastPublishedNanos
+		}
+	})
+	return len(entries), err
+}
+
+func recordChannelEntry(db *gorm.DB, channel string, entry data.HistoryEntry, received bool) error {
+	err := RetryDbWrite(func() error {
+		// Entries that this user published are never marked as received when they're received back from the channel,
+		// since the existing row is kept
+		return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&data.ChannelEntry{DeviceId: entry.DeviceId, EndTime: entry.EndTime, Channel: channel, Received: received}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record a channel entry: %w", err)
+	}
+	return nil
+}
+
+// receiveChannelEntries adds the entries published to the channel since it was last synced to this device's history,
+// and returns the number of received entries
+func receiveChannelEntries(ctx context.Context, channel hctx.ChannelConfig) (int, error) {
+	db := hctx.GetDb(ctx)
+	lastReceivedId := channel.LastReceivedId
+	numReceived := 0
+	for {
+		respBody, err := ApiGet("/api/v1/get-channel-entries?channel_id=" + data.ChannelId(channel.TeamKey) + "&after_id=" + strconv.FormatUint(lastReceivedId, 10))
+		if err != nil {
+			return numReceived, err
+		}
+		var encEntries []*shared.EncChannelEntry
+		if err := json.Unmarshal(respBody, &encEntries); err != nil {
+			return numReceived, fmt.Errorf("failed to load JSON response: %w", err)
+		}
+		for _, encEntry := range encEntries {
+			lastReceivedId = encEntry.Id
+			entry, err := data.DecryptChannelEntry(channel.TeamKey, *encEntry)
+			if err != nil {
+				// Only the server could have published an entry that doesn't decrypt, so skip it rather than
+				// letting it block the channel from syncing
+				hctx.GetLogger().Warnf("Skipping an entry in channel %#v that failed to decrypt: %v", channel.Name, err)
+				continue
+			}
+			// Entries that are already in this user's own history (e.g. ones they published from another device) aren't
+			// marked as received, so that they're still shown by default and never deleted when leaving the channel
+			var numOwn int64
+			err = db.Model(&data.HistoryEntry{}).Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).
+				Where("NOT EXISTS (SELECT 1 FROM channel_entries WHERE channel_entries.device_id = history_entries.device_id AND channel_entries.end_time = history_entries.end_time AND channel_entries.received)").
+				Count(&numOwn).Error
+			if err != nil {
+				return numReceived, fmt.Errorf("failed to check whether a channel entry is already in the DB: %w", err)
+			}
+			AddToDbIfNew(db, entry)
+			if err := recordChannelEntry(db, channel.Name, entry, numOwn == 0); err != nil {
+				return numReceived, err
+			}
+			numReceived++
+		}
+		err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if c := findChannel(config.Channels, channel.Name); c != nil {
+				c.LastReceivedId = lastReceivedId
+			}
+		})
+		if err != nil {
+			return numReceived, err
+		}
+		if len(encEntries) < channelEntriesPageSize {
+			return numReceived, nil
+		}
+	}
+}
+
+// SyncChannels publishes new matching commands to every channel and receives teammates' new commands from them. If
+// force isn't set, channels that were synced recently are skipped.
+func SyncChannels(ctx context.Context, force bool) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil
+	}
+	now := time.Now()
+	for _, channel := range config.Channels {
+		if !force && now.Sub(time.Unix(channel.LastSyncTimestamp, 0)) < channelSyncInterval {
+			continue
+		}
+		numPublished, err := publishChannelEntries(ctx, channel)
+		if err != nil {
+			return err
+		}
+		numReceived, err := receiveChannelEntries(ctx, channel)
+		if err != nil {
+			return err
+		}
+		hctx.GetLogger().Infof("Published %d entries to and received %d entries from channel %#v", numPublished, numReceived, channel.Name)
+		err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if c := findChannel(config.Channels, channel.Name); c != nil {
+				c.LastSyncTimestamp = now.Unix()
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaybeSyncChannels syncs channels that haven't been synced recently. Like the retention policy, this is called
+// after commands are saved. Errors from being offline are ignored, since the channels will be synced later.
+func MaybeSyncChannels(ctx context.Context) error {
+	err := SyncChannels(ctx, false)
+	if IsOfflineError(err) {
+		hctx.GetLogger().Infof("Failed to sync channels: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How often old entries are automatically archived to the cold DB
+const automaticArchiveInterval = 24 * time.Hour
+
+// The number of entries that are moved to the cold DB at a time, so that archiving a large history doesn't require
+// loading all of it into memory
+const archiveBatchSize = 1000
+
+// coldStoragePath returns the path of the cold DB, or "" if cold storage isn't supported. It isn't supported when the
+// home directory is shared between hosts, since each host has its own main DB but there is only a single cold DB.
+func coldStoragePath(homedir string) string {
+	if data.IsSharedHome(homedir) {
+		return ""
+	}
+	return data.GetColdDbPath(homedir)
+}
+
+// hasColdStorage returns whether any entries have been archived to the cold DB
+func hasColdStorage(ctx context.Context) bool {
+	path := coldStoragePath(hctx.GetHome(ctx))
+	if path == "" {
+		return false
+	}
+	// The cold DB is created when entries are first archived, so an empty file doesn't contain any entries yet
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
+
+// withColdStorage attaches the cold DB to a connection to the main DB as the "cold" schema, and calls fn with that
+// connection. The cold DB is only attached for queries that need it, so that the common case of searching recent
+// history only ever touches the small main DB.
+func withColdStorage(ctx context.Context, fn func(conn *gorm.DB) error) error {
+	path := coldStoragePath(hctx.GetHome(ctx))
+	return hctx.GetDb(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS cold", path).Error; err != nil {
+			return fmt.Errorf("failed to attach the cold DB: %w", err)
+		}
+		defer conn.Exec("DETACH DATABASE cold")
+		return fn(conn)
+	})
+}
+
+// forEachTier calls fn with the main DB, and then with the history_entries table of the cold DB if there is one.
+// This is used for operations (e.g. deleting entries) that must apply to entries regardless of whether they have
+// been archived.
+func forEachTier(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if err := fn(hctx.GetDb(ctx)); err != nil {
+		return err
+	}
+	if !hasColdStorage(ctx) {
+		return nil
+	}
+	return withColdStorage(ctx, func(conn *gorm.DB) error {
+		// A new session is started so that fn can safely build multiple queries from it
+		return fn(conn.Table(hctx.ColdHistoryTable).Session(&gorm.Session{}))
+	})
+}
+
+// searchColdStorage returns the archived entries matching query, in the same way as searchPage
+func searchColdStorage(ctx context.Context, query string, limit int, order string, cursor searchCursor) ([]*data.HistoryEntry, error) {
+	var historyEntries []*data.HistoryEntry
+	err := withColdStorage(ctx, func(conn *gorm.DB) error {
+		tx, err := MakeWhereQueryFromSearch(ctx, conn.Table(hctx.ColdHistoryTable), query)
+		if err != nil {
+			return err
+		}
+		tx = applySearchCursor(tx.Order(order), order, cursor)
+		if limit > 0 {
+			tx = tx.Limit(limit)
+		}
+		if err := tx.Find(&historyEntries).Error; err != nil {
+			return fmt.Errorf("cold DB query error: %w", err)
+		}
+		return nil
+	})
+	return historyEntries, err
+}
+
+// countColdStorage returns the number of archived entries matching query
+func countColdStorage(ctx context.Context, query string) (int64, error) {
+	var count int64
+	err := withColdStorage(ctx, func(conn *gorm.DB) error {
+		tx, err := MakeWhereQueryFromSearch(ctx, conn.Table(hctx.ColdHistoryTable), query)
+		if err != nil {
+			return err
+		}
+		if err := tx.Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to count matching archived entries: %w", err)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// CountArchivedEntries returns the number of entries in the cold DB
+func CountArchivedEntries(ctx context.Context) (int64, error) {
+	if !hasColdStorage(ctx) {
+		return 0, nil
+	}
+	return countColdStorage(ctx, "")
+}
+
+// DeleteSearchResults deletes all local entries matching query, including archived ones, and returns the number of
+// deleted entries
+func DeleteSearchResults(ctx context.Context, query string) (int64, error) {
+	var numDeleted int64
+	err := forEachTier(ctx, func(db *gorm.DB) error {
+		tx, err := MakeWhereQueryFromSearch(ctx, db, query)
+		if err != nil {
+			return err
+		}
+		res := hctx.DeleteHistoryEntries(tx)
+		if res.Error != nil {
+			return res.Error
+		}
+		numDeleted += res.RowsAffected
+		return nil
+	})
+	return numDeleted, err
+}
+
+func openColdDb(config hctx.ClientConfig, path string) (*gorm.DB, error) {
+	// Like the main DB, the cold DB is only readable by the current user
+	if f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600); err == nil {
+		f.Close()
+	}
+	db, err := hctx.OpenSqliteDb(config, path, "rwc")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&data.HistoryEntry{}); err != nil {
+		return nil, fmt.Errorf("failed to create the cold DB: %w", err)
+	}
+	return db, nil
+}
+
+// ArchiveToColdStorage moves entries older than the configured number of months out of the main DB and into the
+// cold DB, so that the main DB (which is queried for every search) stays small as history grows. Pinned entries are
+// never archived. Returns the number of archived entries.
+func ArchiveToColdStorage(ctx context.Context, now time.Time) (int64, error) {
+	months := hctx.GetConf(ctx).HotStorageMonths
+	if months <= 0 {
+		return 0, nil
+	}
+	path := coldStoragePath(hctx.GetHome(ctx))
+	if path == "" {
+		return 0, fmt.Errorf("archiving old entries isn't supported when the home directory is shared between hosts")
+	}
+	cutoff := now.AddDate(0, -months, 0)
+	db := hctx.GetDb(ctx)
+	var coldDb *gorm.DB
+	defer func() {
+		if coldDb != nil {
+			if sqlDb, err := coldDb.DB(); err == nil {
+				sqlDb.Close()
+			}
+		}
+	}()
+	var numArchived int64
+	for {
+		var entries []*data.HistoryEntry
+		if err := db.Where("end_time < ? AND COALESCE(pinned, 0) = ?", cutoff, false).Limit(archiveBatchSize).Find(&entries).Error; err != nil {
+			return numArchived, fmt.Errorf("failed to query for entries to archive: %w", err)
+		}
+		if len(entries) == 0 {
+			return numArchived, nil
+		}
+		if coldDb == nil {
+			var err error
+			coldDb, err = openColdDb(hctx.GetConf(ctx), path)
+			if err != nil {
+				return numArchived, err
+			}
+		}
+		// Entries are copied to the cold DB before being deleted from the main DB, so that if archiving is
+		// interrupted the worst case is that entries are briefly in both DBs until the next run
+		if err := coldDb.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(entries, 100).Error; err != nil {
+			return numArchived, fmt.Errorf("failed to copy entries to the cold DB: %w", err)
+		}
+		var numDeleted int64
+		err := RetryDbWrite(func() error {
+			numDeleted = 0
+			return db.Transaction(func(tx *gorm.DB) error {
+				for _, entry := range entries {
+					res := hctx.DeleteHistoryEntries(tx.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime))
+					if res.Error != nil {
+						return res.Error
+					}
+					numDeleted += res.RowsAffected
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return numArchived, fmt.Errorf("failed to delete archived entries from the main DB: %w", err)
+		}
+		if numDeleted == 0 {
+			// This should never happen, but would otherwise loop forever
+			return numArchived, fmt.Errorf("failed to delete any of the %d archived entries from the main DB", len(entries))
+		}
+		numArchived += numDeleted
+	}
+}
+
+// MaybeArchiveToColdStorage archives old entries if that is enabled and they haven't been archived in the last day.
+// Like the retention policy, this is called after commands are saved so that it doesn't require a cron job.
+func MaybeArchiveToColdStorage(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	if config.HotStorageMonths <= 0 || coldStoragePath(hctx.GetHome(ctx)) == "" {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(config.LastArchiveTimestamp, 0)) < automaticArchiveInterval {
+		return nil
+	}
+	numArchived, err := ArchiveToColdStorage(ctx, now)
+	if err != nil {
+		return err
+	}
+	hctx.GetLogger().Infof("Archived %d history entries to the cold DB", numArchived)
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.LastArchiveTimestamp = now.Unix()
+	})
+}
+
+// unarchiveEntry moves an entry from the cold DB back into the main DB. This is done when an entry is pinned, so that
+// it is displayed before all other matching entries.
+func unarchiveEntry(ctx context.Context, deviceId string, endTime time.Time) error {
+	if !hasColdStorage(ctx) {
+		return nil
+	}
+	return withColdStorage(ctx, func(conn *gorm.DB) error {
+		var entries []*data.HistoryEntry
+		if err := conn.Table(hctx.ColdHistoryTable).Where("device_id = ? AND end_time = ?", deviceId, endTime).Find(&entries).Error; err != nil {
+			return fmt.Errorf("failed to query the cold DB: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return conn.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Insert{Modifier: "OR IGNORE"}).Create(entries).Error; err != nil {
+				return fmt.Errorf("failed to restore an archived entry: %w", err)
+			}
+			return tx.Table(hctx.ColdHistoryTable).Where("device_id = ? AND end_time = ?", deviceId, endTime).Delete(&data.HistoryEntry{}).Error
+		})
+	})
+}
+
+// deleteColdStorage deletes the cold DB, e.g. when setting up a fresh install
+func deleteColdStorage(homedir string) error {
+	path := coldStoragePath(homedir)
+	if path == "" {
+		return nil
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete the cold DB: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// The value of PRAGMA auto_vacuum for DBs that free pages via PRAGMA incremental_vacuum
+const autoVacuumIncremental = 2
+
+// CompactResult describes the on-disk size of the local DB (including the WAL) before and after CompactDb
+type CompactResult struct {
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+func (r CompactResult) BytesReclaimed() int64 {
+	if r.BytesAfter > r.BytesBefore {
+		return 0
+	}
+	return r.BytesBefore - r.BytesAfter
+}
+
+// CompactDb shrinks the local DB file after entries have been deleted, since sqlite otherwise keeps the freed
+// pages around for reuse. The first compaction rebuilds the DB with a full VACUUM and switches it to incremental
+// auto-vacuum, so that later compactions only have to release the free pages via PRAGMA incremental_vacuum.
+//
+// This is safe to run while shells are recording commands. Rather than writing a compacted copy of the DB with
+// VACUUM INTO and renaming it over the DB (which would lose any writes made by processes that already had the old
+// file open), VACUUM builds the compacted copy and then copies it back into the DB file while holding sqlite's
+// locks, so concurrent writers just wait (up to the busy timeout) and then see the compacted DB.
+func CompactDb(ctx context.Context) (*CompactResult, error) {
+	dbPath := data.GetDbPath(hctx.GetHome(ctx))
+	result := CompactResult{}
+	var err error
+	result.BytesBefore, err = getDbSizeOnDisk(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	// PRAGMA auto_vacuum only applies to the connection that then runs VACUUM, so everything runs on one connection
+	err = hctx.GetDb(ctx).Connection(func(tx *gorm.DB) error {
+		var autoVacuum int
+		if err := tx.Raw("PRAGMA auto_vacuum").Scan(&autoVacuum).Error; err != nil {
+			return fmt.Errorf("failed to get the auto_vacuum mode: %w", err)
+		}
+		if autoVacuum == autoVacuumIncremental {
+			// incremental_vacuum frees one page each time a row is read from it, so all of its rows have to be read
+			rows, err := tx.Raw("PRAGMA incremental_vacuum").Rows()
+			if err != nil {
+				return fmt.Errorf("failed to run an incremental vacuum: %w", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+			}
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to run an incremental vacuum: %w", err)
+			}
+		} else {
+			for _, stmt := range []string{"PRAGMA auto_vacuum = INCREMENTAL", "VACUUM"} {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return fmt.Errorf("failed to run %#v: %w", stmt, err)
+				}
+			}
+		}
+		// Checkpoint the WAL so that the freed space is also released from it
+		if err := tx.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error; err != nil {
+			return fmt.Errorf("failed to checkpoint the WAL: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.BytesAfter, err = getDbSizeOnDisk(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func getDbSizeOnDisk(dbPath string) (int64, error) {
+	dbSize, err := getFileSize(dbPath)
+	if err != nil {
+		return 0, err
+	}
+	walSize, err := getFileSize(dbPath + "-wal")
+	if err != nil {
+		return 0, err
+	}
+	return dbSize + walSize, nil
+}
+
+// getReclaimableBytes returns how much space is taken up by free pages in the DB, which is a lower bound on how
+// much CompactDb will reclaim
+func getReclaimableBytes(db *gorm.DB) (int64, error) {
+	var freePages, pageSize int64
+	if err := db.Raw("PRAGMA freelist_count").Scan(&freePages).Error; err != nil {
+		return 0, fmt.Errorf("failed to count free pages: %w", err)
+	}
+	if err := db.Raw("PRAGMA page_size").Scan(&pageSize).Error; err != nil {
+		return 0, fmt.Errorf("failed to get the page size: %w", err)
+	}
+	return freePages * pageSize, nil
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+)
+
+// The protocol version of the sync server is stored in this file (along with the server it is for), so that requests
+// can be compressed as soon as a server is known to support it, including by processes that haven't sent any other
+// request yet (e.g. the one that uploads each command)
+const serverProtocolVersionPath = ".server_protocol_version"
+
+// Request bodies smaller than this aren't compressed since compressing them saves little
+const minCompressedRequestSize = 1024
+
+// The largest that a compressed response can be once decompressed
+const maxDecompressedResponseSize = 1024 * 1024 * 1024
+
+func getServerProtocolVersionPath() string {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(data.GetHishtoryDir(homedir), serverProtocolVersionPath)
+}
+
+// getServerProtocolVersion returns the protocol version that the sync server last advertised, or 0 if it is unknown
+func getServerProtocolVersion() int {
+	path := getServerProtocolVersionPath()
+	if path == "" {
+		return 0
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	server, version, _ := strings.Cut(strings.TrimSpace(string(contents)), " ")
+	if server != getServerHostname() {
+		return 0
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// recordServerProtocolVersion stores the protocol version advertised in a response from the sync server, if it
+// changed. Servers that don't advertise a version are recorded as version 0.
+func recordServerProtocolVersion(resp *http.Response) {
+	version, err := strconv.Atoi(resp.Header.Get(shared.ProtocolVersionHeader))
+	if err != nil {
+		version = 0
+	}
+	setServerProtocolVersion(version)
+}
+
+func setServerProtocolVersion(version int) {
+	if version == getServerProtocolVersion() {
+		return
+	}
+	path := getServerProtocolVersionPath()
+	if path == "" {
+		return
+	}
+	contents := fmt.Sprintf("%s %d", getServerHostname(), version)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		hctx.GetLogger().Warnf("failed to record the protocol version of the server: %v", err)
+	}
+}
+
+// setCompressionHeaders sets the headers for protocol version and compression negotiation on a request to the sync
+// server
+func setCompressionHeaders(req *http.Request) {
+	req.Header.Set(shared.ProtocolVersionHeader, strconv.Itoa(shared.ProtocolVersion))
+	// Setting this disables the transport's transparent gzip support, so the response is decompressed by
+	// readResponseBody instead
+	req.Header.Set("Accept-Encoding", "zstd")
+}
+
+// compressRequestBody compresses a request body with zstd if the server supports it and it's worth it. It returns
+// the body to send and whether it was compressed.
+func compressRequestBody(body []byte) ([]byte, bool) {
+	if len(body) < minCompressedRequestSize || getServerProtocolVersion() < shared.ProtocolVersionCompression {
+		return body, false
+	}
+	return shared.CompressZstd(body), true
+}
+
+// readResponseBody reads the body of a response from the sync server, decompressing it if needed
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+		return body, nil
+	case "zstd":
+		return shared.DecompressZstd(body, maxDecompressedResponseSize)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %#v", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// newApiPostRequest creates a POST request to the sync server, with the body compressed if allowed and the server
+// supports it. It returns whether the body was compressed.
+func newApiPostRequest(path, contentType string, data []byte, allowCompression bool) (*http.Request, bool, error) {
+	body, compressed := data, false
+	if allowCompression {
+		body, compressed = compressRequestBody(data)
+	}
+	req, err := http.NewRequest("POST", getServerHostname()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compressed {
+		req.Header.Set("Content-Encoding", "zstd")
+	}
+	setCompressionHeaders(req)
+	return req, compressed, nil
+}
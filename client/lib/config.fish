@@ -4,8 +4,38 @@ function _hishtory_post_exec --on-event fish_postexec
     set --global _hishtory_start_time (date +%s)
 end
 
+function _hishtory_pre_exec --on-event fish_preexec
+    # Identify the command that is about to run so that the tools it runs can log it (see `hishtory query correlation_id:...`)
+    set --global --export HISHTORY_CORRELATION_ID "$HISHTORY_SESSION_ID-"(date +%s)"-"(random)
+end
+
 set --global _hishtory_first_prompt 1
 
+# Identify this shell so that `hishtory last` prints the previous command run in this shell rather than in any shell
+set --global --export HISHTORY_SESSION_ID "$fish_pid-"(random)
+
+# Prompt for the passphrase that the secret key is encrypted with (see `hishtory config-set secret-storage passphrase`),
+# which is only needed in the first shell of each login session
+hishtory unlock --if-locked
+
+# Record the PID of the shell that this one was started from (if it also has hishtory's hook) so that nested shells
+# (e.g. from `poetry shell` or `nix develop`) can be told apart
+set --global --export HISHTORY_PARENT_SHELL_PID "$HISHTORY_SHELL_PID"
+set --global --export HISHTORY_SHELL_PID $fish_pid
+
+# Record the hosts that this shell was reached from over SSH so that they are propagated to nested SSH sessions
+if set -q SSH_CONNECTION; and test "$HISHTORY_SSH_CONNECTION" != "$SSH_CONNECTION"
+    set --global --export HISHTORY_SSH_CONNECTION $SSH_CONNECTION
+    set --global --export LC_HISHTORY_SSH_CHAIN (string trim -- "$LC_HISHTORY_SSH_CHAIN "(string split ' ' -- $SSH_CONNECTION)[1])
+end
+
+# Record how this shell was started, so that commands run by scripts (e.g. provisioning scripts that start an
+# interactive shell and feed it commands) can be told apart from commands typed at a prompt
+set --global _hishtory_shell_mode
+status is-interactive; and set --global --append _hishtory_shell_mode interactive
+status is-login; and set --global --append _hishtory_shell_mode login
+isatty stdin; or set --global --append _hishtory_shell_mode script
+
 function __hishtory_on_prompt --on-event fish_prompt
     # Runs after the command is executed in order to render the prompt
     # $? contains the exit code 
@@ -13,12 +43,29 @@ function __hishtory_on_prompt --on-event fish_prompt
     if [ -n "$_hishtory_first_prompt" ]
         set --global -e _hishtory_first_prompt
     else if [ -n "$_hishtory_command" ]
+        set --local --export HISHTORY_SHELL_MODE (string join , -- $_hishtory_shell_mode)
         hishtory saveHistoryEntry fish $_hishtory_exit_code "$_hishtory_command" $_hishtory_start_time &  # Background Run
         # hishtory saveHistoryEntry fish $_hishtory_exit_code "$_hishtory_command" $_hishtory_start_time  # Foreground Run
         set --global -e _hishtory_command  # Unset _hishtory_command so we don't double-save entries when fish_prompt is invoked but fish_postexec isn't
     end 
 end
 
+function __hishtory_pre_exec_execute
+    # Check the command with the pre-exec hook (see `hishtory config-set pre-exec-hook`) before it is run. If it
+    # is denied, it is left in the command line so that it can be edited.
+    set -l cmd (string join \n -- (commandline))
+    if test -n "$cmd"; and not hishtory preExecCheck fish "$cmd"
+        commandline -f repaint
+        return
+    end
+    commandline -f execute
+end
+
+set -l _hishtory_pre_exec_hook (hishtory config-get pre-exec-hook)
+if test -n "$_hishtory_pre_exec_hook"
+    bind \r __hishtory_pre_exec_execute
+end
+
 function __hishtory_on_control_r
 	set -l tmp (mktemp -t fish.XXXXXX)
 	set -x init_query (commandline -b)
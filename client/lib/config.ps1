@@ -0,0 +1,52 @@
+# Note: This file is sourced by the hishtory line in your PowerShell profile
+
+# Runs after <ENTER>, but before the command is executed. Any existing handler is kept so that it can still
+# decide whether the line is added to PowerShell's own history.
+$global:_hishtory_existing_history_handler = (Get-PSReadLineOption).AddToHistoryHandler
+Set-PSReadLineOption -AddToHistoryHandler {
+    param([string]$line)
+    $global:_hishtory_command = $line
+    $global:_hishtory_start_time = [DateTimeOffset]::Now.ToUnixTimeSeconds()
+    # Identify this command so that the tools it runs can log it (see `hishtory query correlation_id:...`)
+    $env:HISHTORY_CORRELATION_ID = "$PID-$($global:_hishtory_start_time)-$(Get-Random)"
+    if ($global:_hishtory_existing_history_handler) {
+        return & $global:_hishtory_existing_history_handler $line
+    }
+    return $true
+}
+
+$global:_hishtory_original_prompt = $function:prompt
+
+function global:prompt {
+    # Runs after the command is executed in order to render the prompt. This must come first so that $? still
+    # contains the status of the command.
+    $_hishtory_exit_code = if ($?) { 0 } elseif ($global:LASTEXITCODE) { $global:LASTEXITCODE } else { 1 }
+    $_hishtory_last_exit_code = $global:LASTEXITCODE
+    if ($null -ne $global:_hishtory_command) {
+        # Pass the command through as-is, even if it contains quotes (only needed before PowerShell 7.3)
+        $PSNativeCommandArgumentPassing = 'Standard'
+        hishtory saveHistoryEntry powershell $_hishtory_exit_code $global:_hishtory_command $global:_hishtory_start_time | Out-Null  # Foreground Run
+        # Unset _hishtory_command so we don't double-save entries when the prompt is rendered without running a command
+        $global:_hishtory_command = $null
+    }
+    # Restore $LASTEXITCODE since running hishtory overwrote it
+    $global:LASTEXITCODE = $_hishtory_last_exit_code
+    & $global:_hishtory_original_prompt
+}
+
+function global:_hishtory_on_control_r {
+    $line = $null
+    $cursor = $null
+    [Microsoft.PowerShell.PSConsoleReadLine]::GetBufferState([ref]$line, [ref]$cursor)
+    $env:HISHTORY_TERM_INTEGRATION = 1
+    $selected = hishtory tquery $line
+    Remove-Item Env:\HISHTORY_TERM_INTEGRATION
+    [Microsoft.PowerShell.PSConsoleReadLine]::InvokePrompt()
+    if ($selected) {
+        [Microsoft.PowerShell.PSConsoleReadLine]::Replace(0, $line.Length, ($selected -join "`n"))
+    }
+}
+
+if ((hishtory config-get enable-control-r) -eq 'true') {
+    Set-PSReadLineKeyHandler -Chord Ctrl+r -ScriptBlock { _hishtory_on_control_r }
+}
@@ -5,8 +5,40 @@
 if [ -n "$__hishtory_bash_config_sourced" ]; then return; fi
 __hishtory_bash_config_sourced=`date`
 
+# Identify this shell so that `hishtory last` prints the previous command run in this shell rather than in any shell
+export HISHTORY_SESSION_ID="$$-$RANDOM"
+
+# Prompt for the passphrase that the secret key is encrypted with (see `hishtory config-set secret-storage passphrase`),
+# which is only needed in the first shell of each login session
+hishtory unlock --if-locked
+
+# Record the PID of the shell that this one was started from (if it also has hishtory's hook) so that nested shells
+# (e.g. from `poetry shell` or `nix develop`) can be told apart
+export HISHTORY_PARENT_SHELL_PID="$HISHTORY_SHELL_PID"
+export HISHTORY_SHELL_PID="$$"
+
+# Record the hosts that this shell was reached from over SSH so that they are propagated to nested SSH sessions
+if [ -n "$SSH_CONNECTION" ] && [ "$HISHTORY_SSH_CONNECTION" != "$SSH_CONNECTION" ]; then
+  export HISHTORY_SSH_CONNECTION="$SSH_CONNECTION"
+  export LC_HISHTORY_SSH_CHAIN="${LC_HISHTORY_SSH_CHAIN:+$LC_HISHTORY_SSH_CHAIN }${SSH_CONNECTION%% *}"
+fi
+
+# Record how this shell was started, so that commands run by scripts (e.g. provisioning scripts that start an
+# interactive shell and feed it commands) can be told apart from commands typed at a prompt
+__hishtory_shell_mode=""
+[[ $- == *i* ]] && __hishtory_shell_mode="interactive"
+shopt -q login_shell && __hishtory_shell_mode="$__hishtory_shell_mode,login"
+[ -t 0 ] || __hishtory_shell_mode="$__hishtory_shell_mode,script"
+
+# Save multi-line commands (e.g. heredocs and backslash continuations) to the history with their original line
+# breaks, rather than joined with semicolons, so that they're recorded as they were written
+shopt -s cmdhist lithist
+
 # Implementation of running before/after every command based on https://jichu4n.com/posts/debug-trap-and-prompt_command-in-bash/
 function __hishtory_precommand() {
+  if [ -n "$__hishtory_pre_exec_hook_enabled" ]; then
+    __hishtory_pre_exec_check || return 1
+  fi
   if [ -z "$HISHTORY_AT_PROMPT" ]; then
     return
   fi
@@ -14,9 +46,43 @@ function __hishtory_precommand() {
 
   # Run before every command
   HISHTORY_START_TIME=`date +%s`
+  # Identify this command so that the tools it runs can log it (see `hishtory query correlation_id:...`)
+  export HISHTORY_CORRELATION_ID="$HISHTORY_SESSION_ID-$HISHTORY_START_TIME-$RANDOM"
 }
 trap "__hishtory_precommand" DEBUG
 
+# Check each command with the pre-exec hook (see `hishtory config-set pre-exec-hook`) before it is run. With
+# extdebug enabled, bash skips each part of the command for which the DEBUG trap fails, so once the hook denies
+# a command, the rest of it is skipped until the next prompt.
+function __hishtory_pre_exec_check() {
+  # extdebug also runs the DEBUG trap for the commands in functions, but only the commands entered at the prompt
+  # (rather than the ones that they run) need to be checked
+  if [ ${#FUNCNAME[@]} -gt 2 ] || [[ "$BASH_COMMAND" == __hishtory_postcommand* ]]; then
+    return 0
+  fi
+  if [ -n "$__hishtory_pre_exec_denied" ]; then
+    return 1
+  fi
+  # Each line entered at the prompt is only checked once, before the first part of it is run
+  local line="`history 1`"
+  if [ "$line" = "$__hishtory_pre_exec_checked_line" ]; then
+    return 0
+  fi
+  __hishtory_pre_exec_checked_line="$line"
+  if ! hishtory preExecCheck bash "$line"; then
+    __hishtory_pre_exec_denied=1
+    # Remove the denied command from the history since it wasn't run, so that it is checked again if it is re-run
+    line="${line#"${line%%[![:space:]]*}"}"
+    history -d "${line%% *}"
+    __hishtory_pre_exec_checked_line="`history 1`"
+    return 1
+  fi
+}
+if [ -n "$(hishtory config-get pre-exec-hook)" ]; then
+  __hishtory_pre_exec_hook_enabled=1
+  shopt -s extdebug
+fi
+
 HISHTORY_FIRST_PROMPT=1
 function __hishtory_postcommand() {
   EXIT_CODE=$?
@@ -26,10 +92,15 @@ function __hishtory_postcommand() {
     unset HISHTORY_FIRST_PROMPT
     return
   fi
+  if [ -n "$__hishtory_pre_exec_denied" ]; then
+    # Don't record commands that were denied by the pre-exec hook since they weren't run
+    unset __hishtory_pre_exec_denied
+    return
+  fi
 
   # Run after every prompt
-  (hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME &) # Background Run
-  # hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME  # Foreground Run
+  (HISHTORY_ALIASES="$__hishtory_aliases" HISHTORY_SHELL_MODE="$__hishtory_shell_mode" hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME &) # Background Run
+  # HISHTORY_ALIASES="$__hishtory_aliases" HISHTORY_SHELL_MODE="$__hishtory_shell_mode" hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME  # Foreground Run
 }
 PROMPT_COMMAND="__hishtory_postcommand; $PROMPT_COMMAND"
 export HISTTIMEFORMAT=$HISTTIMEFORMAT
@@ -44,3 +115,6 @@ __hishtory_bind_control_r() {
 }
 
 [ "$(hishtory config-get enable-control-r)" = true ] && __hishtory_bind_control_r
+
+# Capture the aliases defined so far so that commands starting with an alias can also be recorded with the alias expanded
+[ "$(hishtory config-get record-resolved-aliases)" = true ] && __hishtory_aliases="$(alias)"
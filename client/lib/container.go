@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// getContainer returns a description of the container that the current shell is running in (e.g.
+// "podman:dev@fedora:39" or "docker:0123456789ab"), or an empty string if it isn't running in a container.
+func getContainer() string {
+	return detectContainer("/", os.Getenv)
+}
+
+// A container ID as it appears in /proc/self/cgroup (cgroup v1) or /proc/self/mountinfo (cgroup v2)
+var containerIdRegex = regexp.MustCompile(`(?:docker|containers|libpod|cri-containerd)[-/]([0-9a-f]{64})`)
+
+func detectContainer(root string, getenv func(string) string) string {
+	engine := ""
+	name := ""
+	image := ""
+	// podman (and toolbox/distrobox, which are built on it) set $container, as does systemd-nspawn
+	if e := getenv("container"); e != "" {
+		engine = e
+	}
+	if _, err := os.Stat(filepath.Join(root, ".dockerenv")); err == nil {
+		engine = "docker"
+	}
+	// podman writes metadata about the container to /run/.containerenv
+	if f, err := os.Open(filepath.Join(root, "run", ".containerenv")); err == nil {
+		defer f.Close()
+		if engine == "" || engine == "oci" {
+			engine = "podman"
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, found := strings.Cut(scanner.Text(), "=")
+			if !found {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			switch key {
+			case "name":
+				name = value
+			case "image":
+				image = value
+			}
+		}
+	}
+	if engine == "" && getenv("KUBERNETES_SERVICE_HOST") != "" {
+		engine = "kubernetes"
+		name = getenv("HOSTNAME")
+	}
+	// Set by toolbox and distrobox to the name of the container, and can be set manually for other containers
+	// (e.g. via containerEnv in devcontainer.json)
+	if id := getenv("CONTAINER_ID"); id != "" {
+		name = id
+		if engine == "" {
+			engine = "container"
+		}
+	}
+	if engine == "" {
+		return ""
+	}
+	if name == "" {
+		for _, procFile := range []string{"cgroup", "mountinfo"} {
+			contents, err := os.ReadFile(filepath.Join(root, "proc", "self", procFile))
+			if err != nil {
+				continue
+			}
+			if matches := containerIdRegex.FindSubmatch(contents); matches != nil {
+				// Use the short form of the ID that docker displays
+				name = string(matches[1][:12])
+				break
+			}
+		}
+	}
+	container := engine
+	if name != "" {
+		container += ":" + name
+	}
+	if image != "" {
+		container += "@" + image
+	}
+	return container
+}
@@ -0,0 +1,19 @@
+package lib
+
+import (
+	"os"
+	"regexp"
+)
+
+// The shell hooks export a new ID in this before running each command, so that the tools that the command runs
+// (e.g. deploy scripts or CI triggers) can log it. Their logs can then be joined back to the history entry for
+// the command via the correlation_id atom.
+const correlationIdEnvVar = "HISHTORY_CORRELATION_ID"
+
+var invalidCorrelationIdChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// getCorrelationId returns the correlation ID that was exported to the command being recorded, or an empty string
+// if the shell hooks didn't set one
+func getCorrelationId() string {
+	return invalidCorrelationIdChars.ReplaceAllString(os.Getenv(correlationIdEnvVar), "")
+}
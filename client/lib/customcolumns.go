@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Custom column commands are run every time a command is recorded, so columns that take longer than this are
+// flagged by `hishtory config-columns dev` since they noticeably slow down every prompt
+const CustomColumnLatencyBudget = 50 * time.Millisecond
+
+// CustomColumnResult is the result of running the command for a custom column
+type CustomColumnResult struct {
+	Name    string
+	Command string
+	// The trimmed stdout of the command, which is what gets recorded as the column's value
+	Output   string
+	Stderr   string
+	Duration time.Duration
+	// Set if the command exited with an error. The output is still recorded in that case.
+	Err error
+}
+
+func (r CustomColumnResult) IsOverBudget() bool {
+	return r.Duration > CustomColumnLatencyBudget
+}
+
+// runCustomColumn runs the command for the given custom column. An error is only returned if the command couldn't
+// be started.
+func runCustomColumn(cc hctx.CustomColumnDefinition) (CustomColumnResult, error) {
+	result := CustomColumnResult{Name: cc.ColumnName, Command: cc.ColumnCommand}
+	cmd := exec.Command("bash", "-c", cc.ColumnCommand)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Start()
+	if err != nil {
+		return result, fmt.Errorf("failed to execute custom command named %v (stdout=%#v, stderr=%#v)", cc.ColumnName, stdout.String(), stderr.String())
+	}
+	result.Err = cmd.Wait()
+	result.Duration = time.Since(start)
+	result.Output = strings.TrimSpace(stdout.String())
+	result.Stderr = strings.TrimSpace(stderr.String())
+	return result, nil
+}
+
+// RunCustomColumns runs the commands for the configured custom columns in the current environment, so that they
+// can be checked while they're being developed. If names is non-empty, only the columns with those names are run.
+func RunCustomColumns(ctx context.Context, names []string) ([]CustomColumnResult, error) {
+	config := hctx.GetConf(ctx)
+	columns := make([]hctx.CustomColumnDefinition, 0)
+	for _, name := range names {
+		found := false
+		for _, cc := range config.CustomColumns {
+			if cc.ColumnName == name {
+				columns = append(columns, cc)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("there is no custom column named %#v, run `hishtory config-get custom-columns` to list them", name)
+		}
+	}
+	if len(names) == 0 {
+		columns = config.CustomColumns
+	}
+	results := make([]CustomColumnResult, 0, len(columns))
+	for _, cc := range columns {
+		result, err := runCustomColumn(cc)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
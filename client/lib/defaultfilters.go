@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The atom that disables the default filters for a single query
+const disableDefaultFiltersAtom = "defaults:false"
+
+// ValidateDefaultFilter checks that filter is a valid search query, so that an invalid default filter can't break
+// every interactive search
+func ValidateDefaultFilter(ctx context.Context, filter string) error {
+	if strings.TrimSpace(filter) == "" {
+		return fmt.Errorf("default filters can't be empty")
+	}
+	if _, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), filter); err != nil {
+		return fmt.Errorf("invalid default filter %#v: %w", filter, err)
+	}
+	return nil
+}
+
+// getFilteredFields returns the fields that query has atoms for (e.g. exit_code for `-exit_code:130`). before and
+// after are both returned as "time", since they both limit the time range.
+func getFilteredFields(query string) map[string]bool {
+	fields := make(map[string]bool)
+	tokens, err := tokenize(query)
+	if err != nil {
+		return fields
+	}
+	for _, token := range tokens {
+		token = strings.TrimPrefix(token, "-")
+		if !containsUnescaped(token, ":") {
+			continue
+		}
+		field := unescape(splitEscaped(token, ':', 2)[0])
+		if field == "before" || field == "after" {
+			field = "time"
+		}
+		fields[field] = true
+	}
+	return fields
+}
+
+// applyDefaultFilters returns query with the default filters from the config appended. Default filters are
+// overridden by the query, so they're skipped if the query already filters on the same field, and they're all
+// skipped if the query contains `defaults:false`.
+func applyDefaultFilters(config hctx.ClientConfig, query string) string {
+	if len(config.DefaultFilters) == 0 {
+		return query
+	}
+	if containsToken(query, disableDefaultFiltersAtom) {
+		return query
+	}
+	filters := getActiveDefaultFilters(config, getFilteredFields(query))
+	if len(filters) == 0 {
+		return query
+	}
+	return strings.TrimSpace(query + " " + strings.Join(filters, " "))
+}
+
+func containsToken(query, token string) bool {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return false
+	}
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// getActiveDefaultFilters returns the default filters that aren't overridden by a query that filters on queryFields
+func getActiveDefaultFilters(config hctx.ClientConfig, queryFields map[string]bool) []string {
+	filters := make([]string, 0)
+	for _, filter := range config.DefaultFilters {
+		isOverridden := false
+		for field := range getFilteredFields(filter) {
+			if queryFields[field] {
+				isOverridden = true
+			}
+		}
+		if !isOverridden {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// How long we're willing to wait for `mise current` since it runs after every single command
+const miseTimeout = 500 * time.Millisecond
+
+// getDevEnvironment returns a description of the direnv and/or mise environment that is
+// active in the current shell, or an empty string if neither is in use.
+func getDevEnvironment(ctx context.Context) string {
+	envs := make([]string, 0)
+	if direnvEnv := getDirenvEnvironment(); direnvEnv != "" {
+		envs = append(envs, direnvEnv)
+	}
+	if miseEnv := getMiseEnvironment(ctx); miseEnv != "" {
+		envs = append(envs, miseEnv)
+	}
+	return strings.Join(envs, " ")
+}
+
+func getDirenvEnvironment() string {
+	// direnv sets DIRENV_DIR to "-" followed by the directory containing the loaded .envrc, and
+	// DIRENV_DIFF to an encoded diff of the environment that it applied.
+	direnvDir := strings.TrimPrefix(os.Getenv("DIRENV_DIR"), "-")
+	if direnvDir == "" {
+		return ""
+	}
+	env := "direnv:" + direnvDir
+	if diff := os.Getenv("DIRENV_DIFF"); diff != "" {
+		h := sha256.Sum256([]byte(diff))
+		env += "#" + hex.EncodeToString(h[:])[:8]
+	}
+	return env
+}
+
+func getMiseEnvironment(ctx context.Context) string {
+	// MISE_SHELL is only set when mise has been activated in the current shell
+	if os.Getenv("MISE_SHELL") == "" {
+		return ""
+	}
+	if _, err := exec.LookPath("mise"); err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, miseTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "mise", "current")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		hctx.GetLogger().Warnf("failed to get the current mise tool versions: %v", err)
+		return ""
+	}
+	return parseMiseCurrent(stdout.String())
+}
+
+// parseMiseCurrent converts the output of `mise current` (lines of "tool version [version...]")
+// into a stable single-line form like "mise:go@1.21.0,node@20.1.0".
+func parseMiseCurrent(output string) string {
+	tools := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		tools = append(tools, fields[0]+"@"+strings.Join(fields[1:], "+"))
+	}
+	if len(tools) == 0 {
+		return ""
+	}
+	sort.Strings(tools)
+	return "mise:" + strings.Join(tools, ",")
+}
@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+)
+
+func getQuarantinePath(homedir string) string {
+	return path.Join(data.GetHishtoryDir(homedir), data.QUARANTINE_PATH)
+}
+
+// quarantineEntry appends an encrypted history entry that we failed to decrypt to the quarantine file so
+// that it can be inspected later rather than blocking syncing.
+func quarantineEntry(ctx context.Context, entry shared.EncHistoryEntry) error {
+	f, err := os.OpenFile(getQuarantinePath(hctx.GetHome(ctx)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open quarantine file: %w", err)
+	}
+	defer f.Close()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quarantined entry: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write to quarantine file: %w", err)
+	}
+	return nil
+}
+
+func countQuarantinedEntries(homedir string) (int, error) {
+	contents, err := os.ReadFile(getQuarantinePath(homedir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read quarantine file: %w", err)
+	}
+	return bytes.Count(contents, []byte("\n")), nil
+}
+
+// checkDbIntegrity runs PRAGMA integrity_check and returns the problems it found, if any
+func checkDbIntegrity(db *gorm.DB) ([]string, error) {
+	var results []string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&results).Error; err != nil {
+		return nil, fmt.Errorf("failed to run integrity check: %w", err)
+	}
+	if len(results) == 1 && results[0] == "ok" {
+		return nil, nil
+	}
+	return results, nil
+}
+
+// repairDb salvages all readable history entries from a corrupted DB into a freshly created DB. The
+// corrupted DB (and its WAL files) are kept next to the new DB with a .corrupt suffix.
+func repairDb(out io.Writer, config hctx.ClientConfig, homedir string) error {
+	// The agent would otherwise keep using the corrupted DB
+	if err := hctx.StopAgent(); err != nil {
+		return err
+	}
+	dbPath := data.GetDbPath(homedir)
+	backupPath := fmt.Sprintf("%s.corrupt-%d", dbPath, time.Now().Unix())
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := os.Rename(dbPath+suffix, backupPath+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move corrupted DB to %s: %w", backupPath+suffix, err)
+		}
+	}
+	fmt.Fprintf(out, "Moved the corrupted DB to %s\n", backupPath)
+
+	salvaged := make([]data.HistoryEntry, 0)
+	oldDb, err := hctx.OpenSqliteDb(config, backupPath, "ro")
+	if err == nil {
+		rows, err := oldDb.Model(&data.HistoryEntry{}).Rows()
+		if err == nil {
+			for rows.Next() {
+				var entry data.HistoryEntry
+				if err := oldDb.ScanRows(rows, &entry); err != nil {
+					fmt.Fprintf(out, "Skipping unreadable row: %v\n", err)
+					continue
+				}
+				salvaged = append(salvaged, entry)
+			}
+			if err := rows.Err(); err != nil {
+				fmt.Fprintf(out, "Stopped reading the corrupted DB early: %v\n", err)
+			}
+			rows.Close()
+		} else {
+			fmt.Fprintf(out, "Failed to read from the corrupted DB: %v\n", err)
+		}
+		if sqlDb, err := oldDb.DB(); err == nil {
+			sqlDb.Close()
+		}
+	} else {
+		fmt.Fprintf(out, "Failed to open the corrupted DB: %v\n", err)
+	}
+
+	newDb, err := hctx.OpenLocalSqliteDb(config)
+	if err != nil {
+		return fmt.Errorf("failed to create a new DB: %w", err)
+	}
+	for _, entry := range salvaged {
+		AddToDbIfNew(newDb, entry)
+	}
+	fmt.Fprintf(out, "Salvaged %d history entries into a new DB\n", len(salvaged))
+	fmt.Fprintf(out, "Entries that couldn't be salvaged can be restored by running `hishtory reupload` on another device\n")
+	return nil
+}
+
+// RunDoctor checks the local hishtory install for problems and fixes the ones that it can. It returns the
+// number of problems that couldn't be automatically fixed.
+func RunDoctor(out io.Writer) (int, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	unfixedProblems := 0
+
+	fmt.Fprintln(out, "Checking the config...")
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the config, you may need to re-install hishtory with `hishtory install`: %w", err)
+	}
+	if config.UserSecret == "" || config.DeviceId == "" {
+		fmt.Fprintln(out, "  The config is missing a secret key or device ID, re-install hishtory with `hishtory install`")
+		unfixedProblems += 1
+	}
+
+	fmt.Fprintln(out, "Checking the DB integrity...")
+	dbPath := data.GetDbPath(homedir)
+	db, err := hctx.OpenSqliteDb(config, dbPath, "rwc")
+	var problems []string
+	if err != nil {
+		problems = []string{err.Error()}
+	} else {
+		problems, err = checkDbIntegrity(db)
+		if err != nil {
+			problems = []string{err.Error()}
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(out, "  Found DB corruption:\n    %s\n", strings.Join(problems, "\n    "))
+		if db != nil {
+			if sqlDb, err := db.DB(); err == nil {
+				sqlDb.Close()
+			}
+		}
+		if err := repairDb(out, config, homedir); err != nil {
+			return 0, err
+		}
+	}
+
+	db, err = hctx.OpenLocalSqliteDb(config)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintln(out, "Checkpointing the WAL, rebuilding indexes, and vacuuming the DB...")
+	for _, stmt := range []string{"PRAGMA wal_checkpoint(TRUNCATE)", "REINDEX", "VACUUM"} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return 0, fmt.Errorf("failed to run %#v: %w", stmt, err)
+		}
+	}
+	if problems, err := checkDbIntegrity(db); err != nil || len(problems) > 0 {
+		fmt.Fprintf(out, "  The DB is still corrupted after repairing it (err=%v): %s\n", err, strings.Join(problems, ", "))
+		unfixedProblems += 1
+	}
+
+	if !config.IsOffline {
+		fmt.Fprintln(out, "Syncing with the backend...")
+		ctx := hctx.WithHome(hctx.WithDb(hctx.WithConf(context.Background(), config), db), homedir)
+		if err := RetrieveAdditionalEntriesFromRemote(ctx); err != nil {
+			fmt.Fprintf(out, "  Failed to sync: %v\n", err)
+			unfixedProblems += 1
+		}
+	}
+
+	numQuarantined, err := countQuarantinedEntries(homedir)
+	if err != nil {
+		return 0, err
+	}
+	if numQuarantined > 0 {
+		fmt.Fprintf(out, "  %d history entries from the backend couldn't be decrypted and were quarantined in %s. This usually means they were encrypted by a device using a different secret key or encryption provider (see `hishtory encryption setup`).\n", numQuarantined, getQuarantinePath(homedir))
+		unfixedProblems += 1
+	}
+
+	return unfixedProblems, nil
+}
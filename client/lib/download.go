@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+)
+
+// The number of downloaded entries that a decryption worker decrypts at a time. Each chunk is inserted into the DB
+// as soon as it is decrypted, while the workers carry on decrypting the later chunks.
+const decryptionChunkSize = 500
+
+// numDecryptionWorkers returns the number of goroutines that downloaded entries are decrypted across. Decryption is
+// CPU bound, so there is no point in having more workers than there are CPUs for Go to run them on (see
+// BenchmarkDecryptEntries).
+func numDecryptionWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// A decryptionResult is a downloaded entry along with either its decrypted contents or the reason that it couldn't
+// be decrypted
+type decryptionResult struct {
+	encEntry *shared.EncHistoryEntry
+	entry    data.HistoryEntry
+	err      error
+}
+
+// decryptEntries decrypts entries across numWorkers goroutines, and calls handleChunk with the results of each chunk
+// of decryptionChunkSize entries once it is decrypted. Chunks are handled one at a time, but not necessarily in
+// order. If handleChunk returns an error, the remaining chunks are skipped and the error is returned.
+func decryptEntries(entries []*shared.EncHistoryEntry, decrypt func(shared.EncHistoryEntry) (data.HistoryEntry, error), numWorkers int, handleChunk func([]decryptionResult) error) error {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	chunks := make(chan []*shared.EncHistoryEntry)
+	results := make(chan []decryptionResult, numWorkers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(chunks)
+		for start := 0; start < len(entries); start += decryptionChunkSize {
+			select {
+			case chunks <- entries[start:min(start+decryptionChunkSize, len(entries))]:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				chunkResults := make([]decryptionResult, len(chunk))
+				for i, encEntry := range chunk {
+					entry, err := decrypt(*encEntry)
+					chunkResults[i] = decryptionResult{encEntry: encEntry, entry: entry, err: err}
+				}
+				select {
+				case results <- chunkResults:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for chunkResults := range results {
+		if err := handleChunk(chunkResults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeDownloadedEntries decrypts entries downloaded from the backend and inserts them into db, skipping the ones that
+// are already in it. Entries that can't be decrypted are quarantined (see quarantineEntry) so that a single bad entry
+// doesn't block syncing forever, and the number of them is returned.
+func storeDownloadedEntries(ctx context.Context, db *gorm.DB, entries []*shared.EncHistoryEntry, provider data.EncryptionProvider, userSecret string) (int, error) {
+	decrypt := func(entry shared.EncHistoryEntry) (data.HistoryEntry, error) {
+		return data.DecryptHistoryEntryWithProvider(provider, userSecret, entry)
+	}
+	numQuarantined := 0
+	err := decryptEntries(entries, decrypt, numDecryptionWorkers(), func(results []decryptionResult) error {
+		decEntries := make([]data.HistoryEntry, 0, len(results))
+		for _, result := range results {
+			if result.err != nil {
+				hctx.GetLogger().Warnf("failed to decrypt history entry from server, quarantining it: %v", result.err)
+				if err := quarantineEntry(ctx, *result.encEntry); err != nil {
+					return err
+				}
+				numQuarantined++
+				continue
+			}
+			decEntries = append(decEntries, result.entry)
+		}
+		return ReliableDbCreateInBatches(db, decEntries, decryptionChunkSize, nil)
+	})
+	return numQuarantined, err
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// EditEntryCommand replaces the command of entry (e.g. to fix a typo), and syncs the edit to all other devices.
+// The entry keeps its ID, so its tags and pins are kept too.
+func EditEntryCommand(ctx context.Context, entry data.HistoryEntry, command string) error {
+	if strings.TrimSpace(command) == "" {
+		return fmt.Errorf("the edited command can't be empty, use `hishtory redact` to delete the entry instead")
+	}
+	if command == entry.Command {
+		return nil
+	}
+	if err := unarchiveEntry(ctx, entry.DeviceId, entry.EndTime); err != nil {
+		return err
+	}
+	update := data.MetadataUpdate{Kind: data.MetadataUpdateEditCommand, DeviceId: entry.DeviceId, EndTime: entry.EndTime, Command: command}
+	if err := applyMetadataUpdate(hctx.GetDb(ctx), update); err != nil {
+		return err
+	}
+	if err := RecordAuditEvent(ctx, AuditActionEdit, "edited the command of 1 entry"); err != nil {
+		return err
+	}
+	return SendMetadataUpdates(ctx, []data.MetadataUpdate{update})
+}
+
+// prepareEditor writes command to a temp file, and returns the command that opens it in the user's editor. Once the
+// editor exits, finish must be called with the error from running it, and returns the edited command.
+func prepareEditor(command string) (cmd *exec.Cmd, finish func(runErr error) (string, error), err error) {
+	f, err := os.CreateTemp("", "hishtory-edit-*.sh")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp file for editing: %w", err)
+	}
+	_, err = f.WriteString(command + "\n")
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("failed to write temp file for editing: %w", err)
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd = exec.Command("sh", "-c", editor+" \"$1\"", "hishtory-editor", f.Name())
+	finish = func(runErr error) (string, error) {
+		defer os.Remove(f.Name())
+		if runErr != nil {
+			return "", fmt.Errorf("failed to run editor %#v: %w", editor, runErr)
+		}
+		edited, err := os.ReadFile(f.Name())
+		if err != nil {
+			return "", fmt.Errorf("failed to read edited command: %w", err)
+		}
+		return strings.TrimSuffix(string(edited), "\n"), nil
+	}
+	return cmd, finish, nil
+}
+
+// EditInEditor opens command in the user's editor, and returns the edited command
+func EditInEditor(command string) (string, error) {
+	cmd, finish, err := prepareEditor(command)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return finish(cmd.Run())
+}
+
+// startEditingEntry edits the command of the highlighted entry in place, rather than editing it before selecting
+// it like keys.EditEntry. Long and multi-line commands are opened in the user's editor.
+func startEditingEntry(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	if !isSearchingHistory(m.ctx) {
+		m.statusMessage = "Only entries in your shell history can be edited"
+		return m, nil
+	}
+	entry := m.tableEntries[m.table.Cursor()]
+	if len(entry.Command) <= MAX_INLINE_EDIT_LENGTH && !strings.Contains(entry.Command, "\n") {
+		m.isEditing = true
+		m.editingEntry = entry
+		m.queryInput.Blur()
+		m.editInput.SetValue(entry.Command)
+		m.editInput.CursorEnd()
+		m.editInput.Focus()
+		return m, textinput.Blink
+	}
+	return m, openInEditor(entry.Command, entry)
+}
+
+// saveEditedEntry saves the edited command of the entry that is being edited in place
+func saveEditedEntry(m model, entry *data.HistoryEntry, command string) (model, tea.Cmd) {
+	err := EditEntryCommand(m.ctx, *entry, command)
+	if IsOfflineError(err) {
+		m.isOffline = true
+	} else if err != nil && strings.TrimSpace(command) == "" {
+		m.statusMessage = err.Error()
+		return m, nil
+	} else if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	if command != entry.Command {
+		m.statusMessage = "Saved the edited command"
+	}
+	cursor := m.table.Cursor()
+	m = runQueryAndUpdateTable(m, true)
+	m.table.SetCursor(min(cursor, len(m.tableEntries)-1))
+	return m, nil
+}
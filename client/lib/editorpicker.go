@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// ServeEscapedPicker implements `hishtory picker --stdout-escaped`, a long-lived protocol that lets editors (e.g.
+// a Telescope or fzf-lua source in Neovim) search the history live as the user types:
+//
+//   - Each line read from in is the full current query.
+//   - For each query, up to limit matching entries are written to out in the same order as the TUI, one per line
+//     in the same escaped format as `hishtory query --fzf-source` (see FzfSourceColumns), followed by an empty
+//     line that marks the end of the results. Since the command is escaped and never empty, results are never
+//     empty lines.
+//   - If a query is invalid, the error is written to errOut and the results are empty.
+//   - Queries that are superseded by a newer query before they are run are skipped, so only the results for the
+//     latest query are written when the user types faster than the queries run.
+//
+// It returns once in is closed.
+func ServeEscapedPicker(ctx context.Context, in io.Reader, out, errOut io.Writer, limit int) error {
+	queries := make(chan string, 64)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			queries <- strings.TrimSuffix(scanner.Text(), "\r")
+		}
+		readErr <- scanner.Err()
+		close(queries)
+	}()
+
+	w := bufio.NewWriter(out)
+	for query := range queries {
+		query, isClosed := latestQuery(query, queries)
+		writeEscapedPickerResults(ctx, w, errOut, query, limit)
+		if err := w.Flush(); err != nil {
+			// The editor closed the pipe, so there is no one left to respond to
+			return nil
+		}
+		if isClosed {
+			break
+		}
+	}
+	if err := <-readErr; err != nil {
+		return fmt.Errorf("failed to read queries: %w", err)
+	}
+	return nil
+}
+
+// latestQuery skips over any queries that are already waiting in queries, since they supersede query. It also
+// returns whether queries was closed.
+func latestQuery(query string, queries <-chan string) (string, bool) {
+	for {
+		select {
+		case next, ok := <-queries:
+			if !ok {
+				return query, true
+			}
+			query = next
+		default:
+			return query, false
+		}
+	}
+}
+
+// writeEscapedPickerResults writes the results for a single query. Write errors are reported by the next Flush.
+func writeEscapedPickerResults(ctx context.Context, w io.Writer, errOut io.Writer, query string, limit int) {
+	results, err := getResultsProvider(ctx).search(ctx, query, searchCursor{}, limit)
+	if err != nil {
+		fmt.Fprintf(errOut, "Invalid query %#v: %v\n", query, err)
+		results = nil
+	}
+	lastCommand := ""
+	for _, entry := range results {
+		if hctx.GetConf(ctx).FilterDuplicateCommands && strings.TrimSpace(entry.Command) == strings.TrimSpace(lastCommand) {
+			continue
+		}
+		lastCommand = entry.Command
+		fmt.Fprintln(w, formatFzfLine(*entry))
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,372 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+)
+
+// The providers that synced entries can be encrypted with, see hctx.EncryptionConfig
+const (
+	EncryptionProviderSecret = "secret"
+	EncryptionProviderAge    = "age"
+	EncryptionProviderKms    = "kms"
+)
+
+var EncryptionProviders = []string{EncryptionProviderSecret, EncryptionProviderAge, EncryptionProviderKms}
+
+// How long the kms provider's data key is cached in memory for (e.g. by the agent), so that the KMS isn't called for
+// every recorded command. Revoking access to the KMS key takes effect once the cache expires.
+const kmsKeyCacheTtl = time.Hour
+
+// How long the kms provider's commands may take to wrap or unwrap the data key
+const kmsCommandTimeout = 30 * time.Second
+
+// A keyWrapper wraps (i.e. encrypts) and unwraps the random data key used by the age and kms providers
+type keyWrapper interface {
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrappedKey []byte) ([]byte, error)
+}
+
+// ageKeyWrapper wraps the data key to age recipients, and unwraps it with an age identity file
+type ageKeyWrapper struct {
+	identityFile string
+	// Defaults to the recipients of the identities in identityFile
+	recipients []string
+}
+
+func (w ageKeyWrapper) parseIdentities() ([]age.Identity, error) {
+	f, err := os.Open(w.identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the age identity file: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the age identity file %s: %w", w.identityFile, err)
+	}
+	return identities, nil
+}
+
+func (w ageKeyWrapper) Wrap(key []byte) ([]byte, error) {
+	var recipients []age.Recipient
+	if len(w.recipients) > 0 {
+		parsed, err := age.ParseRecipients(strings.NewReader(strings.Join(w.recipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the age recipients: %w", err)
+		}
+		recipients = parsed
+	} else {
+		identities, err := w.parseIdentities()
+		if err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				recipients = append(recipients, x25519.Recipient())
+			}
+		}
+	}
+	var wrapped bytes.Buffer
+	writer, err := age.Encrypt(&wrapped, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap the data key with age: %w", err)
+	}
+	if _, err := writer.Write(key); err != nil {
+		return nil, fmt.Errorf("failed to wrap the data key with age: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to wrap the data key with age: %w", err)
+	}
+	return wrapped.Bytes(), nil
+}
+
+func (w ageKeyWrapper) Unwrap(wrappedKey []byte) ([]byte, error) {
+	identities, err := w.parseIdentities()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := age.Decrypt(bytes.NewReader(wrappedKey), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key with %s: %w", w.identityFile, err)
+	}
+	return io.ReadAll(reader)
+}
+
+// kmsKeyWrapper wraps and unwraps the data key by running shell commands, typically the CLI of a cloud KMS (e.g.
+// `aws kms encrypt`). This supports any KMS without hishtory depending on every cloud provider's SDK.
+type kmsKeyWrapper struct {
+	encryptCommand string
+	decryptCommand string
+}
+
+func (w kmsKeyWrapper) Wrap(key []byte) ([]byte, error) {
+	if w.encryptCommand == "" {
+		return nil, fmt.Errorf("a KMS encrypt command is required to wrap a new data key")
+	}
+	return runKmsCommand(w.encryptCommand, key)
+}
+
+func (w kmsKeyWrapper) Unwrap(wrappedKey []byte) ([]byte, error) {
+	return runKmsCommand(w.decryptCommand, wrappedKey)
+}
+
+func runKmsCommand(command string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("the KMS command %#v failed (stderr=%#v): %w", command, stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func getKeyWrapper(config hctx.EncryptionConfig) (keyWrapper, error) {
+	switch config.Provider {
+	case EncryptionProviderAge:
+		return ageKeyWrapper{identityFile: config.AgeIdentityFile}, nil
+	case EncryptionProviderKms:
+		return kmsKeyWrapper{decryptCommand: config.KmsDecryptCommand}, nil
+	default:
+		return nil, fmt.Errorf("the %#v encryption provider doesn't use a data key", config.Provider)
+	}
+}
+
+// Unwrapped data keys, so that the data key is only unwrapped once per process. This is keyed by the entire config
+// rather than just the wrapped key, so that e.g. a different identity file has to unwrap the key itself.
+var dataKeyCache = make(map[hctx.EncryptionConfig]cachedDataKey)
+var dataKeyCacheMutex sync.Mutex
+
+type cachedDataKey struct {
+	key []byte
+	// Zero if the key doesn't expire
+	expiresAt time.Time
+}
+
+func init() {
+	hctx.RegisterAgentHandler("kms_data_key", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var config hctx.EncryptionConfig
+		if err := json.Unmarshal(args, &config); err != nil {
+			return nil, err
+		}
+		if config.Provider != EncryptionProviderKms {
+			return nil, fmt.Errorf("the agent only caches data keys for the kms provider, not %#v", config.Provider)
+		}
+		return unwrapDataKey(config)
+	})
+}
+
+// GetEncryptionProvider returns the provider that synced entries are encrypted with
+func GetEncryptionProvider(config hctx.ClientConfig) (data.EncryptionProvider, error) {
+	switch config.Encryption.Provider {
+	case "", EncryptionProviderSecret:
+		return data.SecretEncryptionProvider{UserSecret: config.UserSecret}, nil
+	case EncryptionProviderAge, EncryptionProviderKms:
+		key, err := getDataKey(config.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		return data.NewDataKeyEncryptionProvider(key)
+	default:
+		return nil, fmt.Errorf("unknown encryption provider %#v, must be one of %s (or run `hishtory update` if it was configured by a newer version of hishtory)", config.Encryption.Provider, strings.Join(EncryptionProviders, ", "))
+	}
+}
+
+func getDataKey(config hctx.EncryptionConfig) ([]byte, error) {
+	if config.Provider == EncryptionProviderKms && !hctx.IsAgentProcess() {
+		// The agent (if it is running) caches the key unwrapped by the KMS across processes, so that the KMS isn't
+		// called for every recorded command. It is only ever kept in memory, rather than being written to disk.
+		var key []byte
+		err := hctx.CallAgent(context.Background(), "kms_data_key", nil, config, &key)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, hctx.ErrAgentUnavailable) {
+			return nil, err
+		}
+	}
+	return unwrapDataKey(config)
+}
+
+// unwrapDataKey returns the unwrapped data key, which is cached in memory
+func unwrapDataKey(config hctx.EncryptionConfig) ([]byte, error) {
+	dataKeyCacheMutex.Lock()
+	defer dataKeyCacheMutex.Unlock()
+	if cached, ok := dataKeyCache[config]; ok && (cached.expiresAt.IsZero() || time.Now().Before(cached.expiresAt)) {
+		return cached.key, nil
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(config.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the wrapped data key: %w", err)
+	}
+	wrapper, err := getKeyWrapper(config)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wrapper.Unwrap(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != data.DataKeySize {
+		return nil, fmt.Errorf("the unwrapped data key has %d bytes rather than %d, check that it was wrapped by `hishtory encryption setup`", len(key), data.DataKeySize)
+	}
+	cached := cachedDataKey{key: key}
+	if config.Provider == EncryptionProviderKms {
+		cached.expiresAt = time.Now().Add(kmsKeyCacheTtl)
+	}
+	dataKeyCache[config] = cached
+	return key, nil
+}
+
+// EncryptionSetupOptions configures an encryption provider via SetupEncryption
+type EncryptionSetupOptions struct {
+	Provider string
+	// The wrapped data key from a device that already uses this provider. If this is empty, a new data key is
+	// generated, which means that this must be the first device to use the provider.
+	WrappedKey      string
+	AgeIdentityFile string
+	AgeRecipients   []string
+	// Only needed when generating a new data key
+	KmsEncryptCommand string
+	KmsDecryptCommand string
+}
+
+// SetupEncryption returns the config for the given encryption provider, after checking that the data key can be
+// unwrapped. Note that this doesn't save the config.
+func SetupEncryption(opts EncryptionSetupOptions) (hctx.EncryptionConfig, error) {
+	config := hctx.EncryptionConfig{Provider: opts.Provider}
+	var wrapper keyWrapper
+	switch opts.Provider {
+	case EncryptionProviderSecret:
+		return config, nil
+	case EncryptionProviderAge:
+		if opts.AgeIdentityFile == "" {
+			return config, fmt.Errorf("the age provider requires an identity file (e.g. one generated by age-keygen)")
+		}
+		identityFile, err := expandIdentityPath(opts.AgeIdentityFile)
+		if err != nil {
+			return config, err
+		}
+		config.AgeIdentityFile = identityFile
+		wrapper = ageKeyWrapper{identityFile: identityFile, recipients: opts.AgeRecipients}
+	case EncryptionProviderKms:
+		if opts.KmsDecryptCommand == "" {
+			return config, fmt.Errorf("the kms provider requires a command to decrypt the data key")
+		}
+		config.KmsDecryptCommand = opts.KmsDecryptCommand
+		wrapper = kmsKeyWrapper{encryptCommand: opts.KmsEncryptCommand, decryptCommand: opts.KmsDecryptCommand}
+	default:
+		return config, fmt.Errorf("unknown encryption provider %#v, must be one of %s", opts.Provider, strings.Join(EncryptionProviders, ", "))
+	}
+	if opts.WrappedKey != "" {
+		config.WrappedKey = strings.TrimSpace(opts.WrappedKey)
+	} else {
+		key := make([]byte, data.DataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return config, fmt.Errorf("failed to generate a data key: %w", err)
+		}
+		wrappedKey, err := wrapper.Wrap(key)
+		if err != nil {
+			return config, err
+		}
+		config.WrappedKey = base64.StdEncoding.EncodeToString(wrappedKey)
+	}
+	// Check that the key can be unwrapped now, rather than the next time an entry is synced
+	if _, err := getDataKey(config); err != nil {
+		return config, fmt.Errorf("failed to unwrap the data key: %w", err)
+	}
+	return config, nil
+}
+
+// JoinEncryptionCommand returns the command that sets up another device to use the same encryption provider
+func JoinEncryptionCommand(encryption hctx.EncryptionConfig) string {
+	args := []string{"hishtory", "encryption", "setup", encryption.Provider}
+	switch encryption.Provider {
+	case EncryptionProviderAge:
+		args = append(args, "--identity", shellQuote(encryption.AgeIdentityFile))
+	case EncryptionProviderKms:
+		args = append(args, "--decrypt-command", shellQuote(encryption.KmsDecryptCommand))
+	}
+	args = append(args, "--wrapped-key", encryption.WrappedKey)
+	return strings.Join(args, " ")
+}
+
+// expandIdentityPath makes the path of an age identity file absolute, so that it works from any directory
+func expandIdentityPath(p string) (string, error) {
+	if strings.HasPrefix(p, "~/") {
+		homedir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get homedir: %w", err)
+		}
+		p = filepath.Join(homedir, p[2:])
+	}
+	return filepath.Abs(p)
+}
+
+// RetryQuarantinedEntries tries to decrypt the quarantined entries again (e.g. after configuring the encryption
+// provider that they were encrypted with), and adds the ones that can now be decrypted to the DB. Returns the number
+// of recovered entries.
+func RetryQuarantinedEntries(ctx context.Context) (int, error) {
+	quarantinePath := getQuarantinePath(hctx.GetHome(ctx))
+	contents, err := os.ReadFile(quarantinePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read quarantine file: %w", err)
+	}
+	config := hctx.GetConf(ctx)
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return 0, err
+	}
+	db := hctx.GetDb(ctx)
+	var remaining bytes.Buffer
+	numRecovered := 0
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var encEntry shared.EncHistoryEntry
+		if err := json.Unmarshal(line, &encEntry); err == nil {
+			if entry, err := data.DecryptHistoryEntryWithProvider(provider, config.UserSecret, encEntry); err == nil {
+				AddToDbIfNew(db, entry)
+				numRecovered++
+				continue
+			}
+		}
+		remaining.Write(line)
+		remaining.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read quarantine file: %w", err)
+	}
+	if numRecovered == 0 {
+		return 0, nil
+	}
+	if remaining.Len() == 0 {
+		return numRecovered, os.Remove(quarantinePath)
+	}
+	return numRecovered, os.WriteFile(quarantinePath, remaining.Bytes(), 0o600)
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+const (
+	// The maximum number of environment variables that can be snapshotted, since they're stored with every entry
+	maxEnvSnapshotVariables = 32
+	// Values longer than this are truncated so that a large variable (e.g. a PEM certificate) doesn't bloat
+	// every entry
+	maxEnvSnapshotValueLength = 256
+)
+
+// ValidateEnvSnapshotVariables checks that the given allowlist of environment variables can be snapshotted
+func ValidateEnvSnapshotVariables(names []string) error {
+	if len(names) > maxEnvSnapshotVariables {
+		return fmt.Errorf("at most %d environment variables can be recorded, got %d", maxEnvSnapshotVariables, len(names))
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return fmt.Errorf("%#v is not a valid environment variable name", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("environment variable %#v is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// buildEnvironmentVariables snapshots the environment variables that are allowlisted in the config. Variables that
+// aren't set are skipped, so that `env:NAME=` can be used to find entries where a variable was set to "".
+func buildEnvironmentVariables(ctx context.Context) data.EnvironmentVariables {
+	var vars data.EnvironmentVariables
+	for _, name := range hctx.GetConf(ctx).EnvSnapshotVariables {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if len(val) > maxEnvSnapshotValueLength {
+			val = strings.ToValidUTF8(val[:maxEnvSnapshotValueLength], "")
+		}
+		vars = append(vars, data.EnvironmentVariable{Name: name, Val: val})
+		if len(vars) == maxEnvSnapshotVariables {
+			break
+		}
+	}
+	return vars
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// The columns output by `hishtory query --fzf-source`, in order. This is a stable interface that
+// users' fzf bindings rely on, so new columns may only ever be appended to the end.
+var FzfSourceColumns = []string{"Command", "Hostname", "CWD", "Timestamp", "Runtime", "Exit Code"}
+
+// WriteFzfSource streams all history entries matching the query as tab-separated lines suitable for
+// consumption by fzf. The command is always the first field and the remaining fields are metadata
+// intended for use in fzf's --preview.
+func WriteFzfSource(ctx context.Context, out io.Writer, query string) error {
+	return writeFzfEntries(ctx, out, query, formatFzfLine)
+}
+
+func writeFzfEntries(ctx context.Context, out io.Writer, query string, formatLine func(data.HistoryEntry) string) error {
+	w := bufio.NewWriter(out)
+	lastCommand := ""
+	closed, err := streamFzfEntries(ctx, hctx.GetDb(ctx), w, query, formatLine, &lastCommand)
+	if err != nil || closed {
+		return err
+	}
+	// Archived entries are all older than the entries in the main DB, so they are streamed afterwards
+	if hasColdStorage(ctx) {
+		err = withColdStorage(ctx, func(conn *gorm.DB) error {
+			closed, err = streamFzfEntries(ctx, conn.Table(hctx.ColdHistoryTable), w, query, formatLine, &lastCommand)
+			return err
+		})
+		if err != nil || closed {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// streamFzfEntries writes the entries in db matching query to w, and returns whether w was closed
+func streamFzfEntries(ctx context.Context, db *gorm.DB, w *bufio.Writer, query string, formatLine func(data.HistoryEntry) string, lastCommand *string) (bool, error) {
+	config := hctx.GetConf(ctx)
+	tx, err := MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return false, err
+	}
+	rows, err := tx.Order("end_time DESC").Rows()
+	if err != nil {
+		return false, fmt.Errorf("DB query error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry data.HistoryEntry
+		if err := tx.ScanRows(rows, &entry); err != nil {
+			return false, fmt.Errorf("failed to scan history entry: %w", err)
+		}
+		if config.FilterDuplicateCommands && strings.TrimSpace(entry.Command) == strings.TrimSpace(*lastCommand) {
+			continue
+		}
+		*lastCommand = entry.Command
+		if _, err := w.WriteString(formatLine(entry) + "\n"); err != nil {
+			// The most common cause of this is fzf exiting and closing the pipe, so there is no need to report it
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to iterate over history entries: %w", err)
+	}
+	return false, nil
+}
+
+func formatFzfLine(entry data.HistoryEntry) string {
+	fields := []string{
+		escapeFzfField(entry.Command),
+		escapeFzfField(entry.Hostname),
+		escapeFzfField(entry.CurrentWorkingDirectory),
+		entry.StartTime.Format(time.RFC3339),
+		entry.EndTime.Sub(entry.StartTime).Round(time.Millisecond).String(),
+		fmt.Sprintf("%d", entry.ExitCode),
+	}
+	return strings.Join(fields, "\t")
+}
+
+// escapeFzfField escapes the characters that would otherwise break the one-entry-per-line,
+// tab-separated format. The command can be restored via `printf '%b'`.
+func escapeFzfField(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	s = strings.ReplaceAll(s, "\t", "\\t")
+	return s
+}
@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// GenerateOptions configures the synthetic history generated by GenerateHistory
+type GenerateOptions struct {
+	NumEntries int
+	// The same seed (and options) always generates the same history
+	Seed     int64
+	NumHosts int
+}
+
+// Generated history starts at a fixed time rather than relative to now, so that it is the same every time
+var generatedHistoryStart = time.Date(2023, 1, 2, 9, 0, 0, 0, time.UTC)
+
+// A command that is generated with the given relative weight. Placeholders like {file} are replaced with a random
+// value from generatedWords, and commands starting with "cd " change the directory of later commands in the session.
+type generatedCommand struct {
+	template string
+	weight   int
+	// The typical runtime of the command, in seconds
+	runtime float64
+	// The chance that the command fails
+	failureRate float64
+}
+
+var generatedCommands = []generatedCommand{
+	{"git status", 20, 0.1, 0.01},
+	{"ls", 15, 0.05, 0.01},
+	{"cd {dir}", 12, 0.01, 0.03},
+	{"git diff", 8, 0.3, 0},
+	{"vim {file}", 8, 120, 0.01},
+	{"ls -la", 6, 0.05, 0.01},
+	{"git add {file}", 6, 0.1, 0.02},
+	{"git commit -m '{message}'", 6, 0.5, 0.05},
+	{"git checkout {branch}", 5, 0.3, 0.1},
+	{"cat {file}", 5, 0.05, 0.03},
+	{"make", 5, 20, 0.15},
+	{"go test ./...", 5, 30, 0.2},
+	{"git push", 4, 2, 0.05},
+	{"git pull", 4, 2, 0.05},
+	{"grep -rn {word} .", 4, 0.5, 0.3},
+	{"make test", 4, 45, 0.2},
+	{"go build ./...", 4, 10, 0.1},
+	{"git log --oneline", 3, 2, 0},
+	{"npm run dev", 3, 300, 0.05},
+	{"docker ps", 3, 0.3, 0.02},
+	{"kubectl get pods -n {namespace}", 3, 1, 0.05},
+	{"ssh {host}", 3, 600, 0.05},
+	{"curl -s https://{host}/api/{word}", 3, 0.5, 0.1},
+	{"python3 {script}", 3, 5, 0.15},
+	{"npm install", 2, 40, 0.05},
+	{"docker compose up -d", 2, 15, 0.05},
+	{"kubectl logs {pod} -n {namespace}", 2, 2, 0.05},
+	{"tail -f /var/log/{log}", 1, 60, 0},
+	{"terraform plan", 1, 20, 0.1},
+	{"rm {file}", 1, 0.01, 0.05},
+	{"htop", 1, 30, 0},
+}
+
+var generatedWords = map[string][]string{
+	"dir":       {"..", "~", "src", "cmd", "internal", "docs", "scripts", "/tmp", "/etc"},
+	"file":      {"main.go", "README.md", "Makefile", "go.mod", "config.yaml", "index.ts", "package.json", "notes.txt", ".env"},
+	"message":   {"Fix typo", "Add tests", "Update dependencies", "Refactor config loading", "WIP", "Bump version", "Handle empty input"},
+	"branch":    {"main", "master", "dev", "fix-login", "feature/search", "release-1.2"},
+	"word":      {"TODO", "error", "config", "users", "health", "version", "timeout"},
+	"namespace": {"default", "payments", "monitoring", "staging"},
+	"host":      {"api.example.com", "db.internal", "10.0.0.5", "build.example.com", "localhost:8080"},
+	"pod":       {"web-7d9f8-abcde", "worker-5c4b-xyz12", "redis-0", "postgres-0"},
+	"script":    {"manage.py migrate", "train.py --epochs 10", "scripts/backfill.py", "-m http.server"},
+	"log":       {"syslog", "nginx/access.log", "nginx/error.log", "auth.log"},
+}
+
+var generatedHostnames = []string{"laptop", "devbox", "build-01", "web-01", "db-01", "desktop"}
+
+var generatedProjects = []string{"hishtory", "website", "infra", "api", "dotfiles", "ml-experiments"}
+
+var generatedExitCodes = []int{1, 1, 1, 2, 127, 130}
+
+// GenerateHistory generates realistic synthetic history entries, for benchmarks, stress testing the TUI, and
+// reproducing performance issues. Entries are grouped into shell sessions on a few hosts, with commands drawn from a
+// weighted distribution of common commands.
+func GenerateHistory(opts GenerateOptions) ([]data.HistoryEntry, error) {
+	if opts.NumEntries < 0 {
+		return nil, fmt.Errorf("the number of entries can't be negative")
+	}
+	if opts.NumHosts < 1 {
+		return nil, fmt.Errorf("at least one host is required")
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	hosts := make([]string, opts.NumHosts)
+	deviceIds := make([]string, opts.NumHosts)
+	for i := range hosts {
+		if i < len(generatedHostnames) {
+			hosts[i] = generatedHostnames[i]
+		} else {
+			hosts[i] = fmt.Sprintf("host-%02d", i+1)
+		}
+		deviceId, err := uuid.NewRandomFromReader(rng)
+		if err != nil {
+			return nil, err
+		}
+		deviceIds[i] = deviceId.String()
+	}
+	totalWeight := 0
+	for _, c := range generatedCommands {
+		totalWeight += c.weight
+	}
+
+	entries := make([]data.HistoryEntry, 0, opts.NumEntries)
+	t := generatedHistoryStart
+	for len(entries) < opts.NumEntries {
+		// Most commands are run on the first couple of hosts
+		hostIdx := int(math.Min(float64(len(hosts)-1), rng.ExpFloat64()*1.5))
+		homedir := "/home/david"
+		username := "david"
+		if hostIdx > 1 && rng.Float64() < 0.3 {
+			homedir, username = "/root", "root"
+		}
+		cwd := path.Join(homedir, "code", generatedProjects[rng.Intn(len(generatedProjects))])
+		shellPid := 1000 + rng.Intn(60000)
+		sessionLength := 1 + int(rng.ExpFloat64()*40)
+		for i := 0; i < sessionLength && len(entries) < opts.NumEntries; i++ {
+			c := pickGeneratedCommand(rng, totalWeight)
+			command := fillGeneratedCommand(rng, c.template)
+			runtime := time.Duration(c.runtime * math.Exp(rng.NormFloat64()*0.75) * float64(time.Second))
+			exitCode := 0
+			if rng.Float64() < c.failureRate {
+				exitCode = generatedExitCodes[rng.Intn(len(generatedExitCodes))]
+			}
+			entries = append(entries, data.HistoryEntry{
+				LocalUsername:           username,
+				Hostname:                hosts[hostIdx],
+				Command:                 command,
+				CurrentWorkingDirectory: cwd,
+				HomeDirectory:           homedir,
+				ExitCode:                exitCode,
+				StartTime:               t,
+				EndTime:                 t.Add(runtime),
+				DeviceId:                deviceIds[hostIdx],
+				AsRoot:                  username == "root",
+				ShellMode:               "interactive",
+				ShellLevel:              1,
+				ShellPid:                shellPid,
+			})
+			if exitCode == 0 && strings.HasPrefix(command, "cd ") {
+				cwd = changeGeneratedDir(cwd, homedir, strings.TrimPrefix(command, "cd "))
+			}
+			// The time spent thinking before the next command, which is at least a second so that every entry
+			// has a distinct start time
+			t = t.Add(runtime + time.Second + time.Duration(rng.ExpFloat64()*20*float64(time.Second)))
+		}
+		// The gap before the next session
+		t = t.Add(time.Duration(rng.ExpFloat64() * float64(2*time.Hour)))
+	}
+	return entries, nil
+}
+
+func pickGeneratedCommand(rng *rand.Rand, totalWeight int) generatedCommand {
+	n := rng.Intn(totalWeight)
+	for _, c := range generatedCommands {
+		if n < c.weight {
+			return c
+		}
+		n -= c.weight
+	}
+	return generatedCommands[len(generatedCommands)-1]
+}
+
+func fillGeneratedCommand(rng *rand.Rand, template string) string {
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			return template
+		}
+		end := strings.Index(template[start:], "}") + start
+		words := generatedWords[template[start+1:end]]
+		template = template[:start] + words[rng.Intn(len(words))] + template[end+1:]
+	}
+}
+
+func changeGeneratedDir(cwd, homedir, dir string) string {
+	switch {
+	case dir == "~":
+		return homedir
+	case path.IsAbs(dir):
+		return dir
+	default:
+		return path.Join(cwd, dir)
+	}
+}
+
+// InsertGeneratedHistory saves generated entries to the local DB, without uploading them. Entries that are already
+// in the DB (e.g. from generating history with the same seed again) are skipped, and the number of new entries is
+// returned.
+func InsertGeneratedHistory(ctx context.Context, entries []data.HistoryEntry) (int64, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	// Small batches are much faster than large ones, since binding parameters is quadratic in the number of
+	// parameters in the sqlite driver
+	// Entries are inserted via a trigger on the history_entries view, which sqlite doesn't count as affected rows, so
+	// the number of new entries is counted instead
+	db := hctx.GetDb(ctx)
+	var before, after int64
+	if err := db.Model(&data.HistoryEntry{}).Count(&before).Error; err != nil {
+		return 0, fmt.Errorf("failed to count entries: %w", err)
+	}
+	if err := db.Clauses(clause.Insert{Modifier: "OR IGNORE"}).CreateInBatches(entries, 100).Error; err != nil {
+		return 0, fmt.Errorf("failed to insert the generated entries: %w", err)
+	}
+	if err := db.Model(&data.HistoryEntry{}).Count(&after).Error; err != nil {
+		return 0, fmt.Errorf("failed to count entries: %w", err)
+	}
+	return after - before, nil
+}
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// A hostname that was used by a device, along with when it was used
+type HostnameRecord struct {
+	DeviceId  string
+	Hostname  string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     int64
+}
+
+// GetHostnameHistory returns every hostname that each device has recorded history entries under, so that
+// renamed machines can be identified.
+func GetHostnameHistory(ctx context.Context) ([]HostnameRecord, error) {
+	rows, err := hctx.GetDb(ctx).Model(&data.HistoryEntry{}).
+		Select("device_id, hostname, MIN(start_time), MAX(end_time), COUNT(*)").
+		Group("device_id, hostname").
+		Order("device_id, MIN(start_time)").
+		Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hostname history: %w", err)
+	}
+	defer rows.Close()
+	records := make([]HostnameRecord, 0)
+	for rows.Next() {
+		var record HostnameRecord
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&record.DeviceId, &record.Hostname, &firstSeen, &lastSeen, &record.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan hostname history: %w", err)
+		}
+		record.FirstSeen, err = parseSqliteTime(firstSeen)
+		if err != nil {
+			return nil, err
+		}
+		record.LastSeen, err = parseSqliteTime(lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// parseSqliteTime parses a timestamp returned by an aggregate function, since those aren't converted into
+// a time.Time by the sqlite driver
+func parseSqliteTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse timestamp %#v from the DB", s)
+}
+
+var (
+	deviceHostnamesMutex sync.Mutex
+	deviceHostnames      map[string]string
+)
+
+// getDeviceHostname returns the most recent hostname used by the device that recorded the given entry, so
+// that entries from renamed machines are all displayed under the machine's current name.
+func getDeviceHostname(ctx context.Context, entry data.HistoryEntry) string {
+	deviceHostnamesMutex.Lock()
+	defer deviceHostnamesMutex.Unlock()
+	if deviceHostnames == nil {
+		deviceHostnames = make(map[string]string)
+		// Note that SQLite returns the hostname from the row with the maximum end_time
+		rows, err := hctx.GetDb(ctx).Model(&data.HistoryEntry{}).Select("device_id, hostname, MAX(end_time)").Group("device_id").Rows()
+		if err != nil {
+			hctx.GetLogger().Warnf("failed to query device hostnames: %v", err)
+			return entry.Hostname
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var deviceId, hostname string
+			var endTime interface{}
+			if err := rows.Scan(&deviceId, &hostname, &endTime); err != nil {
+				hctx.GetLogger().Warnf("failed to scan device hostnames: %v", err)
+				return entry.Hostname
+			}
+			deviceHostnames[deviceId] = hostname
+		}
+	}
+	if hostname, ok := deviceHostnames[entry.DeviceId]; ok && entry.DeviceId != "" {
+		return hostname
+	}
+	return entry.Hostname
+}
+
+// MergeHostnames rewrites the hostname of all local history entries recorded under oldHostname to be
+// newHostname. Returns the number of updated entries.
+func MergeHostnames(ctx context.Context, oldHostname, newHostname string) (int64, error) {
+	// Hostnames are stored in the hostnames table in the main DB, so entries are merged by pointing them at the new
+	// hostname's row
+	var numUpdated int64
+	err := hctx.GetDb(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("INSERT INTO hostnames (hostname) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM hostnames WHERE hostname = ?)", newHostname, newHostname).Error; err != nil {
+			return err
+		}
+		res := tx.Exec("UPDATE OR IGNORE "+hctx.HistoryEntryRowsTable+" SET hostname_ref = (SELECT id FROM hostnames WHERE hostname = ?) WHERE hostname_ref = (SELECT id FROM hostnames WHERE hostname = ?)", newHostname, oldHostname)
+		numUpdated = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge hostnames: %w", err)
+	}
+	if hasColdStorage(ctx) {
+		err := withColdStorage(ctx, func(conn *gorm.DB) error {
+			res := conn.Exec("UPDATE OR IGNORE cold.history_entries SET hostname = ? WHERE hostname = ?", newHostname, oldHostname)
+			numUpdated += res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to merge hostnames of archived entries: %w", err)
+		}
+	}
+	deviceHostnamesMutex.Lock()
+	deviceHostnames = nil
+	deviceHostnamesMutex.Unlock()
+	return numUpdated, nil
+}
@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+)
+
+const (
+	// Journals for days older than this are skipped if they weren't published (e.g. because hishtory wasn't used
+	// for a while), rather than publishing a flood of them at once
+	maxJournalCatchUpDays = 7
+	// How long to wait before retrying after publishing failed
+	journalPublishRetryInterval = time.Hour
+	// The version of the Notion API that the requests are written for
+	notionApiVersion = "2022-06-28"
+	// Notion limits the number of blocks that can be added per request, and the length of each piece of text
+	notionMaxBlocksPerRequest = 100
+	notionMaxTextLength       = 2000
+)
+
+// The base URL of the Notion API, overridden in tests
+var notionApiUrl = "https://api.notion.com"
+
+// A journalPublisher publishes the rendered journal for a day
+type journalPublisher func(ctx context.Context, day time.Time, journal string) error
+
+// MaybePublishJournals publishes the journals for the days that have ended since they were last published to each
+// of the configured integrations. This is run periodically by the built-in scheduler, so that journals are published
+// daily without requiring a cron job. Failures are logged and retried later rather than returned, so that an
+// unreachable integration doesn't break recording commands.
+func MaybePublishJournals(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	integrations := config.Integrations
+	if !integrations.IsEnabled() {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(integrations.LastPublishFailureTimestamp, 0)) < journalPublishRetryInterval {
+		return nil
+	}
+	var err error
+	if integrations.Obsidian != nil {
+		obsidian := *integrations.Obsidian
+		err = publishPendingJournals(ctx, "Obsidian", obsidian.LastPublishedDate, now, func(ctx context.Context, day time.Time, journal string) error {
+			return publishToObsidian(ctx, obsidian, day, journal)
+		}, func(config *hctx.ClientConfig, day string) {
+			if config.Integrations.Obsidian != nil {
+				config.Integrations.Obsidian.LastPublishedDate = day
+			}
+		})
+	}
+	if integrations.Notion != nil && err == nil {
+		notion := *integrations.Notion
+		err = publishPendingJournals(ctx, "Notion", notion.LastPublishedDate, now, func(ctx context.Context, day time.Time, journal string) error {
+			return publishToNotion(ctx, notion, day, journal)
+		}, func(config *hctx.ClientConfig, day string) {
+			if config.Integrations.Notion != nil {
+				config.Integrations.Notion.LastPublishedDate = day
+			}
+		})
+	}
+	if err != nil {
+		hctx.GetLogger().Warnf("Failed to publish journals, will retry in %s: %v", journalPublishRetryInterval, err)
+		return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.Integrations.LastPublishFailureTimestamp = now.Unix()
+		})
+	}
+	return nil
+}
+
+// publishPendingJournals publishes the journal for each day after lastPublished that has ended, recording each
+// day once it is published so that it isn't published twice
+func publishPendingJournals(ctx context.Context, name, lastPublished string, now time.Time, publish journalPublisher, recordPublished func(config *hctx.ClientConfig, day string)) error {
+	for _, day := range pendingJournalDays(lastPublished, now) {
+		journal, err := BuildJournal(ctx, day, JournalGroupByProject, "")
+		if err != nil {
+			return err
+		}
+		// Days without any commands are skipped rather than publishing empty journals
+		if len(journal.Groups) > 0 {
+			rendered, err := RenderJournal(journal, hctx.GetConf(ctx).JournalTemplate)
+			if err != nil {
+				return err
+			}
+			if err := publish(ctx, day, rendered); err != nil {
+				return fmt.Errorf("failed to publish the journal for %s to %s: %w", day.Format("2006-01-02"), name, err)
+			}
+			hctx.GetLogger().Infof("Published the journal for %s to %s", day.Format("2006-01-02"), name)
+		}
+		err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			recordPublished(config, day.Format("2006-01-02"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingJournalDays returns the days that have ended since lastPublished (in the format 2006-01-02), oldest
+// first. If nothing was published yet, only yesterday is pending.
+func pendingJournalDays(lastPublished string, now time.Time) []time.Time {
+	yesterday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -1)
+	start := yesterday
+	if last, err := time.ParseInLocation("2006-01-02", lastPublished, time.Local); err == nil {
+		start = last.AddDate(0, 0, 1)
+	}
+	if earliest := yesterday.AddDate(0, 0, -(maxJournalCatchUpDays - 1)); start.Before(earliest) {
+		start = earliest
+	}
+	days := make([]time.Time, 0)
+	for day := start; !day.After(yesterday); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// PublishJournal publishes an already rendered journal for the given day to all of the configured integrations
+func PublishJournal(ctx context.Context, day time.Time, journal string) error {
+	integrations := hctx.GetConf(ctx).Integrations
+	if !integrations.IsEnabled() {
+		return fmt.Errorf("no integrations are configured, see `hishtory config-set obsidian-folder` and `hishtory config-set notion-database`")
+	}
+	if integrations.Obsidian != nil {
+		if err := publishToObsidian(ctx, *integrations.Obsidian, day, journal); err != nil {
+			return fmt.Errorf("failed to publish to Obsidian: %w", err)
+		}
+	}
+	if integrations.Notion != nil {
+		if err := publishToNotion(ctx, *integrations.Notion, day, journal); err != nil {
+			return fmt.Errorf("failed to publish to Notion: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishToObsidian appends the journal to the day's note in the vault, creating it if it doesn't exist yet
+func publishToObsidian(ctx context.Context, obsidian hctx.ObsidianIntegration, day time.Time, journal string) error {
+	fileNameFormat := obsidian.FileNameFormat
+	if fileNameFormat == "" {
+		fileNameFormat = "2006-01-02.md"
+	}
+	folder := obsidian.Folder
+	if strings.HasPrefix(folder, "~/") {
+		folder = filepath.Join(hctx.GetHome(ctx), folder[2:])
+	}
+	path := filepath.Join(folder, day.Format(fileNameFormat))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create the folder for %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if stat.Size() > 0 {
+		// Separate the journal from the existing contents of the note
+		journal = "\n" + journal
+	}
+	if _, err := f.WriteString(journal); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", path, err)
+	}
+	return nil
+}
+
+// publishToNotion adds a page with the journal to the Notion database. The Markdown is converted into Notion
+// blocks, see markdownToNotionBlocks.
+func publishToNotion(ctx context.Context, notion hctx.NotionIntegration, day time.Time, journal string) error {
+	titleProperty := notion.TitleProperty
+	if titleProperty == "" {
+		titleProperty = "Name"
+	}
+	blocks := markdownToNotionBlocks(journal)
+	chunks := shared.Chunks(blocks, notionMaxBlocksPerRequest)
+	if len(chunks) == 0 {
+		chunks = [][]notionBlock{{}}
+	}
+	page := map[string]interface{}{
+		"parent": map[string]string{"database_id": notion.DatabaseId},
+		"properties": map[string]interface{}{
+			titleProperty: map[string]interface{}{"title": notionRichText(day.Format("2006-01-02"))},
+		},
+		"children": chunks[0],
+	}
+	var createdPage struct {
+		Id string `json:"id"`
+	}
+	if err := notionRequest(ctx, notion.Token, http.MethodPost, "/v1/pages", page, &createdPage); err != nil {
+		return err
+	}
+	for _, chunk := range chunks[1:] {
+		err := notionRequest(ctx, notion.Token, http.MethodPatch, "/v1/blocks/"+createdPage.Id+"/children", map[string]interface{}{"children": chunk}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func notionRequest(ctx context.Context, token, method, path string, body, response interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the request to %s: %w", path, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, notionApiUrl+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create the request to %s: %w", path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Notion-Version", notionApiVersion)
+	req.Header.Set("Content-Type", "application/json")
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response from %s %s: %w", method, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var notionErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &notionErr) == nil && notionErr.Message != "" {
+			return fmt.Errorf("failed to %s %s: status_code=%d: %s", method, path, resp.StatusCode, notionErr.Message)
+		}
+		return fmt.Errorf("failed to %s %s: status_code=%d", method, path, resp.StatusCode)
+	}
+	if response != nil {
+		if err := json.Unmarshal(respBody, response); err != nil {
+			return fmt.Errorf("failed to parse the response from %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+type notionBlock map[string]interface{}
+
+func newNotionBlock(blockType string, content map[string]interface{}) notionBlock {
+	return notionBlock{"object": "block", "type": blockType, blockType: content}
+}
+
+// markdownToNotionBlocks converts the subset of Markdown that journals are typically written in (headings, list
+// items, paragraphs, inline code, and fenced code blocks) into Notion blocks
+func markdownToNotionBlocks(markdown string) []notionBlock {
+	blocks := make([]notionBlock, 0)
+	lines := strings.Split(markdown, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "```"):
+			// Fenced code blocks may be indented to nest them in a list item (see markdownCode)
+			indent := strings.Repeat(" ", len(lines[i])-len(strings.TrimLeft(lines[i], " ")))
+			fence := line[:len(line)-len(strings.TrimLeft(line, "`"))]
+			code := make([]string, 0)
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != fence; i++ {
+				code = append(code, strings.TrimPrefix(lines[i], indent))
+			}
+			blocks = append(blocks, newNotionBlock("code", map[string]interface{}{"rich_text": notionText(strings.Join(code, "\n"), false), "language": "shell"}))
+		case strings.HasPrefix(line, "# "):
+			blocks = append(blocks, newNotionBlock("heading_1", map[string]interface{}{"rich_text": notionRichText(line[2:])}))
+		case strings.HasPrefix(line, "## "):
+			blocks = append(blocks, newNotionBlock("heading_2", map[string]interface{}{"rich_text": notionRichText(line[3:])}))
+		case strings.HasPrefix(line, "### "):
+			blocks = append(blocks, newNotionBlock("heading_3", map[string]interface{}{"rich_text": notionRichText(line[4:])}))
+		case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+			blocks = append(blocks, newNotionBlock("bulleted_list_item", map[string]interface{}{"rich_text": notionRichText(line[2:])}))
+		default:
+			blocks = append(blocks, newNotionBlock("paragraph", map[string]interface{}{"rich_text": notionRichText(line)}))
+		}
+	}
+	return blocks
+}
+
+// notionRichText converts a line of Markdown text into Notion rich text, formatting inline code spans as code
+func notionRichText(text string) []map[string]interface{} {
+	richText := make([]map[string]interface{}, 0)
+	for text != "" {
+		start := strings.Index(text, "`")
+		if start == -1 {
+			break
+		}
+		fence := text[start : start+len(text[start:])-len(strings.TrimLeft(text[start:], "`"))]
+		end := strings.Index(text[start+len(fence):], fence)
+		if end == -1 {
+			break
+		}
+		code := text[start+len(fence) : start+len(fence)+end]
+		if strings.HasPrefix(code, " ") && strings.HasSuffix(code, " ") && strings.TrimSpace(code) != "" {
+			code = code[1 : len(code)-1]
+		}
+		richText = append(richText, notionText(text[:start], false)...)
+		richText = append(richText, notionText(code, true)...)
+		text = text[start+len(fence)+end+len(fence):]
+	}
+	return append(richText, notionText(text, false)...)
+}
+
+// notionText returns the rich text objects for plain or code text, split to fit within Notion's length limit
+func notionText(text string, isCode bool) []map[string]interface{} {
+	richText := make([]map[string]interface{}, 0)
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := len(runes)
+		if n > notionMaxTextLength {
+			n = notionMaxTextLength
+		}
+		richText = append(richText, map[string]interface{}{
+			"type":        "text",
+			"text":        map[string]string{"content": string(runes[:n])},
+			"annotations": map[string]bool{"code": isCode},
+		})
+		runes = runes[n:]
+	}
+	return richText
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The ways that `hishtory journal` can group entries
+const (
+	JournalGroupByProject = "project"
+	JournalGroupBySession = "session"
+)
+
+// DefaultJournalTemplate is used to render journals if ClientConfig.JournalTemplate is unset. See JournalData for
+// the fields that are available to templates.
+const DefaultJournalTemplate = `## {{ .Date.Format "2006-01-02" }}
+{{ range .Groups }}
+### {{ .Name }}
+
+{{ range .Entries }}- {{ .StartTime.Format "15:04" }} {{ code .Command }}{{ if ne .ExitCode 0 }} (exit code {{ .ExitCode }}){{ end }}
+{{ end }}{{ end }}`
+
+// JournalData is the data that journal templates are rendered with
+type JournalData struct {
+	// The start of the day that the journal covers, in the local time zone
+	Date   time.Time
+	Groups []JournalGroup
+}
+
+// JournalGroup is the entries from a single project or session, oldest first
+type JournalGroup struct {
+	Name    string
+	Entries []*data.HistoryEntry
+}
+
+// BuildJournal returns the entries that were started on the given day and match query, grouped by groupBy
+// (either JournalGroupByProject or JournalGroupBySession). Groups are ordered by their first entry.
+func BuildJournal(ctx context.Context, day time.Time, groupBy, query string) (*JournalData, error) {
+	if groupBy != JournalGroupByProject && groupBy != JournalGroupBySession {
+		return nil, fmt.Errorf("unknown grouping %#v, expected %#v or %#v", groupBy, JournalGroupByProject, JournalGroupBySession)
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 0, 1)
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*data.HistoryEntry
+	err = tx.Where("CAST(strftime(\"%s\",start_time) AS INTEGER) >= ? AND CAST(strftime(\"%s\",start_time) AS INTEGER) < ?", start.Unix(), end.Unix()).
+		Order("start_time ASC").Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history entries: %w", err)
+	}
+	journal := JournalData{Date: start}
+	groupIndexes := make(map[string]int)
+	projects := make(map[string]string)
+	for _, entry := range entries {
+		entry.StartTime = entry.StartTime.Local()
+		entry.EndTime = entry.EndTime.Local()
+		var name string
+		if groupBy == JournalGroupBySession {
+			name = getJournalSession(entry)
+		} else {
+			key := entry.HomeDirectory + "\x00" + entry.CurrentWorkingDirectory
+			project, ok := projects[key]
+			if !ok {
+				project = getJournalProject(entry)
+				projects[key] = project
+			}
+			name = project
+		}
+		idx, ok := groupIndexes[name]
+		if !ok {
+			idx = len(journal.Groups)
+			groupIndexes[name] = idx
+			journal.Groups = append(journal.Groups, JournalGroup{Name: name})
+		}
+		journal.Groups[idx].Entries = append(journal.Groups[idx].Entries, entry)
+	}
+	return &journal, nil
+}
+
+// getJournalProject returns the project that an entry was run in, which is the root of the git repository
+// containing its working directory, or the working directory itself if it isn't in a repository (or doesn't
+// exist on this device)
+func getJournalProject(entry *data.HistoryEntry) string {
+	cwd := entry.CurrentWorkingDirectory
+	if strings.HasPrefix(cwd, "~") && entry.HomeDirectory != "" {
+		cwd = filepath.Join(entry.HomeDirectory, strings.TrimPrefix(cwd, "~"))
+	}
+	for dir := filepath.Clean(cwd); filepath.IsAbs(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			if entry.HomeDirectory != "" {
+				return abbreviateHomeDir(dir, entry.HomeDirectory)
+			}
+			return dir
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return entry.CurrentWorkingDirectory
+}
+
+// getJournalSession returns the shell session that an entry was run in, identified by its hostname and the PID
+// of the shell
+func getJournalSession(entry *data.HistoryEntry) string {
+	if entry.ShellPid == 0 {
+		return entry.Hostname
+	}
+	return entry.Hostname + " (pid " + strconv.Itoa(entry.ShellPid) + ")"
+}
+
+// RenderJournal renders the journal with the given text/template, or DefaultJournalTemplate if it is empty
+func RenderJournal(journal *JournalData, tmpl string) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultJournalTemplate
+	}
+	t, err := template.New("journal").Funcs(template.FuncMap{"code": markdownCode}).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the journal template: %w", err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, journal); err != nil {
+		return "", fmt.Errorf("failed to render the journal template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// markdownCode formats a command as Markdown code. Single-line commands are inline code, and multi-line commands
+// are fenced code blocks, indented so that they're nested in the list item that they're part of. The backticks
+// are always longer than any run of backticks in the command.
+func markdownCode(command string) string {
+	fence := strings.Repeat("`", longestBacktickRun(command)+1)
+	if !strings.Contains(command, "\n") {
+		if strings.HasPrefix(command, "`") || strings.HasSuffix(command, "`") {
+			command = " " + command + " "
+		}
+		return fence + command + fence
+	}
+	if len(fence) < 3 {
+		fence = "```"
+	}
+	lines := strings.Split(strings.TrimRight(command, "\n"), "\n")
+	return "\n  " + fence + "\n  " + strings.Join(lines, "\n  ") + "\n  " + fence
+}
+
+func longestBacktickRun(s string) int {
+	longest, current := 0, 0
+	for _, c := range s {
+		if c == '`' {
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+	}
+	return longest
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The subset of a kubeconfig file needed to determine the active context and namespace
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// getKubeContext returns the active kubectl context and namespace (e.g. "prod/payments"), or an empty string if
+// kubectl isn't configured. This parses the kubeconfig directly rather than running kubectl since it runs after
+// every single command.
+func getKubeContext(homedir string) string {
+	paths := filepath.SplitList(os.Getenv("KUBECONFIG"))
+	if len(paths) == 0 {
+		paths = []string{filepath.Join(homedir, ".kube", "config")}
+	}
+	return parseKubeContext(paths)
+}
+
+// parseKubeContext merges the given kubeconfig files following kubectl's rules: the first file to set
+// current-context wins, and so does the first file to define each context.
+func parseKubeContext(paths []string) string {
+	currentContext := ""
+	namespaces := make(map[string]string)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var config kubeconfig
+		if err := yaml.Unmarshal(contents, &config); err != nil {
+			continue
+		}
+		if currentContext == "" {
+			currentContext = config.CurrentContext
+		}
+		for _, c := range config.Contexts {
+			if _, ok := namespaces[c.Name]; !ok {
+				namespaces[c.Name] = c.Context.Namespace
+			}
+		}
+	}
+	if currentContext == "" {
+		return ""
+	}
+	namespace := namespaces[currentContext]
+	if namespace == "" {
+		namespace = "default"
+	}
+	return currentContext + "/" + namespace
+}
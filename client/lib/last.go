@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+const (
+	// The directory (within the hishtory directory) that caches the last command run in each shell session
+	lastCommandCacheDir = "last-command"
+	// Cached commands for sessions that haven't run a command in this long are deleted
+	lastCommandCacheMaxAge = 7 * 24 * time.Hour
+	// The default format used by `hishtory last`
+	DefaultLastCommandFormat = "exit_code={exit_code} runtime={runtime} cwd={cwd}"
+)
+
+// LastCommand is the information about the previous command that is printed by `hishtory last`
+type LastCommand struct {
+	Command   string    `json:"command"`
+	ExitCode  int       `json:"exit_code"`
+	Cwd       string    `json:"cwd"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	RuntimeMs int64     `json:"runtime_ms"`
+}
+
+func newLastCommand(entry data.HistoryEntry) LastCommand {
+	return LastCommand{
+		Command:   entry.Command,
+		ExitCode:  entry.ExitCode,
+		Cwd:       entry.CurrentWorkingDirectory,
+		StartTime: entry.StartTime,
+		EndTime:   entry.EndTime,
+		RuntimeMs: entry.EndTime.Sub(entry.StartTime).Milliseconds(),
+	}
+}
+
+func (l LastCommand) Runtime() time.Duration {
+	return l.EndTime.Sub(l.StartTime)
+}
+
+var invalidSessionIdChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// getLastCommandCachePath returns the path that the last command of the current shell session is cached at, or
+// an empty string if the shell hooks didn't set $HISHTORY_SESSION_ID
+func getLastCommandCachePath(homedir string) string {
+	sessionId := invalidSessionIdChars.ReplaceAllString(os.Getenv("HISHTORY_SESSION_ID"), "")
+	if sessionId == "" {
+		return ""
+	}
+	return filepath.Join(data.GetHishtoryDir(homedir), lastCommandCacheDir, sessionId+".json")
+}
+
+// CacheLastCommand records entry as the last command run in the current shell session, so that `hishtory last`
+// can print it without opening the DB. If entry is nil (e.g. because the command was prefixed with a space),
+// the cache is cleared so that `hishtory last` doesn't print stale info about an earlier command.
+func CacheLastCommand(homedir string, entry *data.HistoryEntry) error {
+	cachePath := getLastCommandCachePath(homedir)
+	if cachePath == "" {
+		return nil
+	}
+	if entry == nil {
+		if err := os.Remove(cachePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to clear the last command cache: %w", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err != nil {
+		return fmt.Errorf("failed to create the last command cache directory: %w", err)
+	}
+	contents, err := json.Marshal(newLastCommand(*entry))
+	if err != nil {
+		return fmt.Errorf("failed to serialize the last command: %w", err)
+	}
+	// Write to a temporary file and rename it so that a concurrent `hishtory last` never reads a partial write
+	tmpPath := cachePath + ".tmp"
+	if err := os.WriteFile(tmpPath, contents, 0o600); err != nil {
+		return fmt.Errorf("failed to write the last command cache: %w", err)
+	}
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		return fmt.Errorf("failed to write the last command cache: %w", err)
+	}
+	pruneLastCommandCache(filepath.Dir(cachePath))
+	return nil
+}
+
+// pruneLastCommandCache deletes the cached commands of sessions that are most likely closed
+func pruneLastCommandCache(dir string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > lastCommandCacheMaxAge {
+			_ = os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+}
+
+// GetCachedLastCommand returns the last command run in the current shell session. ok is false if the shell hooks
+// didn't set $HISHTORY_SESSION_ID, in which case GetLastCommandFromDb should be used instead. A nil command with
+// ok set means that no command has been recorded for this session yet.
+func GetCachedLastCommand(homedir string) (last *LastCommand, ok bool, err error) {
+	cachePath := getLastCommandCachePath(homedir)
+	if cachePath == "" {
+		return nil, false, nil
+	}
+	contents, err := os.ReadFile(cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read the last command cache: %w", err)
+	}
+	var cached LastCommand
+	if err := json.Unmarshal(contents, &cached); err != nil {
+		return nil, true, fmt.Errorf("failed to parse the last command cache at %s: %w", cachePath, err)
+	}
+	return &cached, true, nil
+}
+
+// GetLastCommandFromDb returns the most recent command run on this device, or nil if there isn't one
+func GetLastCommandFromDb(ctx context.Context) (*LastCommand, error) {
+	var entries []data.HistoryEntry
+	err := hctx.GetDb(ctx).Where("device_id = ?", hctx.GetConf(ctx).DeviceId).Order("end_time DESC").Limit(1).Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for the last command: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	last := newLastCommand(entries[0])
+	return &last, nil
+}
+
+// FormatLastCommand renders last according to format, which may contain the placeholders {command},
+// {exit_code}, {runtime}, {runtime_ms}, {cwd}, and {end_time}
+func FormatLastCommand(last LastCommand, format string) string {
+	return strings.NewReplacer(
+		"{command}", last.Command,
+		"{exit_code}", strconv.Itoa(last.ExitCode),
+		"{runtime}", last.Runtime().Round(time.Millisecond).String(),
+		"{runtime_ms}", strconv.FormatInt(last.Runtime().Milliseconds(), 10),
+		"{cwd}", last.Cwd,
+		"{end_time}", last.EndTime.Format(time.RFC3339),
+	).Replace(format)
+}
@@ -26,6 +26,7 @@ import (
 	_ "embed" // for embedding config.sh
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/araddon/dateparse"
 	"github.com/fatih/color"
@@ -46,6 +47,18 @@ var ConfigZshContents string
 //go:embed config.fish
 var ConfigFishContents string
 
+//go:embed config.ps1
+var ConfigPowerShellContents string
+
+//go:embed config.nu
+var ConfigNushellContents string
+
+//go:embed config.tcsh
+var ConfigTcshContents string
+
+//go:embed config.ksh
+var ConfigKshContents string
+
 var Version string = "Unknown"
 var GitCommit string = "Unknown"
 
@@ -58,13 +71,17 @@ func getCwd(ctx context.Context) (string, string, error) {
 		return "", "", fmt.Errorf("failed to get cwd for last command: %v", err)
 	}
 	homedir := hctx.GetHome(ctx)
+	return abbreviateHomeDir(cwd, homedir), homedir, nil
+}
+
+func abbreviateHomeDir(cwd, homedir string) string {
 	if cwd == homedir {
-		return "~/", homedir, nil
+		return "~/"
 	}
 	if strings.HasPrefix(cwd, homedir) {
-		return strings.Replace(cwd, homedir, "~", 1), homedir, nil
+		return strings.Replace(cwd, homedir, "~", 1)
 	}
-	return cwd, homedir, nil
+	return cwd
 }
 
 func getCwdWithoutSubstitution() (string, error) {
@@ -105,6 +122,10 @@ func BuildHistoryEntry(ctx context.Context, args []string) (*data.HistoryEntry,
 		return nil, fmt.Errorf("failed to build history entry: %v", err)
 	}
 	entry.LocalUsername = user.Username
+	entry.AsRoot = isRunningAsRoot()
+	if sudoUser := getSudoUser(); sudoUser != nil {
+		entry.LocalUsername = sudoUser.Username
+	}
 
 	// cwd and homedir
 	cwd, homedir, err := getCwd(ctx)
@@ -143,8 +164,17 @@ func BuildHistoryEntry(ctx context.Context, args []string) (*data.HistoryEntry,
 			return nil, err
 		}
 		entry.Command = cmd
-	} else if shell == "zsh" || shell == "fish" {
-		cmd := strings.TrimSuffix(strings.TrimSuffix(args[4], "\n"), " ")
+	} else if shell == "zsh" || shell == "fish" || shell == "powershell" || shell == "nu" || shell == "ksh" || shell == "tcsh" {
+		cmd := args[4]
+		if shell == "tcsh" && cmd == "-" {
+			// tcsh can't safely quote arbitrary commands, so it passes the command via stdin
+			stdin, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read command from stdin: %v", err)
+			}
+			cmd = string(stdin)
+		}
+		cmd = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(cmd, "\n"), "\r"), " ")
 		if strings.HasPrefix(cmd, " ") {
 			// Don't save commands that start with a space
 			return nil, nil
@@ -153,6 +183,9 @@ func BuildHistoryEntry(ctx context.Context, args []string) (*data.HistoryEntry,
 	} else {
 		return nil, fmt.Errorf("tried to save a hishtory entry from an unsupported shell=%#v", shell)
 	}
+	// Multi-line commands (e.g. heredocs and backslash continuations) are stored with their original line breaks,
+	// but shells on Windows may report them with CRLF line endings
+	entry.Command = strings.ReplaceAll(entry.Command, "\r\n", "\n")
 	if strings.TrimSpace(entry.Command) == "" {
 		// Skip recording empty commands where the user just hits enter in their terminal
 		return nil, nil
@@ -176,6 +209,36 @@ func BuildHistoryEntry(ctx context.Context, args []string) (*data.HistoryEntry,
 	}
 	entry.CustomColumns = cc
 
+	// direnv/mise environment
+	entry.DevEnvironment = getDevEnvironment(ctx)
+
+	// ssh session
+	entry.RemoteHosts = getRemoteHosts()
+
+	// container
+	entry.Container = getContainer()
+
+	// kubectl context
+	entry.KubeContext = getKubeContext(homedir)
+
+	// allowlisted environment variables
+	entry.EnvironmentVariables = buildEnvironmentVariables(ctx)
+
+	// the command with its leading alias expanded
+	entry.ResolvedCommand = getResolvedCommand(ctx, entry.Command)
+
+	// how the shell was started
+	entry.ShellMode = getShellMode()
+
+	// whether the shell was started from another shell
+	entry.ShellLevel, entry.ShellPid, entry.ParentShellPid = getShellNesting()
+
+	// the tmux pane
+	entry.TmuxPane = getTmuxPane()
+
+	// the ID that was exported to the command
+	entry.CorrelationId = getCorrelationId()
+
 	return &entry, nil
 }
 
@@ -183,23 +246,17 @@ func buildCustomColumns(ctx context.Context) (data.CustomColumns, error) {
 	ccs := data.CustomColumns{}
 	config := hctx.GetConf(ctx)
 	for _, cc := range config.CustomColumns {
-		cmd := exec.Command("bash", "-c", cc.ColumnCommand)
-		var stdout bytes.Buffer
-		cmd.Stdout = &stdout
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		err := cmd.Start()
+		result, err := runCustomColumn(cc)
 		if err != nil {
-			return nil, fmt.Errorf("failed to execute custom command named %v (stdout=%#v, stderr=%#v)", cc.ColumnName, stdout.String(), stderr.String())
+			return nil, err
 		}
-		err = cmd.Wait()
-		if err != nil {
+		if result.Err != nil {
 			// Log a warning, but don't crash. This way commands can exit with a different status and still work.
-			hctx.GetLogger().Warnf("failed to execute custom command named %v (stdout=%#v, stderr=%#v)", cc.ColumnName, stdout.String(), stderr.String())
+			hctx.GetLogger().Warnf("failed to execute custom command named %v (stdout=%#v, stderr=%#v)", cc.ColumnName, result.Output, result.Stderr)
 		}
 		ccv := data.CustomColumn{
 			Name: cc.ColumnName,
-			Val:  strings.TrimSpace(stdout.String()),
+			Val:  result.Output,
 		}
 		ccs = append(ccs, ccv)
 	}
@@ -337,23 +394,32 @@ func getLastCommand(history string) (string, error) {
 }
 
 func shouldSkipHiddenCommand(ctx context.Context, historyLine string) (bool, error) {
-	config := hctx.GetConf(ctx)
-	if config.LastSavedHistoryLine == historyLine {
-		return true, nil
-	}
-	config.LastSavedHistoryLine = historyLine
-	err := hctx.SetConfig(config)
+	// Note that this reads LastSavedHistoryLine from within UpdateConfig rather than from the context, since
+	// another shell may have updated it since this command started
+	shouldSkip := false
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if config.LastSavedHistoryLine == historyLine {
+			shouldSkip = true
+			return
+		}
+		config.LastSavedHistoryLine = historyLine
+	})
 	if err != nil {
 		return false, err
 	}
-	return false, nil
+	return shouldSkip, nil
 }
 
-func Setup(userSecret string, isOffline bool) error {
+func Setup(userSecret string, isOffline, isReadOnly bool) error {
 	if userSecret == "" {
 		userSecret = uuid.Must(uuid.NewRandom()).String()
 	}
 	fmt.Println("Setting secret hishtory key to " + string(userSecret))
+	if phrase, err := RecoveryPhrase(userSecret); err == nil {
+		fmt.Println("Your recovery phrase is: " + phrase)
+		fmt.Println("Write it down somewhere safe, since it can be used to recover your synced history via `hishtory secret recover` if you lose your secret key")
+	}
+	previousConfig, _ := hctx.GetConfig()
 
 	// Create and set the config
 	var config hctx.ClientConfig
@@ -361,25 +427,46 @@ func Setup(userSecret string, isOffline bool) error {
 	config.IsEnabled = true
 	config.DeviceId = uuid.Must(uuid.NewRandom()).String()
 	config.ControlRSearchEnabled = true
+	config.ConfigVersion = hctx.LatestConfigVersion
 	config.IsOffline = isOffline
+	config.ReadOnlyDevice = isReadOnly
+	// The new secret is stored in the keychain if the previous one was. That isn't possible with passphrase storage,
+	// since the passphrase isn't known here, so the new secret is then stored in the config file instead.
+	if previousConfig.SecretStorage == hctx.SecretStorageKeychain {
+		config.SecretStorage = previousConfig.SecretStorage
+	}
 	err := hctx.SetConfig(config)
 	if err != nil {
 		return fmt.Errorf("failed to persist config to disk: %v", err)
 	}
 
 	// Drop all existing data
-	db, err := hctx.OpenLocalSqliteDb()
+	db, err := hctx.OpenLocalSqliteDb(config)
 	if err != nil {
 		return err
 	}
-	db.Exec("DELETE FROM history_entries")
+	res := db.Exec("DELETE FROM " + hctx.HistoryEntryRowsTable)
+	auditDetails := fmt.Sprintf("set up this device and deleted %d local entries", res.RowsAffected)
+	if previousConfig.UserSecret != "" && previousConfig.UserSecret != userSecret {
+		auditDetails = fmt.Sprintf("switched to a different secret key and deleted %d local entries", res.RowsAffected)
+	}
+	if err := recordAuditEvent(db, AuditActionInit, auditDetails); err != nil {
+		return err
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get homedir: %w", err)
+	}
+	if err := deleteColdStorage(homedir); err != nil {
+		return err
+	}
 
 	// Bootstrap from remote date
 	if config.IsOffline {
 		return nil
 	}
-	if _, err := ApiGet("/api/v1/register?user_id=" + data.UserId(userSecret) + "&device_id=" + config.DeviceId); err != nil {
-		return fmt.Errorf("failed to register device with backend: %w", err)
+	if err := RegisterDevice(config); err != nil {
+		return err
 	}
 
 	respBody, err := ApiGet("/api/v1/bootstrap?user_id=" + data.UserId(userSecret) + "&device_id=" + config.DeviceId)
@@ -391,17 +478,29 @@ func Setup(userSecret string, isOffline bool) error {
 	if err != nil {
 		return fmt.Errorf("failed to load JSON response: %v", err)
 	}
-	for _, entry := range retrievedEntries {
-		decEntry, err := data.DecryptHistoryEntry(userSecret, *entry)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt history entry from server: %w", err)
-		}
-		AddToDbIfNew(db, decEntry)
+	// Entries that can't be decrypted were probably encrypted by a device using an encryption provider, so they are
+	// set aside until this device is set up to use that provider too
+	numQuarantined, err := storeDownloadedEntries(hctx.WithHome(context.Background(), homedir), db, retrievedEntries, data.SecretEncryptionProvider{UserSecret: userSecret}, userSecret)
+	if err != nil {
+		return err
+	}
+	if numQuarantined > 0 {
+		fmt.Printf("%d history entries couldn't be decrypted, if your other devices use an encryption provider run `hishtory encryption setup` to decrypt them\n", numQuarantined)
 	}
 
 	return nil
 }
 
+// RegisterDevice registers this device with the backend, advertising whether it is read-only so that the backend
+// rejects uploads from it. Registering a device again is a no-op, so whether it is read-only can't be changed later.
+func RegisterDevice(config hctx.ClientConfig) error {
+	_, err := ApiGet("/api/v1/register?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId + "&read_only=" + strconv.FormatBool(config.ReadOnlyDevice))
+	if err != nil {
+		return fmt.Errorf("failed to register device with backend: %w", err)
+	}
+	return nil
+}
+
 func AddToDbIfNew(db *gorm.DB, entry data.HistoryEntry) {
 	tx := db.Where("local_username = ?", entry.LocalUsername)
 	tx = tx.Where("hostname = ?", entry.Hostname)
@@ -414,7 +513,7 @@ func AddToDbIfNew(db *gorm.DB, entry data.HistoryEntry) {
 	var results []data.HistoryEntry
 	tx.Limit(1).Find(&results)
 	if len(results) == 0 {
-		db.Create(entry)
+		ReliableDbCreate(db, entry)
 		// TODO: check the error here and bubble it up
 	}
 }
@@ -434,12 +533,19 @@ func getCustomColumnValue(ctx context.Context, header string, entry data.History
 	return "", fmt.Errorf("failed to find a column matching the column name %#v (is there a typo?)", header)
 }
 
+// The columns that are built in to hishtory (as opposed to custom columns), see buildTableRow
+var builtinColumnNames = []string{"Hostname", "CWD", "Timestamp", "Runtime", "Exit Code", "Command", "Dev Env", "Remote", "Container", "Kube Context", "Count", "Tags", "Entry ID", "Pinned", "As Root", "Shell Mode", "Shell Level", "Tmux", "Correlation ID"}
+
 func buildTableRow(ctx context.Context, columnNames []string, entry data.HistoryEntry) ([]string, error) {
 	row := make([]string, 0)
 	for _, header := range columnNames {
 		switch header {
 		case "Hostname":
-			row = append(row, entry.Hostname)
+			if hctx.GetConf(ctx).DisplayDeviceHostname {
+				row = append(row, getDeviceHostname(ctx, entry))
+			} else {
+				row = append(row, entry.Hostname)
+			}
 		case "CWD":
 			row = append(row, entry.CurrentWorkingDirectory)
 		case "Timestamp":
@@ -450,6 +556,48 @@ func buildTableRow(ctx context.Context, columnNames []string, entry data.History
 			row = append(row, fmt.Sprintf("%d", entry.ExitCode))
 		case "Command":
 			row = append(row, entry.Command)
+		case "Dev Env":
+			row = append(row, entry.DevEnvironment)
+		case "Remote":
+			row = append(row, entry.RemoteHosts)
+		case "Container":
+			row = append(row, entry.Container)
+		case "Kube Context":
+			row = append(row, entry.KubeContext)
+		case "Count":
+			row = append(row, strconv.Itoa(max(entry.HitCount, 1)))
+		case "Tags":
+			tags, err := GetEntryTags(ctx, entry)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, strings.Join(tags, ","))
+		case "Entry ID":
+			row = append(row, entryKey(&entry))
+		case "Pinned":
+			if entry.Pinned {
+				row = append(row, "pinned")
+			} else {
+				row = append(row, "")
+			}
+		case "As Root":
+			if entry.AsRoot {
+				row = append(row, "root")
+			} else {
+				row = append(row, "")
+			}
+		case "Shell Mode":
+			row = append(row, entry.ShellMode)
+		case "Shell Level":
+			if entry.ShellLevel > 0 {
+				row = append(row, strconv.Itoa(entry.ShellLevel))
+			} else {
+				row = append(row, "")
+			}
+		case "Tmux":
+			row = append(row, entry.TmuxPane)
+		case "Correlation ID":
+			row = append(row, entry.CorrelationId)
 		default:
 			customColumnValue, err := getCustomColumnValue(ctx, header, entry)
 			if err != nil {
@@ -469,7 +617,9 @@ func stringArrayToAnyArray(arr []string) []any {
 	return ret
 }
 
-func DisplayResults(ctx context.Context, results []*data.HistoryEntry, numResults int) error {
+// DisplayResults prints up to numResults of the given results as a table, and returns how many were printed
+func DisplayResults(ctx context.Context, results []*data.HistoryEntry, numResults int) (int, error) {
+	defer hctx.StartSpan("render")()
 	config := hctx.GetConf(ctx)
 	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 
@@ -488,7 +638,7 @@ func DisplayResults(ctx context.Context, results []*data.HistoryEntry, numResult
 		}
 		row, err := buildTableRow(ctx, config.DisplayedColumns, *entry)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		tbl.AddRow(stringArrayToAnyArray(row)...)
 		numRows += 1
@@ -499,7 +649,7 @@ func DisplayResults(ctx context.Context, results []*data.HistoryEntry, numResult
 	}
 
 	tbl.Print()
-	return nil
+	return numRows, nil
 }
 
 func IsEnabled(ctx context.Context) (bool, error) {
@@ -550,6 +700,11 @@ func ImportHistory(ctx context.Context, shouldReadStdin, force bool) (int, error
 		}
 		historyEntries = append(historyEntries, extraEntries...)
 	}
+	if len(historyEntries) > 0 {
+		if err := SnapshotDb(ctx, "import"); err != nil {
+			return 0, err
+		}
+	}
 	db := hctx.GetDb(ctx)
 	currentUser, err := user.Current()
 	if err != nil {
@@ -559,37 +714,60 @@ func ImportHistory(ctx context.Context, shouldReadStdin, force bool) (int, error
 	if err != nil {
 		return 0, err
 	}
-	for _, cmd := range historyEntries {
+	// Each entry gets a distinct timestamp, in the same order as in the history files, ending at the current time
+	now := time.Now()
+	entries := make([]data.HistoryEntry, 0, len(historyEntries))
+	for i, cmd := range historyEntries {
 		cmd := stripZshWeirdness(cmd)
 		if isBashWeirdness(cmd) || strings.HasPrefix(cmd, " ") {
 			// Skip it
 			continue
 		}
-		entry := data.HistoryEntry{
+		timestamp := now.Add(-time.Duration(len(historyEntries)-1-i) * time.Microsecond)
+		entries = append(entries, data.HistoryEntry{
 			LocalUsername:           currentUser.Name,
 			Hostname:                hostname,
 			Command:                 cmd,
 			CurrentWorkingDirectory: "Unknown",
 			HomeDirectory:           homedir,
 			ExitCode:                0,
-			StartTime:               time.Now(),
-			EndTime:                 time.Now(),
+			StartTime:               timestamp,
+			EndTime:                 timestamp,
 			DeviceId:                config.DeviceId,
-		}
-		err = ReliableDbCreate(db, entry)
-		if err != nil {
-			return 0, fmt.Errorf("failed to insert imported history entry: %v", err)
+		})
+	}
+	batchSize := config.ImportBatchSize
+	if batchSize <= 0 {
+		batchSize = hctx.DefaultImportBatchSize
+	}
+	var onProgress func(int)
+	if isTerminal(os.Stderr) && len(entries) > batchSize {
+		onProgress = func(numInserted int) {
+			fmt.Fprintf(os.Stderr, "\rImported %d/%d entries", numInserted, len(entries))
 		}
 	}
-	err = Reupload(ctx)
-	if err != nil {
-		return 0, fmt.Errorf("failed to upload hishtory import: %v", err)
+	err = ReliableDbCreateInBatches(db, entries, batchSize, onProgress)
+	if onProgress != nil {
+		fmt.Fprintln(os.Stderr)
 	}
-	config.HaveCompletedInitialImport = true
-	err = hctx.SetConfig(config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert imported history entries: %v", err)
+	}
+	// The import is marked as completed before uploading, and the upload is resumed if it is interrupted, so that a
+	// failed upload of a large history doesn't lead to importing it again
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.HaveCompletedInitialImport = true
+		if !config.IsOffline && !config.ReadOnlyDevice {
+			config.BootstrapUpload = &hctx.BootstrapUploadProgress{}
+		}
+	})
 	if err != nil {
 		return 0, fmt.Errorf("failed to mark initial import as completed, this may lead to duplicate history entries: %v", err)
 	}
+	err = MaybeResumeBootstrapUpload(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload hishtory import: %v", err)
+	}
 	// Trigger a checkpoint so that these bulk entries are added from the WAL to the main DB
 	db.Exec("PRAGMA wal_checkpoint")
 	return len(historyEntries), nil
@@ -707,9 +885,9 @@ func Update(ctx context.Context) error {
 	// Unlink the existing binary so we can overwrite it even though it is still running
 	if runtime.GOOS == "linux" {
 		homedir := hctx.GetHome(ctx)
-		err = syscall.Unlink(path.Join(homedir, data.GetHishtoryPath(), "hishtory"))
+		err = syscall.Unlink(data.GetHishtoryBinaryPath(homedir))
 		if err != nil {
-			return fmt.Errorf("failed to unlink %s for update: %v", path.Join(homedir, data.GetHishtoryPath(), "hishtory"), err)
+			return fmt.Errorf("failed to unlink %s for update: %v", data.GetHishtoryBinaryPath(homedir), err)
 		}
 	}
 
@@ -896,29 +1074,39 @@ func getServerHostname() string {
 	return "https://api.hishtory.dev"
 }
 
-func httpClient() *http.Client {
-	return &http.Client{}
-}
-
 func ApiGet(path string) ([]byte, error) {
 	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
 		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
 	}
+	if backoff := getRateLimitBackoff(); backoff > 0 {
+		return nil, fmt.Errorf("skipped GET %s%s since the server rate limited requests for another %s: status_code=429", getServerHostname(), path, backoff.Round(time.Second))
+	}
+	endpoint, _, _ := strings.Cut(path, "?")
+	defer hctx.StartSpan("GET " + endpoint)()
 	start := time.Now()
 	req, err := http.NewRequest("GET", getServerHostname()+path, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GET: %v", err)
 	}
 	req.Header.Set("X-Hishtory-Version", "v0."+Version)
-	resp, err := httpClient().Do(req)
+	setCompressionHeaders(req)
+	client, err := httpClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to GET %s%s: %w", getServerHostname(), path, err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to GET %s%s: %v", getServerHostname(), path, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		recordRateLimit(resp)
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to GET %s%s: status_code=%d", getServerHostname(), path, resp.StatusCode)
 	}
-	respBody, err := io.ReadAll(resp.Body)
+	recordServerProtocolVersion(resp)
+	respBody, err := readResponseBody(resp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body from GET %s%s: %v", getServerHostname(), path, err)
 	}
@@ -931,22 +1119,29 @@ func ApiPost(path, contentType string, data []byte) ([]byte, error) {
 	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
 		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
 	}
+	if backoff := getRateLimitBackoff(); backoff > 0 {
+		return nil, fmt.Errorf("skipped POST %s since the server rate limited requests for another %s: status_code=429", path, backoff.Round(time.Second))
+	}
+	endpoint, _, _ := strings.Cut(path, "?")
+	defer hctx.StartSpan("POST " + endpoint)()
 	start := time.Now()
-	req, err := http.NewRequest("POST", getServerHostname()+path, bytes.NewBuffer(data))
+	client, err := httpClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create POST: %v", err)
+		return nil, fmt.Errorf("failed to POST %s: %w", path, err)
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("X-Hishtory-Version", "v0."+Version)
-	resp, err := httpClient().Do(req)
+	resp, err := doApiPost(client, path, contentType, data, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to POST %s: %v", path, err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		recordRateLimit(resp)
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to POST %s: status_code=%d", path, resp.StatusCode)
 	}
-	respBody, err := io.ReadAll(resp.Body)
+	recordServerProtocolVersion(resp)
+	respBody, err := readResponseBody(resp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body from POST %s: %v", path, err)
 	}
@@ -955,6 +1150,26 @@ func ApiPost(path, contentType string, data []byte) ([]byte, error) {
 	return respBody, nil
 }
 
+func doApiPost(client *http.Client, path, contentType string, data []byte, allowCompression bool) (*http.Response, error) {
+	req, compressed, err := newApiPostRequest(path, contentType, data, allowCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create POST: %v", err)
+	}
+	req.Header.Set("X-Hishtory-Version", "v0."+Version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to POST %s: %v", path, err)
+	}
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+		// The server no longer supports compressed requests (e.g. because it was downgraded), so forget its
+		// protocol version and retry without compression
+		resp.Body.Close()
+		setServerProtocolVersion(0)
+		return doApiPost(client, path, contentType, data, false)
+	}
+	return resp, nil
+}
+
 func IsOfflineError(err error) bool {
 	if err == nil {
 		return false
@@ -965,43 +1180,126 @@ func IsOfflineError(err error) bool {
 		strings.Contains(err.Error(), ": EOF") ||
 		strings.Contains(err.Error(), ": status_code=502") ||
 		strings.Contains(err.Error(), ": status_code=503") ||
+		// Rate limited requests are retried later, like requests made while offline
+		strings.Contains(err.Error(), ": status_code=429") ||
 		strings.Contains(err.Error(), ": i/o timeout") ||
 		strings.Contains(err.Error(), "connect: operation timed out") ||
 		strings.Contains(err.Error(), "net/http: TLS handshake timeout")
 }
 
+// SaveHistoryEntryLocally saves entry to the local DB. If CollapseDuplicateEntries is enabled and the same command
+// was already run in the same directory on this host, the most recent such entry is updated instead: its hit
+// count is incremented and its times and exit code are set to those of entry, so that it sorts as recently used.
+func SaveHistoryEntryLocally(ctx context.Context, entry data.HistoryEntry) error {
+	db := hctx.GetDb(ctx)
+	if !hctx.GetConf(ctx).CollapseDuplicateEntries {
+		return ReliableDbCreate(db, entry)
+	}
+	var rowsAffected int64
+	err := RetryDbWrite(func() error {
+		tx := db.Exec(`UPDATE `+hctx.HistoryEntryRowsTable+` SET hit_count = MAX(COALESCE(hit_count, 0), 1) + 1, start_time = ?, end_time = ?, exit_code = ?
+			WHERE rowid = (SELECT rowid FROM history_entries WHERE command = ? AND current_working_directory = ? AND hostname = ? AND device_id = ? ORDER BY end_time DESC LIMIT 1)`,
+			entry.StartTime, entry.EndTime, entry.ExitCode, entry.Command, entry.CurrentWorkingDirectory, entry.Hostname, entry.DeviceId)
+		rowsAffected = tx.RowsAffected
+		return tx.Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to collapse duplicate history entry: %w", err)
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+	return ReliableDbCreate(db, entry)
+}
+
 func ReliableDbCreate(db *gorm.DB, entry interface{}) error {
-	var err error = nil
-	i := 0
-	for i = 0; i < 10; i++ {
-		result := db.Create(entry)
-		err = result.Error
+	isRetry := false
+	return RetryDbWrite(func() error {
+		err := db.Create(entry).Error
+		if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") && isRetry {
+			// An earlier attempt that we thought failed must have actually succeeded
+			return nil
+		}
+		isRetry = true
+		return err
+	})
+}
+
+// The maximum number of rows inserted by a single INSERT statement. The time that the sqlite driver takes to bind the
+// variables of a statement grows quadratically with their number, so inserting more rows per statement is slower.
+const maxRowsPerInsert = 20
+
+// ReliableDbCreateInBatches inserts entries in transactions of batchSize entries, which is much faster than inserting
+// them one at a time with ReliableDbCreate since every transaction has a fixed cost (e.g. locking and syncing the DB).
+// Entries that are already in the DB are skipped, so that a batch can safely be retried. If onProgress is non-nil, it
+// is called with the number of entries inserted so far after every batch.
+func ReliableDbCreateInBatches(db *gorm.DB, entries []data.HistoryEntry, batchSize int, onProgress func(numInserted int)) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("the batch size must be positive, got %d", batchSize)
+	}
+	for start := 0; start < len(entries); start += batchSize {
+		batch := entries[start:min(start+batchSize, len(entries))]
+		err := RetryDbWrite(func() error {
+			return db.Transaction(func(tx *gorm.DB) error {
+				// history_entries is a view, which doesn't support ON CONFLICT
+				return tx.Clauses(clause.Insert{Modifier: "OR IGNORE"}).CreateInBatches(batch, maxRowsPerInsert).Error
+			})
+		})
 		if err != nil {
-			errMsg := err.Error()
-			if errMsg == "database is locked (5) (SQLITE_BUSY)" || errMsg == "database is locked (261)" {
-				time.Sleep(time.Duration(i*rand.Intn(100)) * time.Millisecond)
-				continue
-			}
-			if strings.Contains(errMsg, "UNIQUE constraint failed") {
-				if i == 0 {
-					return err
-				} else {
-					return nil
-				}
+			return err
+		}
+		if onProgress != nil {
+			onProgress(start + len(batch))
+		}
+	}
+	return nil
+}
+
+const (
+	maxDbWriteAttempts    = 10
+	initialDbWriteBackoff = 10 * time.Millisecond
+	maxDbWriteBackoff     = time.Second
+)
+
+// IsDbBusyError returns whether the given error is sqlite reporting that another process holds a lock on the DB
+func IsDbBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errMsg := err.Error()
+	return strings.Contains(errMsg, "database is locked") || strings.Contains(errMsg, "database table is locked") || strings.Contains(errMsg, "SQLITE_BUSY")
+}
+
+// RetryDbWrite runs the given DB write, retrying it with exponential backoff (plus jitter, so that concurrent
+// shells don't retry in lockstep) if the DB is locked by another process for longer than the busy timeout.
+func RetryDbWrite(write func() error) error {
+	backoff := initialDbWriteBackoff
+	var err error
+	for i := 0; i < maxDbWriteAttempts; i++ {
+		err = write()
+		if !IsDbBusyError(err) {
+			if err != nil {
+				return fmt.Errorf("unrecoverable sqlite error: %w", err)
 			}
-			return fmt.Errorf("unrecoverable sqlite error: %v", err)
+			return nil
 		}
-		if err != nil && err.Error() != "database is locked (5) (SQLITE_BUSY)" {
-			return fmt.Errorf("unrecoverable sqlite error: %v", err)
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+		if backoff > maxDbWriteBackoff {
+			backoff = maxDbWriteBackoff
 		}
 	}
-	return fmt.Errorf("failed to create DB entry even with %d retries: %v", i, err)
+	return fmt.Errorf("failed to write to the DB even with %d retries: %w", maxDbWriteAttempts, err)
 }
 
 func EncryptAndMarshal(config hctx.ClientConfig, entries []*data.HistoryEntry) ([]byte, error) {
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return nil, err
+	}
 	var encEntries []shared.EncHistoryEntry
 	for _, entry := range entries {
-		encEntry, err := data.EncryptHistoryEntry(config.UserSecret, *entry)
+		encEntry, err := EncryptHistoryEntry(config, provider, *entry)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encrypt history entry")
 		}
@@ -1015,29 +1313,11 @@ func EncryptAndMarshal(config hctx.ClientConfig, entries []*data.HistoryEntry) (
 	return jsonValue, nil
 }
 
-func Reupload(ctx context.Context) error {
-	config := hctx.GetConf(ctx)
-	if config.IsOffline {
-		return nil
-	}
-	entries, err := Search(ctx, hctx.GetDb(ctx), "", 0)
-	if err != nil {
-		return fmt.Errorf("failed to reupload due to failed search: %v", err)
-	}
-	for _, chunk := range shared.Chunks(entries, 100) {
-		jsonValue, err := EncryptAndMarshal(config, chunk)
-		if err != nil {
-			return fmt.Errorf("failed to reupload due to failed encryption: %v", err)
-		}
-		_, err = ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
-		if err != nil {
-			return fmt.Errorf("failed to reupload due to failed POST: %v", err)
-		}
-	}
-	return nil
-}
-
 func RetrieveAdditionalEntriesFromRemote(ctx context.Context) error {
+	defer hctx.StartSpan("sync")()
+	if err := MergeSharedHomeDbs(ctx); err != nil {
+		return err
+	}
 	db := hctx.GetDb(ctx)
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
@@ -1055,17 +1335,21 @@ func RetrieveAdditionalEntriesFromRemote(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to load JSON response: %v", err)
 	}
-	for _, entry := range retrievedEntries {
-		decEntry, err := data.DecryptHistoryEntry(config.UserSecret, *entry)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt history entry from server: %v", err)
-		}
-		AddToDbIfNew(db, decEntry)
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return err
+	}
+	if _, err := storeDownloadedEntries(ctx, db, retrievedEntries, provider, config.UserSecret); err != nil {
+		return err
 	}
-	return ProcessDeletionRequests(ctx)
+	if err := ProcessDeletionRequests(ctx); err != nil {
+		return err
+	}
+	return ProcessMetadataUpdates(ctx)
 }
 
 func ProcessDeletionRequests(ctx context.Context) error {
+	defer hctx.StartSpan("deletion requests")()
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
 		return nil
@@ -1082,13 +1366,31 @@ func ProcessDeletionRequests(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	db := hctx.GetDb(ctx)
 	for _, request := range deletionRequests {
-		for _, entry := range request.Messages.Ids {
-			res := db.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.Date).Delete(&data.HistoryEntry{})
-			if res.Error != nil {
-				return fmt.Errorf("DB error: %v", res.Error)
+		var numDeleted int64
+		err := forEachTier(ctx, func(db *gorm.DB) error {
+			for _, entry := range request.Messages.Ids {
+				err := RetryDbWrite(func() error {
+					res := hctx.DeleteHistoryEntries(db.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.Date))
+					numDeleted += res.RowsAffected
+					return res.Error
+				})
+				if err != nil {
+					return fmt.Errorf("DB error: %v", err)
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if numDeleted > 0 {
+			if err := RecordAuditEvent(ctx, AuditActionRemoteDelete, fmt.Sprintf("deleted %d entries per a deletion request from another device", numDeleted)); err != nil {
+				return err
+			}
+		}
+		if err := recordSharedHomeDeletions(ctx, request.Messages.Ids); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1105,15 +1407,35 @@ func GetBanner(ctx context.Context) ([]byte, error) {
 
 func parseTimeGenerously(input string) (time.Time, error) {
 	input = strings.ReplaceAll(input, "_", " ")
-	return dateparse.ParseLocal(input)
+	t, err := dateparse.ParseLocal(input)
+	if err != nil {
+		// Also support relative times (e.g. `after:2y` for the last two years), which are useful in default filters
+		if age, ageErr := ParseRetentionAge(input); ageErr == nil {
+			return time.Now().Add(-age), nil
+		}
+	}
+	return t, err
 }
 
 func MakeWhereQueryFromSearch(ctx context.Context, db *gorm.DB, query string) (*gorm.DB, error) {
+	defer hctx.StartSpan("query build")()
 	tokens, err := tokenize(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to tokenize query: %v", err)
 	}
+	if isMainDb(ctx, db) {
+		// Searches are re-run on every keystroke in the TUI, so reuse their prepared statements
+		db = hctx.WithPreparedStatements(db)
+	}
+	if ctx != nil {
+		// So that the search stops once ctx is cancelled (e.g. because the query in the TUI changed)
+		db = db.WithContext(ctx)
+	}
+	coldTier := hctx.IsColdTier(db)
 	tx := db.Model(&data.HistoryEntry{}).Where("true")
+	if excludesReceivedChannelEntries(ctx, tokens) {
+		tx = tx.Where("NOT EXISTS (SELECT 1 FROM channel_entries WHERE channel_entries.device_id = history_entries.device_id AND channel_entries.end_time = history_entries.end_time AND channel_entries.received)")
+	}
 	for _, token := range tokens {
 		if strings.HasPrefix(token, "-") {
 			if token == "-" {
@@ -1122,36 +1444,77 @@ func MakeWhereQueryFromSearch(ctx context.Context, db *gorm.DB, query string) (*
 				continue
 			}
 			if containsUnescaped(token, ":") {
-				query, v1, v2, err := parseAtomizedToken(ctx, token[1:])
+				query, v1, v2, err := parseAtomizedToken(ctx, token[1:], coldTier)
 				if err != nil {
 					return nil, err
 				}
-				tx = tx.Where("NOT "+query, v1, v2)
+				tx = tx.Where("NOT "+query, trimNilVars(v1, v2)...)
 			} else {
-				query, v1, v2, v3, err := parseNonAtomizedToken(token[1:])
+				query, vars, err := parseNonAtomizedToken(token[1:], coldTier)
 				if err != nil {
 					return nil, err
 				}
-				tx = tx.Where("NOT "+query, v1, v2, v3)
+				tx = tx.Where("NOT "+query, vars...)
 			}
 		} else if containsUnescaped(token, ":") {
-			query, v1, v2, err := parseAtomizedToken(ctx, token)
+			query, v1, v2, err := parseAtomizedToken(ctx, token, coldTier)
 			if err != nil {
 				return nil, err
 			}
-			tx = tx.Where(query, v1, v2)
+			tx = tx.Where(query, trimNilVars(v1, v2)...)
 		} else {
-			query, v1, v2, v3, err := parseNonAtomizedToken(token)
+			query, vars, err := parseNonAtomizedToken(token, coldTier)
 			if err != nil {
 				return nil, err
 			}
-			tx = tx.Where(query, v1, v2, v3)
+			tx = tx.Where(query, vars...)
 		}
 	}
 	return tx, nil
 }
 
 func Search(ctx context.Context, db *gorm.DB, query string, limit int) ([]*data.HistoryEntry, error) {
+	return searchWithOrder(ctx, db, query, limit, "end_time DESC")
+}
+
+func searchWithOrder(ctx context.Context, db *gorm.DB, query string, limit int, order string) ([]*data.HistoryEntry, error) {
+	return searchPage(ctx, db, query, limit, order, searchCursor{})
+}
+
+// A searchCursor is the position in the results of a search that the next page of results starts after, see
+// searchPage
+type searchCursor struct {
+	// The last entry of the previous page, or nil for the first page
+	After *data.HistoryEntry `json:"after,omitempty"`
+	// The number of results in the previous pages. This is only used for orders that can't be paged by key (i.e.
+	// sorting by frecency, since the scores change over time).
+	Offset int `json:"offset,omitempty"`
+}
+
+// keysetCondition returns the condition for the entries that come after entry in order, or false if order doesn't
+// support keyset pagination. (end_time, device_id) is unique, so paging by it never skips or repeats an entry.
+func keysetCondition(order string, entry *data.HistoryEntry) (string, []interface{}, bool) {
+	if order != pinnedFirstOrder {
+		return "", nil, false
+	}
+	return "(COALESCE(pinned, 0), end_time, device_id) < (?, ?, ?)", []interface{}{entry.Pinned, entry.EndTime, entry.DeviceId}, true
+}
+
+// applySearchCursor restricts tx (which must be ordered by order) to the results that come after cursor
+func applySearchCursor(tx *gorm.DB, order string, cursor searchCursor) *gorm.DB {
+	if cursor.After != nil {
+		if condition, vars, ok := keysetCondition(order, cursor.After); ok {
+			return tx.Where(condition, vars...)
+		}
+	}
+	return tx.Offset(cursor.Offset)
+}
+
+// searchPage returns up to limit of the entries matching query that come after cursor in order. Where the order
+// supports it, pages are fetched via keyset pagination rather than an offset, so that loading a page deep into a huge
+// history (e.g. when scrolling down in the TUI) is as fast as loading the first one.
+func searchPage(ctx context.Context, db *gorm.DB, query string, limit int, order string, cursor searchCursor) ([]*data.HistoryEntry, error) {
+	defer hctx.StartSpan("search")()
 	if ctx == nil && query != "" {
 		return nil, fmt.Errorf("lib.Search called with a nil context and a non-empty query (this should never happen)")
 	}
@@ -1160,7 +1523,7 @@ func Search(ctx context.Context, db *gorm.DB, query string, limit int) ([]*data.
 	if err != nil {
 		return nil, err
 	}
-	tx = tx.Order("end_time DESC")
+	tx = applySearchCursor(tx.Order(order), order, cursor)
 	if limit > 0 {
 		tx = tx.Limit(limit)
 	}
@@ -1169,15 +1532,99 @@ func Search(ctx context.Context, db *gorm.DB, query string, limit int) ([]*data.
 	if result.Error != nil {
 		return nil, fmt.Errorf("DB query error: %v", result.Error)
 	}
+	// Archived entries are older than every entry in the main DB, so they are only searched if the main DB didn't
+	// have enough results
+	if isMainDb(ctx, db) && (limit <= 0 || len(historyEntries) < limit) && hasColdStorage(ctx) {
+		coldLimit := 0
+		if limit > 0 {
+			coldLimit = limit - len(historyEntries)
+		}
+		coldCursor := cursor
+		if cursor.Offset > 0 && len(historyEntries) == 0 {
+			// The page starts in the archived entries, after all of the matching entries in the main DB
+			numHotMatches, err := countHotMatches(ctx, db, query)
+			if err != nil {
+				return nil, err
+			}
+			coldCursor.Offset = max(0, cursor.Offset-int(numHotMatches))
+		} else {
+			coldCursor.Offset = 0
+		}
+		coldEntries, err := searchColdStorage(ctx, query, coldLimit, order, coldCursor)
+		if err != nil {
+			return nil, err
+		}
+		historyEntries = append(historyEntries, coldEntries...)
+	}
 	return historyEntries, nil
 }
 
-func parseNonAtomizedToken(token string) (string, interface{}, interface{}, interface{}, error) {
+// countHotMatches returns the number of entries in db (but not in the cold DB) matching query
+func countHotMatches(ctx context.Context, db *gorm.DB, query string) (int64, error) {
+	tx, err := MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	if err := tx.Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count matching entries: %w", err)
+	}
+	return count, nil
+}
+
+// isMainDb returns whether db is the (unfiltered) main DB, rather than e.g. another host's DB or a filtered query
+func isMainDb(ctx context.Context, db *gorm.DB) bool {
+	return ctx != nil && db == hctx.GetDb(ctx)
+}
+
+// CountSearchResults returns the total number of entries matching query, ignoring any limit
+func CountSearchResults(ctx context.Context, db *gorm.DB, query string) (int64, error) {
+	count, err := countHotMatches(ctx, db, query)
+	if err != nil {
+		return 0, err
+	}
+	if isMainDb(ctx, db) && hasColdStorage(ctx) {
+		coldCount, err := countColdStorage(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+		count += coldCount
+	}
+	return count, nil
+}
+
+// QueryStats describes how many entries matched a query and how long it took, to help users understand
+// truncated results and slow queries
+type QueryStats struct {
+	NumMatches   int64
+	NumDisplayed int
+	Duration     time.Duration
+}
+
+func (s QueryStats) String() string {
+	return fmt.Sprintf("Showing %d of %d matching entries (%s)", s.NumDisplayed, s.NumMatches, s.Duration.Round(time.Millisecond/10))
+}
+
+// trimNilVars removes the unused (nil) vars returned by parseAtomizedToken. gorm appends vars that don't have a
+// placeholder to the query, which would shift the vars of all later conditions.
+func trimNilVars(vars ...interface{}) []interface{} {
+	for len(vars) > 0 && vars[len(vars)-1] == nil {
+		vars = vars[:len(vars)-1]
+	}
+	return vars
+}
+
+// parseNonAtomizedToken returns the condition for a search token without an atom on the entries in the given tier
+// (see hctx.HostnameCondition)
+func parseNonAtomizedToken(token string, coldTier bool) (string, []interface{}, error) {
 	wildcardedToken := "%" + unescape(token) + "%"
-	return "(command LIKE ? OR hostname LIKE ? OR current_working_directory LIKE ?)", wildcardedToken, wildcardedToken, wildcardedToken, nil
+	// resolved_command is included so that searching for either an alias or the command it expanded to finds the entry
+	return "(command LIKE ? OR " + hctx.HostnameCondition(coldTier, "hostname LIKE ?") + " OR current_working_directory LIKE ? OR COALESCE(resolved_command, '') LIKE ?)", []interface{}{wildcardedToken, wildcardedToken, wildcardedToken, wildcardedToken}, nil
 }
 
-func parseAtomizedToken(ctx context.Context, token string) (string, interface{}, interface{}, error) {
+// parseAtomizedToken returns the condition for a search token with an atom (e.g. cwd:/tmp) on the entries in the given
+// tier (see hctx.HostnameCondition)
+func parseAtomizedToken(ctx context.Context, token string, coldTier bool) (string, interface{}, interface{}, error) {
 	splitToken := splitEscaped(token, ':', 2)
 	field := unescape(splitToken[0])
 	val := unescape(splitToken[1])
@@ -1187,11 +1634,99 @@ func parseAtomizedToken(ctx context.Context, token string) (string, interface{},
 	case "host":
 		fallthrough
 	case "hostname":
-		return "(instr(hostname, ?) > 0)", val, nil, nil
+		return "(" + hctx.HostnameCondition(coldTier, "instr(hostname, ?) > 0") + ")", val, nil, nil
 	case "cwd":
 		return "(instr(current_working_directory, ?) > 0 OR instr(REPLACE(current_working_directory, '~/', home_directory), ?) > 0)", strings.TrimSuffix(val, "/"), strings.TrimSuffix(val, "/"), nil
 	case "exit_code":
 		return "(exit_code = ?)", val, nil, nil
+	case "dev_env":
+		return "(instr(dev_environment, ?) > 0)", val, nil, nil
+	case "remote":
+		switch val {
+		case "true":
+			return "(COALESCE(remote_hosts, '') != ?)", "", nil, nil
+		case "false":
+			return "(COALESCE(remote_hosts, '') = ?)", "", nil, nil
+		default:
+			return "(instr(COALESCE(remote_hosts, ''), ?) > 0)", val, nil, nil
+		}
+	case "container":
+		switch val {
+		case "true":
+			return "(COALESCE(container, '') != ?)", "", nil, nil
+		case "false":
+			return "(COALESCE(container, '') = ?)", "", nil, nil
+		default:
+			return "(instr(COALESCE(container, ''), ?) > 0)", val, nil, nil
+		}
+	case "tmux":
+		switch val {
+		case "true":
+			return "(COALESCE(tmux_pane, '') != ?)", "", nil, nil
+		case "false":
+			return "(COALESCE(tmux_pane, '') = ?)", "", nil, nil
+		default:
+			return "(instr(COALESCE(tmux_pane, ''), ?) > 0)", val, nil, nil
+		}
+	case "correlation_id":
+		return "(correlation_id = ?)", val, nil, nil
+	case "env":
+		name, value, hasValue := strings.Cut(val, "=")
+		if !hasValue {
+			return "EXISTS (SELECT 1 FROM json_each(environment_variables) WHERE json_extract(value, '$.name') = ?)", name, nil, nil
+		}
+		return "EXISTS (SELECT 1 FROM json_each(environment_variables) WHERE json_extract(value, '$.name') = ? AND json_extract(value, '$.value') = ?)", name, value, nil
+	case "kubecontext":
+		switch val {
+		case "true":
+			return "(COALESCE(kube_context, '') != ?)", "", nil, nil
+		case "false":
+			return "(COALESCE(kube_context, '') = ?)", "", nil, nil
+		default:
+			return "(instr(COALESCE(kube_context, ''), ?) > 0)", val, nil, nil
+		}
+	case "pinned":
+		switch val {
+		case "true":
+			return "(COALESCE(pinned, 0) = ?)", true, nil, nil
+		case "false":
+			return "(COALESCE(pinned, 0) = ?)", false, nil, nil
+		default:
+			return "", nil, nil, fmt.Errorf("failed to parse pinned:%s, expected pinned:true or pinned:false", val)
+		}
+	case "root":
+		switch val {
+		case "true":
+			return "(COALESCE(as_root, 0) = ?)", true, nil, nil
+		case "false":
+			return "(COALESCE(as_root, 0) = ?)", false, nil, nil
+		default:
+			return "", nil, nil, fmt.Errorf("failed to parse root:%s, expected root:true or root:false", val)
+		}
+	case "shlvl":
+		return "(shell_level = ?)", val, nil, nil
+	case "nested":
+		switch val {
+		case "true":
+			return "(COALESCE(parent_shell_pid, 0) != ?)", 0, nil, nil
+		case "false":
+			return "(COALESCE(parent_shell_pid, 0) = ?)", 0, nil, nil
+		default:
+			return "", nil, nil, fmt.Errorf("failed to parse nested:%s, expected nested:true or nested:false", val)
+		}
+	case "interactive", "login", "script":
+		query, v, err := parseShellModeAtom(field, val)
+		return query, v, nil, err
+	case "defaults":
+		// Only used to disable the default filters in interactive searches, see applyDefaultFilters
+		if val != "true" && val != "false" {
+			return "", nil, nil, fmt.Errorf("failed to parse defaults:%s, expected defaults:true or defaults:false", val)
+		}
+		return "(1 = ?)", 1, nil, nil
+	case "tag":
+		return "EXISTS (SELECT 1 FROM entry_tags WHERE entry_tags.device_id = history_entries.device_id AND entry_tags.end_time = history_entries.end_time AND entry_tags.tag = ?)", val, nil, nil
+	case "channel":
+		return "EXISTS (SELECT 1 FROM channel_entries WHERE channel_entries.device_id = history_entries.device_id AND channel_entries.end_time = history_entries.end_time AND channel_entries.channel = ?)", val, nil, nil
 	case "before":
 		t, err := parseTimeGenerously(val)
 		if err != nil {
@@ -1205,27 +1740,20 @@ func parseAtomizedToken(ctx context.Context, token string) (string, interface{},
 		}
 		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) > ?)", t.Unix(), nil, nil
 	default:
-		knownCustomColumns := make([]string, 0)
-		// Get custom columns that are defined on this machine
-		conf := hctx.GetConf(ctx)
-		for _, c := range conf.CustomColumns {
-			knownCustomColumns = append(knownCustomColumns, c.ColumnName)
-		}
-		// Also get all ones that are in the DB
-		names, err := getAllCustomColumnNames(ctx)
+		// Check if the atom is for a custom column that exists (either on this machine or in the DB) and if it
+		// isn't, return an error
+		knownCustomColumns, err := getKnownCustomColumnNames(ctx)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to get custom column names from the DB: %v", err)
-		}
-		knownCustomColumns = append(knownCustomColumns, names...)
-		// Check if the atom is for a custom column that exists and if it isn't, return an error
-		isCustomColumn := false
-		for _, ccName := range knownCustomColumns {
-			if ccName == field {
-				isCustomColumn = true
-			}
+			return "", nil, nil, err
 		}
-		if !isCustomColumn {
-			return "", nil, nil, fmt.Errorf("search query contains unknown search atom '%s' that doesn't match any column names", field)
+		if !containsString(knownCustomColumns, field) {
+			err := fmt.Errorf("search query contains unknown search atom '%s' that doesn't match any column names", field)
+			if allNames, namesErr := getAllAtomNames(ctx); namesErr == nil {
+				if suggestion := suggestAtom(allNames, field); suggestion != "" {
+					err = fmt.Errorf("%w (did you mean '%s'?)", err, suggestion)
+				}
+			}
+			return "", nil, nil, err
 		}
 		// Build the where clause for the custom column
 		return "EXISTS (SELECT 1 FROM json_each(custom_columns) WHERE json_extract(value, '$.name') = ? and instr(json_extract(value, '$.value'), ?) > 0)", field, val, nil
@@ -1311,7 +1839,8 @@ func unescape(query string) string {
 }
 
 func GetDumpRequests(config hctx.ClientConfig) ([]*shared.DumpRequest, error) {
-	if config.IsOffline {
+	// Read-only devices don't reply to dump requests, since that would upload their entries
+	if config.IsOffline || config.ReadOnlyDevice {
 		return make([]*shared.DumpRequest, 0), nil
 	}
 	resp, err := ApiGet("/api/v1/get-dump-requests?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId)
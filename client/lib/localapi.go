@@ -0,0 +1,563 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The local API serves the local history DB over HTTP as JSON:API (https://jsonapi.org/) documents, so that rich
+// clients (e.g. a web UI) can query history without parsing CLI output or reading the DB directly. Filters use the
+// same query syntax as `hishtory query`.
+
+const jsonApiContentType = "application/vnd.api+json"
+
+const (
+	defaultApiPageSize = 50
+	maxApiPageSize     = 1000
+)
+
+// The fields of an entry that can be requested via fields[entries], in the order they are returned by default
+var apiEntryFields = []string{"command", "hostname", "username", "cwd", "home_directory", "exit_code", "start_time", "end_time", "runtime_seconds", "device_id", "dev_environment", "remote_hosts", "container", "kube_context", "environment_variables", "hit_count", "pinned", "resolved_command", "as_root", "shell_mode", "shell_level", "shell_pid", "parent_shell_pid", "tmux_pane", "correlation_id", "custom_columns"}
+
+// The SQL expressions that entries can be aggregated by via group_by
+var apiAggregations = map[string]string{
+	"hostname":  "hostname",
+	"cwd":       "current_working_directory",
+	"exit_code": "exit_code",
+	"command":   "command",
+	"prefix":    commandPrefixSql,
+	"day":       "date(start_time, 'localtime')",
+	"hour":      "CAST(strftime('%H', start_time, 'localtime') AS INTEGER)",
+}
+
+type apiHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request)
+
+type jsonApiResource struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type jsonApiDocument struct {
+	// Either a single jsonApiResource or a slice of them
+	Data  interface{}            `json:"data"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+	Links map[string]string      `json:"links,omitempty"`
+}
+
+type jsonApiError struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewLocalApiHandler returns the handler for the local API. Every request must be authenticated with the
+// given token via an `Authorization: Bearer TOKEN` header.
+func NewLocalApiHandler(ctx context.Context, token string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handlers map[string]apiHandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			handler, ok := handlers[r.Method]
+			if !ok {
+				writeApiError(w, http.StatusMethodNotAllowed, "Method not allowed", r.Method+" is not supported for "+pattern)
+				return
+			}
+			handler(ctx, w, r)
+		})
+	}
+	handle("/api/v1/entries", map[string]apiHandlerFunc{http.MethodGet: apiEntriesHandler})
+	handle("/api/v1/aggregations", map[string]apiHandlerFunc{http.MethodGet: apiAggregationsHandler})
+	handle("/api/v1/stats", map[string]apiHandlerFunc{http.MethodGet: apiStatsHandler})
+	handle("/api/v1/devices", map[string]apiHandlerFunc{http.MethodGet: apiDevicesHandler})
+	handle("/api/v1/hostname-merges", map[string]apiHandlerFunc{http.MethodPost: apiHostnameMergeHandler})
+	handle("/api/v1/settings", map[string]apiHandlerFunc{http.MethodGet: apiGetSettingsHandler, http.MethodPatch: apiPatchSettingsHandler})
+	handle("/api/v1/mcp", map[string]apiHandlerFunc{http.MethodPost: apiMcpHandler})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		providedToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(providedToken), []byte(token)) != 1 {
+			writeApiError(w, http.StatusUnauthorized, "Unauthorized", "a valid token must be provided via an `Authorization: Bearer TOKEN` header")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func apiEntriesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	fields, err := parseApiFields(params.Get("fields[entries]"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid fields", err.Error())
+		return
+	}
+	pageSize, pageNumber, err := parseApiPage(params)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid page", err.Error())
+		return
+	}
+	order := "end_time DESC"
+	switch params.Get("sort") {
+	case "", "-end_time":
+	case "end_time":
+		order = "end_time ASC"
+	default:
+		writeApiError(w, http.StatusBadRequest, "Invalid sort", "sort must be one of end_time or -end_time")
+		return
+	}
+
+	db := hctx.GetDb(ctx)
+	tx, err := MakeWhereQueryFromSearch(ctx, db, params.Get("filter[query]"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid filter", err.Error())
+		return
+	}
+	var total int64
+	if err := tx.Count(&total).Error; err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Query failed", err.Error())
+		return
+	}
+	// Re-build the query since gorm statements can't be reused after Count
+	tx, _ = MakeWhereQueryFromSearch(ctx, db, params.Get("filter[query]"))
+	var entries []*data.HistoryEntry
+	if err := tx.Order(order).Limit(pageSize).Offset((pageNumber - 1) * pageSize).Find(&entries).Error; err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Query failed", err.Error())
+		return
+	}
+
+	resources := make([]jsonApiResource, 0, len(entries))
+	for _, entry := range entries {
+		resources = append(resources, jsonApiResource{Type: "entries", Id: entryKey(entry), Attributes: apiEntryAttributes(entry, fields)})
+	}
+	doc := jsonApiDocument{
+		Data:  resources,
+		Meta:  map[string]interface{}{"total": total},
+		Links: map[string]string{"self": apiPageLink(r, pageNumber)},
+	}
+	if int64(pageNumber*pageSize) < total {
+		doc.Links["next"] = apiPageLink(r, pageNumber+1)
+	}
+	if pageNumber > 1 {
+		doc.Links["prev"] = apiPageLink(r, pageNumber-1)
+	}
+	writeApiDocument(w, doc)
+}
+
+type apiAggregation struct {
+	Key                   string  `json:"key"`
+	Count                 int64   `json:"count"`
+	NumFailures           int64   `json:"num_failures"`
+	AverageRuntimeSeconds float64 `json:"average_runtime_seconds"`
+}
+
+func apiAggregationsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupBy := params.Get("group_by")
+	groupBySql, ok := apiAggregations[groupBy]
+	if !ok {
+		writeApiError(w, http.StatusBadRequest, "Invalid group_by", "group_by must be one of "+strings.Join(getApiAggregationNames(), ", "))
+		return
+	}
+	pageSize, pageNumber, err := parseApiPage(params)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid page", err.Error())
+		return
+	}
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), params.Get("filter[query]"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid filter", err.Error())
+		return
+	}
+	aggregations, err := queryApiAggregations(tx, groupBySql, pageSize, (pageNumber-1)*pageSize)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Query failed", err.Error())
+		return
+	}
+
+	resources := make([]jsonApiResource, 0, len(aggregations))
+	for _, a := range aggregations {
+		resources = append(resources, jsonApiResource{
+			Type: "aggregations",
+			Id:   groupBy + "/" + a.Key,
+			Attributes: map[string]interface{}{
+				groupBy:                   a.Key,
+				"count":                   a.Count,
+				"num_failures":            a.NumFailures,
+				"average_runtime_seconds": a.AverageRuntimeSeconds,
+			},
+		})
+	}
+	doc := jsonApiDocument{
+		Data:  resources,
+		Links: map[string]string{"self": apiPageLink(r, pageNumber)},
+	}
+	if len(aggregations) == pageSize {
+		doc.Links["next"] = apiPageLink(r, pageNumber+1)
+	}
+	writeApiDocument(w, doc)
+}
+
+// queryApiAggregations groups the entries matched by tx by the given SQL expression, with the largest groups first
+func queryApiAggregations(tx *gorm.DB, groupBySql string, limit, offset int) ([]apiAggregation, error) {
+	var aggregations []apiAggregation
+	err := tx.Select("CAST(" + groupBySql + " AS TEXT) AS key, COUNT(*) AS count, SUM(exit_code != 0) AS num_failures, AVG(" + runtimeSecondsSql + ") AS average_runtime_seconds").
+		Group("key").Order("count DESC, key").Limit(limit).Offset(offset).Scan(&aggregations).Error
+	return aggregations, err
+}
+
+func apiStatsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxApiPageSize {
+			writeApiError(w, http.StatusBadRequest, "Invalid limit", fmt.Sprintf("limit must be between 1 and %d", maxApiPageSize))
+			return
+		}
+	}
+	stats, err := ComputeStats(ctx, r.URL.Query().Get("filter[query]"), limit)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Failed to compute stats", err.Error())
+		return
+	}
+	attributes, err := toJsonAttributes(stats)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Failed to compute stats", err.Error())
+		return
+	}
+	writeApiDocument(w, jsonApiDocument{Data: jsonApiResource{Type: "stats", Id: "current", Attributes: attributes}})
+}
+
+func apiDevicesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	records, err := GetHostnameHistory(ctx)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Query failed", err.Error())
+		return
+	}
+	currentDeviceId := hctx.GetConf(ctx).DeviceId
+	resources := make([]jsonApiResource, 0, len(records))
+	for _, record := range records {
+		resources = append(resources, jsonApiResource{
+			Type: "devices",
+			Id:   record.DeviceId + "/" + record.Hostname,
+			Attributes: map[string]interface{}{
+				"device_id":      record.DeviceId,
+				"hostname":       record.Hostname,
+				"first_seen":     record.FirstSeen,
+				"last_seen":      record.LastSeen,
+				"count":          record.Count,
+				"is_this_device": record.DeviceId == currentDeviceId,
+			},
+		})
+	}
+	writeApiDocument(w, jsonApiDocument{Data: resources})
+}
+
+func apiHostnameMergeHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Data struct {
+			Attributes struct {
+				OldHostname string `json:"old_hostname"`
+				NewHostname string `json:"new_hostname"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	attributes := request.Data.Attributes
+	if attributes.OldHostname == "" || attributes.NewHostname == "" {
+		writeApiError(w, http.StatusBadRequest, "Invalid request body", "both old_hostname and new_hostname must be specified")
+		return
+	}
+	numUpdated, err := MergeHostnames(ctx, attributes.OldHostname, attributes.NewHostname)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Failed to merge hostnames", err.Error())
+		return
+	}
+	writeApiDocument(w, jsonApiDocument{Data: jsonApiResource{
+		Type: "hostname-merges",
+		Id:   attributes.OldHostname + "/" + attributes.NewHostname,
+		Attributes: map[string]interface{}{
+			"old_hostname": attributes.OldHostname,
+			"new_hostname": attributes.NewHostname,
+			"num_updated":  numUpdated,
+		},
+	}})
+}
+
+// The subset of the config that can be viewed and edited via the local API
+type apiSettings struct {
+	ControlRSearchEnabled   *bool     `json:"enable_control_r_search,omitempty"`
+	FilterDuplicateCommands *bool     `json:"filter_duplicate_commands,omitempty"`
+	DisplayDeviceHostname   *bool     `json:"display_device_hostname,omitempty"`
+	DisplayedColumns        *[]string `json:"displayed_columns,omitempty"`
+	TimestampFormat         *string   `json:"timestamp_format,omitempty"`
+	ColorTheme              *string   `json:"color_theme,omitempty"`
+	SearchBackend           *string   `json:"search_backend,omitempty"`
+}
+
+func writeApiSettings(w http.ResponseWriter, config hctx.ClientConfig) {
+	attributes, err := toJsonAttributes(apiSettings{
+		ControlRSearchEnabled:   &config.ControlRSearchEnabled,
+		FilterDuplicateCommands: &config.FilterDuplicateCommands,
+		DisplayDeviceHostname:   &config.DisplayDeviceHostname,
+		DisplayedColumns:        &config.DisplayedColumns,
+		TimestampFormat:         &config.TimestampFormat,
+		ColorTheme:              &config.ColorTheme,
+		SearchBackend:           &config.SearchBackend,
+	})
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Failed to read settings", err.Error())
+		return
+	}
+	writeApiDocument(w, jsonApiDocument{Data: jsonApiResource{Type: "settings", Id: "current", Attributes: attributes}})
+}
+
+func apiGetSettingsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	// Read the config from disk rather than from ctx, since it may have changed since the server was started
+	config, err := hctx.GetConfig()
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Failed to read settings", err.Error())
+		return
+	}
+	writeApiSettings(w, config)
+}
+
+func apiPatchSettingsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Data struct {
+			Type       string      `json:"type"`
+			Id         string      `json:"id"`
+			Attributes apiSettings `json:"attributes"`
+		} `json:"data"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	settings := request.Data.Attributes
+	if settings.ColorTheme != nil {
+		if _, err := GetColorTheme(hctx.ClientConfig{ColorTheme: *settings.ColorTheme}); err != nil {
+			writeApiError(w, http.StatusBadRequest, "Invalid color_theme", err.Error())
+			return
+		}
+	}
+	if settings.SearchBackend != nil {
+		if _, err := GetSearchBackend(hctx.ClientConfig{SearchBackend: *settings.SearchBackend}); err != nil {
+			writeApiError(w, http.StatusBadRequest, "Invalid search_backend", err.Error())
+			return
+		}
+	}
+	if settings.TimestampFormat != nil && strings.TrimSpace(*settings.TimestampFormat) == "" {
+		writeApiError(w, http.StatusBadRequest, "Invalid timestamp_format", "the timestamp format can't be empty")
+		return
+	}
+	if settings.DisplayedColumns != nil && len(*settings.DisplayedColumns) == 0 {
+		writeApiError(w, http.StatusBadRequest, "Invalid displayed_columns", "at least one column must be displayed")
+		return
+	}
+	var updated hctx.ClientConfig
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if settings.ControlRSearchEnabled != nil {
+			config.ControlRSearchEnabled = *settings.ControlRSearchEnabled
+		}
+		if settings.FilterDuplicateCommands != nil {
+			config.FilterDuplicateCommands = *settings.FilterDuplicateCommands
+		}
+		if settings.DisplayDeviceHostname != nil {
+			config.DisplayDeviceHostname = *settings.DisplayDeviceHostname
+		}
+		if settings.DisplayedColumns != nil {
+			config.DisplayedColumns = *settings.DisplayedColumns
+		}
+		if settings.TimestampFormat != nil {
+			config.TimestampFormat = *settings.TimestampFormat
+		}
+		if settings.ColorTheme != nil {
+			config.ColorTheme = *settings.ColorTheme
+		}
+		if settings.SearchBackend != nil {
+			config.SearchBackend = *settings.SearchBackend
+		}
+		updated = *config
+	})
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, "Failed to update settings", err.Error())
+		return
+	}
+	writeApiSettings(w, updated)
+}
+
+// toJsonAttributes converts a struct into a JSON:API attributes map using its JSON field names
+func toJsonAttributes(v interface{}) (map[string]interface{}, error) {
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var attributes map[string]interface{}
+	err = json.Unmarshal(serialized, &attributes)
+	return attributes, err
+}
+
+func getApiAggregationNames() []string {
+	names := make([]string, 0, len(apiAggregations))
+	for name := range apiAggregations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseApiFields(fields string) ([]string, error) {
+	if fields == "" {
+		return apiEntryFields, nil
+	}
+	requested := strings.Split(fields, ",")
+	for _, field := range requested {
+		known := false
+		for _, f := range apiEntryFields {
+			if f == field {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown field %#v, must be one of %s", field, strings.Join(apiEntryFields, ", "))
+		}
+	}
+	return requested, nil
+}
+
+func parseApiPage(params url.Values) (pageSize, pageNumber int, err error) {
+	pageSize, pageNumber = defaultApiPageSize, 1
+	if s := params.Get("page[size]"); s != "" {
+		pageSize, err = strconv.Atoi(s)
+		if err != nil || pageSize < 1 || pageSize > maxApiPageSize {
+			return 0, 0, fmt.Errorf("page[size] must be between 1 and %d", maxApiPageSize)
+		}
+	}
+	if s := params.Get("page[number]"); s != "" {
+		pageNumber, err = strconv.Atoi(s)
+		if err != nil || pageNumber < 1 {
+			return 0, 0, fmt.Errorf("page[number] must be a positive integer")
+		}
+	}
+	return pageSize, pageNumber, nil
+}
+
+func apiPageLink(r *http.Request, pageNumber int) string {
+	params := r.URL.Query()
+	params.Set("page[number]", strconv.Itoa(pageNumber))
+	return r.URL.Path + "?" + params.Encode()
+}
+
+func apiEntryAttributes(entry *data.HistoryEntry, fields []string) map[string]interface{} {
+	attributes := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "command":
+			attributes[field] = entry.Command
+		case "hostname":
+			attributes[field] = entry.Hostname
+		case "username":
+			attributes[field] = entry.LocalUsername
+		case "cwd":
+			attributes[field] = entry.CurrentWorkingDirectory
+		case "home_directory":
+			attributes[field] = entry.HomeDirectory
+		case "exit_code":
+			attributes[field] = entry.ExitCode
+		case "start_time":
+			attributes[field] = entry.StartTime
+		case "end_time":
+			attributes[field] = entry.EndTime
+		case "runtime_seconds":
+			attributes[field] = entry.EndTime.Sub(entry.StartTime).Seconds()
+		case "device_id":
+			attributes[field] = entry.DeviceId
+		case "dev_environment":
+			attributes[field] = entry.DevEnvironment
+		case "remote_hosts":
+			attributes[field] = entry.RemoteHosts
+		case "container":
+			attributes[field] = entry.Container
+		case "kube_context":
+			attributes[field] = entry.KubeContext
+		case "environment_variables":
+			envVars := make(map[string]string)
+			for _, v := range entry.EnvironmentVariables {
+				envVars[v.Name] = v.Val
+			}
+			attributes[field] = envVars
+		case "hit_count":
+			attributes[field] = max(entry.HitCount, 1)
+		case "pinned":
+			attributes[field] = entry.Pinned
+		case "resolved_command":
+			attributes[field] = entry.ResolvedCommand
+		case "as_root":
+			attributes[field] = entry.AsRoot
+		case "shell_mode":
+			attributes[field] = entry.ShellMode
+		case "shell_level":
+			attributes[field] = entry.ShellLevel
+		case "shell_pid":
+			attributes[field] = entry.ShellPid
+		case "parent_shell_pid":
+			attributes[field] = entry.ParentShellPid
+		case "tmux_pane":
+			attributes[field] = entry.TmuxPane
+		case "correlation_id":
+			attributes[field] = entry.CorrelationId
+		case "custom_columns":
+			attributes[field] = entry.CustomColumns
+		}
+	}
+	return attributes
+}
+
+func writeApiDocument(w http.ResponseWriter, doc jsonApiDocument) {
+	w.Header().Set("Content-Type", jsonApiContentType)
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		hctx.GetLogger().Warnf("failed to write local API response: %v", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, title, detail string) {
+	w.Header().Set("Content-Type", jsonApiContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string][]jsonApiError{
+		"errors": {{Status: strconv.Itoa(status), Title: title, Detail: detail}},
+	})
+}
+
+// GetOrCreateLocalApiToken returns the token for the local API, generating and persisting one if it doesn't exist yet
+func GetOrCreateLocalApiToken(ctx context.Context) (string, error) {
+	if token := hctx.GetConf(ctx).LocalApiToken; token != "" {
+		return token, nil
+	}
+	token := uuid.Must(uuid.NewRandom()).String()
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		if config.LocalApiToken == "" {
+			config.LocalApiToken = token
+		}
+		token = config.LocalApiToken
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to persist the local API token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,392 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The MCP server lets AI assistants search the history via the Model Context Protocol
+// (https://modelcontextprotocol.io/). It speaks JSON-RPC 2.0, either over stdio (`hishtory mcp`) or over the local
+// API (POST /api/v1/mcp), and only exposes read-only tools. Secrets matching the configured redaction patterns
+// are replaced before anything is returned.
+
+// The MCP versions that are supported, newest first. Clients that request a different version are sent the newest.
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// What redacted secrets are replaced with
+const mcpRedactedPlaceholder = "[REDACTED]"
+
+const (
+	defaultMcpResultLimit = 20
+	maxMcpResultLimit     = 100
+)
+
+// The fields of entries that are returned by search_history. Fields like environment variables are left out since
+// they are likely to contain secrets.
+var mcpEntryFields = []string{"command", "cwd", "hostname", "exit_code", "start_time", "runtime_seconds"}
+
+// The JSON-RPC error codes that are used
+const (
+	jsonRpcParseError     = -32700
+	jsonRpcMethodNotFound = -32601
+	jsonRpcInvalidParams  = -32602
+	jsonRpcInternalError  = -32603
+)
+
+type jsonRpcRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonRpcResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonRpcError   `json:"error,omitempty"`
+}
+
+type jsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+type mcpToolResult struct {
+	Content []mcpTextContent `json:"content"`
+	IsError bool             `json:"isError"`
+}
+
+type mcpTextContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+var mcpTools = []mcpTool{
+	{
+		Name:        "search_history",
+		Description: "Search the user's shell history, newest commands first. Use this to find commands that the user ran before, e.g. \"the kubectl command I used last week\".",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "A hishtory query. Words match anywhere in the command, and atoms filter by field, e.g. `kubectl apply after:2024-06-01 before:2024-06-08 cwd:~/code exit_code:0 hostname:laptop`. Prefix a word or atom with - to exclude it. Empty to return the latest commands.",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("The maximum number of commands to return (default %d)", defaultMcpResultLimit),
+					"minimum":     1,
+					"maximum":     maxMcpResultLimit,
+				},
+			},
+		},
+	},
+	{
+		Name:        "aggregate_history",
+		Description: "Count the user's shell history commands grouped by a field, largest groups first, along with how many failed and their average runtime. Use this to find the commands, directories, or machines that the user uses the most.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"group_by": map[string]interface{}{
+					"type":        "string",
+					"description": "What to group commands by. prefix is the first word of the command.",
+					"enum":        getApiAggregationNames(),
+				},
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "A hishtory query to filter the commands by, in the same format as for search_history",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("The maximum number of groups to return (default %d)", defaultMcpResultLimit),
+					"minimum":     1,
+					"maximum":     maxMcpResultLimit,
+				},
+			},
+			"required": []string{"group_by"},
+		},
+	},
+}
+
+// ServeMcp serves MCP over stdio, reading newline-delimited JSON-RPC messages from r and writing the responses to w
+func ServeMcp(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		resp := HandleMcpMessage(ctx, []byte(line))
+		if resp == nil {
+			continue
+		}
+		if _, err := w.Write(append(resp, '\n')); err != nil {
+			return fmt.Errorf("failed to write an MCP response: %w", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func apiMcpHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid body", err.Error())
+		return
+	}
+	resp := HandleMcpMessage(ctx, body)
+	if resp == nil {
+		// Notifications don't have a response
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		hctx.GetLogger().Warnf("failed to write MCP response: %v", err)
+	}
+}
+
+// HandleMcpMessage handles a single JSON-RPC message and returns the serialized response, or nil if the message is
+// a notification
+func HandleMcpMessage(ctx context.Context, msg []byte) []byte {
+	var req jsonRpcRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return marshalJsonRpcResponse(jsonRpcResponse{Id: json.RawMessage("null"), Error: &jsonRpcError{Code: jsonRpcParseError, Message: "failed to parse the message: " + err.Error()}})
+	}
+	if len(req.Id) == 0 {
+		// Notifications (e.g. notifications/initialized) don't require any handling
+		return nil
+	}
+	result, rpcErr := handleMcpRequest(ctx, req)
+	return marshalJsonRpcResponse(jsonRpcResponse{Id: req.Id, Result: result, Error: rpcErr})
+}
+
+func marshalJsonRpcResponse(resp jsonRpcResponse) []byte {
+	resp.JsonRpc = "2.0"
+	serialized, err := json.Marshal(resp)
+	if err != nil {
+		serialized, _ = json.Marshal(jsonRpcResponse{JsonRpc: "2.0", Id: resp.Id, Error: &jsonRpcError{Code: jsonRpcInternalError, Message: err.Error()}})
+	}
+	return serialized
+}
+
+func handleMcpRequest(ctx context.Context, req jsonRpcRequest) (interface{}, *jsonRpcError) {
+	if len(req.Params) == 0 {
+		req.Params = json.RawMessage("{}")
+	}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &jsonRpcError{Code: jsonRpcInvalidParams, Message: err.Error()}
+		}
+		version := mcpProtocolVersions[0]
+		for _, v := range mcpProtocolVersions {
+			if v == params.ProtocolVersion {
+				version = v
+			}
+		}
+		return map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]interface{}{"name": "hishtory", "version": "v0." + Version},
+			"instructions":    "Searches the user's shell history. Secrets may have been replaced with " + mcpRedactedPlaceholder + ".",
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpTools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &jsonRpcError{Code: jsonRpcInvalidParams, Message: err.Error()}
+		}
+		if len(params.Arguments) == 0 {
+			params.Arguments = json.RawMessage("{}")
+		}
+		var result interface{}
+		var err error
+		switch params.Name {
+		case "search_history":
+			result, err = mcpSearchHistory(ctx, params.Arguments)
+		case "aggregate_history":
+			result, err = mcpAggregateHistory(ctx, params.Arguments)
+		default:
+			return nil, &jsonRpcError{Code: jsonRpcInvalidParams, Message: fmt.Sprintf("unknown tool %#v", params.Name)}
+		}
+		// Tool failures (e.g. invalid queries) are returned as results so that the assistant can see them and retry
+		if err != nil {
+			return mcpToolResult{Content: []mcpTextContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		text, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return mcpToolResult{Content: []mcpTextContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		return mcpToolResult{Content: []mcpTextContent{{Type: "text", Text: string(text)}}}, nil
+	default:
+		return nil, &jsonRpcError{Code: jsonRpcMethodNotFound, Message: fmt.Sprintf("unknown method %#v", req.Method)}
+	}
+}
+
+func parseMcpLimit(limit int) (int, error) {
+	if limit == 0 {
+		return defaultMcpResultLimit, nil
+	}
+	if limit < 1 || limit > maxMcpResultLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxMcpResultLimit)
+	}
+	return limit, nil
+}
+
+func mcpSearchHistory(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	limit, err := parseMcpLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	redactor, err := newMcpRedactor(hctx.GetConf(ctx).McpRedactionPatterns)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), args.Query)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*data.HistoryEntry
+	if err := tx.Order("end_time DESC").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to search history: %w", err)
+	}
+	results := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		attributes := apiEntryAttributes(entry, mcpEntryFields)
+		for field, value := range attributes {
+			if s, ok := value.(string); ok {
+				attributes[field] = redactor.redact(s)
+			}
+		}
+		results = append(results, attributes)
+	}
+	return results, nil
+}
+
+func mcpAggregateHistory(ctx context.Context, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		GroupBy string `json:"group_by"`
+		Query   string `json:"query"`
+		Limit   int    `json:"limit"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	groupBySql, ok := apiAggregations[args.GroupBy]
+	if !ok {
+		return nil, fmt.Errorf("group_by must be one of %s", strings.Join(getApiAggregationNames(), ", "))
+	}
+	limit, err := parseMcpLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	redactor, err := newMcpRedactor(hctx.GetConf(ctx).McpRedactionPatterns)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), args.Query)
+	if err != nil {
+		return nil, err
+	}
+	aggregations, err := queryApiAggregations(tx, groupBySql, limit, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate history: %w", err)
+	}
+	for i := range aggregations {
+		aggregations[i].Key = redactor.redact(aggregations[i].Key)
+	}
+	return aggregations, nil
+}
+
+type mcpRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+// ValidateMcpRedactionPattern checks that a redaction pattern is a valid regex
+func ValidateMcpRedactionPattern(pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid redaction pattern %#v: %w", pattern, err)
+	}
+	return nil
+}
+
+func newMcpRedactor(patterns []string) (*mcpRedactor, error) {
+	r := &mcpRedactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %#v: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// redact replaces each match of the patterns with a placeholder. If a pattern has capturing groups, only the text
+// matched by the groups is replaced, so that e.g. `--password[= ](\S+)` keeps the flag but hides its value.
+func (r *mcpRedactor) redact(s string) string {
+	for _, re := range r.patterns {
+		matches := re.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var redacted strings.Builder
+		last := 0
+		for _, match := range matches {
+			spans := [][]int{match[:2]}
+			if len(match) > 2 {
+				spans = nil
+				for i := 2; i < len(match); i += 2 {
+					if match[i] >= 0 {
+						spans = append(spans, match[i:i+2])
+					}
+				}
+			}
+			for _, span := range spans {
+				// Skip nested groups, which are already covered by their enclosing group
+				if span[0] < last || span[0] == span[1] {
+					continue
+				}
+				redacted.WriteString(s[last:span[0]])
+				redacted.WriteString(mcpRedactedPlaceholder)
+				last = span[1]
+			}
+		}
+		redacted.WriteString(s[last:])
+		s = redacted.String()
+	}
+	return s
+}
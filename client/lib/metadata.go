@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Metadata updates are changes to existing entries (e.g. tagging, pinning, or editing them) and to snippets.
+// Entries are uploaded once when they're recorded, so changes to them are instead synced as encrypted metadata
+// updates that every device applies.
+
+func applyMetadataUpdate(db *gorm.DB, update data.MetadataUpdate) error {
+	tag := data.EntryTag{DeviceId: update.DeviceId, EndTime: update.EndTime, Tag: update.Tag}
+	var err error
+	switch update.Kind {
+	case data.MetadataUpdateAddTag:
+		err = RetryDbWrite(func() error {
+			return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tag).Error
+		})
+	case data.MetadataUpdateRemoveTag:
+		err = RetryDbWrite(func() error {
+			return db.Where("device_id = ? AND end_time = ? AND tag = ?", tag.DeviceId, tag.EndTime, tag.Tag).Delete(&data.EntryTag{}).Error
+		})
+	case data.MetadataUpdatePin, data.MetadataUpdateUnpin:
+		err = RetryDbWrite(func() error {
+			return hctx.UpdateHistoryEntries(db.Where("device_id = ? AND end_time = ?", update.DeviceId, update.EndTime), map[string]interface{}{"pinned": update.Kind == data.MetadataUpdatePin}).Error
+		})
+	case data.MetadataUpdateEditCommand:
+		// The resolved alias no longer matches the edited command, so it is cleared rather than kept stale
+		err = RetryDbWrite(func() error {
+			return hctx.UpdateHistoryEntries(db.Where("device_id = ? AND end_time = ?", update.DeviceId, update.EndTime), map[string]interface{}{"command": update.Command, "resolved_command": ""}).Error
+		})
+	case data.MetadataUpdateSaveSnippet, data.MetadataUpdateDeleteSnippet:
+		if update.Snippet == nil {
+			hctx.GetLogger().Warnf("skipping %s metadata update without a snippet", update.Kind)
+			return nil
+		}
+		err = applySnippetUpdate(db, update.Kind, *update.Snippet)
+	default:
+		// Sent by a newer version of hishtory, so skip it rather than failing to sync
+		hctx.GetLogger().Warnf("skipping metadata update with unknown kind %#v", update.Kind)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply metadata update to the DB: %w", err)
+	}
+	return nil
+}
+
+// SendMetadataUpdates sends the given updates to the backend so that they're applied on all other devices
+func SendMetadataUpdates(ctx context.Context, updates []data.MetadataUpdate) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline || len(updates) == 0 {
+		return nil
+	}
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return err
+	}
+	encUpdates := make([]shared.EncMetadataUpdate, 0, len(updates))
+	for _, update := range updates {
+		encUpdate, err := data.EncryptMetadataUpdateWithProvider(provider, config.UserSecret, update)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt metadata update: %w", err)
+		}
+		encUpdates = append(encUpdates, encUpdate)
+	}
+	jsonValue, err := json.Marshal(encUpdates)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata updates: %w", err)
+	}
+	_, err = ApiPost("/api/v1/add-metadata-updates", "application/json", jsonValue)
+	if err != nil {
+		return fmt.Errorf("failed to send metadata updates to the backend, so they may not be synced to your other devices: %w", err)
+	}
+	return nil
+}
+
+// ProcessMetadataUpdates applies the metadata updates that were sent by other devices
+func ProcessMetadataUpdates(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil
+	}
+	resp, err := ApiGet("/api/v1/get-metadata-updates?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId)
+	if IsOfflineError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var encUpdates []*shared.EncMetadataUpdate
+	if err := json.Unmarshal(resp, &encUpdates); err != nil {
+		return fmt.Errorf("failed to load JSON response: %w", err)
+	}
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return err
+	}
+	db := hctx.GetDb(ctx)
+	for _, encUpdate := range encUpdates {
+		update, err := data.DecryptMetadataUpdateWithProvider(provider, config.UserSecret, *encUpdate)
+		if err != nil {
+			hctx.GetLogger().Warnf("failed to decrypt metadata update from server, skipping it: %v", err)
+			continue
+		}
+		if update.Kind == data.MetadataUpdatePin || update.Kind == data.MetadataUpdateEditCommand {
+			if err := unarchiveEntry(ctx, update.DeviceId, update.EndTime); err != nil {
+				return err
+			}
+		}
+		if err := applyMetadataUpdate(db, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
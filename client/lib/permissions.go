@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/ddworken/hishtory/client/data"
+)
+
+// The files in the hishtory directories that don't contain any private data (the binary and the shell hooks), so
+// they only need to be protected from modification by other users. All other files (the config, which contains the
+// secret key, the DB and its WAL, logs, and backups) must only be accessible by their owner.
+var publicHishtoryFiles = map[string]bool{
+	"hishtory":     true,
+	"hishtory.exe": true,
+	"config.sh":    true,
+	"config.zsh":   true,
+	"config.fish":  true,
+	"config.ps1":   true,
+	"config.nu":    true,
+	"config.tcsh":  true,
+	"config.ksh":   true,
+}
+
+// getExpectedOwner returns the user that hishtory's files should be owned by. When hishtory is run via sudo,
+// that is the user who ran sudo rather than root.
+func getExpectedOwner() (uid, gid int) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if uid != 0 {
+		return uid, gid
+	}
+	sudoUid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return uid, gid
+	}
+	sudoGid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		sudoGid = gid
+	}
+	return sudoUid, sudoGid
+}
+
+// AuditPermissions checks that every file in the hishtory directories is owned by the current user and isn't
+// accessible by other users beyond what it needs, and fixes the problems if fix is set. Files owned by another
+// user (usually root, after an accidental `sudo hishtory`) can only be fixed when running as root. It returns the
+// number of problems that weren't fixed.
+func AuditPermissions(out io.Writer, fix bool) (int, error) {
+	if runtime.GOOS == "windows" {
+		fmt.Fprintln(out, "Auditing file permissions isn't supported on Windows")
+		return 0, nil
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	expectedUid, expectedGid := getExpectedOwner()
+	unfixedProblems := 0
+	reportProblem := func(problem string, fixProblem func() error) {
+		fmt.Fprintf(out, "  %s\n", problem)
+		if !fix || fixProblem == nil {
+			unfixedProblems += 1
+			return
+		}
+		if err := fixProblem(); err != nil {
+			fmt.Fprintf(out, "    Failed to fix: %v\n", err)
+			unfixedProblems += 1
+			return
+		}
+		fmt.Fprintln(out, "    Fixed")
+	}
+
+	dirs := []string{data.GetHishtoryDir(homedir)}
+	if configDir := data.GetHishtoryConfigDir(homedir); configDir != dirs[0] {
+		dirs = append(dirs, configDir)
+	}
+	for _, dir := range dirs {
+		fmt.Fprintf(out, "Checking the permissions of %s...\n", dir)
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) && path == dir {
+					return filepath.SkipDir
+				}
+				reportProblem(fmt.Sprintf("%s can't be read: %v", path, err), nil)
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := os.Lstat(path)
+			if err != nil {
+				reportProblem(fmt.Sprintf("%s can't be read: %v", path, err), nil)
+				return nil
+			}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return nil
+			}
+
+			if uid, ok := getFileOwner(info); ok && uid != expectedUid {
+				problem := fmt.Sprintf("%s is owned by uid %d rather than uid %d", path, uid, expectedUid)
+				if uid == 0 {
+					problem += ", likely because hishtory was run via sudo"
+				}
+				var fixOwner func() error
+				if os.Getuid() == 0 {
+					fixOwner = func() error {
+						return os.Lchown(path, expectedUid, expectedGid)
+					}
+				} else {
+					problem += fmt.Sprintf(". Fix this by running `sudo chown -R %d:%d %s`", expectedUid, expectedGid, dir)
+				}
+				reportProblem(problem, fixOwner)
+			}
+
+			// Directories and private files shouldn't be accessible by other users at all, while public files
+			// only need to be protected from modification
+			disallowed := fs.FileMode(0o077)
+			if !info.IsDir() && publicHishtoryFiles[info.Name()] {
+				disallowed = 0o022
+			}
+			if perm := info.Mode().Perm(); perm&disallowed != 0 {
+				expected := perm &^ disallowed
+				reportProblem(fmt.Sprintf("%s has mode %#o, expected %#o", path, perm, expected), func() error {
+					return os.Chmod(path, expected)
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to check the permissions of %s: %w", dir, err)
+		}
+	}
+	return unfixedProblems, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package lib
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// getFileOwner returns the uid of the user that owns the file, if it is available on this platform
+func getFileOwner(info fs.FileInfo) (uid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
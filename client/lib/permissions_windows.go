@@ -0,0 +1,10 @@
+//go:build windows
+
+package lib
+
+import "io/fs"
+
+// getFileOwner returns the uid of the user that owns the file, if it is available on this platform
+func getFileOwner(info fs.FileInfo) (uid int, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The name of the built-in bubbletea TUI search backend
+const BuiltinSearchBackend = "builtin"
+
+// SearchBackend is an interactive picker used by `hishtory tquery` (and thus the control-r binding)
+// to let the user select a command from their history.
+type SearchBackend interface {
+	// Search runs the interactive picker and returns the selected command, or an empty string if
+	// the user didn't select anything.
+	Search(ctx context.Context, initialQuery string) (string, error)
+}
+
+// The preview shown by fzf-like pickers, using the fields from FzfSourceColumns
+const externalPickerPreview = `printf "Host: %s\nCWD: %s\nTime: %s\nRuntime: %s\nExit Code: %s\n\n%b\n" {2} {3} {4} {5} {6} {1}`
+
+type externalPicker struct {
+	binary string
+	// Builds the arguments for the picker given the initial query
+	makeArgs func(initialQuery string) []string
+	// Whether the picker understands the full tab-separated fzf source format. If false, it is only
+	// given the commands.
+	supportsFzfSource bool
+}
+
+func fzfLikeArgs(initialQuery string) []string {
+	return []string{"--delimiter", "\t", "--with-nth", "1", "--no-sort", "--query", initialQuery, "--preview", externalPickerPreview, "--preview-window", "down:8:wrap"}
+}
+
+var externalPickers = map[string]externalPicker{
+	"fzf":  {binary: "fzf", makeArgs: fzfLikeArgs, supportsFzfSource: true},
+	"skim": {binary: "sk", makeArgs: fzfLikeArgs, supportsFzfSource: true},
+	"fuzzel": {binary: "fuzzel", makeArgs: func(initialQuery string) []string {
+		return []string{"--dmenu", "--prompt", "hishtory> "}
+	}, supportsFzfSource: false},
+}
+
+// GetSearchBackendNames returns the names of all supported search backends
+func GetSearchBackendNames() []string {
+	return []string{BuiltinSearchBackend, "fzf", "skim", "fuzzel"}
+}
+
+// GetSearchBackend returns the search backend configured by the user
+func GetSearchBackend(config hctx.ClientConfig) (SearchBackend, error) {
+	if config.SearchBackend == "" || config.SearchBackend == BuiltinSearchBackend {
+		return builtinTui{}, nil
+	}
+	picker, ok := externalPickers[config.SearchBackend]
+	if !ok {
+		return nil, fmt.Errorf("unknown search backend %#v (valid options are %s)", config.SearchBackend, strings.Join(GetSearchBackendNames(), ", "))
+	}
+	return picker, nil
+}
+
+func (p externalPicker) Search(ctx context.Context, initialQuery string) (string, error) {
+	if _, err := exec.LookPath(p.binary); err != nil {
+		return "", fmt.Errorf("search backend %#v is not installed (set a different one via `hishtory config-set search-backend`): %w", p.binary, err)
+	}
+	// Unlike the built-in TUI, external pickers can't display new entries as they arrive, so sync first
+	err := RetrieveAdditionalEntriesFromRemote(ctx)
+	if err != nil && !IsOfflineError(err) {
+		return "", err
+	}
+	err = ProcessDeletionRequests(ctx)
+	if err != nil && !IsOfflineError(err) {
+		return "", err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		if p.supportsFzfSource {
+			err = WriteFzfSource(ctx, pw, applyDefaultFilters(hctx.GetConf(ctx), ""))
+		} else {
+			err = writeCommandsOnly(ctx, pw, applyDefaultFilters(hctx.GetConf(ctx), ""))
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	cmd := exec.CommandContext(ctx, p.binary, p.makeArgs(initialQuery)...)
+	cmd.Stdin = pr
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// fzf and skim exit with 1 when nothing matched and 130 when the user aborted, and
+			// fuzzel exits with 1 when aborted. None of those are errors from our perspective.
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to run search backend %#v: %w", p.binary, err)
+	}
+	selected := strings.TrimSuffix(stdout.String(), "\n")
+	if p.supportsFzfSource {
+		selected, _, _ = strings.Cut(selected, "\t")
+	}
+	return unescapeFzfField(selected), nil
+}
+
+// writeCommandsOnly is like WriteFzfSource, but only outputs the (escaped) commands for pickers that
+// don't support multiple columns
+func writeCommandsOnly(ctx context.Context, out io.Writer, query string) error {
+	return writeFzfEntries(ctx, out, query, func(entry data.HistoryEntry) string {
+		return escapeFzfField(entry.Command)
+	})
+}
+
+// unescapeFzfField reverses escapeFzfField
+func unescapeFzfField(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'n':
+				sb.WriteByte('\n')
+				i++
+				continue
+			case 't':
+				sb.WriteByte('\t')
+				i++
+				continue
+			case '\\':
+				sb.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
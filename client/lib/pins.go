@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"context"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The order that results are displayed in the TUI by default, with pinned entries before all other matching entries.
+// device_id breaks ties so that the TUI can load more results via keyset pagination (see searchPage).
+const pinnedFirstOrder = "COALESCE(pinned, 0) DESC, end_time DESC, device_id DESC"
+
+// SetEntryPinned pins or unpins entry, and syncs the change to all other devices
+func SetEntryPinned(ctx context.Context, entry data.HistoryEntry, pinned bool) error {
+	update := data.MetadataUpdate{Kind: data.MetadataUpdateUnpin, DeviceId: entry.DeviceId, EndTime: entry.EndTime}
+	if pinned {
+		update.Kind = data.MetadataUpdatePin
+	}
+	if pinned {
+		if err := unarchiveEntry(ctx, entry.DeviceId, entry.EndTime); err != nil {
+			return err
+		}
+	}
+	if err := applyMetadataUpdate(hctx.GetDb(ctx), update); err != nil {
+		return err
+	}
+	return SendMetadataUpdates(ctx, []data.MetadataUpdate{update})
+}
+
+// togglePinned pins the highlighted entry in the TUI, or unpins it if it is already pinned
+func togglePinned(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	if !isSearchingHistory(m.ctx) {
+		m.statusMessage = "Only entries in your shell history can be pinned"
+		return m, nil
+	}
+	entry := *m.tableEntries[m.table.Cursor()]
+	err := SetEntryPinned(m.ctx, entry, !entry.Pinned)
+	if IsOfflineError(err) {
+		m.isOffline = true
+	} else if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	if entry.Pinned {
+		m.statusMessage = "Unpinned the entry"
+	} else {
+		m.statusMessage = "Pinned the entry, it will be displayed first whenever it matches your search"
+	}
+	m = runQueryAndUpdateTable(m, true)
+	return m, nil
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The pre-exec hook runs before every command, so it is killed (and the command is allowed) if it doesn't decide
+// within this long. This keeps a slow or hung hook from hanging the user's prompt.
+const preExecHookTimeout = 500 * time.Millisecond
+
+// The decisions that the pre-exec hook can make about a command
+const (
+	PreExecAllow = "allow"
+	PreExecDeny  = "deny"
+	PreExecWarn  = "warn"
+)
+
+// PreExecResult is the decision made by the pre-exec hook configured via ClientConfig.PreExecHook
+type PreExecResult struct {
+	Decision string
+	// The explanation from the hook, which is displayed to the user for denied commands and warnings
+	Message string
+}
+
+// CheckPreExec runs the pre-exec hook (if one is configured) for a command that is about to be run, and returns
+// whether the command should be allowed, denied, or allowed with a warning. The hook is given the entry that will
+// be recorded for the command as JSON on stdin (without the exit code and end time, since the command hasn't run
+// yet), and prints its decision as the first word of its output, optionally followed by a message (e.g.
+// `deny: use the deploy script instead`). The hook fails open: commands are allowed if the hook fails, times out,
+// or prints an unknown decision.
+func CheckPreExec(ctx context.Context, shell, command string) PreExecResult {
+	hook := hctx.GetConf(ctx).PreExecHook
+	if hook == "" {
+		return PreExecResult{Decision: PreExecAllow}
+	}
+	if shell == "bash" {
+		// Like saveHistoryEntry, the bash hook passes the output of `history 1`
+		cmd, err := getLastCommand(command)
+		if err == nil {
+			cmd, err = maybeSkipBashHistTimePrefix(cmd)
+		}
+		if err != nil {
+			hctx.GetLogger().Warnf("Skipping the pre-exec hook since we failed to parse the bash history line %#v: %v", command, err)
+			return PreExecResult{Decision: PreExecAllow}
+		}
+		command = cmd
+	}
+	entry := buildPreExecEntry(ctx, command)
+	result, err := runPreExecHook(hook, entry, preExecHookTimeout)
+	if err != nil {
+		hctx.GetLogger().Warnf("Allowing %#v since the pre-exec hook failed: %v", command, err)
+		return PreExecResult{Decision: PreExecAllow}
+	}
+	return result
+}
+
+// buildPreExecEntry builds the entry for a command that hasn't been run yet. This only includes the metadata that is
+// cheap to gather, since it delays every command.
+func buildPreExecEntry(ctx context.Context, command string) *data.HistoryEntry {
+	entry := &data.HistoryEntry{
+		Command:   strings.ReplaceAll(command, "\r\n", "\n"),
+		StartTime: time.Now(),
+		DeviceId:  hctx.GetConf(ctx).DeviceId,
+		AsRoot:    isRunningAsRoot(),
+	}
+	if u, err := user.Current(); err == nil {
+		entry.LocalUsername = u.Username
+	}
+	if sudoUser := getSudoUser(); sudoUser != nil {
+		entry.LocalUsername = sudoUser.Username
+	}
+	if cwd, homedir, err := getCwd(ctx); err == nil {
+		entry.CurrentWorkingDirectory = cwd
+		entry.HomeDirectory = homedir
+		entry.KubeContext = getKubeContext(homedir)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		entry.Hostname = hostname
+	}
+	entry.DevEnvironment = getDevEnvironment(ctx)
+	entry.RemoteHosts = getRemoteHosts()
+	entry.Container = getContainer()
+	entry.EnvironmentVariables = buildEnvironmentVariables(ctx)
+	entry.ShellMode = getShellMode()
+	entry.ShellLevel, entry.ShellPid, entry.ParentShellPid = getShellNesting()
+	entry.TmuxPane = getTmuxPane()
+	return entry
+}
+
+func runPreExecHook(hook string, entry *data.HistoryEntry, timeout time.Duration) (PreExecResult, error) {
+	input, err := json.Marshal(entry)
+	if err != nil {
+		return PreExecResult{}, fmt.Errorf("failed to serialize the entry: %w", err)
+	}
+	cmd := exec.Command("bash", "-c", hook)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return PreExecResult{}, fmt.Errorf("failed to start the pre-exec hook: %w", err)
+	}
+	// Rather than waiting for the hook to be killed, give up as soon as the timeout passes since processes started
+	// by the hook could otherwise keep its output open indefinitely
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return PreExecResult{}, fmt.Errorf("the pre-exec hook failed (stderr=%#v): %w", stderr.String(), err)
+		}
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		return PreExecResult{}, fmt.Errorf("the pre-exec hook didn't finish within %s", timeout)
+	}
+	return parsePreExecOutput(stdout.String())
+}
+
+// parsePreExecOutput parses the decision printed by the pre-exec hook, e.g. `allow` or `warn: this is prod`
+func parsePreExecOutput(output string) (PreExecResult, error) {
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	end := strings.IndexFunc(firstLine, func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		end = len(firstLine)
+	}
+	decision := strings.ToLower(firstLine[:end])
+	message := strings.TrimSpace(strings.TrimLeft(firstLine[end:], ": \t"))
+	switch decision {
+	case PreExecAllow, PreExecDeny, PreExecWarn:
+		return PreExecResult{Decision: decision, Message: message}, nil
+	default:
+		return PreExecResult{}, fmt.Errorf("unknown decision %#v, expected one of %s, %s, or %s", decision, PreExecAllow, PreExecDeny, PreExecWarn)
+	}
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The machine-readable formats supported by `hishtory query --format`, so that scripts can consume search results
+// without scraping the table:
+//   - json: a JSON array with an object per entry
+//   - tsv: a line per entry with tab-separated fields, where tabs, newlines, and backslashes are escaped like
+//     in --fzf-source
+//   - null-delimited: like tsv, but each entry is terminated by a NUL byte rather than a newline and the fields
+//     aren't escaped, for use with e.g. `xargs -0`
+var QueryOutputFormats = []string{"json", "tsv", "null-delimited"}
+
+// FormattedQueryOptions configures the output of WriteFormattedResults
+type FormattedQueryOptions struct {
+	Format string
+	// A comma-separated list of the fields to output, using the same names as the local API. Defaults to all fields.
+	Fields string
+	// The maximum number of entries to output, or 0 for no limit
+	Limit int
+	// The number of matching entries to skip, for paginating through the results along with Limit
+	Offset int
+}
+
+// WriteFormattedResults writes the entries matching query to out in a machine-readable format, most recent first
+func WriteFormattedResults(ctx context.Context, out io.Writer, query string, options FormattedQueryOptions) error {
+	if !isQueryOutputFormat(options.Format) {
+		return fmt.Errorf("unknown format %#v, must be one of %s", options.Format, strings.Join(QueryOutputFormats, ", "))
+	}
+	fields, err := parseApiFields(options.Fields)
+	if err != nil {
+		return err
+	}
+	if options.Limit < 0 || options.Offset < 0 {
+		return fmt.Errorf("--limit and --offset must not be negative")
+	}
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	if err != nil {
+		return err
+	}
+	tx = tx.Order("end_time DESC").Offset(options.Offset)
+	if options.Limit > 0 {
+		tx = tx.Limit(options.Limit)
+	}
+	var entries []*data.HistoryEntry
+	if err := tx.Find(&entries).Error; err != nil {
+		return fmt.Errorf("DB query error: %w", err)
+	}
+	if hasColdStorage(ctx) && (options.Limit == 0 || len(entries) < options.Limit) {
+		// The page continues into the archived entries, which are all older than the entries in the main DB
+		coldOffset := 0
+		if len(entries) == 0 && options.Offset > 0 {
+			numHotMatches, err := countHotMatches(ctx, hctx.GetDb(ctx), query)
+			if err != nil {
+				return err
+			}
+			coldOffset = max(0, options.Offset-int(numHotMatches))
+		}
+		coldLimit := 0
+		if options.Limit > 0 {
+			coldLimit = options.Limit - len(entries)
+		}
+		coldEntries, err := searchColdStorage(ctx, query, coldLimit, "end_time DESC", searchCursor{Offset: coldOffset})
+		if err != nil {
+			return err
+		}
+		entries = append(entries, coldEntries...)
+	}
+
+	if options.Format == "json" {
+		results := make([]map[string]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			results = append(results, apiEntryAttributes(entry, fields))
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(results)
+	}
+	w := bufio.NewWriter(out)
+	for _, entry := range entries {
+		attributes := apiEntryAttributes(entry, fields)
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			value, err := formatFieldValue(attributes[field])
+			if err != nil {
+				return err
+			}
+			if options.Format == "tsv" {
+				value = escapeFzfField(value)
+			}
+			values = append(values, value)
+		}
+		terminator := "\n"
+		if options.Format == "null-delimited" {
+			terminator = "\x00"
+		}
+		if _, err := w.WriteString(strings.Join(values, "\t") + terminator); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func isQueryOutputFormat(format string) bool {
+	for _, f := range QueryOutputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// formatFieldValue formats a single field for the delimited formats. Timestamps use RFC 3339 and structured values
+// (e.g. environment variables) are encoded as JSON.
+func formatFieldValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("failed to format %#v: %w", value, err)
+		}
+		return string(b), nil
+	}
+}
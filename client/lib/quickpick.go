@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/mattn/go-runewidth"
+)
+
+// The number of results displayed by the quick picker
+const quickPickHeight = 10
+
+// quickPickModel is a minimal picker for `hishtory query --pick`. Unlike the TUI, it only displays the matching
+// commands below a search box, and it is rendered inline (without taking over the screen) so that it works well
+// in places where the full TUI is overkill, like vim's :terminal.
+type quickPickModel struct {
+	ctx     context.Context
+	input   textinput.Model
+	entries []*data.HistoryEntry
+	cursor  int
+	// An error from the last search, displayed until the query is changed
+	searchErr error
+	// The width of the terminal, or 0 if it is unknown
+	width    int
+	selected *data.HistoryEntry
+	done     bool
+}
+
+func newQuickPickModel(ctx context.Context, initialQuery string) quickPickModel {
+	input := textinput.New()
+	input.Prompt = "> "
+	input.Placeholder = "search your history"
+	input.CharLimit = 156
+	input.SetValue(initialQuery)
+	input.Focus()
+	m := quickPickModel{ctx: ctx, input: input}
+	return m.search()
+}
+
+func (m quickPickModel) search() quickPickModel {
+	_, entries, err := getRows(m.ctx, []string{"Command"}, m.input.Value(), quickPickHeight)
+	m.searchErr = err
+	if err == nil {
+		m.entries = entries
+		m.cursor = 0
+	}
+	return m
+}
+
+func (m quickPickModel) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m quickPickModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, keys.SelectEntry):
+			if len(m.entries) > 0 {
+				m.selected = m.entries[m.cursor]
+			}
+			m.done = true
+			return m, tea.Quit
+		case key.Matches(msg, keys.Quit):
+			m.done = true
+			return m, tea.Quit
+		case key.Matches(msg, keys.Up):
+			m.cursor = max(m.cursor-1, 0)
+			return m, nil
+		case key.Matches(msg, keys.Down):
+			m.cursor = max(min(m.cursor+1, len(m.entries)-1), 0)
+			return m, nil
+		}
+		previousQuery := m.input.Value()
+		var cmd tea.Cmd
+		m.input, cmd = m.input.Update(msg)
+		if m.input.Value() != previousQuery {
+			m = m.search()
+		}
+		return m, cmd
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		return m, nil
+	default:
+		var cmd tea.Cmd
+		m.input, cmd = m.input.Update(msg)
+		return m, cmd
+	}
+}
+
+func (m quickPickModel) View() string {
+	if m.done {
+		// Clear the picker so that only the selection is left behind
+		return ""
+	}
+	width := m.width
+	if width <= 0 {
+		width = 80
+	}
+	var sb strings.Builder
+	sb.WriteString(m.input.View() + "\n")
+	if m.searchErr != nil {
+		sb.WriteString(runewidth.Truncate(fmt.Sprintf("  failed to search: %v", m.searchErr), width, "…") + "\n")
+	} else if len(m.entries) == 0 {
+		sb.WriteString("  no matching commands\n")
+	}
+	for i, entry := range m.entries {
+		prefix := "  "
+		if i == m.cursor {
+			prefix = "> "
+		}
+		sb.WriteString(runewidth.Truncate(prefix+collapseNewlines(entry.Command), width, "…") + "\n")
+	}
+	return sb.String()
+}
+
+// QuickPick runs the quick picker for `hishtory query --pick` and returns the selected command, or an empty string
+// if nothing was selected. The picker is drawn on stderr so that stdout only contains the selection.
+func QuickPick(ctx context.Context, initialQuery string) (string, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return "", fmt.Errorf("hishtory query --pick must be run in a terminal")
+	}
+	err := RetrieveAdditionalEntriesFromRemote(ctx)
+	if err != nil && !IsOfflineError(err) {
+		return "", err
+	}
+	if _, err := Search(ctx, hctx.GetDb(ctx), initialQuery, 1); err != nil {
+		// The initial query is likely invalid, so start with an empty one rather than failing
+		initialQuery = ""
+	}
+	finalModel, err := tea.NewProgram(newQuickPickModel(ctx, initialQuery), tea.WithOutput(os.Stderr)).Run()
+	if err != nil {
+		return "", err
+	}
+	selected := finalModel.(quickPickModel).selected
+	if selected == nil {
+		return "", nil
+	}
+	if err := RecordEntryUsage(ctx, *selected); err != nil {
+		hctx.GetLogger().Warnf("%v", err)
+	}
+	return selected.Command, nil
+}
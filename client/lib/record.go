@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// A RecordedCommand is a command reported to `hishtory record` by a tool other than a shell hook (e.g. a CI
+// wrapper or an editor terminal). Unset fields default to the values for the current process.
+type RecordedCommand struct {
+	Command   string     `json:"command"`
+	ExitCode  int        `json:"exit_code"`
+	Cwd       string     `json:"cwd,omitempty"`
+	StartTime RecordTime `json:"start_time,omitempty"`
+	EndTime   RecordTime `json:"end_time,omitempty"`
+	Hostname  string     `json:"hostname,omitempty"`
+}
+
+// A RecordTime is a timestamp that is either a unix timestamp in seconds or an RFC3339 string, in both JSON and flags
+type RecordTime struct {
+	time.Time
+}
+
+func ParseRecordTime(s string) (RecordTime, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return RecordTime{}, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return RecordTime{time.Unix(0, int64(seconds*float64(time.Second)))}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return RecordTime{}, fmt.Errorf("failed to parse %#v as either a unix timestamp or an RFC3339 time", s)
+	}
+	return RecordTime{t}, nil
+}
+
+func (t *RecordTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else if string(b) != "null" {
+		s = string(b)
+	}
+	parsed, err := ParseRecordTime(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func (t RecordTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Time)
+}
+
+// ReadRecordedCommands parses a batch of commands from r, either as a JSON array or as a stream of JSON objects
+// (e.g. one per line)
+func ReadRecordedCommands(r io.Reader) ([]RecordedCommand, error) {
+	br := bufio.NewReader(r)
+	peeked, err := peekFirstNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	if peeked == '[' {
+		var commands []RecordedCommand
+		if err := json.NewDecoder(br).Decode(&commands); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON array of commands: %w", err)
+		}
+		return commands, nil
+	}
+	commands := make([]RecordedCommand, 0)
+	decoder := json.NewDecoder(br)
+	for {
+		var command RecordedCommand
+		err := decoder.Decode(&command)
+		if err == io.EOF {
+			return commands, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse command #%d: %w", len(commands)+1, err)
+		}
+		commands = append(commands, command)
+	}
+}
+
+func peekFirstNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read commands: %w", err)
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		_, _ = br.ReadByte()
+	}
+}
+
+// BuildRecordedEntries converts the given commands into history entries. Custom columns and the direnv/mise
+// environment are computed once for the current process and shared by all of the entries.
+func BuildRecordedEntries(ctx context.Context, commands []RecordedCommand) ([]*data.HistoryEntry, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	user, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build history entry: %w", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build history entry: %w", err)
+	}
+	homedir := hctx.GetHome(ctx)
+	currentCwd, err := getCwdWithoutSubstitution()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build history entry: %w", err)
+	}
+	cc, err := buildCustomColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devEnvironment := getDevEnvironment(ctx)
+	remoteHosts := getRemoteHosts()
+	container := getContainer()
+	kubeContext := getKubeContext(homedir)
+	envVars := buildEnvironmentVariables(ctx)
+	now := time.Now()
+
+	entries := make([]*data.HistoryEntry, 0, len(commands))
+	for i, command := range commands {
+		if strings.TrimSpace(command.Command) == "" {
+			return nil, fmt.Errorf("command #%d is empty", i+1)
+		}
+		entry := data.HistoryEntry{
+			LocalUsername:        user.Username,
+			Hostname:             hostname,
+			Command:              strings.TrimRight(command.Command, "\r\n"),
+			ExitCode:             command.ExitCode,
+			HomeDirectory:        homedir,
+			DeviceId:             hctx.GetConf(ctx).DeviceId,
+			CustomColumns:        cc,
+			DevEnvironment:       devEnvironment,
+			RemoteHosts:          remoteHosts,
+			Container:            container,
+			KubeContext:          kubeContext,
+			EnvironmentVariables: envVars,
+			StartTime:            command.StartTime.Time,
+			EndTime:              command.EndTime.Time,
+		}
+		if command.Hostname != "" {
+			entry.Hostname = command.Hostname
+		}
+		cwd := command.Cwd
+		if cwd == "" {
+			cwd = currentCwd
+		}
+		entry.CurrentWorkingDirectory = abbreviateHomeDir(cwd, homedir)
+		if entry.EndTime.IsZero() {
+			entry.EndTime = now
+		}
+		if entry.StartTime.IsZero() {
+			entry.StartTime = entry.EndTime
+		}
+		if entry.EndTime.Before(entry.StartTime) {
+			return nil, fmt.Errorf("command #%d (%#v) ends before it starts", i+1, entry.Command)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
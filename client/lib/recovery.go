@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/google/uuid"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// RecoveryPhrase returns the BIP39 mnemonic that encodes userSecret, so that the secret can be written down and
+// recovered via SecretFromRecoveryPhrase if the config file is lost. Only the secrets that hishtory generates (which
+// are UUIDs) have a recovery phrase, since custom secrets can be arbitrarily long.
+func RecoveryPhrase(userSecret string) (string, error) {
+	id, err := uuid.Parse(userSecret)
+	if err != nil || id.String() != userSecret {
+		return "", fmt.Errorf("your secret key wasn't generated by hishtory, so it doesn't have a recovery phrase (back up the secret key itself instead)")
+	}
+	phrase, err := bip39.NewMnemonic(id[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to generate the recovery phrase: %w", err)
+	}
+	return phrase, nil
+}
+
+// SecretFromRecoveryPhrase returns the secret key encoded by a recovery phrase from RecoveryPhrase. The words are
+// case-insensitive and may be separated by any whitespace.
+func SecretFromRecoveryPhrase(phrase string) (string, error) {
+	normalized := strings.Join(strings.Fields(strings.ToLower(phrase)), " ")
+	entropy, err := bip39.EntropyFromMnemonic(normalized)
+	if err != nil {
+		return "", fmt.Errorf("invalid recovery phrase (check for typos and missing words): %w", err)
+	}
+	id, err := uuid.FromBytes(entropy)
+	if err != nil {
+		return "", fmt.Errorf("invalid recovery phrase, expected 12 words: %w", err)
+	}
+	return id.String(), nil
+}
+
+// GetRecoveryConfig returns the config that `hishtory secret recover` keeps the settings of when re-initializing
+// hishtory with a recovered secret key. Recovering is mostly needed when the config file was lost, so if it can't be
+// read this is an empty config and hishtory is set up as an online, writable device.
+func GetRecoveryConfig() hctx.ClientConfig {
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return hctx.ClientConfig{}
+	}
+	return config
+}
+
+// RecoverSecret re-initializes hishtory with the secret key encoded by a recovery phrase, keeping this device's
+// offline and read-only settings (see GetRecoveryConfig)
+func RecoverSecret(secretKey string) error {
+	config := GetRecoveryConfig()
+	return Setup(secretKey, config.IsOffline, config.ReadOnlyDevice)
+}
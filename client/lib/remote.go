@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"os"
+	"strings"
+)
+
+// getRemoteHosts returns the chain of hosts that the current shell was reached from over SSH, outermost first,
+// or an empty string if the current shell isn't in an SSH session. SSH_CONNECTION only describes the last hop,
+// so the shell integrations record the earlier hops in LC_HISHTORY_SSH_CHAIN. LC_* variables are forwarded by
+// ssh on most systems, so this is propagated through nested SSH sessions.
+func getRemoteHosts() string {
+	// SSH_CONNECTION is "CLIENT_IP CLIENT_PORT SERVER_IP SERVER_PORT"
+	connection := strings.Fields(os.Getenv("SSH_CONNECTION"))
+	if len(connection) == 0 {
+		return ""
+	}
+	client := connection[0]
+	chain := strings.Fields(os.Getenv("LC_HISHTORY_SSH_CHAIN"))
+	if len(chain) == 0 || chain[len(chain)-1] != client {
+		chain = append(chain, client)
+	}
+	return strings.Join(chain, " ")
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+)
+
+// ParseRetentionAge parses a retention age like "90d", "12w", "2y", or any duration
+// accepted by time.ParseDuration (e.g. "36h").
+func ParseRetentionAge(age string) (time.Duration, error) {
+	age = strings.TrimSpace(age)
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if strings.HasSuffix(age, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(age, suffix))
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid retention age %#v: expected a positive number of %s", age, suffix)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention age %#v: expected something like 90d, 12w, or 2y", age)
+	}
+	return d, nil
+}
+
+// ValidateRetentionRule checks that a retention rule has a valid age and keep query
+func ValidateRetentionRule(ctx context.Context, rule hctx.RetentionRule) error {
+	if _, err := ParseRetentionAge(rule.MaxAge); err != nil {
+		return err
+	}
+	if _, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), rule.KeepQuery); err != nil {
+		return fmt.Errorf("invalid keep query %#v: %w", rule.KeepQuery, err)
+	}
+	return nil
+}
+
+// FindEntriesToPrune returns all history entries that should be deleted according to the configured retention policy
+func FindEntriesToPrune(ctx context.Context, now time.Time) ([]*data.HistoryEntry, error) {
+	toPrune := make([]*data.HistoryEntry, 0)
+	seen := make(map[string]bool)
+	for _, rule := range hctx.GetConf(ctx).RetentionPolicy {
+		maxAge, err := ParseRetentionAge(rule.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		cutoff := now.Add(-maxAge)
+		// Old entries are likely to have been archived, so both the main and the cold DB are checked
+		err = forEachTier(ctx, func(db *gorm.DB) error {
+			var oldEntries []*data.HistoryEntry
+			if err := db.Where("end_time < ?", cutoff).Find(&oldEntries).Error; err != nil {
+				return fmt.Errorf("failed to query for entries older than %s: %w", rule.MaxAge, err)
+			}
+			keep := make(map[string]bool)
+			if rule.KeepQuery != "" {
+				// Note that the end_time condition must come first since the search query's WHERE clauses may
+				// contain trailing nil arguments
+				tx, err := MakeWhereQueryFromSearch(ctx, db.Where("end_time < ?", cutoff), rule.KeepQuery)
+				if err != nil {
+					return fmt.Errorf("invalid keep query %#v: %w", rule.KeepQuery, err)
+				}
+				var keptEntries []*data.HistoryEntry
+				if err := tx.Find(&keptEntries).Error; err != nil {
+					return fmt.Errorf("failed to query for entries matching %#v: %w", rule.KeepQuery, err)
+				}
+				for _, entry := range keptEntries {
+					keep[entryKey(entry)] = true
+				}
+			}
+			for _, entry := range oldEntries {
+				id := entryKey(entry)
+				if keep[id] || seen[id] {
+					continue
+				}
+				seen[id] = true
+				toPrune = append(toPrune, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return toPrune, nil
+}
+
+// entryKey returns a comparable key identifying an entry. Note that time.Time values can't be used
+// directly as map keys since they also contain a location.
+func entryKey(entry *data.HistoryEntry) string {
+	return fmt.Sprintf("%s/%d", entry.DeviceId, entry.EndTime.UnixNano())
+}
+
+func entryIdentifier(entry *data.HistoryEntry) shared.MessageIdentifier {
+	return shared.MessageIdentifier{DeviceId: entry.DeviceId, Date: entry.EndTime}
+}
+
+// Prune deletes the given entries locally and sends a deletion request so that they are also deleted on all
+// other devices. The DB is snapshotted first so that the deletion can be undone locally via `hishtory rollback`.
+func Prune(ctx context.Context, entries []*data.HistoryEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := SnapshotDb(ctx, "prune"); err != nil {
+		return err
+	}
+	err := forEachTier(ctx, func(db *gorm.DB) error {
+		tx := db.Begin()
+		for _, entry := range entries {
+			res := hctx.DeleteHistoryEntries(tx.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime))
+			if res.Error != nil {
+				tx.Rollback()
+				return fmt.Errorf("DB error while pruning: %w", res.Error)
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("failed to commit pruning: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := RecordAuditEvent(ctx, AuditActionPrune, fmt.Sprintf("pruned %d entries per the retention policy", len(entries))); err != nil {
+		return err
+	}
+	return DeleteOnRemoteInstances(ctx, entries)
+}
+
+// DeleteOnRemoteInstances sends a deletion request so that the given entries are deleted on all other devices
+func DeleteOnRemoteInstances(ctx context.Context, historyEntries []*data.HistoryEntry) error {
+	var deletionRequest shared.DeletionRequest
+	for _, entry := range historyEntries {
+		deletionRequest.Messages.Ids = append(deletionRequest.Messages.Ids, entryIdentifier(entry))
+	}
+	// Other hosts that share this home directory count as other devices too, even when offline
+	if err := recordSharedHomeDeletions(ctx, deletionRequest.Messages.Ids); err != nil {
+		return err
+	}
+
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil
+	}
+	deletionRequest.SendTime = time.Now()
+	deletionRequest.UserId = data.UserId(config.UserSecret)
+	return SendDeletionRequest(deletionRequest)
+}
+
+// applyRetentionPolicy prunes the entries that are past the retention policy, if one is configured. This is run
+// periodically by the built-in scheduler so that the retention policy is enforced without requiring a cron job.
+func applyRetentionPolicy(ctx context.Context) error {
+	config := hctx.GetConf(ctx)
+	if len(config.RetentionPolicy) == 0 {
+		return nil
+	}
+	now := time.Now()
+	entries, err := FindEntriesToPrune(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = Prune(ctx, entries)
+	if err != nil && !IsOfflineError(err) {
+		return err
+	}
+	if err != nil {
+		// The entries were deleted locally, but other devices won't be told about it. There isn't much we can
+		// do about that, since we no longer know which entries were pruned.
+		hctx.GetLogger().Infof("Failed to send a deletion request for %d pruned entries: %v", len(entries), err)
+	}
+	hctx.GetLogger().Infof("Automatically pruned %d history entries per the retention policy", len(entries))
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.LastPruneTimestamp = now.Unix()
+	})
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The actions that rules can run
+const (
+	// Appends the entry as a line of JSON to the file at the given path
+	RuleActionAppend = "append"
+	// Runs the given script via bash, with the entry as JSON on stdin
+	RuleActionRun = "run"
+	// Adds the given tag to the entry
+	RuleActionTag = "tag"
+	// Sends a desktop notification, with a message in the same format as `hishtory last --format`
+	RuleActionNotify = "notify"
+	// Pins the entry, so that it is displayed before all other matching entries in the TUI
+	RuleActionPin = "pin"
+)
+
+// Scripts run by rules are killed if they don't finish within this long. Rules run after the shell hook has returned
+// (since commands are saved in the background), so this doesn't delay the prompt.
+const ruleScriptTimeout = 10 * time.Second
+
+// The message of notifications sent by rules that don't specify one
+const defaultRuleNotificationFormat = "{command} exited with {exit_code} after {runtime}"
+
+// Sends desktop notifications, overridden in tests
+var sendNotification = sendDesktopNotification
+
+// ParseRuleAction parses an action in the format used by `hishtory config-add rule`, which is either TYPE or
+// TYPE:ARG (e.g. `pin` or `tag:deploy`)
+func ParseRuleAction(s string) (hctx.RuleAction, error) {
+	actionType, arg, _ := strings.Cut(s, ":")
+	action := hctx.RuleAction{Type: actionType, Arg: arg}
+	return action, validateRuleAction(action)
+}
+
+func validateRuleAction(action hctx.RuleAction) error {
+	switch action.Type {
+	case RuleActionAppend, RuleActionRun:
+		if action.Arg == "" {
+			return fmt.Errorf("the %s action requires an argument (e.g. `%s:~/path`)", action.Type, action.Type)
+		}
+	case RuleActionTag:
+		return ValidateTag(action.Arg)
+	case RuleActionPin:
+		if action.Arg != "" {
+			return fmt.Errorf("the pin action doesn't take an argument")
+		}
+	case RuleActionNotify:
+	default:
+		return fmt.Errorf("unknown action %#v, expected one of %s, %s, %s, %s, or %s", action.Type, RuleActionAppend, RuleActionRun, RuleActionTag, RuleActionNotify, RuleActionPin)
+	}
+	return nil
+}
+
+// ValidateRule checks that a rule has a name, a valid query, and valid actions
+func ValidateRule(ctx context.Context, rule hctx.Rule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("rules must have a name")
+	}
+	if _, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), rule.Query); err != nil {
+		return fmt.Errorf("invalid query %#v: %w", rule.Query, err)
+	}
+	if len(rule.Actions) == 0 {
+		return fmt.Errorf("rules must have at least one action")
+	}
+	for _, action := range rule.Actions {
+		if err := validateRuleAction(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunRules runs the actions of each rule that matches a newly saved entry. Failures are logged rather than
+// returned, so that a broken rule doesn't interfere with saving commands or with the other rules.
+func RunRules(ctx context.Context, entry *data.HistoryEntry) {
+	for _, rule := range hctx.GetConf(ctx).Rules {
+		matches, err := ruleMatches(ctx, rule, entry)
+		if err != nil {
+			hctx.GetLogger().Warnf("Failed to check whether the rule %#v matches %#v: %v", rule.Name, entry.Command, err)
+			continue
+		}
+		if !matches {
+			continue
+		}
+		for _, action := range rule.Actions {
+			if err := runRuleAction(ctx, rule, action, entry); err != nil {
+				hctx.GetLogger().Warnf("Failed to run the %s action of the rule %#v for %#v: %v", action.Type, rule.Name, entry.Command, err)
+			}
+		}
+	}
+}
+
+// ruleMatches returns whether the saved entry matches the rule's query. The query is run against the DB rather than
+// evaluated in Go, so that it supports everything that searches do.
+func ruleMatches(ctx context.Context, rule hctx.Rule, entry *data.HistoryEntry) (bool, error) {
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), rule.Query)
+	if err != nil {
+		return false, err
+	}
+	var count int64
+	if err := tx.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func runRuleAction(ctx context.Context, rule hctx.Rule, action hctx.RuleAction, entry *data.HistoryEntry) error {
+	switch action.Type {
+	case RuleActionAppend:
+		return appendEntryToFile(expandRulePath(ctx, action.Arg), entry)
+	case RuleActionRun:
+		return runRuleScript(ctx, rule, expandRulePath(ctx, action.Arg), entry)
+	case RuleActionTag:
+		return TagEntry(ctx, *entry, action.Arg)
+	case RuleActionPin:
+		return SetEntryPinned(ctx, *entry, true)
+	case RuleActionNotify:
+		format := action.Arg
+		if format == "" {
+			format = defaultRuleNotificationFormat
+		}
+		return sendNotification("hiSHtory: "+rule.Name, FormatLastCommand(newLastCommand(*entry), format))
+	default:
+		return fmt.Errorf("unknown action %#v", action.Type)
+	}
+}
+
+// expandRulePath expands a leading ~/ in a path, since rules are usually configured with paths in the home directory
+func expandRulePath(ctx context.Context, path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(hctx.GetHome(ctx), path[2:])
+	}
+	return path
+}
+
+func appendEntryToFile(path string, entry *data.HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the entry: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to %s: %w", path, err)
+	}
+	return nil
+}
+
+// runRuleScript runs a script with the entry as JSON on stdin and the name of the rule in $HISHTORY_RULE_NAME
+func runRuleScript(ctx context.Context, rule hctx.Rule, script string, entry *data.HistoryEntry) error {
+	input, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the entry: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ruleScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-c", script)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), "HISHTORY_RULE_NAME="+rule.Name)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("the script didn't finish within %s", ruleScriptTimeout)
+		}
+		return fmt.Errorf("the script failed (stderr=%#v): %w", stderr.String(), err)
+	}
+	return nil
+}
+
+func sendDesktopNotification(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// The title and message are passed as arguments so that they don't need to be escaped for AppleScript
+		cmd = exec.Command("osascript", "-e", "on run argv", "-e", "display notification (item 2 of argv) with title (item 1 of argv)", "-e", "end run", title, message)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", "--", title, message)
+	default:
+		return fmt.Errorf("desktop notifications aren't supported on %s", runtime.GOOS)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to send a notification (output=%#v): %w", string(output), err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The directory in hishtory's data directory that scheduled backups are written to
+const scheduledBackupsDir = "backups"
+
+// The number of scheduled backups that are kept, older ones are deleted
+const scheduledBackupsToKeep = 7
+
+// The next run of a task is delayed by up to this fraction of its interval
+const scheduledTaskJitter = 0.1
+
+// A ScheduledTask is a maintenance task that hishtory's built-in scheduler runs periodically, so that it doesn't
+// require setting up a cron job. Due tasks are run opportunistically after commands are recorded, or by `hishtory
+// schedule daemon`.
+type ScheduledTask struct {
+	Name            string
+	Description     string
+	DefaultEnabled  bool
+	DefaultInterval time.Duration
+	run             func(ctx context.Context) error
+}
+
+// ScheduledTasks are the tasks run by the built-in scheduler, in the order that they are run
+var ScheduledTasks = []ScheduledTask{
+	{
+		Name:            "prune",
+		Description:     "Prune the entries that are past the retention policy, if one is configured",
+		DefaultEnabled:  true,
+		DefaultInterval: 24 * time.Hour,
+		run:             applyRetentionPolicy,
+	},
+	{
+		Name:            "digest",
+		Description:     "Publish the journals for the days that have ended to the configured integrations, if there are any",
+		DefaultEnabled:  true,
+		DefaultInterval: time.Hour,
+		run:             MaybePublishJournals,
+	},
+	{
+		Name:            "reconcile",
+		Description:     "Pull new entries, deletions, and pins and tags from your other devices, so the local DB is up to date even if you don't search it",
+		DefaultEnabled:  false,
+		DefaultInterval: time.Hour,
+		run:             RetrieveAdditionalEntriesFromRemote,
+	},
+	{
+		Name:            "backup",
+		Description:     fmt.Sprintf("Write a full encrypted backup to the %s directory in hishtory's data directory, keeping the last %d", scheduledBackupsDir, scheduledBackupsToKeep),
+		DefaultEnabled:  false,
+		DefaultInterval: 24 * time.Hour,
+		run:             writeScheduledBackup,
+	},
+}
+
+// FindScheduledTask returns the scheduled task with the given name
+func FindScheduledTask(name string) (*ScheduledTask, error) {
+	names := make([]string, 0, len(ScheduledTasks))
+	for i, task := range ScheduledTasks {
+		if task.Name == name {
+			return &ScheduledTasks[i], nil
+		}
+		names = append(names, task.Name)
+	}
+	return nil, fmt.Errorf("unknown scheduled task %#v, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// IsEnabled returns whether the task is enabled in the given config
+func (t ScheduledTask) IsEnabled(config hctx.ClientConfig) bool {
+	if override, ok := config.ScheduledTasks[t.Name]; ok {
+		return override.Enabled
+	}
+	return t.DefaultEnabled
+}
+
+// Interval returns how often the task runs in the given config
+func (t ScheduledTask) Interval(config hctx.ClientConfig) time.Duration {
+	if override, ok := config.ScheduledTasks[t.Name]; ok && override.Interval != "" {
+		if interval, err := ParseScheduledTaskInterval(override.Interval); err == nil {
+			return interval
+		}
+	}
+	return t.DefaultInterval
+}
+
+// ParseScheduledTaskInterval parses how often a scheduled task runs, e.g. "30m" or "12h"
+func ParseScheduledTaskInterval(interval string) (time.Duration, error) {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse interval %#v (expected a duration like 30m or 12h): %w", interval, err)
+	}
+	if d < time.Minute {
+		return 0, fmt.Errorf("interval %#v is too short, scheduled tasks can run at most once a minute", interval)
+	}
+	return d, nil
+}
+
+func nextScheduledRun(now time.Time, interval time.Duration) time.Time {
+	jitter := time.Duration(rand.Int63n(int64(float64(interval)*scheduledTaskJitter) + 1))
+	return now.Add(interval + jitter)
+}
+
+// RunDueScheduledTasks runs the enabled tasks that are due. Each task is claimed in the ledger before it runs, so
+// that concurrent invocations don't run the same task twice. Failures are recorded in the ledger and logged rather
+// than returned, so that a failing task doesn't break recording commands.
+func RunDueScheduledTasks(ctx context.Context) error {
+	for _, task := range ScheduledTasks {
+		if !task.IsEnabled(hctx.GetConf(ctx)) {
+			continue
+		}
+		claimed, err := claimScheduledTask(task, hctx.GetConf(ctx), time.Now())
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := runScheduledTask(ctx, task); err != nil {
+			hctx.GetLogger().Warnf("%v", err)
+		}
+	}
+	return nil
+}
+
+// claimScheduledTask marks the task as running in the ledger if it is due, and returns whether it was due
+func claimScheduledTask(task ScheduledTask, config hctx.ClientConfig, now time.Time) (bool, error) {
+	claimed := false
+	err := hctx.UpdateConfig(func(c *hctx.ClientConfig) {
+		run := c.ScheduledTaskRuns[task.Name]
+		if now.Unix() < run.NextRunTimestamp {
+			return
+		}
+		if c.ScheduledTaskRuns == nil {
+			c.ScheduledTaskRuns = make(map[string]hctx.ScheduledTaskRun)
+		}
+		run.LastRunTimestamp = now.Unix()
+		run.NextRunTimestamp = nextScheduledRun(now, task.Interval(config)).Unix()
+		c.ScheduledTaskRuns[task.Name] = run
+		claimed = true
+	})
+	return claimed, err
+}
+
+// RunScheduledTask runs the task now, regardless of whether it is enabled or due, and records the run in the ledger
+func RunScheduledTask(ctx context.Context, task ScheduledTask) error {
+	now := time.Now()
+	err := hctx.UpdateConfig(func(c *hctx.ClientConfig) {
+		if c.ScheduledTaskRuns == nil {
+			c.ScheduledTaskRuns = make(map[string]hctx.ScheduledTaskRun)
+		}
+		run := c.ScheduledTaskRuns[task.Name]
+		run.LastRunTimestamp = now.Unix()
+		run.NextRunTimestamp = nextScheduledRun(now, task.Interval(hctx.GetConf(ctx))).Unix()
+		c.ScheduledTaskRuns[task.Name] = run
+	})
+	if err != nil {
+		return err
+	}
+	return runScheduledTask(ctx, task)
+}
+
+func runScheduledTask(ctx context.Context, task ScheduledTask) error {
+	start := time.Now()
+	taskErr := task.run(ctx)
+	err := hctx.UpdateConfig(func(c *hctx.ClientConfig) {
+		if c.ScheduledTaskRuns == nil {
+			c.ScheduledTaskRuns = make(map[string]hctx.ScheduledTaskRun)
+		}
+		run := c.ScheduledTaskRuns[task.Name]
+		run.LastRunDurationMs = time.Since(start).Milliseconds()
+		run.LastError = ""
+		if taskErr != nil {
+			run.LastError = taskErr.Error()
+		}
+		c.ScheduledTaskRuns[task.Name] = run
+	})
+	if taskErr != nil {
+		return fmt.Errorf("scheduled task %s failed: %w", task.Name, taskErr)
+	}
+	return err
+}
+
+// ResetScheduledTask clears the task's ledger entry so that it runs the next time the scheduler runs, e.g. after it is
+// enabled or its interval is changed
+func ResetScheduledTask(config *hctx.ClientConfig, name string) {
+	if run, ok := config.ScheduledTaskRuns[name]; ok {
+		run.NextRunTimestamp = 0
+		config.ScheduledTaskRuns[name] = run
+	}
+}
+
+// writeScheduledBackup writes a full backup to the scheduled backups directory and deletes the oldest ones. These are
+// always full backups, so that each of them can be restored on its own, and they don't update the starting point
+// for incremental backups made via `hishtory backup`.
+func writeScheduledBackup(ctx context.Context) error {
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(data.GetHishtoryDir(hctx.GetHome(ctx)), scheduledBackupsDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create the backups directory: %w", err)
+	}
+	backupPath := filepath.Join(dir, fmt.Sprintf("hishtory-backup-%s.hbak", time.Now().Format("20060102-150405.000")))
+	f, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = CreateBackup(f, config, false)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(backupPath)
+		return err
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "hishtory-backup-*.hbak"))
+	if err != nil {
+		return err
+	}
+	// The timestamps in the file names sort chronologically
+	sort.Strings(backups)
+	for len(backups) > scheduledBackupsToKeep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("failed to delete an old backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
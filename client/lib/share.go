@@ -0,0 +1,349 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm/clause"
+)
+
+// Entries imported from another user's share are tagged with this prefix followed by the name of the share, so that
+// they can be searched for with `tag:shared:NAME`
+const importedShareTagPrefix = "shared:"
+
+// How often shares are automatically published and imported shares are refreshed
+const shareSyncInterval = time.Hour
+
+func ValidateShareName(name string) error {
+	if name == "" {
+		return fmt.Errorf("share names can't be empty")
+	}
+	return ValidateTag(importedShareTagPrefix + name)
+}
+
+func findShare(shares []hctx.ShareConfig, name string) *hctx.ShareConfig {
+	for i := range shares {
+		if shares[i].Name == name {
+			return &shares[i]
+		}
+	}
+	return nil
+}
+
+func findImportedShare(shares []hctx.ImportedShareConfig, name string) *hctx.ImportedShareConfig {
+	for i := range shares {
+		if shares[i].Name == name {
+			return &shares[i]
+		}
+	}
+	return nil
+}
+
+// GetShareReadKey returns the read key of the given share, which is all that another user needs to import it
+func GetShareReadKey(config hctx.ClientConfig, share hctx.ShareConfig) string {
+	return data.ShareReadKey(config.UserSecret, share.Name, share.Salt)
+}
+
+func checkCanSyncShares(config hctx.ClientConfig) error {
+	if config.IsOffline {
+		return fmt.Errorf("sharing history requires syncing, which is disabled for offline installs")
+	}
+	return nil
+}
+
+// CreateShare shares the entries matching query with the users that are given the returned read key. The share is
+// kept up to date as new matching commands are recorded, until it is revoked with RevokeShare.
+func CreateShare(ctx context.Context, name, query string) (string, error) {
+	config := hctx.GetConf(ctx)
+	if err := checkCanSyncShares(config); err != nil {
+		return "", err
+	}
+	if config.ReadOnlyDevice {
+		return "", fmt.Errorf("read-only devices can't share history, since that requires uploading it")
+	}
+	if err := ValidateShareName(name); err != nil {
+		return "", err
+	}
+	if findShare(config.Shares, name) != nil {
+		return "", fmt.Errorf("there is already a share named %#v", name)
+	}
+	if _, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query); err != nil {
+		return "", fmt.Errorf("invalid query %#v: %w", query, err)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate a salt for the share: %w", err)
+	}
+	share := hctx.ShareConfig{Name: name, Query: query, Salt: base64.URLEncoding.EncodeToString(salt)}
+	if _, err := publishShare(ctx, share); err != nil {
+		return "", err
+	}
+	share.LastPublishedTimestamp = time.Now().Unix()
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.Shares = append(config.Shares, share)
+	})
+	if err != nil {
+		return "", err
+	}
+	return GetShareReadKey(config, share), nil
+}
+
+// getSharedEntries returns the entries that are in the given share. Entries that were imported from other users'
+// shares are never shared again.
+func getSharedEntries(ctx context.Context, share hctx.ShareConfig) ([]*data.HistoryEntry, error) {
+	entries, err := Search(ctx, hctx.GetDb(ctx), share.Query, 0)
+	if err != nil {
+		return nil, err
+	}
+	var importedTags []*data.EntryTag
+	if err := hctx.GetDb(ctx).Where("tag LIKE ?", importedShareTagPrefix+"%").Find(&importedTags).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up imported entries: %w", err)
+	}
+	imported := make(map[string]bool)
+	for _, tag := range importedTags {
+		imported[fmt.Sprintf("%s/%d", tag.DeviceId, tag.EndTime.UnixNano())] = true
+	}
+	sharedEntries := make([]*data.HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !imported[fmt.Sprintf("%s/%d", entry.DeviceId, entry.EndTime.UnixNano())] {
+			sharedEntries = append(sharedEntries, entry)
+		}
+	}
+	return sharedEntries, nil
+}
+
+// publishShare re-encrypts the entries in the share with its read key, and replaces the share's entries on the
+// backend with them. Returns the number of published entries.
+func publishShare(ctx context.Context, share hctx.ShareConfig) (int, error) {
+	config := hctx.GetConf(ctx)
+	entries, err := getSharedEntries(ctx, share)
+	if err != nil {
+		return 0, err
+	}
+	readKey := GetShareReadKey(config, share)
+	encEntries := make([]shared.EncSharedEntry, 0, len(entries))
+	for _, entry := range entries {
+		encEntry, err := data.EncryptSharedEntry(readKey, *entry)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt shared entry: %w", err)
+		}
+		encEntries = append(encEntries, encEntry)
+	}
+	reqBody, err := json.Marshal(encEntries)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal shared entries: %w", err)
+	}
+	_, err = ApiPost("/api/v1/submit-shared-entries?share_id="+data.ShareId(readKey)+"&user_id="+data.UserId(config.UserSecret), "application/json", reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish share %#v: %w", share.Name, err)
+	}
+	return len(entries), nil
+}
+
+// RevokeShare deletes the share with the given name from the backend, so that it can no longer be read. Users that
+// already imported it keep the entries that they imported.
+func RevokeShare(ctx context.Context, name string) error {
+	config := hctx.GetConf(ctx)
+	share := findShare(config.Shares, name)
+	if share == nil {
+		return fmt.Errorf("there is no share named %#v", name)
+	}
+	if err := checkCanSyncShares(config); err != nil {
+		return err
+	}
+	_, err := ApiPost("/api/v1/revoke-share?share_id="+data.ShareId(GetShareReadKey(config, *share))+"&user_id="+data.UserId(config.UserSecret), "application/json", []byte{})
+	if err != nil {
+		return fmt.Errorf("failed to revoke share %#v: %w", name, err)
+	}
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		shares := make([]hctx.ShareConfig, 0, len(config.Shares))
+		for _, s := range config.Shares {
+			if s.Name != name {
+				shares = append(shares, s)
+			}
+		}
+		config.Shares = shares
+	})
+}
+
+// ImportShare adds the entries from another user's share to this device's history, tagged with "shared:NAME". The
+// share is refreshed periodically until it is removed with RemoveImportedShare. Returns the number of entries in the
+// share.
+func ImportShare(ctx context.Context, name, readKey string) (int, error) {
+	config := hctx.GetConf(ctx)
+	if err := checkCanSyncShares(config); err != nil {
+		return 0, err
+	}
+	if err := ValidateShareName(name); err != nil {
+		return 0, err
+	}
+	if findImportedShare(config.ImportedShares, name) != nil {
+		return 0, fmt.Errorf("a share named %#v was already imported", name)
+	}
+	share := hctx.ImportedShareConfig{Name: name, ReadKey: strings.TrimSpace(readKey)}
+	numEntries, err := importShare(ctx, share)
+	if err != nil {
+		return 0, err
+	}
+	share.LastImportedTimestamp = time.Now().Unix()
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.ImportedShares = append(config.ImportedShares, share)
+	})
+	return numEntries, err
+}
+
+// isRevokedShareError returns whether err is from requesting a share that doesn't exist, which is usually because it
+// was revoked by its owner
+func isRevokedShareError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "status_code=404")
+}
+
+func importShare(ctx context.Context, share hctx.ImportedShareConfig) (int, error) {
+	respBody, err := ApiGet("/api/v1/get-shared-entries?share_id=" + data.ShareId(share.ReadKey))
+	if isRevokedShareError(err) {
+		return 0, fmt.Errorf("share %#v doesn't exist, either the read key is wrong or the share was revoked: %w", share.Name, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var encEntries []*shared.EncSharedEntry
+	if err := json.Unmarshal(respBody, &encEntries); err != nil {
+		return 0, fmt.Errorf("failed to load JSON response: %w", err)
+	}
+	db := hctx.GetDb(ctx)
+	tag := importedShareTagPrefix + share.Name
+	for _, encEntry := range encEntries {
+		entry, err := data.DecryptSharedEntry(share.ReadKey, *encEntry)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt an entry in share %#v: %w", share.Name, err)
+		}
+		AddToDbIfNew(db, entry)
+		err = RetryDbWrite(func() error {
+			return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&data.EntryTag{DeviceId: entry.DeviceId, EndTime: entry.EndTime, Tag: tag}).Error
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to tag an imported entry: %w", err)
+		}
+	}
+	return len(encEntries), nil
+}
+
+// RemoveImportedShare stops refreshing the imported share with the given name, and deletes its entries from this
+// device. Returns the number of deleted entries.
+func RemoveImportedShare(ctx context.Context, name string) (int64, error) {
+	config := hctx.GetConf(ctx)
+	if findImportedShare(config.ImportedShares, name) == nil {
+		return 0, fmt.Errorf("no share named %#v was imported", name)
+	}
+	tag := importedShareTagPrefix + name
+	numDeleted, err := DeleteSearchResults(ctx, "tag:"+tag)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete the imported entries: %w", err)
+	}
+	if err := RecordAuditEvent(ctx, AuditActionDelete, fmt.Sprintf("deleted %d entries imported from the share %#v", numDeleted, name)); err != nil {
+		return 0, err
+	}
+	if err := hctx.GetDb(ctx).Where("tag = ?", tag).Delete(&data.EntryTag{}).Error; err != nil {
+		return 0, fmt.Errorf("failed to delete the tags of the imported entries: %w", err)
+	}
+	err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		shares := make([]hctx.ImportedShareConfig, 0, len(config.ImportedShares))
+		for _, s := range config.ImportedShares {
+			if s.Name != name {
+				shares = append(shares, s)
+			}
+		}
+		config.ImportedShares = shares
+	})
+	return numDeleted, err
+}
+
+// SyncShares publishes the shares created on this device that have new matching entries, and imports any new
+// entries from the shares imported into this device. If force is set, every share is published and imported
+// regardless of when it was last synced.
+func SyncShares(ctx context.Context, force bool) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline || (len(config.Shares) == 0 && len(config.ImportedShares) == 0) {
+		return nil
+	}
+	now := time.Now()
+	for _, share := range config.Shares {
+		if !force && now.Sub(time.Unix(share.LastPublishedTimestamp, 0)) < shareSyncInterval {
+			continue
+		}
+		if !force {
+			hasNewEntries, err := shareHasNewEntries(ctx, share)
+			if err != nil {
+				return err
+			}
+			if !hasNewEntries {
+				continue
+			}
+		}
+		numPublished, err := publishShare(ctx, share)
+		if err != nil {
+			return err
+		}
+		hctx.GetLogger().Infof("Published %d entries to share %#v", numPublished, share.Name)
+		err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if s := findShare(config.Shares, share.Name); s != nil {
+				s.LastPublishedTimestamp = now.Unix()
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, share := range config.ImportedShares {
+		if !force && now.Sub(time.Unix(share.LastImportedTimestamp, 0)) < shareSyncInterval {
+			continue
+		}
+		numImported, err := importShare(ctx, share)
+		if err != nil {
+			return err
+		}
+		hctx.GetLogger().Infof("Imported %d entries from share %#v", numImported, share.Name)
+		err = hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if s := findImportedShare(config.ImportedShares, share.Name); s != nil {
+				s.LastImportedTimestamp = now.Unix()
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareHasNewEntries returns whether any entries matching the share were recorded since it was last published
+func shareHasNewEntries(ctx context.Context, share hctx.ShareConfig) (bool, error) {
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), share.Query)
+	if err != nil {
+		return false, err
+	}
+	var count int64
+	if err := tx.Where("end_time > ?", time.Unix(share.LastPublishedTimestamp, 0)).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check for new entries in share %#v: %w", share.Name, err)
+	}
+	return count > 0, nil
+}
+
+// MaybeSyncShares syncs shares if they haven't been synced recently. Like the retention policy, this is called after
+// commands are saved. Errors from being offline or from shares that were revoked are only logged, since they'll be
+// retried later.
+func MaybeSyncShares(ctx context.Context) error {
+	err := SyncShares(ctx, false)
+	if IsOfflineError(err) || isRevokedShareError(err) {
+		hctx.GetLogger().Infof("Failed to sync shares: %v", err)
+		return nil
+	}
+	return err
+}
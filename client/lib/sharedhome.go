@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MergeSharedHomeDbs merges in any new history entries (and deletions) from the DBs of the other hosts that share
+// this home directory. Each host only ever writes to its own DB, and the other hosts' DBs are opened read-only,
+// which avoids the corruption that comes from multiple hosts writing to one sqlite DB over a network filesystem.
+func MergeSharedHomeDbs(ctx context.Context) error {
+	homedir := hctx.GetHome(ctx)
+	if !data.IsSharedHome(homedir) {
+		return nil
+	}
+	siblingDbPaths, err := data.GetSharedHomeDbPaths(homedir)
+	if err != nil {
+		return err
+	}
+	db := hctx.GetDb(ctx)
+	for _, siblingDbPath := range siblingDbPaths {
+		if err := mergeSharedHomeDb(hctx.GetConf(ctx), db, siblingDbPath); err != nil {
+			// Don't let one unreadable DB (e.g. from a host that is mid-write) block querying
+			hctx.GetLogger().Warnf("failed to merge history entries from %s: %v", siblingDbPath, err)
+		}
+	}
+	// Apply all known deletions, including ones for entries that were just merged in
+	res := hctx.DeleteHistoryEntries(db.Where("EXISTS (SELECT 1 FROM deleted_entries WHERE deleted_entries.device_id = history_entries.device_id AND deleted_entries.end_time = history_entries.end_time)"))
+	if res.Error != nil {
+		return fmt.Errorf("failed to apply deletions from other hosts: %w", res.Error)
+	}
+	if res.RowsAffected > 0 {
+		return RecordAuditEvent(ctx, AuditActionRemoteDelete, fmt.Sprintf("deleted %d entries that were deleted by another host sharing this home directory", res.RowsAffected))
+	}
+	return nil
+}
+
+func mergeSharedHomeDb(config hctx.ClientConfig, db *gorm.DB, siblingDbPath string) error {
+	siblingDb, err := hctx.OpenSqliteDb(config, siblingDbPath, "ro")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rawDb, err := siblingDb.DB(); err == nil {
+			rawDb.Close()
+		}
+	}()
+
+	dbName := filepath.Base(siblingDbPath)
+	var merge data.SharedHomeMerge
+	if err := db.Where("db_name = ?", dbName).Limit(1).Find(&merge).Error; err != nil {
+		return fmt.Errorf("failed to look up merge state: %w", err)
+	}
+	var maxRowId int64
+	if err := siblingDb.Raw("SELECT COALESCE(MAX(rowid), 0) FROM history_entries").Scan(&maxRowId).Error; err != nil {
+		return fmt.Errorf("failed to query history entries: %w", err)
+	}
+	if maxRowId < merge.LastRowId {
+		// The DB was replaced (e.g. by `hishtory doctor` or `hishtory restore`), so merge it from scratch
+		merge.LastRowId = 0
+	}
+	if maxRowId > merge.LastRowId {
+		var entries []data.HistoryEntry
+		if err := siblingDb.Where("rowid > ? AND rowid <= ?", merge.LastRowId, maxRowId).Find(&entries).Error; err != nil {
+			return fmt.Errorf("failed to read history entries: %w", err)
+		}
+		for _, entry := range entries {
+			AddToDbIfNew(db, entry)
+		}
+	}
+
+	if siblingDb.Migrator().HasTable(&data.DeletedEntry{}) {
+		var deletions []data.DeletedEntry
+		if err := siblingDb.Find(&deletions).Error; err != nil {
+			return fmt.Errorf("failed to read deleted entries: %w", err)
+		}
+		if len(deletions) > 0 {
+			if err := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(deletions, 100).Error; err != nil {
+				return fmt.Errorf("failed to record deleted entries: %w", err)
+			}
+		}
+	}
+
+	merge.DbName = dbName
+	merge.LastRowId = maxRowId
+	if err := db.Save(&merge).Error; err != nil {
+		return fmt.Errorf("failed to save merge state: %w", err)
+	}
+	return nil
+}
+
+// recordSharedHomeDeletions records that the given entries were deleted, so that the other hosts that share
+// this home directory delete them too rather than merging them back in.
+func recordSharedHomeDeletions(ctx context.Context, ids []shared.MessageIdentifier) error {
+	if len(ids) == 0 || !data.IsSharedHome(hctx.GetHome(ctx)) {
+		return nil
+	}
+	deletions := make([]data.DeletedEntry, 0, len(ids))
+	for _, id := range ids {
+		deletions = append(deletions, data.DeletedEntry{DeviceId: id.DeviceId, EndTime: id.Date})
+	}
+	if err := hctx.GetDb(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(deletions, 100).Error; err != nil {
+		return fmt.Errorf("failed to record deleted entries: %w", err)
+	}
+	return nil
+}
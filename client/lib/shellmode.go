@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The shell hooks set this to how the shell was started, as a comma-separated list of shellModes
+const shellModeEnvVar = "HISHTORY_SHELL_MODE"
+
+// The flags that can be recorded in HistoryEntry.ShellMode, each of which can be searched via an atom of the
+// same name (e.g. `script:false`)
+var shellModes = []string{"interactive", "login", "script"}
+
+// getShellMode returns the shell mode reported by the shell hook, with unknown flags dropped and the rest in a
+// consistent order so that they can be searched reliably
+func getShellMode() string {
+	reported := make(map[string]bool)
+	for _, flag := range strings.Split(os.Getenv(shellModeEnvVar), ",") {
+		reported[strings.TrimSpace(flag)] = true
+	}
+	flags := make([]string, 0)
+	for _, mode := range shellModes {
+		if reported[mode] {
+			flags = append(flags, mode)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// parseShellModeAtom returns the SQL for an atom like `interactive:true`. Entries whose shell mode isn't known
+// (e.g. ones recorded by older versions of hishtory) don't match either `MODE:true` or `MODE:false`.
+func parseShellModeAtom(mode, val string) (string, interface{}, error) {
+	switch val {
+	case "true":
+		return "(instr(',' || COALESCE(shell_mode, '') || ',', ?) > 0)", "," + mode + ",", nil
+	case "false":
+		return "(COALESCE(shell_mode, '') != '' AND instr(',' || shell_mode || ',', ?) = 0)", "," + mode + ",", nil
+	default:
+		return "", nil, fmt.Errorf("failed to parse %s:%s, expected %s:true or %s:false", mode, val, mode, mode)
+	}
+}
+
+// getShellNesting returns $SHLVL and the PIDs of the current shell and of the shell it was started from, as
+// exported by the shell hooks. Each is 0 if it isn't known.
+func getShellNesting() (level, pid, parentPid int) {
+	parseEnv := func(name string) int {
+		n, err := strconv.Atoi(strings.TrimSpace(os.Getenv(name)))
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return parseEnv("SHLVL"), parseEnv("HISHTORY_SHELL_PID"), parseEnv("HISHTORY_PARENT_SHELL_PID")
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// SnapshotDb snapshots the local DB before running a risky operation (e.g. a bulk delete or an import), so that
+// it can be undone via `hishtory rollback`
+func SnapshotDb(ctx context.Context, operation string) error {
+	dbPath := data.GetDbPath(hctx.GetHome(ctx))
+	if _, err := hctx.SnapshotDb(hctx.GetDb(ctx), dbPath, operation); err != nil {
+		return err
+	}
+	hctx.CleanUpDbSnapshots(dbPath)
+	return nil
+}
+
+// ListSnapshots returns the snapshots of the local DB that can be rolled back to, newest first
+func ListSnapshots(ctx context.Context) ([]hctx.DbSnapshot, error) {
+	return hctx.ListDbSnapshots(data.GetDbPath(hctx.GetHome(ctx)))
+}
+
+// RollbackToSnapshot replaces the contents of the local DB with the snapshot with the given ID (or the newest
+// snapshot if id is empty). The DB is snapshotted first, so the rollback can itself be undone. The rollback only
+// affects the local DB, so entries that were deleted from other devices stay deleted there. The audit log is never
+// rolled back, so that it still records what happened before the rollback.
+//
+// Rather than replacing the DB file, the rows are copied into the DB in a single transaction. This keeps it safe
+// to roll back while other shells are writing to the DB, and means that snapshots taken before a migration can be
+// rolled back to without downgrading the DB's schema.
+func RollbackToSnapshot(ctx context.Context, id string) (*hctx.DbSnapshot, error) {
+	snapshots, err := ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var target *hctx.DbSnapshot
+	for i := range snapshots {
+		if id == "" || snapshots[i].Id == id {
+			target = &snapshots[i]
+			break
+		}
+	}
+	if target == nil {
+		if id == "" {
+			return nil, fmt.Errorf("there are no snapshots to roll back to")
+		}
+		return nil, fmt.Errorf("there is no snapshot with the ID %#v, run `hishtory rollback --list` to list the snapshots", id)
+	}
+	// Expired snapshots are only cleaned up once the rollback is done, since the target may be one of them
+	dbPath := data.GetDbPath(hctx.GetHome(ctx))
+	if _, err := hctx.SnapshotDb(hctx.GetDb(ctx), dbPath, "rollback"); err != nil {
+		return nil, err
+	}
+	defer hctx.CleanUpDbSnapshots(dbPath)
+	// ATTACH applies to a single connection, so everything runs on one connection
+	err = hctx.GetDb(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS snapshot", "file:"+target.Path+"?mode=ro").Error; err != nil {
+			return fmt.Errorf("failed to open the snapshot %s: %w", target.Path, err)
+		}
+		defer conn.Exec("DETACH DATABASE snapshot")
+		return conn.Transaction(func(tx *gorm.DB) error {
+			var tables []string
+			if err := tx.Raw("SELECT name FROM snapshot.sqlite_master WHERE type = 'table' AND name IN (SELECT name FROM main.sqlite_master WHERE type IN ('table', 'view')) AND name != ?", auditLogTable).Scan(&tables).Error; err != nil {
+				return fmt.Errorf("failed to list the tables in the snapshot: %w", err)
+			}
+			for _, table := range tables {
+				if err := restoreTableFromSnapshot(tx, table); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to roll back to the snapshot %s: %w", target.Id, err)
+	}
+	if err := RecordAuditEvent(ctx, AuditActionRollback, fmt.Sprintf("rolled back the local DB to the snapshot %s taken before the %s", target.Id, target.Operation)); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// restoreTableFromSnapshot replaces the rows of the given table with the rows from the attached snapshot. Only the
+// columns that exist in both are copied, since the snapshot may have been taken before a migration added columns.
+func restoreTableFromSnapshot(tx *gorm.DB, table string) error {
+	var columns []string
+	err := tx.Raw("SELECT name FROM pragma_table_info(?, 'snapshot') WHERE name IN (SELECT name FROM pragma_table_info(?, 'main'))", table, table).Scan(&columns).Error
+	if err != nil {
+		return fmt.Errorf("failed to list the columns of %s: %w", table, err)
+	}
+	tableToClear := table
+	var mainTypes []string
+	if err := tx.Raw("SELECT type FROM main.sqlite_master WHERE name = ?", table).Scan(&mainTypes).Error; err != nil {
+		return fmt.Errorf("failed to look up %s: %w", table, err)
+	}
+	if len(mainTypes) == 1 && mainTypes[0] == "view" {
+		// Snapshots from before history entries were normalized have a history_entries table, which is restored by
+		// inserting into the history_entries view in place of the rows that it shows
+		tableToClear = hctx.HistoryEntryRowsTable
+	}
+	if err := tx.Exec(fmt.Sprintf("DELETE FROM main.`%s`", tableToClear)).Error; err != nil {
+		return fmt.Errorf("failed to clear %s: %w", table, err)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	quotedColumns := "`" + strings.Join(columns, "`,`") + "`"
+	if err := tx.Exec(fmt.Sprintf("INSERT INTO main.`%s` (%s) SELECT %s FROM snapshot.`%s`", table, quotedColumns, quotedColumns, table)).Error; err != nil {
+		return fmt.Errorf("failed to restore %s: %w", table, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// Snippet names are passed as a single argument to `hishtory snippet run`, so they're limited like tags
+const maxSnippetNameLength = 64
+
+// Matches the positional parameters in a snippet: $1 to $9, ${N} for any N, and $@ for all of the arguments
+var snippetParamRegex = regexp.MustCompile(`\$([1-9])|\$\{([1-9][0-9]*)\}|\$@`)
+
+// Matches arguments that don't need to be quoted when they're substituted into a snippet
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func ValidateSnippetName(name string) error {
+	if name == "" {
+		return fmt.Errorf("snippet names can't be empty")
+	}
+	if len(name) > maxSnippetNameLength {
+		return fmt.Errorf("snippet name %#v is too long, snippet names can be at most %d characters", name, maxSnippetNameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("snippet name %#v contains whitespace, which isn't supported", name)
+	}
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("snippet name %#v starts with a dash, which isn't supported", name)
+	}
+	return nil
+}
+
+// SaveSnippet saves command under name (replacing any existing snippet with that name), and syncs it to all other
+// devices
+func SaveSnippet(ctx context.Context, name, command string) error {
+	if err := ValidateSnippetName(name); err != nil {
+		return err
+	}
+	if strings.TrimSpace(command) == "" {
+		return fmt.Errorf("can't save an empty command as a snippet")
+	}
+	return updateSnippet(ctx, data.MetadataUpdateSaveSnippet, data.Snippet{Name: name, Command: command, UpdatedTime: time.Now().UTC()})
+}
+
+// DeleteSnippet deletes the snippet with the given name, and syncs the deletion to all other devices
+func DeleteSnippet(ctx context.Context, name string) error {
+	if _, err := GetSnippet(ctx, name); err != nil {
+		return err
+	}
+	return updateSnippet(ctx, data.MetadataUpdateDeleteSnippet, data.Snippet{Name: name, UpdatedTime: time.Now().UTC()})
+}
+
+func updateSnippet(ctx context.Context, kind string, snippet data.Snippet) error {
+	update := data.MetadataUpdate{Kind: kind, Snippet: &snippet}
+	if err := applyMetadataUpdate(hctx.GetDb(ctx), update); err != nil {
+		return err
+	}
+	return SendMetadataUpdates(ctx, []data.MetadataUpdate{update})
+}
+
+// applySnippetUpdate saves or deletes a snippet, unless the snippet was already changed more recently (e.g. on
+// another device)
+func applySnippetUpdate(db *gorm.DB, kind string, snippet data.Snippet) error {
+	return RetryDbWrite(func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var existing data.Snippet
+			err := tx.Where("name = ?", snippet.Name).First(&existing).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err == nil && existing.UpdatedTime.After(snippet.UpdatedTime) {
+				return nil
+			}
+			if kind == data.MetadataUpdateDeleteSnippet {
+				return tx.Where("name = ?", snippet.Name).Delete(&data.Snippet{}).Error
+			}
+			return tx.Save(&snippet).Error
+		})
+	})
+}
+
+// GetSnippet returns the snippet with the given name
+func GetSnippet(ctx context.Context, name string) (*data.Snippet, error) {
+	var snippet data.Snippet
+	err := hctx.GetDb(ctx).Where("name = ?", name).First(&snippet).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("no snippet named %#v, run `hishtory snippet list` to see your snippets", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up snippet %#v: %w", name, err)
+	}
+	return &snippet, nil
+}
+
+// ListSnippets returns all saved snippets, sorted by name
+func ListSnippets(ctx context.Context) ([]data.Snippet, error) {
+	var snippets []data.Snippet
+	if err := hctx.GetDb(ctx).Order("name").Find(&snippets).Error; err != nil {
+		return nil, fmt.Errorf("failed to list snippets: %w", err)
+	}
+	return snippets, nil
+}
+
+// ExpandSnippet substitutes args into the positional parameters of command ($1 to $9, ${N} and $@), quoting them
+// for the shell where needed. If command doesn't have any positional parameters, args are appended to it instead,
+// like with a shell alias.
+func ExpandSnippet(command string, args []string) (string, error) {
+	quotedArgs := make([]string, len(args))
+	for i, arg := range args {
+		quotedArgs[i] = shellQuote(arg)
+	}
+	matches := snippetParamRegex.FindAllStringSubmatch(command, -1)
+	if len(matches) == 0 {
+		return strings.Join(append([]string{command}, quotedArgs...), " "), nil
+	}
+	numParams := 0
+	usesAllArgs := false
+	for _, match := range matches {
+		if match[0] == "$@" {
+			usesAllArgs = true
+			continue
+		}
+		n, err := strconv.Atoi(match[1] + match[2])
+		if err != nil {
+			return "", fmt.Errorf("failed to parse snippet parameter %#v: %w", match[0], err)
+		}
+		numParams = max(numParams, n)
+	}
+	if len(args) < numParams {
+		return "", fmt.Errorf("expected at least %d arguments for the snippet, got %d", numParams, len(args))
+	}
+	if len(args) > numParams && !usesAllArgs {
+		return "", fmt.Errorf("expected %d arguments for the snippet, got %d", numParams, len(args))
+	}
+	return snippetParamRegex.ReplaceAllStringFunc(command, func(param string) string {
+		if param == "$@" {
+			return strings.Join(quotedArgs, " ")
+		}
+		n, _ := strconv.Atoi(strings.Trim(param, "${}"))
+		return quotedArgs[n-1]
+	}), nil
+}
+
+// RunSnippet runs command (an expanded snippet) in the user's shell and returns its exit code
+func RunSnippet(command string) (int, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "sh"
+	}
+	cmd := exec.Command(shell, "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, fmt.Errorf("failed to run the snippet with %#v: %w", shell, err)
+	}
+	return 0, nil
+}
+
+// shellQuote quotes s so that it is a single word in POSIX shells
+func shellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
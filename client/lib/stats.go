@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// The SQL expression for the first word of a command (e.g. `git` for `git status`)
+const commandPrefixSql = "(CASE WHEN instr(trim(command), ' ') > 0 THEN substr(trim(command), 1, instr(trim(command), ' ') - 1) ELSE trim(command) END)"
+
+// The SQL expression for the runtime of a command in seconds
+const runtimeSecondsSql = "((julianday(end_time) - julianday(start_time)) * 86400.0)"
+
+type CommandCount struct {
+	Command string `json:"command"`
+	Count   int64  `json:"count"`
+}
+
+type TimeBucketCount struct {
+	// The hour of the day (0-23) or the day of the week (0-6, starting on Sunday)
+	Bucket int   `json:"bucket"`
+	Count  int64 `json:"count"`
+}
+
+type PrefixStats struct {
+	Prefix                string  `json:"prefix"`
+	Count                 int64   `json:"count"`
+	NumFailures           int64   `json:"num_failures"`
+	FailureRate           float64 `json:"failure_rate"`
+	AverageRuntimeSeconds float64 `json:"average_runtime_seconds"`
+}
+
+type HostStats struct {
+	Hostname    string  `json:"hostname"`
+	Count       int64   `json:"count"`
+	NumFailures int64   `json:"num_failures"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+type HistoryStats struct {
+	TotalCount  int64          `json:"total_count"`
+	TopCommands []CommandCount `json:"top_commands"`
+	// The commands that were most often selected from a search to be run again, see RecordEntryUsage
+	MostReusedCommands []CommandCount    `json:"most_reused_commands"`
+	ByHourOfDay        []TimeBucketCount `json:"by_hour_of_day"`
+	ByDayOfWeek        []TimeBucketCount `json:"by_day_of_week"`
+	ByPrefix           []PrefixStats     `json:"by_prefix"`
+	ByHost             []HostStats       `json:"by_host"`
+}
+
+// ComputeStats aggregates statistics about all history entries matching the given search query. All
+// aggregation is done in SQLite so that this doesn't require loading every entry into memory.
+func ComputeStats(ctx context.Context, query string, limit int) (*HistoryStats, error) {
+	db := hctx.GetDb(ctx)
+	stats := HistoryStats{}
+
+	tx, err := MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Count(&stats.TotalCount).Error; err != nil {
+		return nil, fmt.Errorf("failed to count history entries: %w", err)
+	}
+
+	tx, err = MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Select("command, COUNT(*) AS count").Group("command").Order("count DESC, command").Limit(limit).Scan(&stats.TopCommands).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top commands: %w", err)
+	}
+
+	tx, err = MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&data.EntryUsage{}).Select("command, COUNT(*) AS count").Where("command IN (?)", tx.Select("command")).
+		Group("command").Order("count DESC, command").Limit(limit).Scan(&stats.MostReusedCommands).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query most reused commands: %w", err)
+	}
+
+	stats.ByHourOfDay, err = countByTimeBucket(ctx, query, "%H")
+	if err != nil {
+		return nil, err
+	}
+	stats.ByDayOfWeek, err = countByTimeBucket(ctx, query, "%w")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err = MakeWhereQueryFromSearch(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Select(commandPrefixSql + " AS prefix, COUNT(*) AS count, SUM(exit_code != 0) AS num_failures, AVG(" + runtimeSecondsSql + ") AS average_runtime_seconds").
+		Group("prefix").Order("count DESC, prefix").Limit(limit).Scan(&stats.ByPrefix).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query per-prefix stats: %w", err)
+	}
+	for i := range stats.ByPrefix {
+		stats.ByPrefix[i].FailureRate = float64(stats.ByPrefix[i].NumFailures) / float64(stats.ByPrefix[i].Count)
+	}
+
+	stats.ByHost, err = countByHost(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func countByHost(ctx context.Context, query string) ([]HostStats, error) {
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	if err != nil {
+		return nil, err
+	}
+	var counts []HostStats
+	err = tx.Select("hostname, COUNT(*) AS count, SUM(exit_code != 0) AS num_failures").Group("hostname").Order("count DESC, hostname").Scan(&counts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query per-host stats: %w", err)
+	}
+	for i := range counts {
+		counts[i].FailureRate = float64(counts[i].NumFailures) / float64(counts[i].Count)
+	}
+	return counts, nil
+}
+
+func countByTimeBucket(ctx context.Context, query, strftimeFormat string) ([]TimeBucketCount, error) {
+	tx, err := MakeWhereQueryFromSearch(ctx, hctx.GetDb(ctx), query)
+	if err != nil {
+		return nil, err
+	}
+	var counts []TimeBucketCount
+	err = tx.Select("CAST(strftime(?, start_time, 'localtime') AS INTEGER) AS bucket, COUNT(*) AS count", strftimeFormat).Group("bucket").Order("bucket").Scan(&counts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query counts by time bucket %#v: %w", strftimeFormat, err)
+	}
+	return counts, nil
+}
+
+type StorageStats struct {
+	TotalCount int64       `json:"total_count"`
+	ByHost     []HostStats `json:"by_host"`
+	// Bucketed by year, e.g. 2023
+	ByYear       []TimeBucketCount `json:"by_year"`
+	DbSizeBytes  int64             `json:"db_size_bytes"`
+	WalSizeBytes int64             `json:"wal_size_bytes"`
+	// The space taken up by free pages in the DB, which can be released via `hishtory compact`
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+// ComputeStorageStats returns how many entries are stored locally (broken down by host and by year) along
+// with the size of the local DB, to help with deciding what to prune.
+func ComputeStorageStats(ctx context.Context) (*StorageStats, error) {
+	stats := StorageStats{}
+	if err := hctx.GetDb(ctx).Model(&data.HistoryEntry{}).Count(&stats.TotalCount).Error; err != nil {
+		return nil, fmt.Errorf("failed to count history entries: %w", err)
+	}
+	var err error
+	stats.ByHost, err = countByHost(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	stats.ByYear, err = countByTimeBucket(ctx, "", "%Y")
+	if err != nil {
+		return nil, err
+	}
+	dbPath := data.GetDbPath(hctx.GetHome(ctx))
+	stats.DbSizeBytes, err = getFileSize(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	stats.WalSizeBytes, err = getFileSize(dbPath + "-wal")
+	if err != nil {
+		return nil, err
+	}
+	stats.ReclaimableBytes, err = getReclaimableBytes(hctx.GetDb(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func getFileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return fi.Size(), nil
+}
+
+// GetRemoteStorageUsage returns how much data this user has stored on the backend
+func GetRemoteStorageUsage(config hctx.ClientConfig) (*shared.StorageUsage, error) {
+	resp, err := ApiGet("/api/v1/storage-usage?user_id=" + data.UserId(config.UserSecret))
+	if err != nil {
+		return nil, err
+	}
+	var usage shared.StorageUsage
+	if err := json.Unmarshal(resp, &usage); err != nil {
+		return nil, fmt.Errorf("failed to parse storage usage response: %w", err)
+	}
+	return &usage, nil
+}
+
+// FormatBytes formats a number of bytes as a human-readable string (e.g. 1.5 MB)
+func FormatBytes(numBytes int64) string {
+	const unit = 1024
+	if numBytes < unit {
+		return fmt.Sprintf("%d B", numBytes)
+	}
+	div, exp := int64(unit), 0
+	for n := numBytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(numBytes)/float64(div), "KMGTPE"[exp])
+}
+
+func DisplayStats(stats *HistoryStats) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	fmt.Printf("Total commands: %d\n\n", stats.TotalCount)
+
+	fmt.Println("Top commands:")
+	tbl := table.New("Count", "Command")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, c := range stats.TopCommands {
+		tbl.AddRow(c.Count, c.Command)
+	}
+	tbl.Print()
+
+	fmt.Println("\nMost reused commands (selected from a search):")
+	tbl = table.New("Count", "Command")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, c := range stats.MostReusedCommands {
+		tbl.AddRow(c.Count, c.Command)
+	}
+	tbl.Print()
+
+	fmt.Println("\nBy command prefix:")
+	tbl = table.New("Prefix", "Count", "Failure Rate", "Average Runtime")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, p := range stats.ByPrefix {
+		avgRuntime := time.Duration(p.AverageRuntimeSeconds * float64(time.Second)).Round(time.Millisecond)
+		tbl.AddRow(p.Prefix, p.Count, fmt.Sprintf("%.1f%%", p.FailureRate*100), avgRuntime.String())
+	}
+	tbl.Print()
+
+	fmt.Println("\nBy host:")
+	tbl = table.New("Hostname", "Count", "Failure Rate")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, h := range stats.ByHost {
+		tbl.AddRow(h.Hostname, h.Count, fmt.Sprintf("%.1f%%", h.FailureRate*100))
+	}
+	tbl.Print()
+
+	fmt.Println("\nBusiest hours:")
+	tbl = table.New("Hour", "Count")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, b := range stats.ByHourOfDay {
+		tbl.AddRow(fmt.Sprintf("%02d:00", b.Bucket), b.Count)
+	}
+	tbl.Print()
+
+	fmt.Println("\nBusiest days:")
+	tbl = table.New("Day", "Count")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, b := range stats.ByDayOfWeek {
+		tbl.AddRow(time.Weekday(b.Bucket).String(), b.Count)
+	}
+	tbl.Print()
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// isRunningAsRoot returns whether hishtory is running as root (always false on Windows)
+func isRunningAsRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// getSudoUser returns the user who ran sudo if hishtory is running as root via sudo (e.g. in a shell started by
+// `sudo -i`), or nil otherwise. Commands run in such shells are attributed to that user rather than to root.
+func getSudoUser() *user.User {
+	if !isRunningAsRoot() {
+		return nil
+	}
+	username := os.Getenv("SUDO_USER")
+	if username == "" || username == "root" {
+		return nil
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		hctx.GetLogger().Infof("Failed to look up SUDO_USER=%#v: %v", username, err)
+		return nil
+	}
+	return u
+}
+
+// UseSudoUserHome makes hishtory use the home directory of the user who ran sudo rather than root's, so that
+// commands run in a root shell are saved to that user's history rather than to a separate history for root. This
+// is only done if that user has hishtory installed. It returns that user's home directory, or an empty string if
+// hishtory isn't running via sudo. This must be called before hctx.MakeContext.
+func UseSudoUserHome() string {
+	u := getSudoUser()
+	if u == nil || u.HomeDir == "" {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(data.GetHishtoryConfigDir(u.HomeDir), data.CONFIG_PATH)); err != nil {
+		return ""
+	}
+	if err := os.Setenv("HOME", u.HomeDir); err != nil {
+		return ""
+	}
+	return u.HomeDir
+}
+
+// RestoreSudoUserOwnership gives the files in the hishtory directories under homedir that were created or
+// replaced by root back to the user who ran sudo. Otherwise, the root-owned files (e.g. the DB's WAL) would stop
+// hishtory from working once that user exits the root shell.
+func RestoreSudoUserOwnership(homedir string) {
+	uid, gid := getExpectedOwner()
+	if uid == 0 {
+		return
+	}
+	for _, dir := range []string{data.GetHishtoryDir(homedir), data.GetHishtoryConfigDir(homedir)} {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			info, err := os.Lstat(path)
+			if err != nil {
+				return nil
+			}
+			if owner, ok := getFileOwner(info); ok && owner == 0 {
+				if err := os.Lchown(path, uid, gid); err != nil {
+					hctx.GetLogger().Infof("Failed to restore the ownership of %s: %v", path, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			hctx.GetLogger().Infof("Failed to restore the ownership of %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Tags are searched for via `tag:NAME` atoms, so they're limited to a single reasonably short token
+const maxTagLength = 64
+
+// The entry ID that refers to the most recently run command, so that it can be tagged without looking up its ID
+const lastEntryId = "last"
+
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tags can't be empty")
+	}
+	if len(tag) > maxTagLength {
+		return fmt.Errorf("tag %#v is too long, tags can be at most %d characters", tag, maxTagLength)
+	}
+	if strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("tag %#v contains whitespace, which isn't supported", tag)
+	}
+	return nil
+}
+
+// GetEntryById returns the entry with the given ID, in the format returned by entryKey (and displayed in the
+// Entry ID column). The ID "last" refers to the most recently run command.
+func GetEntryById(ctx context.Context, id string) (*data.HistoryEntry, error) {
+	db := hctx.GetDb(ctx)
+	if id == lastEntryId {
+		entries, err := Search(ctx, db, "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("there are no history entries yet")
+		}
+		return entries[0], nil
+	}
+	separatorIdx := strings.LastIndex(id, "/")
+	if separatorIdx < 0 {
+		return nil, fmt.Errorf("invalid entry ID %#v, expected an ID in the format DEVICE_ID/END_TIME (see the Entry ID column)", id)
+	}
+	deviceId := id[:separatorIdx]
+	endTimeNanos, err := strconv.ParseInt(id[separatorIdx+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry ID %#v, expected an ID in the format DEVICE_ID/END_TIME (see the Entry ID column): %w", id, err)
+	}
+	// Times are stored as strings that include the timezone offset they were recorded with, so they can't be
+	// compared for equality in SQL. Instead, find the candidates from the same second and compare them here.
+	var entries []*data.HistoryEntry
+	err = db.Where("device_id = ? AND CAST(strftime('%s', end_time) AS INTEGER) = ?", deviceId, time.Unix(0, endTimeNanos).Unix()).Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up entry %#v: %w", id, err)
+	}
+	for _, entry := range entries {
+		if entry.EndTime.UnixNano() == endTimeNanos {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("no history entry with ID %#v", id)
+}
+
+// GetEntryTags returns the tags attached to entry, sorted alphabetically
+func GetEntryTags(ctx context.Context, entry data.HistoryEntry) ([]string, error) {
+	tags := make([]string, 0)
+	err := hctx.GetDb(ctx).Model(&data.EntryTag{}).Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Order("tag").Pluck("tag", &tags).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tags for the entry: %w", err)
+	}
+	return tags, nil
+}
+
+// TagEntry attaches the given tags to entry, and syncs them to all other devices
+func TagEntry(ctx context.Context, entry data.HistoryEntry, tags ...string) error {
+	return updateEntryTags(ctx, entry, data.MetadataUpdateAddTag, tags)
+}
+
+// UntagEntry removes the given tags from entry, and syncs the removal to all other devices
+func UntagEntry(ctx context.Context, entry data.HistoryEntry, tags ...string) error {
+	return updateEntryTags(ctx, entry, data.MetadataUpdateRemoveTag, tags)
+}
+
+func updateEntryTags(ctx context.Context, entry data.HistoryEntry, kind string, tags []string) error {
+	updates := make([]data.MetadataUpdate, 0, len(tags))
+	for _, tag := range tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+		updates = append(updates, data.MetadataUpdate{Kind: kind, DeviceId: entry.DeviceId, EndTime: entry.EndTime, Tag: tag})
+	}
+	db := hctx.GetDb(ctx)
+	for _, update := range updates {
+		if err := applyMetadataUpdate(db, update); err != nil {
+			return err
+		}
+	}
+	return SendMetadataUpdates(ctx, updates)
+}
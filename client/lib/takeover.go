@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// The comment that starts the config fragment that hishtory (and upstream hishtory) adds to shell rc files
+const shellConfigFragmentMarker = "# Hishtory Config:"
+
+// Matches the line of a config fragment that sources hishtory's shell config, capturing the install's directory
+var sourceConfigLineRegex = regexp.MustCompile(`(?:source|\.)\s+["']?([^"'\s]+)[/\\]config\.(?:sh|zsh|fish|ps1|nu|tcsh|ksh)["']?`)
+
+// Entries recorded by two installs for the same command are considered duplicates if they started within this long
+// of each other
+const duplicateEntryTolerance = 2 * time.Second
+
+// OtherInstallHook is a config fragment in a shell rc file that hooks in a hishtory install from a different
+// directory than this one, e.g. upstream hishtory installed alongside this fork. Every command run in that shell is
+// then recorded by both installs.
+type OtherInstallHook struct {
+	RcPath string
+	// The other install's directory, which contains its binary, shell config, and DB
+	Dir string
+	// The indexes of the fragment's lines in the rc file
+	lines []int
+}
+
+// FindOtherInstallHooks returns the hooks in the given shell rc files for hishtory installs in any directory other
+// than ownDir
+func FindOtherInstallHooks(rcPaths []string, ownDir string) ([]OtherInstallHook, error) {
+	hooks := make([]OtherInstallHook, 0)
+	for _, rcPath := range rcPaths {
+		contents, err := os.ReadFile(rcPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rcPath, err)
+		}
+		lines := strings.Split(string(contents), "\n")
+		for i, line := range lines {
+			if strings.TrimSpace(line) != shellConfigFragmentMarker {
+				continue
+			}
+			// Fragments are the marker followed by a line that adds the install to the PATH and a line that sources
+			// its shell config, both of which reference the install's directory
+			rawDir := ""
+			for j := i + 1; j < len(lines) && j <= i+2; j++ {
+				if match := sourceConfigLineRegex.FindStringSubmatch(lines[j]); match != nil {
+					rawDir = match[1]
+				}
+			}
+			dir := filepath.Clean(expandHomeDir(rawDir))
+			if rawDir == "" || dir == filepath.Clean(ownDir) {
+				continue
+			}
+			hook := OtherInstallHook{RcPath: rcPath, Dir: dir, lines: []int{i}}
+			for j := i + 1; j < len(lines) && j <= i+2; j++ {
+				if strings.Contains(lines[j], rawDir) {
+					hook.lines = append(hook.lines, j)
+				}
+			}
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+func expandHomeDir(path string) string {
+	for _, prefix := range []string{"~/", "$HOME/", "${HOME}/"} {
+		if strings.HasPrefix(path, prefix) {
+			if homedir, err := os.UserHomeDir(); err == nil {
+				return filepath.Join(homedir, strings.TrimPrefix(path, prefix))
+			}
+		}
+	}
+	return path
+}
+
+// RemoveOtherInstallHooks removes the given hooks from their shell rc files. Unlike removing this install's own
+// hooks, only the fragment's exact lines are removed, since the fragments of both installs start with the same marker.
+func RemoveOtherInstallHooks(hooks []OtherInstallHook) error {
+	linesByRcPath := make(map[string]map[int]bool)
+	for _, hook := range hooks {
+		if linesByRcPath[hook.RcPath] == nil {
+			linesByRcPath[hook.RcPath] = make(map[int]bool)
+		}
+		for _, line := range hook.lines {
+			linesByRcPath[hook.RcPath][line] = true
+		}
+	}
+	for rcPath, linesToRemove := range linesByRcPath {
+		contents, err := os.ReadFile(rcPath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rcPath, err)
+		}
+		fileInfo, err := os.Stat(rcPath)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(string(contents), "\n")
+		kept := make([]string, 0, len(lines))
+		for i, line := range lines {
+			if !linesToRemove[i] {
+				kept = append(kept, line)
+			}
+		}
+		if err := os.WriteFile(rcPath, []byte(strings.Join(kept, "\n")), fileInfo.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to remove the hooks from %s: %w", rcPath, err)
+		}
+	}
+	return nil
+}
+
+// OtherInstallDirs returns the distinct directories of the installs that the given hooks belong to
+func OtherInstallDirs(hooks []OtherInstallHook) []string {
+	dirs := make([]string, 0)
+	for _, hook := range hooks {
+		if !containsString(dirs, hook.Dir) {
+			dirs = append(dirs, hook.Dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// ImportOtherInstallDb imports the history entries from the DB of the hishtory install in dir into this install's DB,
+// and uploads them. Entries that were recorded by both installs (since both were hooked into the same shell) are
+// skipped. Returns the number of imported entries and the number of skipped duplicates.
+func ImportOtherInstallDb(ctx context.Context, dir string) (int, int, error) {
+	dbPath := filepath.Join(dir, data.DB_PATH)
+	if _, err := os.Stat(dbPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	otherDb, err := hctx.OpenSqliteDb(hctx.GetConf(ctx), dbPath, "ro")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open the DB of the install in %s: %w", dir, err)
+	}
+	defer func() {
+		if rawDb, err := otherDb.DB(); err == nil {
+			rawDb.Close()
+		}
+	}()
+	var otherEntries []*data.HistoryEntry
+	if err := otherDb.Find(&otherEntries).Error; err != nil {
+		return 0, 0, fmt.Errorf("failed to read the entries from %s: %w", dbPath, err)
+	}
+	if len(otherEntries) == 0 {
+		return 0, 0, nil
+	}
+
+	// The start times of this install's entries, by command, to find the entries that both installs recorded.
+	// These are compared in Go rather than in SQL, since sqlite compares timestamps as strings.
+	startTimes := make(map[string][]time.Time)
+	err = forEachTier(ctx, func(db *gorm.DB) error {
+		var rows []*data.HistoryEntry
+		if err := db.Model(&data.HistoryEntry{}).Select("command", "start_time").Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			startTimes[row.Command] = append(startTimes[row.Command], row.StartTime)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query for existing entries: %w", err)
+	}
+	isDuplicate := func(entry *data.HistoryEntry) bool {
+		for _, startTime := range startTimes[entry.Command] {
+			diff := startTime.Sub(entry.StartTime)
+			if diff <= duplicateEntryTolerance && diff >= -duplicateEntryTolerance {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := SnapshotDb(ctx, "takeover"); err != nil {
+		return 0, 0, err
+	}
+	db := hctx.GetDb(ctx)
+	imported := make([]*data.HistoryEntry, 0)
+	numDuplicates := 0
+	for _, entry := range otherEntries {
+		if isDuplicate(entry) {
+			numDuplicates++
+			continue
+		}
+		AddToDbIfNew(db, *entry)
+		imported = append(imported, entry)
+	}
+	if hctx.GetConf(ctx).IsOffline {
+		return len(imported), numDuplicates, nil
+	}
+	if err := UploadEntries(ctx, imported); err != nil {
+		if IsOfflineError(err) {
+			fmt.Printf("Imported %d entries but couldn't upload them since the server is unreachable, run `hishtory reupload` to sync them to your other devices\n", len(imported))
+			return len(imported), numDuplicates, nil
+		}
+		return 0, 0, fmt.Errorf("failed to upload the imported entries: %w", err)
+	}
+	return len(imported), numDuplicates, nil
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/muesli/termenv"
+	"golang.org/x/term"
+)
+
+// The number of matching commands that are printed when the TUI can't be rendered
+const numPlainResults = TABLE_HEIGHT
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// isDumbTerminal returns whether the terminal doesn't support colors or moving the cursor (e.g. emacs' shell-mode)
+func isDumbTerminal() bool {
+	return os.Getenv("TERM") == "dumb"
+}
+
+// canRenderTui returns whether the TUI can be rendered, which requires reading keys from a terminal and drawing
+// to a terminal that supports moving the cursor. The TUI is drawn on stderr so that stdout can be captured by the
+// shell integration.
+func canRenderTui() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stderr) && !isDumbTerminal()
+}
+
+// getColorProfile returns the color profile that the TUI is rendered with. Colors are disabled if the user set
+// NO_COLOR (see https://no-color.org/) or if the terminal doesn't support them.
+func getColorProfile() termenv.Profile {
+	if os.Getenv("NO_COLOR") != "" || isDumbTerminal() {
+		return termenv.Ascii
+	}
+	return termenv.ANSI
+}
+
+// writePlainResults writes the commands matching query to w, one per line with the most recent first. This is
+// the fallback for when the TUI can't be rendered.
+func writePlainResults(ctx context.Context, w io.Writer, query string) error {
+	err := RetrieveAdditionalEntriesFromRemote(ctx)
+	if err != nil && !IsOfflineError(err) {
+		return err
+	}
+	_, entries, err := getRows(ctx, []string{"Command"}, query, numPlainResults)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// Collapse multi-line commands so that each command is printed on a single line
+		if _, err := fmt.Fprintln(w, collapseNewlines(strings.TrimSpace(entry.Command))); err != nil {
+			return fmt.Errorf("failed to write results: %w", err)
+		}
+	}
+	return nil
+}
+
+// tuiFallback is used instead of the TUI when it can't be rendered
+func tuiFallback(ctx context.Context, initialQuery string) error {
+	if os.Getenv("HISHTORY_TERM_INTEGRATION") == "" {
+		return writePlainResults(ctx, os.Stdout, initialQuery)
+	}
+	// stdout is inserted into the shell's buffer, so print the results to stderr and leave the buffer unchanged
+	if err := writePlainResults(ctx, os.Stderr, initialQuery); err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", initialQuery)
+	return nil
+}
+
+// CanReadPassphrase returns whether a passphrase can be read from the terminal with ReadPassphrase
+func CanReadPassphrase() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stderr)
+}
+
+// ReadPassphrase prompts for a passphrase on stderr and reads it from the terminal without echoing it
+func ReadPassphrase(prompt string) (string, error) {
+	if !CanReadPassphrase() {
+		return "", fmt.Errorf("can't prompt for a passphrase since hishtory isn't running in a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the passphrase: %w", err)
+	}
+	return string(passphrase), nil
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/muesli/termenv"
+)
+
+const (
+	DefaultColorTheme = "default"
+	AutoColorTheme    = "auto"
+)
+
+var builtinColorThemes = map[string]hctx.ThemeColors{
+	"default": {
+		Header:             "240",
+		SelectedForeground: "229",
+		SelectedBackground: "57",
+		Border:             "240",
+	},
+	"dark": {
+		Header:             "245",
+		SelectedForeground: "229",
+		SelectedBackground: "57",
+		MatchHighlight:     "214",
+		Border:             "240",
+	},
+	"light": {
+		Header:             "244",
+		SelectedForeground: "255",
+		SelectedBackground: "27",
+		MatchHighlight:     "166",
+		Border:             "250",
+	},
+	"solarized": {
+		Header:             "#93a1a1",
+		SelectedForeground: "#fdf6e3",
+		SelectedBackground: "#268bd2",
+		MatchHighlight:     "#b58900",
+		Border:             "#586e75",
+	},
+}
+
+// GetColorThemeNames returns the names of all themes that can be passed to `config-set color-theme`
+func GetColorThemeNames() []string {
+	names := []string{AutoColorTheme}
+	for name := range builtinColorThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetColorTheme returns the colors for the configured theme with any user-defined overrides applied
+func GetColorTheme(config hctx.ClientConfig) (hctx.ThemeColors, error) {
+	themeName := config.ColorTheme
+	if themeName == "" {
+		themeName = DefaultColorTheme
+	}
+	if themeName == AutoColorTheme {
+		themeName = "light"
+		if hasDarkBackground() {
+			themeName = "dark"
+		}
+	}
+	theme, ok := builtinColorThemes[themeName]
+	if !ok {
+		return hctx.ThemeColors{}, fmt.Errorf("unknown color theme %#v (options: %s)", config.ColorTheme, strings.Join(GetColorThemeNames(), ", "))
+	}
+	return mergeThemeColors(theme, config.ThemeOverrides), nil
+}
+
+func mergeThemeColors(base, overrides hctx.ThemeColors) hctx.ThemeColors {
+	if overrides.Header != "" {
+		base.Header = overrides.Header
+	}
+	if overrides.SelectedForeground != "" {
+		base.SelectedForeground = overrides.SelectedForeground
+	}
+	if overrides.SelectedBackground != "" {
+		base.SelectedBackground = overrides.SelectedBackground
+	}
+	if overrides.MatchHighlight != "" {
+		base.MatchHighlight = overrides.MatchHighlight
+	}
+	if overrides.Border != "" {
+		base.Border = overrides.Border
+	}
+	return base
+}
+
+// SetThemeOverride sets the override for a single named element of the color theme
+func SetThemeOverride(config *hctx.ClientConfig, element, color string) error {
+	switch element {
+	case "header":
+		config.ThemeOverrides.Header = color
+	case "selected-foreground":
+		config.ThemeOverrides.SelectedForeground = color
+	case "selected-background":
+		config.ThemeOverrides.SelectedBackground = color
+	case "match-highlight":
+		config.ThemeOverrides.MatchHighlight = color
+	case "border":
+		config.ThemeOverrides.Border = color
+	default:
+		return fmt.Errorf("unknown theme element %#v (options: %s)", element, strings.Join(ThemeElementNames, ", "))
+	}
+	return nil
+}
+
+var ThemeElementNames = []string{"header", "selected-foreground", "selected-background", "match-highlight", "border"}
+
+func hasDarkBackground() bool {
+	// Many terminals (e.g. rxvt, konsole) set COLORFGBG="fg;bg" which is much cheaper to check than querying the terminal
+	if colorFgBg := os.Getenv("COLORFGBG"); colorFgBg != "" {
+		parts := strings.Split(colorFgBg, ";")
+		bg, err := strconv.Atoi(parts[len(parts)-1])
+		if err == nil {
+			return bg < 7 || bg == 8
+		}
+	}
+	// Otherwise query the terminal that the TUI is rendered on. This defaults to dark if the terminal doesn't respond.
+	return termenv.NewOutput(os.Stderr).HasDarkBackground()
+}
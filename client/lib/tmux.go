@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Looking up the tmux pane happens for every command, so give up quickly if the tmux server is slow to respond
+const tmuxTimeout = 200 * time.Millisecond
+
+// The format used to describe a pane in HistoryEntry.TmuxPane, e.g. "main:1.0"
+const tmuxPaneFormat = "#{session_name}:#{window_index}.#{pane_index}"
+
+// getTmuxPane returns the tmux session, window, and pane that the current shell is running in (e.g. "main:1.0"),
+// or an empty string if it isn't running in tmux. If tmux can't be queried, the pane ID (e.g. "%3") is returned
+// instead so that entries are still attributed to tmux.
+func getTmuxPane() string {
+	paneId := os.Getenv("TMUX_PANE")
+	if os.Getenv("TMUX") == "" || paneId == "" {
+		return ""
+	}
+	pane, err := runTmux("display-message", "-p", "-t", paneId, tmuxPaneFormat)
+	if err != nil || pane == "" {
+		hctx.GetLogger().Infof("failed to look up the tmux pane %#v: %v", paneId, err)
+		return paneId
+	}
+	return pane
+}
+
+func runTmux(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tmuxTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "tmux", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tmux %s failed (stderr=%#v): %w", strings.Join(args, " "), stderr.String(), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// TmuxPopup implements `hishtory tmux-popup`, which is meant to be run via tmux's display-popup. It shows the
+// search TUI and then types the chosen command into targetPane (or the pane that the popup was opened over, if
+// targetPane is empty) without running it. If onlyThisPane is set, the search starts out restricted to the history
+// of the target pane.
+func TmuxPopup(ctx context.Context, targetPane, initialQuery string, onlyThisPane bool) error {
+	if os.Getenv("TMUX") == "" {
+		return fmt.Errorf("hishtory tmux-popup must be run inside of tmux (e.g. via `tmux display-popup -E 'hishtory tmux-popup'`)")
+	}
+	if targetPane == "" {
+		// Inside of a popup, this resolves to the active pane of the client that opened the popup
+		pane, err := runTmux("display-message", "-p", "#{pane_id}")
+		if err != nil {
+			return fmt.Errorf("failed to find the active tmux pane: %w", err)
+		}
+		targetPane = pane
+	}
+	if onlyThisPane {
+		pane, err := runTmux("display-message", "-p", "-t", targetPane, tmuxPaneFormat)
+		if err != nil {
+			return fmt.Errorf("failed to look up the tmux pane %#v: %w", targetPane, err)
+		}
+		initialQuery = strings.TrimSpace("tmux:" + pane + " " + initialQuery)
+	}
+	backend, err := GetSearchBackend(hctx.GetConf(ctx))
+	if err != nil {
+		return err
+	}
+	selected, err := backend.Search(ctx, initialQuery)
+	if err != nil {
+		return err
+	}
+	if selected == "" {
+		return nil
+	}
+	return sendToTmuxPane(targetPane, selected)
+}
+
+// sendToTmuxPane types command into the given pane without running it. Multi-line commands are inserted via a
+// bracketed paste since sending their newlines as keys would run each line as it is typed.
+func sendToTmuxPane(pane, command string) error {
+	if !strings.Contains(command, "\n") {
+		_, err := runTmux("send-keys", "-t", pane, "-l", command)
+		return err
+	}
+	const bufferName = "hishtory-tmux-popup"
+	cmd := exec.Command("tmux", "load-buffer", "-b", bufferName, "-")
+	cmd.Stdin = strings.NewReader(command)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load the command into a tmux buffer (output=%#v): %w", string(out), err)
+	}
+	_, err := runTmux("paste-buffer", "-p", "-d", "-b", bufferName, "-t", pane)
+	return err
+}
@@ -18,19 +18,23 @@ import (
 	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/table"
-	"github.com/ddworken/hishtory/shared"
-	"github.com/muesli/termenv"
 	"golang.org/x/term"
+	"gorm.io/gorm"
 )
 
 const TABLE_HEIGHT = 20
 const PADDED_NUM_ENTRIES = TABLE_HEIGHT * 5
 
+// Commands longer than this are edited in $EDITOR rather than inline in the TUI
+const MAX_INLINE_EDIT_LENGTH = 200
+
 var SELECTED_COMMAND string = ""
 
-var baseStyle = lipgloss.NewStyle().
-	BorderStyle(lipgloss.NormalBorder()).
-	BorderForeground(lipgloss.Color("240"))
+func getBaseStyle(theme hctx.ThemeColors) lipgloss.Style {
+	return lipgloss.NewStyle().
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color(theme.Border))
+}
 
 type keyMap struct {
 	Up                      key.Binding
@@ -44,6 +48,16 @@ type keyMap struct {
 	TableLeft               key.Binding
 	TableRight              key.Binding
 	DeleteEntry             key.Binding
+	UndoDelete              key.Binding
+	EditEntry               key.Binding
+	EditSavedEntry          key.Binding
+	ViewEntry               key.Binding
+	TagEntry                key.Binding
+	PinEntry                key.Binding
+	FillPlaceholders        key.Binding
+	RecordMacro             key.Binding
+	OpenPalette             key.Binding
+	CheatSheet              key.Binding
 	Help                    key.Binding
 	Quit                    key.Binding
 }
@@ -64,10 +78,10 @@ func (k keyMap) ShortHelp() []key.Binding {
 
 func (k keyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
-		{fakeTitleKeyBinding, k.Up, k.Left, k.SelectEntry, k.SelectEntryAndChangeDir},
-		{fakeEmptyKeyBinding, k.Down, k.Right, k.DeleteEntry},
-		{fakeEmptyKeyBinding, k.PageUp, k.TableLeft, k.Quit},
-		{fakeEmptyKeyBinding, k.PageDown, k.TableRight, k.Help},
+		{fakeTitleKeyBinding, k.Up, k.Left, k.SelectEntry, k.SelectEntryAndChangeDir, k.PinEntry, k.FillPlaceholders},
+		{fakeEmptyKeyBinding, k.Down, k.Right, k.DeleteEntry, k.EditEntry, k.TagEntry, k.EditSavedEntry},
+		{fakeEmptyKeyBinding, k.PageUp, k.TableLeft, k.Quit, k.RecordMacro, k.ViewEntry, k.UndoDelete},
+		{fakeEmptyKeyBinding, k.PageDown, k.TableRight, k.Help, k.OpenPalette, k.CheatSheet},
 	}
 }
 
@@ -116,6 +130,46 @@ var keys = keyMap{
 		key.WithKeys("ctrl+k"),
 		key.WithHelp("ctrl+k", "delete the highlighted entry "),
 	),
+	UndoDelete: key.NewBinding(
+		key.WithKeys("ctrl+z"),
+		key.WithHelp("ctrl+z", "undo the last deletion "),
+	),
+	EditEntry: key.NewBinding(
+		key.WithKeys("ctrl+o"),
+		key.WithHelp("ctrl+o", "edit before selecting "),
+	),
+	EditSavedEntry: key.NewBinding(
+		key.WithKeys("alt+e"),
+		key.WithHelp("alt+e", "edit the saved command "),
+	),
+	ViewEntry: key.NewBinding(
+		key.WithKeys("ctrl+s"),
+		key.WithHelp("ctrl+s", "view the full entry "),
+	),
+	TagEntry: key.NewBinding(
+		key.WithKeys("ctrl+y"),
+		key.WithHelp("ctrl+y", "tag the highlighted entry "),
+	),
+	PinEntry: key.NewBinding(
+		key.WithKeys("ctrl+l"),
+		key.WithHelp("ctrl+l", "pin or unpin the highlighted entry "),
+	),
+	FillPlaceholders: key.NewBinding(
+		key.WithKeys("tab"),
+		key.WithHelp("tab", "fill in placeholders before selecting "),
+	),
+	RecordMacro: key.NewBinding(
+		key.WithKeys("ctrl+g"),
+		key.WithHelp("ctrl+g", "record a macro "),
+	),
+	OpenPalette: key.NewBinding(
+		key.WithKeys("ctrl+t"),
+		key.WithHelp("ctrl+t", "search all actions "),
+	),
+	CheatSheet: key.NewBinding(
+		key.WithKeys("?"),
+		key.WithHelp("?", "list keybindings and filters "),
+	),
 	Help: key.NewBinding(
 		key.WithKeys("ctrl+h"),
 		key.WithHelp("ctrl+h", "help "),
@@ -132,6 +186,7 @@ const (
 	NotSelected SelectStatus = iota
 	Selected
 	SelectedWithChangeDir
+	SelectedWithEdits
 )
 
 type model struct {
@@ -153,15 +208,28 @@ type model struct {
 	table table.Model
 	// The entries in the table
 	tableEntries []*data.HistoryEntry
+	// Where the next page of results for lastQuery starts, and whether there may be any more of them. Results are
+	// loaded a page at a time as the user scrolls down, see loadMoreResults.
+	nextPage       searchCursor
+	hasMoreResults bool
 	// Whether the user has hit enter to select an entry and the TUI is thus about to quit.
 	selected SelectStatus
 
 	// The search box for the query
 	queryInput textinput.Model
+	// The input box for editing the highlighted command before selecting it
+	editInput textinput.Model
+	// Whether the user is currently editing a command in editInput
+	isEditing bool
+	// The entry whose saved command is being edited in editInput, or nil if the command is being edited before
+	// selecting it
+	editingEntry *data.HistoryEntry
 	// The query to run. Reset to nil after it was run.
 	runQuery *string
 	// The previous query that was run.
 	lastQuery string
+	// The search for the query that is running in the background, if any
+	search *tuiSearch
 
 	// Unrecoverable error.
 	fatalErr error
@@ -172,15 +240,88 @@ type model struct {
 
 	// A banner from the backend to be displayed. Generally an empty string.
 	banner string
+
+	// The colors used for rendering the TUI
+	theme hctx.ThemeColors
+
+	// The macros that the user has recorded, see TuiMacro
+	macros []hctx.TuiMacro
+	// Whether a macro is being recorded or saved
+	macroState macroState
+	// The key presses recorded for the macro that is currently being recorded
+	macroKeys []string
+	// The input box for naming a just-recorded macro
+	macroNameInput textinput.Model
+	// Whether a macro is currently being replayed, in which case nested macros aren't expanded
+	isReplayingMacro bool
+	// A status message about macros (e.g. that one was saved), displayed until the next key press
+	macroMessage string
+
+	// Whether the command palette is open
+	isPaletteOpen bool
+	// The search box for the command palette
+	paletteInput textinput.Model
+	// The index of the highlighted command in the command palette
+	paletteCursor int
+
+	// Whether the cheat sheet listing every key binding and the active filters is open
+	isCheatSheetOpen bool
+
+	// Whether the highlighted entry is being viewed in full, see keys.ViewEntry
+	isViewingEntry bool
+	// The metadata of the entry being viewed
+	entryViewHeader string
+	// The command of the entry being viewed, wrapped to the width of the terminal
+	entryViewLines []string
+	// The index of the first line of entryViewLines that is displayed
+	entryViewOffset int
+
+	// Whether the tag prompt for the highlighted entry is open, see keys.TagEntry
+	isTagging bool
+	// The input box for the tag to add to (or remove from) the highlighted entry
+	tagInput textinput.Model
+	// The tags that the highlighted entry had when the tag prompt was opened
+	currentTags []string
+
+	// Whether the prompt for saving the highlighted entry as a snippet is open
+	isSavingSnippet bool
+	// The input box for the name of the snippet
+	snippetNameInput textinput.Model
+
+	// Whether the placeholders (e.g. IP addresses) in the highlighted entry are being filled in, see keys.FillPlaceholders
+	isFillingPlaceholders bool
+	// The command whose placeholders are being filled in
+	placeholderCommand string
+	// The placeholders in placeholderCommand, and the index of the one that is being filled in
+	placeholders     []placeholder
+	placeholderIndex int
+	// The input box for the value of the placeholder that is being filled in
+	placeholderInput textinput.Model
+
+	// A status message (e.g. that a tag was added), displayed until the next key press
+	statusMessage string
+
+	// The size of the terminal, or 0 if it is unknown
+	terminalWidth  int
+	terminalHeight int
+
+	// Stats about the last query that was run, only set if the config enables DisplayQueryStats
+	queryStats *QueryStats
 }
 
 type doneDownloadingMsg struct{}
+type editorFinishedMsg struct {
+	command string
+	// The entry whose saved command was edited, or nil if the command was edited before selecting it
+	entry *data.HistoryEntry
+	err   error
+}
 type offlineMsg struct{}
 type bannerMsg struct {
 	banner string
 }
 
-func initialModel(ctx context.Context, t table.Model, tableEntries []*data.HistoryEntry, initialQuery string) model {
+func initialModel(ctx context.Context, theme hctx.ThemeColors, t table.Model, tableEntries []*data.HistoryEntry, initialQuery string) model {
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
@@ -192,7 +333,32 @@ func initialModel(ctx context.Context, t table.Model, tableEntries []*data.Histo
 	if initialQuery != "" {
 		queryInput.SetValue(initialQuery)
 	}
-	return model{ctx: ctx, spinner: s, isLoading: true, table: t, tableEntries: tableEntries, runQuery: &initialQuery, queryInput: queryInput, help: help.New()}
+	editInput := textinput.New()
+	editInput.CharLimit = MAX_INLINE_EDIT_LENGTH
+	editInput.Width = 100
+	macroNameInput := textinput.New()
+	macroNameInput.CharLimit = 64
+	macroNameInput.Width = 50
+	paletteInput := textinput.New()
+	paletteInput.Placeholder = "delete"
+	paletteInput.CharLimit = 64
+	paletteInput.Width = 50
+	tagInput := textinput.New()
+	tagInput.Placeholder = "golden"
+	tagInput.CharLimit = maxTagLength
+	tagInput.Width = 50
+	snippetNameInput := textinput.New()
+	snippetNameInput.Placeholder = "deploy"
+	snippetNameInput.CharLimit = maxSnippetNameLength
+	snippetNameInput.Width = 50
+	placeholderInput := textinput.New()
+	placeholderInput.CharLimit = MAX_INLINE_EDIT_LENGTH
+	placeholderInput.Width = 50
+	terminalWidth, terminalHeight, err := getTerminalSize()
+	if err != nil {
+		terminalWidth, terminalHeight = 0, 0
+	}
+	return model{terminalWidth: terminalWidth, terminalHeight: terminalHeight, ctx: ctx, spinner: s, isLoading: true, table: t, tableEntries: tableEntries, runQuery: &initialQuery, queryInput: queryInput, editInput: editInput, help: help.New(), theme: theme, macros: hctx.GetConf(ctx).TuiMacros, macroNameInput: macroNameInput, paletteInput: paletteInput, tagInput: tagInput, snippetNameInput: snippetNameInput, placeholderInput: placeholderInput}
 }
 
 func (m model) Init() tea.Cmd {
@@ -200,29 +366,129 @@ func (m model) Init() tea.Cmd {
 }
 
 func runQueryAndUpdateTable(m model, updateTable bool) model {
+	if m.search != nil {
+		// Search for the query of the background search right away instead, since its results would be outdated
+		// by the time that they are displayed
+		m.search.cancel()
+		if m.runQuery == nil {
+			m.runQuery = &m.search.query
+		}
+		m.search = nil
+	}
 	if (m.runQuery != nil && *m.runQuery != m.lastQuery) || updateTable || m.searchErr != nil {
 		if m.runQuery == nil {
 			m.runQuery = &m.lastQuery
 		}
-		rows, entries, err := getRows(m.ctx, hctx.GetConf(m.ctx).DisplayedColumns, *m.runQuery, PADDED_NUM_ENTRIES)
-		m.searchErr = err
+		numEntries := PADDED_NUM_ENTRIES
+		if *m.runQuery == m.lastQuery {
+			// Reload as many results as were already loaded, so that e.g. deleting an entry far down the table
+			// doesn't drop the results after it
+			numEntries = max(numEntries, m.nextPage.Offset)
+		}
+		m = showSearchResults(m, runTuiSearch(m.ctx, getTableColumns(m), *m.runQuery, numEntries), updateTable)
+	}
+	return scrollResults(m)
+}
+
+// A searchResultsMsg has the results of searching for a query in the TUI, see runTuiSearch
+type searchResultsMsg struct {
+	// The search that these are the results of, if it ran in the background
+	search      *tuiSearch
+	query       string
+	columnNames []string
+	page        rowsPage
+	// Only set if the config enables DisplayQueryStats
+	queryStats *QueryStats
+	err        error
+}
+
+// runTuiSearch searches for the first numEntries results of query, formatted as rows with columnNames
+func runTuiSearch(ctx context.Context, columnNames []string, query string, numEntries int) searchResultsMsg {
+	start := time.Now()
+	results := searchResultsMsg{query: query, columnNames: columnNames}
+	results.page, results.err = getRowsPage(ctx, columnNames, query, searchCursor{}, numEntries, "")
+	if results.err != nil || !hctx.GetConf(ctx).DisplayQueryStats {
+		return results
+	}
+	numMatches, err := getResultsProvider(ctx).count(ctx, query)
+	if err != nil {
+		results.err = err
+		return results
+	}
+	results.queryStats = &QueryStats{NumMatches: numMatches, NumDisplayed: len(results.page.entries), Duration: time.Since(start)}
+	return results
+}
+
+// showSearchResults displays the results of a search in the table, or the error if the search failed
+func showSearchResults(m model, results searchResultsMsg, updateTable bool) model {
+	m.searchErr = results.err
+	if results.err != nil {
+		return m
+	}
+	rows := padRows(results.page.rows, PADDED_NUM_ENTRIES)
+	m.tableEntries = results.page.entries
+	m.nextPage, m.hasMoreResults = results.page.next, results.page.hasMore
+	m.queryStats = results.queryStats
+	if updateTable {
+		t, err := makeTable(m.ctx, m.theme, results.columnNames, rows, m.terminalWidth, m.terminalHeight)
 		if err != nil {
+			m.fatalErr = err
 			return m
 		}
-		m.tableEntries = entries
-		if updateTable {
-			t, err := makeTable(m.ctx, rows)
-			if err != nil {
-				m.fatalErr = err
-				return m
-			}
-			m.table = t
+		m.table = t
+	}
+	m.table.SetRows(rows)
+	m.table.SetHighlightTerms(getHighlightTerms(m.theme, results.query))
+	m.table.SetCursor(0)
+	m.lastQuery = results.query
+	m.runQuery = nil
+	return m
+}
+
+// A tuiSearch is a search for the query typed into the TUI that runs in the background, so that typing stays
+// responsive on large DBs. It is cancelled as soon as the query changes again, so that searches for outdated queries
+// don't pile up.
+type tuiSearch struct {
+	query  string
+	cancel context.CancelFunc
+}
+
+// searchInBackground starts searching for query in the background, after waiting for TuiSearchDebounceMs, and
+// cancels the search for the previous query if it is still running. The results are sent as a searchResultsMsg.
+func searchInBackground(m model, query string) (model, tea.Cmd) {
+	if m.search != nil {
+		if m.search.query == query {
+			return m, nil
 		}
-		m.table.SetRows(rows)
-		m.table.SetCursor(0)
-		m.lastQuery = *m.runQuery
-		m.runQuery = nil
+		m.search.cancel()
+		m.search = nil
 	}
+	if query == m.lastQuery && m.searchErr == nil {
+		return m, nil
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	search := &tuiSearch{query: query, cancel: cancel}
+	m.search = search
+	// The search replaces any query that was waiting to be run
+	m.runQuery = nil
+	columnNames := getTableColumns(m)
+	debounce := time.Duration(hctx.GetConf(m.ctx).TuiSearchDebounceMs) * time.Millisecond
+	return m, func() tea.Msg {
+		select {
+		case <-time.After(debounce):
+		case <-ctx.Done():
+			return searchResultsMsg{search: search, query: query, err: ctx.Err()}
+		}
+		results := runTuiSearch(ctx, columnNames, query, PADDED_NUM_ENTRIES)
+		results.search = search
+		return results
+	}
+}
+
+// scrollResults loads more results once the cursor gets close to the end of the loaded ones, and ensures that the
+// cursor can't be scrolled past the end of them
+func scrollResults(m model) model {
+	m = loadMoreResults(m)
 	if m.table.Cursor() >= len(m.tableEntries) {
 		// Ensure that we can't scroll past the end of the table
 		m.table.SetCursor(len(m.tableEntries) - 1)
@@ -230,9 +496,139 @@ func runQueryAndUpdateTable(m model, updateTable bool) model {
 	return m
 }
 
+// loadMoreResults loads the next page of results once the cursor is within a table's height of the end of the
+// loaded results, so that opening the TUI doesn't require loading every matching entry of a huge history
+func loadMoreResults(m model) model {
+	if !m.hasMoreResults || m.table.Cursor() < len(m.tableEntries)-TABLE_HEIGHT {
+		return m
+	}
+	lastCommand := ""
+	if len(m.tableEntries) > 0 {
+		lastCommand = m.tableEntries[len(m.tableEntries)-1].Command
+	}
+	page, err := getRowsPage(m.ctx, getTableColumns(m), m.lastQuery, m.nextPage, PADDED_NUM_ENTRIES, lastCommand)
+	m.searchErr = err
+	if err != nil {
+		return m
+	}
+	// Replace the padding after the loaded results with the new page
+	rows := append(m.table.Rows()[:len(m.tableEntries):len(m.tableEntries)], page.rows...)
+	m.table.SetRows(padRows(rows, PADDED_NUM_ENTRIES))
+	m.tableEntries = append(m.tableEntries, page.entries...)
+	m.nextPage, m.hasMoreResults = page.next, page.hasMore
+	if m.queryStats != nil {
+		m.queryStats.NumDisplayed = len(m.tableEntries)
+	}
+	return m
+}
+
+func updateWhileEditing(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "enter":
+		if m.editingEntry != nil {
+			entry := m.editingEntry
+			m.isEditing = false
+			m.editingEntry = nil
+			m.editInput.Blur()
+			m.queryInput.Focus()
+			return saveEditedEntry(m, entry, m.editInput.Value())
+		}
+		SELECTED_COMMAND = m.editInput.Value()
+		m.selected = SelectedWithEdits
+		return m, tea.Quit
+	case "esc":
+		// Cancel the edit and go back to searching
+		m.isEditing = false
+		m.editingEntry = nil
+		m.editInput.Blur()
+		m.queryInput.Focus()
+		return m, nil
+	case "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.editInput, cmd = m.editInput.Update(msg)
+		return m, cmd
+	}
+}
+
+func startEditing(m model) (model, tea.Cmd) {
+	command := m.tableEntries[m.table.Cursor()].Command
+	if len(command) <= MAX_INLINE_EDIT_LENGTH && !strings.Contains(command, "\n") {
+		m.isEditing = true
+		m.queryInput.Blur()
+		m.editInput.SetValue(command)
+		m.editInput.CursorEnd()
+		m.editInput.Focus()
+		return m, textinput.Blink
+	}
+	// Long and multi-line commands are hard to edit inline, so open them in the user's editor instead
+	return m, openInEditor(command, nil)
+}
+
+func openInEditor(command string, entry *data.HistoryEntry) tea.Cmd {
+	cmd, finish, err := prepareEditor(command)
+	if err != nil {
+		return func() tea.Msg {
+			return editorFinishedMsg{err: err}
+		}
+	}
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		edited, err := finish(err)
+		if err != nil {
+			return editorFinishedMsg{err: err}
+		}
+		return editorFinishedMsg{command: edited, entry: entry}
+	})
+}
+
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if m.macroState == namingMacro || m.macroState == bindingMacro {
+			return updateWhileSavingMacro(m, msg)
+		}
+		if m.macroState == notRecordingMacro && !m.isReplayingMacro {
+			m.macroMessage = ""
+		}
+		if key.Matches(msg, keys.RecordMacro) && !m.isEditing && !m.isTagging && !m.isSavingSnippet && !m.isFillingPlaceholders && !m.isPaletteOpen && !m.isReplayingMacro {
+			return toggleMacroRecording(m)
+		}
+		if m.macroState == recordingMacro && !m.isReplayingMacro {
+			m.macroKeys = append(m.macroKeys, msg.String())
+		}
+		if m.isEditing {
+			return updateWhileEditing(m, msg)
+		}
+		if m.isTagging {
+			return updateWhileTagging(m, msg)
+		}
+		if m.isSavingSnippet {
+			return updateWhileSavingSnippet(m, msg)
+		}
+		if m.isFillingPlaceholders {
+			return updateWhileFillingPlaceholders(m, msg)
+		}
+		m.statusMessage = ""
+		if m.isPaletteOpen {
+			return updateWhilePaletteOpen(m, msg)
+		}
+		if m.isViewingEntry {
+			return updateWhileViewingEntry(m, msg)
+		}
+		if m.isCheatSheetOpen {
+			// Any key closes the cheat sheet without being handled, so that e.g. esc doesn't exit hishtory
+			m.isCheatSheetOpen = false
+			return m, nil
+		}
+		if macro := getTuiMacro(m.macros, msg.String()); macro != nil && !m.isReplayingMacro {
+			return replayMacro(m, *macro)
+		}
+		if m.search != nil && key.Matches(msg, keys.SelectEntry, keys.SelectEntryAndChangeDir, keys.DeleteEntry, keys.EditEntry, keys.EditSavedEntry, keys.ViewEntry, keys.TagEntry, keys.FillPlaceholders, keys.PinEntry) {
+			// These act on the highlighted entry, so they need the results for the current query
+			m = runQueryAndUpdateTable(m, false)
+		}
 		switch {
 		case key.Matches(msg, keys.Quit):
 			m.quitting = true
@@ -248,16 +644,48 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			return m, tea.Quit
 		case key.Matches(msg, keys.DeleteEntry):
+			if len(m.tableEntries) == 0 {
+				return m, nil
+			}
+			if !isSearchingHistory(m.ctx) {
+				m.statusMessage = "Only entries in your shell history can be deleted"
+				return m, nil
+			}
 			err := deleteHistoryEntry(m.ctx, *m.tableEntries[m.table.Cursor()])
 			if err != nil {
 				m.fatalErr = err
 				return m, nil
 			}
 			m = runQueryAndUpdateTable(m, true)
+			if GetDeletionGracePeriod(hctx.GetConf(m.ctx)) > 0 {
+				m.statusMessage = "Deleted the entry, press ctrl+z to undo"
+			}
 			return m, nil
+		case key.Matches(msg, keys.UndoDelete):
+			return undoDeletion(m)
+		case key.Matches(msg, keys.EditEntry):
+			if len(m.tableEntries) == 0 {
+				return m, nil
+			}
+			return startEditing(m)
+		case key.Matches(msg, keys.EditSavedEntry):
+			return startEditingEntry(m)
 		case key.Matches(msg, keys.Help):
 			m.help.ShowAll = !m.help.ShowAll
 			return m, nil
+		case key.Matches(msg, keys.OpenPalette):
+			return openPalette(m)
+		case key.Matches(msg, keys.ViewEntry):
+			return openEntryView(m)
+		case key.Matches(msg, keys.TagEntry):
+			return openTagPrompt(m)
+		case key.Matches(msg, keys.FillPlaceholders):
+			return startFillingPlaceholders(m)
+		case key.Matches(msg, keys.PinEntry):
+			return togglePinned(m)
+		case key.Matches(msg, keys.CheatSheet) && m.queryInput.Value() == "":
+			// ? is only bound when the query is empty, since otherwise it could be part of the query
+			return openCheatSheet(m)
 		default:
 			t, cmd1 := m.table.Update(msg)
 			m.table = t
@@ -267,14 +695,46 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			i, cmd2 := m.queryInput.Update(msg)
 			m.queryInput = i
 			searchQuery := m.queryInput.Value()
-			m.runQuery = &searchQuery
-			m = runQueryAndUpdateTable(m, false)
-			return m, tea.Batch(cmd1, cmd2)
+			if m.isReplayingMacro {
+				// The later keys of the macro may act on the results, so they are needed right away
+				m.runQuery = &searchQuery
+				return runQueryAndUpdateTable(m, false), tea.Batch(cmd1, cmd2)
+			}
+			m, cmd3 := searchInBackground(m, searchQuery)
+			return scrollResults(m), tea.Batch(cmd1, cmd2, cmd3)
 		}
 	case tea.WindowSizeMsg:
 		m.help.Width = msg.Width
+		m.terminalWidth = msg.Width
+		m.terminalHeight = msg.Height
+		// Keep the same entry highlighted, since the table is rebuilt for the new size
+		cursor := m.table.Cursor()
 		m = runQueryAndUpdateTable(m, true)
+		m.table.SetCursor(min(cursor, len(m.tableEntries)-1))
+		if m.isViewingEntry {
+			// Re-wrap the entry for the new width
+			m = resizeEntryView(m)
+		}
 		return m, nil
+	case editorFinishedMsg:
+		if msg.err != nil {
+			m.fatalErr = msg.err
+			return m, nil
+		}
+		if msg.entry != nil {
+			return saveEditedEntry(m, msg.entry, msg.command)
+		}
+		SELECTED_COMMAND = msg.command
+		m.selected = SelectedWithEdits
+		return m, tea.Quit
+	case searchResultsMsg:
+		if msg.search == nil || msg.search != m.search {
+			// The query changed again since this search started
+			return m, nil
+		}
+		m.search.cancel()
+		m.search = nil
+		return scrollResults(showSearchResults(m, msg, false)), nil
 	case offlineMsg:
 		m.isOffline = true
 		return m, nil
@@ -297,6 +757,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m model) View() string {
+	defer hctx.StartSpan("render")()
 	if m.fatalErr != nil {
 		return fmt.Sprintf("An unrecoverable error occured: %v\n", m.fatalErr)
 	}
@@ -308,6 +769,10 @@ func (m model) View() string {
 		}
 		return ""
 	}
+	if m.selected == SelectedWithEdits {
+		// SELECTED_COMMAND was already set when the edit was completed
+		return ""
+	}
 	if m.quitting {
 		return ""
 	}
@@ -323,38 +788,109 @@ func (m model) View() string {
 		warning += fmt.Sprintf("Warning: failed to search: %v\n\n", m.searchErr)
 	}
 	helpView := m.help.View(keys)
-	return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n", loadingMessage, warning, m.banner, m.queryInput.View(), baseStyle.Render(m.table.View())) + helpView
+	if m.queryStats != nil {
+		helpView = m.queryStats.String() + "\n" + helpView
+	}
+	switch m.macroState {
+	case recordingMacro:
+		warning += fmt.Sprintf("Recording a macro (%d keys so far), press ctrl+g to stop\n\n", len(m.macroKeys))
+	case namingMacro:
+		return fmt.Sprintf("\n%s\n%s%s\nMacro Name (enter to continue, esc to discard): %s\n%s\n\n%s\n", loadingMessage, warning, m.banner, m.macroNameInput.View(), m.macroMessage, getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	case bindingMacro:
+		return fmt.Sprintf("\n%s\n%s%s\nPress the key to run the macro %#v with (esc to discard)\n%s\n\n%s\n", loadingMessage, warning, m.banner, strings.TrimSpace(m.macroNameInput.Value()), m.macroMessage, getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	if m.macroMessage != "" {
+		warning += m.macroMessage + "\n\n"
+	}
+	if m.statusMessage != "" && !m.isTagging && !m.isSavingSnippet {
+		warning += m.statusMessage + "\n\n"
+	}
+	if m.isPaletteOpen {
+		return fmt.Sprintf("\n%s\n%s%s\nSearch Actions (enter to run, esc to cancel): %s\n\n%s\n", loadingMessage, warning, m.banner, m.paletteInput.View(), paletteView(m)) + helpView
+	}
+	if m.isViewingEntry {
+		return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n", loadingMessage, warning, m.banner, m.queryInput.View(), entryView(m)) + helpView
+	}
+	if m.isCheatSheetOpen {
+		return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n", loadingMessage, warning, m.banner, m.queryInput.View(), cheatSheetView(m)) + helpView
+	}
+	if m.isTagging {
+		return fmt.Sprintf("\n%s\n%s%s\n%s\n\n%s\n", loadingMessage, warning, m.banner, tagPromptView(m), getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	if m.isSavingSnippet {
+		return fmt.Sprintf("\n%s\n%s%s\n%s\n\n%s\n", loadingMessage, warning, m.banner, snippetPromptView(m), getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	if m.isFillingPlaceholders {
+		return fmt.Sprintf("\n%s\n%s%s\n%s\n\n%s\n", loadingMessage, warning, m.banner, placeholdersView(m), getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	if m.isEditing && m.editingEntry != nil {
+		return fmt.Sprintf("\n%s\n%s%s\nEdit Saved Command (enter to save, esc to cancel): %s\n\n%s\n", loadingMessage, warning, m.banner, m.editInput.View(), getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	if m.isEditing {
+		return fmt.Sprintf("\n%s\n%s%s\nEdit Command (enter to select, esc to cancel): %s\n\n%s\n", loadingMessage, warning, m.banner, m.editInput.View(), getBaseStyle(m.theme).Render(m.table.View())) + helpView
+	}
+	return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n%s", loadingMessage, warning, m.banner, m.queryInput.View(), getBaseStyle(m.theme).Render(m.table.View()), hiddenColumnsView(m)) + helpView
 }
 
 func getRows(ctx context.Context, columnNames []string, query string, numEntries int) ([]table.Row, []*data.HistoryEntry, error) {
-	db := hctx.GetDb(ctx)
-	config := hctx.GetConf(ctx)
-	searchResults, err := Search(ctx, db, query, numEntries)
+	page, err := getRowsPage(ctx, columnNames, query, searchCursor{}, numEntries, "")
 	if err != nil {
 		return nil, nil, err
 	}
-	var rows []table.Row
-	var filteredData []*data.HistoryEntry
-	lastCommand := ""
-	for i := 0; i < numEntries; i++ {
-		if i < len(searchResults) {
-			entry := searchResults[i]
-			if strings.TrimSpace(entry.Command) == strings.TrimSpace(lastCommand) && config.FilterDuplicateCommands {
-				continue
-			}
-			entry.Command = strings.ReplaceAll(entry.Command, "\n", "\\n")
-			row, err := buildTableRow(ctx, columnNames, *entry)
-			if err != nil {
-				return nil, nil, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
-			}
-			rows = append(rows, row)
-			filteredData = append(filteredData, entry)
-			lastCommand = entry.Command
-		} else {
-			rows = append(rows, table.Row{})
+	return padRows(page.rows, numEntries), page.entries, nil
+}
+
+// A rowsPage is a page of the results of a search, see getRowsPage
+type rowsPage struct {
+	rows    []table.Row
+	entries []*data.HistoryEntry
+	// Where the next page starts
+	next searchCursor
+	// Whether there may be more results after this page
+	hasMore bool
+}
+
+// getRowsPage returns the table rows for up to numEntries of the results of query that come after cursor. lastCommand
+// is the command of the last entry before cursor, so that duplicates are also filtered across pages.
+func getRowsPage(ctx context.Context, columnNames []string, query string, cursor searchCursor, numEntries int, lastCommand string) (rowsPage, error) {
+	config := hctx.GetConf(ctx)
+	searchResults, err := getResultsProvider(ctx).search(ctx, query, cursor, numEntries)
+	if err != nil {
+		return rowsPage{}, err
+	}
+	page := rowsPage{next: cursor, hasMore: len(searchResults) == numEntries}
+	page.next.Offset += len(searchResults)
+	if len(searchResults) > 0 {
+		page.next.After = searchResults[len(searchResults)-1]
+	}
+	for _, entry := range searchResults {
+		if strings.TrimSpace(entry.Command) == strings.TrimSpace(lastCommand) && config.FilterDuplicateCommands {
+			continue
+		}
+		// Multi-line commands are stored with their original line breaks, but are collapsed onto a single line
+		// in the table. The full command is still shown by keys.ViewEntry and is what gets selected.
+		displayedEntry := *entry
+		displayedEntry.Command = collapseNewlines(entry.Command)
+		row, err := buildTableRow(ctx, columnNames, displayedEntry)
+		if err != nil {
+			return rowsPage{}, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
+		}
+		for i := range row {
+			row[i] = truncateTableCell(row[i])
 		}
+		page.rows = append(page.rows, row)
+		page.entries = append(page.entries, entry)
+		lastCommand = entry.Command
+	}
+	return page, nil
+}
+
+// padRows pads rows with empty rows up to numRows rows
+func padRows(rows []table.Row, numRows int) []table.Row {
+	for len(rows) < numRows {
+		rows = append(rows, table.Row{})
 	}
-	return rows, filteredData, nil
+	return rows
 }
 
 func calculateColumnWidths(rows []table.Row, numColumns int) []int {
@@ -373,7 +909,10 @@ func getTerminalSize() (int, int, error) {
 
 var bigQueryResults []table.Row
 
-func makeTableColumns(ctx context.Context, columnNames []string, rows []table.Row) ([]table.Column, error) {
+// The columns that bigQueryResults was computed for, since they change if the terminal is resized
+var bigQueryColumns string
+
+func makeTableColumns(ctx context.Context, columnNames []string, rows []table.Row, terminalWidth int) ([]table.Column, error) {
 	// Handle an initial query with no results
 	if len(rows) == 0 || len(rows[0]) == 0 {
 		allRows, _, err := getRows(ctx, columnNames, "", 25)
@@ -389,7 +928,7 @@ func makeTableColumns(ctx context.Context, columnNames []string, rows []table.Ro
 			}
 			allRows = append(allRows, row)
 		}
-		return makeTableColumns(ctx, columnNames, allRows)
+		return makeTableColumns(ctx, columnNames, allRows, terminalWidth)
 	}
 
 	// Calculate the minimum amount of space that we need for each column for the current actual search
@@ -401,20 +940,17 @@ func makeTableColumns(ctx context.Context, columnNames []string, rows []table.Ro
 	}
 
 	// Calculate the maximum column width that is useful for each column if we search for the empty string
-	if bigQueryResults == nil {
+	if bigQueryResults == nil || bigQueryColumns != strings.Join(columnNames, "\x00") {
 		bigRows, _, err := getRows(ctx, columnNames, "", 1000)
 		if err != nil {
 			return nil, err
 		}
 		bigQueryResults = bigRows
+		bigQueryColumns = strings.Join(columnNames, "\x00")
 	}
 	maximumColumnWidths := calculateColumnWidths(bigQueryResults, len(columnNames))
 
-	// Get the actual terminal width. If we're below this, opportunistically add some padding aiming for the maximum column widths
-	terminalWidth, _, err := getTerminalSize()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get terminal size: %v", err)
-	}
+	// If we're below the terminal width, opportunistically add some padding aiming for the maximum column widths
 	for totalWidth < (terminalWidth - len(columnNames)) {
 		prevTotalWidth := totalWidth
 		for i := range columnNames {
@@ -438,6 +974,10 @@ func makeTableColumns(ctx context.Context, columnNames []string, rows []table.Ro
 				largestColumnSize = columnWidths[i]
 			}
 		}
+		if largestColumnSize <= minColumnWidth {
+			// Too many columns were configured to fit, getVisibleColumns should have hidden some of them
+			break
+		}
 		columnWidths[largestColumnIdx] -= 2
 		totalWidth -= 2
 	}
@@ -463,9 +1003,8 @@ func min(a, b int) int {
 	return b
 }
 
-func makeTable(ctx context.Context, rows []table.Row) (table.Model, error) {
-	config := hctx.GetConf(ctx)
-	columns, err := makeTableColumns(ctx, config.DisplayedColumns, rows)
+func makeTable(ctx context.Context, theme hctx.ThemeColors, columnNames []string, rows []table.Row, terminalWidth, terminalHeight int) (table.Model, error) {
+	columns, err := makeTableColumns(ctx, columnNames, rows, terminalWidth)
 	if err != nil {
 		return table.Model{}, err
 	}
@@ -485,11 +1024,8 @@ func makeTable(ctx context.Context, rows []table.Row) (table.Model, error) {
 		MoveLeft:  keys.TableLeft,
 		MoveRight: keys.TableRight,
 	}
-	_, terminalHeight, err := getTerminalSize()
-	if err != nil {
-		return table.Model{}, err
-	}
-	tableHeight := min(TABLE_HEIGHT, terminalHeight-12)
+	// Always show at least a few rows, even if that means scrolling on very short terminals
+	tableHeight := max(min(TABLE_HEIGHT, terminalHeight-12), 3)
 	t := table.New(
 		table.WithColumns(columns),
 		table.WithRows(rows),
@@ -501,55 +1037,163 @@ func makeTable(ctx context.Context, rows []table.Row) (table.Model, error) {
 	s := table.DefaultStyles()
 	s.Header = s.Header.
 		BorderStyle(lipgloss.NormalBorder()).
-		BorderForeground(lipgloss.Color("240")).
+		BorderForeground(lipgloss.Color(theme.Header)).
 		BorderBottom(true).
 		Bold(false)
 	s.Selected = s.Selected.
-		Foreground(lipgloss.Color("229")).
-		Background(lipgloss.Color("57")).
+		Foreground(lipgloss.Color(theme.SelectedForeground)).
+		Background(lipgloss.Color(theme.SelectedBackground)).
 		Bold(false)
+	s.Highlight = lipgloss.NewStyle().
+		Foreground(lipgloss.Color(theme.MatchHighlight)).
+		Bold(true)
 	t.SetStyles(s)
 	t.Focus()
 	return t, nil
 }
 
+func getHighlightTerms(theme hctx.ThemeColors, query string) []string {
+	if theme.MatchHighlight == "" {
+		return nil
+	}
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil
+	}
+	terms := make([]string, 0)
+	for _, token := range tokens {
+		// Only highlight plain search terms since negated terms and atoms don't correspond to a substring of the command
+		if token == "" || strings.HasPrefix(token, "-") || containsUnescaped(token, ":") {
+			continue
+		}
+		terms = append(terms, unescape(token))
+	}
+	return terms
+}
+
 func deleteHistoryEntry(ctx context.Context, entry data.HistoryEntry) error {
-	db := hctx.GetDb(ctx)
 	// Delete locally
-	r := db.Model(&data.HistoryEntry{}).Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Delete(&data.HistoryEntry{})
-	if r.Error != nil {
-		return r.Error
+	err := forEachTier(ctx, func(db *gorm.DB) error {
+		return RetryDbWrite(func() error {
+			return hctx.DeleteHistoryEntries(db.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime)).Error
+		})
+	})
+	if err != nil {
+		return err
 	}
-
-	// Delete remotely
-	config := hctx.GetConf(ctx)
-	if config.IsOffline {
-		return nil
+	if err := RecordAuditEvent(ctx, AuditActionDelete, "deleted 1 entry from the search TUI"); err != nil {
+		return err
 	}
-	dr := shared.DeletionRequest{
-		UserId:   data.UserId(hctx.GetConf(ctx).UserSecret),
-		SendTime: time.Now(),
+
+	// Keep it in the trash during the grace period so that it can be restored, and delete it remotely once the
+	// grace period is over
+	if GetDeletionGracePeriod(hctx.GetConf(ctx)) > 0 {
+		return trashEntry(ctx, entry)
 	}
-	dr.Messages.Ids = append(dr.Messages.Ids, shared.MessageIdentifier{Date: entry.EndTime, DeviceId: entry.DeviceId})
-	return SendDeletionRequest(dr)
+	return DeleteOnRemoteInstances(ctx, []*data.HistoryEntry{&entry})
 }
 
 func TuiQuery(ctx context.Context, initialQuery string) error {
-	lipgloss.SetColorProfile(termenv.ANSI)
-	rows, entries, err := getRows(ctx, hctx.GetConf(ctx).DisplayedColumns, initialQuery, PADDED_NUM_ENTRIES)
+	backend, err := GetSearchBackend(hctx.GetConf(ctx))
+	if err != nil {
+		return err
+	}
+	if _, isBuiltin := backend.(builtinTui); isBuiltin && !canRenderTui() {
+		return tuiFallback(ctx, initialQuery)
+	}
+	selected, err := backend.Search(ctx, initialQuery)
+	if err != nil {
+		return err
+	}
+	if selected == "" && os.Getenv("HISHTORY_TERM_INTEGRATION") != "" {
+		// Print out the initialQuery instead so that we don't clear the terminal
+		selected = initialQuery
+	}
+	fmt.Printf("%s\n", selected)
+	return nil
+}
+
+// builtinTui is the default SearchBackend which uses bubbletea to render a table of history entries
+type builtinTui struct{}
+
+func (b builtinTui) Search(ctx context.Context, initialQuery string) (string, error) {
+	lipgloss.SetColorProfile(getColorProfile())
+	theme, err := GetColorTheme(hctx.GetConf(ctx))
+	if err != nil {
+		return "", err
+	}
+	terminalWidth, terminalHeight, err := getTerminalSize()
+	if err != nil {
+		return "", fmt.Errorf("failed to get terminal size: %w", err)
+	}
+	columnNames, _ := getVisibleColumns(hctx.GetConf(ctx).DisplayedColumns, terminalWidth)
+	page, err := getRowsPage(ctx, columnNames, initialQuery, searchCursor{}, PADDED_NUM_ENTRIES, "")
 	if err != nil {
 		if initialQuery != "" {
 			// initialQuery is likely invalid in some way, let's just drop it
-			return TuiQuery(ctx, "")
+			return b.Search(ctx, "")
 		}
 		// Something else has gone wrong, crash
-		return err
+		return "", err
 	}
-	t, err := makeTable(ctx, rows)
+	t, err := makeTable(ctx, theme, columnNames, padRows(page.rows, PADDED_NUM_ENTRIES), terminalWidth, terminalHeight)
 	if err != nil {
-		return err
+		return "", err
 	}
-	p := tea.NewProgram(initialModel(ctx, t, entries, initialQuery), tea.WithOutput(os.Stderr))
+	t.SetHighlightTerms(getHighlightTerms(theme, initialQuery))
+	options := []tea.ProgramOption{tea.WithOutput(os.Stderr)}
+	if !isTerminal(os.Stdin) {
+		// stdin was used for something else (e.g. the candidates for `hishtory tquery --stdin`)
+		options = append(options, tea.WithInputTTY())
+	}
+	m := initialModel(ctx, theme, t, page.entries, initialQuery)
+	m.nextPage, m.hasMoreResults = page.next, page.hasMore
+	p := tea.NewProgram(m, options...)
+	if isSearchingHistory(ctx) {
+		syncInBackground(ctx, p)
+	} else {
+		// There aren't any entries to load from the backend
+		go p.Send(doneDownloadingMsg{})
+	}
+	// Blocking: Start the TUI
+	finalModel, err := p.Run()
+	if err != nil {
+		return "", err
+	}
+	recordSelectedEntryUsage(ctx, finalModel.(model))
+	return SELECTED_COMMAND, nil
+}
+
+// syncInBackground retrieves new entries, processes deletion requests, and checks for a banner from the backend
+// while the TUI is running
+func syncInBackground(ctx context.Context, p *tea.Program) {
+	if _, ok := getResultsProvider(ctx).(agentResultsProvider); ok {
+		// Async: Sync via the agent, which already has the DB open
+		go func() {
+			err := syncViaAgent(ctx)
+			if err != nil {
+				p.Send(err)
+			}
+			p.Send(doneDownloadingMsg{})
+		}()
+	} else {
+		syncDirectlyInBackground(ctx, p)
+	}
+	// Async: Check for any banner from the server
+	go func() {
+		banner, err := GetBanner(ctx)
+		if err != nil {
+			if IsOfflineError(err) {
+				p.Send(offlineMsg{})
+			} else {
+				p.Send(err)
+			}
+		}
+		p.Send(bannerMsg{banner: string(banner)})
+	}()
+}
+
+func syncDirectlyInBackground(ctx context.Context, p *tea.Program) {
 	// Async: Retrieve additional entries from the backend
 	go func() {
 		err := RetrieveAdditionalEntriesFromRemote(ctx)
@@ -565,29 +1209,6 @@ func TuiQuery(ctx context.Context, initialQuery string) error {
 			p.Send(err)
 		}
 	}()
-	// Async: Check for any banner from the server
-	go func() {
-		banner, err := GetBanner(ctx)
-		if err != nil {
-			if IsOfflineError(err) {
-				p.Send(offlineMsg{})
-			} else {
-				p.Send(err)
-			}
-		}
-		p.Send(bannerMsg{banner: string(banner)})
-	}()
-	// Blocking: Start the TUI
-	_, err = p.Run()
-	if err != nil {
-		return err
-	}
-	if SELECTED_COMMAND == "" && os.Getenv("HISHTORY_TERM_INTEGRATION") != "" {
-		// Print out the initialQuery instead so that we don't clear the terminal
-		SELECTED_COMMAND = initialQuery
-	}
-	fmt.Printf("%s\n", strings.ReplaceAll(SELECTED_COMMAND, "\\n", "\n"))
-	return nil
 }
 
 // TODO: support custom key bindings
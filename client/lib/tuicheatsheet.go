@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+func openCheatSheet(m model) (model, tea.Cmd) {
+	m.isCheatSheetOpen = true
+	return m, nil
+}
+
+// cheatSheetView renders every key binding and the filters that currently apply to the results. The bindings are
+// generated from keys and the user's macros so that the cheat sheet can't get out of sync with them.
+func cheatSheetView(m model) string {
+	type row struct {
+		key  string
+		desc string
+	}
+	var bindings []row
+	for _, column := range keys.FullHelp() {
+		for _, binding := range column {
+			if len(binding.Keys()) == 0 || binding.Keys()[0] == "" {
+				continue
+			}
+			bindings = append(bindings, row{strings.TrimSpace(binding.Help().Key), strings.TrimSpace(binding.Help().Desc)})
+		}
+	}
+	for _, macro := range m.macros {
+		bindings = append(bindings, row{macro.Key, fmt.Sprintf("run the %s macro (%s)", macro.Name, strings.Join(macro.Keys, " "))})
+	}
+	keyWidth := 0
+	for _, b := range bindings {
+		if lipgloss.Width(b.key) > keyWidth {
+			keyWidth = lipgloss.Width(b.key)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Keybindings:\n")
+	for _, b := range bindings {
+		sb.WriteString("  " + b.key + strings.Repeat(" ", keyWidth-lipgloss.Width(b.key)) + "  " + b.desc + "\n")
+	}
+	sb.WriteString("\nActive filters:\n")
+	filters := getActiveFilters(m)
+	if len(filters) == 0 {
+		sb.WriteString("  none\n")
+	}
+	for _, filter := range filters {
+		sb.WriteString("  " + filter + "\n")
+	}
+	sb.WriteString("\nPress any key to close")
+	return sb.String()
+}
+
+// getActiveFilters describes each filter that is applied to the results, both from the search query and from
+// the config
+func getActiveFilters(m model) []string {
+	filters := make([]string, 0)
+	tokens, err := tokenize(m.queryInput.Value())
+	if err == nil {
+		for _, token := range tokens {
+			if token == "" || token == "-" {
+				continue
+			}
+			excluded := strings.HasPrefix(token, "-")
+			term := strings.TrimPrefix(token, "-")
+			var filter string
+			if containsUnescaped(term, ":") {
+				splitToken := splitEscaped(term, ':', 2)
+				filter = fmt.Sprintf("%s is %#v", unescape(splitToken[0]), unescape(splitToken[1]))
+				if excluded {
+					filter = fmt.Sprintf("%s is not %#v", unescape(splitToken[0]), unescape(splitToken[1]))
+				}
+			} else {
+				filter = fmt.Sprintf("contains %#v", unescape(term))
+				if excluded {
+					filter = fmt.Sprintf("doesn't contain %#v", unescape(term))
+				}
+			}
+			filters = append(filters, filter)
+		}
+	}
+	config := hctx.GetConf(m.ctx)
+	if !containsToken(m.queryInput.Value(), disableDefaultFiltersAtom) {
+		for _, filter := range getActiveDefaultFilters(config, getFilteredFields(m.queryInput.Value())) {
+			filters = append(filters, fmt.Sprintf("%s (default filter)", filter))
+		}
+	}
+	if config.FilterDuplicateCommands {
+		filters = append(filters, "duplicate commands are hidden (filter-duplicate-commands)")
+	}
+	return filters
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mattn/go-runewidth"
+)
+
+// Table cells are truncated to this many bytes so that rendering a huge entry (e.g. a pasted script) doesn't
+// freeze the TUI. The full entry can still be viewed via keys.ViewEntry.
+const maxTableCellLength = 1024
+
+// The number of lines of the full entry view that are displayed at once
+const entryViewHeight = TABLE_HEIGHT
+
+func truncateTableCell(value string) string {
+	if len(value) <= maxTableCellLength {
+		return value
+	}
+	truncated := value[:maxTableCellLength]
+	for !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated + "…"
+}
+
+// collapseNewlines displays a multi-line command on a single line by replacing each line break with `\n`
+func collapseNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\\n")
+}
+
+// wrapLines splits s into lines that are at most width cells wide, breaking at the line breaks of multi-line
+// commands. Only the lines that are scrolled into view are rendered, so this is the only work that scales with
+// the size of the entry.
+func wrapLines(s string, width int) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		start := 0
+		lineWidth := 0
+		for i, r := range line {
+			w := runewidth.RuneWidth(r)
+			if lineWidth+w > width && i > start {
+				lines = append(lines, line[start:i])
+				start = i
+				lineWidth = 0
+			}
+			lineWidth += w
+		}
+		lines = append(lines, line[start:])
+	}
+	return lines
+}
+
+func openEntryView(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	entry := *m.tableEntries[m.table.Cursor()]
+	header, err := buildTableRow(m.ctx, []string{"Hostname", "CWD", "Timestamp", "Runtime", "Exit Code"}, entry)
+	if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	m.entryViewHeader = fmt.Sprintf("Host: %s   CWD: %s   Time: %s   Runtime: %s   Exit Code: %s", header[0], header[1], header[2], header[3], header[4])
+	m.entryViewLines = wrapLines(entry.Command, entryViewWidth(m))
+	m.entryViewOffset = 0
+	m.isViewingEntry = true
+	return m, nil
+}
+
+func entryViewWidth(m model) int {
+	if m.help.Width <= 0 {
+		return 100
+	}
+	return m.help.Width
+}
+
+// resizeEntryView re-wraps the entry that is being viewed after the terminal is resized
+func resizeEntryView(m model) model {
+	if len(m.tableEntries) == 0 {
+		m.isViewingEntry = false
+		m.entryViewLines = nil
+		return m
+	}
+	m.entryViewLines = wrapLines(m.tableEntries[m.table.Cursor()].Command, entryViewWidth(m))
+	m.entryViewOffset = min(m.entryViewOffset, max(len(m.entryViewLines)-entryViewHeight, 0))
+	return m
+}
+
+func updateWhileViewingEntry(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	maxOffset := max(len(m.entryViewLines)-entryViewHeight, 0)
+	switch {
+	case msg.String() == "esc" || key.Matches(msg, keys.ViewEntry):
+		m.isViewingEntry = false
+		m.entryViewLines = nil
+	case key.Matches(msg, keys.Up):
+		m.entryViewOffset = max(m.entryViewOffset-1, 0)
+	case key.Matches(msg, keys.Down):
+		m.entryViewOffset = min(m.entryViewOffset+1, maxOffset)
+	case key.Matches(msg, keys.PageUp):
+		m.entryViewOffset = max(m.entryViewOffset-entryViewHeight, 0)
+	case key.Matches(msg, keys.PageDown):
+		m.entryViewOffset = min(m.entryViewOffset+entryViewHeight, maxOffset)
+	case msg.String() == "home":
+		m.entryViewOffset = 0
+	case msg.String() == "end":
+		m.entryViewOffset = maxOffset
+	case key.Matches(msg, keys.SelectEntry):
+		m.isViewingEntry = false
+		m.entryViewLines = nil
+		return m.Update(msg)
+	}
+	return m, nil
+}
+
+func entryView(m model) string {
+	end := min(m.entryViewOffset+entryViewHeight, len(m.entryViewLines))
+	var sb strings.Builder
+	sb.WriteString(m.entryViewHeader + "\n\n")
+	for _, line := range m.entryViewLines[m.entryViewOffset:end] {
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString(fmt.Sprintf("\nLines %d-%d of %d (↑/↓/pgup/pgdn to scroll, enter to select, esc to close)", m.entryViewOffset+1, end, len(m.entryViewLines)))
+	return sb.String()
+}
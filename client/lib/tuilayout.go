@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Below this terminal width, only the Command column is displayed
+const singleColumnTerminalWidth = 50
+
+// The narrowest that columns are shrunk to before low-priority columns are hidden instead
+const (
+	minColumnWidth        = 8
+	minCommandColumnWidth = 20
+)
+
+// The order in which columns are kept when the terminal is too narrow to display all of them, most important
+// first. Columns that aren't listed (e.g. custom columns) are hidden before any of these.
+var columnPriorities = []string{"Command", "CWD", "Timestamp", "Hostname", "Exit Code", "Runtime"}
+
+func columnPriority(column string) int {
+	for i, c := range columnPriorities {
+		if c == column {
+			return i
+		}
+	}
+	return len(columnPriorities)
+}
+
+// getVisibleColumns returns which of the given columns fit in a terminal of the given width, in their original
+// order, along with the columns that were hidden. A terminalWidth of 0 means that the width is unknown, in which
+// case every column is displayed.
+func getVisibleColumns(columnNames []string, terminalWidth int) (visible, hidden []string) {
+	if terminalWidth <= 0 || len(columnNames) <= 1 {
+		return columnNames, nil
+	}
+	byPriority := make([]int, len(columnNames))
+	for i := range columnNames {
+		byPriority[i] = i
+	}
+	// Sort by priority, and then right to left so that later columns are hidden first
+	sort.SliceStable(byPriority, func(i, j int) bool {
+		pi, pj := columnPriority(columnNames[byPriority[i]]), columnPriority(columnNames[byPriority[j]])
+		if pi != pj {
+			return pi < pj
+		}
+		return byPriority[i] < byPriority[j]
+	})
+
+	isVisible := make([]bool, len(columnNames))
+	// The table border takes up 2 columns, and each cell is padded by 1 on either side
+	usedWidth := 2
+	for n, i := range byPriority {
+		width := minColumnWidth
+		if columnNames[i] == "Command" {
+			width = minCommandColumnWidth
+		}
+		if n > 0 && (terminalWidth < singleColumnTerminalWidth || usedWidth+width+2 > terminalWidth) {
+			break
+		}
+		isVisible[i] = true
+		usedWidth += width + 2
+	}
+	for i, column := range columnNames {
+		if isVisible[i] {
+			visible = append(visible, column)
+		} else {
+			hidden = append(hidden, column)
+		}
+	}
+	return visible, hidden
+}
+
+// getTableColumns returns the configured columns that fit in the terminal
+func getTableColumns(m model) []string {
+	visible, _ := getVisibleColumns(hctx.GetConf(m.ctx).DisplayedColumns, m.terminalWidth)
+	return visible
+}
+
+// hiddenColumnsView renders the values of the columns that don't fit in the terminal for the highlighted entry,
+// stacked below the table, so that no information is lost on narrow terminals
+func hiddenColumnsView(m model) string {
+	_, hidden := getVisibleColumns(hctx.GetConf(m.ctx).DisplayedColumns, m.terminalWidth)
+	if len(hidden) == 0 || len(m.tableEntries) == 0 || m.table.Cursor() < 0 || m.table.Cursor() >= len(m.tableEntries) {
+		return ""
+	}
+	values, err := buildTableRow(m.ctx, hidden, *m.tableEntries[m.table.Cursor()])
+	if err != nil {
+		return ""
+	}
+	fields := make([]string, 0, len(hidden))
+	for i, column := range hidden {
+		fields = append(fields, column+": "+values[i])
+	}
+	return strings.Join(wrapLines(truncateTableCell(strings.Join(fields, "  ")), m.terminalWidth), "\n") + "\n"
+}
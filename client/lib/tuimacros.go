@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+type macroState int
+
+const (
+	notRecordingMacro macroState = iota
+	// Key presses are being recorded into model.macroKeys
+	recordingMacro
+	// Recording finished and the user is entering a name for the macro
+	namingMacro
+	// The user is pressing the key to bind the macro to
+	bindingMacro
+)
+
+// The names of all keys that bubbletea represents with a KeyType rather than with runes, e.g. "ctrl+k" or "down"
+var namedKeys = func() map[string]tea.KeyType {
+	names := make(map[string]tea.KeyType)
+	for kt := tea.KeyType(-128); kt <= 127; kt++ {
+		if name := kt.String(); name != "" && kt != tea.KeyRunes {
+			if _, ok := names[name]; !ok {
+				names[name] = kt
+			}
+		}
+	}
+	return names
+}()
+
+// parseKeyMsg is the inverse of tea.KeyMsg.String(), used for replaying recorded macros
+func parseKeyMsg(s string) (tea.KeyMsg, error) {
+	if s == "" {
+		return tea.KeyMsg{}, fmt.Errorf("invalid empty key")
+	}
+	k := tea.Key{}
+	if strings.HasPrefix(s, "alt+") && len(s) > len("alt+") {
+		k.Alt = true
+		s = strings.TrimPrefix(s, "alt+")
+	}
+	if kt, ok := namedKeys[s]; ok {
+		k.Type = kt
+		if kt == tea.KeySpace {
+			// Like bubbletea, include the rune so that text inputs insert the space
+			k.Runes = []rune{' '}
+		}
+	} else {
+		k.Type = tea.KeyRunes
+		k.Runes = []rune(s)
+	}
+	return tea.KeyMsg(k), nil
+}
+
+// validateMacroKey checks whether a macro can be bound to the given key without breaking the TUI
+func validateMacroKey(k string) error {
+	msg, err := parseKeyMsg(k)
+	if err != nil {
+		return err
+	}
+	if (msg.Type == tea.KeyRunes && !msg.Alt) || msg.Type == tea.KeySpace || msg.Type == tea.KeyBackspace {
+		return fmt.Errorf("%#v can't be bound to a macro since it is used for typing queries, try a key like alt+1 or f2", k)
+	}
+	for _, binding := range []key.Binding{keys.Up, keys.Down, keys.PageUp, keys.PageDown, keys.SelectEntry, keys.SelectEntryAndChangeDir, keys.Left, keys.Right, keys.TableLeft, keys.TableRight, keys.DeleteEntry, keys.UndoDelete, keys.EditEntry, keys.EditSavedEntry, keys.RecordMacro, keys.OpenPalette, keys.Help, keys.Quit} {
+		if key.Matches(msg, binding) {
+			return fmt.Errorf("%#v can't be bound to a macro since it is already bound to %#v", k, strings.TrimSpace(binding.Help().Desc))
+		}
+	}
+	return nil
+}
+
+// SaveTuiMacro persists the given macro, replacing any existing macro with the same name or key
+func SaveTuiMacro(macro hctx.TuiMacro) error {
+	if err := validateMacroKey(macro.Key); err != nil {
+		return err
+	}
+	for _, k := range macro.Keys {
+		if _, err := parseKeyMsg(k); err != nil {
+			return err
+		}
+	}
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		macros := make([]hctx.TuiMacro, 0, len(config.TuiMacros)+1)
+		for _, m := range config.TuiMacros {
+			if m.Name != macro.Name && m.Key != macro.Key {
+				macros = append(macros, m)
+			}
+		}
+		config.TuiMacros = append(macros, macro)
+	})
+}
+
+func getTuiMacro(macros []hctx.TuiMacro, k string) *hctx.TuiMacro {
+	for i := range macros {
+		if macros[i].Key == k {
+			return &macros[i]
+		}
+	}
+	return nil
+}
+
+// updateWhileSavingMacro handles key presses while the user is naming a just-recorded macro or binding it to a key
+func updateWhileSavingMacro(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		// Discard the macro and go back to searching
+		m = stopSavingMacro(m)
+		m.macroMessage = "Discarded the macro"
+		return m, nil
+	}
+	if m.macroState == namingMacro {
+		if msg.String() != "enter" {
+			var cmd tea.Cmd
+			m.macroNameInput, cmd = m.macroNameInput.Update(msg)
+			return m, cmd
+		}
+		if strings.TrimSpace(m.macroNameInput.Value()) == "" {
+			m.macroMessage = "The macro name can't be empty"
+			return m, nil
+		}
+		m.macroState = bindingMacro
+		m.macroMessage = ""
+		return m, nil
+	}
+	macro := hctx.TuiMacro{Name: strings.TrimSpace(m.macroNameInput.Value()), Key: msg.String(), Keys: m.macroKeys}
+	if err := SaveTuiMacro(macro); err != nil {
+		// Let the user try a different key
+		m.macroMessage = err.Error()
+		return m, nil
+	}
+	replaced := false
+	for i := range m.macros {
+		if m.macros[i].Name == macro.Name || m.macros[i].Key == macro.Key {
+			m.macros[i] = macro
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		m.macros = append(m.macros, macro)
+	}
+	m = stopSavingMacro(m)
+	m.macroMessage = fmt.Sprintf("Saved the macro %#v, press %s to run it", macro.Name, macro.Key)
+	return m, nil
+}
+
+func stopSavingMacro(m model) model {
+	m.macroState = notRecordingMacro
+	m.macroKeys = nil
+	m.macroNameInput.Blur()
+	m.macroNameInput.SetValue("")
+	m.queryInput.Focus()
+	return m
+}
+
+// toggleMacroRecording starts recording a macro, or stops recording and prompts for the macro's name
+func toggleMacroRecording(m model) (model, tea.Cmd) {
+	if m.macroState != recordingMacro {
+		m.macroState = recordingMacro
+		m.macroKeys = make([]string, 0)
+		m.macroMessage = ""
+		return m, nil
+	}
+	if len(m.macroKeys) == 0 {
+		m.macroState = notRecordingMacro
+		m.macroMessage = "Discarded the empty macro"
+		return m, nil
+	}
+	m.macroState = namingMacro
+	m.queryInput.Blur()
+	m.macroNameInput.Focus()
+	return m, textinput.Blink
+}
+
+// replayMacro runs each of the macro's key presses through Update, stopping early if one of them exits the TUI
+func replayMacro(m model, macro hctx.TuiMacro) (tea.Model, tea.Cmd) {
+	m.isReplayingMacro = true
+	cmds := make([]tea.Cmd, 0, len(macro.Keys))
+	for _, k := range macro.Keys {
+		msg, err := parseKeyMsg(k)
+		if err != nil {
+			m.macroMessage = fmt.Sprintf("Failed to run the macro %#v: %v", macro.Name, err)
+			break
+		}
+		updated, cmd := m.Update(msg)
+		m = updated.(model)
+		cmds = append(cmds, cmd)
+		if m.quitting || m.selected != NotSelected || m.fatalErr != nil {
+			break
+		}
+	}
+	m.isReplayingMacro = false
+	return m, tea.Batch(cmds...)
+}
@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The maximum number of commands displayed in the command palette at once
+const maxPaletteResults = 10
+
+// A paletteCommand is an action that can be run from the TUI's command palette
+type paletteCommand struct {
+	name string
+	// The key bound to the command, if any, displayed so that users can learn the bindings
+	key string
+	run func(m model) (tea.Model, tea.Cmd)
+}
+
+// getPaletteCommands returns every action that can be run from the command palette. Actions that have a key
+// binding are run by simulating the key press, so that the palette and the key bindings can never diverge.
+func getPaletteCommands(m model) []paletteCommand {
+	pressKey := func(binding key.Binding) func(m model) (tea.Model, tea.Cmd) {
+		return func(m model) (tea.Model, tea.Cmd) {
+			msg, err := parseKeyMsg(binding.Keys()[0])
+			if err != nil {
+				m.fatalErr = err
+				return m, nil
+			}
+			return m.Update(msg)
+		}
+	}
+	commands := []paletteCommand{}
+	for _, binding := range []key.Binding{keys.SelectEntry, keys.SelectEntryAndChangeDir, keys.EditEntry, keys.EditSavedEntry, keys.FillPlaceholders, keys.ViewEntry, keys.TagEntry, keys.PinEntry, keys.DeleteEntry, keys.UndoDelete, keys.RecordMacro, keys.TableLeft, keys.TableRight, keys.Help, keys.Quit} {
+		commands = append(commands, paletteCommand{
+			name: capitalize(strings.TrimSpace(binding.Help().Desc)),
+			key:  binding.Help().Key,
+			run:  pressKey(binding),
+		})
+	}
+
+	commands = append(commands, paletteCommand{
+		name: capitalize(strings.TrimSpace(keys.CheatSheet.Help().Desc)),
+		key:  keys.CheatSheet.Help().Key,
+		run: func(m model) (tea.Model, tea.Cmd) {
+			return openCheatSheet(m)
+		},
+	})
+
+	commands = append(commands, paletteCommand{
+		name: "Save the highlighted entry as a snippet",
+		run: func(m model) (tea.Model, tea.Cmd) {
+			return openSnippetPrompt(m)
+		},
+	})
+
+	config := hctx.GetConf(m.ctx)
+	commands = append(commands,
+		paletteCommand{
+			name: toggleName(config.FilterDuplicateCommands, "filtering out duplicate commands"),
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					config.FilterDuplicateCommands = !config.FilterDuplicateCommands
+				})
+			},
+		},
+		paletteCommand{
+			name: toggleName(config.DisplayDeviceHostname, "displaying each device's current hostname"),
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					config.DisplayDeviceHostname = !config.DisplayDeviceHostname
+				})
+			},
+		},
+		paletteCommand{
+			name: toggleName(config.SortByFrecency, "sorting results by frecency"),
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					config.SortByFrecency = !config.SortByFrecency
+				})
+			},
+		},
+		paletteCommand{
+			name: toggleName(config.DisplayQueryStats, "displaying the number of matches and query time"),
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					config.DisplayQueryStats = !config.DisplayQueryStats
+				})
+			},
+		},
+	)
+	columnNames := append([]string{}, builtinColumnNames...)
+	for _, cc := range config.CustomColumns {
+		columnNames = append(columnNames, cc.ColumnName)
+	}
+	for _, column := range columnNames {
+		column := column
+		isDisplayed := false
+		for _, c := range config.DisplayedColumns {
+			if c == column {
+				isDisplayed = true
+			}
+		}
+		name := "Show the " + column + " column"
+		if isDisplayed {
+			name = "Hide the " + column + " column"
+		}
+		commands = append(commands, paletteCommand{
+			name: name,
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					columns := make([]string, 0, len(config.DisplayedColumns))
+					for _, c := range config.DisplayedColumns {
+						if c != column {
+							columns = append(columns, c)
+						}
+					}
+					if len(columns) == len(config.DisplayedColumns) {
+						columns = append(columns, column)
+					}
+					config.DisplayedColumns = columns
+				})
+			},
+		})
+	}
+	for _, theme := range GetColorThemeNames() {
+		theme := theme
+		commands = append(commands, paletteCommand{
+			name: "Use the " + theme + " color theme",
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return updateConfigFromTui(m, func(config *hctx.ClientConfig) {
+					config.ColorTheme = theme
+				})
+			},
+		})
+	}
+	for _, macro := range m.macros {
+		macro := macro
+		commands = append(commands, paletteCommand{
+			name: "Run the " + macro.Name + " macro",
+			key:  macro.Key,
+			run: func(m model) (tea.Model, tea.Cmd) {
+				return replayMacro(m, macro)
+			},
+		})
+	}
+	return commands
+}
+
+func toggleName(isEnabled bool, setting string) string {
+	if isEnabled {
+		return "Stop " + setting
+	}
+	return "Start " + setting
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// updateConfigFromTui persists a change to the config and re-renders the TUI with the new config
+func updateConfigFromTui(m model, update func(config *hctx.ClientConfig)) (tea.Model, tea.Cmd) {
+	var updated hctx.ClientConfig
+	err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		update(config)
+		updated = *config
+	})
+	if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	m.ctx = hctx.WithConf(m.ctx, updated)
+	theme, err := GetColorTheme(updated)
+	if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	m.theme = theme
+	return runQueryAndUpdateTable(m, true), nil
+}
+
+// fuzzyScore returns how well query matches target, or false if the characters of query don't all appear in
+// target in order. Matches at the start of words and consecutive matches score higher.
+func fuzzyScore(query, target string) (int, bool) {
+	query = strings.ToLower(strings.ReplaceAll(query, " ", ""))
+	target = strings.ToLower(target)
+	score := 0
+	lastMatch := -2
+	t := []rune(target)
+	ti := 0
+	for _, qc := range query {
+		found := false
+		for ; ti < len(t); ti++ {
+			if t[ti] != qc {
+				continue
+			}
+			score++
+			if ti == lastMatch+1 {
+				score += 2
+			}
+			if ti == 0 || t[ti-1] == ' ' {
+				score += 3
+			}
+			lastMatch = ti
+			ti++
+			found = true
+			break
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+// filterPaletteCommands returns the commands matching query, best matches first
+func filterPaletteCommands(commands []paletteCommand, query string) []paletteCommand {
+	type scoredCommand struct {
+		command paletteCommand
+		score   int
+	}
+	scored := make([]scoredCommand, 0, len(commands))
+	for _, c := range commands {
+		if score, ok := fuzzyScore(query, c.name); ok {
+			scored = append(scored, scoredCommand{c, score})
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+	filtered := make([]paletteCommand, 0, len(scored))
+	for _, s := range scored {
+		filtered = append(filtered, s.command)
+	}
+	return filtered
+}
+
+func openPalette(m model) (model, tea.Cmd) {
+	m.isPaletteOpen = true
+	m.paletteCursor = 0
+	m.paletteInput.SetValue("")
+	m.queryInput.Blur()
+	m.paletteInput.Focus()
+	return m, textinput.Blink
+}
+
+func closePalette(m model) model {
+	m.isPaletteOpen = false
+	m.paletteInput.Blur()
+	m.queryInput.Focus()
+	return m
+}
+
+func updateWhilePaletteOpen(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	matches := filterPaletteCommands(getPaletteCommands(m), m.paletteInput.Value())
+	switch {
+	case msg.String() == "esc" || key.Matches(msg, keys.OpenPalette):
+		return closePalette(m), nil
+	case msg.String() == "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	case key.Matches(msg, keys.Up):
+		if m.paletteCursor > 0 {
+			m.paletteCursor--
+		}
+		return m, nil
+	case key.Matches(msg, keys.Down):
+		if m.paletteCursor < min(len(matches), maxPaletteResults)-1 {
+			m.paletteCursor++
+		}
+		return m, nil
+	case msg.String() == "enter":
+		if len(matches) == 0 {
+			return m, nil
+		}
+		return matches[m.paletteCursor].run(closePalette(m))
+	default:
+		var cmd tea.Cmd
+		m.paletteInput, cmd = m.paletteInput.Update(msg)
+		m.paletteCursor = 0
+		return m, cmd
+	}
+}
+
+func paletteView(m model) string {
+	matches := filterPaletteCommands(getPaletteCommands(m), m.paletteInput.Value())
+	var sb strings.Builder
+	for i, c := range matches {
+		if i >= maxPaletteResults {
+			sb.WriteString(fmt.Sprintf("  ... and %d more\n", len(matches)-maxPaletteResults))
+			break
+		}
+		cursor := "  "
+		if i == m.paletteCursor {
+			cursor = "> "
+		}
+		sb.WriteString(cursor + c.name)
+		if c.key != "" {
+			sb.WriteString(" (" + strings.TrimSpace(c.key) + ")")
+		}
+		sb.WriteString("\n")
+	}
+	if len(matches) == 0 {
+		sb.WriteString("  No matching commands\n")
+	}
+	return sb.String()
+}
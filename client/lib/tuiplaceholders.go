@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// The patterns for the parts of a command that are likely to change when it is re-run, in order of priority for
+// when they overlap (e.g. a path that contains a UUID)
+var placeholderRegexes = []*regexp.Regexp{
+	// UUIDs
+	regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`),
+	// IPv4 addresses, with an optional port or CIDR suffix
+	regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}(?::[0-9]{1,5}|/[0-9]{1,2})?\b`),
+	// Paths that are absolute, relative to the home directory, or explicitly relative to the current directory
+	regexp.MustCompile(`(?:^|[\s=:'"])((?:~|\.{1,2})?/[^\s'"|;&<>()]*)`),
+}
+
+// A placeholder is a part of a command that can be filled in before the command is selected
+type placeholder struct {
+	// The byte offsets of the placeholder in the command
+	start, end int
+	// The value that the placeholder is replaced with, or "" to keep the original value
+	value string
+}
+
+// findPlaceholders returns the parts of command that are likely to change when it is re-run (IP addresses, UUIDs
+// and file paths), in the order that they appear in the command
+func findPlaceholders(command string) []placeholder {
+	var placeholders []placeholder
+	overlaps := func(start, end int) bool {
+		for _, p := range placeholders {
+			if start < p.end && p.start < end {
+				return true
+			}
+		}
+		return false
+	}
+	for _, re := range placeholderRegexes {
+		for _, match := range re.FindAllStringSubmatchIndex(command, -1) {
+			start, end := match[0], match[1]
+			if len(match) > 2 {
+				// Only use the capture group, so that the preceding delimiter isn't part of the placeholder
+				start, end = match[2], match[3]
+			}
+			// A lone / (e.g. in `du -sh /`) isn't worth filling in
+			if end-start <= 1 || overlaps(start, end) {
+				continue
+			}
+			placeholders = append(placeholders, placeholder{start: start, end: end})
+		}
+	}
+	sort.Slice(placeholders, func(i, j int) bool {
+		return placeholders[i].start < placeholders[j].start
+	})
+	return placeholders
+}
+
+// fillPlaceholders returns command with each placeholder replaced by its value
+func fillPlaceholders(command string, placeholders []placeholder) string {
+	var sb strings.Builder
+	prevEnd := 0
+	for _, p := range placeholders {
+		sb.WriteString(command[prevEnd:p.start])
+		if p.value == "" {
+			sb.WriteString(command[p.start:p.end])
+		} else {
+			sb.WriteString(p.value)
+		}
+		prevEnd = p.end
+	}
+	sb.WriteString(command[prevEnd:])
+	return sb.String()
+}
+
+func startFillingPlaceholders(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	command := m.tableEntries[m.table.Cursor()].Command
+	placeholders := findPlaceholders(command)
+	if len(placeholders) == 0 {
+		m.statusMessage = "The highlighted entry doesn't contain any placeholders (IP addresses, UUIDs or file paths) to fill in"
+		return m, nil
+	}
+	m.isFillingPlaceholders = true
+	m.placeholderCommand = command
+	m.placeholders = placeholders
+	m.queryInput.Blur()
+	m.placeholderInput.Focus()
+	m = showPlaceholder(m, 0)
+	return m, textinput.Blink
+}
+
+// showPlaceholder saves the value of the placeholder that is being filled in, and then switches to the placeholder
+// at index idx (wrapping around at either end)
+func showPlaceholder(m model, idx int) model {
+	if m.placeholderIndex < len(m.placeholders) {
+		m.placeholders[m.placeholderIndex].value = m.placeholderInput.Value()
+	}
+	m.placeholderIndex = (idx + len(m.placeholders)) % len(m.placeholders)
+	p := m.placeholders[m.placeholderIndex]
+	m.placeholderInput.Placeholder = m.placeholderCommand[p.start:p.end]
+	m.placeholderInput.SetValue(p.value)
+	m.placeholderInput.CursorEnd()
+	return m
+}
+
+func stopFillingPlaceholders(m model) model {
+	m.isFillingPlaceholders = false
+	m.placeholders = nil
+	m.placeholderIndex = 0
+	m.placeholderInput.Blur()
+	m.queryInput.Focus()
+	return m
+}
+
+// updateWhileFillingPlaceholders handles key presses while filling in the placeholders of the highlighted entry.
+// Tab and shift+tab cycle through the placeholders, and placeholders that are left empty keep their original value.
+func updateWhileFillingPlaceholders(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "tab":
+		return showPlaceholder(m, m.placeholderIndex+1), nil
+	case "shift+tab":
+		return showPlaceholder(m, m.placeholderIndex-1), nil
+	case "enter":
+		m = showPlaceholder(m, m.placeholderIndex)
+		SELECTED_COMMAND = fillPlaceholders(m.placeholderCommand, m.placeholders)
+		m.selected = SelectedWithEdits
+		return m, tea.Quit
+	case "esc":
+		return stopFillingPlaceholders(m), nil
+	case "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.placeholderInput, cmd = m.placeholderInput.Update(msg)
+		return m, cmd
+	}
+}
+
+func placeholdersView(m model) string {
+	// Show the command as it will be selected, with the placeholder that is being filled in highlighted
+	placeholders := append([]placeholder{}, m.placeholders...)
+	placeholders[m.placeholderIndex].value = m.placeholderInput.Value()
+	highlight := lipgloss.NewStyle().Reverse(true)
+	var sb strings.Builder
+	prevEnd := 0
+	for i, p := range placeholders {
+		sb.WriteString(m.placeholderCommand[prevEnd:p.start])
+		value := p.value
+		if value == "" {
+			value = m.placeholderCommand[p.start:p.end]
+		}
+		if i == m.placeholderIndex {
+			value = highlight.Render(value)
+		}
+		sb.WriteString(value)
+		prevEnd = p.end
+	}
+	sb.WriteString(m.placeholderCommand[prevEnd:])
+	return fmt.Sprintf("Fill In Placeholder %d/%d (tab for the next one, enter to select, esc to cancel): %s\nCommand: %s", m.placeholderIndex+1, len(m.placeholders), m.placeholderInput.View(), collapseNewlines(sb.String()))
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// A resultsProvider supplies the entries that the TUI (and the other pickers built on getRows) search through. This
+// is the local DB by default, but other tools can reuse the TUI to pick from their own candidates via
+// `hishtory tquery --stdin`.
+type resultsProvider interface {
+	// search returns up to limit of the entries matching query that come after cursor, in the order that they should
+	// be displayed. Fewer than limit entries are only returned once there are no more matching entries.
+	search(ctx context.Context, query string, cursor searchCursor, limit int) ([]*data.HistoryEntry, error)
+	// count returns the total number of entries matching query
+	count(ctx context.Context, query string) (int64, error)
+}
+
+// dbResultsProvider searches the shell history in the local DB
+type dbResultsProvider struct{}
+
+func (p dbResultsProvider) search(ctx context.Context, query string, cursor searchCursor, limit int) ([]*data.HistoryEntry, error) {
+	config := hctx.GetConf(ctx)
+	return searchPage(ctx, hctx.GetDb(ctx), applyDefaultFilters(config, query), limit, getTuiOrder(config, time.Now()), cursor)
+}
+
+func (p dbResultsProvider) count(ctx context.Context, query string) (int64, error) {
+	return CountSearchResults(ctx, hctx.GetDb(ctx), applyDefaultFilters(hctx.GetConf(ctx), query))
+}
+
+// candidateResultsProvider searches a fixed list of commands (e.g. read from stdin) rather than the shell history.
+// Since the candidates don't have any metadata, only plain search terms (and excluded terms) are supported.
+type candidateResultsProvider struct {
+	candidates []*data.HistoryEntry
+}
+
+func (p candidateResultsProvider) search(ctx context.Context, query string, cursor searchCursor, limit int) ([]*data.HistoryEntry, error) {
+	matches, err := p.match(query)
+	if err != nil {
+		return nil, err
+	}
+	matches = matches[min(cursor.Offset, len(matches)):]
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+func (p candidateResultsProvider) count(ctx context.Context, query string) (int64, error) {
+	matches, err := p.match(query)
+	return int64(len(matches)), err
+}
+
+// match returns the candidates that contain every search term in query (ignoring case, like the DB search) and
+// none of the excluded terms, in their original order
+func (p candidateResultsProvider) match(query string) ([]*data.HistoryEntry, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize query: %w", err)
+	}
+	var included, excluded []string
+	for _, token := range tokens {
+		if token == "" || token == "-" {
+			continue
+		}
+		if containsUnescaped(token, ":") {
+			return nil, fmt.Errorf("search atoms like %#v aren't supported when picking from stdin", token)
+		}
+		if strings.HasPrefix(token, "-") {
+			excluded = append(excluded, strings.ToLower(unescape(token[1:])))
+		} else {
+			included = append(included, strings.ToLower(unescape(token)))
+		}
+	}
+	matches := make([]*data.HistoryEntry, 0)
+	for _, candidate := range p.candidates {
+		command := strings.ToLower(candidate.Command)
+		isMatch := true
+		for _, term := range included {
+			isMatch = isMatch && strings.Contains(command, term)
+		}
+		for _, term := range excluded {
+			isMatch = isMatch && !strings.Contains(command, term)
+		}
+		if isMatch {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches, nil
+}
+
+type resultsProviderKey struct{}
+
+func withResultsProvider(ctx context.Context, provider resultsProvider) context.Context {
+	return context.WithValue(ctx, resultsProviderKey{}, provider)
+}
+
+func getResultsProvider(ctx context.Context) resultsProvider {
+	if provider, ok := ctx.Value(resultsProviderKey{}).(resultsProvider); ok {
+		return provider
+	}
+	return dbResultsProvider{}
+}
+
+// isSearchingHistory returns whether the entries being searched are from the shell history, rather than candidates
+// from another tool. Actions that modify history entries (e.g. deleting or tagging them) are only supported for
+// the shell history.
+func isSearchingHistory(ctx context.Context) bool {
+	switch getResultsProvider(ctx).(type) {
+	case dbResultsProvider, agentResultsProvider:
+		return true
+	default:
+		return false
+	}
+}
+
+// readCandidates reads the candidates for `hishtory tquery --stdin`, one command per line. Empty lines are skipped.
+func readCandidates(r io.Reader) ([]*data.HistoryEntry, error) {
+	candidates := make([]*data.HistoryEntry, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		candidates = append(candidates, &data.HistoryEntry{Command: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read candidates: %w", err)
+	}
+	return candidates, nil
+}
+
+// TuiPickFromCandidates runs the TUI over the commands read from r (one per line) rather than over the shell
+// history, and returns the selected command or an empty string if nothing was selected. This lets other tools
+// reuse hishtory's picker. Since r is usually stdin, the TUI reads keys from the terminal directly.
+func TuiPickFromCandidates(ctx context.Context, initialQuery string, r io.Reader) (string, error) {
+	candidates, err := readCandidates(r)
+	if err != nil {
+		return "", err
+	}
+	ctx = withResultsProvider(ctx, candidateResultsProvider{candidates: candidates})
+	// The candidates only have a command, so the other columns and the default filters don't apply to them
+	config := hctx.GetConf(ctx)
+	config.DisplayedColumns = []string{"Command"}
+	config.DefaultFilters = nil
+	ctx = hctx.WithConf(ctx, config)
+	if !isTerminal(os.Stderr) || isDumbTerminal() {
+		return "", fmt.Errorf("hishtory tquery --stdin must be run in a terminal")
+	}
+	return builtinTui{}.Search(ctx, initialQuery)
+}
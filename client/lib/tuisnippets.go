@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func openSnippetPrompt(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	m.isSavingSnippet = true
+	m.statusMessage = ""
+	m.queryInput.Blur()
+	m.snippetNameInput.SetValue("")
+	m.snippetNameInput.Focus()
+	return m, textinput.Blink
+}
+
+func closeSnippetPrompt(m model) model {
+	m.isSavingSnippet = false
+	m.snippetNameInput.Blur()
+	m.queryInput.Focus()
+	return m
+}
+
+// updateWhileSavingSnippet handles key presses while the prompt for the name of the snippet to save the highlighted
+// entry as is open
+func updateWhileSavingSnippet(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "enter":
+		name := strings.TrimSpace(m.snippetNameInput.Value())
+		if name == "" {
+			return closeSnippetPrompt(m), nil
+		}
+		if err := ValidateSnippetName(name); err != nil {
+			m.statusMessage = err.Error()
+			return m, nil
+		}
+		err := SaveSnippet(m.ctx, name, m.tableEntries[m.table.Cursor()].Command)
+		if IsOfflineError(err) {
+			m.isOffline = true
+		} else if err != nil {
+			m.fatalErr = err
+			return m, nil
+		}
+		m.statusMessage = fmt.Sprintf("Saved the snippet %#v, run it with `hishtory snippet run %s`", name, name)
+		return closeSnippetPrompt(m), nil
+	case "esc":
+		return closeSnippetPrompt(m), nil
+	case "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.snippetNameInput, cmd = m.snippetNameInput.Update(msg)
+		return m, cmd
+	}
+}
+
+func snippetPromptView(m model) string {
+	view := fmt.Sprintf("Snippet Name (enter to save, esc to cancel): %s", m.snippetNameInput.View())
+	if m.statusMessage != "" {
+		view += "\n" + m.statusMessage
+	}
+	return view
+}
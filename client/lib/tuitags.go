@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func openTagPrompt(m model) (model, tea.Cmd) {
+	if len(m.tableEntries) == 0 {
+		return m, nil
+	}
+	if !isSearchingHistory(m.ctx) {
+		m.statusMessage = "Only entries in your shell history can be tagged"
+		return m, nil
+	}
+	tags, err := GetEntryTags(m.ctx, *m.tableEntries[m.table.Cursor()])
+	if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	m.isTagging = true
+	m.currentTags = tags
+	m.statusMessage = ""
+	m.queryInput.Blur()
+	m.tagInput.SetValue("")
+	m.tagInput.Focus()
+	return m, textinput.Blink
+}
+
+func closeTagPrompt(m model) model {
+	m.isTagging = false
+	m.currentTags = nil
+	m.tagInput.Blur()
+	m.queryInput.Focus()
+	return m
+}
+
+// updateWhileTagging handles key presses while the tag prompt is open. Entering a tag that the highlighted entry
+// already has removes it, so the prompt toggles tags.
+func updateWhileTagging(m model, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "enter":
+		tag := strings.TrimSpace(m.tagInput.Value())
+		if tag == "" {
+			return closeTagPrompt(m), nil
+		}
+		if err := ValidateTag(tag); err != nil {
+			m.statusMessage = err.Error()
+			return m, nil
+		}
+		entry := *m.tableEntries[m.table.Cursor()]
+		hasTag := false
+		for _, t := range m.currentTags {
+			if t == tag {
+				hasTag = true
+			}
+		}
+		var err error
+		if hasTag {
+			err = UntagEntry(m.ctx, entry, tag)
+			m.statusMessage = fmt.Sprintf("Removed the tag %#v", tag)
+		} else {
+			err = TagEntry(m.ctx, entry, tag)
+			m.statusMessage = fmt.Sprintf("Added the tag %#v", tag)
+		}
+		if IsOfflineError(err) {
+			m.isOffline = true
+		} else if err != nil {
+			m.fatalErr = err
+			return m, nil
+		}
+		m = closeTagPrompt(m)
+		// Re-run the query since the tag may change the displayed columns or whether the entry matches
+		cursor := m.table.Cursor()
+		m = runQueryAndUpdateTable(m, true)
+		m.table.SetCursor(min(cursor, len(m.tableEntries)-1))
+		return m, nil
+	case "esc":
+		return closeTagPrompt(m), nil
+	case "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.tagInput, cmd = m.tagInput.Update(msg)
+		return m, cmd
+	}
+}
+
+func tagPromptView(m model) string {
+	currentTags := "none"
+	if len(m.currentTags) > 0 {
+		currentTags = strings.Join(m.currentTags, ", ")
+	}
+	view := fmt.Sprintf("Tag (enter to add or remove, esc to cancel): %s\nCurrent tags: %s", m.tagInput.View(), currentTags)
+	if m.statusMessage != "" {
+		view += "\n" + m.statusMessage
+	}
+	return view
+}
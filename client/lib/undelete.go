@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// How long entries deleted from the TUI can be restored if ClientConfig.DeletionGracePeriod is unset
+const defaultDeletionGracePeriod = 10 * time.Minute
+
+// A TrashedHistoryEntry is an entry that was deleted from the search TUI and can still be restored
+type TrashedHistoryEntry struct {
+	Id           uint64
+	DeletionTime time.Time
+	Entry        data.HistoryEntry
+}
+
+// GetDeletionGracePeriod returns how long deleted entries can be restored before the deletion is sent to other
+// devices. 0 means that deletions are sent immediately and can't be undone.
+func GetDeletionGracePeriod(config hctx.ClientConfig) time.Duration {
+	if config.DeletionGracePeriod == "" {
+		return defaultDeletionGracePeriod
+	}
+	gracePeriod, err := ParseDeletionGracePeriod(config.DeletionGracePeriod)
+	if err != nil {
+		return defaultDeletionGracePeriod
+	}
+	return gracePeriod
+}
+
+// ParseDeletionGracePeriod parses a deletion grace period like "10m" or "1h", where "0" disables undeleting
+func ParseDeletionGracePeriod(gracePeriod string) (time.Duration, error) {
+	if gracePeriod == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(gracePeriod)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse grace period %#v (expected a duration like 10m or 1h, or 0 to disable undeleting): %w", gracePeriod, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("grace period %#v must not be negative", gracePeriod)
+	}
+	return d, nil
+}
+
+// trashEntry records a deleted entry so that it can be restored during the grace period
+func trashEntry(ctx context.Context, entry data.HistoryEntry) error {
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the deleted entry: %w", err)
+	}
+	return RetryDbWrite(func() error {
+		return hctx.GetDb(ctx).Create(&data.TrashedEntry{DeletionTime: time.Now(), Entry: serialized}).Error
+	})
+}
+
+func parseTrashedEntry(trashed *data.TrashedEntry) (*TrashedHistoryEntry, error) {
+	var entry data.HistoryEntry
+	if err := json.Unmarshal(trashed.Entry, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse the deleted entry with id=%d: %w", trashed.Id, err)
+	}
+	return &TrashedHistoryEntry{Id: trashed.Id, DeletionTime: trashed.DeletionTime, Entry: entry}, nil
+}
+
+// GetTrashedEntries returns the deleted entries that can still be restored, most recently deleted first
+func GetTrashedEntries(ctx context.Context) ([]*TrashedHistoryEntry, error) {
+	var rows []*data.TrashedEntry
+	if err := hctx.GetDb(ctx).Order("id DESC").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to query for deleted entries: %w", err)
+	}
+	entries := make([]*TrashedHistoryEntry, 0, len(rows))
+	for _, row := range rows {
+		entry, err := parseTrashedEntry(row)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// UndeleteEntries restores the given deleted entries. The entries are removed from the trash before they are
+// restored, so that an entry is never both restored and deleted on other devices. Returns the restored entries.
+func UndeleteEntries(ctx context.Context, ids []uint64) ([]*data.HistoryEntry, error) {
+	db := hctx.GetDb(ctx)
+	restored := make([]*data.HistoryEntry, 0, len(ids))
+	for _, id := range ids {
+		var row data.TrashedEntry
+		res := db.Where("id = ?", id).Limit(1).Find(&row)
+		if res.Error != nil {
+			return nil, fmt.Errorf("failed to query for the deleted entry with id=%d: %w", id, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return nil, fmt.Errorf("there is no deleted entry with id=%d, it may have already been restored or its grace period may be over", id)
+		}
+		entry, err := parseTrashedEntry(&row)
+		if err != nil {
+			return nil, err
+		}
+		var numRemoved int64
+		err = RetryDbWrite(func() error {
+			res := db.Where("id = ?", id).Delete(&data.TrashedEntry{})
+			numRemoved = res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return nil, err
+		}
+		if numRemoved == 0 {
+			// The deletion was sent to other devices concurrently
+			continue
+		}
+		AddToDbIfNew(db, entry.Entry)
+		restored = append(restored, &entry.Entry)
+	}
+	if len(restored) > 0 {
+		if err := RecordAuditEvent(ctx, AuditActionUndelete, fmt.Sprintf("restored %d entries deleted from the search TUI", len(restored))); err != nil {
+			return nil, err
+		}
+	}
+	return restored, nil
+}
+
+// UndeleteLatestEntry restores the most recently deleted entry, returning nil if there is nothing to restore
+func UndeleteLatestEntry(ctx context.Context) (*data.HistoryEntry, error) {
+	var row data.TrashedEntry
+	res := hctx.GetDb(ctx).Order("id DESC").Limit(1).Find(&row)
+	if res.Error != nil {
+		return nil, fmt.Errorf("failed to query for deleted entries: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+	restored, err := UndeleteEntries(ctx, []uint64{row.Id})
+	if err != nil || len(restored) == 0 {
+		return nil, err
+	}
+	return restored[0], nil
+}
+
+// PropagateExpiredDeletions sends the deletions whose grace period is over to other devices, after which they can
+// no longer be restored. This is called after commands are saved. Deletions that fail to send since the device is
+// offline are put back in the trash so that they are retried later.
+func PropagateExpiredDeletions(ctx context.Context) error {
+	db := hctx.GetDb(ctx)
+	cutoff := time.Now().Add(-GetDeletionGracePeriod(hctx.GetConf(ctx)))
+	var rows []*data.TrashedEntry
+	if err := db.Where("deletion_time <= ?", cutoff).Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to query for expired deletions: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	// Remove them from the trash first, so that they can't be restored after the deletion has been sent
+	expired := make([]*data.TrashedEntry, 0, len(rows))
+	entries := make([]*data.HistoryEntry, 0, len(rows))
+	for _, row := range rows {
+		entry, err := parseTrashedEntry(row)
+		if err != nil {
+			return err
+		}
+		var numRemoved int64
+		err = RetryDbWrite(func() error {
+			res := db.Where("id = ?", row.Id).Delete(&data.TrashedEntry{})
+			numRemoved = res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return err
+		}
+		if numRemoved > 0 {
+			expired = append(expired, row)
+			entries = append(entries, &entry.Entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	err := DeleteOnRemoteInstances(ctx, entries)
+	if err == nil {
+		return nil
+	}
+	restoreErr := RetryDbWrite(func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range expired {
+				if err := tx.Create(row).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if restoreErr != nil {
+		return fmt.Errorf("failed to send expired deletions (%v), and then failed to retry them later: %w", err, restoreErr)
+	}
+	if IsOfflineError(err) {
+		hctx.GetLogger().Infof("Failed to send %d expired deletions, will retry later: %v", len(entries), err)
+		return nil
+	}
+	return err
+}
+
+// undoDeletion restores the most recently deleted entry in the TUI
+func undoDeletion(m model) (model, tea.Cmd) {
+	if !isSearchingHistory(m.ctx) {
+		m.statusMessage = "Only entries in your shell history can be restored"
+		return m, nil
+	}
+	restored, err := UndeleteLatestEntry(m.ctx)
+	if err != nil {
+		m.fatalErr = err
+		return m, nil
+	}
+	if restored == nil {
+		m.statusMessage = "There are no deleted entries to restore"
+		return m, nil
+	}
+	m.statusMessage = "Restored " + restored.Command
+	m = runQueryAndUpdateTable(m, true)
+	return m, nil
+}
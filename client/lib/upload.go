@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Uploads are split into batches of at most this many entries and bytes (of JSON, before compression), so that
+// uploading a large history doesn't require a single massive request that times out on flaky connections
+const (
+	uploadBatchMaxEntries = 100
+	uploadBatchMaxBytes   = 1024 * 1024
+)
+
+// UploadEntries encrypts and uploads the given entries in bounded batches
+func UploadEntries(ctx context.Context, entries []*data.HistoryEntry) error {
+	return uploadEntriesInBatches(ctx, entries, nil)
+}
+
+// uploadEntriesInBatches encrypts and uploads the given entries in bounded batches, calling afterBatch (if it is
+// non-nil) with the entries in each batch once it has been uploaded. Entries with the same end time are always
+// uploaded in the same batch, so that progress can be tracked by end time.
+func uploadEntriesInBatches(ctx context.Context, entries []*data.HistoryEntry, afterBatch func(batch []*data.HistoryEntry) error) error {
+	config := hctx.GetConf(ctx)
+	if config.ReadOnlyDevice {
+		// Read-only devices never upload their entries
+		return nil
+	}
+	provider, err := GetEncryptionProvider(config)
+	if err != nil {
+		return err
+	}
+	var batch []*data.HistoryEntry
+	var batchJson [][]byte
+	batchSize := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		body := append(append([]byte("["), bytes.Join(batchJson, []byte(","))...), ']')
+		if _, err := ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", body); err != nil {
+			return err
+		}
+		if afterBatch != nil {
+			if err := afterBatch(batch); err != nil {
+				return err
+			}
+		}
+		batch, batchJson, batchSize = nil, nil, 0
+		return nil
+	}
+	for _, entry := range entries {
+		encEntry, err := EncryptHistoryEntry(config, provider, *entry)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt history entry: %w", err)
+		}
+		encEntry.DeviceId = config.DeviceId
+		entryJson, err := json.Marshal(encEntry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal encrypted history entry: %w", err)
+		}
+		isFull := len(batch) >= uploadBatchMaxEntries || batchSize+len(entryJson) > uploadBatchMaxBytes
+		if isFull && !entry.EndTime.Equal(batch[len(batch)-1].EndTime) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, entry)
+		batchJson = append(batchJson, entryJson)
+		batchSize += len(entryJson) + 1
+	}
+	return flush()
+}
+
+// Reupload uploads every local entry, e.g. after the server lost data. Like the upload after the initial import, this
+// resumes where it left off if it is interrupted.
+func Reupload(ctx context.Context) error {
+	if hctx.GetConf(ctx).IsOffline {
+		return nil
+	}
+	if hctx.GetConf(ctx).ReadOnlyDevice {
+		return fmt.Errorf("this is a read-only device, so its entries can't be uploaded (see `hishtory config-set read-only-device`)")
+	}
+	if err := hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.BootstrapUpload = &hctx.BootstrapUploadProgress{}
+	}); err != nil {
+		return fmt.Errorf("failed to start the upload: %w", err)
+	}
+	return ResumeBootstrapUpload(ctx)
+}
+
+// ResumeBootstrapUpload continues uploading all local entries (e.g. after the initial import), if an upload is in
+// progress. Entries are uploaded oldest first, and the end time of the last uploaded entry is persisted in the config
+// after every batch, so that an interrupted upload resumes from there rather than starting over.
+func ResumeBootstrapUpload(ctx context.Context) error {
+	// The upload's progress is read from disk rather than the context, since it may have been updated since the
+	// context was made
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return err
+	}
+	if config.BootstrapUpload == nil || hctx.GetConf(ctx).IsOffline {
+		return nil
+	}
+	if hctx.GetConf(ctx).ReadOnlyDevice {
+		// The device was made read-only during the upload, so it is abandoned
+		return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			config.BootstrapUpload = nil
+		})
+	}
+	uploadedThrough := config.BootstrapUpload.UploadedThrough
+	entries, err := Search(ctx, hctx.GetDb(ctx), "", 0)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the entries to upload: %w", err)
+	}
+	// Entries are sorted and filtered in Go rather than in SQL, since sqlite compares timestamps as strings which
+	// doesn't work for timestamps with different UTC offsets
+	var remaining []*data.HistoryEntry
+	for _, entry := range entries {
+		if entry.EndTime.After(uploadedThrough) {
+			remaining = append(remaining, entry)
+		}
+	}
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].EndTime.Before(remaining[j].EndTime)
+	})
+	if len(remaining) > 0 {
+		hctx.GetLogger().Infof("Uploading %d history entries (%d were already uploaded)", len(remaining), config.BootstrapUpload.NumUploaded)
+	}
+	err = uploadEntriesInBatches(ctx, remaining, func(batch []*data.HistoryEntry) error {
+		return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+			if config.BootstrapUpload != nil {
+				config.BootstrapUpload.UploadedThrough = batch[len(batch)-1].EndTime
+				config.BootstrapUpload.NumUploaded += len(batch)
+			}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload history entries (the upload will resume where it left off): %w", err)
+	}
+	return hctx.UpdateConfig(func(config *hctx.ClientConfig) {
+		config.BootstrapUpload = nil
+	})
+}
+
+// MaybeResumeBootstrapUpload resumes an interrupted upload, if there is one. Failures from being offline are
+// ignored, since the upload will be resumed again later.
+func MaybeResumeBootstrapUpload(ctx context.Context) error {
+	err := ResumeBootstrapUpload(ctx)
+	if IsOfflineError(err) {
+		hctx.GetLogger().Infof("Failed to resume uploading history entries because the server is unreachable: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The weights given to a run or a selection of a command depending on how long ago it happened, like in Firefox's
+// frecency algorithm. Anything older than the last bucket has a weight of frecencyMinWeight.
+var frecencyBuckets = []struct {
+	maxAge time.Duration
+	weight float64
+}{
+	{4 * 24 * time.Hour, 4},
+	{14 * 24 * time.Hour, 2},
+	{90 * 24 * time.Hour, 1},
+}
+
+const frecencyMinWeight = 0.5
+
+// RecordEntryUsage records that entry was selected from a search to be run again, which is used for sorting by
+// frecency and for the most reused commands in `hishtory stats`. Usages are only stored locally.
+func RecordEntryUsage(ctx context.Context, entry data.HistoryEntry) error {
+	db := hctx.GetDb(ctx)
+	err := RetryDbWrite(func() error {
+		// The command is copied from the DB since the TUI escapes the newlines in the commands that it displays
+		return db.Exec("INSERT INTO entry_usages (device_id, end_time, command, used_time) SELECT device_id, end_time, command, ? FROM history_entries WHERE device_id = ? AND end_time = ?",
+			time.Now().UTC(), entry.DeviceId, entry.EndTime).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record the usage of the entry: %w", err)
+	}
+	return nil
+}
+
+// recordSelectedEntryUsage records the usage of the entry that was selected in the TUI, if any. Failing to record
+// it only makes the frecency ranking slightly less accurate, so it is logged rather than returned.
+func recordSelectedEntryUsage(ctx context.Context, m model) {
+	if m.selected == NotSelected || len(m.tableEntries) == 0 || !isSearchingHistory(ctx) {
+		return
+	}
+	if err := RecordEntryUsage(ctx, *m.tableEntries[m.table.Cursor()]); err != nil {
+		hctx.GetLogger().Warnf("%v", err)
+	}
+}
+
+// frecencyWeightSql returns the SQL expression for the weight of the time in column, relative to now
+func frecencyWeightSql(column string, now time.Time) string {
+	age := fmt.Sprintf("(%d - CAST(strftime('%%s', %s) AS INTEGER))", now.Unix(), column)
+	var sb strings.Builder
+	sb.WriteString("(CASE")
+	for _, bucket := range frecencyBuckets {
+		sb.WriteString(fmt.Sprintf(" WHEN %s < %d THEN %v", age, int64(bucket.maxAge.Seconds()), bucket.weight))
+	}
+	sb.WriteString(fmt.Sprintf(" ELSE %v END)", frecencyMinWeight))
+	return sb.String()
+}
+
+// frecencyScoreSql returns the SQL expression for the frecency score of an entry. An entry scores for how recently
+// it was run (counting each of its hits, see CollapseDuplicateEntries), plus for every time that its command was
+// selected from a search.
+func frecencyScoreSql(now time.Time) string {
+	return fmt.Sprintf("(%s * MAX(COALESCE(hit_count, 0), 1) + COALESCE((SELECT SUM(%s) FROM entry_usages WHERE entry_usages.command = history_entries.command), 0))",
+		frecencyWeightSql("history_entries.end_time", now), frecencyWeightSql("entry_usages.used_time", now))
+}
+
+// getTuiOrder returns the order that results are displayed in the TUI, with pinned entries before all other
+// matching entries
+func getTuiOrder(config hctx.ClientConfig, now time.Time) string {
+	if !config.SortByFrecency {
+		return pinnedFirstOrder
+	}
+	return "COALESCE(pinned, 0) DESC, " + frecencyScoreSql(now) + " DESC, end_time DESC"
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+)
+
+// The fields of history entries that can be stored unencrypted on the server, see ClientConfig.ServerVisibleFields.
+// The command itself (and everything not listed here) is always encrypted.
+const (
+	VisibleFieldStartTime = "start_time"
+	VisibleFieldDeviceId  = "device_id"
+	VisibleFieldHostname  = "hostname"
+	VisibleFieldExitCode  = "exit_code"
+)
+
+var VisibleFields = []string{VisibleFieldStartTime, VisibleFieldDeviceId, VisibleFieldHostname, VisibleFieldExitCode}
+
+func ValidateServerVisibleFields(fields []string) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if !containsString(VisibleFields, field) {
+			return fmt.Errorf("%#v can't be stored unencrypted, expected one of %s", field, strings.Join(VisibleFields, ", "))
+		}
+		if seen[field] {
+			return fmt.Errorf("field %#v is listed more than once", field)
+		}
+		seen[field] = true
+	}
+	return nil
+}
+
+// EncryptHistoryEntry encrypts entry for uploading with the given provider, and also stores the fields that the user
+// opted in to making server-visible unencrypted
+func EncryptHistoryEntry(config hctx.ClientConfig, provider data.EncryptionProvider, entry data.HistoryEntry) (shared.EncHistoryEntry, error) {
+	encEntry, err := data.EncryptHistoryEntryWithProvider(provider, config.UserSecret, entry)
+	if err != nil {
+		return shared.EncHistoryEntry{}, err
+	}
+	for _, field := range config.ServerVisibleFields {
+		switch field {
+		case VisibleFieldStartTime:
+			startTime := entry.StartTime
+			encEntry.StartTime = &startTime
+		case VisibleFieldDeviceId:
+			deviceId := entry.DeviceId
+			encEntry.SourceDeviceId = &deviceId
+		case VisibleFieldHostname:
+			hostname := entry.Hostname
+			encEntry.Hostname = &hostname
+		case VisibleFieldExitCode:
+			exitCode := entry.ExitCode
+			encEntry.ExitCode = &exitCode
+		}
+	}
+	return encEntry, nil
+}
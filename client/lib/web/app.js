@@ -0,0 +1,253 @@
+"use strict";
+
+// The token for the local API is passed in the URL fragment by `hishtory web` so that it is never sent to the
+// server in a URL. It is then kept in sessionStorage and removed from the address bar.
+const tokenMatch = location.hash.match(/token=([^&]+)/);
+if (tokenMatch) {
+  sessionStorage.setItem("hishtory-token", decodeURIComponent(tokenMatch[1]));
+  history.replaceState(null, "", location.pathname + "#search");
+}
+const token = sessionStorage.getItem("hishtory-token");
+
+const PAGE_SIZE = 50;
+const DAYS_OF_WEEK = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function showError(message) {
+  $("error").textContent = message;
+  $("error").hidden = !message;
+}
+
+async function api(path, options = {}) {
+  const resp = await fetch(path, {
+    ...options,
+    headers: {
+      "Authorization": "Bearer " + token,
+      "Content-Type": "application/vnd.api+json",
+    },
+  });
+  const doc = await resp.json();
+  if (!resp.ok) {
+    const err = (doc.errors || [])[0] || {};
+    throw new Error((err.title || resp.statusText) + (err.detail ? ": " + err.detail : ""));
+  }
+  showError("");
+  return doc;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function formatRuntime(seconds) {
+  if (seconds < 60) {
+    return seconds.toFixed(seconds < 10 ? 1 : 0) + "s";
+  }
+  if (seconds < 3600) {
+    return Math.floor(seconds / 60) + "m" + Math.round(seconds % 60) + "s";
+  }
+  return Math.floor(seconds / 3600) + "h" + Math.round((seconds % 3600) / 60) + "m";
+}
+
+// Search
+
+let searchPage = 1;
+
+async function loadSearch() {
+  const params = new URLSearchParams({
+    "filter[query]": $("search-query").value,
+    "fields[entries]": "hostname,cwd,end_time,runtime_seconds,exit_code,command",
+    "page[size]": PAGE_SIZE,
+    "page[number]": searchPage,
+  });
+  const doc = await api("api/v1/entries?" + params);
+  const tbody = $("search-results");
+  tbody.replaceChildren();
+  for (const entry of doc.data) {
+    const a = entry.attributes;
+    const row = tbody.insertRow();
+    if (a.exit_code !== 0) {
+      row.className = "failed";
+    }
+    cell(row, a.hostname);
+    cell(row, a.cwd);
+    cell(row, new Date(a.end_time).toLocaleString());
+    cell(row, formatRuntime(a.runtime_seconds));
+    cell(row, a.exit_code, "exit-code");
+    cell(row, a.command, "command");
+  }
+  const total = doc.meta.total;
+  const first = total === 0 ? 0 : (searchPage - 1) * PAGE_SIZE + 1;
+  $("search-summary").textContent = `${first}-${first + doc.data.length - (total === 0 ? 0 : 1)} of ${total}`;
+  $("search-prev").disabled = !doc.links.prev;
+  $("search-next").disabled = !doc.links.next;
+}
+
+let searchDebounce;
+$("search-query").addEventListener("input", () => {
+  clearTimeout(searchDebounce);
+  searchDebounce = setTimeout(() => {
+    searchPage = 1;
+    loadSearch().catch((e) => showError(e.message));
+  }, 150);
+});
+$("search-form").addEventListener("submit", (e) => e.preventDefault());
+$("search-prev").addEventListener("click", () => {
+  searchPage--;
+  loadSearch().catch((e) => showError(e.message));
+});
+$("search-next").addEventListener("click", () => {
+  searchPage++;
+  loadSearch().catch((e) => showError(e.message));
+});
+
+// Stats
+
+function renderChart(id, rows) {
+  const max = Math.max(1, ...rows.map((r) => r.value));
+  const chart = $(id);
+  chart.replaceChildren();
+  for (const r of rows) {
+    const row = document.createElement("div");
+    row.className = "row";
+    const label = document.createElement("span");
+    label.className = "label";
+    label.textContent = r.label;
+    label.title = r.label;
+    const track = document.createElement("div");
+    const bar = document.createElement("div");
+    bar.className = "bar";
+    bar.style.width = (100 * r.value / max) + "%";
+    track.appendChild(bar);
+    const value = document.createElement("span");
+    value.textContent = r.display !== undefined ? r.display : r.value;
+    row.append(label, track, value);
+    chart.appendChild(row);
+  }
+}
+
+async function loadStats() {
+  const params = new URLSearchParams({ "filter[query]": $("stats-query").value });
+  const stats = (await api("api/v1/stats?" + params)).data.attributes;
+  $("stats-total").textContent = `${stats.total_count} matching commands`;
+  renderChart("chart-top-commands", stats.top_commands.map((c) => ({ label: c.command, value: c.count })));
+  renderChart("chart-prefixes", stats.by_prefix.map((p) => ({
+    label: p.prefix,
+    value: p.failure_rate,
+    display: Math.round(100 * p.failure_rate) + "%",
+  })));
+  renderChart("chart-hours", stats.by_hour_of_day.map((b) => ({ label: String(b.bucket).padStart(2, "0") + ":00", value: b.count })));
+  renderChart("chart-days", stats.by_day_of_week.map((b) => ({ label: DAYS_OF_WEEK[b.bucket], value: b.count })));
+  renderChart("chart-hosts", stats.by_host.map((h) => ({ label: h.hostname, value: h.count })));
+}
+
+$("stats-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  loadStats().catch((e) => showError(e.message));
+});
+
+// Devices
+
+async function loadDevices() {
+  const doc = await api("api/v1/devices");
+  const tbody = $("device-list");
+  tbody.replaceChildren();
+  for (const device of doc.data) {
+    const a = device.attributes;
+    const row = tbody.insertRow();
+    cell(row, a.device_id + (a.is_this_device ? " (this device)" : ""));
+    cell(row, a.hostname);
+    cell(row, new Date(a.first_seen).toLocaleString());
+    cell(row, new Date(a.last_seen).toLocaleString());
+    cell(row, a.count);
+  }
+}
+
+$("merge-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  try {
+    const doc = await api("api/v1/hostname-merges", {
+      method: "POST",
+      body: JSON.stringify({
+        data: {
+          type: "hostname-merges",
+          attributes: { old_hostname: $("merge-old").value, new_hostname: $("merge-new").value },
+        },
+      }),
+    });
+    $("merge-result").textContent = `Updated ${doc.data.attributes.num_updated} entries`;
+    await loadDevices();
+  } catch (err) {
+    showError(err.message);
+  }
+});
+
+// Settings
+
+const settingsForm = $("settings-form");
+
+async function loadSettings() {
+  const settings = (await api("api/v1/settings")).data.attributes;
+  for (const input of settingsForm.querySelectorAll("input")) {
+    const value = settings[input.name];
+    if (input.type === "checkbox") {
+      input.checked = !!value;
+    } else if (Array.isArray(value)) {
+      input.value = value.join(", ");
+    } else {
+      input.value = value || "";
+    }
+  }
+}
+
+settingsForm.addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const attributes = {};
+  for (const input of settingsForm.querySelectorAll("input")) {
+    if (input.type === "checkbox") {
+      attributes[input.name] = input.checked;
+    } else if (input.name === "displayed_columns") {
+      attributes[input.name] = input.value.split(",").map((c) => c.trim()).filter((c) => c);
+    } else {
+      attributes[input.name] = input.value;
+    }
+  }
+  try {
+    await api("api/v1/settings", {
+      method: "PATCH",
+      body: JSON.stringify({ data: { type: "settings", id: "current", attributes } }),
+    });
+    $("settings-result").textContent = "Saved";
+    await loadSettings();
+  } catch (err) {
+    showError(err.message);
+  }
+});
+
+// Navigation
+
+const loaders = { search: loadSearch, stats: loadStats, devices: loadDevices, settings: loadSettings };
+
+function showTab() {
+  const tab = loaders[location.hash.slice(1)] ? location.hash.slice(1) : "search";
+  for (const name of Object.keys(loaders)) {
+    $(name).hidden = name !== tab;
+    document.querySelector(`nav a[data-tab="${name}"]`).classList.toggle("active", name === tab);
+  }
+  if (!token) {
+    showError("Missing API token, please re-open this page via `hishtory web`");
+    return;
+  }
+  loaders[tab]().catch((e) => showError(e.message));
+}
+
+window.addEventListener("hashchange", showTab);
+showTab();
@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+// NewWebUiHandler serves the embedded web UI along with the local API that it is built on. The static assets
+// don't contain any history and so are served without authentication, while the API still requires the token.
+func NewWebUiHandler(ctx context.Context, token string) (http.Handler, error) {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", NewLocalApiHandler(ctx, token))
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	return mux, nil
+}
@@ -29,6 +29,8 @@ type Model struct {
 	hcol    int
 	hstep   int
 	hcursor int
+
+	highlightTerms []string
 }
 
 // Row represents one line in the table.
@@ -105,9 +107,10 @@ func DefaultKeyMap() KeyMap {
 // Styles contains style definitions for this list component. By default, these
 // values are generated by DefaultStyles.
 type Styles struct {
-	Header   lipgloss.Style
-	Cell     lipgloss.Style
-	Selected lipgloss.Style
+	Header    lipgloss.Style
+	Cell      lipgloss.Style
+	Selected  lipgloss.Style
+	Highlight lipgloss.Style
 }
 
 // DefaultStyles returns a set of default style definitions for this table.
@@ -304,6 +307,13 @@ func (m *Model) SetRows(r []Row) {
 	m.UpdateViewport()
 }
 
+// SetHighlightTerms sets the terms that are highlighted (case-insensitively)
+// via the Highlight style when they appear in a cell.
+func (m *Model) SetHighlightTerms(terms []string) {
+	m.highlightTerms = terms
+	m.UpdateViewport()
+}
+
 // SetColumns set a new columns state.
 func (m *Model) SetColumns(c []Column) {
 	m.cols = c
@@ -448,12 +458,13 @@ func (m *Model) renderRow(rowID int) string {
 	var s = make([]string, 0, len(m.cols))
 	for i, value := range m.rows[rowID] {
 		style := lipgloss.NewStyle().Width(m.cols[i].Width).MaxWidth(m.cols[i].Width).Inline(true)
-		var renderedCell string
+		var truncatedValue string
 		if i == m.ColIndex(m.hcol) && m.hcursor > 0 {
-			renderedCell = m.styles.Cell.Render(style.Render(runewidth.Truncate(runewidth.TruncateLeft(value, m.hcursor, "…"), m.cols[i].Width, "…")))
+			truncatedValue = runewidth.Truncate(runewidth.TruncateLeft(value, m.hcursor, "…"), m.cols[i].Width, "…")
 		} else {
-			renderedCell = m.styles.Cell.Render(style.Render(runewidth.Truncate(value, m.cols[i].Width, "…")))
+			truncatedValue = runewidth.Truncate(value, m.cols[i].Width, "…")
 		}
+		renderedCell := m.styles.Cell.Render(style.Render(m.highlightMatches(truncatedValue)))
 		s = append(s, renderedCell)
 	}
 
@@ -466,6 +477,52 @@ func (m *Model) renderRow(rowID int) string {
 	return row
 }
 
+func (m *Model) highlightMatches(value string) string {
+	if len(m.highlightTerms) == 0 {
+		return value
+	}
+	lowerValue := strings.ToLower(value)
+	if len(lowerValue) != len(value) {
+		// Lowercasing changed the byte offsets, so matches can't be mapped back onto the original value
+		return value
+	}
+	isMatched := make([]bool, len(value))
+	foundMatch := false
+	for _, term := range m.highlightTerms {
+		term = strings.ToLower(term)
+		if term == "" {
+			continue
+		}
+		for start := 0; start < len(lowerValue); {
+			idx := strings.Index(lowerValue[start:], term)
+			if idx < 0 {
+				break
+			}
+			for j := start + idx; j < start+idx+len(term); j++ {
+				isMatched[j] = true
+			}
+			foundMatch = true
+			start += idx + len(term)
+		}
+	}
+	if !foundMatch {
+		return value
+	}
+	var sb strings.Builder
+	segmentStart := 0
+	for j := 1; j <= len(value); j++ {
+		if j == len(value) || isMatched[j] != isMatched[segmentStart] {
+			if isMatched[segmentStart] {
+				sb.WriteString(m.styles.Highlight.Render(value[segmentStart:j]))
+			} else {
+				sb.WriteString(value[segmentStart:j])
+			}
+			segmentStart = j
+		}
+	}
+	return sb.String()
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
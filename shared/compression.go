@@ -0,0 +1,40 @@
+package shared
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Clients and the server send the version of the sync protocol that they support in this header, so that clients
+// only use features that the server supports
+const ProtocolVersionHeader = "X-Hishtory-Protocol-Version"
+
+// The current version of the sync protocol. Version 2 added zstd compressed request bodies (`Content-Encoding: zstd`).
+// Compressed responses don't need a protocol version since they are negotiated via `Accept-Encoding`.
+const ProtocolVersion = 2
+
+// The first protocol version that supports zstd compressed request bodies
+const ProtocolVersionCompression = 2
+
+// The encoder is safe for concurrent use via EncodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// CompressZstd compresses data with zstd
+func CompressZstd(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+}
+
+// DecompressZstd decompresses zstd compressed data, failing if it would decompress to more than maxSize bytes
+func DecompressZstd(data []byte, maxSize uint64) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxSize), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a zstd decoder: %w", err)
+	}
+	defer decoder.Close()
+	decompressed, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return decompressed, nil
+}
@@ -15,6 +15,17 @@ type EncHistoryEntry struct {
 	Date          time.Time `json:"time"`
 	EncryptedId   string    `json:"id"`
 	ReadCount     int       `json:"read_count"`
+	// Copies of fields of the entry that the user chose to store unencrypted so that the server can filter on them
+	// (see the server_visible_fields config). Each is nil unless the user opted in to it. The encrypted data always
+	// contains the whole entry, and is all that clients read, so the server can't tamper with these.
+	StartTime      *time.Time `json:"start_time,omitempty"`
+	SourceDeviceId *string    `json:"source_device_id,omitempty"`
+	Hostname       *string    `json:"hostname,omitempty"`
+	ExitCode       *int       `json:"exit_code,omitempty"`
+	// Only used by the server when it is configured to store the encrypted data in object storage, in which case
+	// EncryptedData and Nonce are empty in the DB and are instead stored in the blob with this key
+	BlobKey  string `json:"-"`
+	BlobSize int    `json:"-"`
 }
 
 /*
@@ -33,6 +44,8 @@ type Device struct {
 	// david@daviddworken.com and I can clear it from your device entries.
 	RegistrationIp   string    `json:"registration_ip"`
 	RegistrationDate time.Time `json:"registration_date"`
+	// Whether the device only downloads history, in which case uploads from it are rejected
+	ReadOnly bool `json:"read_only"`
 }
 
 type DumpRequest struct {
@@ -57,6 +70,19 @@ type UpdateInfo struct {
 	Version                   string `json:"version"`
 }
 
+// The amount of storage used on the backend by a single user
+type StorageUsage struct {
+	NumEntries int64 `json:"num_entries"`
+	NumBytes   int64 `json:"num_bytes"`
+}
+
+// What was deleted from the backend when a user deleted their account
+type AccountDeletion struct {
+	NumEntries int64 `json:"num_entries"`
+	NumDevices int64 `json:"num_devices"`
+	NumShares  int64 `json:"num_shares"`
+}
+
 type DeletionRequest struct {
 	UserId              string             `json:"user_id"`
 	DestinationDeviceId string             `json:"destination_device_id"`
@@ -65,6 +91,47 @@ type DeletionRequest struct {
 	ReadCount           int                `json:"read_count"`
 }
 
+// EncMetadataUpdate is an encrypted update to the metadata of history entries (e.g. adding a tag to an entry) that
+// is stored once per destination device, like DeletionRequest.
+type EncMetadataUpdate struct {
+	EncryptedData       []byte    `json:"enc_data"`
+	Nonce               []byte    `json:"nonce"`
+	UserId              string    `json:"user_id"`
+	DestinationDeviceId string    `json:"destination_device_id"`
+	SendTime            time.Time `json:"send_time"`
+	ReadCount           int       `json:"read_count"`
+}
+
+// Share is a set of history entries that a user shared with other users via `hishtory share`. Anyone who knows the
+// share ID can read its entries (which are encrypted with a key that only the owner and the users they shared it with
+// know), but only the owner can replace or revoke them.
+type Share struct {
+	ShareId      string    `json:"share_id" gorm:"primaryKey"`
+	OwnerUserId  string    `json:"owner_user_id" gorm:"not null"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// EncSharedEntry is a history entry in a Share, encrypted with a key derived from the share's read key rather than
+// with the owner's user secret
+type EncSharedEntry struct {
+	ShareId       string    `json:"share_id" gorm:"index:shared_entry_index"`
+	EncryptedData []byte    `json:"enc_data"`
+	Nonce         []byte    `json:"nonce"`
+	Date          time.Time `json:"time"`
+}
+
+// EncChannelEntry is a history entry published to a team channel via `hishtory channel`. It is encrypted with the
+// channel's team key, which everyone in the team has, so any of them can publish to the channel and read from it.
+type EncChannelEntry struct {
+	// Assigned by the server in the order that entries are published, so that clients can fetch only the entries
+	// published since they last synced
+	Id            uint64    `json:"id" gorm:"primaryKey"`
+	ChannelId     string    `json:"channel_id" gorm:"index:channel_entry_index"`
+	EncryptedData []byte    `json:"enc_data"`
+	Nonce         []byte    `json:"nonce"`
+	Date          time.Time `json:"time"`
+}
+
 type MessageIdentifiers struct {
 	Ids []MessageIdentifier `json:"message_ids"`
 }
@@ -93,7 +160,7 @@ func (m MessageIdentifiers) Value() (driver.Value, error) {
 type Feedback struct {
 	UserId   string    `json:"user_id" gorm:"not null"`
 	Date     time.Time `json:"date" gorm:"not null"`
-	Feedback string    `json:"feedback"`
+	Feedback string    `json:"feedback" gorm:"type:text"`
 }
 
 func Chunks[k any](slice []k, chunkSize int) [][]k {
@@ -51,16 +51,19 @@ func ResetLocalState(t *testing.T) {
 	Check(t, err)
 	persistLog()
 	_ = BackupAndRestoreWithId(t, "-reset-local-state")
-	_ = os.RemoveAll(path.Join(homedir, data.GetHishtoryPath()))
+	_ = os.RemoveAll(data.GetHishtoryDir(homedir))
+	_ = os.RemoveAll(data.GetHishtoryConfigDir(homedir))
 }
 
 func BackupAndRestore(t *testing.T) func() {
 	return BackupAndRestoreWithId(t, "")
 }
 
-func getBackPath(file, id string) string {
-	if strings.Contains(file, "/"+data.GetHishtoryPath()+"/") {
-		return strings.Replace(file, data.GetHishtoryPath(), data.GetHishtoryPath()+".test", 1) + id
+func getBackPath(homedir, file, id string) string {
+	for _, dir := range []string{data.GetHishtoryDir(homedir), data.GetHishtoryConfigDir(homedir)} {
+		if strings.HasPrefix(file, dir+"/") {
+			return dir + ".test" + strings.TrimPrefix(file, dir) + id
+		}
 	}
 	return file + ".bak" + id
 }
@@ -71,24 +74,26 @@ func BackupAndRestoreWithId(t *testing.T, id string) func() {
 	Check(t, err)
 	initialWd, err := os.Getwd()
 	Check(t, err)
-	Check(t, os.MkdirAll(path.Join(homedir, data.GetHishtoryPath()+".test"), os.ModePerm))
+	Check(t, os.MkdirAll(data.GetHishtoryDir(homedir)+".test", os.ModePerm))
+	Check(t, os.MkdirAll(data.GetHishtoryConfigDir(homedir)+".test", os.ModePerm))
 
 	renameFiles := []string{
-		path.Join(homedir, data.GetHishtoryPath(), data.DB_PATH),
-		path.Join(homedir, data.GetHishtoryPath(), DB_WAL_PATH),
-		path.Join(homedir, data.GetHishtoryPath(), DB_SHM_PATH),
-		path.Join(homedir, data.GetHishtoryPath(), data.CONFIG_PATH),
-		path.Join(homedir, data.GetHishtoryPath(), "hishtory"),
-		path.Join(homedir, data.GetHishtoryPath(), "config.sh"),
-		path.Join(homedir, data.GetHishtoryPath(), "config.zsh"),
-		path.Join(homedir, data.GetHishtoryPath(), "config.fish"),
+		path.Join(data.GetHishtoryDir(homedir), data.DB_PATH),
+		path.Join(data.GetHishtoryDir(homedir), DB_WAL_PATH),
+		path.Join(data.GetHishtoryDir(homedir), DB_SHM_PATH),
+		path.Join(data.GetHishtoryDir(homedir), data.COLD_DB_PATH),
+		path.Join(data.GetHishtoryConfigDir(homedir), data.CONFIG_PATH),
+		path.Join(data.GetHishtoryDir(homedir), "hishtory"),
+		path.Join(data.GetHishtoryDir(homedir), "config.sh"),
+		path.Join(data.GetHishtoryDir(homedir), "config.zsh"),
+		path.Join(data.GetHishtoryDir(homedir), "config.fish"),
 		path.Join(homedir, ".bash_history"),
 		path.Join(homedir, ".zsh_history"),
 		path.Join(homedir, ".local/share/fish/fish_history"),
 	}
 	for _, file := range renameFiles {
 		touchFile(file)
-		Check(t, os.Rename(file, getBackPath(file, id)))
+		Check(t, os.Rename(file, getBackPath(homedir, file, id)))
 	}
 	copyFiles := []string{
 		path.Join(homedir, ".zshrc"),
@@ -97,7 +102,7 @@ func BackupAndRestoreWithId(t *testing.T, id string) func() {
 	}
 	for _, file := range copyFiles {
 		touchFile(file)
-		Check(t, copy(file, getBackPath(file, id)))
+		Check(t, copy(file, getBackPath(homedir, file, id)))
 	}
 	configureZshrc(homedir)
 	touchFile(path.Join(homedir, ".bash_history"))
@@ -110,13 +115,14 @@ func BackupAndRestoreWithId(t *testing.T, id string) func() {
 			t.Fatalf("failed to execute killall hishtory, stdout=%#v: %v", string(stdout), err)
 		}
 		persistLog()
-		Check(t, os.RemoveAll(path.Join(homedir, data.GetHishtoryPath())))
-		Check(t, os.MkdirAll(path.Join(homedir, data.GetHishtoryPath()), os.ModePerm))
+		Check(t, os.RemoveAll(data.GetHishtoryDir(homedir)))
+		Check(t, os.MkdirAll(data.GetHishtoryDir(homedir), os.ModePerm))
+		Check(t, os.MkdirAll(data.GetHishtoryConfigDir(homedir), os.ModePerm))
 		for _, file := range renameFiles {
-			checkError(os.Rename(getBackPath(file, id), file))
+			checkError(os.Rename(getBackPath(homedir, file, id), file))
 		}
 		for _, file := range copyFiles {
-			checkError(copy(getBackPath(file, id), file))
+			checkError(copy(getBackPath(homedir, file, id), file))
 		}
 		checkError(os.Chdir(initialWd))
 	}
@@ -217,7 +223,7 @@ func buildServer() string {
 	f, err := os.CreateTemp("", "server")
 	checkError(err)
 	fn := f.Name()
-	cmd := exec.Command("go", "build", "-o", fn, "-ldflags", fmt.Sprintf("-X main.ReleaseVersion=v0.%s", version), "backend/server/server.go")
+	cmd := exec.Command("go", "build", "-o", fn, "-ldflags", fmt.Sprintf("-X main.ReleaseVersion=v0.%s", version), "./backend/server")
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
 	var stderr bytes.Buffer
@@ -324,7 +330,7 @@ func TestLog(t *testing.T, line string) {
 func persistLog() {
 	homedir, err := os.UserHomeDir()
 	checkError(err)
-	fp := path.Join(homedir, data.GetHishtoryPath(), "hishtory.log")
+	fp := path.Join(data.GetHishtoryDir(homedir), "hishtory.log")
 	log, err := os.ReadFile(fp)
 	if err != nil {
 		return